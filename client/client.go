@@ -0,0 +1,221 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package client is the API for programs that read and write the reviews in
+// a git repo, on which the git-appraise commands are also built.
+//
+// Every method takes a context, and any git commands that it runs are killed
+// once that is done. Errors about the state of a review are an *Error, which
+// matches one of the sentinel errors, such as ErrNotFound, with errors.Is.
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// Client reads and writes the reviews in a repo.
+type Client struct {
+	repo repository.Repo
+}
+
+// Option is an option for opening a repo.
+type Option func(*options)
+
+type options struct {
+	namespaces  []string
+	reviewStore string
+}
+
+// WithNamespaces uses the given review namespaces, in which reviews are
+// written to the first, and read from all of them. By default, these are
+// the namespaces in the repository.NamespaceEnv environment variable, or
+// else those configured for the repo.
+func WithNamespaces(namespaces ...string) Option {
+	return func(o *options) {
+		o.namespaces = namespaces
+	}
+}
+
+// WithReviewStore stores the reviews in the separate git repo at the given
+// path, rather than in the one configured by repository.ReviewStoreKey, if
+// any.
+func WithReviewStore(path string) Option {
+	return func(o *options) {
+		o.reviewStore = path
+	}
+}
+
+// Open returns a client for the git repo that contains the given path.
+func Open(ctx context.Context, path string, opts ...Option) (*Client, error) {
+	repo, err := open(ctx, path, opts...)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(repository.WithContext(context.Background(), repo)), nil
+}
+
+// open opens the repo at the given path, while bound to the given context.
+func open(ctx context.Context, path string, opts ...Option) (repository.Repo, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	gitRepo, err := repository.NewGitRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	// The repo is only bound to ctx while it is opened.
+	gitRepo = gitRepo.WithContext(ctx)
+	var repo repository.Repo = gitRepo
+	if o.reviewStore != "" {
+		store, err := repository.NewGitRepo(o.reviewStore)
+		if err != nil {
+			return nil, fmt.Errorf("failure opening the review store %q: %v", o.reviewStore, err)
+		}
+		repo = repository.NewSidecarRepo(gitRepo, store)
+	} else if repo, err = repository.OpenReviewStore(gitRepo); err != nil {
+		return nil, err
+	}
+	namespaces := os.Getenv(repository.NamespaceEnv)
+	if o.namespaces != nil {
+		namespaces = strings.Join(o.namespaces, ",")
+	}
+	return repository.OpenNamespace(repo, namespaces)
+}
+
+// New returns a client for a repo that is already open.
+func New(repo repository.Repo) *Client {
+	return &Client{repo: repo}
+}
+
+// Repo returns the repo of the client.
+func (c *Client) Repo() repository.Repo {
+	return c.repo
+}
+
+// bind returns the repo bound to the given context, unless that is already
+// done.
+func (c *Client) bind(ctx context.Context) (repository.Repo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return repository.WithContext(ctx, c.repo), nil
+}
+
+// List returns the summaries of all of the reviews, with the newest first.
+func (c *Client) List(ctx context.Context) ([]review.Summary, error) {
+	repo, err := c.bind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := review.List(repo)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return summaries, err
+}
+
+// ListOpen returns the summaries of the reviews that are neither submitted
+// nor abandoned, with the newest first.
+func (c *Client) ListOpen(ctx context.Context) ([]review.Summary, error) {
+	summaries, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var open []review.Summary
+	for _, summary := range summaries {
+		if summary.IsOpen() {
+			open = append(open, summary)
+		}
+	}
+	return open, nil
+}
+
+// Get returns the review with the given revision, or the open review of the
+// current branch if the revision is empty.
+func (c *Client) Get(ctx context.Context, revision string) (*review.Review, error) {
+	repo, err := c.bind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var r *review.Review
+	if revision == "" {
+		r, err = current(repo)
+	} else {
+		r, err = get(repo, revision)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return r, err
+}
+
+func get(repo repository.Repo, revision string) (*review.Review, error) {
+	if err := repo.VerifyCommit(revision); err != nil {
+		return nil, &Error{
+			Kind:     ErrNotFound,
+			Revision: revision,
+			Message:  fmt.Sprintf("There is no matching review, as %q is not a commit.", revision),
+			Err:      err,
+		}
+	}
+	if len(request.ParseAllValid(repo.GetNotes(request.Ref, revision))) == 0 {
+		return nil, &Error{Kind: ErrNotFound, Revision: revision, Message: "There is no matching review."}
+	}
+	r, err := review.Get(repo, revision)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the review: %w", err)
+	}
+	return r, nil
+}
+
+// current returns the open review of the current branch.
+func current(repo repository.Repo) (*review.Review, error) {
+	reviewRef, err := repo.GetHeadRef()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the review: %w", err)
+	}
+	summaries, err := review.List(repo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the review: %w", err)
+	}
+	var matching []review.Summary
+	for _, summary := range summaries {
+		if summary.IsOpen() && summary.Request.ReviewRef == reviewRef {
+			matching = append(matching, summary)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, &Error{Kind: ErrNotFound, Message: "There is no matching review."}
+	}
+	if len(matching) > 1 {
+		return nil, &Error{
+			Kind:    ErrAmbiguous,
+			Message: fmt.Sprintf("There are %d open reviews for the ref %q.", len(matching), reviewRef),
+		}
+	}
+	return matching[0].Details()
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+type errHeadRefRepo struct {
+	repository.Repo
+}
+
+func (r errHeadRefRepo) GetHeadRef() (string, error) {
+	return "", errors.New("no HEAD")
+}
+
+type errNotesRepo struct {
+	repository.Repo
+}
+
+func (r errNotesRepo) GetNotesCommit(notesRef string) (string, error) {
+	return "", errors.New("no notes")
+}
+
+// newTestRepo returns the mock repo with its review ref checked out, so
+// that the review of TestCommitG is the current review.
+func newTestRepo(t *testing.T) repository.Repo {
+	t.Helper()
+	repo := repository.NewMockRepoForTest()
+	if err := repo.SwitchToRef(repository.TestReviewRef); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// initRepo creates a git repo with a single commit in a temporary directory.
+func initRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	return dir
+}
+
+func TestOpen(t *testing.T) {
+	t.Setenv(repository.NamespaceEnv, "")
+	dir := initRepo(t)
+	c, err := Open(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Repo().(*repository.GitRepo); !ok {
+		t.Errorf("expected a git repo, got %T", c.Repo())
+	}
+	summaries, err := c.List(context.Background())
+	if err != nil || len(summaries) != 0 {
+		t.Errorf("expected no reviews, got %v, %v", summaries, err)
+	}
+}
+
+func TestOpenOptions(t *testing.T) {
+	t.Setenv(repository.NamespaceEnv, "ignored")
+	dir := initRepo(t)
+	store := initRepo(t)
+	c, err := Open(context.Background(), dir, WithReviewStore(store), WithNamespaces("team", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, ok := c.Repo().(*repository.NamespacedRepo)
+	if !ok {
+		t.Fatalf("expected a namespaced repo, got %T", c.Repo())
+	}
+	if repo.Namespace() != "team" || len(repo.Namespaces()) != 2 {
+		t.Errorf("unexpected namespaces %q %q", repo.Namespace(), repo.Namespaces())
+	}
+	if _, ok := repo.Repo.(*repository.SidecarRepo); !ok {
+		t.Errorf("expected a sidecar repo, got %T", repo.Repo)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	t.Setenv(repository.NamespaceEnv, "")
+	dir := initRepo(t)
+	if _, err := Open(context.Background(), filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error opening a missing repo")
+	}
+	if _, err := Open(context.Background(), dir, WithReviewStore(filepath.Join(t.TempDir(), "missing"))); err == nil {
+		t.Error("expected an error opening a missing review store")
+	}
+	if _, err := Open(context.Background(), dir, WithNamespaces("bad/namespace")); err == nil {
+		t.Error("expected an error for an invalid namespace")
+	}
+	cmd := exec.Command("git", "config", repository.ReviewStoreKey, ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if _, err := Open(context.Background(), dir); err == nil {
+		t.Error("expected an error for a review store that is not a separate repo")
+	}
+}
+
+func TestOpenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Open(ctx, initRepo(t)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context to be canceled, got %v", err)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := New(repository.NewMockRepoForTest())
+	if _, err := c.List(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected List to be canceled, got %v", err)
+	}
+	if _, err := c.ListOpen(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected ListOpen to be canceled, got %v", err)
+	}
+	if _, err := c.Get(ctx, repository.TestCommitG); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Get to be canceled, got %v", err)
+	}
+	if _, err := c.Comment(ctx, repository.TestCommitG, CommentOptions{Message: "hi"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Comment to be canceled, got %v", err)
+	}
+	if err := c.Submit(ctx, repository.TestCommitG, SubmitOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Submit to be canceled, got %v", err)
+	}
+	if _, err := c.AddDetachedComment(ctx, "", CommentOptions{Location: &comment.Location{Path: "foo"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected AddDetachedComment to be canceled, got %v", err)
+	}
+}
+
+// cancelingRepo cancels its context once the notes are read, as if the git
+// command that read them had been killed.
+type cancelingRepo struct {
+	repository.Repo
+	cancel context.CancelFunc
+}
+
+func (r cancelingRepo) GetNotes(notesRef, revision string) []repository.Note {
+	r.cancel()
+	return nil
+}
+
+func (r cancelingRepo) GetNotesCommit(notesRef string) (string, error) {
+	r.cancel()
+	return "", nil
+}
+
+func TestCanceledWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(cancelingRepo{repository.NewMockRepoForTest(), cancel})
+	if _, err := c.Get(ctx, repository.TestCommitG); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Get to be canceled rather than not find the review, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	c = New(cancelingRepo{repository.NewMockRepoForTest(), cancel})
+	if _, err := c.List(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected List to be canceled, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	c := New(repository.NewMockRepoForTest())
+	all, err := c.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := c.ListOpen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || len(open) != 1 || open[0].Revision != repository.TestCommitG {
+		t.Errorf("unexpected reviews %v and open reviews %v", all, open)
+	}
+	if _, err := New(errNotesRepo{repository.NewMockRepoForTest()}).ListOpen(context.Background()); err == nil {
+		t.Error("expected an error listing the reviews")
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := New(newTestRepo(t))
+	r, err := c.Get(context.Background(), repository.TestCommitG)
+	if err != nil || r.Revision != repository.TestCommitG {
+		t.Fatalf("unexpected review %v, %v", r, err)
+	}
+	r, err = c.Get(context.Background(), "")
+	if err != nil || r.Revision != repository.TestCommitG {
+		t.Fatalf("unexpected current review %v, %v", r, err)
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	c := New(repository.NewMockRepoForTest())
+	for _, revision := range []string{"", "missing", repository.TestCommitA} {
+		_, err := c.Get(context.Background(), revision)
+		if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrAmbiguous) {
+			t.Errorf("expected %q not to be found, got %v", revision, err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "There is no matching review") {
+			t.Errorf("unexpected message for %q: %v", revision, err)
+		}
+	}
+	var clientErr *Error
+	if _, err := c.Get(context.Background(), "missing"); !errors.As(err, &clientErr) || clientErr.Revision != "missing" || errors.Unwrap(err) == nil {
+		t.Errorf("expected the revision and cause of the error, got %+v", clientErr)
+	}
+}
+
+func TestGetAmbiguous(t *testing.T) {
+	repo := newTestRepo(t)
+	note := repository.Note(`{"timestamp": "0000000004", "reviewRef": "` + repository.TestReviewRef + `", "targetRef": "` + repository.TestTargetRef + `", "description": "other"}`)
+	if err := repo.AppendNote(request.Ref, repository.TestCommitI, note); err != nil {
+		t.Fatal(err)
+	}
+	_, err := New(repo).Get(context.Background(), "")
+	if !errors.Is(err, ErrAmbiguous) || !strings.Contains(err.Error(), "There are 2 open reviews") {
+		t.Errorf("expected the current review to be ambiguous, got %v", err)
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	if _, err := New(errHeadRefRepo{newTestRepo(t)}).Get(context.Background(), ""); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an error reading HEAD, got %v", err)
+	}
+	if _, err := New(errNotesRepo{newTestRepo(t)}).Get(context.Background(), ""); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an error listing the reviews, got %v", err)
+	}
+	repo := errIsAncestorRepo{repository.NewMockRepoForTest()}
+	if _, err := New(repo).Get(context.Background(), repository.TestCommitG); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an error loading the review, got %v", err)
+	}
+}
+
+func TestError(t *testing.T) {
+	cause := errors.New("cause")
+	err := &Error{Kind: ErrConflict, Message: "The message.", Err: cause}
+	if err.Error() != "The message." || !errors.Is(err, ErrConflict) || !errors.Is(err, cause) || errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
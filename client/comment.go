@@ -0,0 +1,251 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// CommentOptions are the contents of a comment.
+type CommentOptions struct {
+	// Message is the description of the comment.
+	Message string
+	// Location is the location that the comment is about. By default, that
+	// is the head commit of the review, and otherwise the commit defaults to
+	// that.
+	Location *comment.Location
+	// Parent is the hash of the comment to which this replies, if any.
+	Parent string
+	// Resolved is whether the comment approves (true) or disapproves
+	// (false) of the review, if it does either.
+	Resolved *bool
+	// Time is when the comment was written, which defaults to now.
+	Time time.Time
+	// Sign signs the comment with the user's signing key.
+	Sign bool
+}
+
+// Comment adds a comment to the review with the given revision, or to the
+// open review of the current branch if the revision is empty, and returns
+// the hash of the comment.
+func (c *Client) Comment(ctx context.Context, revision string, opts CommentOptions) (string, error) {
+	r, err := c.Get(ctx, revision)
+	if err != nil {
+		return "", err
+	}
+	return addComment(r, opts)
+}
+
+// Accept adds a comment that approves of the review with the given
+// revision, and returns the hash of the comment.
+func (c *Client) Accept(ctx context.Context, revision string, opts CommentOptions) (string, error) {
+	resolved := true
+	opts.Resolved = &resolved
+	return c.Comment(ctx, revision, opts)
+}
+
+// Reject adds a comment that disapproves of the review with the given
+// revision, and returns the hash of the comment.
+func (c *Client) Reject(ctx context.Context, revision string, opts CommentOptions) (string, error) {
+	r, err := c.Get(ctx, revision)
+	if err != nil {
+		return "", err
+	}
+	if r.IsAbandoned() {
+		return "", abandonedError(r)
+	}
+	resolved := false
+	opts.Resolved = &resolved
+	return addComment(r, opts)
+}
+
+// Abandon adds a comment that disapproves of the review with the given
+// revision, and then abandons the review by clearing its target ref.
+func (c *Client) Abandon(ctx context.Context, revision string, opts CommentOptions) error {
+	r, err := c.Get(ctx, revision)
+	if err != nil {
+		return err
+	}
+	resolved := false
+	opts.Resolved = &resolved
+	if _, err := addComment(r, opts); err != nil {
+		return err
+	}
+
+	// Empty target ref indicates the request was abandoned.
+	r.Request.TargetRef = ""
+	note, err := r.Request.Write()
+	if err != nil {
+		return err
+	}
+	return r.Repo.AppendNote(request.Ref, r.Revision, note)
+}
+
+// AddDetachedComment adds a comment about a file, which is not attached to
+// any review, and returns the hash of the comment. The location of the
+// comment must name the file, and its commit defaults to the one that the
+// given ref points to, or else HEAD.
+func (c *Client) AddDetachedComment(ctx context.Context, ref string, opts CommentOptions) (string, error) {
+	if opts.Location == nil || opts.Location.Path == "" {
+		return "", errors.New("You must specify the containing file for detached comments.")
+	}
+	repo, err := c.bind(ctx)
+	if err != nil {
+		return "", err
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	commit, err := repo.ResolveRefCommit(ref)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve the comment location: %v", err)
+	}
+	if opts.Parent != "" {
+		threads, err := review.GetDetachedComments(repo, opts.Location.Path)
+		if err != nil {
+			return "", err
+		}
+		if !HasComment(threads, opts.Parent) {
+			return "", parentError()
+		}
+	}
+	cmt, err := newComment(repo, nil, commit, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := review.AddDetachedComment(repo, &cmt); err != nil {
+		return "", err
+	}
+	return cmt.Hash()
+}
+
+// HasComment returns whether the comment with the given hash is in the given
+// comment threads.
+func HasComment(threads []review.CommentThread, hash string) bool {
+	for _, thread := range threads {
+		if thread.Hash == hash || HasComment(thread.Children, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// addComment adds a comment to the given review, and returns its hash.
+func addComment(r *review.Review, opts CommentOptions) (string, error) {
+	if opts.Parent != "" && !HasComment(r.Comments, opts.Parent) {
+		return "", parentError()
+	}
+	headCommit, err := r.GetHeadCommit()
+	if err != nil {
+		return "", err
+	}
+	cmt, err := newComment(r.Repo, r, headCommit, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := r.AddComment(cmt); err != nil {
+		return "", err
+	}
+	return cmt.Hash()
+}
+
+// newComment builds a comment on the given commit, which is part of the given
+// review unless that is nil (for detached comments).
+func newComment(repo repository.Repo, r *review.Review, commit string, opts CommentOptions) (comment.Comment, error) {
+	location := comment.Location{Commit: commit}
+	if opts.Location != nil {
+		location = *opts.Location
+		if location.Commit == "" {
+			location.Commit = commit
+		}
+		if err := location.Check(repo); err != nil {
+			return comment.Comment{}, fmt.Errorf("Unable to comment on the given location: %v", err)
+		}
+	}
+	userEmail, err := repo.GetUserEmail()
+	if err != nil {
+		return comment.Comment{}, err
+	}
+	date := opts.Time
+	if date.IsZero() {
+		date = time.Now()
+	}
+	c := comment.New(userEmail, opts.Message)
+	c.Timestamp = strconv.FormatInt(date.Unix(), 10)
+	c.Location = &location
+	c.Parent = opts.Parent
+	c.Resolved = opts.Resolved
+	if r != nil {
+		if err := encryptComment(repo, r, &c); err != nil {
+			return comment.Comment{}, err
+		}
+	}
+	if opts.Sign {
+		if err := signComment(repo, &c); err != nil {
+			return comment.Comment{}, err
+		}
+	}
+	return c, nil
+}
+
+// encryptComment encrypts the description of a comment on the given review,
+// if that is a private review.
+//
+// This must be done before signing the comment, so that the signature covers
+// the encrypted comment that is written.
+func encryptComment(repo repository.Repo, r *review.Review, c *comment.Comment) error {
+	if r.Request.Encrypted == "" || c.Description == "" {
+		return nil
+	}
+	if err := c.Encrypt(repo); err != nil {
+		return fmt.Errorf("Failed to encrypt the comment on a private review: %v", err)
+	}
+	return nil
+}
+
+// signComment signs the given comment with the user's signing key.
+//
+// This must be done after every other field of the comment has been set.
+func signComment(repo repository.Repo, c *comment.Comment) error {
+	payload, err := c.SigningPayload()
+	if err != nil {
+		return err
+	}
+	signature, err := repo.SignPayload(payload)
+	if err != nil {
+		return fmt.Errorf("Failed to sign the comment: %v", err)
+	}
+	c.Signature = signature
+	return nil
+}
+
+func parentError() error {
+	return &Error{Kind: ErrNotFound, Message: "There is no matching parent comment."}
+}
+
+func abandonedError(r *review.Review) error {
+	return &Error{Kind: ErrAbandoned, Revision: r.Revision, Message: "The review was abandoned."}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+type errUserEmailRepo struct {
+	repository.Repo
+}
+
+func (r errUserEmailRepo) GetUserEmail() (string, error) {
+	return "", errors.New("no email")
+}
+
+type errAppendNoteRepo struct {
+	repository.Repo
+	ref string
+}
+
+func (r errAppendNoteRepo) AppendNote(ref, revision string, note repository.Note) error {
+	if ref == r.ref {
+		return errors.New("append failed")
+	}
+	return r.Repo.AppendNote(ref, revision, note)
+}
+
+type errSignRepo struct {
+	repository.Repo
+}
+
+func (r errSignRepo) SignPayload(payload []byte) (string, error) {
+	return "", errors.New("no signing key")
+}
+
+type errEncryptRepo struct {
+	repository.Repo
+}
+
+func (r errEncryptRepo) EncryptPayload(payload []byte) (string, error) {
+	return "", errors.New("no recipients")
+}
+
+type errResolveRepo struct {
+	repository.Repo
+}
+
+func (r errResolveRepo) ResolveRefCommit(ref string) (string, error) {
+	return "", errors.New("bad ref")
+}
+
+type errCreateCommitRepo struct {
+	repository.Repo
+}
+
+func (r errCreateCommitRepo) CreateCommitWithTree(details *repository.CommitDetails, t *repository.Tree) (string, error) {
+	return "", errors.New("no commit")
+}
+
+// findThread returns the comment thread with the given hash in the review of
+// TestCommitG.
+func findThread(t *testing.T, c *Client, hash string) review.CommentThread {
+	t.Helper()
+	r, err := c.Get(context.Background(), repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.VerifySignatures()
+	for _, thread := range r.Comments {
+		if thread.Hash == hash {
+			return thread
+		}
+		for _, child := range thread.Children {
+			if child.Hash == hash {
+				return child
+			}
+		}
+	}
+	t.Fatalf("no comment %q in %+v", hash, r.Comments)
+	return review.CommentThread{}
+}
+
+func TestComment(t *testing.T) {
+	c := New(newTestRepo(t))
+	ctx := context.Background()
+	hash, err := c.Comment(ctx, "", CommentOptions{Message: "first", Time: time.Unix(1000000000, 0), Sign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := findThread(t, c, hash)
+	if thread.Comment.Description != "first" || thread.Comment.Timestamp != "1000000000" ||
+		thread.Comment.Location.Commit != repository.TestCommitI || !thread.Verified {
+		t.Errorf("unexpected comment %+v", thread)
+	}
+
+	reply, err := c.Comment(ctx, repository.TestCommitG, CommentOptions{
+		Message:  "reply",
+		Location: &comment.Location{Path: "foo.txt"},
+		Parent:   hash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread = findThread(t, c, reply)
+	if thread.Comment.Parent != hash || thread.Comment.Location.Path != "foo.txt" ||
+		thread.Comment.Location.Commit != repository.TestCommitI || thread.Comment.Timestamp == "" {
+		t.Errorf("unexpected reply %+v", thread)
+	}
+}
+
+func TestCommentErrors(t *testing.T) {
+	ctx := context.Background()
+	_, err := New(newTestRepo(t)).Comment(ctx, repository.TestCommitG, CommentOptions{Parent: "missing"})
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "parent comment") {
+		t.Errorf("expected a missing parent, got %v", err)
+	}
+	if _, err := New(newTestRepo(t)).Comment(ctx, "missing", CommentOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing review, got %v", err)
+	}
+	location := &comment.Location{Path: "foo.txt", Range: &comment.Range{StartLine: 9999}}
+	if _, err := New(newTestRepo(t)).Comment(ctx, repository.TestCommitG, CommentOptions{Location: location}); err == nil || !strings.Contains(err.Error(), "Unable to comment") {
+		t.Errorf("expected an invalid location, got %v", err)
+	}
+	if _, err := New(errUserEmailRepo{newTestRepo(t)}).Comment(ctx, repository.TestCommitG, CommentOptions{}); err == nil {
+		t.Error("expected an error reading the user's email")
+	}
+	if _, err := New(errSignRepo{newTestRepo(t)}).Comment(ctx, repository.TestCommitG, CommentOptions{Sign: true}); err == nil || !strings.Contains(err.Error(), "Failed to sign") {
+		t.Errorf("expected an error signing, got %v", err)
+	}
+	if _, err := New(errAppendNoteRepo{newTestRepo(t), comment.Ref}).Comment(ctx, repository.TestCommitG, CommentOptions{}); err == nil {
+		t.Error("expected an error writing the comment")
+	}
+	if _, err := New(errResolveRepo{newTestRepo(t)}).Comment(ctx, repository.TestCommitG, CommentOptions{}); err == nil {
+		t.Error("expected an error finding the head commit")
+	}
+}
+
+func TestCommentEncrypted(t *testing.T) {
+	repo := newTestRepo(t)
+	if err := repo.AddConfigValue(repository.EncryptToKey, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(repo).Get(context.Background(), repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Request.Timestamp = "0000000100"
+	if err := r.Request.Encrypt(repo); err != nil {
+		t.Fatal(err)
+	}
+	note, err := r.Request.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(request.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(repo)
+	hash, err := c.Comment(context.Background(), repository.TestCommitG, CommentOptions{Message: "private", Sign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread := findThread(t, c, hash); thread.Comment.Encrypted == "" || thread.Comment.Description != "private" || !thread.Verified {
+		t.Errorf("expected a verified, encrypted comment, got %+v", thread)
+	}
+	for _, note := range repo.GetNotes(comment.Ref, repository.TestCommitG) {
+		if strings.Contains(string(note), "private") {
+			t.Errorf("expected the comment not to be written in plaintext, got %q", note)
+		}
+	}
+	if _, err := New(errEncryptRepo{repo}).Comment(context.Background(), repository.TestCommitG, CommentOptions{Message: "private"}); err == nil || !strings.Contains(err.Error(), "Failed to encrypt") {
+		t.Errorf("expected an error encrypting, got %v", err)
+	}
+	if _, err := New(errEncryptRepo{repo}).Comment(context.Background(), repository.TestCommitG, CommentOptions{}); err != nil {
+		t.Errorf("expected comments without a description not to be encrypted, got %v", err)
+	}
+}
+
+func TestAcceptAndReject(t *testing.T) {
+	c := New(newTestRepo(t))
+	ctx := context.Background()
+	hash, err := c.Reject(ctx, "", CommentOptions{Message: "NMW"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread := findThread(t, c, hash); thread.Comment.Resolved == nil || *thread.Comment.Resolved {
+		t.Errorf("expected a rejection, got %+v", thread)
+	}
+	hash, err = c.Accept(ctx, "", CommentOptions{Message: "LGTM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread := findThread(t, c, hash); thread.Comment.Resolved == nil || !*thread.Comment.Resolved {
+		t.Errorf("expected an approval, got %+v", thread)
+	}
+	if _, err := c.Reject(ctx, "missing", CommentOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing review, got %v", err)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	c := New(newTestRepo(t))
+	ctx := context.Background()
+	if err := c.Abandon(ctx, "", CommentOptions{Message: "abandoning"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Get(ctx, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsAbandoned() || r.Resolved == nil || *r.Resolved {
+		t.Errorf("expected an abandoned, rejected review, got %+v", r.Summary)
+	}
+	if _, err := c.Reject(ctx, repository.TestCommitG, CommentOptions{Message: "NMW"}); !errors.Is(err, ErrAbandoned) {
+		t.Errorf("expected the review to be abandoned, got %v", err)
+	}
+	if _, err := c.Get(ctx, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected no current review once it is abandoned, got %v", err)
+	}
+}
+
+func TestAbandonErrors(t *testing.T) {
+	ctx := context.Background()
+	if err := New(newTestRepo(t)).Abandon(ctx, "missing", CommentOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing review, got %v", err)
+	}
+	if err := New(errAppendNoteRepo{newTestRepo(t), comment.Ref}).Abandon(ctx, repository.TestCommitG, CommentOptions{}); err == nil {
+		t.Error("expected an error writing the comment")
+	}
+	if err := New(errAppendNoteRepo{newTestRepo(t), request.Ref}).Abandon(ctx, repository.TestCommitG, CommentOptions{}); err == nil {
+		t.Error("expected an error writing the request")
+	}
+}
+
+func TestAddDetachedComment(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	c := New(repo)
+	ctx := context.Background()
+	hash, err := c.AddDetachedComment(ctx, "", CommentOptions{Message: "about foo", Location: &comment.Location{Path: "foo.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.AddDetachedComment(ctx, repository.TestCommitE, CommentOptions{
+		Message:  "reply",
+		Location: &comment.Location{Path: "foo.txt"},
+		Parent:   hash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threads, err := review.GetDetachedComments(repo, "foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 1 || threads[0].Hash != hash || threads[0].Comment.Location.Commit != repository.TestCommitJ ||
+		len(threads[0].Children) != 1 || threads[0].Children[0].Hash != reply ||
+		threads[0].Children[0].Comment.Location.Commit != repository.TestCommitE {
+		t.Errorf("unexpected detached comments %+v", threads)
+	}
+}
+
+func TestAddDetachedCommentErrors(t *testing.T) {
+	ctx := context.Background()
+	location := &comment.Location{Path: "foo.txt"}
+	c := New(repository.NewMockRepoForTest())
+	if _, err := c.AddDetachedComment(ctx, "", CommentOptions{}); err == nil || !strings.Contains(err.Error(), "containing file") {
+		t.Errorf("expected a missing path, got %v", err)
+	}
+	if _, err := c.AddDetachedComment(ctx, "", CommentOptions{Location: location, Parent: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing parent, got %v", err)
+	}
+	if _, err := New(errResolveRepo{repository.NewMockRepoForTest()}).AddDetachedComment(ctx, "", CommentOptions{Location: location}); err == nil {
+		t.Error("expected an error resolving the ref")
+	}
+	if _, err := New(errCreateCommitRepo{repository.NewMockRepoForTest()}).AddDetachedComment(ctx, "", CommentOptions{Location: location, Parent: "parent"}); err == nil {
+		t.Error("expected an error reading the detached comments")
+	}
+	if _, err := New(errCreateCommitRepo{repository.NewMockRepoForTest()}).AddDetachedComment(ctx, "", CommentOptions{Location: location}); err == nil {
+		t.Error("expected an error writing the detached comment")
+	}
+	if _, err := New(errUserEmailRepo{repository.NewMockRepoForTest()}).AddDetachedComment(ctx, "", CommentOptions{Location: location}); err == nil {
+		t.Error("expected an error reading the user's email")
+	}
+}
+
+func TestHasComment(t *testing.T) {
+	threads := []review.CommentThread{
+		{Hash: "abc"},
+		{Hash: "def", Children: []review.CommentThread{{Hash: "ghi"}}},
+	}
+	for hash, want := range map[string]bool{"abc": true, "ghi": true, "xyz": false} {
+		if got := HasComment(threads, hash); got != want {
+			t.Errorf("HasComment(%q) = %v, want %v", hash, got, want)
+		}
+	}
+	if HasComment(nil, "any") {
+		t.Error("expected no comments in nil threads")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import "errors"
+
+// The sentinel errors that the errors about the state of a review match,
+// with errors.Is.
+var (
+	// ErrNotFound means that there is no matching review, or comment.
+	ErrNotFound = errors.New("not found")
+	// ErrAmbiguous means that more than one review matches.
+	ErrAmbiguous = errors.New("ambiguous")
+	// ErrAbandoned means that the review was abandoned.
+	ErrAbandoned = errors.New("abandoned")
+	// ErrNotAccepted means that the review must be accepted first.
+	ErrNotAccepted = errors.New("not accepted")
+	// ErrConflict means that the review conflicts with its target, such as
+	// by having already been submitted to it.
+	ErrConflict = errors.New("conflict")
+)
+
+// Error is an error about the state of a review, which matches its Kind with
+// errors.Is.
+type Error struct {
+	// Kind is one of the sentinel errors, such as ErrNotFound.
+	Kind error
+	// Revision is the revision of the review, if it is known.
+	Revision string
+	// Message describes the error to users.
+	Message string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// Is returns whether the error is of the given kind.
+func (err *Error) Is(target error) bool {
+	return target == err.Kind
+}
+
+// Unwrap returns the underlying error, if any.
+func (err *Error) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/attestation"
+	"msrl.dev/git-appraise/review/ci"
+)
+
+// AttestSubmitsKey is the git config key which, when set to false, stops
+// submits from recording attestations as if SubmitOptions.NoAttest were set,
+// and when set to true, requires them as if SubmitOptions.Attest were set.
+const AttestSubmitsKey = "appraise.attestSubmits"
+
+// The strategies with which a review can be submitted.
+const (
+	// StrategyMerge creates a merge of the review into its target ref.
+	StrategyMerge = "merge"
+	// StrategyRebase rebases the review onto its target ref, and then
+	// fast-forwards the target ref.
+	StrategyRebase = "rebase"
+	// StrategyFastForward merges the review using the default fast-forward
+	// mode.
+	StrategyFastForward = "fast-forward"
+)
+
+// RebaseOptions are the choices of how to rebase a review.
+type RebaseOptions struct {
+	// NoArchive lets the original commits of the review be garbage
+	// collected.
+	NoArchive bool
+}
+
+// SubmitOptions are the choices of how to submit a review.
+type SubmitOptions struct {
+	// Strategy is one of StrategyMerge, StrategyRebase or
+	// StrategyFastForward. If it is empty, then the strategy configured for
+	// the repo is used.
+	Strategy string
+	// TBR ("to be reviewed") submits the review even if it has not been
+	// accepted.
+	TBR bool
+	// NoArchive lets the original commits of a rebased review be garbage
+	// collected.
+	NoArchive bool
+	// NoAttest skips recording an attestation of the review on the
+	// submitted commit.
+	NoAttest bool
+	// Attest requires recording an attestation, so that the review is not
+	// submitted if no signing key is available. Otherwise, the attestation
+	// is skipped with a warning in that case.
+	Attest bool
+	// Warnings receives the warnings about the submit, if not nil.
+	Warnings io.Writer
+}
+
+// Rebase rebases the review with the given revision, or the open review of
+// the current branch if the revision is empty, onto its target ref.
+func (c *Client) Rebase(ctx context.Context, revision string, opts RebaseOptions) error {
+	r, err := c.Get(ctx, revision)
+	if err != nil {
+		return err
+	}
+	if r.Submitted {
+		return submittedError(r)
+	}
+	if r.IsAbandoned() {
+		return abandonedError(r)
+	}
+	if err := r.Repo.VerifyGitRef(r.Request.TargetRef); err != nil {
+		return err
+	}
+	return r.Rebase(!opts.NoArchive)
+}
+
+// Submit merges the accepted review with the given revision, or the open
+// review of the current branch if the revision is empty, into its target
+// ref.
+func (c *Client) Submit(ctx context.Context, revision string, opts SubmitOptions) error {
+	switch opts.Strategy {
+	case "", StrategyMerge, StrategyRebase, StrategyFastForward:
+	default:
+		return fmt.Errorf("Unknown submit strategy %q.", opts.Strategy)
+	}
+	r, err := c.Get(ctx, revision)
+	if err != nil {
+		return err
+	}
+	if r.Submitted {
+		return submittedError(r)
+	}
+	if r.IsAbandoned() {
+		return abandonedError(r)
+	}
+	if !opts.TBR && (r.Resolved == nil || !*r.Resolved) {
+		return &Error{
+			Kind:     ErrNotAccepted,
+			Revision: r.Revision,
+			Message:  "Not submitting as the review has not yet been accepted.",
+		}
+	}
+
+	repo := r.Repo
+	target := r.Request.TargetRef
+	if err := repo.VerifyGitRef(target); err != nil {
+		return err
+	}
+	source, err := r.GetHeadCommit()
+	if err != nil {
+		return err
+	}
+	isAncestor, err := repo.IsAncestor(target, source)
+	if err != nil {
+		return err
+	}
+	if !isAncestor {
+		return &Error{
+			Kind:     ErrConflict,
+			Revision: r.Revision,
+			Message:  "Refusing to submit a non-fast-forward review. First merge the target ref.",
+		}
+	}
+
+	attest, err := attestSubmit(repo, opts)
+	if err != nil {
+		return err
+	}
+
+	strategy := opts.Strategy
+	if strategy == "" {
+		if strategy, err = repo.GetSubmitStrategy(); err != nil {
+			return err
+		}
+	}
+	if strategy == StrategyRebase {
+		if err := r.Rebase(!opts.NoArchive); err != nil {
+			return err
+		}
+		source, err = r.GetHeadCommit()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := repo.SwitchToRef(target); err != nil {
+		return err
+	}
+	if strategy == StrategyMerge {
+		submitMessage := fmt.Sprintf("Submitting review %.12s", r.Revision)
+		if err := repo.MergeRef(source, false, submitMessage, r.Request.Description); err != nil {
+			return err
+		}
+	} else {
+		if err := repo.MergeRef(source, true); err != nil {
+			return err
+		}
+		if strategy != StrategyRebase {
+			strategy = StrategyFastForward
+		}
+	}
+
+	if !attest {
+		return nil
+	}
+	if err := recordAttestation(repo, r, target, strategy, !opts.TBR); err != nil {
+		return fmt.Errorf("The review was submitted, but recording an attestation of it failed: %v\n"+
+			"Configure a signing key, or set %s to false to stop recording attestations.", err, AttestSubmitsKey)
+	}
+	return nil
+}
+
+func submittedError(r *review.Review) error {
+	return &Error{Kind: ErrConflict, Revision: r.Revision, Message: "The review has already been submitted."}
+}
+
+// attestSubmit returns whether to record an attestation of a submitted
+// review, which is checked before submitting it so that a missing signing key
+// is found while the review can still be left unsubmitted.
+//
+// Attestations are recorded unless they are explicitly turned off, so that
+// every submitted commit can be shown to have been reviewed. However, unless
+// they were explicitly required, they are skipped with a warning when no
+// signing key is available.
+func attestSubmit(repo repository.Repo, opts SubmitOptions) (bool, error) {
+	if opts.NoAttest {
+		return false, nil
+	}
+	required := opts.Attest
+	values, err := repo.GetConfigValues(AttestSubmitsKey)
+	if err != nil {
+		return false, err
+	}
+	if len(values) > 0 {
+		value, err := strconv.ParseBool(values[len(values)-1])
+		if err != nil {
+			return false, fmt.Errorf("Invalid value %q for %s: %v", values[len(values)-1], AttestSubmitsKey, err)
+		}
+		if !value {
+			return false, nil
+		}
+		required = true
+	}
+	if _, err := repo.SignPayload(nil); err != nil {
+		if required {
+			return false, fmt.Errorf("Not submitting, as an attestation cannot be signed: %v\n"+
+				"Configure a signing key, or set %s to false to stop recording attestations.", err, AttestSubmitsKey)
+		}
+		if opts.Warnings != nil {
+			fmt.Fprintf(opts.Warnings, "Warning: not recording an attestation, as none can be signed: %v\n", err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// recordAttestation records a signed attestation of the given review on the
+// commit that the target ref points to after submitting it.
+func recordAttestation(repo repository.Repo, r *review.Review, target, strategy string, requireApproval bool) error {
+	commit, err := repo.GetCommitHash(target)
+	if err != nil {
+		return err
+	}
+	submitter, err := repo.GetUserEmail()
+	if err != nil {
+		return err
+	}
+	ciReport, err := ci.GetLatestCIReport(r.Reports)
+	if err != nil {
+		return err
+	}
+	r.VerifySignatures()
+	approvals := []attestation.Approval{}
+	for _, thread := range r.GetApprovals() {
+		approvals = append(approvals, attestation.Approval{
+			Author:    thread.Comment.Author,
+			Timestamp: thread.Comment.Timestamp,
+			Comment:   thread.Hash,
+			Verified:  thread.Verified,
+		})
+	}
+	statement := attestation.New(commit, attestation.Predicate{
+		Timestamp:      strconv.FormatInt(time.Now().Unix(), 10),
+		ReviewRevision: r.Revision,
+		ReviewRef:      r.Request.ReviewRef,
+		TargetRef:      r.Request.TargetRef,
+		Requester:      r.Request.Requester,
+		Submitter:      submitter,
+		Approvers:      approvals,
+		CI:             ciReport,
+		Policy: attestation.Policy{
+			RequireApproval:          requireApproval,
+			RequireVerifiedApprovals: review.RequiresVerifiedApprovals(repo),
+			Strategy:                 strategy,
+		},
+	})
+	envelope, err := attestation.Sign(repo, statement, submitter)
+	if err != nil {
+		return err
+	}
+	note, err := envelope.Write()
+	if err != nil {
+		return err
+	}
+	return repo.AppendNote(attestation.Ref, commit, note)
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/attestation"
+	"msrl.dev/git-appraise/review/ci"
+)
+
+type errVerifyRefRepo struct {
+	repository.Repo
+}
+
+func (r errVerifyRefRepo) VerifyGitRef(ref string) error {
+	return errors.New("bad ref")
+}
+
+type errIsAncestorRepo struct {
+	repository.Repo
+}
+
+func (r errIsAncestorRepo) IsAncestor(ancestor, descendant string) (bool, error) {
+	return false, errors.New("is-ancestor failed")
+}
+
+type errStrategyRepo struct {
+	repository.Repo
+}
+
+func (r errStrategyRepo) GetSubmitStrategy() (string, error) {
+	return "", errors.New("no strategy")
+}
+
+type errRebaseRepo struct {
+	repository.Repo
+}
+
+func (r errRebaseRepo) RebaseRef(ref string) error {
+	return errors.New("rebase failed")
+}
+
+type errSwitchToRefRepo struct {
+	repository.Repo
+}
+
+func (r errSwitchToRefRepo) SwitchToRef(ref string) error {
+	return errors.New("switch failed")
+}
+
+type errMergeRefRepo struct {
+	repository.Repo
+}
+
+func (r errMergeRefRepo) MergeRef(ref string, fastForward bool, messages ...string) error {
+	return errors.New("merge failed")
+}
+
+type errCommitHashRepo struct {
+	repository.Repo
+}
+
+func (r errCommitHashRepo) GetCommitHash(ref string) (string, error) {
+	return "", errors.New("no commit")
+}
+
+// headErrRepo fails to resolve the review ref once the given number of
+// calls have succeeded, so that the head commit of a review can be found
+// while it is loaded, but not afterwards.
+type headErrRepo struct {
+	repository.Repo
+	calls int
+}
+
+func (r *headErrRepo) ResolveRefCommit(ref string) (string, error) {
+	if r.calls--; r.calls < 0 {
+		return "", errors.New("no head")
+	}
+	return r.Repo.ResolveRefCommit(ref)
+}
+
+// newAcceptedRepo returns the mock repo with the review of TestCommitG
+// accepted, and its target ref moved back so that the review can be
+// fast-forwarded.
+func newAcceptedRepo(t *testing.T) repository.Repo {
+	t.Helper()
+	repo := newTestRepo(t)
+	if _, err := New(repo).Accept(context.Background(), repository.TestCommitG, CommentOptions{Message: "LGTM"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef(repository.TestTargetRef, repository.TestCommitE, repository.TestCommitJ); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestRebase(t *testing.T) {
+	ctx := context.Background()
+	for _, opts := range []RebaseOptions{{}, {NoArchive: true}} {
+		c := New(newTestRepo(t))
+		if err := c.Rebase(ctx, "", opts); err != nil {
+			t.Fatal(err)
+		}
+		r, err := c.Get(ctx, repository.TestCommitG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Request.Alias == "" {
+			t.Errorf("expected the review to be rebased, got %+v", r.Request)
+		}
+	}
+}
+
+func TestRebaseErrors(t *testing.T) {
+	ctx := context.Background()
+	if err := New(newTestRepo(t)).Rebase(ctx, "missing", RebaseOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing review, got %v", err)
+	}
+	if err := New(newTestRepo(t)).Rebase(ctx, repository.TestCommitB, RebaseOptions{}); !errors.Is(err, ErrConflict) || !strings.Contains(err.Error(), "already been submitted") {
+		t.Errorf("expected a submitted review, got %v", err)
+	}
+	c := New(newTestRepo(t))
+	if err := c.Abandon(ctx, repository.TestCommitG, CommentOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rebase(ctx, repository.TestCommitG, RebaseOptions{}); !errors.Is(err, ErrAbandoned) {
+		t.Errorf("expected an abandoned review, got %v", err)
+	}
+	if err := New(errVerifyRefRepo{newTestRepo(t)}).Rebase(ctx, repository.TestCommitG, RebaseOptions{}); err == nil {
+		t.Error("expected an error for a bad target ref")
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	ctx := context.Background()
+	for _, strategy := range []string{"", StrategyMerge, StrategyRebase, StrategyFastForward} {
+		repo := newAcceptedRepo(t)
+		if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{Strategy: strategy, NoArchive: true}); err != nil {
+			t.Fatalf("%q: %v", strategy, err)
+		}
+		r, err := New(repo).Get(ctx, repository.TestCommitG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Submitted {
+			t.Errorf("%q: expected the review to be submitted", strategy)
+		}
+		if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{}); !errors.Is(err, ErrConflict) {
+			t.Errorf("%q: expected the review to already be submitted, got %v", strategy, err)
+		}
+	}
+}
+
+func TestSubmitChecks(t *testing.T) {
+	ctx := context.Background()
+	if err := New(newAcceptedRepo(t)).Submit(ctx, repository.TestCommitG, SubmitOptions{Strategy: "squash"}); err == nil || !strings.Contains(err.Error(), "Unknown submit strategy") {
+		t.Errorf("expected an unknown strategy, got %v", err)
+	}
+	if err := New(newAcceptedRepo(t)).Submit(ctx, "missing", SubmitOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing review, got %v", err)
+	}
+	repo := newTestRepo(t)
+	if err := repo.SetRef(repository.TestTargetRef, repository.TestCommitE, repository.TestCommitJ); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{}); !errors.Is(err, ErrNotAccepted) {
+		t.Errorf("expected the review not to be accepted, got %v", err)
+	}
+	if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{TBR: true}); err != nil {
+		t.Errorf("expected a TBR submit to succeed, got %v", err)
+	}
+	c := New(newAcceptedRepo(t))
+	if err := c.Abandon(ctx, repository.TestCommitG, CommentOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Submit(ctx, repository.TestCommitG, SubmitOptions{TBR: true}); !errors.Is(err, ErrAbandoned) {
+		t.Errorf("expected an abandoned review, got %v", err)
+	}
+	err := New(newTestRepo(t)).Submit(ctx, repository.TestCommitG, SubmitOptions{TBR: true})
+	if !errors.Is(err, ErrConflict) || !strings.Contains(err.Error(), "non-fast-forward") {
+		t.Errorf("expected a non-fast-forward review, got %v", err)
+	}
+}
+
+func TestSubmitErrors(t *testing.T) {
+	ctx := context.Background()
+	for name, wrap := range map[string]func(repository.Repo) repository.Repo{
+		"verify":   func(r repository.Repo) repository.Repo { return errVerifyRefRepo{r} },
+		"head":     func(r repository.Repo) repository.Repo { return &headErrRepo{Repo: r} },
+		"ancestor": func(r repository.Repo) repository.Repo { return errIsAncestorRepo{r} },
+		"strategy": func(r repository.Repo) repository.Repo { return errStrategyRepo{r} },
+		"switch":   func(r repository.Repo) repository.Repo { return errSwitchToRefRepo{r} },
+		"merge":    func(r repository.Repo) repository.Repo { return errMergeRefRepo{r} },
+	} {
+		if err := New(wrap(newAcceptedRepo(t))).Submit(ctx, repository.TestCommitG, SubmitOptions{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	for _, strategy := range []string{StrategyMerge, StrategyFastForward} {
+		if err := New(errMergeRefRepo{newAcceptedRepo(t)}).Submit(ctx, repository.TestCommitG, SubmitOptions{Strategy: strategy}); err == nil {
+			t.Errorf("%s: expected an error merging", strategy)
+		}
+	}
+	if err := New(errRebaseRepo{newAcceptedRepo(t)}).Submit(ctx, repository.TestCommitG, SubmitOptions{Strategy: StrategyRebase}); err == nil {
+		t.Error("expected an error rebasing")
+	}
+	// The head commit is found while loading the review, and before
+	// rebasing it.
+	repo := &headErrRepo{Repo: newAcceptedRepo(t), calls: 2}
+	if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{Strategy: StrategyRebase, NoArchive: true}); err == nil {
+		t.Error("expected an error finding the rebased head commit")
+	}
+}
+
+func TestSubmitAttest(t *testing.T) {
+	ctx := context.Background()
+	for _, strategy := range []string{StrategyMerge, StrategyRebase, StrategyFastForward} {
+		repo := newAcceptedRepo(t)
+		if err := repo.AppendNote(ci.Ref, repository.TestCommitI, repository.Note(`{"timestamp":"0000000001","status":"success"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{Strategy: strategy}); err != nil {
+			t.Fatal(err)
+		}
+		commit, err := repo.GetCommitHash(repository.TestTargetRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelopes := attestation.ParseAllValid(repo.GetNotes(attestation.Ref, commit))
+		if len(envelopes) != 1 {
+			t.Fatalf("%s: expected 1 attestation, got %d", strategy, len(envelopes))
+		}
+		statement, signer, err := envelopes[0].Verify(repo, commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := statement.Predicate
+		if signer != "user@example.com" || p.ReviewRevision != repository.TestCommitG || len(p.Approvers) != 1 ||
+			!p.Policy.RequireApproval || p.Policy.Strategy != strategy {
+			t.Errorf("%s: unexpected attestation %q %+v", strategy, signer, p)
+		}
+	}
+}
+
+// submittedAttestations returns the number of attestations on the commit
+// that the target ref points to.
+func submittedAttestations(t *testing.T, repo repository.Repo) int {
+	t.Helper()
+	commit, err := repo.GetCommitHash(repository.TestTargetRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(attestation.ParseAllValid(repo.GetNotes(attestation.Ref, commit)))
+}
+
+func TestSubmitAttestConfig(t *testing.T) {
+	ctx := context.Background()
+	for value, want := range map[string]int{"true": 1, "false": 0} {
+		repo := newAcceptedRepo(t)
+		if err := repo.AddConfigValue(AttestSubmitsKey, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := submittedAttestations(t, repo); got != want {
+			t.Errorf("%s: expected %d attestations, got %d", value, want, got)
+		}
+	}
+
+	repo := newAcceptedRepo(t)
+	if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{NoAttest: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := submittedAttestations(t, repo); got != 0 {
+		t.Errorf("expected NoAttest to skip the attestation, got %d", got)
+	}
+
+	repo = newAcceptedRepo(t)
+	if err := repo.AddConfigValue(AttestSubmitsKey, "invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{}); err == nil || !strings.Contains(err.Error(), AttestSubmitsKey) {
+		t.Errorf("expected an error for the invalid config value, got %v", err)
+	}
+	if r, err := New(repo).Get(ctx, repository.TestCommitG); err != nil || r.Submitted {
+		t.Errorf("expected the review to be left unsubmitted, got %v", err)
+	}
+	if err := New(configErrRepo{repo}).Submit(ctx, repository.TestCommitG, SubmitOptions{}); err == nil {
+		t.Error("expected an error reading the config")
+	}
+}
+
+// configErrRepo fails to read any config values.
+type configErrRepo struct {
+	repository.Repo
+}
+
+func (r configErrRepo) GetConfigValues(key string) ([]string, error) {
+	return nil, errors.New("config read failed")
+}
+
+func TestSubmitAttestNoSigningKey(t *testing.T) {
+	ctx := context.Background()
+	// Without a signing key, the review is submitted with a warning unless
+	// an attestation is required.
+	var warnings strings.Builder
+	repo := newAcceptedRepo(t)
+	if err := New(errSignRepo{repo}).Submit(ctx, repository.TestCommitG, SubmitOptions{Warnings: &warnings}); err != nil {
+		t.Fatal(err)
+	}
+	if got := submittedAttestations(t, repo); got != 0 || !strings.HasPrefix(warnings.String(), "Warning: ") {
+		t.Errorf("expected no attestation and a warning, got %d and %q", got, warnings.String())
+	}
+
+	for name, opts := range map[string]SubmitOptions{"option": {Attest: true}, "config": {}} {
+		repo := newAcceptedRepo(t)
+		if name == "config" {
+			if err := repo.AddConfigValue(AttestSubmitsKey, "true"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := New(errSignRepo{repo}).Submit(ctx, repository.TestCommitG, opts)
+		if err == nil || !strings.Contains(err.Error(), "Not submitting") {
+			t.Errorf("%s: expected an error, got %v", name, err)
+		}
+		if r, err := New(repo).Get(ctx, repository.TestCommitG); err != nil || r.Submitted {
+			t.Errorf("%s: expected the review to be left unsubmitted, got %v", name, err)
+		}
+	}
+}
+
+func TestSubmitAttestErrors(t *testing.T) {
+	ctx := context.Background()
+	err := New(errAppendNoteRepo{newAcceptedRepo(t), attestation.Ref}).Submit(ctx, repository.TestCommitG, SubmitOptions{})
+	if err == nil || !strings.Contains(err.Error(), "was submitted, but") {
+		t.Errorf("expected an attestation error, got %v", err)
+	}
+
+	repo := newAcceptedRepo(t)
+	if err := repo.AppendNote(ci.Ref, repository.TestCommitI, repository.Note(`{"timestamp":"invalid"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(repo).Submit(ctx, repository.TestCommitG, SubmitOptions{}); err == nil {
+		t.Error("expected an error for an invalid CI report")
+	}
+
+	repo = newAcceptedRepo(t)
+	r, err := New(repo).Get(ctx, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordAttestation(errCommitHashRepo{repo}, r, repository.TestTargetRef, StrategyMerge, true); err == nil {
+		t.Error("expected an error finding the submitted commit")
+	}
+	if err := recordAttestation(errUserEmailRepo{repo}, r, repository.TestTargetRef, StrategyMerge, true); err == nil {
+		t.Error("expected an error reading the submitter's email")
+	}
+}
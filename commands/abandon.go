@@ -17,15 +17,14 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/input"
 	"msrl.dev/git-appraise/repository"
-	"msrl.dev/git-appraise/review"
-	"msrl.dev/git-appraise/review/comment"
-	"msrl.dev/git-appraise/review/request"
 )
 
 var abandonFlagSet = flag.NewFlagSet("abandon", flag.ExitOnError)
@@ -40,23 +39,18 @@ func abandonReview(repo repository.Repo, args []string) error {
 	abandonFlagSet.Parse(args)
 	args = abandonFlagSet.Args()
 
-	var r *review.Review
-	var err error
 	if len(args) > 1 {
 		return errors.New("Only abandon a single review is supported.")
 	}
-
+	var revision string
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
+		revision = args[0]
 	}
-
+	ctx := context.Background()
+	cl := client.New(repo)
+	r, err := cl.Get(ctx, revision)
 	if err != nil {
-		return fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return errors.New("There is no matching review.")
+		return err
 	}
 
 	if *abandonMessageFile != "" && *abandonMessage == "" {
@@ -71,37 +65,7 @@ func abandonReview(repo repository.Repo, args []string) error {
 			return err
 		}
 	}
-
-	abandonedCommit, err := r.GetHeadCommit()
-	if err != nil {
-		return err
-	}
-	location := comment.Location{
-		Commit: abandonedCommit,
-	}
-	resolved := false
-	userEmail, err := repo.GetUserEmail()
-	if err != nil {
-		return err
-	}
-	c := comment.New(userEmail, *abandonMessage)
-	c.Location = &location
-	c.Resolved = &resolved
-
-	err = r.AddComment(c)
-	if err != nil {
-		return err
-	}
-
-	// Empty target ref indicates the request was abandoned.
-	r.Request.TargetRef = ""
-
-	note, err := writeRequest(&r.Request)
-	if err != nil {
-		return err
-	}
-
-	return repo.AppendNote(request.Ref, r.Revision, note)
+	return cl.Abandon(ctx, r.Revision, client.CommentOptions{Message: *abandonMessage})
 }
 
 // abandonCmd defines the "abandon" subcommand.
@@ -113,4 +77,5 @@ var abandonCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return abandonReview(repo, args)
 	},
+	changesReviews: true,
 }
@@ -17,15 +17,14 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"time"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/input"
 	"msrl.dev/git-appraise/repository"
-	"msrl.dev/git-appraise/review"
-	"msrl.dev/git-appraise/review/comment"
 )
 
 var acceptFlagSet = flag.NewFlagSet("accept", flag.ExitOnError)
@@ -34,6 +33,7 @@ var (
 	acceptMessageFile = acceptFlagSet.String("F", "", "Take the comment from the given file. Use - to read the message from the standard input")
 	acceptMessage     = acceptFlagSet.String("m", "", "Message to attach to the review")
 	acceptDate        = acceptFlagSet.String("date", "", "Date to use for the review")
+	acceptSign        = acceptFlagSet.Bool("S", false, signFlagUsage)
 )
 
 // acceptReview adds an LGTM comment to the current code review.
@@ -41,38 +41,15 @@ func acceptReview(repo repository.Repo, args []string) error {
 	acceptFlagSet.Parse(args)
 	args = acceptFlagSet.Args()
 
-	var r *review.Review
-	var err error
 	if len(args) > 1 {
 		return errors.New("Only accepting a single review is supported.")
 	}
-
+	var revision string
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
-	}
-
-	if err != nil {
-		return fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return errors.New("There is no matching review.")
-	}
-
-	acceptedCommit, err := r.GetHeadCommit()
-	if err != nil {
-		return err
-	}
-	location := comment.Location{
-		Commit: acceptedCommit,
-	}
-	resolved := true
-	userEmail, err := repo.GetUserEmail()
-	if err != nil {
-		return err
+		revision = args[0]
 	}
 
+	var err error
 	if *acceptMessageFile != "" && *acceptMessage == "" {
 		*acceptMessage, err = input.FromFile(*acceptMessageFile)
 		if err != nil {
@@ -84,19 +61,12 @@ func acceptReview(repo repository.Repo, args []string) error {
 	if err != nil {
 		return err
 	}
-	if date == nil {
-		now := time.Now()
-		date = &now
+	opts := client.CommentOptions{Message: *acceptMessage, Sign: *acceptSign}
+	if date != nil {
+		opts.Time = *date
 	}
-	timestamp := FormatDate(date)
-	c := comment.New(userEmail, *acceptMessage)
-	c.Location = &location
-	c.Resolved = &resolved
-	if len(timestamp) > 0 {
-		c.Timestamp = timestamp
-	}
-
-	return r.AddComment(c)
+	_, err = client.New(repo).Accept(context.Background(), revision, opts)
+	return err
 }
 
 // acceptCmd defines the "accept" subcommand.
@@ -108,4 +78,5 @@ var acceptCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return acceptReview(repo, args)
 	},
+	changesReviews: true,
 }
@@ -32,10 +32,24 @@ const notesRefPattern = "refs/notes/devtools/*"
 const archiveRefPattern = "refs/devtools/archives/*"
 const commentFilename = "APPRAISE_COMMENT_EDITMSG"
 
+// namespacedRef returns the actual name of the given review ref (or ref
+// pattern), for repos that write their reviews in a namespace other than
+// the default one.
+func namespacedRef(repo repository.Repo, ref string) string {
+	if nsRepo, ok := repo.(*repository.NamespacedRepo); ok {
+		return nsRepo.Ref(ref)
+	}
+	return ref
+}
+
 // Command represents the definition of a single command.
 type Command struct {
 	Usage     func(string)
 	RunMethod func(repository.Repo, []string) error
+
+	// changesReviews is set for commands that may change the reviews, so
+	// that the events of their changes are sent to any webhooks.
+	changesReviews bool
 }
 
 // Run executes a command, given its arguments.
@@ -43,21 +57,37 @@ type Command struct {
 // The args parameter is all of the command line args that followed the
 // subcommand.
 func (cmd *Command) Run(repo repository.Repo, args []string) error {
-	return cmd.RunMethod(repo, args)
+	if !cmd.changesReviews {
+		return cmd.RunMethod(repo, args)
+	}
+	return runWithWebhooks(repo, func() error {
+		return cmd.RunMethod(repo, args)
+	})
 }
 
 // CommandMap defines all of the available (sub)commands.
 var CommandMap = map[string]*Command{
-	"abandon": abandonCmd,
-	"accept":  acceptCmd,
-	"comment": commentCmd,
-	"list":    listCmd,
-	"pull":    pullCmd,
-	"push":    pushCmd,
-	"rebase":  rebaseCmd,
-	"reject":  rejectCmd,
-	"request": requestCmd,
-	"show":    showCmd,
-	"submit":  submitCmd,
-	"web":     webCmd,
+	"abandon":       abandonCmd,
+	"accept":        acceptCmd,
+	"comment":       commentCmd,
+	"compact":       compactCmd,
+	"events":        eventsCmd,
+	"init":          initCmd,
+	"list":          listCmd,
+	"lsp":           lspCmd,
+	"pull":          pullCmd,
+	"push":          pushCmd,
+	"rebase":        rebaseCmd,
+	"redact":        redactCmd,
+	"reject":        rejectCmd,
+	"request":       requestCmd,
+	"serve":         serveCmd,
+	"show":          showCmd,
+	"status":        statusCmd,
+	"submit":        submitCmd,
+	"uninstall":     uninstallCmd,
+	"validate-push": validatePushCmd,
+	"verify":        verifyCmd,
+	"watch":         watchCmd,
+	"web":           webCmd,
 }
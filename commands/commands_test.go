@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/web"
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
@@ -77,6 +78,7 @@ func resetCommentFlags() {
 	*commentLgtm = false
 	*commentNmw = false
 	*commentDate = ""
+	*commentSign = false
 	commentLocation = comment.Range{}
 }
 
@@ -84,11 +86,13 @@ func resetAcceptFlags() {
 	*acceptMessage = ""
 	*acceptMessageFile = ""
 	*acceptDate = ""
+	*acceptSign = false
 }
 
 func resetRejectFlags() {
 	*rejectMessage = ""
 	*rejectMessageFile = ""
+	*rejectSign = false
 }
 
 func resetAbandonFlags() {
@@ -105,6 +109,8 @@ func resetRequestFlags() {
 	*requestQuiet = false
 	*requestAllowUncommitted = false
 	*requestDate = ""
+	*requestSign = false
+	*requestEncrypt = false
 }
 
 func resetSubmitFlags() {
@@ -113,12 +119,37 @@ func resetSubmitFlags() {
 	*submitFastForward = false
 	*submitTBR = false
 	*submitArchive = true
+	submitAttest = nil
 }
 
 func resetRebaseFlags() {
 	*rebaseArchive = true
 }
 
+func resetCompactFlags() {
+	*compactBefore = ""
+}
+
+func resetLSPFlags() {
+	*lspStdio = true
+}
+
+func resetServeFlags() {
+	*serveStdio = false
+	*servePollInterval = 2 * time.Second
+}
+
+func resetEventsFlags() {
+	*eventsSince = ""
+	*eventsCursor = false
+}
+
+func resetWatchFlags() {
+	*watchInterval = time.Minute
+	*watchOnce = false
+	*watchExec = ""
+}
+
 func resetWebFlags() {
 	*port = 0
 	*outputDir = ""
@@ -338,7 +369,7 @@ func TestCommandRun(t *testing.T) {
 // --- CommandMap test ---
 
 func TestCommandMapEntries(t *testing.T) {
-	expected := []string{"abandon", "accept", "comment", "list", "pull", "push", "rebase", "reject", "request", "show", "submit", "web"}
+	expected := []string{"abandon", "accept", "comment", "compact", "events", "init", "list", "lsp", "pull", "push", "rebase", "redact", "reject", "request", "serve", "show", "status", "submit", "uninstall", "validate-push", "verify", "watch", "web"}
 	for _, name := range expected {
 		if _, ok := CommandMap[name]; !ok {
 			t.Errorf("CommandMap missing %q", name)
@@ -653,28 +684,6 @@ func TestAbandonReviewEditorError(t *testing.T) {
 
 // --- comment tests ---
 
-func TestCommentHashExists(t *testing.T) {
-	threads := []review.CommentThread{
-		{Hash: "abc"},
-		{Hash: "def", Children: []review.CommentThread{{Hash: "ghi"}}},
-	}
-	if !commentHashExists("abc", threads) {
-		t.Error("expected to find hash 'abc'")
-	}
-	if !commentHashExists("ghi", threads) {
-		t.Error("expected to find nested hash 'ghi'")
-	}
-	if commentHashExists("xyz", threads) {
-		t.Error("should not find hash 'xyz'")
-	}
-}
-
-func TestCommentHashExistsEmpty(t *testing.T) {
-	if commentHashExists("any", nil) {
-		t.Error("should not find hash in nil threads")
-	}
-}
-
 func TestCommentOnReview(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
@@ -846,87 +855,81 @@ func TestValidateArgsEditorError(t *testing.T) {
 	}
 }
 
-func TestBuildCommentFromFlagsBasic(t *testing.T) {
+func TestCommentOptionsFromFlagsBasic(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
-	repo := repository.NewMockRepoForTest()
 	*commentMessage = "test comment"
-	c, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if c.Description != "test comment" {
-		t.Errorf("expected description 'test comment', got %q", c.Description)
+	if opts.Message != "test comment" {
+		t.Errorf("expected message 'test comment', got %q", opts.Message)
 	}
 }
 
-func TestBuildCommentFromFlagsWithFile(t *testing.T) {
+func TestCommentOptionsFromFlagsWithFile(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
-	repo := repository.NewMockRepoForTest()
 	*commentMessage = "file comment"
 	*commentFile = "foo.txt"
-	c, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if c.Location.Path != "foo.txt" {
-		t.Errorf("expected path 'foo.txt', got %q", c.Location.Path)
+	if opts.Location.Path != "foo.txt" {
+		t.Errorf("expected path 'foo.txt', got %q", opts.Location.Path)
 	}
 }
 
-func TestBuildCommentFromFlagsWithDate(t *testing.T) {
+func TestCommentOptionsFromFlagsWithDate(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
-	repo := repository.NewMockRepoForTest()
 	*commentMessage = "dated comment"
 	*commentDate = "1000000000 +0000"
-	c, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if c.Timestamp != "1000000000" {
-		t.Errorf("expected timestamp '1000000000', got %q", c.Timestamp)
+	if opts.Time.Unix() != 1000000000 {
+		t.Errorf("expected time 1000000000, got %v", opts.Time)
 	}
 }
 
-func TestBuildCommentFromFlagsBadDate(t *testing.T) {
+func TestCommentOptionsFromFlagsBadDate(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
-	repo := repository.NewMockRepoForTest()
 	*commentMessage = "test"
 	*commentDate = "INVALID DATE"
-	if _, err := buildCommentFromFlags(repo, repository.TestCommitG); err == nil {
+	if _, err := commentOptionsFromFlags(); err == nil {
 		t.Error("expected error for bad date")
 	}
 }
 
-func TestBuildCommentFromFlagsLGTM(t *testing.T) {
+func TestCommentOptionsFromFlagsLGTM(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
-	repo := repository.NewMockRepoForTest()
 	*commentMessage = "lgtm comment"
 	*commentLgtm = true
-	c, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if c.Resolved == nil || !*c.Resolved {
+	if opts.Resolved == nil || !*opts.Resolved {
 		t.Error("expected resolved=true for lgtm comment")
 	}
 }
 
-func TestBuildCommentFromFlagsNMW(t *testing.T) {
+func TestCommentOptionsFromFlagsNMW(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
-	repo := repository.NewMockRepoForTest()
 	*commentMessage = "needs work"
 	*commentNmw = true
-	c, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if c.Resolved == nil || *c.Resolved {
+	if opts.Resolved == nil || *opts.Resolved {
 		t.Error("expected resolved=false for nmw comment")
 	}
 }
@@ -1379,34 +1382,26 @@ func TestBuildRequestFromFlagsBadMessageFile(t *testing.T) {
 
 // --- rebase tests ---
 
-func TestValidateRebaseRequestTooManyArgs(t *testing.T) {
+func TestRebaseReviewTooManyArgs(t *testing.T) {
+	defer resetRebaseFlags()
 	repo := repository.NewMockRepoForTest()
-	if _, err := validateRebaseRequest(repo, []string{"a", "b"}); err == nil {
+	if err := rebaseReview(repo, []string{"a", "b"}); err == nil {
 		t.Error("expected error for too many args")
 	}
 }
 
-func TestValidateRebaseRequestNoMatch(t *testing.T) {
+func TestRebaseReviewNoMatch(t *testing.T) {
+	defer resetRebaseFlags()
 	repo := repository.NewMockRepoForTest()
-	if _, err := validateRebaseRequest(repo, []string{"nonexistent"}); err == nil {
+	if err := rebaseReview(repo, []string{"nonexistent"}); err == nil {
 		t.Error("expected error for nonexistent review")
 	}
 }
 
-func TestValidateRebaseRequest(t *testing.T) {
-	repo := repository.NewMockRepoForTest()
-	r, err := validateRebaseRequest(repo, []string{repository.TestCommitG})
-	if err != nil {
-		t.Fatal(err)
-	}
-	if r == nil {
-		t.Error("expected non-nil review")
-	}
-}
-
 func TestRebaseSubmittedReview(t *testing.T) {
+	defer resetRebaseFlags()
 	repo := repository.NewMockRepoForTest()
-	_, err := validateRebaseRequest(repo, []string{repository.TestCommitB})
+	err := rebaseReview(repo, []string{repository.TestCommitB})
 	if err == nil || !strings.Contains(err.Error(), "already been submitted") {
 		t.Errorf("expected 'submitted' error, got %v", err)
 	}
@@ -1419,17 +1414,18 @@ func TestRebaseAbandonedReview(t *testing.T) {
 	if err := abandonReview(repo, []string{"-m", "abandoning", repository.TestCommitG}); err != nil {
 		t.Fatal(err)
 	}
-	_, err := validateRebaseRequest(repo, []string{repository.TestCommitG})
+	defer resetRebaseFlags()
+	err := rebaseReview(repo, []string{repository.TestCommitG})
 	if err == nil || !strings.Contains(err.Error(), "abandoned") {
 		t.Errorf("expected 'abandoned' error, got %v", err)
 	}
 }
 
-func TestValidateRebaseRequestBadTargetRef(t *testing.T) {
+func TestRebaseReviewBadTargetRef(t *testing.T) {
 	resetRebaseFlags()
 	defer resetRebaseFlags()
 	repo := errVerifyRefRepo{repository.NewMockRepoForTest()}
-	if _, err := validateRebaseRequest(repo, []string{repository.TestCommitG}); err == nil {
+	if err := rebaseReview(repo, []string{repository.TestCommitG}); err == nil {
 		t.Error("expected error for bad target ref")
 	}
 }
@@ -1850,7 +1846,7 @@ func TestRebaseNoArgs(t *testing.T) {
 	resetRebaseFlags()
 	defer resetRebaseFlags()
 	repo := repository.NewMockRepoForTest()
-	_, err := validateRebaseRequest(repo, nil)
+	err := rebaseReview(repo, nil)
 	if err == nil || !strings.Contains(err.Error(), "no matching review") {
 		t.Errorf("expected 'no matching review' error, got %v", err)
 	}
@@ -2053,12 +2049,12 @@ func TestRejectUserEmailError(t *testing.T) {
 	}
 }
 
-func TestBuildCommentFromFlagsUserEmailError(t *testing.T) {
+func TestCommentOnReviewUserEmailError(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
 	repo := errUserEmailRepo{repository.NewMockRepoForTest()}
 	*commentMessage = "test"
-	_, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	err := commentOnReview(repo, []string{repository.TestCommitG})
 	if err == nil || !strings.Contains(err.Error(), "no email") {
 		t.Errorf("expected 'no email' error, got %v", err)
 	}
@@ -2353,7 +2349,7 @@ func TestAbandonReviewAppendNoteError(t *testing.T) {
 	}
 }
 
-// --- commentOnReview buildCommentFromFlags user email error ---
+// --- commentOnReview user email error ---
 
 func TestCommentOnReviewBuildCommentError(t *testing.T) {
 	resetCommentFlags()
@@ -2366,7 +2362,7 @@ func TestCommentOnReviewBuildCommentError(t *testing.T) {
 	}
 }
 
-// --- commentOnPath buildCommentFromFlags user email error ---
+// --- commentOnPath user email error ---
 
 func TestCommentOnPathBuildCommentError(t *testing.T) {
 	resetCommentFlags()
@@ -2380,16 +2376,16 @@ func TestCommentOnPathBuildCommentError(t *testing.T) {
 	}
 }
 
-// --- buildCommentFromFlags location.Check error ---
+// --- commentOnReview location.Check error ---
 
-func TestBuildCommentFromFlagsLocationCheckError(t *testing.T) {
+func TestCommentOnReviewLocationCheckError(t *testing.T) {
 	resetCommentFlags()
 	defer resetCommentFlags()
 	repo := repository.NewMockRepoForTest()
 	*commentMessage = "test"
 	*commentFile = "foo.txt"
 	commentLocation = comment.Range{StartLine: 9999}
-	_, err := buildCommentFromFlags(repo, repository.TestCommitG)
+	err := commentOnReview(repo, []string{repository.TestCommitG})
 	if err == nil || !strings.Contains(err.Error(), "Unable to comment") {
 		t.Errorf("expected location check error, got %v", err)
 	}
@@ -2800,109 +2796,6 @@ func TestCommentOnPathGetDetachedCommentsError(t *testing.T) {
 	}
 }
 
-// --- abandon Request.Write error ---
-// The Request.Write() error path requires json.Marshal to fail, which
-// requires a non-serializable value. We can't trigger this without source
-// changes. Instead, test the AddComment error path via AppendNote wrapper.
-// The abandon AppendNote error is tested in TestAbandonReviewAppendNoteError.
-
-// --- request getReviewCommit error within requestReview ---
-// This is already covered by TestRequestReviewBadSource and
-// TestRequestReviewBadTarget. But let me verify...
-// Actually, request.go:154 is the getReviewCommit call, which fails when
-// source/target are bad. Let me check if it's still uncovered...
-
-// --- submitReview Rebase error ---
-
-func TestSubmitReviewRebaseError(t *testing.T) {
-	resetSubmitFlags()
-	defer resetSubmitFlags()
-	repo := setupAcceptedReview(t)
-	wrappedRepo := errRebaseRepo{repo}
-	*submitRebase = true
-	err := submitReview(wrappedRepo, []string{repository.TestCommitG})
-	if err == nil || !strings.Contains(err.Error(), "rebase failed") {
-		t.Errorf("expected rebase error, got %v", err)
-	}
-}
-
-// --- requestReview with getReviewCommit error (MergeBase fails) ---
-
-func TestRequestReviewGetReviewCommitError(t *testing.T) {
-	resetRequestFlags()
-	defer resetRequestFlags()
-	repo := errMergeBaseRepo{repository.NewMockRepoForTest()}
-	err := requestReview(repo, []string{
-		"-m", "test",
-		"-source", repository.TestReviewRef,
-		"-target", repository.TestTargetRef,
-		"-allow-uncommitted",
-	})
-	if err == nil || !strings.Contains(err.Error(), "merge-base") {
-		t.Errorf("expected merge-base error, got %v", err)
-	}
-}
-
-// --- submitReview IsAncestor error (separate from GetHeadCommit error) ---
-
-func TestSubmitReviewIsAncestorErrorPath(t *testing.T) {
-	resetSubmitFlags()
-	defer resetSubmitFlags()
-	repo := setupAcceptedReview(t)
-	// In submitReview, IsAncestor is called at line 83 after GetHeadCommit.
-	// We need enough successful calls to pass through review.Get, then fail.
-	// review.Get calls: GetSummaryViaRefs->IsAncestor (1), Details->GetHeadCommit->IsAncestor (1)
-	// submitReview calls: GetHeadCommit->IsAncestor (1), then repo.IsAncestor at line 83 (fail)
-	// So fail after 3 calls (threshold of 3, callCount starts at -1 to allow 4 total calls)
-	wrappedRepo := &lateIsAncestorErrRepo{Repo: repo, callCount: -1}
-	err := submitReview(wrappedRepo, []string{repository.TestCommitG})
-	if err == nil {
-		t.Error("expected IsAncestor error in submit")
-	}
-}
-
-// --- submitReview GetHeadCommit error after rebase ---
-
-func TestSubmitReviewGetHeadCommitAfterRebaseError(t *testing.T) {
-	resetSubmitFlags()
-	defer resetSubmitFlags()
-	repo := setupAcceptedReview(t)
-	// IsAncestor call count during submitReview with rebase:
-	//   1. review.Get -> GetSummaryViaRefs -> IsAncestor
-	//   2. review.Get -> Details -> GetHeadCommit -> IsAncestor
-	//   3. submitReview:78 -> r.GetHeadCommit -> IsAncestor
-	//   4. submitReview:83 -> repo.IsAncestor(target, source)
-	//   5. r.Rebase:682 -> r.GetHeadCommit -> IsAncestor
-	//   6. submitReview:112 -> r.GetHeadCommit -> IsAncestor <- fail here
-	// Start callCount at -3 so 5 calls succeed (callCount 3 > threshold 2 on call 6)
-	wrappedRepo := &lateIsAncestorErrRepo{Repo: repo, callCount: -3}
-	*submitRebase = true
-	err := submitReview(wrappedRepo, []string{repository.TestCommitG})
-	if err == nil {
-		t.Error("expected GetHeadCommit error after rebase")
-	}
-}
-
-// --- abandon Request.Write error ---
-// This requires json.Marshal to fail. We can use the writeRequest var
-// injection to simulate this path.
-
-func TestAbandonReviewWriteError(t *testing.T) {
-	resetAbandonFlags()
-	defer resetAbandonFlags()
-	orig := writeRequest
-	defer func() { writeRequest = orig }()
-	writeRequest = func(r *request.Request) (repository.Note, error) {
-		return nil, fmt.Errorf("write error")
-	}
-	*abandonMessage = "msg"
-	repo := repository.NewMockRepoForTest()
-	err := abandonReview(repo, []string{repository.TestCommitG})
-	if err == nil || !strings.Contains(err.Error(), "write error") {
-		t.Errorf("expected write error, got %v", err)
-	}
-}
-
 // --- Additional test for webGenerateStatic with reviews ---
 
 func TestWebGenerateStaticWithReviews(t *testing.T) {
@@ -3269,3 +3162,113 @@ func TestDefaultJsonMarshalIndent(t *testing.T) {
 		t.Error("jsonMarshalIndent should match json.MarshalIndent by default")
 	}
 }
+
+func TestSubmitReviewRebaseError(t *testing.T) {
+	resetSubmitFlags()
+	defer resetSubmitFlags()
+	repo := setupAcceptedReview(t)
+	wrappedRepo := errRebaseRepo{repo}
+	*submitRebase = true
+	err := submitReview(wrappedRepo, []string{repository.TestCommitG})
+	if err == nil || !strings.Contains(err.Error(), "rebase failed") {
+		t.Errorf("expected rebase error, got %v", err)
+	}
+}
+
+func TestSubmitReviewIsAncestorErrorPath(t *testing.T) {
+	resetSubmitFlags()
+	defer resetSubmitFlags()
+	repo := setupAcceptedReview(t)
+	// Let the IsAncestor calls made while loading the review succeed, so
+	// that the one checking whether the target is an ancestor of the
+	// source fails.
+	wrappedRepo := &lateIsAncestorErrRepo{Repo: repo, callCount: -1}
+	err := submitReview(wrappedRepo, []string{repository.TestCommitG})
+	if err == nil {
+		t.Error("expected IsAncestor error in submit")
+	}
+}
+
+func TestSubmitReviewGetHeadCommitAfterRebaseError(t *testing.T) {
+	resetSubmitFlags()
+	defer resetSubmitFlags()
+	repo := setupAcceptedReview(t)
+	// Let the IsAncestor calls made before and during the rebase succeed,
+	// so that reading the head commit of the rebased review fails.
+	wrappedRepo := &lateIsAncestorErrRepo{Repo: repo, callCount: -3}
+	*submitRebase = true
+	err := submitReview(wrappedRepo, []string{repository.TestCommitG})
+	if err == nil {
+		t.Error("expected GetHeadCommit error after rebase")
+	}
+}
+
+func TestRequestReviewGetReviewCommitError(t *testing.T) {
+	resetRequestFlags()
+	defer resetRequestFlags()
+	repo := errMergeBaseRepo{repository.NewMockRepoForTest()}
+	err := requestReview(repo, []string{
+		"-m", "test",
+		"-source", repository.TestReviewRef,
+		"-target", repository.TestTargetRef,
+		"-allow-uncommitted",
+	})
+	if err == nil || !strings.Contains(err.Error(), "merge-base") {
+		t.Errorf("expected merge-base error, got %v", err)
+	}
+}
+
+// errWriteRequestRepo fails to write the notes of review requests.
+type errWriteRequestRepo struct {
+	repository.Repo
+}
+
+func (r errWriteRequestRepo) AppendNote(ref, revision string, note repository.Note) error {
+	if ref == request.Ref {
+		return fmt.Errorf("write error")
+	}
+	return r.Repo.AppendNote(ref, revision, note)
+}
+
+func TestAbandonReviewWriteError(t *testing.T) {
+	resetAbandonFlags()
+	defer resetAbandonFlags()
+	*abandonMessage = "msg"
+	repo := errWriteRequestRepo{repository.NewMockRepoForTest()}
+	err := abandonReview(repo, []string{repository.TestCommitG})
+	if err == nil || !strings.Contains(err.Error(), "write error") {
+		t.Errorf("expected write error, got %v", err)
+	}
+}
+
+func TestCommentHashExists(t *testing.T) {
+	threads := []review.CommentThread{
+		{Hash: "abc"},
+		{Hash: "def", Children: []review.CommentThread{{Hash: "ghi"}}},
+	}
+	if !client.HasComment(threads, "abc") {
+		t.Error("expected to find hash 'abc'")
+	}
+	if !client.HasComment(threads, "ghi") {
+		t.Error("expected to find nested hash 'ghi'")
+	}
+	if client.HasComment(threads, "xyz") {
+		t.Error("should not find hash 'xyz'")
+	}
+}
+
+func TestValidateRebaseRequest(t *testing.T) {
+	resetRebaseFlags()
+	defer resetRebaseFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := rebaseReview(repo, []string{repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		t.Error("expected non-nil review")
+	}
+}
@@ -17,11 +17,12 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"time"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/input"
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
@@ -40,6 +41,7 @@ var (
 	commentLgtm        = commentFlagSet.Bool("lgtm", false, "'Looks Good To Me'. Set this to express your approval. This cannot be combined with nmw")
 	commentNmw         = commentFlagSet.Bool("nmw", false, "'Needs More Work'. Set this to express your disapproval. This cannot be combined with lgtm")
 	commentDate        = commentFlagSet.String("date", "", "comment date")
+	commentSign        = commentFlagSet.Bool("S", false, signFlagUsage)
 )
 
 func init() {
@@ -52,24 +54,11 @@ including) the 4th character of the 7th line, use:
     -l 2+5:7+4`)
 }
 
-// commentHashExists checks if the given comment hash exists in the given comment threads.
-func commentHashExists(hashToFind string, threads []review.CommentThread) bool {
-	for _, thread := range threads {
-		if thread.Hash == hashToFind {
-			return true
-		}
-		if commentHashExists(hashToFind, thread.Children) {
-			return true
-		}
-	}
-	return false
-}
-
 func validateArgs(repo repository.Repo, args []string, threads []review.CommentThread) error {
 	if *commentLgtm && *commentNmw {
 		return errors.New("You cannot combine the flags -lgtm and -nmw.")
 	}
-	if *commentParent != "" && !commentHashExists(*commentParent, threads) {
+	if *commentParent != "" && !client.HasComment(threads, *commentParent) {
 		return errors.New("There is no matching parent comment.")
 	}
 
@@ -90,81 +79,56 @@ func validateArgs(repo repository.Repo, args []string, threads []review.CommentT
 	return nil
 }
 
-func buildCommentFromFlags(repo repository.Repo, commentedUponCommit string) (*comment.Comment, error) {
-	location := comment.Location{
-		Commit: commentedUponCommit,
-	}
-	if *commentFile != "" {
-		location.Path = *commentFile
-	}
-	location.Range = &commentLocation
-	if err := location.Check(repo); err != nil {
-		return nil, fmt.Errorf("Unable to comment on the given location: %v", err)
-	}
-
-	userEmail, err := repo.GetUserEmail()
-	if err != nil {
-		return nil, err
-	}
-
+// commentOptionsFromFlags returns the contents of the comment given by the
+// flags.
+func commentOptionsFromFlags() (client.CommentOptions, error) {
 	date, err := GetDate(*commentDate)
 	if err != nil {
-		return nil, err
+		return client.CommentOptions{}, err
 	}
-	if date == nil {
-		now := time.Now()
-		date = &now
+	opts := client.CommentOptions{
+		Message: *commentMessage,
+		Location: &comment.Location{
+			Path:  *commentFile,
+			Range: &commentLocation,
+		},
+		Parent: *commentParent,
+		Sign:   *commentSign,
 	}
-	timestamp := FormatDate(date)
-	c := comment.New(userEmail, *commentMessage)
-	c.Location = &location
-	c.Parent = *commentParent
-	if len(timestamp) > 0 {
-		c.Timestamp = timestamp
+	if date != nil {
+		opts.Time = *date
 	}
 	if *commentLgtm || *commentNmw {
 		resolved := *commentLgtm
-		c.Resolved = &resolved
+		opts.Resolved = &resolved
 	}
-
-	return &c, nil
+	return opts, nil
 }
 
 // commentOnReview adds a comment to the current code review.
 func commentOnReview(repo repository.Repo, args []string) error {
-	var r *review.Review
-	var err error
-
 	if len(args) > 1 {
 		return errors.New("Only commenting on a single review is supported.")
 	}
+	var revision string
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
+		revision = args[0]
 	}
-
+	ctx := context.Background()
+	cl := client.New(repo)
+	r, err := cl.Get(ctx, revision)
 	if err != nil {
-		return fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return errors.New("There is no matching review.")
-	}
-
-	if err := validateArgs(repo, args, r.Comments); err != nil {
 		return err
 	}
-
-	commentedUponCommit, err := r.GetHeadCommit()
-	if err != nil {
+	if err := validateArgs(repo, args, r.Comments); err != nil {
 		return err
 	}
-
-	c, err := buildCommentFromFlags(r.Repo, commentedUponCommit)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		return err
 	}
-	return r.AddComment(*c)
+	_, err = cl.Comment(ctx, r.Revision, opts)
+	return err
 }
 
 // commentOnPath adds a comment about the given file without attaching it to a review.
@@ -179,12 +143,6 @@ func commentOnPath(repo repository.Repo, args []string) error {
 	var commentedUponRef string
 	if len(args) == 1 {
 		commentedUponRef = args[0]
-	} else {
-		commentedUponRef = "HEAD"
-	}
-	commentedUponCommit, err := repo.ResolveRefCommit(commentedUponRef)
-	if err != nil {
-		return fmt.Errorf("Failed to resolve the comment location: %v\n", err)
 	}
 
 	commentThreads, err := review.GetDetachedComments(repo, *commentFile)
@@ -194,12 +152,12 @@ func commentOnPath(repo repository.Repo, args []string) error {
 	if err := validateArgs(repo, args, commentThreads); err != nil {
 		return err
 	}
-
-	c, err := buildCommentFromFlags(repo, commentedUponCommit)
+	opts, err := commentOptionsFromFlags()
 	if err != nil {
 		return err
 	}
-	return review.AddDetachedComment(repo, c)
+	_, err = client.New(repo).AddDetachedComment(context.Background(), commentedUponRef, opts)
+	return err
 }
 
 // commentCmd defines the "comment" subcommand.
@@ -216,4 +174,5 @@ var commentCmd = &Command{
 		}
 		return commentOnReview(repo, args)
 	},
+	changesReviews: true,
 }
@@ -0,0 +1,107 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+)
+
+// defaultCompactAge is how old history must be for it to be compacted, when
+// no cutoff is given.
+const defaultCompactAge = 90 * 24 * time.Hour
+
+// compactInstructions explains how to share the compacted refs, since
+// compacting them only changes the local copies.
+const compactInstructions = `
+To share the compacted history, pull from each remote and then immediately
+force-push to it:
+
+  git appraise pull <remote>
+  git push --force <remote> '%s:%s' '%s:%s'
+
+Remotes that validate pushes with "git appraise validate-push" reject the
+push if it would drop notes that were pushed since the pull. In that case,
+pull and compact again before retrying.
+
+Other clones compact their own copies when they next run "git appraise pull",
+so that the squashed history is not merged back in.
+`
+
+var compactFlagSet = flag.NewFlagSet("compact", flag.ExitOnError)
+
+var compactBefore = compactFlagSet.String("before", "", "Compact the history from before this date (YYYY-MM-DD or RFC 3339). Defaults to 90 days ago.")
+
+// parseCompactCutoff parses the date before which history is compacted.
+func parseCompactCutoff(date string) (time.Time, error) {
+	if date == "" {
+		return time.Now().Add(-defaultCompactAge), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", date, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid date %q; expected YYYY-MM-DD or RFC 3339.", date)
+}
+
+// compact squashes the old history of the review notes and archives.
+func compact(repo repository.Repo, args []string) error {
+	compactFlagSet.Parse(args)
+	if len(compactFlagSet.Args()) > 0 {
+		return errors.New("The compact command does not take any arguments.")
+	}
+	before, err := parseCompactCutoff(*compactBefore)
+	if err != nil {
+		return err
+	}
+
+	notes, err := repo.CompactNotes(notesRefPattern, before)
+	if err != nil {
+		return err
+	}
+	archives, err := repo.CompactArchives(archiveRefPattern, before)
+	if err != nil {
+		return err
+	}
+	compacted := append(notes, archives...)
+	if len(compacted) == 0 {
+		fmt.Printf("There is no history before %s to compact.\n", before.Format(time.DateOnly))
+		return nil
+	}
+	fmt.Printf("Compacted the history before %s of:\n  %s\n", before.Format(time.DateOnly), strings.Join(compacted, "\n  "))
+	notesRefs, archiveRefs := namespacedRef(repo, notesRefPattern), namespacedRef(repo, archiveRefPattern)
+	fmt.Printf(compactInstructions, notesRefs, notesRefs, archiveRefs, archiveRefs)
+	return nil
+}
+
+// compactCmd defines the "compact" subcommand.
+var compactCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s compact [<option>...]\n\nOptions:\n", arg0)
+		compactFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return compact(repo, args)
+	},
+}
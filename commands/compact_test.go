@@ -0,0 +1,120 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+)
+
+// compactRepo records the cutoffs that it is asked to compact before.
+type compactRepo struct {
+	repository.Repo
+	notesBefore, archivesBefore time.Time
+	notesErr, archivesErr       error
+}
+
+func (r *compactRepo) CompactNotes(notesRefPattern string, before time.Time) ([]string, error) {
+	r.notesBefore = before
+	return []string{"refs/notes/devtools/discuss"}, r.notesErr
+}
+
+func (r *compactRepo) CompactArchives(archiveRefPattern string, before time.Time) ([]string, error) {
+	r.archivesBefore = before
+	return []string{"refs/devtools/archives/reviews"}, r.archivesErr
+}
+
+func TestCompact(t *testing.T) {
+	defer resetCompactFlags()
+	resetCompactFlags()
+	repo := &compactRepo{Repo: repository.NewMockRepoForTest()}
+	out := captureStdout(t, func() {
+		if err := compact(repo, []string{"-before", "2024-01-02"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)
+	if !repo.notesBefore.Equal(want) || !repo.archivesBefore.Equal(want) {
+		t.Errorf("unexpected cutoffs %v and %v", repo.notesBefore, repo.archivesBefore)
+	}
+	for _, s := range []string{"before 2024-01-02", "refs/notes/devtools/discuss", "refs/devtools/archives/reviews", "git push --force"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected the output to contain %q, got %q", s, out)
+		}
+	}
+
+	resetCompactFlags()
+	if err := compact(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if age := time.Since(repo.notesBefore); age < defaultCompactAge || age > defaultCompactAge+time.Minute {
+		t.Errorf("unexpected default cutoff %v", repo.notesBefore)
+	}
+}
+
+func TestCompactNothing(t *testing.T) {
+	defer resetCompactFlags()
+	resetCompactFlags()
+	out := captureStdout(t, func() {
+		if err := compact(repository.NewMockRepoForTest(), []string{"-before", "2024-01-02T15:04:05Z"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "no history before 2024-01-02") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestCompactNamespace(t *testing.T) {
+	defer resetCompactFlags()
+	resetCompactFlags()
+	repo, err := repository.NewNamespacedRepo(&compactRepo{Repo: repository.NewMockRepoForTest()}, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureStdout(t, func() {
+		if err := compact(repo, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "'refs/notes/security/*:refs/notes/security/*' 'refs/devtools/security/archives/*:refs/devtools/security/archives/*'") {
+		t.Errorf("expected the instructions to use the namespaced refs, got %q", out)
+	}
+}
+
+func TestCompactErrors(t *testing.T) {
+	defer resetCompactFlags()
+	resetCompactFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := compact(repo, []string{"extra"}); err == nil {
+		t.Error("expected an error for an extra argument")
+	}
+	if err := compact(repo, []string{"-before", "yesterday"}); err == nil {
+		t.Error("expected an error for an invalid date")
+	}
+	resetCompactFlags()
+	if err := compact(&compactRepo{Repo: repo, notesErr: errors.New("notes failed")}, nil); err == nil {
+		t.Error("expected an error compacting the notes")
+	}
+	if err := compact(&compactRepo{Repo: repo, archivesErr: errors.New("archives failed")}, nil); err == nil {
+		t.Error("expected an error compacting the archives")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+type errEncryptRepo struct {
+	repository.Repo
+}
+
+func (r errEncryptRepo) EncryptPayload(payload []byte) (string, error) {
+	return "", fmt.Errorf("no recipients")
+}
+
+// requestPrivateReview requests an encrypted review of TestCommitG.
+func requestPrivateReview(t *testing.T, repo repository.Repo, args ...string) {
+	t.Helper()
+	defer resetRequestFlags()
+	resetRequestFlags()
+	args = append(args, "-m", "private fix", "-date", "2005-04-07 22:13:13",
+		"-source", repository.TestReviewRef, "-target", repository.TestTargetRef, repository.TestCommitG)
+	captureStdout(t, func() {
+		if err := requestReview(repo, args); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// assertNotWritten checks that none of the notes on TestCommitG contain the
+// given plaintext.
+func assertNotWritten(t *testing.T, repo repository.Repo, plaintext string) {
+	t.Helper()
+	for _, ref := range []string{request.Ref, comment.Ref} {
+		for _, note := range repo.GetNotes(ref, repository.TestCommitG) {
+			if strings.Contains(string(note), plaintext) {
+				t.Errorf("expected %q not to be written, got %q", plaintext, note)
+			}
+		}
+	}
+}
+
+func TestEncryptedRequest(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if err := repo.AddConfigValue(repository.EncryptToKey, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	requestPrivateReview(t, repo, "-encrypt", "-S")
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.VerifySignatures()
+	if r.Request.Encrypted == "" || r.Request.Description != "private fix" || !r.RequestVerified {
+		t.Errorf("expected a verified, encrypted request, got %+v", r.Request)
+	}
+	assertNotWritten(t, repo, "private fix")
+
+	// Updating the request keeps the review private.
+	requestPrivateReview(t, repo)
+	assertNotWritten(t, repo, "private fix")
+}
+
+func TestEncryptedComments(t *testing.T) {
+	defer resetAcceptFlags()
+	defer resetRejectFlags()
+	defer resetCommentFlags()
+	defer resetAbandonFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := repo.AddConfigValue(repository.EncryptToKey, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	requestPrivateReview(t, repo, "-encrypt")
+
+	*commentSign = true
+	*commentMessage = "private comment"
+	if err := commentOnReview(repo, []string{repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if thread := latestThread(t, repo, repository.TestCommitG); thread.Comment.Encrypted == "" || !thread.Verified {
+		t.Errorf("expected a verified, encrypted comment, got %+v", thread)
+	}
+	if err := acceptReview(repo, []string{"-m", "private approval", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rejectReview(repo, []string{"-m", "private rejection", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if err := abandonReview(repo, []string{"-m", "private abandonment", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptions := make(map[string]bool)
+	for _, thread := range r.Comments {
+		descriptions[thread.Comment.Description] = true
+	}
+	for _, plaintext := range []string{"private fix", "private comment", "private approval", "private rejection", "private abandonment"} {
+		assertNotWritten(t, repo, plaintext)
+		if plaintext != "private fix" && !descriptions[plaintext] {
+			t.Errorf("expected the comment %q to be decrypted, got %v", plaintext, descriptions)
+		}
+	}
+}
+
+func TestEncryptErrors(t *testing.T) {
+	defer resetAcceptFlags()
+	defer resetRejectFlags()
+	defer resetCommentFlags()
+	defer resetAbandonFlags()
+	defer resetRequestFlags()
+	base := repository.NewMockRepoForTest()
+	if err := base.AddConfigValue(repository.EncryptToKey, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	requestPrivateReview(t, base, "-encrypt")
+	repo := errEncryptRepo{base}
+	if err := acceptReview(repo, []string{"-m", "LGTM", repository.TestCommitG}); err == nil {
+		t.Error("expected accept to fail when encrypting fails")
+	}
+	if err := rejectReview(repo, []string{"-m", "NMW", repository.TestCommitG}); err == nil {
+		t.Error("expected reject to fail when encrypting fails")
+	}
+	if err := abandonReview(repo, []string{"-m", "abandon", repository.TestCommitG}); err == nil {
+		t.Error("expected abandon to fail when encrypting fails")
+	}
+	*commentMessage = "comment"
+	if err := commentOnReview(repo, []string{repository.TestCommitG}); err == nil {
+		t.Error("expected comment to fail when encrypting fails")
+	}
+	resetRequestFlags()
+	err := requestReview(repo, []string{"-m", "review", "-allow-uncommitted",
+		"-source", repository.TestReviewRef, "-target", repository.TestTargetRef, repository.TestCommitG})
+	if err == nil || !strings.Contains(err.Error(), "Failed to encrypt") {
+		t.Errorf("expected request to fail when encrypting fails, got %v", err)
+	}
+
+	// Comments without a description are not encrypted.
+	if err := acceptReview(repo, []string{"-m", "", repository.TestCommitG}); err != nil {
+		t.Errorf("unexpected error accepting without a message: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+)
+
+var eventsFlagSet = flag.NewFlagSet("events", flag.ExitOnError)
+
+var (
+	eventsSince  = eventsFlagSet.String("since", "", "Only print the events after this cursor, which is taken from the \"cursor\" field of an earlier event.")
+	eventsCursor = eventsFlagSet.Bool("cursor", false, "After the events, print a line with only the \"cursor\" field, from which to resume even if no events were printed.")
+)
+
+// printEvents prints the events in the history of the review notes as
+// newline-delimited JSON.
+func printEvents(repo repository.Repo, args []string) error {
+	eventsFlagSet.Parse(args)
+	if len(eventsFlagSet.Args()) > 0 {
+		return errors.New("The events command does not take any arguments.")
+	}
+	changes, cursor, err := events.Since(repo, *eventsSince)
+	if err != nil {
+		return err
+	}
+	for _, e := range changes {
+		// Events always encode successfully.
+		line, _ := json.Marshal(e)
+		fmt.Println(string(line))
+	}
+	if *eventsCursor {
+		line, _ := json.Marshal(struct {
+			Cursor string `json:"cursor"`
+		}{cursor})
+		fmt.Println(string(line))
+	}
+	return nil
+}
+
+// eventsCmd defines the "events" subcommand.
+var eventsCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s events [<option>...]\n\nOptions:\n", arg0)
+		eventsFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return printEvents(repo, args)
+	},
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+func TestPrintEvents(t *testing.T) {
+	defer resetEventsFlags()
+	repo := repository.NewMockRepoForTest()
+	out := captureStdout(t, func() {
+		if err := printEvents(repo, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var last events.Event
+	for _, line := range lines {
+		if err := json.Unmarshal([]byte(line), &last); err != nil {
+			t.Fatalf("line %q is not an event: %v", line, err)
+		}
+	}
+	if last.Cursor == "" {
+		t.Fatalf("last event %+v has no cursor", last)
+	}
+
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, repository.Note(`{"timestamp": "0000000010", "author": "a", "description": "nit"}`)); err != nil {
+		t.Fatal(err)
+	}
+	out = captureStdout(t, func() {
+		if err := printEvents(repo, []string{"-since", last.Cursor}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var event events.Event
+	if err := json.Unmarshal([]byte(out), &event); err != nil || strings.Count(out, "\n") != 1 {
+		t.Fatalf("output = %q, %v", out, err)
+	}
+	if event.Type != events.CommentAdded || event.Comment.Description != "nit" {
+		t.Errorf("event = %+v", event)
+	}
+}
+
+func TestPrintEventsCursor(t *testing.T) {
+	defer resetEventsFlags()
+	repo := repository.NewMockRepoForTest()
+	_, cursor, err := events.Since(repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without any new events, only the cursor is printed.
+	out := captureStdout(t, func() {
+		if err := printEvents(repo, []string{"-cursor", "-since", cursor}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var last events.Event
+	if err := json.Unmarshal([]byte(out), &last); err != nil || strings.Count(out, "\n") != 1 || last.Cursor != cursor {
+		t.Fatalf("output = %q, %v", out, err)
+	}
+
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, repository.Note(`{"timestamp": "0000000010", "author": "a", "description": "nit"}`)); err != nil {
+		t.Fatal(err)
+	}
+	out = captureStdout(t, func() {
+		if err := printEvents(repo, []string{"-cursor", "-since", cursor}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("output = %q", out)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &last); err != nil || last.Type != "" || last.Cursor == cursor || last.Cursor == "" {
+		t.Errorf("unexpected final cursor %q: %v", lines[1], err)
+	}
+}
+
+func TestPrintEventsErrors(t *testing.T) {
+	defer resetEventsFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := printEvents(repo, []string{"extra"}); err == nil {
+		t.Error("expected an error for extra arguments")
+	}
+	if err := printEvents(repo, []string{"-since", "bad"}); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
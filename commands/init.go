@@ -0,0 +1,329 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"msrl.dev/git-appraise/repository"
+)
+
+// installedConfigKey is the multi-valued config key used to record each
+// "<key> <value>" config entry added by init, so that uninstall removes
+// exactly those entries and nothing that the user had set themselves.
+const installedConfigKey = "appraise.installed"
+
+const (
+	hookBlockBegin = "# BEGIN git-appraise"
+	hookBlockEnd   = "# END git-appraise"
+	hookShebang    = "#!/bin/sh"
+)
+
+// The hooks guard against recursion using an environment variable, since
+// "git appraise push" itself runs "git push" and hence the pre-push hook.
+//
+// The pre-push hook pushes the review refs itself, after merging in those of
+// the remote, which is why init does not also add push refspecs for them.
+// When the push already includes the review refs anyway (e.g. due to push
+// refspecs that the user configured), git has already chosen which commits
+// to push before the hook runs. So the hook then only merges in the remote's
+// review metadata, and if the two had diverged, the review refs are rejected
+// by the remote and have to be pushed a second time.
+const prePushHook = `if [ -z "$GIT_APPRAISE_HOOK" ]; then
+	export GIT_APPRAISE_HOOK=1
+	if grep -q " %[1]s"; then
+		git appraise pull %[2]s ||
+			echo "git-appraise: failed to pull review metadata from "%[2]s >&2
+	else
+		git appraise pull %[2]s && git appraise push %[2]s ||
+			echo "git-appraise: failed to sync review metadata with "%[2]s >&2
+	fi
+fi`
+
+const postMergeHook = `if [ -z "$GIT_APPRAISE_HOOK" ]; then
+	export GIT_APPRAISE_HOOK=1
+	git appraise pull %s ||
+		echo "git-appraise: failed to pull review metadata from %s" >&2
+fi`
+
+var initFlagSet = flag.NewFlagSet("init", flag.ExitOnError)
+
+var (
+	initNoHooks = initFlagSet.Bool("no-hooks", false, "Do not install the pre-push and post-merge hooks.")
+)
+
+// hooksDir returns the directory that git runs hooks from.
+func hooksDir(repo repository.Repo) (string, error) {
+	hooksPaths, err := repo.GetConfigValues("core.hooksPath")
+	if err != nil {
+		return "", err
+	}
+	if len(hooksPaths) > 0 {
+		dir := hooksPaths[len(hooksPaths)-1]
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repo.GetPath(), dir)
+		}
+		return dir, nil
+	}
+	dataDir, err := repo.GetDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "hooks"), nil
+}
+
+// removeHookBlock returns the given hook script with the git-appraise block removed.
+func removeHookBlock(script string) string {
+	start := strings.Index(script, hookBlockBegin)
+	if start < 0 {
+		return script
+	}
+	end := strings.Index(script[start:], hookBlockEnd)
+	if end < 0 {
+		return script
+	}
+	end += start + len(hookBlockEnd)
+	if end < len(script) && script[end] == '\n' {
+		end++
+	}
+	return script[:start] + script[end:]
+}
+
+// installHook adds the given commands to a hook script, creating the script
+// if necessary and replacing any block previously added by init.
+func installHook(dir, name, commands string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	contents, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	script := removeHookBlock(string(contents))
+	if script == "" {
+		script = hookShebang + "\n"
+	} else if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+	script += hookBlockBegin + "\n" + commands + "\n" + hookBlockEnd + "\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0755)
+}
+
+// uninstallHook removes the block added by init from a hook script, and
+// removes the script entirely if nothing else is left in it.
+func uninstallHook(dir, name string) error {
+	path := filepath.Join(dir, name)
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	script := removeHookBlock(string(contents))
+	if script == string(contents) {
+		return nil
+	}
+	if remaining := strings.TrimSpace(script); remaining == "" || remaining == hookShebang {
+		return os.Remove(path)
+	}
+	return os.WriteFile(path, []byte(script), 0755)
+}
+
+// addConfigValue adds a config value unless it is already set, and records
+// that it was added so that it can later be removed by uninstall.
+func addConfigValue(repo repository.Repo, key, value string) error {
+	values, err := repo.GetConfigValues(key)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(values, value) {
+		return nil
+	}
+	if err := repo.AddConfigValue(key, value); err != nil {
+		return err
+	}
+	return repo.AddConfigValue(installedConfigKey, key+" "+value)
+}
+
+// sidecarStore returns the separate repo that stores the reviews of the given
+// repo (see repository.ReviewStoreKey), or nil if the repo stores them itself.
+func sidecarStore(repo repository.Repo) *repository.GitRepo {
+	for {
+		switch r := repo.(type) {
+		case *repository.NamespacedRepo:
+			repo = r.Repo
+		case *repository.SidecarRepo:
+			return r.Store()
+		default:
+			return nil
+		}
+	}
+}
+
+// installAppraise configures a repo so that the review metadata is fetched and
+// pushed along with the code, and shown in the output of "git log".
+//
+// Unless the hooks are disabled, the review refs are pushed by the pre-push
+// hook rather than by push refspecs, so that the hook can first merge in the
+// remote's review metadata. When the reviews are stored in a sidecar repo,
+// the notes refspecs go on the remote of that repo instead, and the archive
+// refs, which stay local to the code repo, are not configured at all.
+func installAppraise(repo repository.Repo, args []string) error {
+	initFlagSet.Parse(args)
+	initArgs := initFlagSet.Args()
+
+	if len(initArgs) > 1 {
+		return errors.New("Only configuring one remote at a time is supported.")
+	}
+
+	remote := "origin"
+	if len(initArgs) == 1 {
+		remote = initArgs[0]
+	}
+
+	fetchKey, pushKey := "remote."+remote+".fetch", "remote."+remote+".push"
+	notesRefs, archiveRefs := namespacedRef(repo, notesRefPattern), namespacedRef(repo, archiveRefPattern)
+	// The hooks run in the code repo, so with a sidecar store the pre-push
+	// hook has to name the store's remote rather than the one pushed to.
+	var notesRepo repository.Repo = repo
+	hookRemote := `"$1"`
+	if store := sidecarStore(repo); store != nil {
+		notesRepo, hookRemote = store, remote
+	}
+
+	var notesConfig, codeConfig [][2]string
+	notesConfig = append(notesConfig, [2]string{fetchKey, "+" + notesRefs + ":" + repository.RemoteNotesRef(remote, notesRefs)})
+	if notesRepo == repo {
+		codeConfig = append(codeConfig, [2]string{fetchKey, "+" + archiveRefs + ":" + repository.RemoteDevtoolsRef(remote, archiveRefs)})
+	}
+	if *initNoHooks {
+		existingPush, err := notesRepo.GetConfigValues(pushKey)
+		if err != nil {
+			return err
+		}
+		if len(existingPush) == 0 && notesRepo == repo {
+			// Once any push refspecs are configured, git no longer pushes the
+			// current branch by default, so keep doing that explicitly.
+			notesConfig = append(notesConfig, [2]string{pushKey, "HEAD"})
+		}
+		notesConfig = append(notesConfig, [2]string{pushKey, notesRefs + ":" + notesRefs})
+		if notesRepo == repo {
+			codeConfig = append(codeConfig, [2]string{pushKey, archiveRefs + ":" + archiveRefs})
+		}
+	}
+	if notesRepo == repo {
+		codeConfig = append(codeConfig, [2]string{"notes.displayRef", notesRefs})
+	}
+	for _, kv := range notesConfig {
+		if err := addConfigValue(notesRepo, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	for _, kv := range codeConfig {
+		if err := addConfigValue(repo, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	if *initNoHooks {
+		return nil
+	}
+	dir, err := hooksDir(repo)
+	if err != nil {
+		return err
+	}
+	if err := installHook(dir, "pre-push", fmt.Sprintf(prePushHook, strings.TrimSuffix(notesRefs, "*"), hookRemote)); err != nil {
+		return err
+	}
+	return installHook(dir, "post-merge", fmt.Sprintf(postMergeHook, remote, remote))
+}
+
+// removeInstalledConfig removes the config entries recorded by addConfigValue.
+func removeInstalledConfig(repo repository.Repo) error {
+	installed, err := repo.GetConfigValues(installedConfigKey)
+	if err != nil {
+		return err
+	}
+	for _, entry := range installed {
+		key, value, ok := strings.Cut(entry, " ")
+		if ok {
+			if err := repo.RemoveConfigValue(key, value); err != nil {
+				return err
+			}
+		}
+		if err := repo.RemoveConfigValue(installedConfigKey, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uninstallAppraise reverts the changes made by installAppraise.
+func uninstallAppraise(repo repository.Repo, args []string) error {
+	if len(args) > 0 {
+		return errors.New("The uninstall command does not take any arguments.")
+	}
+
+	if err := removeInstalledConfig(repo); err != nil {
+		return err
+	}
+	if store := sidecarStore(repo); store != nil {
+		if err := removeInstalledConfig(store); err != nil {
+			return err
+		}
+	}
+
+	dir, err := hooksDir(repo)
+	if err != nil {
+		return err
+	}
+	if err := uninstallHook(dir, "pre-push"); err != nil {
+		return err
+	}
+	return uninstallHook(dir, "post-merge")
+}
+
+// initCmd defines the "init" subcommand.
+var initCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s init [<option>...] [<remote>]\n\nOptions:\n", arg0)
+		initFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return installAppraise(repo, args)
+	},
+}
+
+// uninstallCmd defines the "uninstall" subcommand.
+var uninstallCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s uninstall\n", arg0)
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return uninstallAppraise(repo, args)
+	},
+}
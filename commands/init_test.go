@@ -0,0 +1,433 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+)
+
+func resetInitFlags() {
+	*initNoHooks = false
+}
+
+// dataDirRepo places the repo's data dir (and hence its hooks) in a temp dir.
+type dataDirRepo struct {
+	repository.Repo
+	dataDir    string
+	dataDirErr error
+}
+
+func (r *dataDirRepo) GetDataDir() (string, error) { return r.dataDir, r.dataDirErr }
+func (r *dataDirRepo) GetPath() string             { return filepath.Dir(r.dataDir) }
+
+func newDataDirRepo(t *testing.T) *dataDirRepo {
+	return &dataDirRepo{
+		Repo:    repository.NewMockRepoForTest(),
+		dataDir: filepath.Join(t.TempDir(), ".git"),
+	}
+}
+
+// configErrRepo fails the config operations selected by its fields.
+type configErrRepo struct {
+	repository.Repo
+	getErrKey string
+	addErr    error
+	removeErr error
+}
+
+func (r *configErrRepo) GetConfigValues(key string) ([]string, error) {
+	if key == r.getErrKey {
+		return nil, fmt.Errorf("config read failed")
+	}
+	return r.Repo.GetConfigValues(key)
+}
+
+func (r *configErrRepo) AddConfigValue(key, value string) error {
+	if r.addErr != nil {
+		return r.addErr
+	}
+	return r.Repo.AddConfigValue(key, value)
+}
+
+func (r *configErrRepo) RemoveConfigValue(key, value string) error {
+	if r.removeErr != nil {
+		return r.removeErr
+	}
+	return r.Repo.RemoveConfigValue(key, value)
+}
+
+func readHook(t *testing.T, repo *dataDirRepo, name string) string {
+	t.Helper()
+	contents, err := os.ReadFile(filepath.Join(repo.dataDir, "hooks", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestInstallAndUninstall(t *testing.T) {
+	defer resetInitFlags()
+	repo := newDataDirRepo(t)
+	if err := repo.AddConfigValue("remote.upstream.fetch", "+refs/heads/*:refs/remotes/upstream/*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := installAppraise(repo, []string{"upstream"}); err != nil {
+		t.Fatal(err)
+	}
+	// Running init a second time should not add anything new.
+	if err := installAppraise(repo, []string{"upstream"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch, _ := repo.GetConfigValues("remote.upstream.fetch")
+	expectedFetch := []string{
+		"+refs/heads/*:refs/remotes/upstream/*",
+		"+refs/notes/devtools/*:refs/notes/remotes/upstream/devtools/*",
+		"+refs/devtools/archives/*:refs/remoteDevtools/upstream/archives/*",
+	}
+	if !slices.Equal(fetch, expectedFetch) {
+		t.Errorf("unexpected fetch refspecs %q", fetch)
+	}
+	// The pre-push hook pushes the review refs, after pulling the remote's.
+	if push, _ := repo.GetConfigValues("remote.upstream.push"); len(push) != 0 {
+		t.Errorf("unexpected push refspecs %q", push)
+	}
+	if displayRef, _ := repo.GetConfigValues("notes.displayRef"); !slices.Equal(displayRef, []string{notesRefPattern}) {
+		t.Errorf("unexpected notes.displayRef %q", displayRef)
+	}
+
+	prePush := readHook(t, repo, "pre-push")
+	if !strings.HasPrefix(prePush, hookShebang+"\n") || strings.Count(prePush, hookBlockBegin) != 1 ||
+		!strings.Contains(prePush, `git appraise push "$1"`) {
+		t.Errorf("unexpected pre-push hook %q", prePush)
+	}
+	if postMerge := readHook(t, repo, "post-merge"); !strings.Contains(postMerge, "git appraise pull upstream") {
+		t.Errorf("unexpected post-merge hook %q", postMerge)
+	}
+	if info, err := os.Stat(filepath.Join(repo.dataDir, "hooks", "pre-push")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected an executable pre-push hook: %v", err)
+	}
+
+	if err := uninstallAppraise(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fetch, _ := repo.GetConfigValues("remote.upstream.fetch"); !slices.Equal(fetch, expectedFetch[:1]) {
+		t.Errorf("unexpected fetch refspecs after uninstall %q", fetch)
+	}
+	for _, key := range []string{"remote.upstream.push", "notes.displayRef", installedConfigKey} {
+		if values, _ := repo.GetConfigValues(key); len(values) != 0 {
+			t.Errorf("unexpected values for %q after uninstall: %q", key, values)
+		}
+	}
+	for _, name := range []string{"pre-push", "post-merge"} {
+		if _, err := os.Stat(filepath.Join(repo.dataDir, "hooks", name)); !os.IsNotExist(err) {
+			t.Errorf("expected the %s hook to be removed: %v", name, err)
+		}
+	}
+}
+
+func TestInstallNamespace(t *testing.T) {
+	defer resetInitFlags()
+	dataDirRepo := newDataDirRepo(t)
+	repo, err := repository.NewNamespacedRepo(dataDirRepo, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := installAppraise(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch, _ := repo.GetConfigValues("remote.origin.fetch")
+	expectedFetch := []string{
+		"+refs/notes/security/*:refs/notes/remotes/origin/security/*",
+		"+refs/devtools/security/archives/*:refs/remoteDevtools/origin/security/archives/*",
+	}
+	if !slices.Equal(fetch, expectedFetch) {
+		t.Errorf("unexpected fetch refspecs %q", fetch)
+	}
+	if displayRef, _ := repo.GetConfigValues("notes.displayRef"); !slices.Equal(displayRef, []string{"refs/notes/security/*"}) {
+		t.Errorf("unexpected notes.displayRef %q", displayRef)
+	}
+	if prePush := readHook(t, dataDirRepo, "pre-push"); !strings.Contains(prePush, `grep -q " refs/notes/security/"`) {
+		t.Errorf("unexpected pre-push hook %q", prePush)
+	}
+}
+
+func TestInstallKeepsExistingPushRefspecsAndHooks(t *testing.T) {
+	defer resetInitFlags()
+	repo := newDataDirRepo(t)
+	if err := repo.AddConfigValue("remote.origin.push", "refs/heads/main:refs/heads/main"); err != nil {
+		t.Fatal(err)
+	}
+	hooks := filepath.Join(repo.dataDir, "hooks")
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		t.Fatal(err)
+	}
+	existing := "#!/bin/sh\nmake test"
+	if err := os.WriteFile(filepath.Join(hooks, "pre-push"), []byte(existing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := installAppraise(repo, []string{"-no-hooks"}); err != nil {
+		t.Fatal(err)
+	}
+	push, _ := repo.GetConfigValues("remote.origin.push")
+	if slices.Contains(push, "HEAD") || push[0] != "refs/heads/main:refs/heads/main" {
+		t.Errorf("unexpected push refspecs %q", push)
+	}
+	resetInitFlags()
+	if err := installAppraise(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if prePush := readHook(t, repo, "pre-push"); !strings.HasPrefix(prePush, existing+"\n"+hookBlockBegin) {
+		t.Errorf("unexpected pre-push hook %q", prePush)
+	}
+	if err := uninstallAppraise(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if prePush := readHook(t, repo, "pre-push"); prePush != existing+"\n" {
+		t.Errorf("unexpected pre-push hook after uninstall %q", prePush)
+	}
+	if push, _ := repo.GetConfigValues("remote.origin.push"); !slices.Equal(push, []string{"refs/heads/main:refs/heads/main"}) {
+		t.Errorf("unexpected push refspecs after uninstall %q", push)
+	}
+}
+
+func TestInstallNoHooks(t *testing.T) {
+	defer resetInitFlags()
+	repo := newDataDirRepo(t)
+	if err := installAppraise(repo, []string{"-no-hooks"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.dataDir, "hooks")); !os.IsNotExist(err) {
+		t.Errorf("expected no hooks to be installed: %v", err)
+	}
+	// Without the hooks, plain "git push" has to push the review refs.
+	push, _ := repo.GetConfigValues("remote.origin.push")
+	expectedPush := []string{"HEAD", "refs/notes/devtools/*:refs/notes/devtools/*", "refs/devtools/archives/*:refs/devtools/archives/*"}
+	if !slices.Equal(push, expectedPush) {
+		t.Errorf("unexpected push refspecs %q", push)
+	}
+}
+
+func TestInstallHooksPath(t *testing.T) {
+	defer resetInitFlags()
+	repo := newDataDirRepo(t)
+	if err := repo.AddConfigValue("core.hooksPath", "githooks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := installAppraise(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.GetPath(), "githooks", "post-merge")); err != nil {
+		t.Errorf("expected the hook in core.hooksPath: %v", err)
+	}
+
+	absolute := t.TempDir()
+	if err := repo.AddConfigValue("core.hooksPath", absolute); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := hooksDir(repo); err != nil || dir != absolute {
+		t.Errorf("unexpected hooks dir %q, %v", dir, err)
+	}
+}
+
+func TestInstallTooManyArgs(t *testing.T) {
+	defer resetInitFlags()
+	if err := installAppraise(newDataDirRepo(t), []string{"a", "b"}); err == nil {
+		t.Error("expected error for too many args")
+	}
+	if err := uninstallAppraise(newDataDirRepo(t), []string{"a"}); err == nil {
+		t.Error("expected error for unexpected args")
+	}
+}
+
+func TestInstallConfigErrors(t *testing.T) {
+	defer resetInitFlags()
+	for _, key := range []string{"remote.origin.push", "remote.origin.fetch", "core.hooksPath"} {
+		repo := &configErrRepo{Repo: newDataDirRepo(t), getErrKey: key}
+		args := []string{"-no-hooks"}
+		if key == "core.hooksPath" {
+			args = []string{"-no-hooks=false"}
+		}
+		if err := installAppraise(repo, args); err == nil {
+			t.Errorf("expected an error when reading %q fails", key)
+		}
+	}
+	repo := &configErrRepo{Repo: newDataDirRepo(t), addErr: fmt.Errorf("config write failed")}
+	if err := installAppraise(repo, nil); err == nil {
+		t.Error("expected an error when writing the config fails")
+	}
+}
+
+func TestInstallHookErrors(t *testing.T) {
+	defer resetInitFlags()
+	repo := newDataDirRepo(t)
+	repo.dataDirErr = fmt.Errorf("no data dir")
+	if err := installAppraise(repo, nil); err == nil {
+		t.Error("expected an error when the data dir is unavailable")
+	}
+
+	// Make each hook path unreadable by turning it into a directory.
+	for _, name := range []string{"pre-push", "post-merge"} {
+		repo := newDataDirRepo(t)
+		if err := os.MkdirAll(filepath.Join(repo.dataDir, "hooks", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := installAppraise(repo, nil); err == nil {
+			t.Errorf("expected an error when the %s hook is a directory", name)
+		}
+	}
+
+	// Make the hooks dir impossible to create.
+	repo = newDataDirRepo(t)
+	if err := os.WriteFile(repo.dataDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installAppraise(repo, nil); err == nil {
+		t.Error("expected an error when the hooks dir cannot be created")
+	}
+}
+
+func TestUninstallErrors(t *testing.T) {
+	defer resetInitFlags()
+	repo := &configErrRepo{Repo: newDataDirRepo(t), getErrKey: installedConfigKey}
+	if err := uninstallAppraise(repo, nil); err == nil {
+		t.Error("expected an error when reading the installed values fails")
+	}
+
+	repo = &configErrRepo{Repo: newDataDirRepo(t), getErrKey: "core.hooksPath"}
+	if err := uninstallAppraise(repo, nil); err == nil {
+		t.Error("expected an error when reading core.hooksPath fails")
+	}
+
+	for _, entry := range []string{"notes.displayRef " + notesRefPattern, "malformed"} {
+		repo = &configErrRepo{Repo: newDataDirRepo(t), removeErr: fmt.Errorf("config write failed")}
+		repo.AddConfigValue(installedConfigKey, entry)
+		if err := uninstallAppraise(repo, nil); err == nil {
+			t.Errorf("expected an error when removing %q fails", entry)
+		}
+	}
+
+	for _, name := range []string{"pre-push", "post-merge"} {
+		repo := newDataDirRepo(t)
+		if err := os.MkdirAll(filepath.Join(repo.dataDir, "hooks", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := uninstallAppraise(repo, nil); err == nil {
+			t.Errorf("expected an error when the %s hook is a directory", name)
+		}
+	}
+}
+
+func TestRemoveHookBlock(t *testing.T) {
+	for _, script := range []string{"#!/bin/sh\n", "#!/bin/sh\n" + hookBlockBegin + "\nunterminated\n"} {
+		if got := removeHookBlock(script); got != script {
+			t.Errorf("removeHookBlock(%q) = %q", script, got)
+		}
+	}
+	script := "#!/bin/sh\n" + hookBlockBegin + "\nfoo\n" + hookBlockEnd
+	if got := removeHookBlock(script); got != "#!/bin/sh\n" {
+		t.Errorf("removeHookBlock(%q) = %q", script, got)
+	}
+}
+
+func TestUninstallHookLeavesOtherScripts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pre-push")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nmake test\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := uninstallHook(dir, "pre-push"); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != "#!/bin/sh\nmake test\n" {
+		t.Errorf("unexpected hook contents %q", contents)
+	}
+}
+
+func TestInstallHookWriteError(t *testing.T) {
+	dir := t.TempDir()
+	// A dangling symlink reads as a missing hook, but cannot be written.
+	if err := os.Symlink(filepath.Join(dir, "missing", "pre-push"), filepath.Join(dir, "pre-push")); err != nil {
+		t.Fatal(err)
+	}
+	if err := installHook(dir, "pre-push", "true"); err == nil {
+		t.Error("expected an error writing the hook")
+	}
+}
+
+func TestInstallSidecar(t *testing.T) {
+	defer resetInitFlags()
+	var repos []*repository.GitRepo
+	for range 2 {
+		dir := t.TempDir()
+		if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+			t.Fatalf("git init: %v: %s", err, out)
+		}
+		repo, err := repository.NewGitRepo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, repo)
+	}
+	code, store := repos[0], repos[1]
+	repo := repository.NewSidecarRepo(code, store)
+	if err := installAppraise(repo, []string{"-no-hooks", "reviews"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fetch, _ := store.GetConfigValues("remote.reviews.fetch"); !slices.Equal(fetch, []string{"+refs/notes/devtools/*:refs/notes/remotes/reviews/devtools/*"}) {
+		t.Errorf("unexpected fetch refspecs in the review store %q", fetch)
+	}
+	if push, _ := store.GetConfigValues("remote.reviews.push"); !slices.Equal(push, []string{"refs/notes/devtools/*:refs/notes/devtools/*"}) {
+		t.Errorf("unexpected push refspecs in the review store %q", push)
+	}
+	for _, key := range []string{"remote.reviews.fetch", "remote.reviews.push", "notes.displayRef"} {
+		if values, _ := code.GetConfigValues(key); len(values) != 0 {
+			t.Errorf("unexpected values for %q in the code repo: %q", key, values)
+		}
+	}
+
+	resetInitFlags()
+	if err := installAppraise(repo, []string{"reviews"}); err != nil {
+		t.Fatal(err)
+	}
+	dataDir, err := code.GetDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prePush, err := os.ReadFile(filepath.Join(dataDir, "hooks", "pre-push")); err != nil || !strings.Contains(string(prePush), "git appraise push reviews") {
+		t.Errorf("unexpected pre-push hook %q: %v", prePush, err)
+	}
+
+	if err := uninstallAppraise(repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"remote.reviews.fetch", "remote.reviews.push", installedConfigKey} {
+		if values, _ := store.GetConfigValues(key); len(values) != 0 {
+			t.Errorf("unexpected values for %q in the review store after uninstall: %q", key, values)
+		}
+	}
+}
@@ -22,8 +22,8 @@ import (
 	"fmt"
 	"io"
 	"os"
-
 	"os/exec"
+	"path/filepath"
 
 	"msrl.dev/git-appraise/repository"
 )
@@ -32,8 +32,10 @@ import (
 // method blocks until the editor command has returned.
 //
 // The specified filename should be a temporary file and provided as a relative path
-// from the repo (e.g. "FILENAME" will be converted to ".git/FILENAME"). This file
-// will be deleted after the editor is closed and its contents have been read.
+// from the repo (e.g. "FILENAME" will be converted to ".git/appraise-edit-123/FILENAME",
+// in a directory of its own so that editors that are open in several worktrees of the
+// repo do not share the file). This file will be deleted after the editor is closed
+// and its contents have been read.
 //
 // This method returns the text that was read from the temporary file, or
 // an error if any step in the process failed.
@@ -48,7 +50,12 @@ func LaunchEditor(repo repository.Repo, fileName string) (string, error) {
 		return "", fmt.Errorf("Unable to get repo data directory: %v\n", err)
 	}
 
-	path := fmt.Sprintf("%s/%s", dataDir, fileName)
+	editDir, err := os.MkdirTemp(dataDir, "appraise-edit-")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create the directory for the file to edit: %v\n", err)
+	}
+	defer os.RemoveAll(editDir)
+	path := filepath.Join(editDir, fileName)
 
 	cmd, err := startInlineCommand(editor, path)
 	if err != nil {
@@ -72,11 +79,9 @@ func LaunchEditor(repo repository.Repo, fileName string) (string, error) {
 
 	output, err := os.ReadFile(path)
 	if err != nil {
-		os.Remove(path)
 		return "", fmt.Errorf("Error reading edited file: %v\n", err)
 	}
-	os.Remove(path)
-	return string(output), err
+	return string(output), nil
 }
 
 // FromFile loads and returns the contents of a given file. If - is passed
@@ -124,6 +124,50 @@ func TestLaunchEditor(t *testing.T) {
 	}
 }
 
+func TestLaunchEditorSeparateFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := filepath.Join(t.TempDir(), "paths")
+	script := writeScript(t, dir, "test-editor.sh",
+		fmt.Sprintf("#!/bin/sh\necho \"$1\" >> %q\necho edited > \"$1\"\n", paths))
+	repo := editorRepo{
+		Repo:    repository.NewMockRepoForTest(),
+		editor:  script,
+		dataDir: dir,
+	}
+	for range 2 {
+		if _, err := LaunchEditor(repo, "COMMENT_EDITMSG"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := os.ReadFile(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Fields(string(out))
+	if len(edited) != 2 || edited[0] == edited[1] {
+		t.Fatalf("expected a separate file for each edit, got %q", edited)
+	}
+	for _, path := range edited {
+		if filepath.Base(path) != "COMMENT_EDITMSG" || filepath.Dir(filepath.Dir(path)) != dir {
+			t.Errorf("expected the file to keep its name within the data dir, got %q", path)
+		}
+		if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+			t.Errorf("expected the directory of %q to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestLaunchEditorMissingDataDir(t *testing.T) {
+	repo := editorRepo{
+		Repo:    repository.NewMockRepoForTest(),
+		editor:  "true",
+		dataDir: filepath.Join(t.TempDir(), "missing"),
+	}
+	if _, err := LaunchEditor(repo, "COMMENT_EDITMSG"); err == nil {
+		t.Error("expected an error for a missing data dir")
+	}
+}
+
 func TestLaunchEditorShellFallback(t *testing.T) {
 	dir := t.TempDir()
 	script := writeScript(t, dir, "test-editor.sh",
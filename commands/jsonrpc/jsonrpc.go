@@ -0,0 +1,287 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jsonrpc implements the JSON-RPC 2.0 protocol, for the commands
+// that serve the reviews to editors and other tools over a single stream.
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// Version is the version of JSON-RPC that is spoken.
+const Version = "2.0"
+
+// The error codes defined by JSON-RPC 2.0.
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+	// ServerError is the code of the errors returned by handlers, other
+	// than those that are an *Error.
+	ServerError = -32000
+)
+
+// Request is a request or notification, which is a request without an ID.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the response to a request, which holds either its result or
+// an error.
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is the error of a request that failed.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// ErrStop may be returned by a handler to stop serving the connection, once
+// the request has been answered with a null result.
+var ErrStop = errors.New("stop serving")
+
+// Handler returns the result of a request with the given method and params,
+// or an error. Errors that are not an *Error are returned with the code
+// ServerError.
+type Handler func(method string, params json.RawMessage) (any, error)
+
+// Conn is a connection over which JSON-RPC messages are exchanged, with each
+// message either on a line of its own, or preceded by headers.
+type Conn struct {
+	r *bufio.Reader
+	// headers is whether the messages are preceded by headers.
+	headers bool
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewConn returns a connection that reads messages from r and writes them
+// to w, with each message on a line of its own.
+func NewConn(r io.Reader, w io.Writer) *Conn {
+	return &Conn{r: bufio.NewReader(r), w: w}
+}
+
+// NewHeaderConn returns a connection that reads messages from r and writes
+// them to w, with each message preceded by a Content-Length header and a
+// blank line, as in the Language Server Protocol.
+func NewHeaderConn(r io.Reader, w io.Writer) *Conn {
+	return &Conn{r: bufio.NewReader(r), w: w, headers: true}
+}
+
+// read returns the next non-empty message, or io.EOF when there are none.
+func (c *Conn) read() ([]byte, error) {
+	if c.headers {
+		return c.readWithHeaders()
+	}
+	for {
+		line, err := c.r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readWithHeaders returns the next message that is preceded by headers, or
+// io.EOF when there are none.
+func (c *Conn) readWithHeaders() ([]byte, error) {
+	header, err := textproto.NewReader(c.r).ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failure reading the message headers: %v", err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || length <= 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(c.r, message); err != nil {
+		return nil, fmt.Errorf("failure reading the message: %v", err)
+	}
+	return bytes.TrimSpace(message), nil
+}
+
+// write writes a single message. It is safe to call concurrently.
+func (c *Conn) write(message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if c.headers {
+		data = append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(data))), data...)
+	} else {
+		data = append(data, '\n')
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.w.Write(data)
+	return err
+}
+
+// Notify sends a notification to the other end of the connection. It is
+// safe to call while the connection is being served.
+func (c *Conn) Notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.write(Request{JSONRPC: Version, Method: method, Params: data})
+}
+
+// Serve handles the requests read from the connection with the given
+// handler, until there are no more.
+//
+// Requests are handled one at a time, in order. Batches of requests are
+// answered with a batch of the responses to the requests in them.
+func (c *Conn) Serve(handler Handler) error {
+	stop := false
+	handleOrStop := func(method string, params json.RawMessage) (any, error) {
+		result, err := handler(method, params)
+		if errors.Is(err, ErrStop) {
+			stop = true
+			return nil, nil
+		}
+		return result, err
+	}
+	for !stop {
+		message, err := c.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(message) == 0 {
+			return errors.New("empty message")
+		}
+		if reply := handleMessage(message, handleOrStop); reply != nil {
+			if err := c.write(reply); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errorResponse returns a response with the given error.
+func errorResponse(id json.RawMessage, code int, message string) *Response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &Response{JSONRPC: Version, ID: id, Error: &Error{Code: code, Message: message}}
+}
+
+// handleMessage handles a single request or a batch of them, and returns
+// the reply to send, if any.
+func handleMessage(message []byte, handler Handler) any {
+	if message[0] != '[' {
+		if response := handleRequest(message, handler); response != nil {
+			return response
+		}
+		return nil
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(message, &batch); err != nil {
+		return errorResponse(nil, ParseError, err.Error())
+	}
+	if len(batch) == 0 {
+		return errorResponse(nil, InvalidRequest, "empty batch")
+	}
+	var responses []*Response
+	for _, request := range batch {
+		if response := handleRequest(request, handler); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// handleRequest handles a single request, and returns its response, or nil
+// for notifications.
+func handleRequest(message []byte, handler Handler) *Response {
+	var request Request
+	if err := json.Unmarshal(message, &request); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return errorResponse(nil, ParseError, err.Error())
+		}
+		return errorResponse(nil, InvalidRequest, err.Error())
+	}
+	if request.JSONRPC != Version || request.Method == "" {
+		return errorResponse(request.ID, InvalidRequest, "not a JSON-RPC 2.0 request")
+	}
+	result, err := handler(request.Method, request.Params)
+	if request.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: ServerError, Message: err.Error()}
+		}
+		return &Response{JSONRPC: Version, ID: request.ID, Error: rpcErr}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(request.ID, InternalError, err.Error())
+	}
+	return &Response{JSONRPC: Version, ID: request.ID, Result: data}
+}
+
+// DecodeParams decodes the params of a request into v, returning an
+// InvalidParams error if they do not match. Missing params leave v as is.
+func DecodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &Error{Code: InvalidParams, Message: err.Error()}
+	}
+	return nil
+}
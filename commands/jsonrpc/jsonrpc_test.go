@@ -0,0 +1,191 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// echoHandler returns the params of "echo" requests, and fails others.
+func echoHandler(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "echo":
+		var v any
+		if err := DecodeParams(params, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "fail":
+		return nil, errors.New("failed")
+	case "unencodable":
+		return func() {}, nil
+	case "stop":
+		return nil, ErrStop
+	}
+	return nil, &Error{Code: MethodNotFound, Message: "unknown method " + method}
+}
+
+func serve(t *testing.T, input string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := NewConn(strings.NewReader(input), &out).Serve(echoHandler); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": {"a": 1}}`, `{"jsonrpc":"2.0","id":1,"result":{"a":1}}`},
+		{`{"jsonrpc": "2.0", "id": "x", "method": "echo"}`, `{"jsonrpc":"2.0","id":"x","result":null}`},
+		{`{"jsonrpc": "2.0", "id": null, "method": "echo", "params": [1]}`, `{"jsonrpc":"2.0","id":null,"result":[1]}`},
+		{`{"jsonrpc": "2.0", "method": "echo"}`, ``},
+		{`{"jsonrpc": "2.0", "method": "fail"}`, ``},
+		{`{"jsonrpc": "2.0", "id": 2, "method": "fail"}`, `{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"failed"}}`},
+		{`{"jsonrpc": "2.0", "id": 3, "method": "other"}`, `{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"unknown method other"}}`},
+		{`{"jsonrpc": "2.0", "id": 4, "method": "echo", "params": [}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid character '}' looking for beginning of value"}}`},
+		{`{"jsonrpc": "1.0", "id": 5, "method": "echo"}`, `{"jsonrpc":"2.0","id":5,"error":{"code":-32600,"message":"not a JSON-RPC 2.0 request"}}`},
+		{`{"jsonrpc": "2.0", "id": 6}`, `{"jsonrpc":"2.0","id":6,"error":{"code":-32600,"message":"not a JSON-RPC 2.0 request"}}`},
+		{`"request"`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"json: cannot unmarshal string into Go value of type jsonrpc.Request"}}`},
+		{`{"jsonrpc": "2.0", "id": 7, "method": "unencodable"}`, `{"jsonrpc":"2.0","id":7,"error":{"code":-32603,"message":"json: unsupported type: func()"}}`},
+		{`[{"jsonrpc": "2.0", "id": 1, "method": "echo"}, {"jsonrpc": "2.0", "method": "echo"}, 1]`, `[{"jsonrpc":"2.0","id":1,"result":null},{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"json: cannot unmarshal number into Go value of type jsonrpc.Request"}}]`},
+		{`[{"jsonrpc": "2.0", "method": "echo"}]`, ``},
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty batch"}}`},
+		{`[1,`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"unexpected end of JSON input"}}`},
+	}
+	for _, test := range tests {
+		want := test.want
+		if want != "" {
+			want += "\n"
+		}
+		if got := serve(t, test.input+"\n"); got != want {
+			t.Errorf("Serve(%s) =\n%s\nwant\n%s", test.input, got, want)
+		}
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	input := "\n  \n" + `{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": 1}` + "\n" + `{"jsonrpc": "2.0", "id": 2, "method": "echo", "params": 2}`
+	want := `{"jsonrpc":"2.0","id":1,"result":1}` + "\n" + `{"jsonrpc":"2.0","id":2,"result":2}` + "\n"
+	if got := serve(t, input); got != want {
+		t.Errorf("Serve() = %q, want %q", got, want)
+	}
+}
+
+// frame precedes a message with its headers.
+func frame(message string) string {
+	return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(message), message)
+}
+
+func TestServeHeaders(t *testing.T) {
+	input := frame(`{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": 1}`) +
+		"Content-Type: application/vscode-jsonrpc; charset=utf-8\r\n" +
+		frame(`{"jsonrpc": "2.0", "method": "echo"}`) +
+		frame(`{"jsonrpc": "2.0", "id": 2, "method": "echo", "params": "\u00e9"}`)
+	want := frame(`{"jsonrpc":"2.0","id":1,"result":1}`) + frame(`{"jsonrpc":"2.0","id":2,"result":"é"}`)
+	var out bytes.Buffer
+	if err := NewHeaderConn(strings.NewReader(input), &out).Serve(echoHandler); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("Serve() = %q, want %q", out.String(), want)
+	}
+
+	for _, input := range []string{
+		"Content-Length: x\r\n\r\n{}",
+		"Content-Type: text/plain\r\n\r\n{}",
+		"Content-Length: 10\r\n\r\n{}",
+		"Content-Length: 2\r\n{}",
+		"Content-Length: 2\r\n\r\n  ",
+	} {
+		if err := NewHeaderConn(strings.NewReader(input), io.Discard).Serve(echoHandler); err == nil {
+			t.Errorf("Serve(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestServeStop(t *testing.T) {
+	input := `{"jsonrpc": "2.0", "id": 1, "method": "stop"}` + "\n" + `{"jsonrpc": "2.0", "id": 2, "method": "echo"}` + "\n"
+	if got, want := serve(t, input), `{"jsonrpc":"2.0","id":1,"result":null}`+"\n"; got != want {
+		t.Errorf("Serve() = %q, want %q", got, want)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) { return 0, errors.New("read failed") }
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestServeErrors(t *testing.T) {
+	if err := NewConn(errReader{}, io.Discard).Serve(echoHandler); err == nil || err.Error() != "read failed" {
+		t.Errorf("Serve() with a failing reader = %v", err)
+	}
+	input := strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "echo"}`)
+	if err := NewConn(input, errWriter{}).Serve(echoHandler); err == nil || err.Error() != "write failed" {
+		t.Errorf("Serve() with a failing writer = %v", err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var out bytes.Buffer
+	conn := NewConn(strings.NewReader(""), &out)
+	if err := conn.Notify("changed", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"jsonrpc":"2.0","method":"changed","params":{"a":1}}` + "\n"; out.String() != want {
+		t.Errorf("Notify() wrote %q, want %q", out.String(), want)
+	}
+	if err := conn.Notify("changed", func() {}); err == nil {
+		t.Error("expected an error for params that cannot be encoded")
+	}
+
+	out.Reset()
+	if err := NewHeaderConn(strings.NewReader(""), &out).Notify("changed", 1); err != nil {
+		t.Fatal(err)
+	}
+	if want := frame(`{"jsonrpc":"2.0","method":"changed","params":1}`); out.String() != want {
+		t.Errorf("Notify() wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestDecodeParams(t *testing.T) {
+	v := struct{ A int }{A: 1}
+	for _, params := range []string{"", "null"} {
+		if err := DecodeParams(json.RawMessage(params), &v); err != nil || v.A != 1 {
+			t.Errorf("DecodeParams(%q) = %v, %+v", params, err, v)
+		}
+	}
+	if err := DecodeParams(json.RawMessage(`{"A": 2}`), &v); err != nil || v.A != 2 {
+		t.Errorf("DecodeParams() = %v, %+v", err, v)
+	}
+	err := DecodeParams(json.RawMessage(`{"A": "x"}`), &v)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != InvalidParams || rpcErr.Error() == "" {
+		t.Errorf("DecodeParams() with invalid params = %v", err)
+	}
+}
@@ -17,9 +17,11 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"flag"
 	"fmt"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/output"
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
@@ -36,11 +38,16 @@ var (
 // TODO(ojarjur): Add more flags for filtering the output (e.g. filtering by reviewer or status).
 func listReviews(repo repository.Repo, args []string) error {
 	listFlagSet.Parse(args)
+	ctx := context.Background()
 	var reviews []review.Summary
+	var err error
 	if *listAll {
-		reviews = review.ListAll(repo)
+		reviews, err = client.New(repo).List(ctx)
 	} else {
-		reviews = review.ListOpen(repo)
+		reviews, err = client.New(repo).ListOpen(ctx)
+	}
+	if err != nil {
+		return err
 	}
 	if *listJSONOutput {
 		b, err := jsonMarshalIndent(reviews, "", "  ")
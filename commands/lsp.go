@@ -0,0 +1,760 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"msrl.dev/git-appraise/client"
+	"msrl.dev/git-appraise/commands/jsonrpc"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+// The commands that the language server can execute on a comment thread.
+const (
+	lspReplyCommand   = "git-appraise.reply"
+	lspResolveCommand = "git-appraise.resolve"
+)
+
+const (
+	// lspServerNotInitialized is the LSP error code for requests received
+	// before the "initialize" request.
+	lspServerNotInitialized = -32002
+	// lspSyncFull is the LSP text document sync kind in which each change
+	// holds the full text of the document.
+	lspSyncFull = 1
+	// The LSP severities of the diagnostics published.
+	lspSeverityWarning     = 2
+	lspSeverityInformation = 3
+	lspDiagnosticSource    = "git-appraise"
+)
+
+var lspFlagSet = flag.NewFlagSet("lsp", flag.ExitOnError)
+
+// lspStdio is accepted since many editors pass it, although the standard
+// input and output are the only transport supported.
+var lspStdio = lspFlagSet.Bool("stdio", true, "Speak the Language Server Protocol over the standard input and output.")
+
+// The types of the Language Server Protocol that are used.
+type (
+	lspPosition struct {
+		Line      int `json:"line"`
+		Character int `json:"character"`
+	}
+	lspRange struct {
+		Start lspPosition `json:"start"`
+		End   lspPosition `json:"end"`
+	}
+	lspDiagnostic struct {
+		Range    lspRange   `json:"range"`
+		Severity int        `json:"severity"`
+		Code     string     `json:"code,omitempty"`
+		Source   string     `json:"source"`
+		Message  string     `json:"message"`
+		Data     *lspThread `json:"data,omitempty"`
+	}
+	lspTextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	}
+	lspDocumentParams struct {
+		TextDocument   lspTextDocument `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	lspPublishParams struct {
+		URI         string          `json:"uri"`
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	lspCodeActionParams struct {
+		TextDocument lspTextDocument `json:"textDocument"`
+		Context      struct {
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		} `json:"context"`
+	}
+	lspCommand struct {
+		Title     string `json:"title"`
+		Command   string `json:"command"`
+		Arguments []any  `json:"arguments,omitempty"`
+	}
+	lspCodeAction struct {
+		Title       string          `json:"title"`
+		Kind        string          `json:"kind"`
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+		Command     *lspCommand     `json:"command"`
+	}
+	lspExecuteCommandParams struct {
+		Command   string            `json:"command"`
+		Arguments []json.RawMessage `json:"arguments"`
+	}
+)
+
+// lspThread identifies the comment thread of a diagnostic, and is also the
+// argument of the commands on it.
+type lspThread struct {
+	Review string `json:"review"`
+	Thread string `json:"thread"`
+	// Message is the reply to add to the thread.
+	Message string `json:"message,omitempty"`
+}
+
+// lspFinding is a comment thread or analyses note on a file of a review.
+type lspFinding struct {
+	path string
+	// commit is the commit whose version of the file the finding is on.
+	commit     string
+	r          *comment.Range
+	diagnostic lspDiagnostic
+}
+
+// languageServer publishes the comment threads and analyses notes of the
+// open reviews in a repo as diagnostics on the files in its working tree.
+//
+// Requests are handled one at a time, so no locking is needed.
+type languageServer struct {
+	repo repository.Repo
+	conn *jsonrpc.Conn
+	// root is the top level of the working tree.
+	root string
+
+	initialized, shutdown bool
+	// documents holds the text of the documents open in the editor, by
+	// their path relative to root.
+	documents map[string]lspTextDocument
+	// published is the URIs of the files with diagnostics, which must be
+	// cleared once they have none.
+	published map[string]bool
+
+	// stateHash is the state of the repo in which findings were read.
+	stateHash string
+	findings  map[string][]lspFinding
+	// contents caches the contents of files at commits, by "commit:path".
+	contents map[string]string
+	// analysesNotes caches the analyses notes downloaded for each report URL.
+	analysesNotes map[string][]analyses.Note
+}
+
+func newLanguageServer(repo repository.Repo, conn *jsonrpc.Conn) *languageServer {
+	return &languageServer{
+		repo:          repo,
+		conn:          conn,
+		root:          repo.GetPath(),
+		documents:     make(map[string]lspTextDocument),
+		published:     make(map[string]bool),
+		analysesNotes: make(map[string][]analyses.Note),
+	}
+}
+
+// run serves requests until the editor exits.
+func (s *languageServer) run() error {
+	if err := s.conn.Serve(s.handle); err != nil {
+		return err
+	}
+	if !s.shutdown {
+		return errors.New("The editor exited without shutting down the language server.")
+	}
+	return nil
+}
+
+// handle handles a single request or notification.
+func (s *languageServer) handle(method string, params json.RawMessage) (any, error) {
+	if !s.initialized && method != "initialize" && method != "exit" {
+		return nil, &jsonrpc.Error{Code: lspServerNotInitialized, Message: "the language server is not initialized"}
+	}
+	switch method {
+	case "initialize":
+		s.initialized = true
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    lspSyncFull,
+					"save":      true,
+				},
+				"codeActionProvider": true,
+				"executeCommandProvider": map[string]any{
+					"commands": []string{lspReplyCommand, lspResolveCommand},
+				},
+			},
+			"serverInfo": map[string]string{"name": "git-appraise"},
+		}, nil
+	case "initialized", "textDocument/didSave":
+		return nil, s.publishAll()
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "exit":
+		return nil, jsonrpc.ErrStop
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		p, err := decode[lspDocumentParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.updateDocument(method, p)
+	case "textDocument/codeAction":
+		p, err := decode[lspCodeActionParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return codeActions(p), nil
+	case "workspace/executeCommand":
+		p, err := decode[lspExecuteCommandParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.executeCommand(p)
+	}
+	return nil, &jsonrpc.Error{Code: jsonrpc.MethodNotFound, Message: fmt.Sprintf("unknown method %q", method)}
+}
+
+// pathOf returns the path, relative to the top level of the working tree,
+// of the file with the given URI.
+func (s *languageServer) pathOf(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	path, err := filepath.Rel(s.root, filepath.FromSlash(u.Path))
+	if err != nil || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(path), true
+}
+
+// uriOf returns the URI of the file at the given path, relative to the top
+// level of the working tree. Open documents keep the URI used by the editor.
+func (s *languageServer) uriOf(path string) string {
+	if document, ok := s.documents[path]; ok {
+		return document.URI
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(s.root, filepath.FromSlash(path)))}).String()
+}
+
+// updateDocument tracks the text of the documents open in the editor, and
+// publishes the diagnostics for their current text.
+func (s *languageServer) updateDocument(method string, p lspDocumentParams) error {
+	path, ok := s.pathOf(p.TextDocument.URI)
+	if !ok {
+		return nil
+	}
+	switch method {
+	case "textDocument/didOpen":
+		s.documents[path] = p.TextDocument
+	case "textDocument/didChange":
+		if len(p.ContentChanges) == 0 {
+			return nil
+		}
+		s.documents[path] = lspTextDocument{
+			URI:  p.TextDocument.URI,
+			Text: p.ContentChanges[len(p.ContentChanges)-1].Text,
+		}
+	case "textDocument/didClose":
+		// The file on disk is diagnosed instead.
+		delete(s.documents, path)
+	}
+	return s.publish(path)
+}
+
+// readFindings reads the findings of the open reviews, by path, unless the
+// repo is unchanged since they were last read.
+func (s *languageServer) readFindings() error {
+	hash, err := s.repo.GetRepoStateHash()
+	if err != nil {
+		return err
+	}
+	if s.findings != nil && hash == s.stateHash {
+		return nil
+	}
+	summaries, err := client.New(s.repo).ListOpen(context.Background())
+	if err != nil {
+		return err
+	}
+	findings := make(map[string][]lspFinding)
+	for _, summary := range summaries {
+		r, err := summary.Details()
+		if err != nil {
+			return err
+		}
+		headCommit, err := r.GetHeadCommit()
+		if err != nil {
+			return err
+		}
+		for _, thread := range r.Comments {
+			location := thread.Comment.Location
+			if location == nil || location.Path == "" || !isOpenThread(thread) {
+				continue
+			}
+			commit := location.Commit
+			if commit == "" {
+				commit = headCommit
+			}
+			severity := lspSeverityInformation
+			if thread.Resolved != nil && !*thread.Resolved {
+				severity = lspSeverityWarning
+			}
+			findings[location.Path] = append(findings[location.Path], lspFinding{
+				path:   location.Path,
+				commit: commit,
+				r:      location.Range,
+				diagnostic: lspDiagnostic{
+					Severity: severity,
+					Code:     "comment",
+					Source:   lspDiagnosticSource,
+					Message:  threadMessage(thread),
+					Data:     &lspThread{Review: r.Revision, Thread: thread.Hash},
+				},
+			})
+		}
+		for _, note := range s.readAnalysesNotes(r) {
+			if note.Location == nil || note.Location.Path == "" {
+				continue
+			}
+			var noteRange *comment.Range
+			if lr := note.Location.Range; lr != nil {
+				noteRange = &comment.Range{
+					StartLine:   lr.StartLine,
+					StartColumn: lr.StartColumn,
+					EndLine:     lr.EndLine,
+					EndColumn:   lr.EndColumn,
+				}
+			}
+			findings[note.Location.Path] = append(findings[note.Location.Path], lspFinding{
+				path:   note.Location.Path,
+				commit: headCommit,
+				r:      noteRange,
+				diagnostic: lspDiagnostic{
+					Severity: lspSeverityInformation,
+					Code:     note.Category,
+					Source:   lspDiagnosticSource,
+					Message:  note.Description,
+				},
+			})
+		}
+	}
+	s.findings, s.stateHash = findings, hash
+	s.contents = make(map[string]string)
+	return nil
+}
+
+// readAnalysesNotes returns the notes of the latest analyses report of the
+// review, downloading them only once for each report.
+func (s *languageServer) readAnalysesNotes(r *review.Review) []analyses.Note {
+	report, err := analyses.GetLatestAnalysesReport(r.Analyses)
+	if err != nil || report == nil || report.URL == "" {
+		return nil
+	}
+	if notes, ok := s.analysesNotes[report.URL]; ok {
+		return notes
+	}
+	notes, err := report.GetNotes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read the analyses of %s: %v\n", r.Revision, err)
+		return nil
+	}
+	s.analysesNotes[report.URL] = notes
+	return notes
+}
+
+// isOpenThread returns whether a comment thread still needs attention: it
+// either has an unresolved comment, or it is an FYI that no reply has
+// resolved.
+func isOpenThread(thread review.CommentThread) bool {
+	if thread.Resolved != nil {
+		return !*thread.Resolved
+	}
+	var hasResolvingReply func([]review.CommentThread) bool
+	hasResolvingReply = func(children []review.CommentThread) bool {
+		for _, child := range children {
+			if (child.Comment.Resolved != nil && *child.Comment.Resolved) || hasResolvingReply(child.Children) {
+				return true
+			}
+		}
+		return false
+	}
+	return !hasResolvingReply(thread.Children)
+}
+
+// threadMessage returns the message of the diagnostic for a comment thread,
+// which holds each of its comments in turn.
+func threadMessage(thread review.CommentThread) string {
+	var comments []string
+	var appendComments func(review.CommentThread)
+	appendComments = func(thread review.CommentThread) {
+		comments = append(comments, fmt.Sprintf("%s: %s", thread.Comment.Author, thread.Comment.Description))
+		for _, child := range thread.Children {
+			appendComments(child)
+		}
+	}
+	appendComments(thread)
+	return strings.Join(comments, "\n\n")
+}
+
+// publishAll publishes the diagnostics of every file with findings, and
+// clears them from the files that no longer have any.
+func (s *languageServer) publishAll() error {
+	if err := s.readFindings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read the reviews: %v\n", err)
+		return nil
+	}
+	paths := make(map[string]bool)
+	for path := range s.findings {
+		paths[path] = true
+	}
+	for uri := range s.published {
+		if path, ok := s.pathOf(uri); ok {
+			paths[path] = true
+		}
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		if err := s.publish(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish publishes the diagnostics of a single file, on its current text.
+func (s *languageServer) publish(path string) error {
+	if err := s.readFindings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read the reviews: %v\n", err)
+		return nil
+	}
+	uri := s.uriOf(path)
+	findings := s.findings[path]
+	if len(findings) == 0 && !s.published[uri] {
+		return nil
+	}
+	diagnostics := []lspDiagnostic{}
+	if text, ok := s.currentText(path); ok {
+		newLines := strings.Split(text, "\n")
+		lineMaps := make(map[string][]int)
+		for _, finding := range findings {
+			lineMap, ok := lineMaps[finding.commit]
+			if !ok {
+				lineMap = s.lineMap(finding.commit, path, newLines)
+				lineMaps[finding.commit] = lineMap
+			}
+			diagnostic := finding.diagnostic
+			diagnostic.Range = mapRange(lineMap, newLines, finding.r)
+			diagnostics = append(diagnostics, diagnostic)
+		}
+	}
+	if len(diagnostics) == 0 {
+		if !s.published[uri] {
+			return nil
+		}
+		delete(s.published, uri)
+	} else {
+		s.published[uri] = true
+	}
+	return s.conn.Notify("textDocument/publishDiagnostics", lspPublishParams{URI: uri, Diagnostics: diagnostics})
+}
+
+// currentText returns the text of a file as it is open in the editor, or
+// else as it is in the working tree.
+func (s *languageServer) currentText(path string) (string, bool) {
+	if document, ok := s.documents[path]; ok {
+		return document.Text, true
+	}
+	contents, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(path)))
+	if err != nil {
+		return "", false
+	}
+	return string(contents), true
+}
+
+// contentsAt returns the contents of a file at a commit, or "" if it did not
+// exist.
+func (s *languageServer) contentsAt(commit, path string) string {
+	key := commit + ":" + path
+	contents, ok := s.contents[key]
+	if !ok {
+		contents, _ = s.repo.Show(commit, path)
+		s.contents[key] = contents
+	}
+	return contents
+}
+
+// lineMap maps the lines of a file at a commit to its current lines. If the
+// file cannot be diffed, then each line is assumed to be where it was.
+func (s *languageServer) lineMap(commit, path string, newLines []string) []int {
+	oldLines := strings.Split(s.contentsAt(commit, path), "\n")
+	lineMap, err := mapLines(s.repo, path, oldLines, newLines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to diff %q against %.12s: %v\n", path, commit, err)
+		lineMap = make([]int, len(oldLines))
+		for i := range lineMap {
+			lineMap[i] = -1
+			if i < len(newLines) {
+				lineMap[i] = i
+			}
+		}
+	}
+	return lineMap
+}
+
+// mapRange maps a range of lines in the old contents of a file, which are
+// numbered from 1, to an LSP range in its current lines, given the map from
+// the old lines to the new ones. Lines that have since changed are mapped to
+// where they would have been, and any columns in them are dropped. A missing
+// range maps to the start of the file.
+func mapRange(lineMap []int, newLines []string, r *comment.Range) lspRange {
+	if r == nil || r.StartLine == 0 {
+		return lspRange{}
+	}
+	lookup := func(line uint32) (int, bool) {
+		i := int(line) - 1
+		if i >= len(lineMap) {
+			return len(newLines) - 1, false
+		}
+		if lineMap[i] >= 0 {
+			return lineMap[i], true
+		}
+		for j := i - 1; j >= 0; j-- {
+			if lineMap[j] >= 0 {
+				return min(lineMap[j]+1, len(newLines)-1), false
+			}
+		}
+		return 0, false
+	}
+	start, startKept := lookup(r.StartLine)
+	endLine := r.EndLine
+	if endLine < r.StartLine {
+		endLine = r.StartLine
+	}
+	end, endKept := lookup(endLine)
+	result := lspRange{
+		Start: lspPosition{Line: start},
+		End:   lspPosition{Line: end, Character: utf16Len(newLines[end])},
+	}
+	if startKept && r.StartColumn > 0 {
+		result.Start.Character = utf16Len(prefix(newLines[start], r.StartColumn-1))
+	}
+	if endKept && r.EndColumn > 0 {
+		result.End.Character = utf16Len(prefix(newLines[end], r.EndColumn-1))
+	}
+	return result
+}
+
+// prefix returns the first n bytes of a line, or all of it if it is shorter.
+func prefix(line string, n uint32) string {
+	return line[:min(int(n), len(line))]
+}
+
+// utf16Len returns the length of a string in UTF-16 code units, which is how
+// LSP counts characters by default.
+func utf16Len(s string) int {
+	n := 0
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		n += max(utf16.RuneLen(r), 1)
+		s = s[size:]
+	}
+	return n
+}
+
+// mapLines returns, for each of the old lines of a file, the index of the
+// same line in its new lines, or -1 if it was changed or removed. The lines
+// are matched using the repo's diff between the two versions of the file.
+func mapLines(repo repository.Repo, path string, oldLines, newLines []string) ([]int, error) {
+	lineMap := make([]int, len(oldLines))
+	if slices.Equal(oldLines, newLines) {
+		for i := range lineMap {
+			lineMap[i] = i
+		}
+		return lineMap, nil
+	}
+	var trees []string
+	for _, lines := range [][]string{oldLines, newLines} {
+		// Both versions end with a newline, so that a change to only the
+		// end of the file does not change its last line.
+		tree, err := repository.NewTreeFromFiles(map[string]string{path: strings.Join(lines, "\n") + "\n"})
+		if err != nil {
+			return nil, err
+		}
+		hash, err := repo.StoreTree(tree.Contents())
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, hash)
+	}
+	diffs, err := repo.ParsedDiff(trees[0], trees[1], "-U0")
+	if err != nil {
+		return nil, err
+	}
+	oldLine, newLine := 0, 0
+	// keep maps the old lines before the given one to the new lines at the
+	// same offset from the last change.
+	keep := func(end int) {
+		for ; oldLine < min(end, len(oldLines)); oldLine, newLine = oldLine+1, newLine+1 {
+			lineMap[oldLine] = -1
+			if newLine < len(newLines) {
+				lineMap[oldLine] = newLine
+			}
+		}
+	}
+	for _, diff := range diffs {
+		for _, fragment := range diff.Fragments {
+			start := int(fragment.OldPosition) - 1
+			if fragment.OldLines == 0 {
+				// The lines are added after the old position.
+				start++
+			}
+			keep(start)
+			for _, line := range fragment.Lines {
+				switch line.Op {
+				case repository.OpContext:
+					keep(oldLine + 1)
+				case repository.OpDelete:
+					if oldLine < len(oldLines) {
+						lineMap[oldLine] = -1
+					}
+					oldLine++
+				case repository.OpAdd:
+					newLine++
+				}
+			}
+		}
+	}
+	keep(len(oldLines))
+	return lineMap, nil
+}
+
+// codeActions returns the actions on the comment threads of the diagnostics
+// in the context of a code action request.
+func codeActions(p lspCodeActionParams) []lspCodeAction {
+	actions := []lspCodeAction{}
+	for _, diagnostic := range p.Context.Diagnostics {
+		thread := diagnostic.Data
+		if thread == nil || thread.Thread == "" {
+			continue
+		}
+		diagnostics := []lspDiagnostic{diagnostic}
+		actions = append(actions,
+			lspCodeAction{
+				Title:       "Reply \"Done\" and resolve the review comment",
+				Kind:        "quickfix",
+				Diagnostics: diagnostics,
+				Command: &lspCommand{
+					Title:     "Resolve",
+					Command:   lspResolveCommand,
+					Arguments: []any{lspThread{Review: thread.Review, Thread: thread.Thread, Message: "Done"}},
+				},
+			},
+			lspCodeAction{
+				Title:       "Reply \"Acknowledged\" to the review comment",
+				Kind:        "quickfix",
+				Diagnostics: diagnostics,
+				Command: &lspCommand{
+					Title:     "Reply",
+					Command:   lspReplyCommand,
+					Arguments: []any{lspThread{Review: thread.Review, Thread: thread.Thread, Message: "Acknowledged"}},
+				},
+			})
+	}
+	return actions
+}
+
+// executeCommand replies to a comment thread, or resolves it, and then
+// publishes the diagnostics again.
+func (s *languageServer) executeCommand(p lspExecuteCommandParams) error {
+	if p.Command != lspReplyCommand && p.Command != lspResolveCommand {
+		return &jsonrpc.Error{Code: jsonrpc.InvalidParams, Message: fmt.Sprintf("unknown command %q", p.Command)}
+	}
+	if len(p.Arguments) != 1 {
+		return &jsonrpc.Error{Code: jsonrpc.InvalidParams, Message: "the command takes a single argument"}
+	}
+	thread, err := decode[lspThread](p.Arguments[0])
+	if err != nil {
+		return err
+	}
+	if thread.Thread == "" || (p.Command == lspReplyCommand && thread.Message == "") {
+		return &jsonrpc.Error{Code: jsonrpc.InvalidParams, Message: "the command needs a thread, and a reply needs a message"}
+	}
+	ctx := context.Background()
+	cl := client.New(s.repo)
+	r, err := cl.Get(ctx, thread.Review)
+	if err != nil {
+		return err
+	}
+	if !client.HasComment(r.Comments, thread.Thread) {
+		return errors.New("There is no matching comment thread.")
+	}
+	opts := client.CommentOptions{Message: thread.Message, Parent: thread.Thread}
+	if p.Command == lspResolveCommand {
+		resolved := true
+		opts.Resolved = &resolved
+	}
+	err = runWithWebhooks(s.repo, func() error {
+		_, err := cl.Comment(ctx, r.Revision, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.publishAll()
+}
+
+// serveLanguage runs a language server for the repo.
+func serveLanguage(repo repository.Repo, args []string) error {
+	lspFlagSet.Parse(args)
+	if len(lspFlagSet.Args()) > 0 {
+		return errors.New("The lsp command does not take any arguments.")
+	}
+	if !*lspStdio {
+		return errors.New("Only serving over the standard input and output is supported.")
+	}
+	conn := jsonrpc.NewHeaderConn(os.Stdin, os.Stdout)
+	restore, err := isolateStdio()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return newLanguageServer(repo, conn).run()
+}
+
+// lspCmd defines the "lsp" subcommand.
+var lspCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s lsp [--stdio]\n\nOptions:\n", arg0)
+		lspFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return serveLanguage(repo, args)
+	},
+}
@@ -0,0 +1,466 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/commands/jsonrpc"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+func TestMapLines(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     []int
+	}{
+		{"a\nb\nc", "a\nb\nc", []int{0, 1, 2}},
+		{"a\nb\nc", "x\na\nb\nc", []int{1, 2, 3}},
+		{"a\nb\nc", "a\nc", []int{0, -1, 1}},
+		{"a\nb\nc\nd", "a\nc\nx\nb\nd", []int{0, -1, 1, 4}},
+		{"a\nb", "", []int{-1, -1}},
+		{"", "a", []int{-1}},
+		{"a\nb", "a\nb\n", []int{0, 1}},
+	}
+	repo := repository.NewEmptyMockRepoForTest()
+	for _, test := range tests {
+		got, err := mapLines(repo, "dir/file", strings.Split(test.old, "\n"), strings.Split(test.new, "\n"))
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mapLines(%q, %q) = %v, %v, want %v", test.old, test.new, got, err, test.want)
+		}
+	}
+	if _, err := mapLines(repo, "/file", []string{"a"}, []string{"b"}); err == nil {
+		t.Error("expected an error mapping the lines of an invalid path")
+	}
+}
+
+func TestMapLinesLargeFile(t *testing.T) {
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	repo, err := repository.NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := make([]string, 20000)
+	new := make([]string, 20000)
+	for i := range old {
+		old[i], new[i] = fmt.Sprint(i), fmt.Sprint(i)
+	}
+	old[0], old[len(old)-1] = "x", "x"
+	new[1], new[len(new)-2] = "y", "y"
+	lineMap, err := mapLines(repo, "file", old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range map[int]int{0: -1, 1: -1, 2: 2, 10000: 10000, len(old) - 2: -1, len(old) - 1: -1} {
+		if lineMap[i] != want {
+			t.Errorf("line %d of a large file was mapped to %d, want %d", i, lineMap[i], want)
+		}
+	}
+}
+
+func TestMapRange(t *testing.T) {
+	old := "one\ntwo\nthree\nfour"
+	tests := []struct {
+		new  string
+		r    *comment.Range
+		want lspRange
+	}{
+		{"one", nil, lspRange{}},
+		{"one", &comment.Range{}, lspRange{}},
+		{old, &comment.Range{StartLine: 2}, lspRange{lspPosition{1, 0}, lspPosition{1, 3}}},
+		{old, &comment.Range{StartLine: 2, StartColumn: 2, EndLine: 3, EndColumn: 4}, lspRange{lspPosition{1, 1}, lspPosition{2, 3}}},
+		{old, &comment.Range{StartLine: 2, StartColumn: 9, EndLine: 1}, lspRange{lspPosition{1, 3}, lspPosition{1, 3}}},
+		{"zero\none\ntwo\nthree\nfour", &comment.Range{StartLine: 2, StartColumn: 2}, lspRange{lspPosition{2, 1}, lspPosition{2, 3}}},
+		// Changed lines keep their place, without their columns.
+		{"one\n2\nthree\nfour", &comment.Range{StartLine: 2, StartColumn: 2}, lspRange{lspPosition{1, 0}, lspPosition{1, 1}}},
+		{"uno\ntwo", &comment.Range{StartLine: 1, EndLine: 4}, lspRange{lspPosition{0, 0}, lspPosition{1, 3}}},
+		{"one\ntwo", &comment.Range{StartLine: 9}, lspRange{lspPosition{1, 0}, lspPosition{1, 3}}},
+		{"one\n2\n3\nfour", &comment.Range{StartLine: 3}, lspRange{lspPosition{1, 0}, lspPosition{1, 1}}},
+		// Characters are counted in UTF-16.
+		{"one\ntwo\né\U0001F600\nfour", &comment.Range{StartLine: 2, EndLine: 3}, lspRange{lspPosition{1, 0}, lspPosition{2, 3}}},
+	}
+	repo := repository.NewEmptyMockRepoForTest()
+	for _, test := range tests {
+		newLines := strings.Split(test.new, "\n")
+		lineMap, err := mapLines(repo, "file", strings.Split(old, "\n"), newLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mapRange(lineMap, newLines, test.r); got != test.want {
+			t.Errorf("mapRange(%q, %+v) = %+v, want %+v", test.new, test.r, got, test.want)
+		}
+	}
+	if got := utf16Len("\xff"); got != 1 {
+		t.Errorf("utf16Len of an invalid byte = %d", got)
+	}
+}
+
+func TestIsOpenThread(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		thread review.CommentThread
+		want   bool
+	}{
+		{review.CommentThread{}, true},
+		{review.CommentThread{Resolved: &no}, true},
+		{review.CommentThread{Resolved: &yes}, false},
+		{review.CommentThread{Children: []review.CommentThread{{Comment: comment.Comment{Resolved: &no}}}}, true},
+		{review.CommentThread{Children: []review.CommentThread{{Children: []review.CommentThread{{Comment: comment.Comment{Resolved: &yes}}}}}}, false},
+	}
+	for _, test := range tests {
+		if got := isOpenThread(test.thread); got != test.want {
+			t.Errorf("isOpenThread(%+v) = %v", test.thread, got)
+		}
+	}
+}
+
+// lspSession is a language server for a mock repo whose working tree is in
+// a temporary directory.
+type lspSession struct {
+	t      *testing.T
+	s      *languageServer
+	out    *strings.Builder
+	nextID int
+}
+
+func newLSPSession(t *testing.T) *lspSession {
+	t.Helper()
+	var out strings.Builder
+	s := newLanguageServer(repository.NewMockRepoForTest(), jsonrpc.NewHeaderConn(strings.NewReader(""), &out))
+	s.root = t.TempDir()
+	if err := os.WriteFile(filepath.Join(s.root, "file"), []byte("header\n"+repository.TestCommitG+":file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &lspSession{t: t, s: s, out: &out}
+}
+
+func (session *lspSession) call(method string, params any) (any, error) {
+	session.t.Helper()
+	raw, err := json.Marshal(params)
+	if err != nil {
+		session.t.Fatal(err)
+	}
+	return session.s.handle(method, raw)
+}
+
+// published returns the diagnostics published since it was last called, by
+// URI.
+func (session *lspSession) published() map[string][]lspDiagnostic {
+	session.t.Helper()
+	published := make(map[string][]lspDiagnostic)
+	for _, message := range strings.Split(session.out.String(), "Content-Length: ")[1:] {
+		_, body, _ := strings.Cut(message, "\r\n\r\n")
+		var notification struct {
+			Method string           `json:"method"`
+			Params lspPublishParams `json:"params"`
+		}
+		if err := json.Unmarshal([]byte(body), &notification); err != nil || notification.Method != "textDocument/publishDiagnostics" {
+			session.t.Fatalf("notification %q: %v", body, err)
+		}
+		published[notification.Params.URI] = notification.Params.Diagnostics
+	}
+	session.out.Reset()
+	return published
+}
+
+func (session *lspSession) addComment(c string) {
+	session.t.Helper()
+	if err := session.s.repo.AppendNote(comment.Ref, repository.TestCommitG, repository.Note(c)); err != nil {
+		session.t.Fatal(err)
+	}
+}
+
+func TestLanguageServer(t *testing.T) {
+	session := newLSPSession(t)
+	s := session.s
+	if _, err := session.call("initialized", nil); err == nil {
+		t.Error("expected an error before initialization")
+	}
+	result, err := session.call("initialize", map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capabilities := result.(map[string]any)["capabilities"]; capabilities == nil {
+		t.Errorf("result = %+v", result)
+	}
+
+	session.addComment(`{"timestamp": "0000000010", "author": "alice", "location": {"commit": "` + repository.TestCommitG + `", "path": "file", "range": {"startLine": 1, "startColumn": 3}}, "description": "Fix this", "resolved": false}`)
+	session.addComment(`{"timestamp": "0000000011", "author": "bob", "location": {"path": "gone", "range": {"startLine": 1}}, "description": "FYI"}`)
+	session.addComment(`{"timestamp": "0000000012", "author": "bob", "location": {"commit": "` + repository.TestCommitG + `"}, "description": "Not on a file"}`)
+	if _, err := session.call("initialized", nil); err != nil {
+		t.Fatal(err)
+	}
+	fileURI := s.uriOf("file")
+	published := session.published()
+	if len(published) != 1 || len(published[fileURI]) != 1 {
+		t.Fatalf("published = %+v", published)
+	}
+	diagnostic := published[fileURI][0]
+	want := lspRange{lspPosition{1, 2}, lspPosition{1, len(repository.TestCommitG) + 5}}
+	if diagnostic.Range != want || diagnostic.Severity != lspSeverityWarning || diagnostic.Message != "alice: Fix this" || diagnostic.Data == nil {
+		t.Errorf("diagnostic = %+v", diagnostic)
+	}
+
+	// The diagnostics follow the text in the editor, rather than on disk.
+	if _, err := session.call("textDocument/didOpen", lspDocumentParams{TextDocument: lspTextDocument{URI: fileURI, Text: repository.TestCommitG + ":file"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.published()[fileURI][0].Range.Start.Line; got != 0 {
+		t.Errorf("line after opening = %d", got)
+	}
+	params := lspDocumentParams{TextDocument: lspTextDocument{URI: fileURI}}
+	if _, err := session.call("textDocument/didChange", params); err != nil {
+		t.Fatal(err)
+	}
+	params.ContentChanges = append(params.ContentChanges, struct {
+		Text string `json:"text"`
+	}{"a\nb\n" + repository.TestCommitG + ":file"})
+	if _, err := session.call("textDocument/didChange", params); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.published()[fileURI][0].Range.Start.Line; got != 2 {
+		t.Errorf("line after changing = %d", got)
+	}
+	if _, err := session.call("textDocument/didClose", params); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.published()[fileURI][0].Range.Start.Line; got != 1 {
+		t.Errorf("line after closing = %d", got)
+	}
+	if _, err := session.call("textDocument/didOpen", lspDocumentParams{TextDocument: lspTextDocument{URI: "file:///elsewhere"}}); err != nil {
+		t.Fatal(err)
+	}
+	if published := session.published(); len(published) != 0 {
+		t.Errorf("published for a file outside of the repo: %+v", published)
+	}
+
+	// Resolving the thread clears its diagnostic.
+	result, err = session.call("textDocument/codeAction", lspCodeActionParams{})
+	if err != nil || len(result.([]lspCodeAction)) != 0 {
+		t.Fatalf("code actions = %+v, %v", result, err)
+	}
+	codeActionParams := lspCodeActionParams{}
+	codeActionParams.Context.Diagnostics = []lspDiagnostic{diagnostic, {Message: "from another server"}}
+	result, err = session.call("textDocument/codeAction", codeActionParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := result.([]lspCodeAction)
+	if len(actions) != 2 {
+		t.Fatalf("code actions = %+v", actions)
+	}
+	for _, action := range []lspCodeAction{actions[1], actions[0]} {
+		if _, err := session.call("workspace/executeCommand", action.Command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if published := session.published(); len(published[fileURI]) != 0 {
+		t.Errorf("published after resolving = %+v", published)
+	}
+	r, err := review.Get(s.repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []string
+	for _, thread := range r.Comments {
+		if thread.Hash == diagnostic.Data.Thread {
+			for _, child := range thread.Children {
+				replies = append(replies, child.Comment.Description)
+			}
+		}
+	}
+	if len(replies) != 2 {
+		t.Errorf("replies = %q", replies)
+	}
+
+	if _, err := session.call("shutdown", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.call("exit", nil); err != jsonrpc.ErrStop {
+		t.Errorf("exit = %v", err)
+	}
+}
+
+func TestLanguageServerAnalyses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"analyze_response": [{"note": [
+			{"location": {"path": "file", "range": {"start_line": 1, "start_column": 1, "end_line": 1, "end_column": 3}}, "category": "lint", "description": "Unused"},
+			{"location": {"path": "file"}, "description": "Whole file"},
+			{"description": "Nowhere"}
+		]}]}`)
+	}))
+	defer server.Close()
+
+	session := newLSPSession(t)
+	s := session.s
+	r, err := review.Get(s.repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headCommit, err := r.GetHeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.root, "file"), []byte("header\n"+headCommit+":file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repo.AppendNote(analyses.Ref, headCommit, repository.Note(`{"timestamp": "0000000010", "url": "`+server.URL+`/fail", "status": "nmw"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.call("initialize", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.call("initialized", nil); err != nil {
+		t.Fatal(err)
+	}
+	if published := session.published(); len(published) != 0 {
+		t.Errorf("published for failed analyses = %+v", published)
+	}
+
+	if err := s.repo.AppendNote(analyses.Ref, headCommit, repository.Note(`{"timestamp": "0000000011", "url": "`+server.URL+`/report", "status": "nmw"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.call("textDocument/didSave", nil); err != nil {
+		t.Fatal(err)
+	}
+	diagnostics := session.published()[s.uriOf("file")]
+	if len(diagnostics) != 2 || diagnostics[0].Code != "lint" || diagnostics[0].Range != (lspRange{lspPosition{1, 0}, lspPosition{1, 2}}) || diagnostics[1].Range != (lspRange{}) {
+		t.Errorf("diagnostics = %+v", diagnostics)
+	}
+
+	// The notes of a report are only downloaded once.
+	server.Close()
+	s.findings = nil
+	if err := s.publishAll(); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := session.published()[s.uriOf("file")]; len(diagnostics) != 2 {
+		t.Errorf("diagnostics = %+v", diagnostics)
+	}
+
+	// Removing the file clears its diagnostics.
+	if err := os.Remove(filepath.Join(s.root, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.publishAll(); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics, ok := session.published()[s.uriOf("file")]; !ok || len(diagnostics) != 0 {
+		t.Errorf("diagnostics = %+v", diagnostics)
+	}
+}
+
+func TestLanguageServerErrors(t *testing.T) {
+	session := newLSPSession(t)
+	if _, err := session.call("initialize", nil); err != nil {
+		t.Fatal(err)
+	}
+	thread := lspThread{Review: repository.TestCommitG, Thread: "nonexistent", Message: "Done"}
+	for _, params := range []any{
+		lspExecuteCommandParams{Command: "other"},
+		lspExecuteCommandParams{Command: lspReplyCommand},
+		lspCommand{Command: lspReplyCommand, Arguments: []any{"x"}},
+		lspCommand{Command: lspReplyCommand, Arguments: []any{lspThread{Review: repository.TestCommitG, Thread: "nonexistent"}}},
+		lspCommand{Command: lspReplyCommand, Arguments: []any{thread}},
+		lspCommand{Command: lspReplyCommand, Arguments: []any{lspThread{Review: "nonexistent", Thread: "x", Message: "Done"}}},
+		lspCommand{Command: lspReplyCommand, Arguments: []any{lspThread{Review: repository.TestCommitA, Thread: "x", Message: "Done"}}},
+		"x",
+	} {
+		if _, err := session.call("workspace/executeCommand", params); err == nil {
+			t.Errorf("executeCommand(%+v) succeeded", params)
+		}
+	}
+	for _, method := range []string{"textDocument/didOpen", "textDocument/codeAction"} {
+		if _, err := session.call(method, "x"); err == nil {
+			t.Errorf("%s with invalid params succeeded", method)
+		}
+	}
+	if _, err := session.call("other", nil); err == nil {
+		t.Error("expected an error for an unknown method")
+	}
+}
+
+func TestLanguageServerRun(t *testing.T) {
+	exchange := func(messages ...string) (string, error) {
+		var input, out strings.Builder
+		for _, message := range messages {
+			fmt.Fprintf(&input, "Content-Length: %d\r\n\r\n%s", len(message), message)
+		}
+		s := newLanguageServer(repository.NewMockRepoForTest(), jsonrpc.NewHeaderConn(strings.NewReader(input.String()), &out))
+		err := s.run()
+		return out.String(), err
+	}
+	out, err := exchange(
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {}}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "shutdown"}`,
+		`{"jsonrpc": "2.0", "method": "exit"}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "shutdown"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"id":1,"result":{"capabilities"`) || !strings.Contains(out, `{"jsonrpc":"2.0","id":2,"result":null}`) || strings.Contains(out, `"id":3`) {
+		t.Errorf("output = %s", out)
+	}
+	if _, err := exchange(`{"jsonrpc": "2.0", "method": "exit"}`); err == nil {
+		t.Error("expected an error exiting without shutting down")
+	}
+	if _, err := exchange(`{`, `{"jsonrpc": "2.0", "id": 1, "method": "initialize"}`, `{"jsonrpc": "2.0", "id": 2, "method": "shutdown"}`, `{"jsonrpc": "2.0", "method": "exit"}`); err != nil {
+		t.Errorf("a parse error stopped the server: %v", err)
+	}
+}
+
+func TestServeLanguage(t *testing.T) {
+	defer resetLSPFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := serveLanguage(repo, []string{"extra"}); err == nil {
+		t.Error("expected an error for extra arguments")
+	}
+	if err := serveLanguage(repo, []string{"-stdio=false"}); err == nil {
+		t.Error("expected an error without --stdio")
+	}
+	resetLSPFlags()
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdin = devNull
+	if err := serveLanguage(repo, []string{"--stdio"}); err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Errorf("serveLanguage() with no input = %v", err)
+	}
+}
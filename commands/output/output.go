@@ -25,6 +25,7 @@ import (
 
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/attestation"
 )
 
 const (
@@ -44,7 +45,7 @@ const (
 	// Template for printing the summary of a code review.
 	reviewDetailsTemplate = `  %q -> %q
   reviewers: %q
-  requester: %q
+  requester: %q%s
   build status: %s
 `
 	// Template for printing the location of an inline comment
@@ -52,7 +53,7 @@ const (
 `
 	// Template for printing a single comment.
 	commentTemplate = `comment: %s
-author: %s
+author: %s%s
 time:   %s
 status: %s`
 
@@ -67,6 +68,26 @@ time:   %s`
 
 	// Number of lines of context to print for inline comments
 	contextLineCount = 5
+
+	// Template for printing the header of the incoming half of a sync status.
+	incomingChangesTemplate = `Incoming changes from %q (merged by pull):
+`
+	// Template for printing the header of the outgoing half of a sync status.
+	outgoingChangesTemplate = `Outgoing changes to %q (sent by push):
+`
+	// Template for printing a single review change within a sync status.
+	reviewChangeTemplate = `  [%s] %.12s
+    %s
+`
+	// Template for printing a verified review attestation.
+	attestationTemplate = `Verified attestation of %.12s signed by %s:
+  review: %.12s
+  %q -> %q
+  requester: %s
+  approvers: %s
+  build status: %s
+  policy: %s
+`
 )
 
 // getStatusString returns a human friendly string encapsulating both the review's
@@ -170,6 +191,18 @@ func showThread(repo repository.Repo, thread review.CommentThread, indent string
 }
 
 // showSubThread prints the given comment (sub)thread, indented by the given prefix string.
+// getSignatureString returns a note on the signature status of a comment or
+// request, for display after its author. Unsigned ones get no note.
+func getSignatureString(signature string, verified bool) string {
+	if signature == "" {
+		return ""
+	}
+	if verified {
+		return " (signed)"
+	}
+	return " (unverified signature)"
+}
+
 func showSubThread(repo repository.Repo, thread review.CommentThread, indent string) {
 	statusString := "fyi"
 	if thread.Resolved != nil {
@@ -181,7 +214,8 @@ func showSubThread(repo repository.Repo, thread review.CommentThread, indent str
 	}
 	threadHash := thread.Hash
 	timestamp := reformatTimestamp(thread.Comment.Timestamp)
-	commentSummary := fmt.Sprintf(indent+commentTemplate, threadHash, thread.Comment.Author, timestamp, statusString)
+	signature := getSignatureString(thread.Comment.Signature, thread.Verified)
+	commentSummary := fmt.Sprintf(indent+commentTemplate, threadHash, thread.Comment.Author, signature, timestamp, statusString)
 	indent = indent + "  "
 	indentedSummary := strings.Replace(commentSummary, "\n", "\n"+indent, -1)
 	indentedDescription := Reflow(thread.Comment.Description, indent, 80)
@@ -352,7 +386,8 @@ func PrintDetails(r *review.Review) error {
 	PrintSummary(r.Summary)
 	fmt.Printf(reviewDetailsTemplate, r.Request.ReviewRef, r.Request.TargetRef,
 		strings.Join(r.Request.Reviewers, ", "),
-		r.Request.Requester, r.GetBuildStatusMessage())
+		r.Request.Requester, getSignatureString(r.Request.Signature, r.RequestVerified),
+		r.GetBuildStatusMessage())
 	printAnalyses(r)
 	if err := printComments(r); err != nil {
 		return err
@@ -395,3 +430,94 @@ func PrintDiff(r *review.Review, diffArgs ...string) error {
 	fmt.Println(diff)
 	return nil
 }
+
+// getChangeStatusString returns a short description of the kind of change
+// that a sync would make to a review.
+func getChangeStatusString(c review.ReviewChange) string {
+	if c.New {
+		return "new"
+	}
+	if c.NewStatus != "" {
+		return c.OldStatus + " -> " + c.NewStatus
+	}
+	return "updated"
+}
+
+// pluralize formats a count of items, e.g. "1 comment" or "2 comments".
+func pluralize(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, noun)
+	}
+	return fmt.Sprintf("%d %ss", count, noun)
+}
+
+// printReviewChanges prints the changes that a sync would make in one direction.
+func printReviewChanges(changes []review.ReviewChange, archived int) {
+	if len(changes) == 0 && archived == 0 {
+		fmt.Println("  none")
+		return
+	}
+	for _, c := range changes {
+		indentedDescription := strings.Replace(c.Description, "\n", "\n    ", -1)
+		fmt.Printf(reviewChangeTemplate, getChangeStatusString(c), c.Revision, indentedDescription)
+		if c.Requests > 0 {
+			fmt.Printf("    %s\n", pluralize(c.Requests, "new request"))
+		}
+		if len(c.Comments) > 0 {
+			fmt.Printf("    %s\n", pluralize(len(c.Comments), "new comment"))
+		}
+	}
+	if archived > 0 {
+		fmt.Printf("  %s\n", pluralize(archived, "archived commit"))
+	}
+}
+
+// PrintSyncStatus prints the differences between the local and remote review metadata.
+func PrintSyncStatus(s *review.SyncStatus) {
+	fmt.Printf(incomingChangesTemplate, s.Remote)
+	printReviewChanges(s.Incoming, s.IncomingArchives)
+	fmt.Printf(outgoingChangesTemplate, s.Remote)
+	printReviewChanges(s.Outgoing, s.OutgoingArchives)
+}
+
+// getApproversString returns a human friendly list of the approvers in an attestation.
+func getApproversString(approvals []attestation.Approval) string {
+	if len(approvals) == 0 {
+		return "none"
+	}
+	var approvers []string
+	for _, approval := range approvals {
+		approver := approval.Author
+		if approval.Verified {
+			approver += " (signed)"
+		}
+		approvers = append(approvers, approver)
+	}
+	return strings.Join(approvers, ", ")
+}
+
+// getPolicyString returns a human friendly description of an attestation's policy.
+func getPolicyString(policy attestation.Policy) string {
+	approval := "approval required"
+	if !policy.RequireApproval {
+		approval = "submitted without approval (tbr)"
+	} else if policy.RequireVerifiedApprovals {
+		approval = "signed approval required"
+	}
+	if policy.Strategy == "" {
+		return approval
+	}
+	return fmt.Sprintf("%s, submitted by %s", approval, policy.Strategy)
+}
+
+// PrintAttestation prints a review attestation that has been verified.
+func PrintAttestation(s *attestation.Statement, signer string) {
+	p := s.Predicate
+	buildStatus := "unknown"
+	if p.CI != nil && p.CI.Status != "" {
+		buildStatus = p.CI.Status
+	}
+	fmt.Printf(attestationTemplate, s.Subject[0].Digest["gitCommit"], signer, p.ReviewRevision,
+		p.ReviewRef, p.TargetRef, p.Requester, getApproversString(p.Approvers),
+		buildStatus, getPolicyString(p.Policy))
+}
@@ -11,6 +11,7 @@ import (
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
 	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/attestation"
 	"msrl.dev/git-appraise/review/ci"
 	"msrl.dev/git-appraise/review/comment"
 	"msrl.dev/git-appraise/review/request"
@@ -594,6 +595,35 @@ func TestSeparateCommentsEndLine(t *testing.T) {
 	}
 }
 
+func TestShowSubThreadSignature(t *testing.T) {
+	for _, test := range []struct {
+		signature string
+		verified  bool
+		want      string
+	}{
+		{"", false, "author: signer\n"},
+		{"sig", true, "author: signer (signed)\n"},
+		{"sig", false, "author: signer (unverified signature)\n"},
+	} {
+		thread := review.CommentThread{
+			Hash: "sig123",
+			Comment: comment.Comment{
+				Timestamp:   "1000000000",
+				Author:      "signer",
+				Description: "signed comment",
+				Signature:   test.signature,
+			},
+			Verified: test.verified,
+		}
+		out := captureStdout(t, func() {
+			showSubThread(testMockRepo(), thread, "")
+		})
+		if !strings.Contains(out, test.want) {
+			t.Errorf("expected %q in the output, got %q", test.want, out)
+		}
+	}
+}
+
 // --- PrintDetails ---
 
 func TestPrintDetails(t *testing.T) {
@@ -624,6 +654,17 @@ func TestPrintDetails(t *testing.T) {
 	if !strings.Contains(out, "build status") {
 		t.Errorf("expected build status label, got %q", out)
 	}
+
+	r.Request.Signature = "sig"
+	r.RequestVerified = true
+	out = captureStdout(t, func() {
+		if err := PrintDetails(r); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, `requester: "tester" (signed)`) {
+		t.Errorf("expected a signed requester in output, got %q", out)
+	}
 }
 
 func TestPrintDetailsWithComments(t *testing.T) {
@@ -1174,3 +1215,82 @@ func TestPrintJSONError(t *testing.T) {
 		t.Error("expected error from PrintJSON")
 	}
 }
+
+func TestPrintSyncStatus(t *testing.T) {
+	status := &review.SyncStatus{
+		Remote: "origin",
+		Incoming: []review.ReviewChange{
+			{Revision: "0123456789abcdef", Description: "new\nreview", New: true, Requests: 1, NewStatus: review.StatusPending},
+			{Revision: "fedcba9876543210", Description: "accepted", Comments: []string{"c1"}, OldStatus: review.StatusPending, NewStatus: review.StatusAccepted},
+			{Revision: "aaaaaaaaaaaaaaaa", Description: "discussed", Comments: []string{"c1", "c2"}},
+		},
+		IncomingArchives: 2,
+	}
+	out := captureStdout(t, func() {
+		PrintSyncStatus(status)
+	})
+	for _, expected := range []string{
+		`Incoming changes from "origin" (merged by pull):`,
+		"  [new] 0123456789ab\n    new\n    review\n    1 new request\n",
+		"  [pending -> accepted] fedcba987654\n    accepted\n    1 new comment\n",
+		"  [updated] aaaaaaaaaaaa\n    discussed\n    2 new comments\n",
+		"  2 archived commits\n",
+		`Outgoing changes to "origin" (sent by push):` + "\n  none\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output, got %q", expected, out)
+		}
+	}
+}
+
+// --- PrintAttestation ---
+
+func TestPrintAttestation(t *testing.T) {
+	s := attestation.New(repository.TestCommitJ, attestation.Predicate{
+		ReviewRevision: repository.TestCommitG,
+		ReviewRef:      repository.TestReviewRef,
+		TargetRef:      repository.TestTargetRef,
+		Requester:      "requester",
+		Approvers: []attestation.Approval{
+			{Author: "alice", Verified: true},
+			{Author: "bob"},
+		},
+		CI:     &ci.Report{Status: ci.StatusSuccess},
+		Policy: attestation.Policy{RequireApproval: true, RequireVerifiedApprovals: true, Strategy: "merge"},
+	})
+	out := captureStdout(t, func() {
+		PrintAttestation(&s, "submitter")
+	})
+	for _, want := range []string{
+		"Verified attestation of J signed by submitter:",
+		"approvers: alice (signed), bob\n",
+		"build status: success\n",
+		"policy: signed approval required, submitted by merge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the output, got %q", want, out)
+		}
+	}
+}
+
+func TestPrintAttestationDefaults(t *testing.T) {
+	s := attestation.New(repository.TestCommitJ, attestation.Predicate{})
+	out := captureStdout(t, func() {
+		PrintAttestation(&s, "submitter")
+	})
+	for _, want := range []string{
+		"approvers: none\n",
+		"build status: unknown\n",
+		"policy: submitted without approval (tbr)\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the output, got %q", want, out)
+		}
+	}
+}
+
+func TestGetPolicyString(t *testing.T) {
+	if got, want := getPolicyString(attestation.Policy{RequireApproval: true}), "approval required"; got != want {
+		t.Errorf("getPolicyString() = %q, want %q", got, want)
+	}
+}
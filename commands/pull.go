@@ -52,4 +52,5 @@ var pullCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return pull(repo, args)
 	},
+	changesReviews: true,
 }
@@ -17,56 +17,19 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/repository"
-	"msrl.dev/git-appraise/review"
 )
 
 var rebaseFlagSet = flag.NewFlagSet("rebase", flag.ExitOnError)
 
 var rebaseArchive = rebaseFlagSet.Bool("archive", true, "Prevent the original commit from being garbage collected.")
 
-// Validate that the user's request to rebase a review makes sense.
-//
-// This checks both that the request is well formed, and that the
-// corresponding review is in a state where rebasing is appropriate.
-func validateRebaseRequest(repo repository.Repo, args []string) (*review.Review, error) {
-	var r *review.Review
-	var err error
-	if len(args) > 1 {
-		return nil, errors.New("Only rebasing a single review is supported.")
-	}
-	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
-	}
-	if err != nil {
-		return nil, fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return nil, errors.New("There is no matching review.")
-	}
-
-	if r.Submitted {
-		return nil, errors.New("The review has already been submitted.")
-	}
-
-	if r.Request.TargetRef == "" {
-		return nil, errors.New("The review was abandoned.")
-	}
-
-	target := r.Request.TargetRef
-	if err := repo.VerifyGitRef(target); err != nil {
-		return nil, err
-	}
-
-	return r, nil
-}
-
 // Rebase the current code review.
 //
 // The "args" parameter contains all of the command line arguments that followed the subcommand.
@@ -74,11 +37,14 @@ func rebaseReview(repo repository.Repo, args []string) error {
 	rebaseFlagSet.Parse(args)
 	args = rebaseFlagSet.Args()
 
-	r, err := validateRebaseRequest(repo, args)
-	if err != nil {
-		return err
+	if len(args) > 1 {
+		return errors.New("Only rebasing a single review is supported.")
+	}
+	var revision string
+	if len(args) == 1 {
+		revision = args[0]
 	}
-	return r.Rebase(*rebaseArchive)
+	return client.New(repo).Rebase(context.Background(), revision, client.RebaseOptions{NoArchive: !*rebaseArchive})
 }
 
 // rebaseCmd defines the "rebase" subcommand.
@@ -90,4 +56,5 @@ var rebaseCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return rebaseReview(repo, args)
 	},
+	changesReviews: true,
 }
@@ -0,0 +1,116 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+// redactInstructions explains how to finish removing a redacted comment,
+// since rewriting the local notes history does not affect any other copies.
+const redactInstructions = `Redacted comment %s in %d commits of %s.
+
+The original comment is still present in every remote and in every other
+clone of this repo. To finish removing it:
+
+  1. Force-push the rewritten notes to each remote, before pulling from it
+     again (otherwise the pull merges the original comment back in):
+
+       git push --force <remote> %s:%s
+
+     Remotes that validate pushes with "git appraise validate-push" accept
+     this, unless they check the pusher and you did not write the comment.
+     The push is also rejected if the remote sets
+     receive.denyNonFastForwards.
+
+  2. Ask everyone else with a clone to discard their copy of the notes and
+     to fetch the rewritten ones, before they next push or pull reviews:
+
+       git update-ref -d %s
+       git appraise pull <remote>
+
+  3. Expire the reflogs and prune the original comment, both here and in
+     each remote and clone:
+
+       git reflog expire --expire=now --all
+       git gc --prune=now
+`
+
+// redactComment replaces a comment with a tombstone throughout the history
+// of the comments notes ref.
+func redactComment(repo repository.Repo, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("Redacting a single comment is required.")
+	}
+	target := args[0]
+
+	allNotes, notesErr := repo.Notes(comment.Ref, "")
+	replacements := make(map[string]repository.Note)
+	var hash string
+	for _, notes := range allNotes {
+		for _, note := range notes {
+			c, err := comment.Parse(note)
+			if err != nil || c.Redacted != "" {
+				continue
+			}
+			commentHash, err := c.Hash()
+			if err != nil || !strings.HasPrefix(commentHash, target) {
+				continue
+			}
+			if hash != "" && hash != commentHash {
+				return fmt.Errorf("The comment hash %q is ambiguous.", target)
+			}
+			hash = commentHash
+			tombstone, err := c.Redact()
+			if err != nil {
+				return err
+			}
+			if replacements[string(note)], err = tombstone.Write(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := notesErr(); err != nil {
+		return err
+	}
+	if hash == "" {
+		return fmt.Errorf("There is no comment matching %q.", target)
+	}
+
+	rewritten, err := repo.RewriteNotesHistory(comment.Ref, replacements)
+	if err != nil {
+		return err
+	}
+	ref := namespacedRef(repo, comment.Ref)
+	fmt.Printf(redactInstructions, hash, rewritten, ref, ref, ref, ref)
+	return nil
+}
+
+// redactCmd defines the "redact" subcommand.
+var redactCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s redact <comment-hash>\n", arg0)
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return redactComment(repo, args)
+	},
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"iter"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+type errReadNotesRepo struct {
+	repository.Repo
+}
+
+func (r errReadNotesRepo) Notes(notesRef, prefix string) (iter.Seq2[string, []repository.Note], func() error) {
+	notes, _ := r.Repo.Notes(notesRef, prefix)
+	return notes, func() error { return fmt.Errorf("read failed") }
+}
+
+type errRewriteRepo struct {
+	repository.Repo
+}
+
+func (r errRewriteRepo) RewriteNotesHistory(notesRef string, replacements map[string]repository.Note) (int, error) {
+	return 0, fmt.Errorf("rewrite failed")
+}
+
+// addTestComment adds a comment on review G and returns its hash.
+func addTestComment(t *testing.T, repo repository.Repo, c comment.Comment) string {
+	t.Helper()
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := c.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestRedactComment(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	secret := comment.New("alice", "the password is hunter2")
+	secret.Timestamp = "0000000001"
+	secretHash := addTestComment(t, repo, secret)
+	reply := comment.New("bob", "please remove that")
+	reply.Timestamp = "0000000002"
+	reply.Parent = secretHash
+	addTestComment(t, repo, reply)
+
+	out := captureStdout(t, func() {
+		if err := redactComment(repo, []string{secretHash[:12]}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "Redacted comment "+secretHash) || !strings.Contains(out, "git push --force") {
+		t.Errorf("unexpected output %q", out)
+	}
+	for _, note := range repo.GetNotes(comment.Ref, repository.TestCommitG) {
+		if strings.Contains(string(note), "hunter2") {
+			t.Errorf("expected the comment to be redacted, got %q", note)
+		}
+	}
+
+	// The thread structure is unchanged.
+	comments, err := review.GetComments(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 || comments[0].Hash != secretHash || comments[0].Comment.Description != comment.RedactedDescription {
+		t.Fatalf("unexpected comments %+v", comments)
+	}
+	if len(comments[0].Children) != 1 || comments[0].Children[0].Comment.Description != reply.Description {
+		t.Errorf("expected the reply to be kept, got %+v", comments[0].Children)
+	}
+
+	// Redacting it again finds nothing, since only the tombstone is left.
+	if err := redactComment(repo, []string{secretHash}); err == nil {
+		t.Error("expected an error redacting a tombstone")
+	}
+}
+
+func TestRedactCommentNamespace(t *testing.T) {
+	repo, err := repository.NewNamespacedRepo(repository.NewMockRepoForTest(), "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := comment.New("alice", "the password is hunter2")
+	secret.Timestamp = "0000000001"
+	secretHash := addTestComment(t, repo, secret)
+
+	out := captureStdout(t, func() {
+		if err := redactComment(repo, []string{secretHash}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "git push --force <remote> refs/notes/security/discuss:refs/notes/security/discuss") {
+		t.Errorf("expected the instructions to use the namespaced ref, got %q", out)
+	}
+}
+
+func TestRedactCommentErrors(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if err := redactComment(repo, nil); err == nil {
+		t.Error("expected an error for a missing comment hash")
+	}
+	if err := redactComment(repo, []string{""}); err == nil {
+		t.Error("expected an error for an empty comment hash")
+	}
+	if err := redactComment(repo, []string{"missing"}); err == nil {
+		t.Error("expected an error for an unknown comment")
+	}
+	if err := redactComment(errReadNotesRepo{repo}, []string{"missing"}); err == nil {
+		t.Error("expected an error reading the notes")
+	}
+
+	// Add comments until two of them share the first character of their hashes.
+	seen := make(map[string]bool)
+	var prefix string
+	for i := 0; prefix == ""; i++ {
+		c := comment.New("alice", fmt.Sprintf("comment %d", i))
+		c.Timestamp = fmt.Sprintf("%010d", i)
+		hash := addTestComment(t, repo, c)
+		if seen[hash[:1]] {
+			prefix = hash[:1]
+		}
+		seen[hash[:1]] = true
+	}
+	if err := redactComment(repo, []string{prefix}); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("expected an ambiguous hash error, got %v", err)
+	}
+
+	c := comment.New("alice", "secret")
+	c.Timestamp = "0000000001"
+	hash := addTestComment(t, repo, c)
+	if err := redactComment(errRewriteRepo{repo}, []string{hash}); err == nil {
+		t.Error("expected an error rewriting the notes")
+	}
+}
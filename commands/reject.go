@@ -17,14 +17,14 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/input"
 	"msrl.dev/git-appraise/repository"
-	"msrl.dev/git-appraise/review"
-	"msrl.dev/git-appraise/review/comment"
 )
 
 var rejectFlagSet = flag.NewFlagSet("reject", flag.ExitOnError)
@@ -32,6 +32,7 @@ var rejectFlagSet = flag.NewFlagSet("reject", flag.ExitOnError)
 var (
 	rejectMessageFile = rejectFlagSet.String("F", "", "Take the comment from the given file. Use - to read the message from the standard input")
 	rejectMessage     = rejectFlagSet.String("m", "", "Message to attach to the review")
+	rejectSign        = rejectFlagSet.Bool("S", false, signFlagUsage)
 )
 
 // rejectReview adds an NMW comment to the current code review.
@@ -39,26 +40,20 @@ func rejectReview(repo repository.Repo, args []string) error {
 	rejectFlagSet.Parse(args)
 	args = rejectFlagSet.Args()
 
-	var r *review.Review
-	var err error
 	if len(args) > 1 {
 		return errors.New("Only rejecting a single review is supported.")
 	}
-
+	var revision string
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
+		revision = args[0]
 	}
-
+	ctx := context.Background()
+	cl := client.New(repo)
+	r, err := cl.Get(ctx, revision)
 	if err != nil {
-		return fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return errors.New("There is no matching review.")
+		return err
 	}
-
-	if r.Request.TargetRef == "" {
+	if r.IsAbandoned() {
 		return errors.New("The review was abandoned.")
 	}
 
@@ -74,23 +69,8 @@ func rejectReview(repo repository.Repo, args []string) error {
 			return err
 		}
 	}
-
-	rejectedCommit, err := r.GetHeadCommit()
-	if err != nil {
-		return err
-	}
-	location := comment.Location{
-		Commit: rejectedCommit,
-	}
-	resolved := false
-	userEmail, err := repo.GetUserEmail()
-	if err != nil {
-		return err
-	}
-	c := comment.New(userEmail, *rejectMessage)
-	c.Location = &location
-	c.Resolved = &resolved
-	return r.AddComment(c)
+	_, err = cl.Reject(ctx, r.Revision, client.CommentOptions{Message: *rejectMessage, Sign: *rejectSign})
+	return err
 }
 
 // rejectCmd defines the "reject" subcommand.
@@ -102,4 +82,5 @@ var rejectCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return rejectReview(repo, args)
 	},
+	changesReviews: true,
 }
@@ -25,6 +25,7 @@ import (
 
 	"msrl.dev/git-appraise/commands/input"
 	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
 	"msrl.dev/git-appraise/review/request"
 )
 
@@ -47,6 +48,8 @@ var (
 	requestQuiet            = requestFlagSet.Bool("quiet", false, "Suppress review summary output")
 	requestAllowUncommitted = requestFlagSet.Bool("allow-uncommitted", false, "Allow uncommitted local changes.")
 	requestDate             = requestFlagSet.String("date", "", "request date")
+	requestSign             = requestFlagSet.Bool("S", false, signFlagUsage)
+	requestEncrypt          = requestFlagSet.Bool("encrypt", false, "Make this a private review, by encrypting its description and any later comments to the recipients in "+repository.EncryptToKey)
 )
 
 // Build the template review request based solely on the parsed flag values.
@@ -162,6 +165,21 @@ func requestReview(repo repository.Repo, args []string) error {
 		}
 		r.Description = description
 	}
+	encrypt := *requestEncrypt
+	// Updating a private review keeps it private.
+	if existing, err := review.GetSummary(repo, reviewCommit); err == nil && existing.Request.Encrypted != "" {
+		encrypt = true
+	}
+	if encrypt {
+		if err := r.Encrypt(repo); err != nil {
+			return fmt.Errorf("Failed to encrypt the request: %v", err)
+		}
+	}
+	if *requestSign {
+		if err := signRequest(repo, &r); err != nil {
+			return err
+		}
+	}
 	note, err := writeRequest(&r)
 	if err != nil {
 		return err
@@ -184,4 +202,5 @@ var requestCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return requestReview(repo, args)
 	},
+	changesReviews: true,
 }
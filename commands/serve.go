@@ -0,0 +1,435 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"msrl.dev/git-appraise/client"
+	"msrl.dev/git-appraise/commands/jsonrpc"
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+// eventNotification is the method of the notifications sent to subscribers
+// for each event.
+const eventNotification = "event"
+
+var serveFlagSet = flag.NewFlagSet("serve", flag.ExitOnError)
+
+var (
+	serveStdio        = serveFlagSet.Bool("stdio", false, "Speak JSON-RPC 2.0 over the standard input and output, with one message per line. This is currently required.")
+	servePollInterval = serveFlagSet.Duration("poll", 2*time.Second, "How often to check for changes to the reviews, for subscribers.")
+)
+
+// The params and results of the methods served.
+type (
+	listParams struct {
+		All bool `json:"all"`
+	}
+	reviewParams struct {
+		Review string `json:"review"`
+	}
+	diffParams struct {
+		Review   string   `json:"review"`
+		DiffArgs []string `json:"diffArgs"`
+	}
+	diffResult struct {
+		Diff string `json:"diff"`
+	}
+	commentParams struct {
+		Review   string         `json:"review"`
+		Message  string         `json:"message"`
+		Path     string         `json:"path"`
+		Range    *comment.Range `json:"range"`
+		Parent   string         `json:"parent"`
+		Resolved *bool          `json:"resolved"`
+		Sign     bool           `json:"sign"`
+	}
+	voteParams struct {
+		Review  string `json:"review"`
+		Message string `json:"message"`
+		Sign    bool   `json:"sign"`
+	}
+	commentResult struct {
+		Hash string `json:"hash"`
+	}
+	submitParams struct {
+		Review string `json:"review"`
+		// Strategy is "merge", "rebase", or "fast-forward", or empty for
+		// the strategy configured for the repo.
+		Strategy string `json:"strategy"`
+		TBR      bool   `json:"tbr"`
+		// Attest requires recording an attestation of the review, rather
+		// than skipping it when no signing key is available.
+		Attest   bool `json:"attest"`
+		NoAttest bool `json:"noAttest"`
+	}
+)
+
+// reviewServer serves the reviews in a repo over JSON-RPC.
+type reviewServer struct {
+	conn         *jsonrpc.Conn
+	pollInterval time.Duration
+
+	// mu guards the repo, and everything below, since the subscribers'
+	// changes are found concurrently with handling requests.
+	mu     sync.Mutex
+	repo   repository.Repo
+	client *client.Client
+	// stateHash is the state of the repo in which summaries were listed.
+	stateHash string
+	summaries []review.Summary
+
+	// stop, when not nil, stops sending events to the subscriber.
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+	snapshot *events.Snapshot
+	// pollHash is the state of the repo in which snapshot was taken.
+	pollHash string
+}
+
+func newReviewServer(repo repository.Repo, conn *jsonrpc.Conn, pollInterval time.Duration) *reviewServer {
+	return &reviewServer{repo: repo, client: client.New(repo), conn: conn, pollInterval: pollInterval}
+}
+
+// run serves requests until the connection is closed.
+func (s *reviewServer) run() error {
+	defer s.unsubscribe()
+	return s.conn.Serve(s.handle)
+}
+
+// decode decodes the params of a request, as a convenience for handlers.
+func decode[T any](params json.RawMessage) (T, error) {
+	var v T
+	err := jsonrpc.DecodeParams(params, &v)
+	return v, err
+}
+
+// handle handles a single request.
+func (s *reviewServer) handle(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "list":
+		p, err := decode[listParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.list(p)
+	case "get":
+		p, err := decode[reviewParams](params)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r, err := s.review(p.Review)
+		if err != nil {
+			return nil, err
+		}
+		r.VerifySignatures()
+		return r, nil
+	case "getDiff":
+		p, err := decode[diffParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.getDiff(p)
+	case "addComment":
+		p, err := decode[commentParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.addComment(p)
+	case "accept", "reject":
+		p, err := decode[voteParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.vote(p, method == "accept")
+	case "submit":
+		p, err := decode[submitParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.submit(p)
+	case "subscribe":
+		return nil, s.subscribe()
+	case "unsubscribe":
+		s.unsubscribe()
+		return nil, nil
+	}
+	return nil, &jsonrpc.Error{Code: jsonrpc.MethodNotFound, Message: fmt.Sprintf("unknown method %q", method)}
+}
+
+// list returns the summaries of the open reviews, or of all of them.
+//
+// The summaries are only listed again once the repo has changed, so that
+// repeated calls do not read all of the notes each time.
+func (s *reviewServer) list(p listParams) ([]review.Summary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, err := s.repo.GetRepoStateHash()
+	if err != nil {
+		return nil, err
+	}
+	if hash != s.stateHash || s.summaries == nil {
+		summaries, err := s.client.List(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		s.summaries, s.stateHash = summaries, hash
+	}
+	summaries := []review.Summary{}
+	for _, summary := range s.summaries {
+		if p.All || summary.IsOpen() {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries, nil
+}
+
+// review returns the review with the given revision, or the current review
+// if the revision is empty. The caller must hold s.mu.
+func (s *reviewServer) review(revision string) (*review.Review, error) {
+	return s.client.Get(context.Background(), revision)
+}
+
+func (s *reviewServer) getDiff(p diffParams) (*diffResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.review(p.Review)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := r.GetDiff(p.DiffArgs...)
+	if err != nil {
+		return nil, err
+	}
+	return &diffResult{Diff: diff}, nil
+}
+
+// comment adds a comment to a review, and runs the webhooks for that.
+// The caller must hold s.mu.
+func (s *reviewServer) comment(add func(ctx context.Context) (string, error)) (*commentResult, error) {
+	var hash string
+	err := runWithWebhooks(s.repo, func() error {
+		var err error
+		hash, err = add(context.Background())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &commentResult{Hash: hash}, nil
+}
+
+func (s *reviewServer) addComment(p commentParams) (*commentResult, error) {
+	if p.Message == "" {
+		return nil, &jsonrpc.Error{Code: jsonrpc.InvalidParams, Message: "a comment needs a message"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts := client.CommentOptions{
+		Message:  p.Message,
+		Location: &comment.Location{Path: p.Path, Range: p.Range},
+		Parent:   p.Parent,
+		Resolved: p.Resolved,
+		Sign:     p.Sign,
+	}
+	return s.comment(func(ctx context.Context) (string, error) {
+		return s.client.Comment(ctx, p.Review, opts)
+	})
+}
+
+// vote accepts or rejects a review.
+func (s *reviewServer) vote(p voteParams, accept bool) (*commentResult, error) {
+	if !accept && p.Message == "" {
+		return nil, &jsonrpc.Error{Code: jsonrpc.InvalidParams, Message: "rejecting a review needs a message"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts := client.CommentOptions{Message: p.Message, Sign: p.Sign}
+	return s.comment(func(ctx context.Context) (string, error) {
+		if accept {
+			return s.client.Accept(ctx, p.Review, opts)
+		}
+		return s.client.Reject(ctx, p.Review, opts)
+	})
+}
+
+func (s *reviewServer) submit(p submitParams) error {
+	switch p.Strategy {
+	case "", client.StrategyMerge, client.StrategyRebase, client.StrategyFastForward:
+	default:
+		return &jsonrpc.Error{Code: jsonrpc.InvalidParams, Message: fmt.Sprintf("unknown strategy %q", p.Strategy)}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return runWithWebhooks(s.repo, func() error {
+		return s.client.Submit(context.Background(), p.Review, client.SubmitOptions{
+			Strategy: p.Strategy,
+			TBR:      p.TBR,
+			NoAttest: p.NoAttest,
+			Attest:   p.Attest,
+			Warnings: os.Stderr,
+		})
+	})
+}
+
+// subscribe starts sending a notification for each event, as the reviews
+// change.
+func (s *reviewServer) subscribe() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return nil
+	}
+	hash, err := s.repo.GetRepoStateHash()
+	if err != nil {
+		return err
+	}
+	snapshot, err := events.TakeSnapshot(s.repo)
+	if err != nil {
+		return err
+	}
+	s.snapshot, s.pollHash = snapshot, hash
+	stop := make(chan struct{})
+	s.stop = stop
+	s.stopped.Add(1)
+	go func() {
+		defer s.stopped.Done()
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.poll()
+			}
+		}
+	}()
+	return nil
+}
+
+// unsubscribe stops sending notifications.
+func (s *reviewServer) unsubscribe() {
+	s.mu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.mu.Unlock()
+	s.stopped.Wait()
+}
+
+// poll notifies the subscriber of the events of any changes to the reviews
+// since they were last checked.
+func (s *reviewServer) poll() {
+	s.mu.Lock()
+	hash, err := s.repo.GetRepoStateHash()
+	if err != nil || hash == s.pollHash {
+		s.mu.Unlock()
+		return
+	}
+	after, err := events.TakeSnapshot(s.repo)
+	if err != nil {
+		s.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "Warning: failed to read the reviews: %v\n", err)
+		return
+	}
+	changes := events.Diff(s.snapshot, after)
+	s.snapshot, s.pollHash = after, hash
+	s.mu.Unlock()
+	for _, e := range changes {
+		s.conn.Notify(eventNotification, e)
+	}
+}
+
+// isolateStdio keeps the standard input and output for the JSON-RPC
+// messages, by giving the rest of the process (including any git commands
+// that it runs) no input and only the standard error for output. Git is also
+// kept from launching an editor, since there is no one to use it. It returns
+// a function that undoes this.
+func isolateStdio() (func(), error) {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = devNull, os.Stderr
+	var restoreEnv []func()
+	for _, key := range []string{"GIT_EDITOR", "GIT_SEQUENCE_EDITOR"} {
+		old, set := os.LookupEnv(key)
+		os.Setenv(key, "true")
+		restoreEnv = append(restoreEnv, func() {
+			if set {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+	return func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		devNull.Close()
+		for _, restore := range restoreEnv {
+			restore()
+		}
+	}, nil
+}
+
+// serveReviews serves the reviews in the repo to editors and other tools.
+func serveReviews(repo repository.Repo, args []string) error {
+	serveFlagSet.Parse(args)
+	if len(serveFlagSet.Args()) > 0 {
+		return errors.New("The serve command does not take any arguments.")
+	}
+	if !*serveStdio {
+		return errors.New("Only serving over the standard input and output, with --stdio, is supported.")
+	}
+	if *servePollInterval <= 0 {
+		return errors.New("The poll interval must be positive.")
+	}
+	conn := jsonrpc.NewConn(os.Stdin, os.Stdout)
+	restore, err := isolateStdio()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return newReviewServer(repo, conn, *servePollInterval).run()
+}
+
+// serveCmd defines the "serve" subcommand.
+var serveCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s serve --stdio [<option>...]\n\nOptions:\n", arg0)
+		serveFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return serveReviews(repo, args)
+	},
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"msrl.dev/git-appraise/client"
+	"msrl.dev/git-appraise/commands/jsonrpc"
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
+)
+
+// call calls a method on the server, with params encoded as JSON.
+func call(t *testing.T, s *reviewServer, method string, params any) (any, error) {
+	t.Helper()
+	raw, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.handle(method, raw)
+}
+
+func newTestServer(repo repository.Repo) (*reviewServer, *strings.Builder) {
+	var out strings.Builder
+	return newReviewServer(repo, jsonrpc.NewConn(strings.NewReader(""), &out), time.Millisecond), &out
+}
+
+func TestServeList(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	result, err := call(t, s, "list", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := result.([]review.Summary)
+	if len(open) != 1 || open[0].Revision != repository.TestCommitG {
+		t.Errorf("open reviews = %+v", open)
+	}
+	result, err = call(t, s, "list", listParams{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := result.([]review.Summary); len(all) <= len(open) {
+		t.Errorf("all reviews = %+v", all)
+	}
+
+	// The summaries are only listed again once the repo changes.
+	s.summaries = []review.Summary{}
+	if result, _ := call(t, s, "list", nil); len(result.([]review.Summary)) != 0 {
+		t.Errorf("the summaries were listed again for an unchanged repo")
+	}
+	if err := s.repo.AppendNote(comment.Ref, repository.TestCommitG, repository.Note(`{"author": "a", "description": "nit"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := call(t, s, "list", nil); len(result.([]review.Summary)) != 1 {
+		t.Errorf("the summaries were not listed again for a changed repo")
+	}
+}
+
+func TestServeGet(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	result, err := call(t, s, "get", reviewParams{Review: repository.TestCommitG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := result.(*review.Review); r.Revision != repository.TestCommitG {
+		t.Errorf("review = %+v", r)
+	}
+	if _, err := call(t, s, "get", reviewParams{Review: "nonexistent"}); err == nil {
+		t.Error("expected an error for a missing review")
+	}
+	if _, err := s.handle("get", json.RawMessage(`[1]`)); err == nil {
+		t.Error("expected an error for invalid params")
+	}
+}
+
+func TestServeGetDiff(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	if _, err := call(t, s, "getDiff", diffParams{Review: repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(t, s, "getDiff", diffParams{Review: "nonexistent"}); err == nil {
+		t.Error("expected an error for a missing review")
+	}
+}
+
+func TestServeAddComment(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	resolved := false
+	result, err := call(t, s, "addComment", commentParams{
+		Review:   repository.TestCommitG,
+		Message:  "Please fix this",
+		Resolved: &resolved,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := result.(*commentResult).Hash
+	r, err := review.Get(s.repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.HasComment(r.Comments, hash) {
+		t.Fatalf("comment %q was not added to %+v", hash, r.Comments)
+	}
+
+	if _, err := call(t, s, "addComment", commentParams{Review: repository.TestCommitG, Message: "Done", Parent: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(t, s, "addComment", commentParams{Review: repository.TestCommitG, Message: "Done", Parent: "nonexistent"}); err == nil {
+		t.Error("expected an error for a missing parent")
+	}
+	if _, err := call(t, s, "addComment", commentParams{Review: repository.TestCommitG}); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+	if _, err := call(t, s, "addComment", commentParams{Review: "nonexistent", Message: "nit"}); err == nil {
+		t.Error("expected an error for a missing review")
+	}
+	if _, err := call(t, s, "addComment", commentParams{Review: repository.TestCommitG, Message: "nit", Path: "foo", Range: &comment.Range{StartLine: 2}}); err == nil {
+		t.Error("expected an error for a missing line")
+	}
+	result, err = call(t, s, "addComment", commentParams{Review: repository.TestCommitG, Message: "nit", Path: "foo", Range: &comment.Range{StartLine: 1}, Sign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash = result.(*commentResult).Hash
+	r, err = review.Get(s.repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, thread := range r.Comments {
+		if thread.Hash == hash && (thread.Comment.Signature == "" || thread.Comment.Location.Path != "foo") {
+			t.Errorf("comment = %+v", thread.Comment)
+		}
+	}
+}
+
+func TestServeVote(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	if _, err := call(t, s, "reject", voteParams{Review: repository.TestCommitG}); err == nil {
+		t.Error("expected an error rejecting without a message")
+	}
+	if _, err := call(t, s, "accept", voteParams{Review: repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := review.Get(s.repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Resolved == nil || !*r.Resolved {
+		t.Errorf("review was not accepted: %v", r.Resolved)
+	}
+	if _, err := call(t, s, "reject", voteParams{Review: repository.TestCommitG, Message: "No"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(t, s, "accept", voteParams{Review: "nonexistent"}); err == nil {
+		t.Error("expected an error for a missing review")
+	}
+
+	resetAbandonFlags()
+	defer resetAbandonFlags()
+	if err := abandonReview(s.repo, []string{"-m", "abandoning", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(t, s, "reject", voteParams{Review: repository.TestCommitG, Message: "No"}); err == nil || !strings.Contains(err.Error(), "abandoned") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestServeSubmit(t *testing.T) {
+	for _, strategy := range []string{"", "merge", "rebase", "fast-forward"} {
+		s, _ := newTestServer(setupAcceptedReview(t))
+		captureStdout(t, func() {
+			if _, err := call(t, s, "submit", submitParams{Review: repository.TestCommitG, Strategy: strategy}); err != nil {
+				t.Errorf("strategy %q: %v", strategy, err)
+			}
+		})
+	}
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	if _, err := call(t, s, "submit", submitParams{Review: repository.TestCommitG}); err == nil {
+		t.Error("expected an error submitting an unaccepted review")
+	}
+	if _, err := call(t, s, "submit", submitParams{Review: "nonexistent"}); err == nil {
+		t.Error("expected an error for a missing review")
+	}
+	var rpcErr *jsonrpc.Error
+	if _, err := call(t, s, "submit", submitParams{Review: repository.TestCommitG, Strategy: "squash"}); !errors.As(err, &rpcErr) || rpcErr.Code != jsonrpc.InvalidParams {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestServeInvalidParams(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	for _, method := range []string{"list", "get", "getDiff", "addComment", "accept", "reject", "submit"} {
+		var rpcErr *jsonrpc.Error
+		if _, err := s.handle(method, json.RawMessage(`"x"`)); !errors.As(err, &rpcErr) || rpcErr.Code != jsonrpc.InvalidParams {
+			t.Errorf("%s: error = %v", method, err)
+		}
+	}
+	var rpcErr *jsonrpc.Error
+	if _, err := s.handle("nonexistent", nil); !errors.As(err, &rpcErr) || rpcErr.Code != jsonrpc.MethodNotFound {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestServeSubscribe(t *testing.T) {
+	s, out := newTestServer(repository.NewMockRepoForTest())
+	// Poll manually, rather than on the ticker.
+	s.pollInterval = time.Hour
+	if _, err := call(t, s, "subscribe", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(t, s, "subscribe", nil); err != nil {
+		t.Fatal(err)
+	}
+	s.poll()
+	if out.Len() != 0 {
+		t.Fatalf("notifications for an unchanged repo: %q", out.String())
+	}
+	if _, err := call(t, s, "addComment", commentParams{Review: repository.TestCommitG, Message: "nit"}); err != nil {
+		t.Fatal(err)
+	}
+	s.poll()
+	var notification struct {
+		Method string       `json:"method"`
+		Params events.Event `json:"params"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &notification); err != nil {
+		t.Fatalf("notification %q: %v", out.String(), err)
+	}
+	if notification.Method != eventNotification || notification.Params.Type != events.CommentAdded || notification.Params.Comment.Description != "nit" {
+		t.Errorf("notification = %+v", notification)
+	}
+	if _, err := call(t, s, "unsubscribe", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.stop != nil {
+		t.Error("the subscription was not stopped")
+	}
+}
+
+func TestServeRun(t *testing.T) {
+	s, _ := newTestServer(repository.NewMockRepoForTest())
+	in, inWriter := io.Pipe()
+	outReader, out := io.Pipe()
+	s.conn = jsonrpc.NewConn(in, out)
+	done := make(chan error)
+	go func() { done <- s.run() }()
+
+	responses := bufio.NewScanner(outReader)
+	request := func(message string) string {
+		t.Helper()
+		if _, err := io.WriteString(inWriter, message+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		if !responses.Scan() {
+			t.Fatal("no response")
+		}
+		return responses.Text()
+	}
+	if got := request(`{"jsonrpc": "2.0", "id": 1, "method": "subscribe"}`); got != `{"jsonrpc":"2.0","id":1,"result":null}` {
+		t.Errorf("response = %s", got)
+	}
+	got := request(`{"jsonrpc": "2.0", "id": 2, "method": "addComment", "params": {"review": "` + repository.TestCommitG + `", "message": "nit"}}`)
+	if !strings.Contains(got, `"hash"`) {
+		t.Errorf("response = %s", got)
+	}
+	// The comment is then announced by the subscription.
+	if !responses.Scan() || !strings.Contains(responses.Text(), `"method":"event"`) {
+		t.Errorf("notification = %s", responses.Text())
+	}
+	inWriter.Close()
+	go io.Copy(io.Discard, outReader)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.stop != nil {
+		t.Error("the subscription was not stopped")
+	}
+}
+
+func TestIsolateStdio(t *testing.T) {
+	t.Setenv("GIT_EDITOR", "vi")
+	os.Unsetenv("GIT_SEQUENCE_EDITOR")
+	stdin, stdout := os.Stdin, os.Stdout
+	restore, err := isolateStdio()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Stdin == stdin || os.Stdout != os.Stderr || os.Getenv("GIT_EDITOR") != "true" || os.Getenv("GIT_SEQUENCE_EDITOR") != "true" {
+		t.Error("the standard input and output were not isolated")
+	}
+	restore()
+	if os.Stdin != stdin || os.Stdout != stdout || os.Getenv("GIT_EDITOR") != "vi" {
+		t.Error("the standard input and output were not restored")
+	}
+	if _, set := os.LookupEnv("GIT_SEQUENCE_EDITOR"); set {
+		t.Error("GIT_SEQUENCE_EDITOR was not unset")
+	}
+}
+
+func TestServeReviews(t *testing.T) {
+	defer resetServeFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := serveReviews(repo, []string{"extra"}); err == nil {
+		t.Error("expected an error for extra arguments")
+	}
+	resetServeFlags()
+	if err := serveReviews(repo, nil); err == nil {
+		t.Error("expected an error without --stdio")
+	}
+	if err := serveReviews(repo, []string{"-stdio", "-poll", "0s"}); err == nil {
+		t.Error("expected an error for a non-positive poll interval")
+	}
+
+	// Serve an empty input.
+	resetServeFlags()
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdin = devNull
+	if err := serveReviews(repo, []string{"-stdio"}); err != nil {
+		t.Fatal(err)
+	}
+}
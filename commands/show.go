@@ -17,11 +17,13 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"strings"
 
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/commands/output"
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
@@ -64,24 +66,18 @@ func showReview(repo repository.Repo, args []string) error {
 		return errors.New("The --diff-opts flag can only be used with the --diff or --inline flag.")
 	}
 
-	var r *review.Review
-	var err error
 	if len(args) > 1 {
 		return errors.New("Only showing a single review is supported.")
 	}
-
+	var revision string
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
+		revision = args[0]
 	}
-
+	r, err := client.New(repo).Get(context.Background(), revision)
 	if err != nil {
-		return fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return errors.New("There is no matching review.")
+		return err
 	}
+	r.VerifySignatures()
 	if *showJSONOutput {
 		return output.PrintJSON(r)
 	}
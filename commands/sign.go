@@ -0,0 +1,44 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// signFlagUsage is the usage message shared by the "-S" flag of every
+// command that writes a comment or a request.
+const signFlagUsage = "Sign using the git signing key configured by user.signingkey and gpg.format"
+
+// signRequest signs the given review request with the user's signing key.
+//
+// This must be done after every other field of the request has been set.
+func signRequest(repo repository.Repo, r *request.Request) error {
+	payload, err := r.SigningPayload()
+	if err != nil {
+		return err
+	}
+	signature, err := repo.SignPayload(payload)
+	if err != nil {
+		return fmt.Errorf("Failed to sign the request: %v", err)
+	}
+	r.Signature = signature
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+)
+
+type errSignRepo struct {
+	repository.Repo
+}
+
+func (r errSignRepo) SignPayload(payload []byte) (string, error) {
+	return "", fmt.Errorf("no signing key")
+}
+
+// latestThread returns the most recent comment thread on the given review.
+func latestThread(t *testing.T, repo repository.Repo, revision string) review.CommentThread {
+	t.Helper()
+	r, err := review.Get(repo, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Comments) == 0 {
+		t.Fatal("expected the review to have comments")
+	}
+	r.VerifySignatures()
+	return r.Comments[len(r.Comments)-1]
+}
+
+func TestSignedAccept(t *testing.T) {
+	defer resetAcceptFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := repo.AddConfigValue(review.RequireVerifiedApprovalsKey, "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acceptReview(repo, []string{"-S", "-m", "LGTM", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	thread := latestThread(t, repo, repository.TestCommitG)
+	if thread.Comment.Signature == "" || !thread.Verified {
+		t.Errorf("expected a verified signature, got %+v", thread)
+	}
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Resolved == nil || !*r.Resolved {
+		t.Error("expected the signed approval to accept the review")
+	}
+}
+
+func TestSignedReject(t *testing.T) {
+	defer resetRejectFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := rejectReview(repo, []string{"-S", "-m", "NMW", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if thread := latestThread(t, repo, repository.TestCommitG); !thread.Verified {
+		t.Errorf("expected a verified signature, got %+v", thread)
+	}
+}
+
+func TestSignedComment(t *testing.T) {
+	defer resetCommentFlags()
+	repo := repository.NewMockRepoForTest()
+	*commentSign = true
+	*commentMessage = "signed"
+	if err := commentOnReview(repo, []string{repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if thread := latestThread(t, repo, repository.TestCommitG); !thread.Verified {
+		t.Errorf("expected a verified signature, got %+v", thread)
+	}
+}
+
+func TestSignedRequest(t *testing.T) {
+	defer resetRequestFlags()
+	repo := repository.NewMockRepoForTest()
+	captureStdout(t, func() {
+		err := requestReview(repo, []string{"-S", "-m", "signed review", "-date", "2005-04-07 22:13:13",
+			"-source", repository.TestReviewRef, "-target", repository.TestTargetRef, repository.TestCommitG})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.VerifySignatures()
+	if r.Request.Signature == "" || !r.RequestVerified {
+		t.Errorf("expected a verified request, got %+v", r.Request)
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	defer resetAcceptFlags()
+	defer resetRejectFlags()
+	defer resetCommentFlags()
+	defer resetRequestFlags()
+	repo := errSignRepo{repository.NewMockRepoForTest()}
+	if err := acceptReview(repo, []string{"-S", "-m", "LGTM", repository.TestCommitG}); err == nil {
+		t.Error("expected accept to fail when signing fails")
+	}
+	if err := rejectReview(repo, []string{"-S", "-m", "NMW", repository.TestCommitG}); err == nil {
+		t.Error("expected reject to fail when signing fails")
+	}
+	*commentSign = true
+	*commentMessage = "comment"
+	if err := commentOnReview(repo, []string{repository.TestCommitG}); err == nil {
+		t.Error("expected comment to fail when signing fails")
+	}
+	err := requestReview(repo, []string{"-S", "-m", "review",
+		"-source", repository.TestReviewRef, "-target", repository.TestTargetRef})
+	if err == nil {
+		t.Error("expected request to fail when signing fails")
+	}
+}
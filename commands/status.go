@@ -0,0 +1,84 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"msrl.dev/git-appraise/commands/output"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+)
+
+var statusFlagSet = flag.NewFlagSet("status", flag.ExitOnError)
+
+var (
+	statusNoFetch    = statusFlagSet.Bool("no-fetch", false, "Compare against the previously fetched remote refs rather than fetching them again.")
+	statusJSONOutput = statusFlagSet.Bool("json", false, "Format the output as JSON")
+)
+
+// syncStatus reports the differences between the local git-notes used for
+// reviews and those in a remote repo, without merging anything.
+func syncStatus(repo repository.Repo, args []string) error {
+	statusFlagSet.Parse(args)
+	statusArgs := statusFlagSet.Args()
+
+	if len(statusArgs) > 1 {
+		return errors.New(
+			"Only comparing with one remote at a time is supported.")
+	}
+
+	remote := "origin"
+	if len(statusArgs) == 1 {
+		remote = statusArgs[0]
+	}
+
+	if !*statusNoFetch {
+		// This only updates the remote-tracking copies of the notes and
+		// archive refs; the local refs are left untouched.
+		if _, err := repo.FetchAndReturnNewReviewHashes(remote, notesRefPattern, archiveRefPattern); err != nil {
+			return err
+		}
+	}
+	status, err := review.GetSyncStatus(repo, remote)
+	if err != nil {
+		return err
+	}
+	if *statusJSONOutput {
+		b, err := jsonMarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	output.PrintSyncStatus(status)
+	return nil
+}
+
+// statusCmd defines the "status" subcommand.
+var statusCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s status [<option>...] [<remote>]\n\nOptions:\n", arg0)
+		statusFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return syncStatus(repo, args)
+	},
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+)
+
+func resetStatusFlags() {
+	*statusNoFetch = false
+	*statusJSONOutput = false
+}
+
+// fetchRecordingRepo records the arguments of FetchAndReturnNewReviewHashes.
+type fetchRecordingRepo struct {
+	repository.Repo
+	fetchedRemote string
+	fetchErr      error
+}
+
+func (r *fetchRecordingRepo) FetchAndReturnNewReviewHashes(remote, notesRefPattern string, devtoolsRefPatterns ...string) ([]string, error) {
+	r.fetchedRemote = remote
+	return nil, r.fetchErr
+}
+
+type errGetAllNotesRepo struct {
+	repository.Repo
+}
+
+func (r errGetAllNotesRepo) GetAllNotes(notesRef string) (map[string][]repository.Note, error) {
+	return nil, fmt.Errorf("notes read failed")
+}
+
+func TestSyncStatusDefault(t *testing.T) {
+	defer resetStatusFlags()
+	repo := &fetchRecordingRepo{Repo: repository.NewMockRepoForTest()}
+	out := captureStdout(t, func() {
+		if err := syncStatus(repo, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if repo.fetchedRemote != "origin" {
+		t.Errorf("expected a fetch from origin, got %q", repo.fetchedRemote)
+	}
+	if !strings.Contains(out, `Outgoing changes to "origin"`) || !strings.Contains(out, "[new] G") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestSyncStatusNoFetch(t *testing.T) {
+	defer resetStatusFlags()
+	repo := &fetchRecordingRepo{Repo: repository.NewMockRepoForTest()}
+	captureStdout(t, func() {
+		if err := syncStatus(repo, []string{"-no-fetch", "upstream"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if repo.fetchedRemote != "" {
+		t.Errorf("expected no fetch, got one from %q", repo.fetchedRemote)
+	}
+}
+
+func TestSyncStatusJSON(t *testing.T) {
+	defer resetStatusFlags()
+	repo := repository.NewMockRepoForTest()
+	out := captureStdout(t, func() {
+		if err := syncStatus(repo, []string{"-json", "upstream"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var status review.SyncStatus
+	if err := json.Unmarshal([]byte(out), &status); err != nil {
+		t.Fatalf("failed to parse %q: %v", out, err)
+	}
+	if status.Remote != "upstream" || len(status.Outgoing) != 3 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestSyncStatusJSONMarshalError(t *testing.T) {
+	defer resetStatusFlags()
+	orig := jsonMarshalIndent
+	defer func() { jsonMarshalIndent = orig }()
+	jsonMarshalIndent = func(any, string, string) ([]byte, error) {
+		return nil, fmt.Errorf("marshal error")
+	}
+	if err := syncStatus(repository.NewMockRepoForTest(), []string{"-json"}); err == nil {
+		t.Error("expected marshal error")
+	}
+}
+
+func TestSyncStatusTooManyArgs(t *testing.T) {
+	defer resetStatusFlags()
+	if err := syncStatus(repository.NewMockRepoForTest(), []string{"a", "b"}); err == nil {
+		t.Error("expected error for too many args")
+	}
+}
+
+func TestSyncStatusFetchError(t *testing.T) {
+	defer resetStatusFlags()
+	repo := &fetchRecordingRepo{Repo: repository.NewMockRepoForTest(), fetchErr: fmt.Errorf("fetch failed")}
+	if err := syncStatus(repo, nil); err == nil {
+		t.Error("expected fetch error")
+	}
+}
+
+func TestSyncStatusNotesError(t *testing.T) {
+	defer resetStatusFlags()
+	repo := errGetAllNotesRepo{repository.NewMockRepoForTest()}
+	if err := syncStatus(repo, nil); err == nil {
+		t.Error("expected notes error")
+	}
+}
@@ -17,11 +17,15 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
+
+	"msrl.dev/git-appraise/client"
 	"msrl.dev/git-appraise/repository"
-	"msrl.dev/git-appraise/review"
 )
 
 var submitFlagSet = flag.NewFlagSet("submit", flag.ExitOnError)
@@ -32,8 +36,21 @@ var (
 	submitFastForward = submitFlagSet.Bool("fast-forward", false, "Create a merge using the default fast-forward mode.")
 	submitTBR         = submitFlagSet.Bool("tbr", false, "(To be reviewed) Force the submission of a review that has not been accepted.")
 	submitArchive     = submitFlagSet.Bool("archive", true, "Prevent the original commit from being garbage collected; only affects rebased submits.")
+
+	// submitAttest is the value of the -attest flag, or nil if it is not
+	// given, in which case an attestation is recorded only if it can be
+	// signed.
+	submitAttest *bool
 )
 
+func init() {
+	submitFlagSet.BoolFunc("attest", "Record a signed attestation of the review on the submitted commit, and fail if none can be signed. By default, one is recorded if it can be signed, unless the \""+client.AttestSubmitsKey+"\" config setting is false.", func(value string) error {
+		attest, err := strconv.ParseBool(value)
+		submitAttest = &attest
+		return err
+	})
+}
+
 // Submit the current code review request.
 //
 // The "args" parameter contains all of the command line arguments that followed the subcommand.
@@ -44,85 +61,31 @@ func submitReview(repo repository.Repo, args []string) error {
 	if *submitMerge && *submitRebase {
 		return errors.New("Only one of --merge or --rebase is allowed.")
 	}
-
-	var r *review.Review
-	var err error
 	if len(args) > 1 {
 		return errors.New("Only accepting a single review is supported.")
 	}
+	var revision string
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
-	} else {
-		r, err = review.GetCurrent(repo)
-	}
-
-	if err != nil {
-		return fmt.Errorf("Failed to load the review: %v\n", err)
-	}
-	if r == nil {
-		return errors.New("There is no matching review.")
-	}
-
-	if r.Submitted {
-		return errors.New("The review has already been submitted.")
+		revision = args[0]
 	}
 
-	if !*submitTBR && (r.Resolved == nil || !*r.Resolved) {
-		return errors.New("Not submitting as the review has not yet been accepted.")
-	}
-
-	target := r.Request.TargetRef
-	if err := repo.VerifyGitRef(target); err != nil {
-		return err
+	opts := client.SubmitOptions{
+		TBR:       *submitTBR,
+		NoArchive: !*submitArchive,
+		Warnings:  os.Stderr,
 	}
-	source, err := r.GetHeadCommit()
-	if err != nil {
-		return err
-	}
-
-	isAncestor, err := repo.IsAncestor(target, source)
-	if err != nil {
-		return err
-	}
-	if !isAncestor {
-		return errors.New("Refusing to submit a non-fast-forward review. First merge the target ref.")
-	}
-
-	if !(*submitRebase || *submitMerge || *submitFastForward) {
-		submitStrategy, err := repo.GetSubmitStrategy()
-		if err != nil {
-			return err
-		}
-		if submitStrategy == "merge" && !*submitRebase && !*submitFastForward {
-			*submitMerge = true
-		}
-		if submitStrategy == "rebase" && !*submitMerge && !*submitFastForward {
-			*submitRebase = true
-		}
-		if submitStrategy == "fast-forward" && !*submitRebase && !*submitMerge {
-			*submitFastForward = true
-		}
-	}
-
-	if *submitRebase {
-		if err := r.Rebase(*submitArchive); err != nil {
-			return err
-		}
-
-		source, err = r.GetHeadCommit()
-		if err != nil {
-			return err
-		}
-	}
-
-	if err := repo.SwitchToRef(target); err != nil {
-		return err
+	if submitAttest != nil {
+		opts.Attest, opts.NoAttest = *submitAttest, !*submitAttest
 	}
-	if *submitMerge {
-		submitMessage := fmt.Sprintf("Submitting review %.12s", r.Revision)
-		return repo.MergeRef(source, false, submitMessage, r.Request.Description)
+	switch {
+	case *submitMerge:
+		opts.Strategy = client.StrategyMerge
+	case *submitRebase:
+		opts.Strategy = client.StrategyRebase
+	case *submitFastForward:
+		opts.Strategy = client.StrategyFastForward
 	}
-	return repo.MergeRef(source, true)
+	return client.New(repo).Submit(context.Background(), revision, opts)
 }
 
 // submitCmd defines the "submit" subcommand.
@@ -134,4 +97,5 @@ var submitCmd = &Command{
 	RunMethod: func(repo repository.Repo, args []string) error {
 		return submitReview(repo, args)
 	},
+	changesReviews: true,
 }
@@ -0,0 +1,286 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+	"msrl.dev/git-appraise/schema"
+)
+
+var validatePushFlagSet = flag.NewFlagSet("validate-push", flag.ExitOnError)
+
+var (
+	validatePushPusher    = validatePushFlagSet.String("pusher", "", "Require new comments to be authored by this identity.")
+	validatePushPusherEnv = validatePushFlagSet.String("pusher-env", "", "Read the identity required by -pusher from the named environment variable (e.g. REMOTE_USER).")
+)
+
+// Test seam; not safe for t.Parallel().
+var validatePushInput io.Reader = os.Stdin
+
+// notesSchemas maps each of the notes refs with a known format to the schema
+// that every line in those notes must conform to.
+var notesSchemas = map[string]string{
+	request.Ref:  schema.Request,
+	comment.Ref:  schema.Comment,
+	ci.Ref:       schema.CI,
+	analyses.Ref: schema.Analysis,
+}
+
+// isZeroHash returns whether the given hash is the all-zeros hash that git
+// hooks use to denote a ref that does not exist.
+func isZeroHash(hash string) bool {
+	return strings.Trim(hash, "0") == ""
+}
+
+// ValidateNotesUpdate returns the reasons, if any, for rejecting the update of
+// the given ref from oldHash to newHash.
+//
+// Only the review notes refs are checked. Updates to those must only add new
+// lines to the notes, other than replacing comments with their tombstones,
+// and each new line must conform to the schema for the ref. Each tombstone must be
+// exactly the one that the "redact" command writes for the comment that it
+// replaces. If pusher is not empty, then new comments and tombstones must be
+// authored by it.
+//
+// Only the old and new values of the ref are compared, so that pushes which
+// rewrite the history of the notes (e.g. to compact or redact them) are
+// accepted. Every other commit in the new history must then only add lines
+// that are in the new value, so that none of them holds notes that were not
+// validated.
+//
+// For repos that use review namespaces, the notes refs in each of the
+// namespaces that reviews are read from are checked.
+func ValidateNotesUpdate(repo repository.Repo, ref, oldHash, newHash, pusher string) ([]string, error) {
+	reviewRef := ref
+	if nsRepo, ok := repo.(*repository.NamespacedRepo); ok {
+		reviewRef = nsRepo.DefaultRef(ref)
+	}
+	if !strings.HasPrefix(reviewRef, strings.TrimSuffix(notesRefPattern, "*")) {
+		return nil, nil
+	}
+	if isZeroHash(newHash) {
+		return []string{fmt.Sprintf("%s: deleting the review notes is not allowed", ref)}, nil
+	}
+	var history []string
+	var err error
+	if isZeroHash(oldHash) {
+		oldHash = ""
+		history = repo.ListCommits(newHash)
+	} else if history, err = repo.ListCommitsBetween(oldHash, newHash); err != nil {
+		return nil, err
+	}
+	diffs, err := repo.DiffNotes(oldHash, newHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var rejections []string
+	for _, diff := range diffs {
+		newLines := make(map[string]bool)
+		for _, note := range diff.New {
+			newLines[string(note)] = true
+		}
+		oldLines := make(map[string]bool)
+		for _, note := range diff.Old {
+			oldLines[string(note)] = true
+		}
+		// Comments may only be removed by replacing them with their
+		// tombstones, as done by the "redact" command.
+		tombstones := make(map[string]comment.Comment)
+		if reviewRef == comment.Ref {
+			for _, note := range diff.New {
+				if c, err := comment.Parse(note); err == nil && c.Redacted != "" && !oldLines[string(note)] {
+					tombstones[c.Redacted] = c
+				}
+			}
+		}
+		redacted := make(map[string]bool)
+		for _, note := range diff.Old {
+			if len(note) == 0 || newLines[string(note)] {
+				continue
+			}
+			if c, err := comment.Parse(note); err == nil && reviewRef == comment.Ref {
+				hash, err := c.Hash()
+				if tombstone, ok := tombstones[hash]; err == nil && ok && tombstone.IsTombstoneOf(c) {
+					redacted[hash] = true
+					continue
+				}
+			}
+			rejections = append(rejections, fmt.Sprintf("%s: the notes for %.12s remove or rewrite existing lines", ref, diff.Revision))
+			break
+		}
+		for _, note := range diff.New {
+			if len(note) == 0 || oldLines[string(note)] {
+				continue
+			}
+			// Only report each new line once, even if it is repeated.
+			oldLines[string(note)] = true
+			if schemaName, ok := notesSchemas[reviewRef]; ok {
+				if err := schema.Validate(schemaName, note); err != nil {
+					rejections = append(rejections, fmt.Sprintf("%s: invalid note for %.12s: %v", ref, diff.Revision, err))
+					continue
+				}
+			}
+			if reviewRef != comment.Ref {
+				continue
+			}
+			c, err := comment.Parse(note)
+			if err != nil {
+				continue
+			}
+			if c.Redacted != "" && !redacted[c.Redacted] {
+				rejections = append(rejections, fmt.Sprintf("%s: the notes for %.12s add a tombstone for %.12s that does not match a removed comment", ref, diff.Revision, c.Redacted))
+			} else if pusher != "" && c.Author != pusher {
+				rejections = append(rejections, fmt.Sprintf("%s: comment on %.12s is authored by %q rather than the pusher %q", ref, diff.Revision, c.Author, pusher))
+			}
+		}
+	}
+	// Diff each commit in the new history against its parent, so that each
+	// line only has to be checked in the commit that adds it.
+	var tipLines map[string]map[string]bool
+	for _, commit := range history {
+		if commit == newHash {
+			continue
+		}
+		details, err := repo.GetCommitDetails(commit)
+		if err != nil {
+			return nil, err
+		}
+		parent := ""
+		if len(details.Parents) > 0 {
+			parent = details.Parents[0]
+		}
+		historyDiffs, err := repo.DiffNotes(parent, commit)
+		if err != nil {
+			return nil, err
+		}
+		if tipLines == nil && len(historyDiffs) > 0 {
+			if tipLines, err = notesLines(repo, newHash); err != nil {
+				return nil, err
+			}
+		}
+		for _, diff := range historyDiffs {
+			oldLines := make(map[string]bool)
+			for _, note := range diff.Old {
+				oldLines[string(note)] = true
+			}
+			if slices.ContainsFunc(diff.New, func(note repository.Note) bool {
+				return len(note) > 0 && !oldLines[string(note)] && !tipLines[diff.Revision][string(note)]
+			}) {
+				rejections = append(rejections, fmt.Sprintf("%s: the notes for %.12s in %.12s have lines that are not in %.12s", ref, diff.Revision, commit, newHash))
+			}
+		}
+	}
+	return rejections, nil
+}
+
+// notesLines returns the set of lines in the notes for each annotated object
+// in the given version of a notes ref.
+func notesLines(repo repository.Repo, notesCommit string) (map[string]map[string]bool, error) {
+	diffs, err := repo.DiffNotes("", notesCommit)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string]map[string]bool)
+	for _, diff := range diffs {
+		lines[diff.Revision] = make(map[string]bool)
+		for _, note := range diff.New {
+			lines[diff.Revision][string(note)] = true
+		}
+	}
+	return lines, nil
+}
+
+// validatePush checks the review notes in a push, for use as either a
+// "pre-receive" or an "update" hook in the receiving repo.
+//
+// When run with no arguments, it reads the "<old> <new> <ref>" lines that are
+// passed to a pre-receive hook on stdin. Otherwise, it takes the same
+// "<ref> <old> <new>" arguments as an update hook.
+func validatePush(repo repository.Repo, args []string) error {
+	validatePushFlagSet.Parse(args)
+	validateArgs := validatePushFlagSet.Args()
+
+	pusher := *validatePushPusher
+	if *validatePushPusherEnv != "" {
+		pusher = os.Getenv(*validatePushPusherEnv)
+		if pusher == "" {
+			return fmt.Errorf("The environment variable %q does not identify the pusher.", *validatePushPusherEnv)
+		}
+	}
+
+	type update struct{ ref, oldHash, newHash string }
+	var updates []update
+	switch len(validateArgs) {
+	case 0:
+		scanner := bufio.NewScanner(validatePushInput)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 3 {
+				return fmt.Errorf("Malformed ref update %q.", scanner.Text())
+			}
+			updates = append(updates, update{ref: fields[2], oldHash: fields[0], newHash: fields[1]})
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	case 3:
+		updates = append(updates, update{ref: validateArgs[0], oldHash: validateArgs[1], newHash: validateArgs[2]})
+	default:
+		return errors.New("Expected either no arguments or the <ref> <old> <new> arguments of an update hook.")
+	}
+
+	var rejections []string
+	for _, u := range updates {
+		r, err := ValidateNotesUpdate(repo, u.ref, u.oldHash, u.newHash, pusher)
+		if err != nil {
+			return err
+		}
+		rejections = append(rejections, r...)
+	}
+	if len(rejections) > 0 {
+		return fmt.Errorf("Rejected the push of review notes:\n  %s", strings.Join(rejections, "\n  "))
+	}
+	return nil
+}
+
+// validatePushCmd defines the "validate-push" subcommand.
+var validatePushCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s validate-push [<option>...] [<ref> <old> <new>]\n\nOptions:\n", arg0)
+		validatePushFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return validatePush(repo, args)
+	},
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+const (
+	validOldNotes = "refs/notes/test/old"
+	validNewNotes = "refs/notes/test/new"
+	zeroHash      = "0000000000000000000000000000000000000000"
+)
+
+func resetValidatePushFlags() {
+	*validatePushPusher = ""
+	*validatePushPusherEnv = ""
+	validatePushInput = strings.NewReader("")
+}
+
+// notesHistoryRepo is a repo in which the given notes refs are the history of
+// the validNewNotes ref since the validOldNotes ref, which the mock repo
+// cannot represent for notes refs.
+type notesHistoryRepo struct {
+	repository.Repo
+	history    []string
+	err        error
+	detailsErr error
+}
+
+func (r notesHistoryRepo) ListCommitsBetween(from, to string) ([]string, error) {
+	return r.history, r.err
+}
+
+// GetCommitDetails returns each commit in the history with the previous one,
+// or the validOldNotes ref for the first, as its parent.
+func (r notesHistoryRepo) GetCommitDetails(ref string) (*repository.CommitDetails, error) {
+	i := slices.Index(r.history, ref)
+	if i < 0 || r.detailsErr != nil {
+		return nil, fmt.Errorf("unknown commit %q: %v", ref, r.detailsErr)
+	}
+	parent := validOldNotes
+	if i > 0 {
+		parent = r.history[i-1]
+	}
+	return &repository.CommitDetails{Parents: []string{parent}}, nil
+}
+
+// newNotesUpdateRepo returns a mock repo with the given notes for a single
+// revision under the validOldNotes and validNewNotes refs, in which the
+// latter is a child of the former.
+func newNotesUpdateRepo(t *testing.T, oldNotes, newNotes []string) repository.Repo {
+	t.Helper()
+	repo := repository.NewMockRepoForTest()
+	for ref, notes := range map[string][]string{validOldNotes: oldNotes, validNewNotes: newNotes} {
+		for _, note := range notes {
+			if err := repo.AppendNote(ref, repository.TestCommitB, repository.Note(note)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return notesHistoryRepo{Repo: repo, history: []string{validNewNotes}}
+}
+
+func writeTestComment(t *testing.T, author, timestamp string) string {
+	t.Helper()
+	c := comment.New(author, "comment")
+	c.Timestamp = timestamp
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(note)
+}
+
+type errDiffNotesRepo struct {
+	repository.Repo
+}
+
+func (r errDiffNotesRepo) DiffNotes(from, to string) ([]repository.NotesDiff, error) {
+	return nil, fmt.Errorf("diff failed")
+}
+
+func TestValidateNotesUpdate(t *testing.T) {
+	first := writeTestComment(t, "alice", "0000000001")
+	second := writeTestComment(t, "bob", "0000000002")
+	for _, test := range []struct {
+		description string
+		ref         string
+		oldNotes    []string
+		newNotes    []string
+		pusher      string
+		rejections  int
+	}{
+		{"append", comment.Ref, []string{first}, []string{first, second}, "", 0},
+		{"reorder", comment.Ref, []string{second, first}, []string{first, second}, "", 0},
+		{"rewrite", comment.Ref, []string{first}, []string{second}, "", 1},
+		{"invalid", comment.Ref, nil, []string{`{"author":"alice"}`, `{"author":"alice"}`}, "", 1},
+		{"invalid request", request.Ref, nil, []string{`{"timestamp":"0000000001"}`}, "", 1},
+		{"unknown ref", "refs/notes/devtools/other", nil, []string{"free form"}, "", 0},
+		{"not a notes ref", "refs/heads/main", []string{first}, nil, "", 0},
+		{"pusher", comment.Ref, []string{first}, []string{first, second}, "bob", 0},
+		{"other author", comment.Ref, nil, []string{first, second}, "bob", 1},
+		{"pusher ignored outside comments", request.Ref, nil, []string{`{"timestamp":"0000000001","requester":"alice"}`}, "bob", 0},
+	} {
+		repo := newNotesUpdateRepo(t, test.oldNotes, test.newNotes)
+		rejections, err := ValidateNotesUpdate(repo, test.ref, validOldNotes, validNewNotes, test.pusher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejections) != test.rejections {
+			t.Errorf("%s: expected %d rejections, got %q", test.description, test.rejections, rejections)
+		}
+	}
+}
+
+func TestValidateNotesUpdateNamespace(t *testing.T) {
+	repo, err := repository.NewNamespacedRepo(newNotesUpdateRepo(t, nil, []string{`{"author":"alice"}`}), "security", "teamA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"refs/notes/security/discuss", "refs/notes/teamA/discuss"} {
+		rejections, err := ValidateNotesUpdate(repo, ref, validOldNotes, validNewNotes, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejections) != 1 || !strings.HasPrefix(rejections[0], ref+": invalid note") {
+			t.Errorf("expected the note in %s to be validated, got %q", ref, rejections)
+		}
+	}
+	rejections, err := ValidateNotesUpdate(repo, comment.Ref, validOldNotes, validNewNotes, "")
+	if err != nil || len(rejections) != 0 {
+		t.Errorf("expected notes outside of the namespaces to be ignored, got %q, %v", rejections, err)
+	}
+}
+
+func TestValidateNotesUpdateRedaction(t *testing.T) {
+	first := writeTestComment(t, "alice", "0000000001")
+	c, err := comment.Parse(repository.Note(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstone, err := c.Redact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := tombstone.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := writeTestComment(t, "bob", "0000000002")
+	resolved := true
+	forged := tombstone
+	forged.Resolved = &resolved
+	forgedResolved, err := forged.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged = tombstone
+	forged.Author = "bob"
+	forgedAuthor, err := forged.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		description string
+		oldNotes    []string
+		newNotes    []string
+		pusher      string
+		rejections  int
+	}{
+		{"redacted", []string{first, second}, []string{string(note), second}, "", 0},
+		{"redacted by its author", []string{first}, []string{string(note)}, "alice", 0},
+		{"redacted by someone else", []string{first}, []string{string(note)}, "bob", 1},
+		{"tombstone without removal", []string{first}, []string{first, string(note)}, "", 1},
+		{"removal with the wrong tombstone", []string{first, second}, []string{string(note)}, "", 1},
+		{"tombstone that resolves the comment", []string{first}, []string{string(forgedResolved)}, "", 2},
+		{"tombstone by the pusher", []string{first}, []string{string(forgedAuthor)}, "bob", 2},
+	} {
+		repo := newNotesUpdateRepo(t, test.oldNotes, test.newNotes)
+		rejections, err := ValidateNotesUpdate(repo, comment.Ref, validOldNotes, validNewNotes, test.pusher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejections) != test.rejections {
+			t.Errorf("%s: expected %d rejections, got %q", test.description, test.rejections, rejections)
+		}
+	}
+}
+
+func TestValidateNotesUpdateCreateAndDelete(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if rejections, err := ValidateNotesUpdate(repo, request.Ref, zeroHash, request.Ref, ""); err != nil || len(rejections) != 0 {
+		t.Errorf("unexpected rejections for a new ref: %q, %v", rejections, err)
+	}
+	if rejections, err := ValidateNotesUpdate(repo, request.Ref, request.Ref, zeroHash, ""); err != nil || len(rejections) != 1 {
+		t.Errorf("expected the deletion to be rejected, got %q, %v", rejections, err)
+	}
+	if _, err := ValidateNotesUpdate(errDiffNotesRepo{repo}, request.Ref, zeroHash, request.Ref, ""); err == nil {
+		t.Error("expected an error from DiffNotes")
+	}
+}
+
+func TestValidateNotesUpdateHistory(t *testing.T) {
+	const midNotes = "refs/notes/test/mid"
+	first := writeTestComment(t, "alice", "0000000001")
+	second := writeTestComment(t, "bob", "0000000002")
+	for _, test := range []struct {
+		description string
+		midNotes    []string
+		rejections  int
+	}{
+		{"added in steps", []string{first}, 0},
+		{"added and then removed", []string{first, second, `{"author":"mallory"}`}, 1},
+		{"added to another revision", nil, 1},
+	} {
+		repo := newNotesUpdateRepo(t, nil, []string{first, second}).(notesHistoryRepo)
+		for _, note := range test.midNotes {
+			if err := repo.AppendNote(midNotes, repository.TestCommitB, repository.Note(note)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.midNotes == nil {
+			if err := repo.AppendNote(midNotes, repository.TestCommitC, repository.Note(first)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		repo.history = []string{midNotes, validNewNotes}
+		rejections, err := ValidateNotesUpdate(repo, comment.Ref, validOldNotes, validNewNotes, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejections) != test.rejections {
+			t.Errorf("%s: expected %d rejections, got %q", test.description, test.rejections, rejections)
+		}
+	}
+
+	repo := notesHistoryRepo{Repo: repository.NewMockRepoForTest(), err: fmt.Errorf("failed")}
+	if _, err := ValidateNotesUpdate(repo, comment.Ref, validOldNotes, validNewNotes, ""); err == nil {
+		t.Error("expected an error from ListCommitsBetween")
+	}
+	repo.err = nil
+	repo.history = []string{midNotes, validNewNotes}
+	repo.detailsErr = fmt.Errorf("failed")
+	if _, err := ValidateNotesUpdate(repo, comment.Ref, validOldNotes, validNewNotes, ""); err == nil {
+		t.Error("expected an error from GetCommitDetails")
+	}
+	repo = newNotesUpdateRepo(t, nil, []string{first}).(notesHistoryRepo)
+	if err := repo.AppendNote(midNotes, repository.TestCommitB, repository.Note(first)); err != nil {
+		t.Fatal(err)
+	}
+	repo.history = []string{midNotes, validNewNotes}
+	for _, from := range []string{validOldNotes, ""} {
+		if _, err := ValidateNotesUpdate(errHistoryDiffNotesRepo{repo, from}, comment.Ref, validOldNotes, validNewNotes, ""); err == nil {
+			t.Errorf("expected an error from DiffNotes from %q", from)
+		}
+	}
+}
+
+func TestValidateNotesUpdateHistoryReAdded(t *testing.T) {
+	first := writeTestComment(t, "alice", "0000000001")
+	second := writeTestComment(t, "bob", "0000000002")
+	bogus := `{"author":"mallory"}`
+	for _, test := range []struct {
+		description string
+		history     [][]string
+		rejections  int
+	}{
+		{"removed and then re-added", [][]string{{first, second}, {first}, {first, second}}, 0},
+		{"re-added and then removed", [][]string{{first, bogus}, {first}, {first, bogus}, {first}}, 2},
+	} {
+		repo := newNotesUpdateRepo(t, nil, []string{first, second}).(notesHistoryRepo)
+		repo.history = nil
+		for i, notes := range test.history {
+			ref := fmt.Sprintf("refs/notes/test/mid%d", i)
+			for _, note := range notes {
+				if err := repo.AppendNote(ref, repository.TestCommitB, repository.Note(note)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			repo.history = append(repo.history, ref)
+		}
+		repo.history = append(repo.history, validNewNotes)
+		rejections, err := ValidateNotesUpdate(repo, comment.Ref, validOldNotes, validNewNotes, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejections) != test.rejections {
+			t.Errorf("%s: expected %d rejections, got %q", test.description, test.rejections, rejections)
+		}
+	}
+}
+
+// errHistoryDiffNotesRepo fails to compare the notes from the given version,
+// other than when comparing the old and new values of a ref.
+type errHistoryDiffNotesRepo struct {
+	notesHistoryRepo
+	from string
+}
+
+func (r errHistoryDiffNotesRepo) DiffNotes(from, to string) ([]repository.NotesDiff, error) {
+	if from == r.from && (from == "" || to != validNewNotes) {
+		return nil, fmt.Errorf("diff failed")
+	}
+	return r.notesHistoryRepo.DiffNotes(from, to)
+}
+
+func TestValidatePushUpdateHook(t *testing.T) {
+	defer resetValidatePushFlags()
+	repo := newNotesUpdateRepo(t, nil, []string{writeTestComment(t, "alice", "0000000001")})
+	if err := validatePush(repo, []string{comment.Ref, validOldNotes, validNewNotes}); err != nil {
+		t.Error(err)
+	}
+	err := validatePush(repo, []string{"-pusher", "bob", comment.Ref, validOldNotes, validNewNotes})
+	if err == nil || !strings.Contains(err.Error(), `rather than the pusher "bob"`) {
+		t.Errorf("expected the push to be rejected, got %v", err)
+	}
+}
+
+func TestValidatePushPreReceiveHook(t *testing.T) {
+	defer resetValidatePushFlags()
+	repo := newNotesUpdateRepo(t, nil, []string{writeTestComment(t, "alice", "0000000001")})
+	t.Setenv("TEST_PUSHER", "alice")
+	validatePushInput = strings.NewReader(fmt.Sprintf("%s %s %s\n\n%s %s refs/heads/main\n",
+		validOldNotes, validNewNotes, comment.Ref, zeroHash, repository.TestCommitB))
+	if err := validatePush(repo, []string{"-pusher-env", "TEST_PUSHER"}); err != nil {
+		t.Error(err)
+	}
+
+	validatePushInput = strings.NewReader(fmt.Sprintf("%s %s %s\n", validOldNotes, zeroHash, comment.Ref))
+	if err := validatePush(repo, nil); err == nil {
+		t.Error("expected the deletion to be rejected")
+	}
+}
+
+func TestValidatePushErrors(t *testing.T) {
+	defer resetValidatePushFlags()
+	repo := repository.NewMockRepoForTest()
+	if err := validatePush(repo, []string{"a", "b"}); err == nil {
+		t.Error("expected an error for the wrong number of args")
+	}
+	if err := validatePush(repo, []string{"-pusher-env", "UNSET_TEST_PUSHER"}); err == nil {
+		t.Error("expected an error for an unset pusher variable")
+	}
+	*validatePushPusherEnv = ""
+	validatePushInput = strings.NewReader("malformed line\n")
+	if err := validatePush(repo, nil); err == nil {
+		t.Error("expected an error for malformed input")
+	}
+	validatePushInput = strings.NewReader(strings.Repeat("x", 1024*1024))
+	if err := validatePush(repo, nil); err == nil {
+		t.Error("expected an error for overly long input")
+	}
+	if err := validatePush(errDiffNotesRepo{repo}, []string{comment.Ref, zeroHash, comment.Ref}); err == nil {
+		t.Error("expected an error from DiffNotes")
+	}
+}
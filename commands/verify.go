@@ -0,0 +1,70 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"msrl.dev/git-appraise/commands/output"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/attestation"
+)
+
+// verifyAttestations checks the review attestations recorded for a commit.
+//
+// This only uses data in the local repo, so it works offline once the
+// review metadata has been pulled.
+func verifyAttestations(repo repository.Repo, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Verifying a single commit is required.")
+	}
+	commit, err := repo.GetCommitHash(args[0])
+	if err != nil {
+		return err
+	}
+	envelopes := attestation.ParseAllValid(repo.GetNotes(attestation.Ref, commit))
+	if len(envelopes) == 0 {
+		return fmt.Errorf("There are no review attestations for %.12s.", commit)
+	}
+	var failures []string
+	verified := 0
+	for _, envelope := range envelopes {
+		statement, signer, err := envelope.Verify(repo, commit)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		verified++
+		output.PrintAttestation(statement, signer)
+	}
+	if verified == 0 {
+		return fmt.Errorf("None of the review attestations for %.12s could be verified:\n  %s", commit, strings.Join(failures, "\n  "))
+	}
+	return nil
+}
+
+// verifyCmd defines the "verify" subcommand.
+var verifyCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s verify <commit>\n", arg0)
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return verifyAttestations(repo, args)
+	},
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/client"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/attestation"
+	"msrl.dev/git-appraise/review/ci"
+)
+
+// submittedCommit returns the commit that the target ref points to.
+func submittedCommit(t *testing.T, repo repository.Repo) string {
+	t.Helper()
+	commit, err := repo.GetCommitHash(repository.TestTargetRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestSubmitAttestAndVerify(t *testing.T) {
+	defer resetSubmitFlags()
+	for _, strategy := range []string{"-merge", "-rebase", "-fast-forward"} {
+		resetSubmitFlags()
+		repo := setupAcceptedReview(t)
+		report := ci.Report{Timestamp: "0000000001", Status: ci.StatusSuccess}
+		if err := repo.AppendNote(ci.Ref, repository.TestCommitI, repository.Note(`{"timestamp":"0000000001","status":"success"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := submitReview(repo, []string{strategy, repository.TestCommitG}); err != nil {
+			t.Fatal(err)
+		}
+		commit := submittedCommit(t, repo)
+		envelopes := attestation.ParseAllValid(repo.GetNotes(attestation.Ref, commit))
+		if len(envelopes) != 1 {
+			t.Fatalf("%s: expected 1 attestation, got %d", strategy, len(envelopes))
+		}
+		statement, signer, err := envelopes[0].Verify(repo, commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := statement.Predicate
+		if signer != "user@example.com" || p.ReviewRevision != repository.TestCommitG || len(p.Approvers) != 1 ||
+			!p.Policy.RequireApproval || p.Policy.Strategy != strings.TrimPrefix(strategy, "-") {
+			t.Errorf("%s: unexpected attestation %q %+v", strategy, signer, p)
+		}
+		if strategy != "-rebase" && (p.CI == nil || *p.CI != report) {
+			t.Errorf("%s: unexpected CI report %+v", strategy, p.CI)
+		}
+
+		out := captureStdout(t, func() {
+			if err := verifyAttestations(repo, []string{repository.TestTargetRef}); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !strings.Contains(out, "Verified attestation") || !strings.Contains(out, "signed by user@example.com") {
+			t.Errorf("%s: unexpected verify output %q", strategy, out)
+		}
+	}
+}
+
+func TestSubmitAttestConfig(t *testing.T) {
+	defer resetSubmitFlags()
+	resetSubmitFlags()
+	repo := setupAcceptedReview(t)
+	if err := submitReview(repo, []string{"-attest=false", repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if envelopes := attestation.ParseAllValid(repo.GetNotes(attestation.Ref, submittedCommit(t, repo))); len(envelopes) != 0 {
+		t.Errorf("expected the flag to disable attestations, got %+v", envelopes)
+	}
+
+	resetSubmitFlags()
+	repo = setupAcceptedReview(t)
+	if err := repo.AddConfigValue(client.AttestSubmitsKey, "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitReview(repo, []string{repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if envelopes := attestation.ParseAllValid(repo.GetNotes(attestation.Ref, submittedCommit(t, repo))); len(envelopes) != 0 {
+		t.Errorf("unexpected attestations %+v", envelopes)
+	}
+}
+
+func TestSubmitAttestErrors(t *testing.T) {
+	defer resetSubmitFlags()
+	resetSubmitFlags()
+	repo := setupAcceptedReview(t)
+	err := submitReview(errSignRepo{repo}, []string{"-attest", repository.TestCommitG})
+	if err == nil || !strings.Contains(err.Error(), "Not submitting") {
+		t.Errorf("expected an attestation error, got %v", err)
+	}
+
+	// Unless the flag is given, the review is submitted without an
+	// attestation if none can be signed.
+	resetSubmitFlags()
+	if err := submitReview(errSignRepo{repo}, []string{repository.TestCommitG}); err != nil {
+		t.Fatal(err)
+	}
+	if envelopes := attestation.ParseAllValid(repo.GetNotes(attestation.Ref, submittedCommit(t, repo))); len(envelopes) != 0 {
+		t.Errorf("unexpected attestations %+v", envelopes)
+	}
+
+	resetSubmitFlags()
+	repo = setupAcceptedReview(t)
+	if err := repo.AppendNote(ci.Ref, repository.TestCommitI, repository.Note(`{"timestamp":"invalid"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitReview(repo, []string{repository.TestCommitG}); err == nil {
+		t.Error("expected an error for an invalid CI report")
+	}
+}
+
+func TestVerifyAttestationsErrors(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if err := verifyAttestations(repo, nil); err == nil {
+		t.Error("expected an error for a missing commit")
+	}
+	if err := verifyAttestations(repo, []string{"missing"}); err == nil {
+		t.Error("expected an error for an unknown commit")
+	}
+	err := verifyAttestations(repo, []string{repository.TestCommitJ})
+	if err == nil || !strings.Contains(err.Error(), "no review attestations") {
+		t.Errorf("expected an error for a commit without attestations, got %v", err)
+	}
+
+	// An attestation for a different commit must not verify.
+	envelope, err := attestation.Sign(repo, attestation.New(repository.TestCommitI, attestation.Predicate{}), "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := envelope.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(attestation.Ref, repository.TestCommitJ, note); err != nil {
+		t.Fatal(err)
+	}
+	err = verifyAttestations(repo, []string{repository.TestCommitJ})
+	if err == nil || !strings.Contains(err.Error(), "could be verified") {
+		t.Errorf("expected a verification failure, got %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
+)
+
+// watchCommandKey is the git config setting that holds a shell command for
+// the watch command to run for each event, when none is given by its flags.
+const watchCommandKey = "appraise.watchCommand"
+
+// watchStateFile is the name of the file, in the repo's data directory, in
+// which the watch command keeps the state of the reviews that it has
+// reported the events of. Repos that read reviews from namespaces other
+// than the default one keep a separate file, named after those namespaces.
+const watchStateFile = "appraise-watch"
+
+// maxWatchBackoff is the longest that the watch command waits between
+// attempts to pull, after repeated failures.
+const maxWatchBackoff = time.Hour
+
+var watchFlagSet = flag.NewFlagSet("watch", flag.ExitOnError)
+
+var (
+	watchInterval = watchFlagSet.Duration("interval", time.Minute, "How long to wait between pulls.")
+	watchOnce     = watchFlagSet.Bool("once", false, "Pull and report the events once, and then exit (e.g. when run from cron).")
+	watchExec     = watchFlagSet.String("exec", "", "Shell command to run for each event, with the event's JSON on its stdin, rather than printing the events. Defaults to the value of "+watchCommandKey+".")
+)
+
+// Test seams; not safe for t.Parallel().
+var (
+	// watchWait waits for the given time before the next pull, and returns
+	// whether to keep watching.
+	watchWait = func(d time.Duration) bool {
+		time.Sleep(d)
+		return true
+	}
+	watchStatePath = func(repo repository.Repo) (string, error) {
+		dataDir, err := repo.GetDataDir()
+		if err != nil {
+			return "", err
+		}
+		name := watchStateFile
+		if namespaced, ok := repo.(interface{ Namespaces() []string }); ok {
+			if namespaces := namespaced.Namespaces(); !slices.Equal(namespaces, []string{repository.DefaultNamespace}) {
+				name += "-" + strings.Join(namespaces, ",")
+			}
+		}
+		return filepath.Join(dataDir, name+".json"), nil
+	}
+)
+
+// readWatchState reads the snapshot of the reviews that were last reported,
+// or returns nil if there is none.
+func readWatchState(path string) (*events.Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s events.Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failure reading %s: %v", path, err)
+	}
+	return &s, nil
+}
+
+// writeWatchState atomically replaces the snapshot of the reviews that were
+// last reported.
+func writeWatchState(path string, s *events.Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// eventSummary returns a one line summary of the note added by an event.
+func eventSummary(e events.Event) string {
+	var description string
+	switch {
+	case e.Request != nil && e.Request.Encrypted != "":
+		description = review.EncryptedDescription
+	case e.Request != nil:
+		description = e.Request.Description
+	case e.Comment != nil && e.Comment.Encrypted != "":
+		description = e.Comment.Author + ": " + review.EncryptedDescription
+	case e.Comment != nil:
+		description = e.Comment.Author + ": " + e.Comment.Description
+	case e.CI != nil:
+		description = strings.TrimSpace(e.CI.Status + " " + e.CI.URL)
+	case e.Analysis != nil:
+		description = e.Analysis.URL
+	}
+	description, _, _ = strings.Cut(description, "\n")
+	return strings.TrimSpace(e.Type + " " + e.Revision + " " + description)
+}
+
+// reportEvent prints an event, or runs the given shell command for it.
+//
+// The command gets the event's JSON on its stdin, and its type and revisions
+// in the APPRAISE_EVENT, APPRAISE_REVIEW and APPRAISE_REVISION environment
+// variables. A failing command only prints a warning, so that it does not
+// stop the other events from being reported.
+func reportEvent(command string, e events.Event) {
+	if command == "" {
+		fmt.Println(eventSummary(e))
+		return
+	}
+	// Events always encode successfully.
+	data, _ := json.Marshal(e)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"APPRAISE_EVENT="+e.Type,
+		"APPRAISE_REVIEW="+e.Review,
+		"APPRAISE_REVISION="+e.Revision)
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %q failed for the %s event %s: %v\n", command, e.Type, e.ID, err)
+	}
+}
+
+// pullRemotes pulls the reviews from each of the given remotes, carrying on
+// past any that fail.
+func pullRemotes(repo repository.Repo, remotes []string) error {
+	var errs []error
+	for _, remote := range remotes {
+		if err := repo.PullNotesAndArchive(remote, notesRefPattern, archiveRefPattern); err != nil {
+			errs = append(errs, fmt.Errorf("failure pulling from %q: %v", remote, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// watch repeatedly pulls the reviews from the given remotes, and reports the
+// events of any changes to them.
+//
+// The state of the reviews is kept between runs, so that restarting does not
+// report the same events again. Events are reported before that state is
+// saved, so a crash may repeat them, but never loses them.
+func watch(repo repository.Repo, args []string) error {
+	watchFlagSet.Parse(args)
+	remotes := watchFlagSet.Args()
+	if len(remotes) == 0 {
+		remotes = []string{"origin"}
+	}
+	if *watchInterval <= 0 {
+		return errors.New("The interval must be positive.")
+	}
+
+	command := *watchExec
+	if command == "" {
+		values, err := repo.GetConfigValues(watchCommandKey)
+		if err != nil {
+			return err
+		}
+		if len(values) > 0 {
+			command = values[len(values)-1]
+		}
+	}
+
+	statePath, err := watchStatePath(repo)
+	if err != nil {
+		return err
+	}
+	before, err := readWatchState(statePath)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		// The first run only reports the changes that it pulls.
+		if before, err = events.TakeSnapshot(repo); err != nil {
+			return err
+		}
+	}
+
+	delay := *watchInterval
+	for {
+		pullErr := pullRemotes(repo, remotes)
+		after, err := events.TakeSnapshot(repo)
+		if err != nil {
+			return err
+		}
+		for _, e := range events.Diff(before, after) {
+			reportEvent(command, e)
+		}
+		if err := writeWatchState(statePath, after); err != nil {
+			return err
+		}
+		before = after
+
+		if *watchOnce {
+			return pullErr
+		}
+		if pullErr != nil {
+			delay = min(2*delay, max(maxWatchBackoff, *watchInterval))
+			fmt.Fprintf(os.Stderr, "Warning: %v; retrying in %s\n", pullErr, delay)
+		} else {
+			delay = *watchInterval
+		}
+		if !watchWait(delay) {
+			return nil
+		}
+	}
+}
+
+// watchCmd defines the "watch" subcommand.
+var watchCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s watch [<option>...] [<remote>...]\n\nOptions:\n", arg0)
+		watchFlagSet.PrintDefaults()
+	},
+	RunMethod: func(repo repository.Repo, args []string) error {
+		return watch(repo, args)
+	},
+}
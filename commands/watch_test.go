@@ -0,0 +1,339 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// pullingRepo is a repo in which pulling from a remote runs a function.
+type pullingRepo struct {
+	repository.Repo
+	pull func(remote string) error
+}
+
+func (r pullingRepo) PullNotesAndArchive(remote, notesRefPattern, archiveRefPattern string) error {
+	return r.pull(remote)
+}
+
+// setupWatch keeps the state of the watch command in a temporary directory,
+// and returns the path of its state file.
+func setupWatch(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), watchStateFile+".json")
+	old := watchStatePath
+	t.Cleanup(func() { watchStatePath = old })
+	watchStatePath = func(repo repository.Repo) (string, error) {
+		return path, nil
+	}
+	return path
+}
+
+// pullComments returns a pull function that adds a comment on the review of
+// G with the next of the given descriptions each time that it is called.
+func pullComments(repo repository.Repo, descriptions ...string) func(string) error {
+	return func(remote string) error {
+		if len(descriptions) == 0 {
+			return nil
+		}
+		note := `{"timestamp": "0000000010", "author": "a", "description": "` + descriptions[0] + `"}`
+		descriptions = descriptions[1:]
+		return repo.AppendNote(comment.Ref, repository.TestCommitG, repository.Note(note))
+	}
+}
+
+func TestWatchOnce(t *testing.T) {
+	defer resetWatchFlags()
+	statePath := setupWatch(t)
+	mock := repository.NewMockRepoForTest()
+	var remotes []string
+	pull := pullComments(mock, "first", "second")
+	repo := pullingRepo{mock, func(remote string) error {
+		remotes = append(remotes, remote)
+		return pull(remote)
+	}}
+
+	out := captureStdout(t, func() {
+		if err := watch(repo, []string{"-once"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := "comment.added " + repository.TestCommitG + " a: first\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("state was not saved: %v", err)
+	}
+
+	// Restarting only reports the new events.
+	out = captureStdout(t, func() {
+		if err := watch(repo, []string{"-once", "origin", "upstream"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := "comment.added " + repository.TestCommitG + " a: second\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	out = captureStdout(t, func() {
+		if err := watch(repo, []string{"-once"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if out != "" {
+		t.Errorf("output without changes = %q", out)
+	}
+	if want := []string{"origin", "origin", "upstream", "origin"}; !slices.Equal(remotes, want) {
+		t.Errorf("pulled from %q, want %q", remotes, want)
+	}
+
+	// Failed pulls make cron jobs fail, after reporting the other changes.
+	repo.pull = func(remote string) error {
+		if remote == "bad" {
+			return errors.New("unreachable")
+		}
+		return pullComments(mock, "third")(remote)
+	}
+	out = captureStdout(t, func() {
+		err := watch(repo, []string{"-once", "bad", "origin"})
+		if err == nil || !strings.Contains(err.Error(), `failure pulling from "bad": unreachable`) {
+			t.Errorf("watch() = %v", err)
+		}
+	})
+	if !strings.Contains(out, "a: third") {
+		t.Errorf("output = %q", out)
+	}
+}
+
+func TestWatchBackoff(t *testing.T) {
+	defer resetWatchFlags()
+	setupWatch(t)
+	mock := repository.NewMockRepoForTest()
+	failures := 0
+	repo := pullingRepo{mock, func(remote string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("unreachable")
+		}
+		return nil
+	}}
+
+	var delays []time.Duration
+	old := watchWait
+	defer func() { watchWait = old }()
+	watchWait = func(d time.Duration) bool {
+		delays = append(delays, d)
+		switch len(delays) {
+		case 1:
+			failures = 3
+		case 6:
+			return false
+		}
+		return true
+	}
+
+	stderr := captureStderr(t, func() {
+		if err := watch(repo, []string{"-interval", "20m"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := []time.Duration{20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour, 20 * time.Minute, 20 * time.Minute}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+	if strings.Count(stderr, "unreachable; retrying in") != 3 {
+		t.Errorf("stderr = %q", stderr)
+	}
+
+	// Intervals longer than the maximum backoff are kept.
+	delays = nil
+	failures = 0
+	captureStderr(t, func() {
+		if err := watch(repo, []string{"-interval", "2h"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if delays[2] != 2*time.Hour {
+		t.Errorf("delays = %v", delays)
+	}
+}
+
+func TestWatchExec(t *testing.T) {
+	defer resetWatchFlags()
+	setupWatch(t)
+	mock := repository.NewMockRepoForTest()
+	repo := pullingRepo{mock, pullComments(mock, "first", "second")}
+	dir := t.TempDir()
+
+	mock.AddConfigValue(watchCommandKey, `cat > "`+dir+`/$APPRAISE_EVENT-$APPRAISE_REVIEW.json"`)
+	if err := watch(repo, []string{"-once"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, events.CommentAdded+"-"+repository.TestCommitG+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event events.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Comment == nil || event.Comment.Description != "first" {
+		t.Errorf("event = %+v", event)
+	}
+
+	// The flag overrides the configured command, and failures are only
+	// reported.
+	stderr := captureStderr(t, func() {
+		if err := watch(repo, []string{"-once", "-exec", "exit 3"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(stderr, `Warning: "exit 3" failed for the comment.added event`) {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	defer resetWatchFlags()
+	statePath := setupWatch(t)
+	repo := repository.NewMockRepoForTest()
+
+	if err := watch(repo, []string{"-interval", "0s"}); err == nil {
+		t.Error("expected an error for a non-positive interval")
+	}
+	resetWatchFlags()
+	if err := watch(errNotesRepo{repo}, []string{"-once"}); err == nil {
+		t.Error("expected an error when the reviews cannot be read")
+	}
+
+	// A saved state does not stop failing to read the reviews after pulling.
+	if err := watch(repo, []string{"-once"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := watch(errNotesRepo{repo}, []string{"-once"}); err == nil {
+		t.Error("expected an error when the reviews cannot be read")
+	}
+
+	if err := os.WriteFile(statePath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := watch(repo, []string{"-once"}); err == nil || !strings.Contains(err.Error(), statePath) {
+		t.Errorf("watch() with a corrupt state = %v", err)
+	}
+	if err := os.Remove(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(statePath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := watch(repo, []string{"-once"}); err == nil {
+		t.Error("expected an error when the state cannot be read")
+	}
+
+	watchStatePath = func(repo repository.Repo) (string, error) {
+		return filepath.Join(t.TempDir(), "missing", watchStateFile+".json"), nil
+	}
+	if err := watch(repo, []string{"-once"}); err == nil {
+		t.Error("expected an error when the state cannot be written")
+	}
+	watchStatePath = func(repo repository.Repo) (string, error) {
+		return "", errors.New("no data dir")
+	}
+	if err := watch(repo, []string{"-once"}); err == nil {
+		t.Error("expected an error without a data dir")
+	}
+}
+
+func TestWatchStatePath(t *testing.T) {
+	repo := newDataDirRepo(t)
+	path, err := watchStatePath(repo)
+	if err != nil || path != filepath.Join(repo.dataDir, "appraise-watch.json") {
+		t.Errorf("unexpected state path %q: %v", path, err)
+	}
+	namespaced, err := repository.NewNamespacedRepo(repo, "security", repository.DefaultNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err = watchStatePath(namespaced)
+	if err != nil || path != filepath.Join(repo.dataDir, "appraise-watch-security,devtools.json") {
+		t.Errorf("unexpected state path %q: %v", path, err)
+	}
+	repo.dataDirErr = errors.New("no data dir")
+	if _, err := watchStatePath(repo); err == nil {
+		t.Error("expected an error without a data dir")
+	}
+}
+
+func TestWriteWatchState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, watchStateFile+".json")
+	for range 2 {
+		if err := writeWatchState(path, &events.Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("expected only the state file to be left, got %v: %v", entries, err)
+	}
+	// A directory in place of the state file cannot be replaced.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWatchState(path, &events.Snapshot{}); err == nil {
+		t.Error("expected an error replacing a directory")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("expected the temporary file to be removed, got %v: %v", entries, err)
+	}
+}
+
+func TestEventSummary(t *testing.T) {
+	tests := []struct {
+		event events.Event
+		want  string
+	}{
+		{events.Event{Type: events.ReviewCreated, Revision: "abc", Request: &request.Request{Description: "Title\n\nBody"}}, "review.created abc Title"},
+		{events.Event{Type: events.ReviewUpdated, Revision: "abc", Request: &request.Request{Encrypted: "x"}}, "review.updated abc [encrypted]"},
+		{events.Event{Type: events.CommentAdded, Revision: "abc", Comment: &comment.Comment{Author: "a", Description: "nit"}}, "comment.added abc a: nit"},
+		{events.Event{Type: events.CommentAdded, Revision: "abc", Comment: &comment.Comment{Author: "a", Encrypted: "x"}}, "comment.added abc a: [encrypted]"},
+		{events.Event{Type: events.CIReported, Revision: "abc", CI: &ci.Report{Status: "success", URL: "https://ci"}}, "ci.reported abc success https://ci"},
+		{events.Event{Type: events.CIReported, Revision: "abc", CI: &ci.Report{URL: "https://ci"}}, "ci.reported abc https://ci"},
+		{events.Event{Type: events.AnalysisReported, Revision: "abc", Analysis: &analyses.Report{URL: "https://a"}}, "analysis.reported abc https://a"},
+		{events.Event{Type: events.ReviewAttested, Revision: "abc"}, "review.attested abc"},
+	}
+	for _, test := range tests {
+		if got := eventSummary(test.event); got != test.want {
+			t.Errorf("eventSummary(%+v) = %q, want %q", test.event, got, test.want)
+		}
+	}
+}
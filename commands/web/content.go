@@ -23,8 +23,9 @@ import (
 )
 
 const (
-	// SHA1 produces 160 bit hashes, so a hex-encoded hash should be no more than 40 characters.
-	maxHashLength = 40
+	// SHA-256 produces 256 bit hashes, so a hex-encoded hash should be no
+	// more than 64 characters (or 40 in repos that use SHA-1).
+	maxHashLength = 64
 )
 
 var (
@@ -277,6 +278,7 @@ func (repoDetails *RepoDetails) WriteReviewTemplate(reviewRev string, p Paths, w
 	if err != nil {
 		return err
 	}
+	reviewDetails.VerifySignatures()
 	commit := reviewDetails.Summary.Revision
 	commitDetails, err := repoDetails.Repo.GetCommitDetails(commit)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -12,6 +13,7 @@ import (
 
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/comment"
 	"msrl.dev/git-appraise/review/request"
 )
 
@@ -120,7 +122,7 @@ func TestStaticPaths(t *testing.T) {
 // --- checkStringLooksLikeHash tests ---
 
 func TestCheckStringLooksLikeHashValid(t *testing.T) {
-	for _, s := range []string{"abc123", "0123456789abcdef", ""} {
+	for _, s := range []string{"abc123", "0123456789abcdef", "", strings.Repeat("a", 40), strings.Repeat("a", 64)} {
 		if err := checkStringLooksLikeHash(s); err != nil {
 			t.Errorf("checkStringLooksLikeHash(%q) = %v, want nil", s, err)
 		}
@@ -532,6 +534,37 @@ func TestWriteReviewTemplate(t *testing.T) {
 	}
 }
 
+func TestWriteReviewTemplateSignedComment(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	c := comment.New("user@example.com", "signed comment")
+	c.Timestamp = "9999999999"
+	payload, err := c.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Signature, err = repo.SignPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	rd := NewRepoDetails(repo)
+	if err := rd.Update(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := rd.WriteReviewTemplate(repository.TestCommitG, ServePaths{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `class="signature-true"`) {
+		t.Errorf("expected a verified signature badge, got %q", buf.String())
+	}
+}
+
 func TestWriteReviewTemplateNonexistent(t *testing.T) {
 	rd := setupRepoDetailsWithReviews(t)
 	var buf bytes.Buffer
@@ -988,6 +1021,7 @@ func newAbandonedReviewRepo() (*abandonedReviewRepo, string) {
 	base := repository.NewMockRepoForTest()
 	abandonedCommit := "aabbccdd"
 	abandonedNotes := `{"timestamp": "0000000010", "reviewRef": "refs/heads/abandoned-change", "targetRef": "", "requester": "tester", "reviewers": ["reviewer"], "description": "Abandoned change"}`
+	base.AppendNote(repository.TestRequestsRef, abandonedCommit, repository.Note(abandonedNotes))
 	return &abandonedReviewRepo{
 		Repo:            base,
 		abandonedCommit: abandonedCommit,
@@ -1604,6 +1638,20 @@ func (r *hexMappedRepo) GetAllNotes(notesRef string) (map[string][]repository.No
 	return notes, nil
 }
 
+func (r *hexMappedRepo) Notes(notesRef, prefix string) (iter.Seq2[string, []repository.Note], func() error) {
+	notes, notesErr := r.Repo.Notes(notesRef, prefix)
+	return func(yield func(string, []repository.Note) bool) {
+		for revision, revisionNotes := range notes {
+			if !yield(revision, revisionNotes) {
+				return
+			}
+			if revision == r.realCommit && !yield(r.hexAlias, revisionNotes) {
+				return
+			}
+		}
+	}, notesErr
+}
+
 func (r *hexMappedRepo) ListNotedRevisions(notesRef string) []string {
 	revs := r.Repo.ListNotedRevisions(notesRef)
 	for i, rev := range revs {
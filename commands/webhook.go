@@ -0,0 +1,61 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/webhook"
+)
+
+// Test seam; not safe for t.Parallel().
+var newDispatcher = webhook.NewDispatcher
+
+// runWithWebhooks runs a command that may change the reviews in the given
+// repo, and then posts the events of its changes to any webhooks configured
+// in the repo.
+//
+// Since the changes have already been made by then, failing to post the
+// events only prints a warning. The events are kept to be retried by a later
+// command.
+func runWithWebhooks(repo repository.Repo, run func() error) error {
+	dispatcher, err := newDispatcher(repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read the webhook configuration: %v\n", err)
+		return run()
+	}
+	if dispatcher == nil {
+		return run()
+	}
+	snapshot, err := events.TakeSnapshot(repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read the reviews, so no webhooks will be sent: %v\n", err)
+		return run()
+	}
+	runErr := run()
+	changes, err := snapshot.Events(repo)
+	if err == nil {
+		err = dispatcher.Dispatch(changes)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to send webhooks: %v\n", err)
+	}
+	return runErr
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/webhook"
+)
+
+// errNotesRepo is a repo whose notes cannot all be read at once.
+type errNotesRepo struct {
+	repository.Repo
+}
+
+func (errNotesRepo) GetAllNotes(notesRef string) (map[string][]repository.Note, error) {
+	return nil, errors.New("cannot read notes")
+}
+
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	old := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.Stderr = old }()
+	os.Stderr = w
+	defer w.Close()
+	outCh := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		outCh <- string(out)
+	}()
+	f()
+	w.Close()
+	return <-outCh
+}
+
+// setupWebhook configures a webhook for the given repo that records the
+// types of the events posted to it, and responds to them with the given
+// status.
+func setupWebhook(t *testing.T, repo repository.Repo, status int) *[]string {
+	t.Helper()
+	var types []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		types = append(types, event.Type+" "+event.Review)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	repo.AddConfigValue(webhook.URLKey, server.URL)
+
+	queueDir := t.TempDir()
+	old := newDispatcher
+	t.Cleanup(func() { newDispatcher = old })
+	newDispatcher = func(repo repository.Repo) (*webhook.Dispatcher, error) {
+		d, err := old(repo)
+		if d != nil {
+			d.QueuePath = filepath.Join(queueDir, webhook.QueueFile)
+		}
+		return d, err
+	}
+	return &types
+}
+
+func TestWebhooks(t *testing.T) {
+	defer resetAcceptFlags()
+	repo := repository.NewMockRepoForTest()
+	types := setupWebhook(t, repo, http.StatusOK)
+
+	// Commands that do not change the reviews send nothing.
+	captureStdout(t, func() {
+		if err := listCmd.Run(repo, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	stderr := captureStderr(t, func() {
+		if err := acceptCmd.Run(repo, []string{"-m", "LGTM", repository.TestCommitG}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if stderr != "" {
+		t.Errorf("unexpected warnings: %q", stderr)
+	}
+	if len(*types) != 1 || (*types)[0] != "review.accepted "+repository.TestCommitG {
+		t.Errorf("events = %q", *types)
+	}
+}
+
+func TestWebhooksWarnings(t *testing.T) {
+	defer resetAcceptFlags()
+	repo := repository.NewMockRepoForTest()
+	types := setupWebhook(t, repo, http.StatusInternalServerError)
+
+	// Failed deliveries are reported, but do not fail the command.
+	stderr := captureStderr(t, func() {
+		if err := acceptCmd.Run(repo, []string{"-m", "LGTM", repository.TestCommitG}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(stderr, "Warning: failed to send webhooks") || len(*types) != 1 {
+		t.Errorf("stderr = %q, events = %q", stderr, *types)
+	}
+
+	// Failed commands still fail, and the failed delivery is not retried
+	// until it is due.
+	stderr = captureStderr(t, func() {
+		if err := acceptCmd.Run(repo, []string{"-m", "LGTM", "a", "b"}); err == nil {
+			t.Error("expected the command to fail")
+		}
+	})
+	if stderr != "" || len(*types) != 1 {
+		t.Errorf("stderr = %q, events = %q", stderr, *types)
+	}
+
+	// Commands still run when the events cannot be found.
+	stderr = captureStderr(t, func() {
+		if err := acceptCmd.Run(errNotesRepo{repo}, []string{"-m", "LGTM", repository.TestCommitG}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(stderr, "failed to read the reviews") {
+		t.Errorf("stderr = %q", stderr)
+	}
+
+	newDispatcher = func(repo repository.Repo) (*webhook.Dispatcher, error) {
+		return nil, errors.New("bad config")
+	}
+	stderr = captureStderr(t, func() {
+		if err := acceptCmd.Run(repo, []string{"-m", "LGTM", repository.TestCommitG}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(stderr, "failed to read the webhook configuration: bad config") {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package events describes the changes to the reviews in a repo as typed
+// events, for tools that integrate with git-appraise.
+//
+// The JSON encoding of events is stable: fields may be added to it, but
+// existing fields keep their meaning. Any incompatible change would come with
+// a new value of the "v" field, as for the notes themselves.
+package events
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/attestation"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// The types of events.
+const (
+	ReviewCreated    = "review.created"
+	ReviewUpdated    = "review.updated"
+	ReviewAbandoned  = "review.abandoned"
+	ReviewSubmitted  = "review.submitted"
+	ReviewAccepted   = "review.accepted"
+	ReviewRejected   = "review.rejected"
+	CommentAdded     = "comment.added"
+	CIReported       = "ci.reported"
+	AnalysisReported = "analysis.reported"
+	ReviewAttested   = "review.attested"
+)
+
+// Event describes a single change to the reviews in a repo.
+//
+// Other than for review.submitted events, each event corresponds to a note
+// that was added, which is included in the field for its type.
+type Event struct {
+	// ID uniquely identifies the event, so that receivers can ignore any
+	// event that is delivered more than once.
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Version is the version of the event format. It is currently 0, and
+	// so is omitted.
+	Version int `json:"v,omitempty"`
+	// Review is the revision that identifies the review that the event is
+	// about, if any.
+	Review string `json:"review,omitempty"`
+	// Revision is the revision annotated by the note that was added, or
+	// the review's revision for review.submitted events.
+	Revision string `json:"revision"`
+
+	Request     *request.Request      `json:"request,omitempty"`
+	Comment     *comment.Comment      `json:"comment,omitempty"`
+	CommentHash string                `json:"commentHash,omitempty"`
+	CI          *ci.Report            `json:"ci,omitempty"`
+	Analysis    *analyses.Report      `json:"analysis,omitempty"`
+	Attestation *attestation.Envelope `json:"attestation,omitempty"`
+
+	// Cursor is set on the events read from the history of the notes by
+	// Since, and is the cursor from which to resume reading them after this
+	// event.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// notesRefs are the notes refs whose changes are described by events.
+var notesRefs = []string{request.Ref, comment.Ref, ci.Ref, analyses.Ref, attestation.Ref}
+
+// eventID returns the ID of the event for the given note, which was added to
+// the given ref for the given revision, or for the given event type if the
+// event is not for a single note.
+//
+// The ID does not depend on the type of the event for a note, since that may
+// depend on the order of the notes.
+func eventID(ref, revision string, note repository.Note) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(ref+"\n"+revision+"\n"+string(note))))
+}
+
+// Snapshot records the state of the reviews in a repo, so that the events of
+// any later changes to them can be found.
+type Snapshot struct {
+	notes map[string]map[string][]repository.Note
+	// open holds the current requests of the reviews that are open.
+	open map[string]request.Request
+}
+
+// snapshotJSON is the JSON encoding of a Snapshot.
+type snapshotJSON struct {
+	Notes map[string]map[string][]string `json:"notes"`
+	Open  map[string]request.Request     `json:"open"`
+}
+
+// MarshalJSON encodes the snapshot, so that it can be kept between runs.
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	encoded := snapshotJSON{
+		Notes: make(map[string]map[string][]string),
+		Open:  s.open,
+	}
+	for ref, revisions := range s.notes {
+		encoded.Notes[ref] = make(map[string][]string)
+		for revision, notes := range revisions {
+			for _, note := range notes {
+				encoded.Notes[ref][revision] = append(encoded.Notes[ref][revision], string(note))
+			}
+		}
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes a snapshot encoded by MarshalJSON.
+func (s *Snapshot) UnmarshalJSON(data []byte) error {
+	var encoded snapshotJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	s.notes = make(map[string]map[string][]repository.Note)
+	for ref, revisions := range encoded.Notes {
+		s.notes[ref] = make(map[string][]repository.Note)
+		for revision, notes := range revisions {
+			for _, note := range notes {
+				s.notes[ref][revision] = append(s.notes[ref][revision], repository.Note(note))
+			}
+		}
+	}
+	s.open = encoded.Open
+	return nil
+}
+
+// TakeSnapshot records the current state of the reviews in the given repo.
+func TakeSnapshot(repo repository.Repo) (*Snapshot, error) {
+	s := &Snapshot{notes: make(map[string]map[string][]repository.Note)}
+	for _, ref := range notesRefs {
+		notes, err := repo.GetAllNotes(ref)
+		if err != nil {
+			return nil, err
+		}
+		s.notes[ref] = notes
+	}
+	s.open = openReviews(repo, s.notes[request.Ref])
+	return s, nil
+}
+
+// currentRequest returns the current request of a review, given its notes.
+func currentRequest(notes []repository.Note) (request.Request, bool) {
+	requests := request.ParseAllValid(notes)
+	if len(requests) == 0 {
+		return request.Request{}, false
+	}
+	slices.SortStableFunc(requests, func(a, b request.Request) int {
+		return strings.Compare(a.Timestamp, b.Timestamp)
+	})
+	return requests[len(requests)-1], true
+}
+
+// openReviews returns the current requests of the reviews that are neither
+// abandoned nor submitted, given the notes of every review request.
+func openReviews(repo repository.Repo, requestNotes map[string][]repository.Note) map[string]request.Request {
+	targetCommits := make(map[string]map[string]bool)
+	open := make(map[string]request.Request)
+	for revision, notes := range requestNotes {
+		r, ok := currentRequest(notes)
+		if !ok || r.TargetRef == "" {
+			continue
+		}
+		if _, ok := targetCommits[r.TargetRef]; !ok {
+			targetCommits[r.TargetRef] = make(map[string]bool)
+			for _, commit := range repo.ListCommits(r.TargetRef) {
+				targetCommits[r.TargetRef][commit] = true
+			}
+		}
+		start := revision
+		if r.Alias != "" {
+			start = r.Alias
+		}
+		if !targetCommits[r.TargetRef][start] {
+			open[revision] = r
+		}
+	}
+	return open
+}
+
+// addedNotes returns the notes in after that are not in before.
+func addedNotes(before, after []repository.Note) []repository.Note {
+	var added []repository.Note
+	for _, note := range after {
+		if len(note) > 0 && !slices.ContainsFunc(before, func(n repository.Note) bool { return string(n) == string(note) }) {
+			added = append(added, note)
+		}
+	}
+	return added
+}
+
+// notesEvents returns the events of the notes that were added to those that
+// annotate the given revision under the given ref.
+func notesEvents(ref, revision string, before, after []repository.Note) []Event {
+	var events []Event
+	hadRequest := len(request.ParseAllValid(before)) > 0
+	for _, note := range addedNotes(before, after) {
+		event, ok := noteEvent(ref, revision, note, hadRequest)
+		if !ok {
+			continue
+		}
+		if event.Type == ReviewCreated {
+			hadRequest = true
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Events returns the events of the changes to the reviews in the given repo
+// since the snapshot was taken.
+func (s *Snapshot) Events(repo repository.Repo) ([]Event, error) {
+	after, err := TakeSnapshot(repo)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(s, after), nil
+}
+
+// Diff returns the events of the changes to the reviews between two
+// snapshots.
+func Diff(s, after *Snapshot) []Event {
+	var events []Event
+	for _, ref := range notesRefs {
+		revisions := make([]string, 0, len(after.notes[ref]))
+		for revision := range after.notes[ref] {
+			revisions = append(revisions, revision)
+		}
+		slices.Sort(revisions)
+		for _, revision := range revisions {
+			events = append(events, notesEvents(ref, revision, s.notes[ref][revision], after.notes[ref][revision])...)
+		}
+	}
+	var closed []string
+	for revision := range s.open {
+		if _, ok := after.open[revision]; !ok {
+			closed = append(closed, revision)
+		}
+	}
+	slices.Sort(closed)
+	for _, revision := range closed {
+		// Reviews that are no longer open have been either abandoned or
+		// submitted, and abandoned reviews already have events.
+		r, ok := currentRequest(after.notes[request.Ref][revision])
+		if !ok || r.TargetRef == "" {
+			continue
+		}
+		events = append(events, Event{
+			ID:       eventID(ReviewSubmitted, revision, nil),
+			Type:     ReviewSubmitted,
+			Review:   revision,
+			Revision: revision,
+			Request:  &r,
+		})
+	}
+	return events
+}
+
+// noteEvent returns the event for a note that was added to the given ref, if
+// the note is valid.
+func noteEvent(ref, revision string, note repository.Note, hadRequest bool) (Event, bool) {
+	notes := []repository.Note{note}
+	event := Event{Revision: revision}
+	switch ref {
+	case request.Ref:
+		requests := request.ParseAllValid(notes)
+		if len(requests) == 0 {
+			return event, false
+		}
+		event.Review = revision
+		event.Request = &requests[0]
+		switch {
+		case requests[0].TargetRef == "":
+			event.Type = ReviewAbandoned
+		case hadRequest:
+			event.Type = ReviewUpdated
+		default:
+			event.Type = ReviewCreated
+		}
+	case comment.Ref:
+		for hash, c := range comment.ParseAllValid(notes) {
+			event.Review = revision
+			event.Comment = &c
+			event.CommentHash = hash
+			switch {
+			case c.Resolved != nil && c.Parent == "" && *c.Resolved:
+				event.Type = ReviewAccepted
+			case c.Resolved != nil && c.Parent == "":
+				event.Type = ReviewRejected
+			default:
+				event.Type = CommentAdded
+			}
+		}
+		if event.Comment == nil {
+			return event, false
+		}
+	case ci.Ref:
+		reports := ci.ParseAllValid(notes)
+		if len(reports) == 0 {
+			return event, false
+		}
+		event.Type = CIReported
+		event.CI = &reports[0]
+	case analyses.Ref:
+		reports := analyses.ParseAllValid(notes)
+		if len(reports) == 0 {
+			return event, false
+		}
+		event.Type = AnalysisReported
+		event.Analysis = &reports[0]
+	default:
+		envelopes := attestation.ParseAllValid(notes)
+		if len(envelopes) == 0 {
+			return event, false
+		}
+		event.Type = ReviewAttested
+		event.Attestation = &envelopes[0]
+	}
+	event.ID = eventID(ref, revision, note)
+	return event, true
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/analyses"
+	"msrl.dev/git-appraise/review/attestation"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// errNotesRepo is a repo whose notes cannot be read.
+type errNotesRepo struct {
+	repository.Repo
+}
+
+func (errNotesRepo) GetAllNotes(notesRef string) (map[string][]repository.Note, error) {
+	return nil, errors.New("cannot read notes")
+}
+
+func appendNotes(t *testing.T, repo repository.Repo, ref, revision string, notes ...string) {
+	t.Helper()
+	for _, note := range notes {
+		if err := repo.AppendNote(ref, revision, repository.Note(note)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	s, err := TakeSnapshot(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.open) != 1 || s.open[repository.TestCommitG].Description != "Final description of G" {
+		t.Errorf("open reviews = %v, want only the review of G", s.open)
+	}
+	if _, err := TakeSnapshot(errNotesRepo{repo}); err == nil {
+		t.Error("expected an error when the notes cannot be read")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	s, err := TakeSnapshot(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events, err := s.Events(repo); err != nil || len(events) != 0 {
+		t.Fatalf("Events() without changes = %v, %v", events, err)
+	}
+
+	appendNotes(t, repo, request.Ref, repository.TestCommitH,
+		`{"timestamp": "0000000005", "targetRef": "refs/heads/master", "description": "H"}`,
+		`{"timestamp": "0000000006", "targetRef": "refs/heads/master", "description": "H again"}`,
+		`not a request`)
+	appendNotes(t, repo, request.Ref, repository.TestCommitD,
+		`{"timestamp": "0000000007", "description": "abandoned"}`)
+	appendNotes(t, repo, comment.Ref, repository.TestCommitG,
+		`{"timestamp": "0000000005", "author": "a", "description": "nit"}`,
+		`{"timestamp": "0000000006", "author": "a", "resolved": true}`,
+		`{"timestamp": "0000000007", "author": "b", "resolved": false}`,
+		`{"timestamp": "0000000008", "author": "b", "parent": "x", "resolved": true}`,
+		`not a comment`)
+	appendNotes(t, repo, ci.Ref, repository.TestCommitJ, `{"status": "success"}`, `{"v": 1}`)
+	appendNotes(t, repo, analyses.Ref, repository.TestCommitJ, `{"url": "https://example.com"}`, `{"v": 1}`)
+	appendNotes(t, repo, attestation.Ref, repository.TestCommitJ,
+		`{"payloadType": "`+attestation.PayloadType+`", "payload": "", "signatures": []}`,
+		`{"payloadType": "other"}`)
+	// Submit the review of G.
+	if err := repo.SetRef("refs/heads/master", repository.TestCommitI, repository.TestCommitJ); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := s.Events(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	ids := make(map[string]bool)
+	for _, e := range events {
+		got = append(got, e.Type+" "+e.Review+" "+e.Revision)
+		if ids[e.ID] {
+			t.Errorf("duplicate event ID %s", e.ID)
+		}
+		ids[e.ID] = true
+	}
+	want := []string{
+		"review.abandoned D D",
+		"review.created H H",
+		"review.updated H H",
+		"comment.added G G",
+		"review.accepted G G",
+		"review.rejected G G",
+		"comment.added G G",
+		"ci.reported  J",
+		"analysis.reported  J",
+		"review.attested  J",
+		"review.submitted G G",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events =\n%q\nwant\n%q", got, want)
+	}
+	if events[3].Comment.Description != "nit" || events[3].CommentHash == "" {
+		t.Errorf("comment event = %+v", events[3])
+	}
+	if events[10].Request.Description != "Final description of G" {
+		t.Errorf("submitted event request = %+v", events[10].Request)
+	}
+
+	if _, err := s.Events(errNotesRepo{repo}); err == nil {
+		t.Error("expected an error when the notes cannot be read")
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	s, err := TakeSnapshot(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored Snapshot
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&restored, s) {
+		t.Errorf("restored snapshot = %+v, want %+v", restored, s)
+	}
+
+	appendNotes(t, repo, comment.Ref, repository.TestCommitG,
+		`{"timestamp": "0000000005", "author": "a", "description": "nit"}`)
+	after, err := TakeSnapshot(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := Diff(&restored, after); len(events) != 1 || events[0].Type != CommentAdded {
+		t.Errorf("Diff() from a restored snapshot = %+v", events)
+	}
+
+	if err := json.Unmarshal([]byte(`{"notes": []}`), &restored); err == nil {
+		t.Error("expected an error when the snapshot is malformed")
+	}
+}
+
+func TestEventID(t *testing.T) {
+	id := eventID(comment.Ref, repository.TestCommitG, repository.Note("note"))
+	if id != eventID(comment.Ref, repository.TestCommitG, repository.Note("note")) {
+		t.Error("event IDs are not deterministic")
+	}
+	if id == eventID(request.Ref, repository.TestCommitG, repository.Note("note")) {
+		t.Error("event IDs do not depend on the ref")
+	}
+	if id == eventID(comment.Ref, repository.TestCommitF, repository.Note("note")) {
+		t.Error("event IDs do not depend on the revision")
+	}
+}
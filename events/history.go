@@ -0,0 +1,114 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"msrl.dev/git-appraise/repository"
+)
+
+// cursorPattern matches the commit hashes of a cursor.
+var cursorPattern = regexp.MustCompile(`^[0-9a-f]*$`)
+
+// parseCursor returns the commits of the notes refs that a cursor holds.
+//
+// A cursor is the hashes of the commits of each of the notes refs, in the
+// order of notesRefs, joined by commas. The hash of a ref that did not exist
+// is empty, and so the empty cursor is the start of the notes history.
+func parseCursor(cursor string) ([]string, error) {
+	if cursor == "" {
+		return make([]string, len(notesRefs)), nil
+	}
+	commits := strings.Split(cursor, ",")
+	if len(commits) != len(notesRefs) || !slices.ContainsFunc(commits, func(commit string) bool { return commit != "" }) {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	for _, commit := range commits {
+		if !cursorPattern.MatchString(commit) {
+			return nil, fmt.Errorf("invalid cursor %q", cursor)
+		}
+	}
+	return commits, nil
+}
+
+// formatCursor returns the cursor for the given commits of the notes refs.
+func formatCursor(commits []string) string {
+	if !slices.ContainsFunc(commits, func(commit string) bool { return commit != "" }) {
+		return ""
+	}
+	return strings.Join(commits, ",")
+}
+
+// Since returns the events of the notes that were added to the reviews in
+// the given repo since the given cursor, and the cursor of the current notes.
+// The empty cursor reads the events of every note.
+//
+// Each event's cursor resumes the stream without missing any later events,
+// although it may repeat some of them, with the same IDs. The events are
+// ordered by the ref and then by the revision of their notes, rather than by
+// time. Only the notes in the namespace in which reviews are written are
+// read, and there are no review.submitted events, since submitting a review
+// does not add any notes.
+func Since(repo repository.Repo, cursor string) ([]Event, string, error) {
+	from, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	to := make([]string, len(notesRefs))
+	for i, ref := range notesRefs {
+		if to[i], err = repo.GetNotesCommit(ref); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var events []Event
+	position := slices.Clone(from)
+	for i, ref := range notesRefs {
+		if to[i] == from[i] || to[i] == "" {
+			continue
+		}
+		diffs, err := repo.DiffNotes(from[i], to[i])
+		if err != nil {
+			return nil, "", fmt.Errorf("failure reading the notes since %q: %v", cursor, err)
+		}
+		var refEvents []Event
+		for _, diff := range diffs {
+			refEvents = append(refEvents, notesEvents(ref, diff.Revision, diff.Old, diff.New)...)
+		}
+		// Resuming from any but the last of a ref's events reads all of
+		// them again, since the commit of the ref only moves past them all
+		// at once.
+		before := formatCursor(position)
+		position[i] = to[i]
+		for j := range refEvents {
+			refEvents[j].Cursor = before
+		}
+		if len(refEvents) > 0 {
+			refEvents[len(refEvents)-1].Cursor = formatCursor(position)
+		}
+		events = append(events, refEvents...)
+	}
+	// The refs after those of the last event have no events to repeat.
+	if len(events) > 0 {
+		events[len(events)-1].Cursor = formatCursor(to)
+	}
+	return events, formatCursor(to), nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// historyErrRepo is a repo whose notes history cannot be read.
+type historyErrRepo struct {
+	repository.Repo
+	commitErr, diffErr error
+}
+
+func (r historyErrRepo) GetNotesCommit(notesRef string) (string, error) {
+	if r.commitErr != nil {
+		return "", r.commitErr
+	}
+	return r.Repo.GetNotesCommit(notesRef)
+}
+
+func (r historyErrRepo) DiffNotes(from, to string) ([]repository.NotesDiff, error) {
+	return nil, r.diffErr
+}
+
+func eventTypes(events []Event) []string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type+" "+e.Revision)
+	}
+	return types
+}
+
+func TestSince(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	all, cursor, err := Since(repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created []string
+	for _, e := range all {
+		if e.Type == ReviewCreated {
+			created = append(created, e.Revision)
+		}
+	}
+	if want := repo.ListNotedRevisions(request.Ref); len(created) != len(want) {
+		t.Errorf("created reviews = %v, want %v", created, want)
+	}
+	if cursor == "" || all[len(all)-1].Cursor != cursor {
+		t.Errorf("cursor = %q, last event cursor = %q", cursor, all[len(all)-1].Cursor)
+	}
+	if events, again, err := Since(repo, cursor); err != nil || len(events) != 0 || again != cursor {
+		t.Errorf("Since(%q) without changes = %v, %q, %v", cursor, events, again, err)
+	}
+
+	appendNotes(t, repo, comment.Ref, repository.TestCommitG,
+		`{"timestamp": "0000000005", "author": "a", "description": "nit"}`,
+		`{"timestamp": "0000000006", "author": "a", "resolved": true}`)
+	appendNotes(t, repo, ci.Ref, repository.TestCommitJ, `{"status": "success"}`, `not a report`)
+	events, next, err := Since(repo, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"comment.added " + repository.TestCommitG,
+		"review.accepted " + repository.TestCommitG,
+		"ci.reported " + repository.TestCommitJ,
+	}
+	if got := eventTypes(events); !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if next == cursor || events[2].Cursor != next {
+		t.Errorf("cursor = %q, last event cursor = %q", next, events[2].Cursor)
+	}
+
+	// Resuming within a ref's events repeats them, but resuming after them
+	// does not.
+	if events[0].Cursor != cursor {
+		t.Errorf("first event cursor = %q, want %q", events[0].Cursor, cursor)
+	}
+	resumed, _, err := Since(repo, events[1].Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventTypes(resumed); !slices.Equal(got, want[2:]) {
+		t.Errorf("resumed events = %q, want %q", got, want[2:])
+	}
+	for i, e := range resumed {
+		if e.ID != events[2+i].ID {
+			t.Errorf("resumed event %d has ID %q, want %q", i, e.ID, events[2+i].ID)
+		}
+	}
+}
+
+func TestSinceErrors(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	for _, cursor := range []string{"abc", "a,b,c,d,e,f", ",,,,", "a,b,c,d,xyz"} {
+		if _, _, err := Since(repo, cursor); err == nil {
+			t.Errorf("expected an error for the cursor %q", cursor)
+		}
+	}
+	if _, _, err := Since(historyErrRepo{Repo: repo, commitErr: errors.New("no ref")}, ""); err == nil {
+		t.Error("expected an error when the notes refs cannot be read")
+	}
+	if _, _, err := Since(historyErrRepo{Repo: repo, diffErr: errors.New("no commit")}, ""); err == nil {
+		t.Error("expected an error when the notes cannot be compared")
+	}
+}
@@ -18,6 +18,7 @@ import (
 )
 
 var port = flag.Uint("port", 0, "Web server port.")
+var pushUsers = flag.String("push-users", "", "File of \"<email>:<bcrypt hash>\" lines (as written by \"htpasswd -B\") for the users who may push review refs. Pushes are refused without it.")
 
 //go:embed repos.html
 var repos_html string
@@ -56,7 +57,15 @@ func (oldRepos *Repos) Discover() error {
 			if err != nil {
 				return nil
 			}
-			repoDetails := web.NewRepoDetails(gitRepo)
+			store, err := repository.OpenReviewStore(gitRepo)
+			if err != nil {
+				return nil
+			}
+			repo, err := repository.OpenNamespace(store, os.Getenv(repository.NamespaceEnv))
+			if err != nil {
+				return nil
+			}
+			repoDetails := web.NewRepoDetails(repo)
 			if err := repoDetails.Update(); err != nil {
 				return nil
 			}
@@ -142,6 +151,14 @@ func webServe() {
 
 	repos.Discover()
 
+	if *pushUsers != "" {
+		var err error
+		if pushers, err = readPushers(*pushUsers); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
 	http.HandleFunc("/_ah/health",
 		func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "ok")
@@ -170,6 +187,9 @@ func webServe() {
 	http.HandleFunc("/{repo}/"+repo, repos.ServeRepoTemplate)
 	http.HandleFunc("/{repo}/"+branch, repos.ServeBranchTemplate)
 	http.HandleFunc("/{repo}/"+review, repos.ServeReviewTemplate)
+	http.HandleFunc("GET /{repo}/git/info/refs", repos.ServeGitInfoRefs)
+	http.HandleFunc("POST /{repo}/git/git-upload-pack", repos.ServeGitUploadPack)
+	http.HandleFunc("POST /{repo}/git/git-receive-pack", repos.ServeGitReceivePack)
 	http.HandleFunc("/", repos.ServeEntryPointRedirect)
 
 	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), nil); err != nil {
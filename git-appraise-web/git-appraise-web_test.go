@@ -126,6 +126,49 @@ func TestReposDiscoverNonGitDir(t *testing.T) {
 	}
 }
 
+func TestReposDiscoverReviewStoreError(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	cmd := exec.Command("git", "-C", dir, "config", "appraise.reviewStore", t.TempDir())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	old, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(old)
+
+	var repos Repos
+	m := make(reposMap)
+	repos.Store(&m)
+	if err := repos.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := repos.Load(); len(loaded) != 0 {
+		t.Errorf("expected the misconfigured repo to be skipped, got %d repos", len(loaded))
+	}
+}
+
+func TestReposDiscoverNamespaceError(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	t.Setenv(repository.NamespaceEnv, "team/a")
+	old, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(old)
+
+	var repos Repos
+	m := make(reposMap)
+	repos.Store(&m)
+	if err := repos.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := repos.Load(); len(loaded) != 0 {
+		t.Errorf("expected the misconfigured repo to be skipped, got %d repos", len(loaded))
+	}
+}
+
 func TestReposDiscoverEmptyGitRepo(t *testing.T) {
 	// An empty git repo (no commits) is still a valid git repo.
 	// GetRepoStateHash succeeds (empty ref list → valid hash)
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"msrl.dev/git-appraise/commands"
+	"msrl.dev/git-appraise/repository"
+)
+
+// The refs of each repo that are advertised over the git smart HTTP protocol
+// are limited to the review refs. That does not keep the code private: the
+// archive refs have the reviewed commits as parents, so fetching them fetches
+// the code too, and git may serve any object that is requested by its hash.
+var uploadPackHideRefs = []string{
+	"HEAD",
+	"refs",
+	"!refs/notes",
+	"refs/notes/remotes",
+	"!refs/devtools",
+}
+
+// incomingRefPrefix is the prefix of the refs under which pushed review refs
+// are received, before being merged into the repo's own review refs.
+const incomingRefPrefix = "refs/appraise/incoming/"
+
+// sideBandMax is the maximum amount of data in a single side-band-64k packet.
+const sideBandMax = 65515
+
+// pushers maps the email address of each user that may push review refs to
+// the bcrypt hash of their password. Pushes are refused while it is nil.
+var pushers map[string][]byte
+
+// mergeLocks serializes the merging of pushed review refs into each repo.
+var mergeLocks sync.Map
+
+// gitPath returns the path of the git repo that stores the reviews of the
+// given repo.
+func gitPath(repo repository.Repo) string {
+	for {
+		switch r := repo.(type) {
+		case *repository.NamespacedRepo:
+			repo = r.Repo
+		case *repository.SidecarRepo:
+			return r.Store().GetPath()
+		default:
+			return repo.GetPath()
+		}
+	}
+}
+
+// lookupGitPath returns the path of the git repo that stores the reviews of
+// the repo named in the request, or writes an error response if there is no
+// such repo.
+func (repos *Repos) lookupGitPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	repo := r.PathValue("repo")
+	repoDetails, found := repos.Load()[repo]
+	if !found {
+		http.Error(w, "Repository "+repo+" not found!", http.StatusNotFound)
+		return "", false
+	}
+	return gitPath(repoDetails.Repo), true
+}
+
+// readPushers reads the users that may push review refs from the given file
+// of "<email>:<bcrypt hash>" lines, as written by "htpasswd -B".
+func readPushers(path string) (map[string][]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte)
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"<email>:<bcrypt hash>\"", path, i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, nil
+}
+
+// authenticatePusher returns the email address of the user that sent the
+// request, or writes an error response if pushes are disabled or the request
+// does not carry the credentials of a user that may push.
+func authenticatePusher(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if pushers == nil {
+		http.Error(w, "Pushes are disabled", http.StatusForbidden)
+		return "", false
+	}
+	user, password, ok := r.BasicAuth()
+	hash, found := pushers[user]
+	if !ok || !found || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="git-appraise"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return "", false
+	}
+	return user, true
+}
+
+// gitService returns the command for the given git service, configured to
+// serve the review refs of the repo at the given path.
+func gitService(path, service string, args ...string) *exec.Cmd {
+	var gitArgs []string
+	if service == "upload-pack" {
+		for _, hidden := range uploadPackHideRefs {
+			gitArgs = append(gitArgs, "-c", "uploadpack.hideRefs="+hidden)
+		}
+	}
+	gitArgs = append(gitArgs, service, "--stateless-rpc")
+	gitArgs = append(gitArgs, args...)
+	return exec.Command("git", append(gitArgs, path)...)
+}
+
+// pktLine encodes the given data as a single pkt-line.
+func pktLine(data string) []byte {
+	return fmt.Appendf(nil, "%04x%s", len(data)+4, data)
+}
+
+// readPktLine reads a single pkt-line, and returns its data. It returns nil
+// data for a flush packet.
+func readPktLine(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if length < 4 {
+		return nil, fmt.Errorf("unexpected special pkt-line %q", header)
+	}
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ServeGitInfoRefs serves the initial ref advertisement of the git smart HTTP
+// protocol. Only the review refs are advertised.
+//
+// For pushes, the review refs are advertised as ".have" lines rather than as
+// refs. Clients then still send only the objects that are missing, but treat
+// every pushed review ref as a new ref instead of rejecting it when it is not
+// a fast-forward. That allows the pushed refs to be merged instead.
+func (repos *Repos) ServeGitInfoRefs(w http.ResponseWriter, r *http.Request) {
+	path, ok := repos.lookupGitPath(w, r)
+	if !ok {
+		return
+	}
+	service, ok := strings.CutPrefix(r.URL.Query().Get("service"), "git-")
+	if service != "upload-pack" && service != "receive-pack" || !ok {
+		http.Error(w, "Only the smart HTTP protocol is supported", http.StatusForbidden)
+		return
+	}
+	if service == "receive-pack" {
+		if _, ok := authenticatePusher(w, r); !ok {
+			return
+		}
+	}
+	cmd := gitService(path, service, "--advertise-refs")
+	v2 := false
+	if service == "upload-pack" {
+		if protocol := r.Header.Get("Git-Protocol"); protocol != "" {
+			cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+protocol)
+			v2 = slices.Contains(strings.Split(protocol, ":"), "version=2")
+		}
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list the refs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if service == "receive-pack" {
+		if out, err = haveReviewRefs(out); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list the refs: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-git-"+service+"-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !v2 {
+		w.Write(pktLine("# service=git-" + service + "\n"))
+		w.Write([]byte("0000"))
+	}
+	w.Write(out)
+}
+
+// haveReviewRefs rewrites a receive-pack ref advertisement so that it only
+// lists the review refs, and lists them as ".have" lines.
+func haveReviewRefs(advertisement []byte) ([]byte, error) {
+	r := bytes.NewReader(advertisement)
+	var caps string
+	var haves []string
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			break
+		}
+		ref, lineCaps, found := strings.Cut(strings.TrimSuffix(string(line), "\n"), "\x00")
+		if found {
+			caps = lineCaps
+		}
+		hash, name, _ := strings.Cut(ref, " ")
+		if repository.IsReviewRef(name) {
+			haves = append(haves, hash)
+		}
+	}
+	var out bytes.Buffer
+	if len(haves) == 0 {
+		// The object names of SHA-256 repos, including the all-zeros one,
+		// are 64 hex digits long rather than 40.
+		zeroID := strings.Repeat("0", 40)
+		if slices.Contains(strings.Fields(caps), "object-format=sha256") {
+			zeroID = strings.Repeat("0", 64)
+		}
+		out.Write(pktLine(zeroID + " capabilities^{}\x00" + caps + "\n"))
+	}
+	for i, hash := range haves {
+		line := hash + " .have"
+		if i == 0 {
+			line += "\x00" + caps
+		}
+		out.Write(pktLine(line + "\n"))
+	}
+	out.WriteString("0000")
+	return out.Bytes(), nil
+}
+
+// requestBody returns the body of a git smart HTTP request, decompressing it
+// if necessary.
+func requestBody(r *http.Request) (io.Reader, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
+// ServeGitUploadPack serves fetches of the review refs.
+func (repos *Repos) ServeGitUploadPack(w http.ResponseWriter, r *http.Request) {
+	path, ok := repos.lookupGitPath(w, r)
+	if !ok {
+		return
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cmd := gitService(path, "upload-pack")
+	if protocol := r.Header.Get("Git-Protocol"); protocol != "" {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+protocol)
+	}
+	cmd.Stdin = body
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// The response has already been started, so the error can only be
+		// logged.
+		log.Printf("upload-pack of %s failed: %v: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+}
+
+// pushCommand is a single ref update that was requested by a push.
+type pushCommand struct {
+	oldHash, newHash, ref string
+	// incomingRef is the ref under which the new value is received, or
+	// the empty string if the update is refused.
+	incomingRef string
+	// status is the reason that the update failed, or "ok".
+	status string
+}
+
+// readPushCommands reads the ref updates and capabilities requested by a push.
+func readPushCommands(body io.Reader) ([]*pushCommand, []string, error) {
+	var commands []*pushCommand
+	var caps []string
+	for {
+		line, err := readPktLine(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == nil {
+			return commands, caps, nil
+		}
+		command, lineCaps, found := strings.Cut(strings.TrimSuffix(string(line), "\n"), "\x00")
+		if found {
+			caps = strings.Fields(lineCaps)
+		}
+		fields := strings.Fields(command)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("unsupported push command %q", command)
+		}
+		commands = append(commands, &pushCommand{oldHash: fields[0], newHash: fields[1], ref: fields[2]})
+	}
+}
+
+// ServeGitReceivePack serves pushes of the review refs.
+//
+// Each pushed review ref is received under a temporary incoming ref, which is
+// then merged into the repo's own review ref in the same way that pulling
+// merges a remote's review refs. Pushes to any other refs are refused, as are
+// pushed notes that "git appraise validate-push" would reject for the
+// authenticated pusher.
+func (repos *Repos) ServeGitReceivePack(w http.ResponseWriter, r *http.Request) {
+	pusher, ok := authenticatePusher(w, r)
+	if !ok {
+		return
+	}
+	path, ok := repos.lookupGitPath(w, r)
+	if !ok {
+		return
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bufferedBody := bufio.NewReader(body)
+	commands, caps, err := readPushCommands(bufferedBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	incomingPrefix := incomingRefPrefix + hex.EncodeToString(id) + "/"
+
+	var received bytes.Buffer
+	sideBand := false
+	var receiveCaps []string
+	for _, c := range caps {
+		if c == "side-band" || c == "side-band-64k" {
+			sideBand = true
+		} else {
+			receiveCaps = append(receiveCaps, c)
+		}
+	}
+	for _, c := range commands {
+		switch {
+		case !repository.IsReviewRef(c.ref):
+			c.status = "only review refs can be pushed"
+		case strings.Trim(c.newHash, "0") == "":
+			c.status = "review refs cannot be deleted"
+		default:
+			c.incomingRef = incomingPrefix + strings.TrimPrefix(c.ref, "refs/")
+			line := strings.Repeat("0", len(c.oldHash)) + " " + c.newHash + " " + c.incomingRef
+			if received.Len() == 0 {
+				line += "\x00" + strings.Join(receiveCaps, " ")
+			}
+			received.Write(pktLine(line + "\n"))
+		}
+	}
+
+	unpackStatus := "ok"
+	if received.Len() == 0 {
+		io.Copy(io.Discard, bufferedBody)
+	} else {
+		received.WriteString("0000")
+		cmd := gitService(path, "receive-pack")
+		cmd.Stdin = io.MultiReader(&received, bufferedBody)
+		out, err := cmd.Output()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to receive the push: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if unpackStatus, err = readReceiveStatus(out, commands); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to receive the push: %v", err), http.StatusInternalServerError)
+			return
+		}
+		mergeIncomingRefs(path, commands, pusher)
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !slices.Contains(caps, "report-status") && !slices.Contains(caps, "report-status-v2") {
+		return
+	}
+	var report bytes.Buffer
+	report.Write(pktLine("unpack " + unpackStatus + "\n"))
+	for _, c := range commands {
+		if c.status == "ok" {
+			report.Write(pktLine("ok " + c.ref + "\n"))
+		} else {
+			report.Write(pktLine("ng " + c.ref + " " + c.status + "\n"))
+		}
+	}
+	report.WriteString("0000")
+	if !sideBand {
+		w.Write(report.Bytes())
+		return
+	}
+	for data := range slices.Chunk(report.Bytes(), sideBandMax) {
+		w.Write(pktLine("\x01" + string(data)))
+	}
+	w.Write([]byte("0000"))
+}
+
+// readReceiveStatus reads the status report of receive-pack, records the
+// status of each of the incoming refs in the corresponding command, and
+// returns the status of unpacking the pushed objects.
+func readReceiveStatus(report []byte, commands []*pushCommand) (string, error) {
+	r := bytes.NewReader(report)
+	line, err := readPktLine(r)
+	if err != nil {
+		return "", err
+	}
+	unpackStatus, ok := strings.CutPrefix(strings.TrimSuffix(string(line), "\n"), "unpack ")
+	if !ok {
+		return "", fmt.Errorf("unexpected status %q", line)
+	}
+	statuses := make(map[string]string)
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return "", err
+		}
+		if line == nil {
+			break
+		}
+		status := strings.TrimSuffix(string(line), "\n")
+		if ref, ok := strings.CutPrefix(status, "ok "); ok {
+			statuses[ref] = "ok"
+		} else if rest, ok := strings.CutPrefix(status, "ng "); ok {
+			ref, reason, _ := strings.Cut(rest, " ")
+			statuses[ref] = reason
+		}
+	}
+	for _, c := range commands {
+		if c.incomingRef == "" {
+			continue
+		}
+		if status, ok := statuses[c.incomingRef]; ok {
+			c.status = status
+		} else {
+			c.status = "not received"
+		}
+	}
+	return unpackStatus, nil
+}
+
+// mergeIncomingRefs validates each of the received incoming refs as pushed by
+// the given user, merges each valid one into the corresponding review ref of
+// the repo at the given path, and then deletes them.
+func mergeIncomingRefs(path string, commands []*pushCommand, pusher string) {
+	lock, _ := mergeLocks.LoadOrStore(path, new(sync.Mutex))
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// The repo is opened again, so that it finds the newly received objects.
+	repo, openErr := repository.NewGitRepo(path)
+	for _, c := range commands {
+		if c.incomingRef == "" || c.status != "ok" {
+			continue
+		}
+		err := openErr
+		if err == nil {
+			var rejections []string
+			rejections, err = validateIncomingRef(repo, c.ref, c.incomingRef, pusher)
+			if err == nil && len(rejections) > 0 {
+				c.status = "rejected: " + strings.Join(rejections, "; ")
+			} else if err == nil {
+				err = repo.MergeReviewRef(c.ref, c.incomingRef)
+			}
+		}
+		if err != nil {
+			c.status = "failed to merge: " + strings.ReplaceAll(err.Error(), "\n", " ")
+		}
+		exec.Command("git", "-C", path, "update-ref", "-d", c.incomingRef).Run()
+	}
+}
+
+// validateIncomingRef returns the reasons, if any, for rejecting the merge of
+// the given incoming ref into the given review ref. Incoming notes are checked
+// in the same way as by "git appraise validate-push", as an update from their
+// merge base with the review ref that was pushed by the given user.
+func validateIncomingRef(repo *repository.GitRepo, ref, incomingRef, pusher string) ([]string, error) {
+	rest, ok := strings.CutPrefix(ref, "refs/notes/")
+	if !ok {
+		return nil, nil
+	}
+	namespace, _, _ := strings.Cut(rest, "/")
+	nsRepo, err := repository.NewNamespacedRepo(repo, namespace)
+	if err != nil {
+		return nil, err
+	}
+	newHash, err := repo.GetCommitHash(incomingRef)
+	if err != nil {
+		return nil, err
+	}
+	oldHash := ""
+	hasLocal, err := repo.HasRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if hasLocal {
+		localHash, err := repo.GetCommitHash(ref)
+		if err != nil {
+			return nil, err
+		}
+		// Unrelated histories have no merge base, in which case every
+		// incoming note is new.
+		if base, err := repo.MergeBase(localHash, newHash); err == nil {
+			oldHash = base
+		}
+	}
+	return commands.ValidateNotesUpdate(nsRepo, ref, oldHash, newHash, pusher)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"msrl.dev/git-appraise/commands/web"
+	"msrl.dev/git-appraise/repository"
+)
+
+const (
+	testNotesRef = "refs/notes/devtools/reviews"
+	testPusher   = "clone@test.com"
+	testPassword = "secret"
+	hubNote      = `{"timestamp":"0000000001","requester":"test@test.com"}`
+	cloneNote    = `{"timestamp":"0000000002","requester":"clone@test.com"}`
+)
+
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// setupHub serves the git repo at the given path as the repo named "proj",
+// and returns the URL from which its review refs are served.
+func setupHub(t *testing.T, dir string) string {
+	t.Helper()
+	repo, err := repository.NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := &Repos{}
+	repos.Store(&reposMap{"proj": web.NewRepoDetails(repo)})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{repo}/git/info/refs", repos.ServeGitInfoRefs)
+	mux.HandleFunc("POST /{repo}/git/git-upload-pack", repos.ServeGitUploadPack)
+	mux.HandleFunc("POST /{repo}/git/git-receive-pack", repos.ServeGitReceivePack)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL + "/proj/git"
+}
+
+// enablePushes lets testPusher push review refs with testPassword, and
+// returns the given URL of a hub with those credentials added to it.
+func enablePushes(t *testing.T, url string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushers = map[string][]byte{testPusher: hash}
+	t.Cleanup(func() { pushers = nil })
+	u, err := neturl.Parse(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = neturl.UserPassword(testPusher, testPassword)
+	return u.String()
+}
+
+// cloneHub clones the git repo at the given path, and adds the hub serving
+// it as the "hub" remote.
+func cloneHub(t *testing.T, dir, url string) string {
+	t.Helper()
+	clone := t.TempDir()
+	gitOutput(t, clone, "clone", "-q", dir, ".")
+	gitOutput(t, clone, "config", "user.email", "clone@test.com")
+	gitOutput(t, clone, "config", "user.name", "Clone")
+	gitOutput(t, clone, "remote", "add", "hub", url)
+	return clone
+}
+
+func TestGitPath(t *testing.T) {
+	code, err := repository.NewGitRepo(setupTestGitRepo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := repository.NewGitRepo(setupTestGitRepo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gitPath(code); got != code.GetPath() {
+		t.Errorf("gitPath(code) = %q", got)
+	}
+	namespaced, err := repository.NewNamespacedRepo(repository.NewSidecarRepo(code, store), "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gitPath(namespaced); got != store.GetPath() {
+		t.Errorf("gitPath(sidecar) = %q, want %q", got, store.GetPath())
+	}
+}
+
+func TestServeGitFetch(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	gitOutput(t, dir, "notes", "--ref", testNotesRef, "add", "-m", "hub note", "HEAD")
+	gitOutput(t, dir, "update-ref", "refs/devtools/archives/reviews", "HEAD")
+	url := setupHub(t, dir)
+	clone := cloneHub(t, dir, url)
+
+	for _, version := range []string{"0", "2"} {
+		refs := gitOutput(t, clone, "-c", "protocol.version="+version, "ls-remote", "hub")
+		if !strings.Contains(refs, testNotesRef) || !strings.Contains(refs, "refs/devtools/archives/reviews") {
+			t.Errorf("protocol v%s: review refs were not listed: %q", version, refs)
+		}
+		if strings.Contains(refs, "HEAD") || strings.Contains(refs, "refs/heads/") {
+			t.Errorf("protocol v%s: code refs were listed: %q", version, refs)
+		}
+		gitOutput(t, clone, "-c", "protocol.version="+version, "fetch", "hub", "+refs/notes/devtools/*:refs/notes/remotes/hub/devtools/*")
+		if note := gitOutput(t, clone, "notes", "--ref", "refs/notes/remotes/hub/devtools/reviews", "show", "HEAD"); note != "hub note" {
+			t.Errorf("protocol v%s: fetched note = %q", version, note)
+		}
+	}
+
+	// Branches cannot be fetched.
+	cmd := exec.Command("git", "fetch", "hub", "refs/heads/main")
+	cmd.Dir = clone
+	if err := cmd.Run(); err == nil {
+		t.Error("expected fetching a branch to fail")
+	}
+}
+
+func TestServeGitPush(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	gitOutput(t, dir, "notes", "--ref", testNotesRef, "add", "-m", hubNote, "HEAD")
+	// Keep the received packs, so that merging them must find their objects.
+	gitOutput(t, dir, "config", "receive.unpackLimit", "1")
+	url := setupHub(t, dir)
+	clone := cloneHub(t, dir, enablePushes(t, url))
+
+	// The clone's notes have diverged from those of the hub, so they are
+	// merged when pushed rather than rejected.
+	gitOutput(t, clone, "notes", "--ref", testNotesRef, "add", "-m", cloneNote, "HEAD")
+	gitOutput(t, clone, "update-ref", "refs/devtools/archives/reviews", "HEAD")
+	out := gitOutput(t, clone, "push", "hub", "refs/notes/devtools/*:refs/notes/devtools/*", "refs/devtools/archives/*:refs/devtools/archives/*")
+	if strings.Contains(out, "rejected") {
+		t.Errorf("push was rejected: %s", out)
+	}
+	if note := gitOutput(t, dir, "notes", "--ref", testNotesRef, "show", "HEAD"); note != hubNote+"\n"+cloneNote {
+		t.Errorf("merged note = %q", note)
+	}
+	if got, want := gitOutput(t, dir, "rev-parse", "refs/devtools/archives/reviews"), gitOutput(t, clone, "rev-parse", "HEAD"); got != want {
+		t.Errorf("pushed archive = %s, want %s", got, want)
+	}
+	if incoming := gitOutput(t, dir, "for-each-ref", incomingRefPrefix); incoming != "" {
+		t.Errorf("incoming refs were not deleted: %s", incoming)
+	}
+
+	// Pulling the merged notes then lets the clone fast-forward the hub.
+	gitOutput(t, clone, "fetch", "hub", "+refs/notes/devtools/*:refs/notes/devtools/*")
+	gitOutput(t, clone, "notes", "--ref", testNotesRef, "append", "-m", `{"timestamp":"0000000003","requester":"clone@test.com"}`, "HEAD")
+	gitOutput(t, clone, "push", "hub", testNotesRef)
+	if got, want := gitOutput(t, dir, "rev-parse", testNotesRef), gitOutput(t, clone, "rev-parse", testNotesRef); got != want {
+		t.Errorf("fast-forwarded notes = %s, want %s", got, want)
+	}
+
+	// Only review refs can be pushed, and they cannot be deleted.
+	for _, refspec := range []string{"HEAD:refs/heads/main", ":" + testNotesRef} {
+		cmd := exec.Command("git", "push", "hub", refspec)
+		cmd.Dir = clone
+		out, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "remote rejected") {
+			t.Errorf("push %q: %v: %s", refspec, err, out)
+		}
+	}
+
+	// Notes that validate-push would reject are not merged, including
+	// comments that are not authored by the pusher.
+	pushed := gitOutput(t, dir, "rev-parse", testNotesRef)
+	gitOutput(t, clone, "notes", "--ref", testNotesRef, "append", "-m", "not a request", "HEAD")
+	gitOutput(t, clone, "notes", "--ref", "refs/notes/devtools/discuss", "add", "-m", `{"timestamp":"0000000004","author":"other@test.com"}`, "HEAD")
+	for _, ref := range []string{testNotesRef, "refs/notes/devtools/discuss"} {
+		cmd := exec.Command("git", "push", "hub", ref)
+		cmd.Dir = clone
+		out, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "rejected: ") {
+			t.Errorf("push %q: %v: %s", ref, err, out)
+		}
+	}
+	if got := gitOutput(t, dir, "rev-parse", testNotesRef); got != pushed {
+		t.Errorf("rejected notes were merged: %s, want %s", got, pushed)
+	}
+	if refs := gitOutput(t, dir, "for-each-ref", "refs/notes/devtools/discuss"); refs != "" {
+		t.Errorf("rejected comments were merged: %s", refs)
+	}
+
+	// Pushes need the credentials of a pusher.
+	cmd := exec.Command("git", "push", url, testNotesRef)
+	cmd.Dir = clone
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("push without credentials succeeded: %s", out)
+	}
+}
+
+func TestServeGitPushMergeError(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	url := setupHub(t, dir)
+	clone := cloneHub(t, dir, enablePushes(t, url))
+	// The hub's notes ref holds something other than a commit.
+	gitOutput(t, dir, "notes", "--ref", testNotesRef, "add", "-m", hubNote, "HEAD")
+	gitOutput(t, dir, "update-ref", testNotesRef, "HEAD:README.md")
+
+	gitOutput(t, clone, "notes", "--ref", testNotesRef, "add", "-m", cloneNote, "HEAD")
+	cmd := exec.Command("git", "push", "hub", testNotesRef)
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "failed to merge") {
+		t.Errorf("push: %v: %s", err, out)
+	}
+
+	// The merge also fails if the repo can no longer be opened.
+	os.RemoveAll(filepath.Join(dir, ".git", "refs"))
+	commands := []*pushCommand{{ref: testNotesRef, incomingRef: incomingRefPrefix + "x/notes/devtools/reviews", status: "ok"}}
+	mergeIncomingRefs(dir, commands, testPusher)
+	if !strings.HasPrefix(commands[0].status, "failed to merge") {
+		t.Errorf("status = %q", commands[0].status)
+	}
+}
+
+// pushRequest returns a request to the git service at the given URL with the
+// credentials of testPusher.
+func pushRequest(method, url, body string) *http.Request {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.SetBasicAuth(testPusher, testPassword)
+	return req
+}
+
+func TestServeGitErrors(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	url := setupHub(t, dir)
+	base := strings.TrimSuffix(url, "/proj/git")
+	enablePushes(t, url)
+
+	for _, test := range []struct {
+		method, path, body string
+		header             map[string]string
+		want               int
+	}{
+		{"GET", "/missing/git/info/refs?service=git-upload-pack", "", nil, http.StatusNotFound},
+		{"POST", "/missing/git/git-upload-pack", "", nil, http.StatusNotFound},
+		{"POST", "/missing/git/git-receive-pack", "", nil, http.StatusNotFound},
+		{"GET", "/proj/git/info/refs", "", nil, http.StatusForbidden},
+		{"GET", "/proj/git/info/refs?service=git-upload-archive", "", nil, http.StatusForbidden},
+		{"POST", "/proj/git/git-upload-pack", "not gzip", map[string]string{"Content-Encoding": "gzip"}, http.StatusBadRequest},
+		{"POST", "/proj/git/git-receive-pack", "not gzip", map[string]string{"Content-Encoding": "gzip"}, http.StatusBadRequest},
+		{"POST", "/proj/git/git-receive-pack", "zzzz", nil, http.StatusBadRequest},
+		{"POST", "/proj/git/git-receive-pack", string(pktLine("bad command\n")), nil, http.StatusBadRequest},
+	} {
+		req := pushRequest(test.method, base+test.path, test.body)
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %s: status = %d, want %d", test.method, test.path, resp.StatusCode, test.want)
+		}
+	}
+
+	// Pushes that only refuse refs do not need to run receive-pack, and
+	// report nothing unless asked to.
+	zero := strings.Repeat("0", 40)
+	for caps, want := range map[string]string{
+		"":              "",
+		"report-status": "000eunpack ok\n0036ng refs/heads/main only review refs can be pushed\n0000",
+	} {
+		body := string(pktLine(zero+" "+zero+" refs/heads/main\x00"+caps+"\n")) + "0000"
+		resp, err := http.DefaultClient.Do(pushRequest("POST", url+"/git-receive-pack", body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		got.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if got.String() != want {
+			t.Errorf("caps %q: response = %q, want %q", caps, got.String(), want)
+		}
+	}
+
+	// A gzipped fetch request is decompressed.
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte("0000"))
+	zw.Close()
+	req, _ := http.NewRequest("POST", url+"/git-upload-pack", &gzipped)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("gzipped fetch status = %d", resp.StatusCode)
+	}
+
+	// Pushes need the credentials of a pusher, and are refused altogether
+	// unless some users may push.
+	for _, test := range []struct {
+		user, password string
+		want           int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{testPusher, "wrong", http.StatusUnauthorized},
+		{"other@test.com", testPassword, http.StatusUnauthorized},
+	} {
+		for _, path := range []string{"/info/refs?service=git-receive-pack", "/git-receive-pack"} {
+			method := "GET"
+			if path == "/git-receive-pack" {
+				method = "POST"
+			}
+			req, _ := http.NewRequest(method, url+path, strings.NewReader("0000"))
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want || resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%s as %q: status = %d, want %d", path, test.user, resp.StatusCode, test.want)
+			}
+		}
+	}
+	savedPushers := pushers
+	pushers = nil
+	resp, err = http.DefaultClient.Do(pushRequest("GET", url+"/info/refs?service=git-receive-pack", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("disabled push status = %d", resp.StatusCode)
+	}
+	pushers = savedPushers
+
+	// The services fail once the repo is gone.
+	os.RemoveAll(dir)
+	for _, service := range []string{"upload-pack", "receive-pack"} {
+		resp, err := http.DefaultClient.Do(pushRequest("GET", url+"/info/refs?service=git-"+service, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("%s advertisement status = %d", service, resp.StatusCode)
+		}
+	}
+	body := string(pktLine(zero+" "+strings.Repeat("1", 40)+" "+testNotesRef+"\x00report-status\n")) + "0000"
+	resp, err = http.DefaultClient.Do(pushRequest("POST", url+"/git-receive-pack", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("receive-pack status = %d", resp.StatusCode)
+	}
+}
+
+func TestReadPktLine(t *testing.T) {
+	for _, input := range []string{"", "zzzz", "0002", "0008ab"} {
+		if _, err := readPktLine(strings.NewReader(input)); err == nil {
+			t.Errorf("readPktLine(%q) succeeded", input)
+		}
+	}
+	if line, err := readPktLine(strings.NewReader("0000")); err != nil || line != nil {
+		t.Errorf("readPktLine(flush) = %q, %v", line, err)
+	}
+}
+
+func TestHaveReviewRefs(t *testing.T) {
+	hash := strings.Repeat("1", 40)
+	advertisement := string(pktLine(hash+" refs/heads/main\x00caps\n")) +
+		string(pktLine(hash+" "+testNotesRef+"\n")) + "0000"
+	got, err := haveReviewRefs([]byte(advertisement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(pktLine(hash+" .have\x00caps\n")) + "0000"; string(got) != want {
+		t.Errorf("haveReviewRefs() = %q, want %q", got, want)
+	}
+	got, err = haveReviewRefs([]byte(string(pktLine(hash+" refs/heads/main\x00caps\n")) + "0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(pktLine(strings.Repeat("0", 40)+" capabilities^{}\x00caps\n")) + "0000"; string(got) != want {
+		t.Errorf("haveReviewRefs() = %q, want %q", got, want)
+	}
+	// The all-zeros object name is as long as those of the repo.
+	sha256Caps := "report-status object-format=sha256"
+	got, err = haveReviewRefs([]byte(string(pktLine(strings.Repeat("a", 64)+" refs/heads/main\x00"+sha256Caps+"\n")) + "0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(pktLine(strings.Repeat("0", 64)+" capabilities^{}\x00"+sha256Caps+"\n")) + "0000"; string(got) != want {
+		t.Errorf("haveReviewRefs() = %q, want %q", got, want)
+	}
+	if _, err := haveReviewRefs([]byte("0008ab")); err == nil {
+		t.Error("expected an error for a truncated advertisement")
+	}
+}
+
+func TestReadReceiveStatus(t *testing.T) {
+	commands := []*pushCommand{
+		{ref: "refs/notes/a", incomingRef: "refs/appraise/incoming/x/notes/a"},
+		{ref: "refs/notes/b", incomingRef: "refs/appraise/incoming/x/notes/b"},
+		{ref: "refs/notes/c", incomingRef: "refs/appraise/incoming/x/notes/c"},
+		{ref: "refs/heads/main", status: "refused"},
+	}
+	report := string(pktLine("unpack ok\n")) +
+		string(pktLine("ok refs/appraise/incoming/x/notes/a\n")) +
+		string(pktLine("ng refs/appraise/incoming/x/notes/b failed\n")) + "0000"
+	unpackStatus, err := readReceiveStatus([]byte(report), commands)
+	if err != nil || unpackStatus != "ok" {
+		t.Fatalf("readReceiveStatus() = %q, %v", unpackStatus, err)
+	}
+	var statuses []string
+	for _, c := range commands {
+		statuses = append(statuses, c.status)
+	}
+	if got, want := fmt.Sprint(statuses), "[ok failed not received refused]"; got != want {
+		t.Errorf("statuses = %s, want %s", got, want)
+	}
+	for _, report := range []string{"", string(pktLine("bad\n")), string(pktLine("unpack ok\n"))} {
+		if _, err := readReceiveStatus([]byte(report), nil); err == nil {
+			t.Errorf("readReceiveStatus(%q) succeeded", report)
+		}
+	}
+}
+
+func TestReadPushers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "pushers")
+	if err := os.WriteFile(path, []byte("# Pushers\n\n"+testPusher+":"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := readPushers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || bcrypt.CompareHashAndPassword(users[testPusher], []byte(testPassword)) != nil {
+		t.Errorf("readPushers() = %q", users)
+	}
+
+	for _, contents := range []string{"no hash\n", ":" + string(hash) + "\n", testPusher + ":plaintext\n"} {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPushers(path); err == nil {
+			t.Errorf("readPushers(%q) succeeded", contents)
+		}
+	}
+	if _, err := readPushers(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readPushers(missing) succeeded")
+	}
+}
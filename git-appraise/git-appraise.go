@@ -30,6 +30,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"sort"
 	"strings"
 
@@ -37,15 +38,25 @@ import (
 	"msrl.dev/git-appraise/repository"
 )
 
-const usageMessageTemplate = `Usage: %s <command>
+const usageMessageTemplate = `Usage: %s [--namespace=<namespace>[,<namespace>...]] <command>
 
 Where <command> is one of:
   %s
 
+The --namespace option selects the namespace in which reviews are written
+(the first one) and read (all of them), overriding the appraise.namespace and
+appraise.readNamespace settings and the GIT_APPRAISE_NAMESPACE variable.
+
 For individual command usage, run:
   %s help <command>
 `
 
+const pluginsMessageTemplate = `
+The following commands are provided by plugins (git-appraise-<command>
+executables) on the PATH:
+  %s
+`
+
 func printUsage(w io.Writer, arg0 string) {
 	var subcommands []string
 	for subcommand := range commands.CommandMap {
@@ -53,6 +64,9 @@ func printUsage(w io.Writer, arg0 string) {
 	}
 	sort.Strings(subcommands)
 	fmt.Fprintf(w, usageMessageTemplate, arg0, strings.Join(subcommands, "\n  "), arg0)
+	if plugins := findPlugins(); len(plugins) > 0 {
+		fmt.Fprintf(w, pluginsMessageTemplate, strings.Join(plugins, "\n  "))
+	}
 }
 
 func printHelp(w io.Writer, args []string) {
@@ -62,6 +76,14 @@ func printHelp(w io.Writer, args []string) {
 	}
 	subcommand, ok := commands.CommandMap[args[2]]
 	if !ok {
+		// Plugins describe their own usage.
+		if path := lookPlugin(args[2]); path != "" {
+			cmd := exec.Command(path, "--help")
+			cmd.Stdout = w
+			cmd.Stderr = w
+			cmd.Run()
+			return
+		}
 		fmt.Fprintf(w, "Unknown command %q\n", args[2])
 		printUsage(w, args[0])
 		return
@@ -70,10 +92,27 @@ func printHelp(w io.Writer, args []string) {
 }
 
 func run(w io.Writer, args []string, cwd string) error {
-	repo, err := repository.NewGitRepo(cwd)
-	if err != nil {
+	namespaces := os.Getenv(repository.NamespaceEnv)
+	if len(args) > 1 {
+		if ns, ok := strings.CutPrefix(args[1], "--namespace="); ok {
+			namespaces = ns
+			args = append(args[:1:1], args[2:]...)
+		}
+	}
+	gitRepo, err := repository.NewGitRepo(cwd)
+	if errors.Is(err, repository.ErrUnsupportedObjectFormat) {
+		return err
+	} else if err != nil {
 		return fmt.Errorf("%s must be run from within a git repo", args[0])
 	}
+	store, err := repository.OpenReviewStore(gitRepo)
+	if err != nil {
+		return err
+	}
+	repo, err := repository.OpenNamespace(store, namespaces)
+	if err != nil {
+		return err
+	}
 	if len(args) < 2 {
 		subcommand, ok := commands.CommandMap["list"]
 		if !ok {
@@ -83,6 +122,13 @@ func run(w io.Writer, args []string, cwd string) error {
 	}
 	subcommand, ok := commands.CommandMap[args[1]]
 	if !ok {
+		if path := lookPlugin(args[1]); path != "" {
+			context, err := newPluginContext(gitRepo, repo)
+			if err != nil {
+				return err
+			}
+			return runPlugin(path, args[2:], context)
+		}
 		printUsage(w, args[0])
 		return fmt.Errorf("unknown command: %q", args[1])
 	}
@@ -100,6 +146,11 @@ func main() {
 		return
 	}
 	if err := run(os.Stdout, os.Args, cwd); err != nil {
+		// Plugins report their own errors, and their exit status is kept.
+		var pluginErr pluginExitError
+		if errors.As(err, &pluginErr) {
+			os.Exit(int(pluginErr))
+		}
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
 	"msrl.dev/git-appraise/commands"
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review"
 )
 
 func setupTestGitRepo(t *testing.T) string {
@@ -38,6 +43,32 @@ func setupTestGitRepo(t *testing.T) string {
 	return dir
 }
 
+// appraise runs git-appraise in the given dir, discarding its output.
+func appraise(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+	if err := run(devNull, append([]string{"git-appraise"}, args...), dir); err != nil {
+		t.Fatalf("git appraise %s: %v", strings.Join(args, " "), err)
+	}
+}
+
+// gitOutput runs git in the given dir, and returns its output.
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
 func TestPrintUsage(t *testing.T) {
 	var buf bytes.Buffer
 	printUsage(&buf, "git-appraise")
@@ -88,6 +119,245 @@ func TestRunNotGitRepo(t *testing.T) {
 	}
 }
 
+func TestRunUnsupportedObjectFormat(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", dir},
+		{"-C", dir, "config", "core.repositoryformatversion", "1"},
+		{"-C", dir, "config", "extensions.objectformat", "md5"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+	var buf bytes.Buffer
+	err := run(&buf, []string{"git-appraise", "list"}, dir)
+	if !errors.Is(err, repository.ErrUnsupportedObjectFormat) || !strings.Contains(err.Error(), "md5") {
+		t.Errorf("expected an unsupported object format error, got %v", err)
+	}
+}
+
+// TestRunWorktreeAndBare runs a review between a linked worktree, in which
+// it is requested, a bare clone, in which it is commented upon, and the main
+// worktree, in which it is submitted.
+func TestRunWorktreeAndBare(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	target := gitOutput(t, dir, "symbolic-ref", "HEAD")
+	worktree := filepath.Join(t.TempDir(), "feature")
+	gitOutput(t, dir, "worktree", "add", "-b", "feature", worktree)
+	if err := os.WriteFile(filepath.Join(worktree, "feature.txt"), []byte("feature\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitOutput(t, worktree, "add", ".")
+	gitOutput(t, worktree, "commit", "-m", "feature")
+	revision := gitOutput(t, worktree, "rev-parse", "HEAD")
+	appraise(t, worktree, "request", "-m", "Worktree review", "-target", target)
+
+	bare := filepath.Join(t.TempDir(), "bare.git")
+	gitOutput(t, t.TempDir(), "clone", "--bare", dir, bare)
+	gitOutput(t, bare, "config", "user.email", "reviewer@test.com")
+	appraise(t, bare, "pull")
+	appraise(t, bare, "list")
+	appraise(t, bare, "show", revision)
+	appraise(t, bare, "comment", "-m", "Looks good", "-f", "feature.txt", "-l", "1", revision)
+	appraise(t, bare, "accept", "-m", "LGTM", revision)
+	appraise(t, bare, "push")
+
+	repo, err := repository.NewGitRepo(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := review.Get(repo, revision)
+	if err != nil || r == nil {
+		t.Fatalf("review.Get() = %v, %v", r, err)
+	}
+	if len(r.Comments) != 2 || r.Resolved == nil || !*r.Resolved {
+		t.Errorf("expected the comments from the bare clone to be seen in the worktree, got %+v", r.Summary)
+	}
+	var buf bytes.Buffer
+	if err := run(&buf, []string{"git-appraise", "submit", "--merge", revision}, worktree); err == nil || !strings.Contains(err.Error(), "already") {
+		t.Errorf("expected submitting from the worktree to fail while the target is checked out in the main worktree, got %v", err)
+	}
+	appraise(t, dir, "submit", "--merge", revision)
+	if r, err := review.Get(repo, revision); err != nil || !r.Submitted {
+		t.Errorf("expected the review to be submitted, got %v", err)
+	}
+}
+
+// TestRunSHA256 runs a review from its request to its submission in repos
+// that use SHA-256 object names, pushing and pulling it between two clones
+// of a shared remote.
+func TestRunSHA256(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	gitOutput(t, t.TempDir(), "init", "--bare", "--object-format=sha256", "-b", "master", remote)
+	author := t.TempDir()
+	gitOutput(t, author, "init", "--object-format=sha256", "-b", "master")
+	gitOutput(t, author, "remote", "add", "origin", remote)
+	gitOutput(t, author, "config", "user.email", "author@test.com")
+	gitOutput(t, author, "config", "user.name", "Author")
+	if err := os.WriteFile(filepath.Join(author, "README.md"), []byte("initial\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitOutput(t, author, "add", ".")
+	gitOutput(t, author, "commit", "-m", "initial")
+	gitOutput(t, author, "checkout", "-b", "feature")
+	if err := os.WriteFile(filepath.Join(author, "feature.txt"), []byte("feature\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitOutput(t, author, "add", ".")
+	gitOutput(t, author, "commit", "-m", "feature")
+	gitOutput(t, author, "push", "origin", "master", "feature")
+	revision := gitOutput(t, author, "rev-parse", "HEAD")
+	if len(revision) != 64 {
+		t.Fatalf("expected a SHA-256 object name, got %q", revision)
+	}
+	getReview := func(dir string) *review.Review {
+		t.Helper()
+		repo, err := repository.NewGitRepo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := review.Get(repo, revision)
+		if err != nil || r == nil {
+			t.Fatalf("review.Get() = %v, %v", r, err)
+		}
+		return r
+	}
+
+	appraise(t, author, "request", "-m", "Add a feature", "-r", "reviewer@test.com", "-target", "refs/heads/master")
+	appraise(t, author, "push")
+
+	reviewer := filepath.Join(t.TempDir(), "reviewer")
+	gitOutput(t, t.TempDir(), "clone", remote, reviewer)
+	gitOutput(t, reviewer, "config", "user.email", "reviewer@test.com")
+	gitOutput(t, reviewer, "config", "user.name", "Reviewer")
+	gitOutput(t, reviewer, "checkout", "feature")
+	appraise(t, reviewer, "pull")
+	if r := getReview(reviewer); r.Request.Description != "Add a feature" {
+		t.Errorf("expected to pull the request, got %+v", r.Request)
+	}
+	appraise(t, reviewer, "comment", "-m", "Looks good", "-f", "feature.txt", "-l", "1", revision)
+	appraise(t, reviewer, "accept", "-m", "LGTM", revision)
+	appraise(t, reviewer, "push")
+
+	appraise(t, author, "pull")
+	r := getReview(author)
+	if len(r.Comments) != 2 || r.Resolved == nil || !*r.Resolved {
+		t.Fatalf("expected to pull the comment and the acceptance, got %+v", r.Summary)
+	}
+	if hash := r.Comments[0].Hash; len(hash) != 40 {
+		t.Errorf("expected comments to keep their SHA-1 hashes, got %q", hash)
+	}
+
+	gitOutput(t, author, "checkout", "master")
+	appraise(t, author, "submit", "--merge", revision)
+	if r := getReview(author); !r.Submitted {
+		t.Error("expected the review to be submitted")
+	}
+	gitOutput(t, author, "push", "origin", "master")
+	appraise(t, reviewer, "pull")
+	gitOutput(t, reviewer, "fetch", "origin", "master:master")
+	if r := getReview(reviewer); !r.Submitted {
+		t.Error("expected the submission to be seen by the reviewer")
+	}
+	gitOutput(t, author, "fsck", "--strict")
+	gitOutput(t, reviewer, "fsck", "--strict")
+}
+
+// TestRunValidatePushHistory validates updates of the comment notes of a repo,
+// including one that rewrites their history by compacting it.
+func TestRunValidatePushHistory(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	const ref = "refs/notes/devtools/discuss"
+	appendNote := func(note string) string {
+		gitOutput(t, dir, "notes", "--ref", ref, "append", "-m", note, "HEAD")
+		return gitOutput(t, dir, "rev-parse", ref)
+	}
+	validate := func(oldHash, newHash string) error {
+		var buf bytes.Buffer
+		return run(&buf, []string{"git-appraise", "validate-push", ref, oldHash, newHash}, dir)
+	}
+	first := appendNote(`{"timestamp":"0000000001","author":"alice","description":"first"}`)
+	second := appendNote(`{"timestamp":"0000000002","author":"bob","description":"second"}`)
+	if err := validate(first, second); err != nil {
+		t.Errorf("unexpected rejection of a new comment: %v", err)
+	}
+
+	appraise(t, dir, "compact", "-before", "2999-01-01")
+	compacted := gitOutput(t, dir, "rev-parse", ref)
+	if compacted == second {
+		t.Fatal("expected compacting the notes to rewrite their history")
+	}
+	if err := validate(second, compacted); err != nil {
+		t.Errorf("unexpected rejection of the compacted notes: %v", err)
+	}
+
+	// A note that is added and then removed again is not validated by
+	// comparing the old and new values of the ref, but is still rejected.
+	blob := strings.Fields(gitOutput(t, dir, "notes", "--ref", ref, "list", "HEAD"))[0]
+	appendNote(`{"author":"mallory"}`)
+	gitOutput(t, dir, "notes", "--ref", ref, "add", "-f", "-C", blob, "HEAD")
+	if err := validate(compacted, gitOutput(t, dir, "rev-parse", ref)); err == nil || !strings.Contains(err.Error(), "lines that are not in") {
+		t.Errorf("expected the removed note to be rejected, got %v", err)
+	}
+}
+
+func TestRunReviewStoreError(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	cmd := exec.Command("git", "-C", dir, "config", "appraise.reviewStore", t.TempDir())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	var buf bytes.Buffer
+	err := run(&buf, []string{"git-appraise", "list"}, dir)
+	if err == nil || !strings.Contains(err.Error(), "review store") {
+		t.Errorf("expected a 'review store' error, got %v", err)
+	}
+}
+
+func TestRunNamespace(t *testing.T) {
+	dir := setupTestGitRepo(t)
+	var gotRepo repository.Repo
+	var gotArgs []string
+	commands.CommandMap["namespace-test"] = &commands.Command{
+		RunMethod: func(repo repository.Repo, args []string) error {
+			gotRepo, gotArgs = repo, args
+			return nil
+		},
+	}
+	defer delete(commands.CommandMap, "namespace-test")
+
+	namespace := func() string {
+		if nsRepo, ok := gotRepo.(*repository.NamespacedRepo); ok {
+			return nsRepo.Namespace()
+		}
+		return repository.DefaultNamespace
+	}
+	var buf bytes.Buffer
+	if err := run(&buf, []string{"git-appraise", "namespace-test", "arg"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if namespace() != repository.DefaultNamespace {
+		t.Errorf("expected the default namespace, got %q", namespace())
+	}
+	if err := run(&buf, []string{"git-appraise", "--namespace=security,devtools", "namespace-test", "arg"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if namespace() != "security" || !slices.Equal(gotArgs, []string{"arg"}) {
+		t.Errorf("expected the security namespace and the remaining args, got %q and %q", namespace(), gotArgs)
+	}
+	t.Setenv(repository.NamespaceEnv, "teamA")
+	if err := run(&buf, []string{"git-appraise", "namespace-test"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if namespace() != "teamA" {
+		t.Errorf("expected the namespace from the environment, got %q", namespace())
+	}
+	if err := run(&buf, []string{"git-appraise", "--namespace=team/a", "namespace-test"}, dir); err == nil || !strings.Contains(err.Error(), "invalid review namespace") {
+		t.Errorf("expected an 'invalid review namespace' error, got %v", err)
+	}
+}
+
 func TestRunUnknownCommand(t *testing.T) {
 	dir := setupTestGitRepo(t)
 	var buf bytes.Buffer
@@ -0,0 +1,161 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"msrl.dev/git-appraise/commands"
+	"msrl.dev/git-appraise/repository"
+)
+
+// pluginPrefix is the prefix of the names of the executables on the PATH
+// that provide subcommands other than those in commands.CommandMap.
+const pluginPrefix = "git-appraise-"
+
+// The environment variables in which plugins are passed their context.
+const (
+	pluginRepoEnv    = "GIT_APPRAISE_REPO"
+	pluginContextEnv = "GIT_APPRAISE_CONTEXT"
+)
+
+// pluginContext describes the repo that a plugin is run in. It is passed to
+// the plugin as JSON, in the GIT_APPRAISE_CONTEXT environment variable.
+type pluginContext struct {
+	// Repo is the path to the top level of the repo.
+	Repo string `json:"repo"`
+	// GitDir is the path to the repo's git directory.
+	GitDir string `json:"gitDir"`
+	// ReviewStore is the path to the sidecar repo in which the reviews are
+	// stored, if any.
+	ReviewStore string `json:"reviewStore,omitempty"`
+	// Namespaces are the namespaces from which reviews are read, starting
+	// with the one in which they are written.
+	Namespaces []string `json:"namespaces"`
+}
+
+// pluginExitError is the exit status of a plugin that failed.
+type pluginExitError int
+
+func (err pluginExitError) Error() string {
+	return fmt.Sprintf("plugin exited with status %d", int(err))
+}
+
+// isPluginName reports whether the given name can be that of a plugin. The
+// built in commands take precedence over plugins, which also keeps the
+// git-appraise-web server from being run as the "web" command.
+func isPluginName(name string) bool {
+	_, builtin := commands.CommandMap[name]
+	return name != "" && !builtin && !strings.ContainsAny(name, `/\`)
+}
+
+// findPlugins returns the names of the plugins on the PATH, in order.
+func findPlugins() []string {
+	var plugins []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutPrefix(entry.Name(), pluginPrefix)
+			if !ok {
+				continue
+			}
+			if runtime.GOOS == "windows" {
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+			if !isPluginName(name) || slices.Contains(plugins, name) {
+				continue
+			}
+			if _, err := exec.LookPath(filepath.Join(dir, entry.Name())); err != nil {
+				continue
+			}
+			plugins = append(plugins, name)
+		}
+	}
+	slices.Sort(plugins)
+	return plugins
+}
+
+// lookPlugin returns the path to the plugin with the given name, or the
+// empty string if there is no such plugin.
+func lookPlugin(name string) string {
+	if !isPluginName(name) {
+		return ""
+	}
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// newPluginContext returns the context in which to run plugins for the
+// given repo.
+func newPluginContext(gitRepo *repository.GitRepo, repo repository.Repo) (*pluginContext, error) {
+	gitDir, err := gitRepo.GetGitDir()
+	if err != nil {
+		return nil, err
+	}
+	context := &pluginContext{
+		Repo:       gitRepo.GetPath(),
+		GitDir:     gitDir,
+		Namespaces: []string{repository.DefaultNamespace},
+	}
+	if nsRepo, ok := repo.(*repository.NamespacedRepo); ok {
+		context.Namespaces = nsRepo.Namespaces()
+		repo = nsRepo.Repo
+	}
+	if sidecar, ok := repo.(*repository.SidecarRepo); ok {
+		context.ReviewStore = sidecar.Store().GetPath()
+	}
+	return context, nil
+}
+
+// runPlugin runs the plugin at the given path with the given arguments, in
+// the given context.
+//
+// The plugin shares the standard input and output of git-appraise. Its
+// review namespaces are also passed on in GIT_APPRAISE_NAMESPACE, so that
+// any git-appraise commands that it runs use the same ones.
+func runPlugin(path string, args []string, context *pluginContext) error {
+	// Contexts always encode successfully.
+	contextJSON, _ := json.Marshal(context)
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		pluginRepoEnv+"="+context.Repo,
+		pluginContextEnv+"="+string(contextJSON),
+		repository.NamespaceEnv+"="+strings.Join(context.Namespaces, ","))
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return pluginExitError(exitErr.ExitCode())
+	}
+	return err
+}
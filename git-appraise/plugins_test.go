@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+)
+
+// writePlugin writes a shell script with the given name and body to the
+// given directory.
+func writePlugin(t *testing.T, dir, name, body string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindPlugins(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writePlugin(t, first, "git-appraise-foo", "true", 0755)
+	writePlugin(t, first, "git-appraise-notexec", "true", 0644)
+	writePlugin(t, first, "git-appraise-list", "true", 0755)
+	writePlugin(t, first, "git-appraise-", "true", 0755)
+	writePlugin(t, first, "other", "true", 0755)
+	writePlugin(t, second, "git-appraise-foo", "true", 0755)
+	writePlugin(t, second, "git-appraise-bar", "true", 0755)
+	t.Setenv("PATH", strings.Join([]string{first, filepath.Join(first, "missing"), second}, string(filepath.ListSeparator)))
+
+	if plugins := findPlugins(); !slices.Equal(plugins, []string{"bar", "foo"}) {
+		t.Errorf("findPlugins() = %q", plugins)
+	}
+	if path := lookPlugin("foo"); path != filepath.Join(first, "git-appraise-foo") {
+		t.Errorf("lookPlugin(foo) = %q", path)
+	}
+	for _, name := range []string{"list", "missing", "notexec", "", "../foo"} {
+		if path := lookPlugin(name); path != "" {
+			t.Errorf("lookPlugin(%q) = %q, want no plugin", name, path)
+		}
+	}
+}
+
+func TestPluginUsage(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "git-appraise-foo", `echo "foo usage $1"`, 0755)
+	t.Setenv("PATH", dir)
+
+	var buf bytes.Buffer
+	printUsage(&buf, "git-appraise")
+	if !strings.Contains(buf.String(), "provided by plugins") || !strings.HasSuffix(buf.String(), "\n  foo\n") {
+		t.Errorf("usage does not list the plugin: %q", buf.String())
+	}
+	buf.Reset()
+	printHelp(&buf, []string{"git-appraise", "help", "foo"})
+	if buf.String() != "foo usage --help\n" {
+		t.Errorf("help for the plugin = %q", buf.String())
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	buf.Reset()
+	printUsage(&buf, "git-appraise")
+	if strings.Contains(buf.String(), "plugins") {
+		t.Errorf("usage lists plugins when there are none: %q", buf.String())
+	}
+}
+
+func TestRunPlugin(t *testing.T) {
+	repoDir := setupTestGitRepo(t)
+	pluginDir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out")
+	writePlugin(t, pluginDir, "git-appraise-foo", `
+{
+	echo "$@"
+	echo "$GIT_APPRAISE_REPO"
+	echo "$GIT_APPRAISE_NAMESPACE"
+	echo "$GIT_APPRAISE_CONTEXT"
+} > "`+out+`"`, 0755)
+	writePlugin(t, pluginDir, "git-appraise-fail", "exit 3", 0755)
+	t.Setenv("PATH", pluginDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	var buf bytes.Buffer
+	if err := run(&buf, []string{"git-appraise", "--namespace=security,devtools", "foo", "a", "b"}, repoDir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || lines[0] != "a b" || lines[1] != repoDir || lines[2] != "security,devtools" {
+		t.Fatalf("plugin output = %q", lines)
+	}
+	var context pluginContext
+	if err := json.Unmarshal([]byte(lines[3]), &context); err != nil {
+		t.Fatal(err)
+	}
+	want := pluginContext{
+		Repo:       repoDir,
+		GitDir:     filepath.Join(repoDir, ".git"),
+		Namespaces: []string{"security", "devtools"},
+	}
+	if !slices.Equal(context.Namespaces, want.Namespaces) || context.Repo != want.Repo || context.GitDir != want.GitDir || context.ReviewStore != "" {
+		t.Errorf("context = %+v, want %+v", context, want)
+	}
+
+	// Sidecar repos are passed on, and the default namespace is used.
+	storeDir := t.TempDir()
+	if out, err := exec.Command("git", "init", "--bare", storeDir).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if out, err := exec.Command("git", "-C", repoDir, "config", repository.ReviewStoreKey, storeDir).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if err := run(&buf, []string{"git-appraise", "foo"}, repoDir); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &context); err != nil {
+		t.Fatal(err)
+	}
+	if context.ReviewStore != storeDir || !slices.Equal(context.Namespaces, []string{repository.DefaultNamespace}) {
+		t.Errorf("context = %+v", context)
+	}
+
+	err = run(&buf, []string{"git-appraise", "fail"}, repoDir)
+	var exitErr pluginExitError
+	if !errors.As(err, &exitErr) || exitErr != 3 || err.Error() != "plugin exited with status 3" {
+		t.Errorf("run() of a failing plugin = %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected usage output %q", buf.String())
+	}
+}
+
+// TestMainPluginExitSubprocess tests that git-appraise exits with the status
+// of a failed plugin.
+func TestMainPluginExitSubprocess(t *testing.T) {
+	pluginDir := t.TempDir()
+	writePlugin(t, pluginDir, "git-appraise-fail", "exit 3", 0755)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainPluginExitHelper$")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_PLUGIN_EXIT=1", "PATH="+pluginDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	cmd.Dir = setupTestGitRepo(t)
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("expected exit code 3, got %v", err)
+	}
+}
+
+func TestMainPluginExitHelper(t *testing.T) {
+	if os.Getenv("TEST_MAIN_PLUGIN_EXIT") != "1" {
+		return
+	}
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+	os.Args = []string{"git-appraise", "fail"}
+	main()
+}
@@ -19,12 +19,18 @@ package repository
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"maps"
+	"net/mail"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
 	"sort"
 	"strconv"
@@ -36,7 +42,9 @@ import (
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
 	"github.com/go-git/go-git/v5/storage/filesystem"
 )
 
@@ -51,6 +59,11 @@ const (
 type GitRepo struct {
 	Path  string
 	gogit *gogit.Repository
+	// ctx, if set, is the context to which the commands that are run are
+	// bound.
+	ctx context.Context
+	// objectFormat is the hash function that the repo's object names use.
+	objectFormat formatcfg.ObjectFormat
 }
 
 // execGitCommand is a test seam for injecting command execution failures.
@@ -99,14 +112,42 @@ type refIter interface {
 	ForEach(func(*plumbing.Reference) error) error
 }
 
+// WithContext returns a copy of the repo that runs each of its commands
+// with the given context, so that they are killed once it is done.
+func (repo *GitRepo) WithContext(ctx context.Context) *GitRepo {
+	bound := *repo
+	bound.ctx = ctx
+	return &bound
+}
+
+// command returns a command that runs the given program in the repo, bound
+// to the repo's context.
+func (repo *GitRepo) command(program string, args ...string) *exec.Cmd {
+	ctx := repo.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Dir = repo.Path
+	return cmd
+}
+
+// contextErr returns the error of the repo's context, if it is done, so
+// that commands that were killed report why.
+func (repo *GitRepo) contextErr(err error) error {
+	if err != nil && repo.ctx != nil && repo.ctx.Err() != nil {
+		return repo.ctx.Err()
+	}
+	return err
+}
+
 // Run the given git command with the given I/O reader/writers, returning an error if it fails.
 func (repo *GitRepo) runGitCommandWithIO(stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
-	cmd := exec.Command("git", args...)
-	cmd.Dir = repo.Path
+	cmd := repo.command("git", args...)
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	return execGitCommand(cmd)
+	return repo.contextErr(execGitCommand(cmd))
 }
 
 // Run the given git command and return its stdout, or an error if the command fails.
@@ -121,6 +162,9 @@ func (repo *GitRepo) runGitCommandRaw(args ...string) (string, string, error) {
 func (repo *GitRepo) runGitCommand(args ...string) (string, error) {
 	stdout, stderr, err := repo.runGitCommandRaw(args...)
 	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return stdout, err
+		}
 		if stderr == "" {
 			stderr = "Error running git command: " + strings.Join(args, " ")
 		}
@@ -137,32 +181,66 @@ func (repo *GitRepo) runGitCommandInline(args ...string) error {
 // NewGitRepo determines if the given working directory is inside of a git repository,
 // and returns the corresponding GitRepo instance if it is.
 func NewGitRepo(path string) (*GitRepo, error) {
-	// Try PlainOpen first (handles bare repos and exact paths), then fall
-	// back to DetectDotGit for opening from subdirectories.
-	r, err := gogit.PlainOpen(path)
+	// Try opening the exact path first (handles bare repos), then fall
+	// back to DetectDotGit for opening from subdirectories. The common dir
+	// is used so that linked worktrees (see "git worktree") share the refs
+	// and objects of the repo that they were added to.
+	r, err := gogit.PlainOpenWithOptions(path, &gogit.PlainOpenOptions{
+		EnableDotGitCommonDir: true,
+	})
 	if err == gogit.ErrRepositoryNotExists {
 		r, err = gogit.PlainOpenWithOptions(path, &gogit.PlainOpenOptions{
-			DetectDotGit: true,
+			DetectDotGit:          true,
+			EnableDotGitCommonDir: true,
 		})
 	}
 	if err != nil {
 		return nil, err
 	}
+	format, err := readObjectFormat(r)
+	if err != nil {
+		return nil, err
+	}
 	// go-git's Worktree() returns ErrIsBareRepository for bare repos
 	// and nil otherwise; no other error conditions exist.
 	wt, err := r.Worktree()
 	if err != nil {
-		return &GitRepo{Path: path, gogit: r}, nil
+		return &GitRepo{Path: path, gogit: r, objectFormat: format}, nil
 	}
 	// Path is set to the repo root so GetDataDir and CLI commands operate
 	// from a consistent location. The remaining CLI methods (notes, diff,
 	// fetch, push, merge, rebase) use absolute refs and commit hashes,
 	// so running from the root rather than a subdirectory is correct.
-	return &GitRepo{Path: wt.Filesystem.Root(), gogit: r}, nil
+	return &GitRepo{Path: wt.Filesystem.Root(), gogit: r, objectFormat: format}, nil
 }
 
 var errNotInitialized = fmt.Errorf("repository not initialized")
 
+// ErrUnsupportedObjectFormat is returned when opening a repo that uses an
+// object format other than SHA-1 or SHA-256.
+var ErrUnsupportedObjectFormat = errors.New("unsupported object format")
+
+// readObjectFormat returns the object format of the given repo, or an error
+// if it is neither SHA-1 nor SHA-256.
+//
+// go-git fixes the size of object names when it is built, so the objects of
+// SHA-256 repos are read and written with git itself (see usesGit).
+func readObjectFormat(r *gogit.Repository) (formatcfg.ObjectFormat, error) {
+	cfg, err := r.Config()
+	if err != nil {
+		return "", err
+	}
+	// go-git does not parse this extension, even though it writes it.
+	format := formatcfg.ObjectFormat(cfg.Raw.Section("extensions").Option("objectformat"))
+	if format == "" {
+		format = formatcfg.DefaultObjectFormat
+	}
+	if format == formatcfg.SHA1 || format == formatcfg.SHA256 {
+		return format, nil
+	}
+	return "", fmt.Errorf("%w: the repository uses %s object names, which git-appraise does not support", ErrUnsupportedObjectFormat, format)
+}
+
 // resolveRevision resolves a ref string (which may be HEAD, a full ref, or a
 // commit hash) to a plumbing.Hash using go-git's ResolveRevision.
 func (repo *GitRepo) resolveRevision(ref string) (plumbing.Hash, error) {
@@ -201,6 +279,9 @@ func (repo *GitRepo) HasObject(hash string) (bool, error) {
 	if repo.gogit == nil {
 		return false, errNotInitialized
 	}
+	if repo.usesGit() {
+		return repo.hasObjectWithGit(hash)
+	}
 	h := plumbing.NewHash(hash)
 	_, err := repo.gogit.Storer.EncodedObject(plumbing.AnyObject, h)
 	if err == plumbing.ErrObjectNotFound {
@@ -215,7 +296,32 @@ func (repo *GitRepo) GetPath() string {
 }
 
 // GetDataDir returns the path to the repo data area, e.g. `.git` directory for git.
+//
+// In a linked worktree, this is the common dir that is shared by all of the
+// worktrees of the repo, rather than the worktree's own git dir, since the
+// data kept there (e.g. hooks and the notes lock) is about the shared refs.
 func (repo *GitRepo) GetDataDir() (string, error) {
+	gitDir, err := repo.GetGitDir()
+	if err != nil {
+		return "", err
+	}
+	commonDir, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return gitDir, nil
+	} else if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSpace(string(commonDir))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(gitDir, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// GetGitDir returns the path to the git dir of the repo's working tree, which
+// is that of a linked worktree (e.g. ".git/worktrees/<name>") when the repo
+// was opened from one.
+func (repo *GitRepo) GetGitDir() (string, error) {
 	if repo.gogit == nil {
 		return "", errNotInitialized
 	}
@@ -223,11 +329,29 @@ func (repo *GitRepo) GetDataDir() (string, error) {
 	return repo.gogit.Storer.(*filesystem.Storage).Filesystem().Root(), nil
 }
 
+// hasLinkedWorktrees returns whether the repo has any linked worktrees, or
+// is one, in which case a branch may be checked out in another worktree.
+func (repo *GitRepo) hasLinkedWorktrees() bool {
+	dataDir, err := repo.GetDataDir()
+	if err != nil {
+		return false
+	}
+	entries, _ := os.ReadDir(filepath.Join(dataDir, "worktrees"))
+	return len(entries) > 0
+}
+
 // GetRepoStateHash returns a hash which embodies the entire current state of a repository.
 func (repo *GitRepo) GetRepoStateHash() (string, error) {
 	if repo.gogit == nil {
 		return "", errNotInitialized
 	}
+	if repo.usesGit() {
+		stateSummary, err := repo.runGitCommand("for-each-ref", "--format=%(objectname) %(refname)", "refs/")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", sha1.Sum([]byte(stateSummary))), nil
+	}
 	refs, err := gogitReferences(repo)
 	if err != nil {
 		return "", err
@@ -315,11 +439,390 @@ func (repo *GitRepo) GetSubmitStrategy() (string, error) {
 	return val, nil
 }
 
+// GetConfigValues returns all of the values set for the given git config key.
+//
+// If the key is not set, then the returned slice is empty.
+func (repo *GitRepo) GetConfigValues(key string) ([]string, error) {
+	stdout, stderr, err := repo.runGitCommandRaw("config", "--get-all", key)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && stderr == "" {
+			// The key is not set.
+			return nil, nil
+		}
+		if stderr == "" {
+			stderr = "Error reading the git config key " + key
+		}
+		return nil, fmt.Errorf("%s", stderr)
+	}
+	return strings.Split(stdout, "\n"), nil
+}
+
+// AddConfigValue adds a value for the given key to the repository's local git config.
+func (repo *GitRepo) AddConfigValue(key, value string) error {
+	_, err := repo.runGitCommand("config", "--local", "--add", key, value)
+	return err
+}
+
+// RemoveConfigValue removes every occurrence of the given value for the
+// given key from the repository's local git config.
+//
+// Removing a value that is not set is not an error.
+func (repo *GitRepo) RemoveConfigValue(key, value string) error {
+	_, stderr, err := repo.runGitCommandRaw("config", "--local", "--fixed-value", "--unset-all", key, value)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			// Nothing matched the given key and value.
+			return nil
+		}
+		if stderr == "" {
+			stderr = "Error removing the git config key " + key
+		}
+		return fmt.Errorf("%s", stderr)
+	}
+	return nil
+}
+
+// getLastConfigValue returns the value that git uses for a config key
+// (i.e. the last one set), or the given default if the key is not set.
+func (repo *GitRepo) getLastConfigValue(key, defaultValue string) (string, error) {
+	values, err := repo.GetConfigValues(key)
+	if err != nil || len(values) == 0 {
+		return defaultValue, err
+	}
+	return values[len(values)-1], nil
+}
+
+// runSigningProgram runs an external program (e.g. gpg or ssh-keygen) with
+// the given payload on stdin, and returns its stdout.
+func (repo *GitRepo) runSigningProgram(payload []byte, program string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := repo.command(program, args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := repo.contextErr(execGitCommand(cmd)); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return "", err
+		}
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return stdout.String(), fmt.Errorf("%s failed: %s", program, message)
+	}
+	return stdout.String(), nil
+}
+
+// writeTempFile writes the given contents to a new temporary file, and
+// returns its path along with a function to remove it.
+func writeTempFile(pattern, contents string) (string, func(), error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+	_, err = f.WriteString(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return f.Name(), remove, nil
+}
+
+// SignPayload signs the given payload using the signing key configured for
+// git commits, i.e. "user.signingkey", with the format given by "gpg.format".
+func (repo *GitRepo) SignPayload(payload []byte) (string, error) {
+	format, err := repo.getLastConfigValue("gpg.format", "openpgp")
+	if err != nil {
+		return "", err
+	}
+	key, err := repo.getLastConfigValue("user.signingkey", "")
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case "openpgp":
+		program, err := repo.getLastConfigValue("gpg.program", "gpg")
+		if err != nil {
+			return "", err
+		}
+		args := []string{"--batch", "--detach-sign", "--armor"}
+		if key != "" {
+			args = append(args, "--local-user", key)
+		}
+		return repo.runSigningProgram(payload, program, args...)
+	case "ssh":
+		if key == "" {
+			return "", fmt.Errorf("user.signingkey must be set to sign with SSH keys")
+		}
+		program, err := repo.getLastConfigValue("gpg.ssh.program", "ssh-keygen")
+		if err != nil {
+			return "", err
+		}
+		// Like git, accept either the path to a key or a literal public key,
+		// in which case the private key must be available from an agent.
+		keyFile := key
+		if literal, ok := strings.CutPrefix(key, "key::"); ok || strings.HasPrefix(key, "ssh-") {
+			if !ok {
+				literal = key
+			}
+			path, remove, err := writeTempFile("appraise-signing-key-*.pub", literal+"\n")
+			if err != nil {
+				return "", err
+			}
+			defer remove()
+			keyFile = path
+		} else if keyFile, err = expandHome(key); err != nil {
+			return "", err
+		}
+		return repo.runSigningProgram(payload, program, "-Y", "sign", "-n", signatureNamespace, "-f", keyFile)
+	}
+	return "", fmt.Errorf("unsupported signature format %q", format)
+}
+
+// readAllowedSigners returns the contents of the allowed signers file used to
+// verify SSH signatures.
+//
+// If AllowedSignersRefKey names a ref, then this is read from the file named
+// by "appraise.allowedSignersFile" that is committed in that ref, so that
+// changes to it are reviewed like any other change. Otherwise, or if that
+// file is missing, it is read from the local file named by
+// "gpg.ssh.allowedSignersFile". The file is never read from the checked out
+// commit, whose author would then choose which keys are trusted.
+func (repo *GitRepo) readAllowedSigners() (string, error) {
+	path, err := repo.getLastConfigValue("appraise.allowedSignersFile", DefaultAllowedSignersFile)
+	if err != nil {
+		return "", err
+	}
+	ref, err := repo.getLastConfigValue(AllowedSignersRefKey, "")
+	if err != nil {
+		return "", err
+	}
+	if ref != "" {
+		if contents, err := repo.Show(ref, path); err == nil {
+			return contents + "\n", nil
+		}
+	}
+	localPath, err := repo.getLastConfigValue("gpg.ssh.allowedSignersFile", "")
+	if err != nil {
+		return "", err
+	}
+	if localPath == "" {
+		if ref == "" {
+			return "", fmt.Errorf("neither %s nor gpg.ssh.allowedSignersFile is set", AllowedSignersRefKey)
+		}
+		return "", fmt.Errorf("no allowed signers file found at %q in %q", path, ref)
+	}
+	if localPath, err = expandHome(localPath); err != nil {
+		return "", err
+	}
+	contents, err := os.ReadFile(localPath)
+	return string(contents), err
+}
+
+// checkGPGStatus checks the status output of "gpg --verify" for a good
+// signature by a key that is trusted to belong to the given signer.
+//
+// The key must either be fully trusted in the user's keyring, or have one of
+// the given trusted fingerprints. The user ID that the signature is reported
+// for must also have exactly the signer's email address, since anyone can
+// put any text in the user IDs of their own keys.
+func checkGPGStatus(status, signer string, trustedKeys []string) error {
+	var uid string
+	var fingerprints []string
+	trusted := false
+	for line := range strings.SplitSeq(status, "\n") {
+		keyword, args, _ := strings.Cut(strings.TrimPrefix(line, "[GNUPG:] "), " ")
+		switch keyword {
+		case "GOODSIG":
+			_, uid, _ = strings.Cut(args, " ")
+		case "VALIDSIG":
+			// The fingerprint of the signing key comes first, and that of
+			// its primary key last.
+			if fields := strings.Fields(args); len(fields) > 0 {
+				fingerprints = append(fingerprints, fields[0], fields[len(fields)-1])
+			}
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			trusted = true
+		}
+	}
+	if uid == "" || len(fingerprints) == 0 {
+		return fmt.Errorf("the signature is not a valid signature")
+	}
+	if address, err := mail.ParseAddress(uid); err != nil || address.Address != signer {
+		return fmt.Errorf("the signature was not made by a key for %q", signer)
+	}
+	for _, trustedKey := range trustedKeys {
+		trustedKey = strings.ReplaceAll(trustedKey, " ", "")
+		for _, fingerprint := range fingerprints {
+			if strings.EqualFold(fingerprint, trustedKey) {
+				trusted = true
+			}
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("the key that made the signature is not trusted; either fully trust it in your keyring, or add its fingerprint to %s", TrustedOpenPGPKeyKey)
+	}
+	return nil
+}
+
+// VerifyPayloadSignature verifies that the given signature of the payload was
+// made by the given signer.
+//
+// SSH signatures are verified against the repo's allowed signers file, while
+// OpenPGP signatures must be made by a trusted key in the user's keyring that
+// has a user ID for the signer's email address.
+func (repo *GitRepo) VerifyPayloadSignature(payload []byte, signature, signer string) error {
+	sigFile, remove, err := writeTempFile("appraise-signature-*.sig", signature)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	switch {
+	case strings.HasPrefix(signature, sshSignaturePrefix):
+		allowedSigners, err := repo.readAllowedSigners()
+		if err != nil {
+			return err
+		}
+		allowedSignersFile, removeAllowedSigners, err := writeTempFile("appraise-allowed-signers-*", allowedSigners)
+		if err != nil {
+			return err
+		}
+		defer removeAllowedSigners()
+		program, err := repo.getLastConfigValue("gpg.ssh.program", "ssh-keygen")
+		if err != nil {
+			return err
+		}
+		_, err = repo.runSigningProgram(payload, program, "-Y", "verify",
+			"-n", signatureNamespace, "-f", allowedSignersFile, "-I", signer, "-s", sigFile)
+		return err
+	case strings.HasPrefix(signature, pgpSignaturePrefix):
+		program, err := repo.getLastConfigValue("gpg.program", "gpg")
+		if err != nil {
+			return err
+		}
+		trustedKeys, err := repo.GetConfigValues(TrustedOpenPGPKeyKey)
+		if err != nil {
+			return err
+		}
+		status, err := repo.runSigningProgram(payload, program, "--batch", "--status-fd=1", "--verify", sigFile, "-")
+		if err != nil {
+			return err
+		}
+		return checkGPGStatus(status, signer, trustedKeys)
+	}
+	return fmt.Errorf("unrecognized signature format")
+}
+
+// isAgeRecipient returns whether the given recipient is an age public key,
+// rather than the name of an OpenPGP key.
+func isAgeRecipient(recipient string) bool {
+	return strings.HasPrefix(recipient, "age1") || strings.HasPrefix(recipient, "ssh-")
+}
+
+// expandHome expands a leading "~/" in the given path to the user's home
+// directory, as git does for paths in its config.
+func expandHome(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// EncryptPayload encrypts the given payload to the recipients configured by
+// "appraise.encryptTo".
+//
+// The recipients must either all be age recipients, in which case the
+// payload is encrypted using age, or all be OpenPGP keys, in which case it
+// is encrypted using gpg.
+func (repo *GitRepo) EncryptPayload(payload []byte) (string, error) {
+	recipients, err := repo.GetConfigValues(EncryptToKey)
+	if err != nil {
+		return "", err
+	}
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("%s must be set to encrypt reviews", EncryptToKey)
+	}
+	age := isAgeRecipient(recipients[0])
+	var args []string
+	for _, recipient := range recipients {
+		if isAgeRecipient(recipient) != age {
+			return "", fmt.Errorf("%s must not mix age and OpenPGP recipients", EncryptToKey)
+		}
+		args = append(args, "--recipient", recipient)
+	}
+	if age {
+		program, err := repo.getLastConfigValue("appraise.ageProgram", "age")
+		if err != nil {
+			return "", err
+		}
+		return repo.runSigningProgram(payload, program, append([]string{"--encrypt", "--armor"}, args...)...)
+	}
+	program, err := repo.getLastConfigValue("gpg.program", "gpg")
+	if err != nil {
+		return "", err
+	}
+	// The recipients were chosen explicitly, so they are trusted even if
+	// their keys have not been certified.
+	return repo.runSigningProgram(payload, program, append([]string{"--batch", "--encrypt", "--armor", "--trust-model", "always"}, args...)...)
+}
+
+// DecryptPayload decrypts the given ciphertext, using gpg for OpenPGP
+// messages and age, with the identities configured by "appraise.ageIdentity",
+// for age messages.
+func (repo *GitRepo) DecryptPayload(ciphertext string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ciphertext, ageMessagePrefix):
+		identities, err := repo.GetConfigValues(AgeIdentityKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(identities) == 0 {
+			return nil, fmt.Errorf("%s must be set to decrypt age messages", AgeIdentityKey)
+		}
+		args := []string{"--decrypt"}
+		for _, identity := range identities {
+			path, err := expandHome(identity)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--identity", path)
+		}
+		program, err := repo.getLastConfigValue("appraise.ageProgram", "age")
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := repo.runSigningProgram([]byte(ciphertext), program, args...)
+		return []byte(plaintext), err
+	case strings.HasPrefix(ciphertext, pgpMessagePrefix):
+		program, err := repo.getLastConfigValue("gpg.program", "gpg")
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := repo.runSigningProgram([]byte(ciphertext), program, "--batch", "--quiet", "--decrypt")
+		return []byte(plaintext), err
+	}
+	return nil, fmt.Errorf("unrecognized encryption format")
+}
+
 // HasUncommittedChanges returns true if there are local, uncommitted changes.
 func (repo *GitRepo) HasUncommittedChanges() (bool, error) {
 	if repo.gogit == nil {
 		return false, errNotInitialized
 	}
+	if repo.usesGit() {
+		status, err := repo.runGitCommand("status", "--porcelain")
+		return status != "", err
+	}
 	status, err := gogitStatus(repo)
 	if err != nil {
 		return false, err
@@ -332,6 +835,16 @@ func (repo *GitRepo) VerifyCommit(hash string) error {
 	if repo.gogit == nil {
 		return errNotInitialized
 	}
+	if repo.usesGit() {
+		_, kind, _, err := repo.readObjectWithGit(hash)
+		if err != nil {
+			return fmt.Errorf("Hash %q not found: %v", hash, err)
+		}
+		if kind != "commit" {
+			return fmt.Errorf("Hash %q points to a non-commit object of type %q", hash, kind)
+		}
+		return nil
+	}
 	h := plumbing.NewHash(hash)
 	obj, err := repo.gogit.Storer.EncodedObject(plumbing.AnyObject, h)
 	if err != nil {
@@ -372,6 +885,9 @@ func (repo *GitRepo) GetHeadRef() (string, error) {
 
 // GetCommitHash returns the hash of the commit pointed to by the given ref.
 func (repo *GitRepo) GetCommitHash(ref string) (string, error) {
+	if repo.usesGit() {
+		return repo.runGitCommand("rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	}
 	h, err := repo.resolveRevision(ref)
 	if err != nil {
 		return "", err
@@ -418,9 +934,33 @@ func (repo *GitRepo) ResolveRefCommit(ref string) (string, error) {
 	return "", fmt.Errorf("Unknown git ref %q", ref)
 }
 
+// readCommit reads the commit pointed to by the given ref, in either of the
+// object formats.
+func (repo *GitRepo) readCommit(ref string) (*gitCommit, error) {
+	if repo.usesGit() {
+		return repo.readCommitWithGit(ref)
+	}
+	c, err := repo.resolveToCommit(ref)
+	if err != nil {
+		return nil, err
+	}
+	var parents []string
+	for _, p := range c.ParentHashes {
+		parents = append(parents, p.String())
+	}
+	return &gitCommit{
+		Hash:      c.Hash.String(),
+		Tree:      c.TreeHash.String(),
+		Parents:   parents,
+		Author:    c.Author,
+		Committer: c.Committer,
+		Message:   c.Message,
+	}, nil
+}
+
 // GetCommitMessage returns the message stored in the commit pointed to by the given ref.
 func (repo *GitRepo) GetCommitMessage(ref string) (string, error) {
-	c, err := repo.resolveToCommit(ref)
+	c, err := repo.readCommit(ref)
 	if err != nil {
 		return "", err
 	}
@@ -429,7 +969,7 @@ func (repo *GitRepo) GetCommitMessage(ref string) (string, error) {
 
 // GetCommitTime returns the commit time of the commit pointed to by the given ref.
 func (repo *GitRepo) GetCommitTime(ref string) (string, error) {
-	c, err := repo.resolveToCommit(ref)
+	c, err := repo.readCommit(ref)
 	if err != nil {
 		return "", err
 	}
@@ -440,26 +980,23 @@ func (repo *GitRepo) GetCommitTime(ref string) (string, error) {
 // For merge commits, this is the second parent (the merged-in branch head),
 // which is the intended behavior for the review diff base calculation.
 func (repo *GitRepo) GetLastParent(ref string) (string, error) {
-	c, err := repo.resolveToCommit(ref)
+	c, err := repo.readCommit(ref)
 	if err != nil {
 		return "", err
 	}
-	if len(c.ParentHashes) == 0 {
+	if len(c.Parents) == 0 {
 		return "", nil
 	}
-	return c.ParentHashes[len(c.ParentHashes)-1].String(), nil
+	return c.Parents[len(c.Parents)-1], nil
 }
 
 // GetCommitDetails returns the details of a commit's metadata.
 func (repo GitRepo) GetCommitDetails(ref string) (*CommitDetails, error) {
-	c, err := repo.resolveToCommit(ref)
+	c, err := repo.readCommit(ref)
 	if err != nil {
 		return nil, err
 	}
-	var parents []string
-	for _, p := range c.ParentHashes {
-		parents = append(parents, p.String())
-	}
+	parents := c.Parents
 	if parents == nil {
 		parents = []string{""}
 	}
@@ -468,7 +1005,7 @@ func (repo GitRepo) GetCommitDetails(ref string) (*CommitDetails, error) {
 		AuthorEmail:    c.Author.Email,
 		Committer:      c.Committer.Name,
 		CommitterEmail: c.Committer.Email,
-		Tree:           c.TreeHash.String(),
+		Tree:           c.Tree,
 		Time:           strconv.FormatInt(c.Author.When.Unix(), 10),
 		Parents:        parents,
 		Summary:        strings.SplitN(c.Message, "\n", 2)[0],
@@ -477,6 +1014,13 @@ func (repo GitRepo) GetCommitDetails(ref string) (*CommitDetails, error) {
 
 // MergeBase determines if the first commit that is an ancestor of the two arguments.
 func (repo *GitRepo) MergeBase(a, b string) (string, error) {
+	if repo.usesGit() {
+		base, err := repo.runGitCommand("merge-base", "--end-of-options", a, b)
+		if err != nil || base == "" {
+			return "", fmt.Errorf("no merge base found")
+		}
+		return base, nil
+	}
 	cA, err := repo.resolveToCommit(a)
 	if err != nil {
 		return "", err
@@ -495,6 +1039,16 @@ func (repo *GitRepo) MergeBase(a, b string) (string, error) {
 
 // IsAncestor determines if the first argument points to a commit that is an ancestor of the second.
 func (repo *GitRepo) IsAncestor(ancestor, descendant string) (bool, error) {
+	if repo.usesGit() {
+		_, _, err := repo.runGitCommandRaw("merge-base", "--is-ancestor", "--end-of-options", ancestor, descendant)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
+		}
+		return true, nil
+	}
 	cAnc, err := repo.resolveToCommit(ancestor)
 	if err != nil {
 		return false, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
@@ -539,7 +1093,7 @@ func (repo *GitRepo) ParsedDiff(left, right string, diffArgs ...string) ([]FileD
 		return nil, err
 	}
 
-	return parsedDiff(diff)
+	return ParseDiff(diff)
 }
 
 func (repo *GitRepo) ParsedDiff1(commit string, diffArgs ...string) ([]FileDiff, error) {
@@ -551,10 +1105,11 @@ func (repo *GitRepo) ParsedDiff1(commit string, diffArgs ...string) ([]FileDiff,
 		return nil, err
 	}
 
-	return parsedDiff(diff)
+	return ParseDiff(diff)
 }
 
-func parsedDiff(diff string) ([]FileDiff, error) {
+// ParseDiff parses the output of "git diff" into a list of file diffs.
+func ParseDiff(diff string) ([]FileDiff, error) {
 	files, _, err := gitdiff.Parse(strings.NewReader(diff))
 	if err != nil {
 		return nil, err
@@ -610,6 +1165,10 @@ func parsedDiff(diff string) ([]FileDiff, error) {
 
 // Show returns the contents of the given file at the given commit.
 func (repo *GitRepo) Show(commit, path string) (string, error) {
+	if repo.usesGit() {
+		contents, err := repo.readBlobWithGit(commit + ":" + path)
+		return strings.TrimSpace(contents), err
+	}
 	c, err := repo.resolveToCommit(commit)
 	if err != nil {
 		return "", err
@@ -627,6 +1186,11 @@ func (repo *GitRepo) SwitchToRef(ref string) error {
 	if repo.gogit == nil {
 		return errNotInitialized
 	}
+	// git refuses to check out a branch that is checked out in another
+	// worktree, whereas go-git does not know about other worktrees.
+	if repo.usesGit() || repo.hasLinkedWorktrees() {
+		return repo.switchToRefWithGit(ref)
+	}
 	wt, err := repo.gogit.Worktree()
 	if err != nil {
 		return err
@@ -647,6 +1211,26 @@ func (repo *GitRepo) SwitchToRef(ref string) error {
 	})
 }
 
+// switchToRefWithGit changes the currently-checked-out ref using git itself.
+func (repo *GitRepo) switchToRefWithGit(ref string) error {
+	if branch, ok := strings.CutPrefix(ref, branchRefPrefix); ok {
+		_, err := repo.runGitCommand("checkout", "--quiet", branch, "--")
+		return err
+	}
+	h, err := repo.GetCommitHash(ref)
+	if err != nil {
+		return err
+	}
+	_, err = repo.runGitCommand("checkout", "--quiet", "--detach", h, "--")
+	return err
+}
+
+// The summaries of the commits written to archive refs.
+const (
+	archiveSummaryPrefix = "Archive "
+	mergeArchivesSummary = "Merge local and remote archives"
+)
+
 // mergeArchives merges two archive refs.
 func (repo *GitRepo) mergeArchives(archive, remoteArchive string) error {
 	hasRemote, err := repo.HasRef(remoteArchive)
@@ -666,6 +1250,9 @@ func (repo *GitRepo) mergeArchives(archive, remoteArchive string) error {
 		// The local archive does not exist, so we merely need to set it
 		return repo.SetRef(archive, remoteHash, "")
 	}
+	if err := repo.adoptCompaction(archive, remoteArchive, true); err != nil {
+		return err
+	}
 	archiveHash, err := repo.GetCommitHash(archive)
 	if err != nil {
 		return err
@@ -681,12 +1268,13 @@ func (repo *GitRepo) mergeArchives(archive, remoteArchive string) error {
 	}
 
 	// Create a merge commit of the two archives.
-	// resolveToCommit will succeed because remoteArchive was already
-	// verified as a valid commit ref above.
-	cRemote, _ := repo.resolveToCommit(remoteArchive)
+	cRemote, err := repo.GetCommitDetails(remoteHash)
+	if err != nil {
+		return err
+	}
 	newDetails := &CommitDetails{
-		Summary: "Merge local and remote archives",
-		Tree:    cRemote.TreeHash.String(),
+		Summary: mergeArchivesSummary,
+		Tree:    cRemote.Tree,
 		Parents: []string{remoteHash, archiveHash},
 	}
 	newArchiveHash, err := repo.CreateCommit(newDetails)
@@ -706,11 +1294,16 @@ func (repo *GitRepo) mergeArchives(archive, remoteArchive string) error {
 // If the ref pointed to by the 'archive' argument does not exist
 // yet, then it will be created.
 func (repo *GitRepo) ArchiveRef(ref, archive string) error {
-	cRef, err := repo.resolveToCommit(ref)
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cRef, err := repo.readCommit(ref)
 	if err != nil {
 		return err
 	}
-	refHash := cRef.Hash.String()
+	refHash := cRef.Hash
 
 	var parents []string
 	archiveHash, err := repo.GetCommitHash(archive)
@@ -728,8 +1321,8 @@ func (repo *GitRepo) ArchiveRef(ref, archive string) error {
 	parents = append(parents, refHash)
 
 	newDetails := &CommitDetails{
-		Summary: fmt.Sprintf("Archive %s", refHash),
-		Tree:    cRef.TreeHash.String(),
+		Summary: archiveSummaryPrefix + refHash,
+		Tree:    cRef.Tree,
 		Parents: parents,
 	}
 	newArchiveHash, err := repo.CreateCommit(newDetails)
@@ -778,6 +1371,13 @@ func (repo *GitRepo) ListCommits(ref string) []string {
 	if repo.gogit == nil {
 		return nil
 	}
+	if repo.usesGit() {
+		out, err := repo.runGitCommand("rev-list", "--date-order", "--reverse", "--end-of-options", ref)
+		if err != nil || out == "" {
+			return nil
+		}
+		return strings.Split(out, "\n")
+	}
 	h, err := repo.resolveRevision(ref)
 	if err != nil {
 		return nil
@@ -811,6 +1411,13 @@ func (repo *GitRepo) ListCommitsBetween(from, to string) ([]string, error) {
 	if repo.gogit == nil {
 		return nil, errNotInitialized
 	}
+	if repo.usesGit() {
+		out, err := repo.runGitCommand("rev-list", "--reverse", "--end-of-options", from+".."+to)
+		if err != nil || out == "" {
+			return nil, err
+		}
+		return strings.Split(out, "\n"), nil
+	}
 	fromHash, err := repo.resolveRevision(from)
 	if err != nil {
 		return nil, err
@@ -849,6 +1456,13 @@ func (repo *GitRepo) StoreBlob(contents string) (string, error) {
 	if repo.gogit == nil {
 		return "", fmt.Errorf("failure storing a git blob: repository not initialized")
 	}
+	if repo.usesGit() {
+		out, err := repo.runGitCommandWithInput(contents, "hash-object", "-w", "--stdin")
+		if err != nil {
+			return "", fmt.Errorf("failure storing a git blob: %v", err)
+		}
+		return strings.TrimSpace(out), nil
+	}
 	obj := repo.gogit.Storer.NewEncodedObject()
 	obj.SetType(plumbing.BlobObject)
 	// Writer, WriteString, and Close operate on an in-memory buffer
@@ -868,6 +1482,9 @@ func (repo *GitRepo) StoreTree(contents map[string]TreeChild) (string, error) {
 	if repo.gogit == nil {
 		return "", fmt.Errorf("failure storing a git tree: repository not initialized")
 	}
+	if repo.usesGit() {
+		return repo.storeTreeWithGit(contents)
+	}
 	var entries []object.TreeEntry
 	for path, obj := range contents {
 		objHash, err := obj.Store(repo)
@@ -900,6 +1517,13 @@ func (repo *GitRepo) readBlob(objHash string) (*Blob, error) {
 	if repo.gogit == nil {
 		return nil, fmt.Errorf("failure reading the file contents of %q: repository not initialized", objHash)
 	}
+	if repo.usesGit() {
+		contents, err := repo.readBlobWithGit(objHash)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file contents of %q: %v", objHash, err)
+		}
+		return &Blob{contents: contents, savedHashes: map[Repo]string{repo: objHash}}, nil
+	}
 	h := plumbing.NewHash(objHash)
 	obj, err := repo.gogit.BlobObject(h)
 	if err != nil {
@@ -920,6 +1544,9 @@ func (repo *GitRepo) readTreeWithHash(ref, hash string) (*Tree, error) {
 	if repo.gogit == nil {
 		return nil, fmt.Errorf("failure listing the file contents of %q: repository not initialized", ref)
 	}
+	if repo.usesGit() {
+		return repo.readTreeWithHashWithGit(ref, hash)
+	}
 	h := plumbing.NewHash(ref)
 	t, err := repo.gogit.TreeObject(h)
 	if err != nil {
@@ -993,6 +1620,20 @@ func (repo *GitRepo) CreateCommit(details *CommitDetails) (string, error) {
 		}
 	}
 
+	if repo.usesGit() {
+		h, err := repo.writeCommitWithGit(&gitCommit{
+			Tree:      details.Tree,
+			Parents:   slices.DeleteFunc(slices.Clone(details.Parents), func(p string) bool { return p == "" }),
+			Author:    author,
+			Committer: committer,
+			Message:   details.Summary,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failure creating commit: %v", err)
+		}
+		return h, nil
+	}
+
 	var parentHashes []plumbing.Hash
 	for _, p := range details.Parents {
 		if p == "" {
@@ -1053,6 +1694,9 @@ func (repo *GitRepo) SetRef(ref, newCommitHash, previousCommitHash string) error
 	if repo.gogit == nil {
 		return errNotInitialized
 	}
+	if repo.usesGit() {
+		return repo.setRefWithGit(ref, newCommitHash, previousCommitHash)
+	}
 	newRef := plumbing.NewHashReference(plumbing.ReferenceName(ref), plumbing.NewHash(newCommitHash))
 	if previousCommitHash != "" {
 		oldRef := plumbing.NewHashReference(plumbing.ReferenceName(ref), plumbing.NewHash(previousCommitHash))
@@ -1146,6 +1790,9 @@ func lookupNoteEntry(tree *object.Tree, remaining string) (*object.TreeEntry, er
 
 // GetNotes reads the notes from the given ref for a given revision.
 func (repo *GitRepo) GetNotes(notesRef, revision string) []Note {
+	if repo.usesGit() {
+		return repo.getNotesWithGit(notesRef, revision)
+	}
 	tree, err := repo.readNotesTree(notesRef)
 	if err != nil || tree == nil {
 		return nil
@@ -1165,29 +1812,115 @@ func (repo *GitRepo) GetNotes(notesRef, revision string) []Note {
 //
 // The returned value is a mapping from commit hash to the list of notes for that commit.
 func (repo *GitRepo) GetAllNotes(notesRef string) (map[string][]Note, error) {
-	tree, err := repo.readNotesTree(notesRef)
-	if err != nil {
+	return repo.getAllNotes(notesRef, repo.isCommit)
+}
+
+// isCommit returns whether the repo contains a commit with the given hash.
+func (repo *GitRepo) isCommit(hash string) bool {
+	if repo.usesGit() {
+		kind, err := repo.runGitCommand("cat-file", "-t", "--end-of-options", hash)
+		return err == nil && kind == "commit"
+	}
+	// Requesting CommitObject directly lets the storer check the type from
+	// the object header without fully decompressing the object.
+	_, err := repo.gogit.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash(hash))
+	return err == nil
+}
+
+// getAllNotes reads the contents of the notes under the given ref for every
+// object that the given function reports to be a commit.
+func (repo *GitRepo) getAllNotes(notesRef string, isCommit func(string) bool) (map[string][]Note, error) {
+	notes, notesErr := repo.Notes(notesRef, "")
+	var commitNotesMap map[string][]Note
+	for revision, revisionNotes := range notes {
+		if !isCommit(revision) {
+			continue
+		}
+		if commitNotesMap == nil {
+			commitNotesMap = make(map[string][]Note)
+		}
+		commitNotesMap[revision] = revisionNotes
+	}
+	if err := notesErr(); err != nil {
 		return nil, err
 	}
-	if tree == nil {
-		return nil, nil
+	return commitNotesMap, nil
+}
+
+// Notes returns an iterator over the notes under the given ref, or in the
+// given notes commit, which yields the hash of every annotated object along
+// with its notes.
+//
+// Only the objects whose hashes start with the given prefix are yielded, and
+// fan-out directories that cannot hold them are not read. If a note or a
+// fan-out directory cannot be read, then the iteration stops, and the
+// returned function reports why.
+func (repo *GitRepo) Notes(notesRef, prefix string) (iter.Seq2[string, []Note], func() error) {
+	if repo.usesGit() {
+		return repo.notesWithGit(notesRef, prefix)
+	}
+	tree, err := repo.readNotesTreeAt(notesRef)
+	notes := func(yield func(string, []Note) bool) {
+		if err != nil || tree == nil {
+			return
+		}
+		_, err = walkNotesTree(tree, "", prefix, func(revision string, blob plumbing.Hash) (bool, error) {
+			contents, err := repo.readBlobContents(blob)
+			if err != nil {
+				return false, fmt.Errorf("failed to read the notes of %q: %v", revision, err)
+			}
+			return yield(revision, splitNotesBlob(contents)), nil
+		})
 	}
-	entries := collectNotesEntries(tree, "")
-	commitNotesMap := make(map[string][]Note)
-	for _, e := range entries {
-		// Only include notes for commit objects. Requesting CommitObject
-		// directly lets the storer check the type from the object header
-		// without fully decompressing the object.
-		if _, err := repo.gogit.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash(e.ObjectHash)); err != nil {
+	return notes, func() error { return err }
+}
+
+// readNotesTreeAt is like readNotesTree, but also accepts the hash of a
+// notes commit.
+func (repo *GitRepo) readNotesTreeAt(notesRef string) (*object.Tree, error) {
+	if repo.gogit == nil {
+		return nil, errNotInitialized
+	}
+	if hasRef, _ := repo.HasRef(notesRef); hasRef || !plumbing.IsHash(notesRef) {
+		return repo.readNotesTree(notesRef)
+	}
+	c, err := repo.resolveToCommit(notesRef)
+	if err != nil {
+		return nil, err
+	}
+	return c.Tree()
+}
+
+// walkNotesTree calls the given function with the annotated object hash and
+// blob hash of every note in the given notes tree whose object hash starts
+// with the given prefix, until the function returns false or an error.
+//
+// Fan-out directories (e.g. "ab/cdef...") are only read if they could hold
+// such notes. It returns false if the walk was stopped early.
+func walkNotesTree(tree *object.Tree, path, prefix string, fn func(revision string, blob plumbing.Hash) (bool, error)) (bool, error) {
+	for _, entry := range tree.Entries {
+		name := path + entry.Name
+		if entry.Mode != filemode.Dir {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if ok, err := fn(name, entry.Hash); !ok || err != nil {
+				return false, err
+			}
 			continue
 		}
-		contents, err := repo.readBlobContents(e.BlobHash)
-		if err != nil {
+		if !strings.HasPrefix(name, prefix) && !strings.HasPrefix(prefix, name) {
 			continue
 		}
-		commitNotesMap[e.ObjectHash] = splitNotesBlob(contents)
+		subtree, err := tree.Tree(entry.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to read the notes under %q: %v", name, err)
+		}
+		if ok, err := walkNotesTree(subtree, name, prefix, fn); !ok || err != nil {
+			return false, err
+		}
 	}
-	return commitNotesMap, nil
+	return true, nil
 }
 
 // readNotesCommit resolves a notes ref to its commit object.
@@ -1226,92 +1959,78 @@ func detectFanout(tree *object.Tree) bool {
 	return false
 }
 
-// buildNotesTree creates a new notes tree with the given entry added or
-// replaced. It preserves the existing tree's fan-out layout.
-func (repo *GitRepo) buildNotesTree(existing *object.Tree, revision string, blobHash plumbing.Hash) (plumbing.Hash, error) {
+// buildNotesTree returns the hash of a notes tree that is the given tree,
+// which may be nil, with the notes of each of the given revisions replaced
+// by the given blobs. If the given tree uses fan-out directories (e.g.
+// "ab/cdef..."), then so does the new tree.
+func (repo *GitRepo) buildNotesTree(existing *object.Tree, blobs map[string]plumbing.Hash) (plumbing.Hash, error) {
 	var entries []object.TreeEntry
-	entryName := revision
-	fanout := existing != nil && detectFanout(existing)
-	if fanout {
-		entryName = revision[:2] + "/" + revision[2:]
-	}
-
-	if existing != nil {
-		for _, e := range existing.Entries {
-			if e.Mode == filemode.Dir && fanout {
-				// Rebuild subtree if it might contain the target entry.
-				if e.Name == revision[:2] {
-					subtree, _ := existing.Tree(e.Name)
-					newSubEntries := make([]object.TreeEntry, 0, len(subtree.Entries))
-					for _, se := range subtree.Entries {
-						if se.Name != revision[2:] {
-							newSubEntries = append(newSubEntries, se)
-						}
-					}
-					newSubEntries = append(newSubEntries, object.TreeEntry{
-						Name: revision[2:],
-						Mode: filemode.Regular,
-						Hash: blobHash,
-					})
-					sort.Sort(object.TreeEntrySorter(newSubEntries))
-					subTree := &object.Tree{Entries: newSubEntries}
-					obj := repo.gogit.Storer.NewEncodedObject()
-					subTree.Encode(obj)
-					h, err := storeObject(repo, obj)
-					if err != nil {
-						return plumbing.ZeroHash, err
-					}
-					entries = append(entries, object.TreeEntry{
-						Name: e.Name,
-						Mode: filemode.Dir,
-						Hash: h,
-					})
-					continue
+	if existing == nil || !detectFanout(existing) {
+		if existing != nil {
+			for _, e := range existing.Entries {
+				if _, ok := blobs[e.Name]; !ok {
+					entries = append(entries, e)
 				}
-				entries = append(entries, e)
-			} else if e.Name != revision {
-				entries = append(entries, e)
 			}
 		}
+		return repo.storeNotesTree(appendNoteEntries(entries, blobs))
 	}
 
-	if fanout {
-		// Check if we already added the subtree above.
-		found := false
-		for _, e := range entries {
-			if e.Name == revision[:2] {
-				found = true
-				break
+	// Group the blobs by the fan-out directory that holds them.
+	subtrees := make(map[string]map[string]plumbing.Hash)
+	for revision, blob := range blobs {
+		if subtrees[revision[:2]] == nil {
+			subtrees[revision[:2]] = make(map[string]plumbing.Hash)
+		}
+		subtrees[revision[:2]][revision[2:]] = blob
+	}
+	for _, e := range existing.Entries {
+		updates, ok := subtrees[e.Name]
+		if e.Mode != filemode.Dir || !ok {
+			if _, ok := blobs[e.Name]; !ok {
+				entries = append(entries, e)
 			}
+			continue
 		}
-		if !found {
-			// Create new subtree for this fan-out prefix.
-			subEntries := []object.TreeEntry{{
-				Name: revision[2:],
-				Mode: filemode.Regular,
-				Hash: blobHash,
-			}}
-			subTree := &object.Tree{Entries: subEntries}
-			obj := repo.gogit.Storer.NewEncodedObject()
-			subTree.Encode(obj)
-			h, err := storeObject(repo, obj)
-			if err != nil {
-				return plumbing.ZeroHash, err
+		subtree, err := existing.Tree(e.Name)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		var subEntries []object.TreeEntry
+		for _, se := range subtree.Entries {
+			if _, ok := updates[se.Name]; !ok {
+				subEntries = append(subEntries, se)
 			}
-			entries = append(entries, object.TreeEntry{
-				Name: revision[:2],
-				Mode: filemode.Dir,
-				Hash: h,
-			})
 		}
-	} else {
-		entries = append(entries, object.TreeEntry{
-			Name: entryName,
-			Mode: filemode.Regular,
-			Hash: blobHash,
-		})
+		h, err := repo.storeNotesTree(appendNoteEntries(subEntries, updates))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: e.Name, Mode: filemode.Dir, Hash: h})
+		delete(subtrees, e.Name)
 	}
+	for dir, updates := range subtrees {
+		h, err := repo.storeNotesTree(appendNoteEntries(nil, updates))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: h})
+	}
+	return repo.storeNotesTree(entries)
+}
 
+// appendNoteEntries appends a tree entry for each of the given notes blobs,
+// keyed by their names within the tree.
+func appendNoteEntries(entries []object.TreeEntry, blobs map[string]plumbing.Hash) []object.TreeEntry {
+	for name, blob := range blobs {
+		entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: blob})
+	}
+	return entries
+}
+
+// storeNotesTree stores a tree with the given entries, in the order that git
+// requires, and returns its hash.
+func (repo *GitRepo) storeNotesTree(entries []object.TreeEntry) (plumbing.Hash, error) {
 	sort.Sort(object.TreeEntrySorter(entries))
 	t := &object.Tree{Entries: entries}
 	obj := repo.gogit.Storer.NewEncodedObject()
@@ -1319,12 +2038,211 @@ func (repo *GitRepo) buildNotesTree(existing *object.Tree, revision string, blob
 	return storeObject(repo, obj)
 }
 
+// listNotesBlobs returns the blob hash of the notes for every object
+// annotated by the given version of a notes ref.
+func (repo *GitRepo) listNotesBlobs(notesRef string) (map[string]string, error) {
+	blobs := make(map[string]string)
+	if notesRef == "" {
+		return blobs, nil
+	}
+	out, err := repo.runGitCommand("ls-tree", "-r", notesRef)
+	if err != nil {
+		return nil, err
+	}
+	for line := range strings.SplitSeq(out, "\n") {
+		// Each line has the form "<mode> SP <type> SP <hash> TAB <path>".
+		info, path, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		// Notes trees may use fan-out directories, e.g. "ab/cdef...".
+		blobs[strings.ReplaceAll(path, "/", "")] = fields[2]
+	}
+	return blobs, nil
+}
+
+// diffNotesBlobs returns the blob hashes of the notes in two versions of a
+// notes ref, for every annotated object whose notes may differ between them.
+//
+// When both versions exist, only the entries that changed are listed, so that
+// comparing two large notes trees does not require reading all of either.
+func (repo *GitRepo) diffNotesBlobs(from, to string) (map[string]string, map[string]string, error) {
+	if from == "" || to == "" {
+		fromBlobs, err := repo.listNotesBlobs(from)
+		if err != nil {
+			return nil, nil, err
+		}
+		toBlobs, err := repo.listNotesBlobs(to)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fromBlobs, toBlobs, nil
+	}
+	out, err := repo.runGitCommand("diff-tree", "-r", "--no-renames", from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	fromBlobs, toBlobs := make(map[string]string), make(map[string]string)
+	for line := range strings.SplitSeq(out, "\n") {
+		// Each line has the form
+		// ":<old mode> SP <new mode> SP <old hash> SP <new hash> SP <status> TAB <path>".
+		info, path, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(strings.TrimPrefix(info, ":"))
+		if !ok || len(fields) != 5 {
+			continue
+		}
+		// Notes trees may use fan-out directories, e.g. "ab/cdef...", and
+		// a note that moves between them is reported as a removal and an
+		// addition of the same revision.
+		revision := strings.ReplaceAll(path, "/", "")
+		if isBlobMode(fields[0]) {
+			fromBlobs[revision] = fields[2]
+		}
+		if isBlobMode(fields[1]) {
+			toBlobs[revision] = fields[3]
+		}
+	}
+	return fromBlobs, toBlobs, nil
+}
+
+// isBlobMode reports whether the given git file mode, as printed by
+// diff-tree, is that of a blob rather than of a missing entry or submodule.
+func isBlobMode(mode string) bool {
+	return mode != "000000" && mode != "160000"
+}
+
+// readNotesBlobs reads the notes stored in each of the given blobs, using a
+// single git process for all of them.
+func (repo *GitRepo) readNotesBlobs(hashes []string) (map[string][]Note, error) {
+	notes := make(map[string][]Note)
+	if len(hashes) == 0 {
+		return notes, nil
+	}
+	var stdout, stderr bytes.Buffer
+	stdin := strings.NewReader(strings.Join(hashes, "\n") + "\n")
+	if err := repo.runGitCommandWithIO(stdin, &stdout, &stderr, "cat-file", "--batch"); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, err
+	}
+	out := stdout.Bytes()
+	for _, hash := range hashes {
+		// Each object is printed as "<hash> SP <type> SP <size> LF <contents> LF".
+		header, rest, ok := bytes.Cut(out, []byte("\n"))
+		fields := strings.Fields(string(header))
+		if !ok || len(fields) != 3 || fields[1] != "blob" {
+			return nil, fmt.Errorf("failed to read the notes blob %q: %q", hash, header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size+1 > len(rest) {
+			return nil, fmt.Errorf("failed to read the notes blob %q: %q", hash, header)
+		}
+		notes[hash] = splitNotesBlob(string(rest[:size]))
+		out = rest[size+1:]
+	}
+	return notes, nil
+}
+
+// DiffNotes compares two versions of a notes ref, and returns the notes of
+// every annotated object whose notes differ between them.
+func (repo *GitRepo) DiffNotes(from, to string) ([]NotesDiff, error) {
+	fromBlobs, toBlobs, err := repo.diffNotesBlobs(from, to)
+	if err != nil {
+		return nil, err
+	}
+	revisions := slices.Collect(maps.Keys(fromBlobs))
+	for revision := range toBlobs {
+		if _, ok := fromBlobs[revision]; !ok {
+			revisions = append(revisions, revision)
+		}
+	}
+	slices.Sort(revisions)
+	var changed []string
+	blobs := make(map[string]bool)
+	for _, revision := range revisions {
+		if fromBlobs[revision] == toBlobs[revision] {
+			continue
+		}
+		changed = append(changed, revision)
+		for _, blob := range []string{fromBlobs[revision], toBlobs[revision]} {
+			if blob != "" {
+				blobs[blob] = true
+			}
+		}
+	}
+	notes, err := repo.readNotesBlobs(slices.Sorted(maps.Keys(blobs)))
+	if err != nil {
+		return nil, err
+	}
+	var diffs []NotesDiff
+	for _, revision := range changed {
+		diffs = append(diffs, NotesDiff{Revision: revision, Old: notes[fromBlobs[revision]], New: notes[toBlobs[revision]]})
+	}
+	return diffs, nil
+}
+
+// GetNotesCommit returns the hash of the commit that the given notes ref
+// points to, or the empty string if there is no such ref.
+func (repo *GitRepo) GetNotesCommit(notesRef string) (string, error) {
+	if repo.usesGit() {
+		if hasRef, err := repo.HasRef(notesRef); err != nil || !hasRef {
+			return "", err
+		}
+		return repo.GetCommitHash(notesRef)
+	}
+	commit, err := repo.readNotesCommit(notesRef)
+	if err != nil || commit == nil {
+		return "", err
+	}
+	return commit.Hash.String(), nil
+}
+
 // AppendNote appends a note to a revision under the given ref.
 func (repo *GitRepo) AppendNote(notesRef, revision string, note Note) error {
+	return repo.AppendNotes(notesRef, map[string][]Note{revision: {note}})
+}
+
+// maxAppendAttempts is how many times to try to append notes before giving
+// up, when the notes ref keeps being changed concurrently.
+const maxAppendAttempts = 5
+
+// AppendNotes appends the given notes to each of the given revisions under
+// the given ref, in a single notes commit.
+//
+// The notes lock is held while doing so, so that other git-appraise
+// processes wait their turn. The ref is only updated if it still points to
+// the notes commit that the existing notes were read from, so that notes
+// written concurrently by anything else (e.g. "git notes") are never lost;
+// if it does not, the notes commit is rebuilt on top of the new one.
+func (repo *GitRepo) AppendNotes(notesRef string, notes map[string][]Note) error {
 	if repo.gogit == nil {
 		return errNotInitialized
 	}
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for attempt := 1; ; attempt++ {
+		err := repo.appendNotes(notesRef, notes)
+		if !errors.Is(err, storage.ErrReferenceHasChanged) {
+			return err
+		}
+		if attempt == maxAppendAttempts {
+			return fmt.Errorf("failed to append notes to %s after %d attempts: %w", notesRef, attempt, err)
+		}
+	}
+}
 
+// appendNotes makes a single attempt at appending the given notes, which
+// fails with storage.ErrReferenceHasChanged if the ref is changed while
+// doing so.
+func (repo *GitRepo) appendNotes(notesRef string, notes map[string][]Note) error {
+	if repo.usesGit() {
+		return repo.appendNotesWithGit(notesRef, notes)
+	}
 	// Get existing notes commit and tree (may be nil if ref doesn't exist).
 	parentCommit, err := repo.readNotesCommit(notesRef)
 	if err != nil {
@@ -1336,28 +2254,39 @@ func (repo *GitRepo) AppendNote(notesRef, revision string, note Note) error {
 		existingTree, _ = parentCommit.Tree()
 	}
 
-	// Read existing note content for this revision, if any.
-	var newContent string
-	if existingTree != nil {
-		entry, err := lookupNoteEntry(existingTree, revision)
-		if err == nil {
-			existing, err := repo.readBlobContents(entry.Hash)
-			if err == nil && existing != "" {
-				newContent = strings.TrimRight(existing, "\n") + "\n"
+	blobs := make(map[string]plumbing.Hash)
+	for revision, revisionNotes := range notes {
+		if len(revisionNotes) == 0 {
+			continue
+		}
+		// Read existing note content for this revision, if any.
+		var newContent string
+		if existingTree != nil {
+			entry, err := lookupNoteEntry(existingTree, revision)
+			if err == nil {
+				existing, err := repo.readBlobContents(entry.Hash)
+				if err == nil && existing != "" {
+					newContent = strings.TrimRight(existing, "\n") + "\n"
+				}
 			}
 		}
-	}
-	newContent += string(note) + "\n"
+		for _, note := range revisionNotes {
+			newContent += string(note) + "\n"
+		}
 
-	// Store the new blob.
-	blobHashStr, err := repo.StoreBlob(newContent)
-	if err != nil {
-		return err
+		// Store the new blob.
+		blobHashStr, err := repo.StoreBlob(newContent)
+		if err != nil {
+			return err
+		}
+		blobs[revision] = plumbing.NewHash(blobHashStr)
+	}
+	if len(blobs) == 0 {
+		return nil
 	}
-	blobHash := plumbing.NewHash(blobHashStr)
 
 	// Build the updated notes tree.
-	treeHash, err := repo.buildNotesTree(existingTree, revision, blobHash)
+	treeHash, err := repo.buildNotesTree(existingTree, blobs)
 	if err != nil {
 		return err
 	}
@@ -1390,8 +2319,174 @@ func (repo *GitRepo) AppendNote(notesRef, revision string, note Note) error {
 	return repo.SetRef(notesRef, commitHash.String(), previousHash)
 }
 
+// notesRewriter rewrites the blobs and trees of a notes ref's history,
+// remembering what it has already rewritten since most of the objects are
+// shared between commits.
+type notesRewriter struct {
+	repo         *GitRepo
+	replacements map[string]Note
+	objects      map[plumbing.Hash]plumbing.Hash
+}
+
+// rewriteBlob returns the hash of the given notes blob with the matching
+// lines replaced.
+func (w *notesRewriter) rewriteBlob(h plumbing.Hash) (plumbing.Hash, error) {
+	contents, err := w.repo.readBlobContents(h)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	lines := strings.Split(contents, "\n")
+	changed := false
+	for i, line := range lines {
+		if replacement, ok := w.replacements[line]; ok {
+			lines[i] = string(replacement)
+			changed = true
+		}
+	}
+	if !changed {
+		return h, nil
+	}
+	newHash, err := w.repo.StoreBlob(strings.Join(lines, "\n"))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return plumbing.NewHash(newHash), nil
+}
+
+// rewriteTree returns the hash of the given notes tree with the matching
+// lines of every blob in it replaced.
+func (w *notesRewriter) rewriteTree(tree *object.Tree) (plumbing.Hash, error) {
+	if rewritten, ok := w.objects[tree.Hash]; ok {
+		return rewritten, nil
+	}
+	entries := make([]object.TreeEntry, 0, len(tree.Entries))
+	changed := false
+	for _, entry := range tree.Entries {
+		newHash, ok := w.objects[entry.Hash]
+		if !ok {
+			var err error
+			if entry.Mode == filemode.Dir {
+				var subtree *object.Tree
+				subtree, err = tree.Tree(entry.Name)
+				if err == nil {
+					newHash, err = w.rewriteTree(subtree)
+				}
+			} else {
+				newHash, err = w.rewriteBlob(entry.Hash)
+			}
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			w.objects[entry.Hash] = newHash
+		}
+		changed = changed || newHash != entry.Hash
+		entry.Hash = newHash
+		entries = append(entries, entry)
+	}
+	if !changed {
+		w.objects[tree.Hash] = tree.Hash
+		return tree.Hash, nil
+	}
+	obj := w.repo.gogit.Storer.NewEncodedObject()
+	(&object.Tree{Entries: entries}).Encode(obj)
+	newHash, err := storeObject(w.repo, obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	w.objects[tree.Hash] = newHash
+	return newHash, nil
+}
+
+// RewriteNotesHistory rewrites every commit in the history of the given
+// notes ref, so that each note line that matches a key of the given map
+// is replaced by the corresponding value, and then updates the ref to
+// point to the rewritten history.
+//
+// The authors, committers, and messages of the rewritten commits are left
+// unchanged. It returns the number of commits whose notes were changed.
+func (repo *GitRepo) RewriteNotesHistory(notesRef string, replacements map[string]Note) (int, error) {
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if repo.usesGit() {
+		return repo.rewriteNotesHistoryWithGit(notesRef, replacements)
+	}
+	head, err := repo.readNotesCommit(notesRef)
+	if err != nil || head == nil {
+		return 0, err
+	}
+	// List the commits with parents before their children, so that each
+	// commit's parents have been rewritten by the time it is reached.
+	out, err := repo.runGitCommand("rev-list", "--reverse", "--topo-order", head.Hash.String())
+	if err != nil {
+		return 0, err
+	}
+	w := &notesRewriter{
+		repo:         repo,
+		replacements: replacements,
+		objects:      make(map[plumbing.Hash]plumbing.Hash),
+	}
+	commits := make(map[plumbing.Hash]plumbing.Hash)
+	rewritten := 0
+	for line := range strings.SplitSeq(out, "\n") {
+		c, err := repo.gogit.CommitObject(plumbing.NewHash(line))
+		if err != nil {
+			return 0, err
+		}
+		tree, err := c.Tree()
+		if err != nil {
+			return 0, err
+		}
+		treeHash, err := w.rewriteTree(tree)
+		if err != nil {
+			return 0, err
+		}
+		changed := treeHash != c.TreeHash
+		if changed {
+			rewritten++
+		}
+		parents := make([]plumbing.Hash, len(c.ParentHashes))
+		for i, parent := range c.ParentHashes {
+			parents[i] = commits[parent]
+			changed = changed || parents[i] != parent
+		}
+		if !changed {
+			commits[c.Hash] = c.Hash
+			continue
+		}
+		newCommit := *c
+		newCommit.TreeHash = treeHash
+		newCommit.ParentHashes = parents
+		obj := repo.gogit.Storer.NewEncodedObject()
+		if err := newCommit.EncodeWithoutSignature(obj); err != nil {
+			return 0, err
+		}
+		commits[c.Hash], err = storeObject(repo, obj)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if newHead := commits[head.Hash]; newHead != head.Hash {
+		if err := repo.SetRef(notesRef, newHead.String(), head.Hash.String()); err != nil {
+			return 0, err
+		}
+	}
+	return rewritten, nil
+}
+
 // ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
 func (repo *GitRepo) ListNotedRevisions(notesRef string) []string {
+	return repo.listNotedRevisions(notesRef, repo.isCommit)
+}
+
+// listNotedRevisions returns the revisions annotated by notes in the given
+// ref that the given function reports to be commits.
+func (repo *GitRepo) listNotedRevisions(notesRef string, isCommit func(string) bool) []string {
+	if repo.usesGit() {
+		return repo.listNotedRevisionsWithGit(notesRef, isCommit)
+	}
 	tree, err := repo.readNotesTree(notesRef)
 	if err != nil || tree == nil {
 		return nil
@@ -1399,7 +2494,7 @@ func (repo *GitRepo) ListNotedRevisions(notesRef string) []string {
 	entries := collectNotesEntries(tree, "")
 	var revisions []string
 	for _, e := range entries {
-		if _, err := repo.gogit.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash(e.ObjectHash)); err != nil {
+		if !isCommit(e.ObjectHash) {
 			continue
 		}
 		revisions = append(revisions, e.ObjectHash)
@@ -1429,6 +2524,10 @@ func (repo *GitRepo) Fetch(remote string, refspecs ...string) error {
 	if repo.gogit == nil {
 		return errNotInitialized
 	}
+	if repo.usesGit() {
+		_, err := repo.runGitCommand(append([]string{"fetch", "--no-tags", remote}, refspecs...)...)
+		return err
+	}
 	specs := make([]config.RefSpec, len(refspecs))
 	for i, rs := range refspecs {
 		specs[i] = config.RefSpec(rs)
@@ -1474,6 +2573,9 @@ func (repo *GitRepo) getRefHashes(refPattern string) (map[string]string, error)
 		return nil, errNotInitialized
 	}
 	refPrefix := strings.TrimSuffix(refPattern, "*")
+	if repo.usesGit() {
+		return repo.getRefHashesWithGit(refPrefix)
+	}
 	refs, err := gogitReferences(repo)
 	if err != nil {
 		return nil, err
@@ -1506,6 +2608,13 @@ func getRemoteNotesRef(remote, localNotesRef string) string {
 	return notesRefPrefix + "remotes/" + remote + "/" + relativeNotesRef
 }
 
+// RemoteNotesRef returns the local ref under which the given remote's copy of
+// a notes ref is stored after being fetched (e.g. by PullNotesAndArchive or
+// FetchAndReturnNewReviewHashes).
+func RemoteNotesRef(remote, localNotesRef string) string {
+	return getRemoteNotesRef(remote, localNotesRef)
+}
+
 func getLocalNotesRef(remote, remoteNotesRef string) string {
 	relativeNotesRef := strings.TrimPrefix(remoteNotesRef, notesRefPrefix+"remotes/"+remote+"/")
 	return notesRefPrefix + relativeNotesRef
@@ -1530,7 +2639,19 @@ func catSortUniq(local, remote string) string {
 	return strings.Join(slices.Sorted(maps.Keys(lines)), "\n")
 }
 
+// MergeNotes merges the remote's notes refs matching the given pattern, as
+// last fetched, into the corresponding local notes refs.
 func (repo *GitRepo) MergeNotes(remote, notesRefPattern string) error {
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return repo.mergeNotes(remote, notesRefPattern)
+}
+
+// mergeNotes merges the remote's notes refs, while the notes lock is held.
+func (repo *GitRepo) mergeNotes(remote, notesRefPattern string) error {
 	remoteRefPattern := getRemoteNotesRef(remote, notesRefPattern)
 	refsMap, err := repo.getRefHashes(remoteRefPattern)
 	if err != nil {
@@ -1548,6 +2669,12 @@ func (repo *GitRepo) MergeNotes(remote, notesRefPattern string) error {
 // mergeNotesRef merges a remote notes ref into a local notes ref using
 // the cat_sort_uniq strategy.
 func (repo *GitRepo) mergeNotesRef(localRef, remoteRef string) error {
+	if repo.usesGit() {
+		return repo.mergeNotesRefWithGit(localRef, remoteRef)
+	}
+	if err := repo.adoptCompaction(localRef, remoteRef, false); err != nil {
+		return err
+	}
 	localCommit, err := repo.readNotesCommit(localRef)
 	if err != nil {
 		return err
@@ -1684,6 +2811,12 @@ func getRemoteDevtoolsRef(remote, devtoolsRefPattern string) string {
 	return remoteDevtoolsRefPrefix + remote + "/" + relativeRef
 }
 
+// RemoteDevtoolsRef returns the local ref under which the given remote's copy
+// of a devtools ref (e.g. an archive ref) is stored after being fetched.
+func RemoteDevtoolsRef(remote, devtoolsRef string) string {
+	return getRemoteDevtoolsRef(remote, devtoolsRef)
+}
+
 func getLocalDevtoolsRef(remote, remoteDevtoolsRef string) string {
 	relativeRef := strings.TrimPrefix(remoteDevtoolsRef, remoteDevtoolsRefPrefix+remote+"/")
 	return devtoolsRefPrefix + relativeRef
@@ -1692,6 +2825,17 @@ func getLocalDevtoolsRef(remote, remoteDevtoolsRef string) string {
 // MergeArchives merges in the remote's state of the archives reference into
 // the local repository's.
 func (repo *GitRepo) MergeArchives(remote, archiveRefPattern string) error {
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return repo.mergeRemoteArchives(remote, archiveRefPattern)
+}
+
+// mergeRemoteArchives merges the remote's archive refs, while the notes lock
+// is held.
+func (repo *GitRepo) mergeRemoteArchives(remote, archiveRefPattern string) error {
 	remoteRefPattern := getRemoteDevtoolsRef(remote, archiveRefPattern)
 	refsMap, err := repo.getRefHashes(remoteRefPattern)
 	if err != nil {
@@ -1706,9 +2850,356 @@ func (repo *GitRepo) MergeArchives(remote, archiveRefPattern string) error {
 	return nil
 }
 
+// isArchiveRef reports whether the given ref is an archive ref, in either the
+// default namespace or another one.
+func isArchiveRef(ref string) bool {
+	rest, ok := strings.CutPrefix(ref, devtoolsRefPrefix)
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(rest, "archives/") {
+		return true
+	}
+	_, rest, _ = strings.Cut(rest, "/")
+	return strings.HasPrefix(rest, "archives/")
+}
+
+// IsReviewRef reports whether the given ref holds review data that is shared
+// between clones: a notes ref (other than the local copies of a remote's
+// notes refs) or an archive ref, in any namespace.
+func IsReviewRef(ref string) bool {
+	if rest, ok := strings.CutPrefix(ref, notesRefPrefix); ok {
+		return rest != "" && !strings.HasPrefix(rest, "remotes/")
+	}
+	return isArchiveRef(ref)
+}
+
+// MergeReviewRef merges another copy of a review ref, stored under the
+// incoming ref (e.g. one that was pushed by another clone), into the given
+// review ref. Notes refs are merged using the "cat_sort_uniq" strategy, and
+// archive refs with a merge commit, in the same way as when pulling them.
+// Either ref is simply fast-forwarded when possible.
+func (repo *GitRepo) MergeReviewRef(ref, incomingRef string) error {
+	if !IsReviewRef(ref) {
+		return fmt.Errorf("%q is not a review ref", ref)
+	}
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if isArchiveRef(ref) {
+		return repo.mergeArchives(ref, incomingRef)
+	}
+	incomingHash, err := repo.GetCommitHash(incomingRef)
+	if err != nil {
+		return err
+	}
+	hasLocal, err := repo.HasRef(ref)
+	if err != nil {
+		return err
+	}
+	if !hasLocal {
+		return repo.SetRef(ref, incomingHash, "")
+	}
+	localHash, err := repo.GetCommitHash(ref)
+	if err != nil {
+		return err
+	}
+	if isAncestor, err := repo.IsAncestor(incomingHash, localHash); err != nil || isAncestor {
+		return err
+	}
+	if isAncestor, err := repo.IsAncestor(localHash, incomingHash); err != nil {
+		return err
+	} else if isAncestor {
+		return repo.SetRef(ref, incomingHash, localHash)
+	}
+	return repo.mergeNotesRef(ref, incomingRef)
+}
+
+// compactedFromTrailer marks the snapshot commits written when compacting the
+// history of a ref, and names the commit whose history each one replaces.
+const compactedFromTrailer = "Compacted-from: "
+
+// compactedFrom returns the commit whose history the given commit replaced,
+// or the empty string if it is not a snapshot written by compacting a ref.
+func compactedFrom(message string) string {
+	for line := range strings.SplitSeq(message, "\n") {
+		if base, ok := strings.CutPrefix(line, compactedFromTrailer); ok {
+			return base
+		}
+	}
+	return ""
+}
+
+// compactionBase returns the last commit in the first-parent history of the
+// given ref that was committed before the given time, or nil if there is no
+// history up to that point which is left to compact.
+func (repo *GitRepo) compactionBase(ref string, before time.Time) (*object.Commit, error) {
+	c, err := repo.resolveToCommit(ref)
+	if err != nil {
+		return nil, err
+	}
+	for !c.Committer.When.Before(before) {
+		if len(c.ParentHashes) == 0 {
+			return nil, nil
+		}
+		if c, err = repo.gogit.CommitObject(c.ParentHashes[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.ParentHashes) == 0 || compactedFrom(c.Message) != "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// archiveHistory walks the commits written to an archive ref by ArchiveRef,
+// mergeArchives, and compactHistory, starting from the given one. It returns
+// the set of those commits, along with the commits that they archive.
+//
+// Any other commits found in the history are treated as archived, so that
+// they remain reachable.
+func (repo *GitRepo) archiveHistory(head *object.Commit) (map[plumbing.Hash]bool, []plumbing.Hash, error) {
+	history := make(map[plumbing.Hash]bool)
+	archived := make(map[plumbing.Hash]bool)
+	queue := []plumbing.Hash{head.Hash}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if history[h] || archived[h] {
+			continue
+		}
+		c, err := repo.gogit.CommitObject(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		parents := c.ParentHashes
+		switch {
+		case compactedFrom(c.Message) != "":
+			history[h] = true
+		case strings.HasPrefix(c.Message, archiveSummaryPrefix) && len(parents) > 0:
+			history[h] = true
+			queue = append(queue, parents[:len(parents)-1]...)
+			parents = parents[len(parents)-1:]
+		case strings.HasPrefix(c.Message, mergeArchivesSummary):
+			history[h] = true
+			queue = append(queue, parents...)
+			parents = nil
+		default:
+			archived[h] = true
+			parents = nil
+		}
+		for _, parent := range parents {
+			archived[parent] = true
+		}
+	}
+	commits := slices.SortedFunc(maps.Keys(archived), func(a, b plumbing.Hash) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return history, commits, nil
+}
+
+// compactHistory replaces the history of the given ref, up to and including
+// the base commit, with a single snapshot commit. The snapshot has the same
+// tree, author, and committer as the base commit, along with the given
+// parents. The commits made since the base are then rewritten on top of the
+// snapshot, with their trees and metadata left unchanged.
+//
+// Parents of those commits that are part of the replaced history are
+// replaced with the snapshot. If the history argument is nil, then that is
+// every commit reachable from the base. Otherwise, it is the given set.
+//
+// The snapshot only depends upon the base commit and its parents, so that
+// the same compaction in different clones produces identical commits.
+func (repo *GitRepo) compactHistory(ref string, base *object.Commit, parents []plumbing.Hash, history map[plumbing.Hash]bool) error {
+	head, err := repo.resolveToCommit(ref)
+	if err != nil {
+		return err
+	}
+	snapshot := &object.Commit{
+		Author:       base.Author,
+		Committer:    base.Committer,
+		Message:      fmt.Sprintf("Compact the history up to %s\n\n%s%s\n", base.Hash, compactedFromTrailer, base.Hash),
+		TreeHash:     base.TreeHash,
+		ParentHashes: parents,
+	}
+	obj := repo.gogit.Storer.NewEncodedObject()
+	snapshot.Encode(obj)
+	snapshotHash, err := storeObject(repo, obj)
+	if err != nil {
+		return err
+	}
+
+	// List the commits since the base with parents before their children,
+	// so that each commit's parents have been rewritten when it is reached.
+	out, err := repo.runGitCommand("rev-list", "--reverse", "--topo-order", head.Hash.String(), "^"+base.Hash.String())
+	if err != nil {
+		return err
+	}
+	commits := map[plumbing.Hash]plumbing.Hash{base.Hash: snapshotHash}
+	for line := range strings.SplitSeq(out, "\n") {
+		if line == "" {
+			continue
+		}
+		c, err := repo.gogit.CommitObject(plumbing.NewHash(line))
+		if err != nil {
+			return err
+		}
+		var newParents []plumbing.Hash
+		for _, parent := range c.ParentHashes {
+			newParent, ok := commits[parent]
+			if !ok {
+				newParent = parent
+				if history == nil || history[parent] {
+					newParent = snapshotHash
+				}
+			}
+			if !slices.Contains(newParents, newParent) {
+				newParents = append(newParents, newParent)
+			}
+		}
+		// Leave the commits that were archived untouched, along with any
+		// signatures on them.
+		if slices.Equal(newParents, c.ParentHashes) {
+			commits[c.Hash] = c.Hash
+			continue
+		}
+		newCommit := *c
+		newCommit.ParentHashes = newParents
+		obj := repo.gogit.Storer.NewEncodedObject()
+		if err := newCommit.EncodeWithoutSignature(obj); err != nil {
+			return err
+		}
+		if commits[c.Hash], err = storeObject(repo, obj); err != nil {
+			return err
+		}
+	}
+	return repo.SetRef(ref, commits[head.Hash].String(), head.Hash.String())
+}
+
+// compactRefs compacts the history before the given time of each ref
+// matching the given pattern, and returns the names of the refs compacted.
+func (repo *GitRepo) compactRefs(refPattern string, before time.Time, archive bool) ([]string, error) {
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	refsMap, err := repo.getRefHashes(refPattern)
+	if err != nil {
+		return nil, err
+	}
+	var compacted []string
+	for _, ref := range slices.Sorted(maps.Keys(refsMap)) {
+		if repo.usesGit() {
+			ok, err := repo.compactRefWithGit(ref, before, archive)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				compacted = append(compacted, ref)
+			}
+			continue
+		}
+		base, err := repo.compactionBase(ref, before)
+		if err != nil {
+			return nil, err
+		}
+		if base == nil {
+			continue
+		}
+		var history map[plumbing.Hash]bool
+		var parents []plumbing.Hash
+		if archive {
+			if history, parents, err = repo.archiveHistory(base); err != nil {
+				return nil, err
+			}
+		}
+		if err := repo.compactHistory(ref, base, parents, history); err != nil {
+			return nil, err
+		}
+		compacted = append(compacted, ref)
+	}
+	return compacted, nil
+}
+
+// CompactNotes squashes the history of each notes ref matching the given
+// pattern, up to its last commit before the given time, into a single
+// snapshot commit with the same notes. Any later commits are rewritten
+// on top of the snapshot.
+//
+// It returns the names of the refs that were compacted.
+func (repo *GitRepo) CompactNotes(notesRefPattern string, before time.Time) ([]string, error) {
+	return repo.compactRefs(notesRefPattern, before, false)
+}
+
+// CompactArchives squashes the history of each archive ref matching the
+// given pattern, up to its last commit before the given time, into a
+// single snapshot commit whose parents are every commit archived in
+// that history, so that they all remain reachable.
+//
+// It returns the names of the refs that were compacted.
+func (repo *GitRepo) CompactArchives(archiveRefPattern string, before time.Time) ([]string, error) {
+	return repo.compactRefs(archiveRefPattern, before, true)
+}
+
+// adoptCompaction compacts the history of the local ref in the same way as
+// that of the remote ref, if the remote ref was compacted since they last
+// shared any history. Otherwise, merging the two refs would bring back all
+// of the history that the compaction squashed.
+func (repo *GitRepo) adoptCompaction(localRef, remoteRef string, archive bool) error {
+	if repo.usesGit() {
+		return repo.adoptCompactionWithGit(localRef, remoteRef, archive)
+	}
+	if hasLocal, err := repo.HasRef(localRef); err != nil || !hasLocal {
+		return err
+	}
+	out, err := repo.runGitCommand("rev-list", remoteRef, "--not", localRef)
+	if err != nil {
+		return err
+	}
+	for line := range strings.SplitSeq(out, "\n") {
+		if line == "" {
+			continue
+		}
+		snapshot, err := repo.gogit.CommitObject(plumbing.NewHash(line))
+		if err != nil {
+			return err
+		}
+		baseHash := compactedFrom(snapshot.Message)
+		if baseHash == "" {
+			continue
+		}
+		// The base is missing if the local ref has never included it.
+		if isAncestor, err := repo.IsAncestor(baseHash, localRef); err != nil || !isAncestor {
+			continue
+		}
+		base, err := repo.gogit.CommitObject(plumbing.NewHash(baseHash))
+		if err != nil {
+			return err
+		}
+		var history map[plumbing.Hash]bool
+		if archive {
+			if history, _, err = repo.archiveHistory(base); err != nil {
+				return err
+			}
+		}
+		return repo.compactHistory(localRef, base, snapshot.ParentHashes, history)
+	}
+	return nil
+}
+
 // listTreeEntryNames returns all file paths in the tree of the commit
 // identified by the given hash, equivalent to `git ls-tree -r --name-only`.
 func (repo *GitRepo) listTreeEntryNames(commitHash string) ([]string, error) {
+	if repo.usesGit() {
+		out, err := repo.runGitCommand("ls-tree", "-r", "--name-only", "--end-of-options", commitHash)
+		if err != nil || out == "" {
+			return nil, err
+		}
+		return strings.Split(out, "\n"), nil
+	}
 	c, err := repo.gogit.CommitObject(plumbing.NewHash(commitHash))
 	if err != nil {
 		return nil, err
@@ -1726,6 +3217,13 @@ func (repo *GitRepo) listTreeEntryNames(commitHash string) ([]string, error) {
 // diffTreeNames returns the names of files that differ between the trees of
 // two commits, equivalent to `git diff --name-only`.
 func (repo *GitRepo) diffTreeNames(fromHash, toHash string) ([]string, error) {
+	if repo.usesGit() {
+		out, err := repo.runGitCommand("diff-tree", "-r", "--name-only", "--no-renames", fromHash, toHash)
+		if err != nil || out == "" {
+			return nil, err
+		}
+		return strings.Split(out, "\n"), nil
+	}
 	fromCommit, err := repo.gogit.CommitObject(plumbing.NewHash(fromHash))
 	if err != nil {
 		return nil, err
@@ -1831,10 +3329,15 @@ func (repo *GitRepo) PullNotesAndArchive(remote, notesRefPattern, archiveRefPatt
 	if _, err := repo.FetchAndReturnNewReviewHashes(remote, notesRefPattern, archiveRefPattern); err != nil {
 		return fmt.Errorf("failure fetching from the remote %q: %v", remote, err)
 	}
-	if err := repo.MergeArchives(remote, archiveRefPattern); err != nil {
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := repo.mergeRemoteArchives(remote, archiveRefPattern); err != nil {
 		return fmt.Errorf("failure merging archives from the remote %q: %v", remote, err)
 	}
-	if err := repo.MergeNotes(remote, notesRefPattern); err != nil {
+	if err := repo.mergeNotes(remote, notesRefPattern); err != nil {
 		return fmt.Errorf("failure merging notes from the remote %q: %v", remote, err)
 	}
 	return nil
@@ -1845,6 +3348,12 @@ func (repo *GitRepo) Push(remote string, refSpecs ...string) error {
 	if repo.gogit == nil {
 		return errNotInitialized
 	}
+	if repo.usesGit() {
+		if _, err := repo.runGitCommand(append([]string{"push", remote}, refSpecs...)...); err != nil {
+			return fmt.Errorf("Failed to push the local refs to the remote '%s': %v", remote, err)
+		}
+		return nil
+	}
 	specs := make([]config.RefSpec, len(refSpecs))
 	for i, rs := range refSpecs {
 		specs[i] = config.RefSpec(rs)
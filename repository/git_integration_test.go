@@ -2,10 +2,16 @@ package repository
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -14,7 +20,9 @@ import (
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
 )
 
 func setupTestRepoWithRemote(t *testing.T) (local *GitRepo, remoteDir string) {
@@ -121,6 +129,117 @@ func TestGitRepoGetDataDir(t *testing.T) {
 	}
 }
 
+// addWorktree adds a linked worktree of the given repo, with a new branch of
+// the given name checked out, and opens it.
+func addWorktree(t *testing.T, repo *GitRepo, branch string) *GitRepo {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), branch)
+	gitRun(t, repo.Path, "worktree", "add", "-b", branch, dir)
+	// Open the worktree from a subdirectory, as commands are often run.
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := NewGitRepo(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved, _ := filepath.EvalSymlinks(dir); worktree.Path != dir && worktree.Path != resolved {
+		t.Errorf("expected the path of the worktree %q, got %q", dir, worktree.Path)
+	}
+	return worktree
+}
+
+func TestGitRepoLinkedWorktree(t *testing.T) {
+	repo := setupTestRepo(t)
+	worktree := addWorktree(t, repo, "feature")
+	mainDataDir, _ := repo.GetDataDir()
+
+	dataDir, err := worktree.GetDataDir()
+	if err != nil || dataDir != mainDataDir {
+		t.Errorf("expected the data dir to be the common dir %q, got %q, %v", mainDataDir, dataDir, err)
+	}
+	gitDir, err := worktree.GetGitDir()
+	if err != nil || gitDir != filepath.Join(mainDataDir, "worktrees", "feature") {
+		t.Errorf("expected the worktree's own git dir, got %q, %v", gitDir, err)
+	}
+	if mainGitDir, _ := repo.GetGitDir(); mainGitDir != mainDataDir {
+		t.Errorf("expected the git dir of the main worktree to be its data dir, got %q", mainGitDir)
+	}
+
+	addCommit(t, worktree, "feature.txt", "feature", "feature commit")
+	head, err := worktree.GetCommitHash("HEAD")
+	if err != nil || head != gitRun(t, repo.Path, "rev-parse", "feature") {
+		t.Errorf("expected HEAD to be the feature branch, got %q, %v", head, err)
+	}
+	if dirty, err := worktree.HasUncommittedChanges(); err != nil || dirty {
+		t.Errorf("HasUncommittedChanges() = %v, %v", dirty, err)
+	}
+	if err := worktree.AppendNote("refs/notes/devtools/reviews", head, Note("request")); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes("refs/notes/devtools/reviews", head); len(notes) != 1 || string(notes[0]) != "request" {
+		t.Errorf("expected the notes to be shared with the main worktree, got %q", notes)
+	}
+
+	// Git refers to the common dir relative to the worktree's git dir, but
+	// it may also be absolute.
+	if err := os.WriteFile(filepath.Join(gitDir, "commondir"), []byte(mainDataDir+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if dataDir, err := worktree.GetDataDir(); err != nil || dataDir != mainDataDir {
+		t.Errorf("expected an absolute common dir to be used, got %q, %v", dataDir, err)
+	}
+}
+
+func TestGitRepoLinkedWorktreeSwitchToRef(t *testing.T) {
+	repo := setupTestRepo(t)
+	worktree := addWorktree(t, repo, "feature")
+	if !repo.hasLinkedWorktrees() || !worktree.hasLinkedWorktrees() {
+		t.Error("expected both worktrees to know that there are linked worktrees")
+	}
+	if err := worktree.SwitchToRef("refs/heads/main"); err == nil || !strings.Contains(err.Error(), "already") {
+		t.Errorf("expected an error switching to a branch checked out in the main worktree, got %v", err)
+	}
+	if err := repo.SwitchToRef("refs/heads/feature"); err == nil {
+		t.Error("expected an error switching to a branch checked out in the linked worktree")
+	}
+	gitRun(t, repo.Path, "branch", "other")
+	if err := worktree.SwitchToRef("refs/heads/other"); err != nil {
+		t.Fatal(err)
+	}
+	if branch := gitRun(t, worktree.Path, "symbolic-ref", "HEAD"); branch != "refs/heads/other" {
+		t.Errorf("expected the worktree to switch branches, got %q", branch)
+	}
+	if branch := gitRun(t, repo.Path, "symbolic-ref", "HEAD"); branch != "refs/heads/main" {
+		t.Errorf("expected the main worktree to be unchanged, got %q", branch)
+	}
+	gitRun(t, repo.Path, "worktree", "remove", worktree.Path)
+	if repo.hasLinkedWorktrees() {
+		t.Error("expected no linked worktrees once the worktree is removed")
+	}
+}
+
+func TestGitRepoGetDataDirErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	worktree := addWorktree(t, repo, "feature")
+	gitDir, _ := worktree.GetGitDir()
+	if err := os.Remove(filepath.Join(gitDir, "commondir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(gitDir, "commondir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.GetDataDir(); err == nil {
+		t.Error("expected an error for an unreadable commondir file")
+	}
+	if worktree.hasLinkedWorktrees() {
+		t.Error("expected no linked worktrees without a data dir")
+	}
+	if _, err := (&GitRepo{}).GetGitDir(); err != errNotInitialized {
+		t.Errorf("GetGitDir: got %v, want errNotInitialized", err)
+	}
+}
+
 func TestGitRepoGetRepoStateHash(t *testing.T) {
 	repo := setupTestRepo(t)
 	hash, err := repo.GetRepoStateHash()
@@ -154,6 +273,382 @@ func TestGitRepoGetSubmitStrategy(t *testing.T) {
 	}
 }
 
+func TestGitRepoConfigValues(t *testing.T) {
+	repo := setupTestRepo(t)
+	values, err := repo.GetConfigValues("appraise.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("unexpected values: %q", values)
+	}
+	for _, value := range []string{"+refs/a/*:refs/b/*", "second value", "+refs/a/*:refs/b/*"} {
+		if err := repo.AddConfigValue("appraise.test", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, err = repo.GetConfigValues("appraise.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[1] != "second value" {
+		t.Fatalf("unexpected values: %q", values)
+	}
+	// The value is matched literally, rather than as a regular expression.
+	if err := repo.RemoveConfigValue("appraise.test", "+refs/a/*:refs/b/*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RemoveConfigValue("appraise.test", "missing"); err != nil {
+		t.Fatal(err)
+	}
+	values, err = repo.GetConfigValues("appraise.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0] != "second value" {
+		t.Fatalf("unexpected values: %q", values)
+	}
+}
+
+// setupSSHSigning configures the repo to sign with a newly generated SSH key,
+// and returns the allowed signers line for that key.
+func setupSSHSigning(t *testing.T, repo *GitRepo) string {
+	t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not available")
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test", "-f", keyFile).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen failed: %v\n%s", err, out)
+	}
+	publicKey, err := os.ReadFile(keyFile + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, repo.Path, "config", "gpg.format", "ssh")
+	gitRun(t, repo.Path, "config", "user.signingkey", keyFile)
+	return "test@example.com " + strings.TrimSpace(string(publicKey)) + "\n"
+}
+
+func TestGitRepoSSHSignatures(t *testing.T) {
+	repo := setupTestRepo(t)
+	allowedSigners := setupSSHSigning(t, repo)
+	payload := []byte(`{"author":"test@example.com"}`)
+	signature, err := repo.SignPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signature, sshSignaturePrefix) {
+		t.Fatalf("unexpected signature: %q", signature)
+	}
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err == nil {
+		t.Error("expected verification to fail without an allowed signers file")
+	}
+
+	if err := os.MkdirAll(filepath.Join(repo.Path, ".git-appraise"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A file committed to the checked out branch is not trusted on its own.
+	gitRun(t, repo.Path, "checkout", "-b", "review")
+	addCommit(t, repo, DefaultAllowedSignersFile, allowedSigners, "add allowed signers")
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err == nil {
+		t.Error("expected verification to fail with the allowed signers file of the checked out branch")
+	}
+	gitRun(t, repo.Path, "config", AllowedSignersRefKey, "refs/heads/main")
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err == nil {
+		t.Error("expected verification to fail with an allowed signers file that is not in the trusted ref")
+	}
+	gitRun(t, repo.Path, "checkout", "main")
+	gitRun(t, repo.Path, "merge", "review")
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err != nil {
+		t.Errorf("unexpected verification failure: %v", err)
+	}
+	if err := repo.VerifyPayloadSignature(payload, signature, "other@example.com"); err == nil {
+		t.Error("expected verification to fail for a different signer")
+	}
+	if err := repo.VerifyPayloadSignature([]byte("modified"), signature, "test@example.com"); err == nil {
+		t.Error("expected verification to fail for a modified payload")
+	}
+
+	// Fall back to the local allowed signers file if the committed one is missing.
+	localFile := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(localFile, []byte(allowedSigners), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, repo.Path, "config", "appraise.allowedSignersFile", "missing")
+	gitRun(t, repo.Path, "config", "gpg.ssh.allowedSignersFile", localFile)
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err != nil {
+		t.Errorf("unexpected verification failure with a local allowed signers file: %v", err)
+	}
+}
+
+func TestGitRepoPGPSignatures(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+	t.Setenv("GNUPGHOME", t.TempDir())
+	if out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key",
+		"Test <test@example.com>", "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Skipf("unable to generate a gpg key: %v\n%s", err, out)
+	}
+	repo := setupTestRepo(t)
+	payload := []byte(`{"author":"test@example.com"}`)
+	signature, err := repo.SignPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signature, pgpSignaturePrefix) {
+		t.Fatalf("unexpected signature: %q", signature)
+	}
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err != nil {
+		t.Errorf("unexpected verification failure: %v", err)
+	}
+	if err := repo.VerifyPayloadSignature(payload, signature, "other@example.com"); err == nil {
+		t.Error("expected verification to fail for a different signer")
+	}
+	if err := repo.VerifyPayloadSignature([]byte("modified"), signature, "test@example.com"); err == nil {
+		t.Error("expected verification to fail for a modified payload")
+	}
+
+	gitRun(t, repo.Path, "config", "user.signingkey", "test@example.com")
+	if _, err := repo.SignPayload(payload); err != nil {
+		t.Errorf("unexpected failure signing with an explicit key: %v", err)
+	}
+
+	// Keys that are merely in the keyring, without being trusted, do not
+	// verify signatures unless their fingerprints are configured.
+	publicKey, err := exec.Command("gpg", "--batch", "--armor", "--export", "test@example.com").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", t.TempDir())
+	importCmd := exec.Command("gpg", "--batch", "--import")
+	importCmd.Stdin = bytes.NewReader(publicKey)
+	if out, err := importCmd.CombinedOutput(); err != nil {
+		t.Fatalf("unable to import the gpg key: %v\n%s", err, out)
+	}
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err == nil || !strings.Contains(err.Error(), "not trusted") {
+		t.Errorf("expected verification to fail for an untrusted key, got %v", err)
+	}
+	out, err := exec.Command("gpg", "--batch", "--with-colons", "--fingerprint", "test@example.com").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fingerprint string
+	for line := range strings.SplitSeq(string(out), "\n") {
+		if fields := strings.Split(line, ":"); fields[0] == "fpr" && fingerprint == "" {
+			fingerprint = fields[9]
+		}
+	}
+	gitRun(t, repo.Path, "config", TrustedOpenPGPKeyKey, fingerprint)
+	if err := repo.VerifyPayloadSignature(payload, signature, "test@example.com"); err != nil {
+		t.Errorf("unexpected verification failure with a trusted fingerprint: %v", err)
+	}
+}
+
+func TestGitRepoSignPayloadErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	gitRun(t, repo.Path, "config", "gpg.format", "x509")
+	if _, err := repo.SignPayload(nil); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+	gitRun(t, repo.Path, "config", "gpg.format", "ssh")
+	if _, err := repo.SignPayload(nil); err == nil {
+		t.Error("expected an error for a missing signing key")
+	}
+
+	var ran [][]string
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		ran = append(ran, cmd.Args)
+		if cmd.Args[0] == "ssh-keygen" {
+			return fmt.Errorf("exit status 255")
+		}
+		return cmd.Run()
+	})
+	for _, key := range []string{"key::ssh-ed25519 AAAA", "ssh-ed25519 AAAA", "~/.ssh/id_ed25519"} {
+		gitRun(t, repo.Path, "config", "user.signingkey", key)
+		ran = nil
+		if _, err := repo.SignPayload(nil); err == nil || !strings.Contains(err.Error(), "ssh-keygen failed") {
+			t.Errorf("expected signing with %q to fail, got %v", key, err)
+		}
+		keyFile := ran[len(ran)-1][len(ran[len(ran)-1])-1]
+		if strings.HasPrefix(key, "~/") {
+			if !filepath.IsAbs(keyFile) || !strings.HasSuffix(keyFile, ".ssh/id_ed25519") {
+				t.Errorf("expected the key path to be expanded, got %q", keyFile)
+			}
+		} else if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+			t.Errorf("expected the temporary key file %q to be removed", keyFile)
+		}
+	}
+}
+
+func TestGitRepoVerifyPayloadSignatureErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	if err := repo.VerifyPayloadSignature(nil, "not a signature", "test@example.com"); err == nil {
+		t.Error("expected an error for an unrecognized signature")
+	}
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		if cmd.Args[0] == "gpg" {
+			cmd.Stdout.Write([]byte("[GNUPG:] GOODSIG 0123 Other <other@example.com>\n" +
+				"[GNUPG:] VALIDSIG ABCD 2026-01-01 0 4 0 22 8 00 ABCD\n[GNUPG:] TRUST_ULTIMATE 0 pgp\n"))
+			return nil
+		}
+		return cmd.Run()
+	})
+	if err := repo.VerifyPayloadSignature(nil, pgpSignaturePrefix, "test@example.com"); err == nil {
+		t.Error("expected an error for a signature by someone else")
+	}
+	if err := repo.VerifyPayloadSignature(nil, pgpSignaturePrefix, "other@example.com"); err != nil {
+		t.Errorf("unexpected verification failure: %v", err)
+	}
+}
+
+func TestCheckGPGStatus(t *testing.T) {
+	const (
+		goodSig  = "[GNUPG:] GOODSIG 0123 Test <test@example.com>\n"
+		validSig = "[GNUPG:] VALIDSIG 4567 2026-01-01 0 4 0 22 8 00 89AB\n"
+		trusted  = "[GNUPG:] TRUST_FULLY 0 pgp\n"
+	)
+	for _, test := range []struct {
+		description string
+		status      string
+		trustedKeys []string
+		valid       bool
+	}{
+		{"trusted", goodSig + validSig + trusted, nil, true},
+		{"ultimately trusted", goodSig + validSig + "[GNUPG:] TRUST_ULTIMATE 0 pgp\n", nil, true},
+		{"trusted fingerprint", goodSig + validSig + "[GNUPG:] TRUST_UNDEFINED 0 pgp\n", []string{"4567"}, true},
+		{"trusted primary key fingerprint", goodSig + validSig, []string{"89 ab"}, true},
+		{"untrusted", goodSig + validSig + "[GNUPG:] TRUST_MARGINAL 0 pgp\n", []string{"0123"}, false},
+		{"no valid signature", goodSig + trusted, nil, false},
+		{"no good signature", validSig + trusted, nil, false},
+		{"other signer", "[GNUPG:] GOODSIG 0123 Other <other@example.com>\n" + validSig + trusted, nil, false},
+		{"signer in the name", "[GNUPG:] GOODSIG 0123 <test@example.com> <other@example.com>\n" + validSig + trusted, nil, false},
+		{"signer as a suffix", "[GNUPG:] GOODSIG 0123 Test <eviltest@example.com>\n" + validSig + trusted, nil, false},
+		{"bare email", "[GNUPG:] GOODSIG 0123 test@example.com\n" + validSig + trusted, nil, true},
+	} {
+		if err := checkGPGStatus(test.status, "test@example.com", test.trustedKeys); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%v, got %v", test.description, test.valid, err)
+		}
+	}
+}
+
+func TestGitRepoPGPEncryption(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+	t.Setenv("GNUPGHOME", t.TempDir())
+	if out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key",
+		"Test <test@example.com>", "default", "default", "never").CombinedOutput(); err != nil {
+		t.Skipf("unable to generate a gpg key: %v\n%s", err, out)
+	}
+	repo := setupTestRepo(t)
+	gitRun(t, repo.Path, "config", EncryptToKey, "test@example.com")
+	ciphertext, err := repo.EncryptPayload([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ciphertext, pgpMessagePrefix) {
+		t.Fatalf("unexpected ciphertext: %q", ciphertext)
+	}
+	if plaintext, err := repo.DecryptPayload(ciphertext); err != nil || string(plaintext) != "secret" {
+		t.Errorf("unexpected decryption %q, %v", plaintext, err)
+	}
+
+	t.Setenv("GNUPGHOME", t.TempDir())
+	if _, err := repo.DecryptPayload(ciphertext); err == nil {
+		t.Error("expected an error decrypting without the key")
+	}
+}
+
+func TestGitRepoAgeEncryption(t *testing.T) {
+	repo := setupTestRepo(t)
+	var ran [][]string
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		if cmd.Args[0] != "age" {
+			return cmd.Run()
+		}
+		ran = append(ran, cmd.Args)
+		input, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(cmd.Args, "--encrypt") {
+			fmt.Fprintf(cmd.Stdout, "%s\n%s", ageMessagePrefix, input)
+		} else {
+			fmt.Fprint(cmd.Stdout, strings.TrimPrefix(string(input), ageMessagePrefix+"\n"))
+		}
+		return nil
+	})
+
+	gitRun(t, repo.Path, "config", EncryptToKey, "age1recipient")
+	gitRun(t, repo.Path, "config", "--add", EncryptToKey, "ssh-ed25519 AAAA")
+	ciphertext, err := repo.EncryptPayload([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"age", "--encrypt", "--armor", "--recipient", "age1recipient", "--recipient", "ssh-ed25519 AAAA"}
+	if !strings.HasPrefix(ciphertext, ageMessagePrefix) || len(ran) != 1 || !slices.Equal(ran[0], want) {
+		t.Errorf("unexpected encryption %q by %q", ciphertext, ran)
+	}
+
+	if _, err := repo.DecryptPayload(ciphertext); err == nil || !strings.Contains(err.Error(), AgeIdentityKey) {
+		t.Errorf("expected an error decrypting without an identity, got %v", err)
+	}
+	gitRun(t, repo.Path, "config", AgeIdentityKey, "~/.age/key.txt")
+	ran = nil
+	if plaintext, err := repo.DecryptPayload(ciphertext); err != nil || string(plaintext) != "secret" {
+		t.Errorf("unexpected decryption %q, %v", plaintext, err)
+	}
+	if len(ran) != 1 || ran[0][1] != "--decrypt" || !filepath.IsAbs(ran[0][3]) || !strings.HasSuffix(ran[0][3], ".age/key.txt") {
+		t.Errorf("expected the identity path to be expanded, got %q", ran)
+	}
+
+	gitRun(t, repo.Path, "config", "--add", EncryptToKey, "test@example.com")
+	if _, err := repo.EncryptPayload([]byte("secret")); err == nil || !strings.Contains(err.Error(), "must not mix") {
+		t.Errorf("expected an error for mixed recipients, got %v", err)
+	}
+}
+
+func TestGitRepoEncryptionErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	if _, err := repo.EncryptPayload([]byte("secret")); err == nil || !strings.Contains(err.Error(), EncryptToKey) {
+		t.Errorf("expected an error without any recipients, got %v", err)
+	}
+	if _, err := repo.DecryptPayload("not a ciphertext"); err == nil {
+		t.Error("expected an error for an unrecognized ciphertext")
+	}
+
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		if slices.Contains(cmd.Args, "config") {
+			return errors.New("config failure")
+		}
+		return cmd.Run()
+	})
+	if _, err := repo.EncryptPayload([]byte("secret")); err == nil {
+		t.Error("expected an error reading the recipients")
+	}
+	if _, err := repo.DecryptPayload(ageMessagePrefix); err == nil {
+		t.Error("expected an error reading the identities")
+	}
+	if _, err := repo.DecryptPayload(pgpMessagePrefix); err == nil {
+		t.Error("expected an error reading the gpg program")
+	}
+}
+
+func TestGitRepoConfigValuesInvalidKey(t *testing.T) {
+	repo := setupTestRepo(t)
+	if _, err := repo.GetConfigValues("nosection"); err == nil {
+		t.Error("expected an error reading an invalid key")
+	}
+	if err := repo.AddConfigValue("nosection", "value"); err == nil {
+		t.Error("expected an error adding an invalid key")
+	}
+	if err := repo.RemoveConfigValue("nosection", "value"); err == nil {
+		t.Error("expected an error removing an invalid key")
+	}
+}
+
 func TestGitRepoHasUncommittedChanges(t *testing.T) {
 	repo := setupTestRepo(t)
 	has, err := repo.HasUncommittedChanges()
@@ -657,7 +1152,7 @@ func TestGitRepoSwitchToRef(t *testing.T) {
 }
 
 func TestParsedDiffEmpty(t *testing.T) {
-	fileDiffs, err := parsedDiff("")
+	fileDiffs, err := ParseDiff("")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -674,6 +1169,22 @@ func TestGetRemoteNotesRef(t *testing.T) {
 	}
 }
 
+func TestRemoteNotesRef(t *testing.T) {
+	ref := RemoteNotesRef("upstream", "refs/notes/devtools/discuss")
+	expected := "refs/notes/remotes/upstream/devtools/discuss"
+	if ref != expected {
+		t.Fatalf("expected %q, got %q", expected, ref)
+	}
+}
+
+func TestRemoteDevtoolsRef(t *testing.T) {
+	ref := RemoteDevtoolsRef("upstream", "refs/devtools/archives/reviews")
+	expected := "refs/remoteDevtools/upstream/archives/reviews"
+	if ref != expected {
+		t.Fatalf("expected %q, got %q", expected, ref)
+	}
+}
+
 func TestGetLocalNotesRef(t *testing.T) {
 	ref := getLocalNotesRef("origin", "refs/notes/remotes/origin/devtools/reviews")
 	expected := "refs/notes/devtools/reviews"
@@ -1411,7 +1922,7 @@ func TestGitRepoParsedDiff1Error(t *testing.T) {
 func TestParsedDiffBinary(t *testing.T) {
 	// Binary files produce a diff with no text fragments
 	binaryDiff := "diff --git a/file.bin b/file.bin\nnew file mode 100644\nindex 0000000..1234567\nBinary files /dev/null and b/file.bin differ\n"
-	fileDiffs, err := parsedDiff(binaryDiff)
+	fileDiffs, err := ParseDiff(binaryDiff)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1602,45 +2113,160 @@ func TestGitRepoArchiveRefGetDetailsError(t *testing.T) {
 }
 
 // Test GetAllNotes error paths
-func TestGitRepoGetAllNotesOverviewError(t *testing.T) {
-	repo := &GitRepo{Path: "/nonexistent/path"}
-	_, err := repo.GetAllNotes("refs/notes/test")
-	if err == nil {
-		t.Fatal("expected error for nonexistent repo")
+// collectNotes returns the revisions and notes yielded by the given notes
+// iterator, failing the test on an error.
+func collectNotes(t *testing.T, notes iter.Seq2[string, []Note], notesErr func() error) map[string]string {
+	t.Helper()
+	result := make(map[string]string)
+	for revision, revisionNotes := range notes {
+		var lines []string
+		for _, note := range revisionNotes {
+			lines = append(lines, string(note))
+		}
+		result[revision] = strings.Join(lines, "\n")
+	}
+	if err := notesErr(); err != nil {
+		t.Fatal(err)
 	}
+	return result
 }
 
-// Test ListNotedRevisions error path (git notes list fails)
-func TestGitRepoListNotedRevisionsEmpty(t *testing.T) {
+func TestGitRepoNotesIterator(t *testing.T) {
 	repo := setupTestRepo(t)
-	revisions := repo.ListNotedRevisions("refs/notes/nonexistent")
-	if len(revisions) != 0 {
-		t.Fatalf("expected no revisions for nonexistent notes ref, got %v", revisions)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	blob, err := repo.StoreBlob("not a commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ref = "refs/notes/devtools/test"
+	for _, note := range []struct{ revision, note string }{{head, "first"}, {head, "second"}, {blob, "blob"}} {
+		if err := repo.AppendNote(ref, note.revision, Note(note.note)); err != nil {
+			t.Fatal(err)
+		}
 	}
-}
 
-// Test Remotes error path
-func TestGitRepoRemotesError(t *testing.T) {
-	repo := &GitRepo{Path: "/nonexistent/path"}
-	_, err := repo.Remotes()
-	if err == nil {
-		t.Fatal("expected error for nonexistent repo")
+	notes, notesErr := repo.Notes(ref, "")
+	if got := collectNotes(t, notes, notesErr); len(got) != 2 || got[head] != "first\nsecond" || got[blob] != "blob" {
+		t.Errorf("unexpected notes %q", got)
+	}
+	notes, notesErr = repo.Notes(gitRun(t, repo.Path, "rev-parse", ref), head[:6])
+	if got := collectNotes(t, notes, notesErr); len(got) != 1 || got[head] != "first\nsecond" {
+		t.Errorf("unexpected notes for the prefix %q: %q", head[:6], got)
+	}
+	notes, notesErr = repo.Notes(ref, "")
+	for range notes {
+		break
+	}
+	if err := notesErr(); err != nil {
+		t.Fatal(err)
 	}
-}
 
-// Test PushNotes error path
-func TestGitRepoPushNotesError(t *testing.T) {
-	repo := setupTestRepo(t)
-	err := repo.PushNotes("nonexistent_remote", "refs/notes/*")
-	if err == nil {
-		t.Fatal("expected error pushing to nonexistent remote")
+	notes, notesErr = repo.Notes("refs/notes/missing", "")
+	if got := collectNotes(t, notes, notesErr); len(got) != 0 {
+		t.Errorf("expected no notes for a missing ref, got %q", got)
 	}
-	if !strings.Contains(err.Error(), "Failed to push") {
-		t.Fatalf("expected 'Failed to push' in error, got: %v", err)
+	notes, notesErr = repo.Notes(strings.Repeat("0", 40), "")
+	for range notes {
+		t.Error("expected no notes for a missing notes commit")
+	}
+	if notesErr() == nil {
+		t.Error("expected an error for a missing notes commit")
+	}
+	if _, notesErr := (&GitRepo{}).Notes(ref, ""); notesErr() != errNotInitialized {
+		t.Errorf("expected errNotInitialized, got %v", notesErr())
 	}
 }
 
-// Test PushNotesAndArchive error path
+func TestGitRepoNotesIteratorFanout(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	missing := strings.Repeat("1", 40)
+	if head[0] == '1' {
+		missing = strings.Repeat("2", 40)
+	}
+	mktree := func(input string) string {
+		cmd := exec.Command("git", "mktree", "--missing")
+		cmd.Dir = repo.Path
+		cmd.Stdin = strings.NewReader(input)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	note, err := repo.StoreBlob("note\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The notes for head are nested under a fan-out directory, next to a
+	// directory with an unreadable note and one that cannot be read at all.
+	nested := mktree("100644 blob " + note + "\t" + head[2:] + "\n")
+	unreadable := mktree("100644 blob " + missing + "\t" + missing[2:] + "\n")
+	root := mktree("040000 tree " + nested + "\t" + head[:2] + "\n" +
+		"040000 tree " + unreadable + "\t" + missing[:2] + "\n" +
+		"040000 tree " + missing + "\tzz\n")
+	commit := gitRun(t, repo.Path, "commit-tree", root, "-m", "notes")
+
+	notes, notesErr := repo.Notes(commit, head[:1])
+	if got := collectNotes(t, notes, notesErr); len(got) != 1 || got[head] != "note" {
+		t.Errorf("unexpected notes for a prefix within a fan-out directory: %q", got)
+	}
+	notes, notesErr = repo.Notes(commit, head[:4])
+	if got := collectNotes(t, notes, notesErr); len(got) != 1 || got[head] != "note" {
+		t.Errorf("unexpected notes for a prefix beyond a fan-out directory: %q", got)
+	}
+	for _, prefix := range []string{"", missing[:3], "z"} {
+		notes, notesErr = repo.Notes(commit, prefix)
+		for revision := range notes {
+			if revision != head {
+				t.Errorf("unexpected notes for %q with the prefix %q", revision, prefix)
+			}
+		}
+		if notesErr() == nil {
+			t.Errorf("expected an error reading the notes with the prefix %q", prefix)
+		}
+	}
+}
+
+func TestGitRepoGetAllNotesOverviewError(t *testing.T) {
+	repo := &GitRepo{Path: "/nonexistent/path"}
+	_, err := repo.GetAllNotes("refs/notes/test")
+	if err == nil {
+		t.Fatal("expected error for nonexistent repo")
+	}
+}
+
+// Test ListNotedRevisions error path (git notes list fails)
+func TestGitRepoListNotedRevisionsEmpty(t *testing.T) {
+	repo := setupTestRepo(t)
+	revisions := repo.ListNotedRevisions("refs/notes/nonexistent")
+	if len(revisions) != 0 {
+		t.Fatalf("expected no revisions for nonexistent notes ref, got %v", revisions)
+	}
+}
+
+// Test Remotes error path
+func TestGitRepoRemotesError(t *testing.T) {
+	repo := &GitRepo{Path: "/nonexistent/path"}
+	_, err := repo.Remotes()
+	if err == nil {
+		t.Fatal("expected error for nonexistent repo")
+	}
+}
+
+// Test PushNotes error path
+func TestGitRepoPushNotesError(t *testing.T) {
+	repo := setupTestRepo(t)
+	err := repo.PushNotes("nonexistent_remote", "refs/notes/*")
+	if err == nil {
+		t.Fatal("expected error pushing to nonexistent remote")
+	}
+	if !strings.Contains(err.Error(), "Failed to push") {
+		t.Fatalf("expected 'Failed to push' in error, got: %v", err)
+	}
+}
+
+// Test PushNotesAndArchive error path
 func TestGitRepoPushNotesAndArchiveError(t *testing.T) {
 	repo := setupTestRepo(t)
 	err := repo.PushNotesAndArchive("nonexistent_remote", "refs/notes/*", "refs/devtools/*")
@@ -2329,7 +2955,7 @@ func TestMockRepoResolveLocalRefHEADNotAnywhere(t *testing.T) {
 func TestParsedDiffParseError(t *testing.T) {
 	// This specific format triggers a gitdiff.Parse error
 	malformed := "diff --git a/f b/f\n@@ -1 +1 @@\n"
-	_, err := parsedDiff(malformed)
+	_, err := ParseDiff(malformed)
 	if err == nil {
 		t.Fatal("expected error from gitdiff.Parse")
 	}
@@ -3339,6 +3965,9 @@ func TestNewGitRepoBare(t *testing.T) {
 	if repo.Path != dir {
 		t.Errorf("expected path %q, got %q", dir, repo.Path)
 	}
+	if dataDir, err := repo.GetDataDir(); err != nil || dataDir != dir {
+		t.Errorf("expected the data dir of a bare repo to be the repo, got %q, %v", dataDir, err)
+	}
 }
 
 // TestNewGitRepoInvalid tests NewGitRepo on a path that is not a repo.
@@ -3349,6 +3978,28 @@ func TestNewGitRepoInvalid(t *testing.T) {
 	}
 }
 
+// TestNewGitRepoObjectFormat tests that NewGitRepo checks the object format
+// of each repo, and only opens those that use SHA-1 or SHA-256.
+func TestNewGitRepoObjectFormat(t *testing.T) {
+	for _, format := range []formatcfg.ObjectFormat{formatcfg.SHA1, formatcfg.SHA256} {
+		dir := t.TempDir()
+		gitRun(t, dir, "init", "--object-format="+string(format))
+		repo, err := NewGitRepo(dir)
+		if err != nil {
+			t.Errorf("NewGitRepo on a %s repo: %v", format, err)
+		} else if repo.usesGit() != (format == formatcfg.SHA256) {
+			t.Errorf("usesGit() on a %s repo = %v", format, repo.usesGit())
+		}
+	}
+	dir := t.TempDir()
+	gitRun(t, dir, "init")
+	gitRun(t, dir, "config", "core.repositoryformatversion", "1")
+	gitRun(t, dir, "config", "extensions.objectformat", "md5")
+	if _, err := NewGitRepo(dir); !errors.Is(err, ErrUnsupportedObjectFormat) || !strings.Contains(err.Error(), "md5") {
+		t.Errorf("expected ErrUnsupportedObjectFormat naming the format, got %v", err)
+	}
+}
+
 // TestSwitchToRefErrors tests SwitchToRef error paths.
 func TestSwitchToRefErrors(t *testing.T) {
 	repo := setupTestRepo(t)
@@ -4160,6 +4811,152 @@ func TestAppendNoteCommitStoreError(t *testing.T) {
 	}
 }
 
+func TestAppendNotes(t *testing.T) {
+	repo := setupTestRepo(t)
+	first, _ := repo.GetCommitHash("HEAD")
+	addCommit(t, repo, "second.txt", "second", "second commit")
+	second, _ := repo.GetCommitHash("HEAD")
+	if err := repo.AppendNote("refs/notes/test", first, Note("existing")); err != nil {
+		t.Fatal(err)
+	}
+	parent, _ := repo.GetNotesCommit("refs/notes/test")
+
+	if err := repo.AppendNotes("refs/notes/test", map[string][]Note{
+		first:  {Note("first a"), Note("first b")},
+		second: {Note("second")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes("refs/notes/test", first); !reflect.DeepEqual(notes, []Note{Note("existing"), Note("first a"), Note("first b")}) {
+		t.Errorf("unexpected notes for the first commit %q", notes)
+	}
+	if notes := repo.GetNotes("refs/notes/test", second); !reflect.DeepEqual(notes, []Note{Note("second")}) {
+		t.Errorf("unexpected notes for the second commit %q", notes)
+	}
+	// All of the notes are written in a single commit.
+	if got := gitRun(t, repo.Path, "rev-parse", "refs/notes/test^"); got != parent {
+		t.Errorf("expected a single notes commit on top of %s, got parent %s", parent, got)
+	}
+	if out := gitRun(t, repo.Path, "notes", "--ref=refs/notes/test", "show", second); out != "second" {
+		t.Errorf("expected git to read the batched notes, got %q", out)
+	}
+}
+
+func TestAppendNotesFanout(t *testing.T) {
+	repo := setupTestRepo(t)
+	first, _ := repo.GetCommitHash("HEAD")
+	blobHash, _ := repo.StoreBlob("existing\n")
+	topTree := storeFanoutTree(t, repo, first, plumbing.NewHash(blobHash))
+	commit := &object.Commit{
+		Author:    repo.notesSignature(),
+		Committer: repo.notesSignature(),
+		Message:   "fan-out notes\n",
+		TreeHash:  topTree.Hash,
+	}
+	obj := repo.gogit.Storer.NewEncodedObject()
+	commit.Encode(obj)
+	commitHash, err := storeObject(repo, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef("refs/notes/fanout", commitHash.String(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	notes := map[string][]Note{first: {Note("first")}}
+	var others []string
+	for i := range 3 {
+		addCommit(t, repo, fmt.Sprintf("file%d.txt", i), "x", fmt.Sprintf("commit %d", i))
+		hash, _ := repo.GetCommitHash("HEAD")
+		notes[hash] = []Note{Note(hash)}
+		others = append(others, hash)
+	}
+	if err := repo.AppendNotes("refs/notes/fanout", notes); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.GetNotes("refs/notes/fanout", first); !reflect.DeepEqual(got, []Note{Note("existing"), Note("first")}) {
+		t.Errorf("unexpected notes for the first commit %q", got)
+	}
+	for _, hash := range others {
+		if got := repo.GetNotes("refs/notes/fanout", hash); !reflect.DeepEqual(got, []Note{Note(hash)}) {
+			t.Errorf("unexpected notes for %s: %q", hash, got)
+		}
+	}
+	if out := gitRun(t, repo.Path, "ls-tree", "--name-only", "refs/notes/fanout"); strings.Contains(out, first) {
+		t.Errorf("expected the fan-out layout to be preserved, got %q", out)
+	}
+}
+
+func TestAppendNotesEmpty(t *testing.T) {
+	repo := setupTestRepo(t)
+	hash, _ := repo.GetCommitHash("HEAD")
+	if err := repo.AppendNotes("refs/notes/test", map[string][]Note{hash: nil}); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := repo.GetNotesCommit("refs/notes/test"); err != nil || commit != "" {
+		t.Errorf("expected no notes commit to be written, got %q, %v", commit, err)
+	}
+	if err := (&GitRepo{Path: t.TempDir()}).AppendNotes("refs/notes/test", nil); err != errNotInitialized {
+		t.Errorf("expected errNotInitialized, got %v", err)
+	}
+}
+
+func TestAppendNotesConcurrentUpdate(t *testing.T) {
+	repo := setupTestRepo(t)
+	hash, _ := repo.GetCommitHash("HEAD")
+	if err := repo.AppendNote("refs/notes/test", hash, Note("first")); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate another writer moving the ref after the existing notes were
+	// read, by doing so when the new notes commit is stored.
+	orig := storeObject
+	defer func() { storeObject = orig }()
+	storeObject = func(r *GitRepo, obj plumbing.EncodedObject) (plumbing.Hash, error) {
+		if obj.Type() == plumbing.CommitObject {
+			storeObject = orig
+			gitRun(t, r.Path, "notes", "--ref=refs/notes/test", "append", "-m", "concurrent", hash)
+		}
+		return orig(r, obj)
+	}
+	if err := repo.AppendNotes("refs/notes/test", map[string][]Note{hash: {Note("batched")}}); err != nil {
+		t.Fatal(err)
+	}
+	notes := repo.GetNotes("refs/notes/test", hash)
+	if len(notes) < 3 || string(notes[0]) != "first" || string(notes[len(notes)-2]) != "concurrent" || string(notes[len(notes)-1]) != "batched" {
+		t.Errorf("expected the notes to be rebuilt on top of the concurrent note, got %q", notes)
+	}
+}
+
+func TestAppendNotesConcurrentUpdateGivesUp(t *testing.T) {
+	repo := setupTestRepo(t)
+	hash, _ := repo.GetCommitHash("HEAD")
+	if err := repo.AppendNote("refs/notes/test", hash, Note("first")); err != nil {
+		t.Fatal(err)
+	}
+	orig := storeObject
+	defer func() { storeObject = orig }()
+	attempts := 0
+	storeObject = func(r *GitRepo, obj plumbing.EncodedObject) (plumbing.Hash, error) {
+		if obj.Type() == plumbing.CommitObject {
+			attempts++
+			gitRun(t, r.Path, "notes", "--ref=refs/notes/test", "append", "-m", fmt.Sprintf("concurrent %d", attempts), hash)
+		}
+		return orig(r, obj)
+	}
+	err := repo.AppendNotes("refs/notes/test", map[string][]Note{hash: {Note("batched")}})
+	if !errors.Is(err, storage.ErrReferenceHasChanged) {
+		t.Errorf("expected the concurrent change to be reported, got %v", err)
+	}
+	if attempts != maxAppendAttempts {
+		t.Errorf("expected %d attempts, got %d", maxAppendAttempts, attempts)
+	}
+	for _, note := range repo.GetNotes("refs/notes/test", hash) {
+		if string(note) == "batched" {
+			t.Error("expected none of the notes to be written")
+		}
+	}
+}
+
 func TestFetchNilGogit(t *testing.T) {
 	repo := &GitRepo{Path: t.TempDir()}
 	err := repo.Fetch("origin", "refs/heads/*:refs/remotes/origin/*")
@@ -4435,7 +5232,7 @@ func TestBuildNotesTreeFanout(t *testing.T) {
 	blobHash2, _ := repo.StoreBlob("second fanout note\n")
 	blobPlumb2 := plumbing.NewHash(blobHash2)
 
-	newTreeHash, err := repo.buildNotesTree(topTree, hash2, blobPlumb2)
+	newTreeHash, err := repo.buildNotesTree(topTree, map[string]plumbing.Hash{hash2: blobPlumb2})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -4479,7 +5276,7 @@ func TestBuildNotesTreeFanoutSamePrefix(t *testing.T) {
 	// Build with same revision (replace existing entry, keep other).
 	newBlobHash, _ := repo.StoreBlob("replacement note\n")
 	newBlobPlumb := plumbing.NewHash(newBlobHash)
-	newTreeHash, err := repo.buildNotesTree(loaded, hash, newBlobPlumb)
+	newTreeHash, err := repo.buildNotesTree(loaded, map[string]plumbing.Hash{hash: newBlobPlumb})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -4507,7 +5304,7 @@ func TestBuildNotesTreeFanoutStoreError(t *testing.T) {
 
 	newBlobHash, _ := repo.StoreBlob("new note\n")
 	newBlobPlumb := plumbing.NewHash(newBlobHash)
-	_, err := repo.buildNotesTree(topTree, hash, newBlobPlumb)
+	_, err := repo.buildNotesTree(topTree, map[string]plumbing.Hash{hash: newBlobPlumb})
 	if err == nil {
 		t.Error("expected error from buildNotesTree when storeObject fails")
 	}
@@ -4552,7 +5349,7 @@ func TestBuildNotesTreeFanoutNewPrefixStoreError(t *testing.T) {
 
 	newBlobHash, _ := repo.StoreBlob("new\n")
 	newBlobPlumb := plumbing.NewHash(newBlobHash)
-	_, err = repo.buildNotesTree(loaded, hash, newBlobPlumb)
+	_, err = repo.buildNotesTree(loaded, map[string]plumbing.Hash{hash: newBlobPlumb})
 	if err == nil {
 		t.Error("expected error from buildNotesTree when new prefix subtree store fails")
 	}
@@ -4628,13 +5425,9 @@ func TestGetNotesReadBlobContentError(t *testing.T) {
 		t.Error("expected nil notes when blob is unreadable")
 	}
 
-	// GetAllNotes should skip entries with unreadable blobs.
-	allNotes, err := repo.GetAllNotes("refs/notes/badblob")
-	if err != nil {
-		t.Fatal(err)
-	}
-	if len(allNotes) != 0 {
-		t.Error("expected no notes when blob is unreadable")
+	// GetAllNotes should fail rather than return a partial set of notes.
+	if allNotes, err := repo.GetAllNotes("refs/notes/badblob"); err == nil {
+		t.Errorf("expected an error when a blob is unreadable, got %v", allNotes)
 	}
 }
 
@@ -4780,3 +5573,707 @@ func TestDiffTreeNamesFromNameBranch(t *testing.T) {
 	}
 	_ = hash1
 }
+
+func TestConfigValuesExecError(t *testing.T) {
+	repo := setupTestRepo(t)
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		if len(cmd.Args) > 1 && cmd.Args[1] == "config" {
+			return fmt.Errorf("injected config failure")
+		}
+		return cmd.Run()
+	})
+	if _, err := repo.GetConfigValues("appraise.test"); err == nil {
+		t.Error("expected error from GetConfigValues")
+	}
+	if err := repo.RemoveConfigValue("appraise.test", "value"); err == nil {
+		t.Error("expected error from RemoveConfigValue")
+	}
+}
+
+func TestGitRepoDiffNotes(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/test"
+	if err := repo.AppendNote(ref, head, Note("first")); err != nil {
+		t.Fatal(err)
+	}
+	before := gitRun(t, repo.Path, "rev-parse", ref)
+	addCommit(t, repo, "second.txt", "second", "second commit")
+	second := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	if err := repo.AppendNote(ref, head, Note("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(ref, second, Note("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := repo.DiffNotes(before, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("expected two differences, got %+v", diffs)
+	}
+	for _, diff := range diffs {
+		switch diff.Revision {
+		case head:
+			if len(diff.Old) != 1 || len(diff.New) != 2 || string(diff.New[1]) != "second" {
+				t.Errorf("unexpected diff %+v", diff)
+			}
+		case second:
+			if diff.Old != nil || len(diff.New) != 1 {
+				t.Errorf("unexpected diff %+v", diff)
+			}
+		default:
+			t.Errorf("unexpected revision %q", diff.Revision)
+		}
+	}
+
+	if diffs, err := repo.DiffNotes(ref, ref); err != nil || len(diffs) != 0 {
+		t.Errorf("expected no differences, got %+v, %v", diffs, err)
+	}
+	diffs, err = repo.DiffNotes("", before)
+	if err != nil || len(diffs) != 1 || diffs[0].Revision != head {
+		t.Errorf("unexpected diffs %+v, %v", diffs, err)
+	}
+	if _, err := repo.DiffNotes("refs/notes/missing", ref); err == nil {
+		t.Error("expected an error for a missing ref")
+	}
+	if _, err := repo.DiffNotes(ref, "refs/notes/missing"); err == nil {
+		t.Error("expected an error for a missing ref")
+	}
+}
+
+func TestGitRepoGetNotesCommit(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/test"
+	if commit, err := repo.GetNotesCommit(ref); err != nil || commit != "" {
+		t.Errorf("expected no commit for a missing ref, got %q, %v", commit, err)
+	}
+	if err := repo.AppendNote(ref, head, Note("first")); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.GetNotesCommit(ref)
+	if err != nil || commit != gitRun(t, repo.Path, "rev-parse", ref) {
+		t.Errorf("unexpected commit %q, %v", commit, err)
+	}
+	if _, err := (&GitRepo{}).GetNotesCommit(ref); err == nil {
+		t.Error("expected an error for an uninitialized repo")
+	}
+}
+
+func TestGitRepoDiffNotesFanout(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	tree, err := repo.StoreTree(map[string]TreeChild{head[2:]: NewBlob("note\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nest the notes under a fan-out directory, next to a submodule entry
+	// that does not hold any notes.
+	cmd := exec.Command("git", "mktree")
+	cmd.Dir = repo.Path
+	cmd.Stdin = strings.NewReader("040000 tree " + tree + "\t" + head[:2] + "\n160000 commit " + head + "\tmodule\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := gitRun(t, repo.Path, "commit-tree", strings.TrimSpace(string(out)), "-m", "notes")
+	diffs, err := repo.DiffNotes("", commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Revision != head || string(diffs[0].New[0]) != "note" {
+		t.Errorf("unexpected diffs %+v", diffs)
+	}
+
+	// Moving the notes out of the fan-out directory does not change them.
+	flatTree, err := repo.StoreTree(map[string]TreeChild{head: NewBlob("note\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := gitRun(t, repo.Path, "commit-tree", flatTree, "-m", "flat notes")
+	if diffs, err := repo.DiffNotes(flat, commit); err != nil || len(diffs) != 0 {
+		t.Errorf("expected no differences, got %+v, %v", diffs, err)
+	}
+}
+
+func TestGitRepoDiffNotesReadBlobError(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/test"
+	if err := repo.AppendNote(ref, head, Note("first")); err != nil {
+		t.Fatal(err)
+	}
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		if len(cmd.Args) > 1 && cmd.Args[1] == "cat-file" {
+			return fmt.Errorf("injected cat-file failure")
+		}
+		return cmd.Run()
+	})
+	if _, err := repo.DiffNotes("", ref); err == nil {
+		t.Error("expected an error reading the new notes")
+	}
+	if _, err := repo.DiffNotes(ref, ""); err == nil {
+		t.Error("expected an error reading the old notes")
+	}
+}
+
+func TestGitRepoDiffNotesMalformedBatch(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/test"
+	if err := repo.AppendNote(ref, head, Note("first")); err != nil {
+		t.Fatal(err)
+	}
+	for _, output := range []string{"", "abc missing\n", "abc blob x\nfirst\n", "abc blob 100\nfirst\n"} {
+		withExecHook(t, func(cmd *exec.Cmd) error {
+			if len(cmd.Args) > 1 && cmd.Args[1] == "cat-file" {
+				_, err := io.WriteString(cmd.Stdout, output)
+				return err
+			}
+			return cmd.Run()
+		})
+		if _, err := repo.DiffNotes("", ref); err == nil {
+			t.Errorf("expected an error for the output %q", output)
+		}
+	}
+}
+
+func TestGitRepoRewriteNotesHistory(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	addCommit(t, repo, "second.txt", "second", "second commit")
+	second := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/test"
+	for _, note := range []struct{ revision, contents string }{
+		{head, "secret"}, {head, "other"}, {second, "unrelated"},
+	} {
+		if err := repo.AppendNote(ref, note.revision, Note(note.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := gitRun(t, repo.Path, "rev-list", "--max-parents=0", ref)
+
+	// Add a commit with a fan-out tree, and a merge on top of that. This
+	// also moves the original notes for the first commit to the second.
+	blob := gitRun(t, repo.Path, "rev-parse", ref+":"+head)
+	subtree, err := repo.StoreTree(map[string]TreeChild{head[2:]: NewBlob("secret\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "mktree")
+	cmd.Dir = repo.Path
+	cmd.Stdin = strings.NewReader("040000 tree " + subtree + "\t" + head[:2] + "\n100644 blob " + blob + "\t" + second + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := strings.TrimSpace(string(out))
+	fanout := gitRun(t, repo.Path, "commit-tree", tree, "-p", ref, "-m", "fan-out")
+	merge := gitRun(t, repo.Path, "commit-tree", tree, "-p", fanout, "-p", first, "-m", "merge")
+	gitRun(t, repo.Path, "update-ref", ref, merge)
+	messages := gitRun(t, repo.Path, "log", "--format=%s%n%an%n%ad", ref)
+
+	rewritten, err := repo.RewriteNotesHistory(ref, map[string]Note{"secret": Note("[redacted]")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != 5 {
+		t.Errorf("expected every commit to be rewritten, got %d", rewritten)
+	}
+	for _, commit := range strings.Fields(gitRun(t, repo.Path, "rev-list", ref)) {
+		cmd := exec.Command("git", "grep", "-q", "secret", commit)
+		cmd.Dir = repo.Path
+		if err := cmd.Run(); err == nil {
+			t.Errorf("expected the notes in %s to be rewritten", commit)
+		}
+	}
+	if got := gitRun(t, repo.Path, "log", "--format=%s%n%an%n%ad", ref); got != messages {
+		t.Errorf("expected the commit metadata to be unchanged, got %q, want %q", got, messages)
+	}
+	notes := repo.GetNotes(ref, second)
+	if len(notes) != 2 || string(notes[0]) != "[redacted]" || string(notes[1]) != "other" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+
+	before := gitRun(t, repo.Path, "rev-parse", ref)
+	if rewritten, err := repo.RewriteNotesHistory(ref, map[string]Note{"secret": Note("[redacted]")}); err != nil || rewritten != 0 {
+		t.Errorf("expected nothing to be rewritten, got %d, %v", rewritten, err)
+	}
+	if after := gitRun(t, repo.Path, "rev-parse", ref); after != before {
+		t.Errorf("expected the ref to be unchanged, got %s, want %s", after, before)
+	}
+	if rewritten, err := repo.RewriteNotesHistory("refs/notes/missing", nil); err != nil || rewritten != 0 {
+		t.Errorf("expected nothing to be rewritten for a missing ref, got %d, %v", rewritten, err)
+	}
+}
+
+func TestGitRepoRewriteNotesHistoryErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/test"
+	if err := repo.AppendNote(ref, head, Note("secret")); err != nil {
+		t.Fatal(err)
+	}
+	replacements := map[string]Note{"secret": Note("[redacted]")}
+
+	for _, objectType := range []plumbing.ObjectType{plumbing.BlobObject, plumbing.TreeObject, plumbing.CommitObject} {
+		old := storeObject
+		storeObject = func(repo *GitRepo, obj plumbing.EncodedObject) (plumbing.Hash, error) {
+			if obj.Type() == objectType {
+				return plumbing.ZeroHash, fmt.Errorf("injected write failure")
+			}
+			return repo.gogit.Storer.SetEncodedObject(obj)
+		}
+		if _, err := repo.RewriteNotesHistory(ref, replacements); err == nil {
+			t.Errorf("expected an error writing a %s", objectType)
+		}
+		storeObject = old
+	}
+
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		if len(cmd.Args) > 1 && cmd.Args[1] == "rev-list" {
+			return fmt.Errorf("injected rev-list failure")
+		}
+		return cmd.Run()
+	})
+	if _, err := repo.RewriteNotesHistory(ref, replacements); err == nil {
+		t.Error("expected an error listing the notes history")
+	}
+
+	if _, err := (&GitRepo{}).RewriteNotesHistory(ref, replacements); err == nil {
+		t.Error("expected an error for an uninitialized repo")
+	}
+}
+
+// gitRunAt runs a git command as of the given date, so that any commits it
+// creates have that date.
+func gitRunAt(t *testing.T, dir, date string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_AUTHOR_DATE="+date,
+		"GIT_COMMITTER_NAME=Test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_COMMITTER_DATE="+date,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+var compactCutoff = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// addDatedNotes appends a note for each of the given dates to the given
+// revision, and returns the resulting notes commits.
+func addDatedNotes(t *testing.T, repo *GitRepo, ref, revision string, dates ...string) []string {
+	t.Helper()
+	var commits []string
+	for _, date := range dates {
+		gitRunAt(t, repo.Path, date, "notes", "--ref", ref, "append", "-m", "note from "+date, revision)
+		commits = append(commits, gitRun(t, repo.Path, "rev-parse", ref))
+	}
+	return commits
+}
+
+func TestGitRepoCompactNotes(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/discuss"
+	old := addDatedNotes(t, repo, ref, head, "2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z", "2020-01-03T00:00:00Z")
+	addDatedNotes(t, repo, ref, head, "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+	gitRun(t, repo.Path, "update-ref", "refs/notes/devtools/copy", ref)
+	notes := repo.GetNotes(ref, head)
+	messages := gitRun(t, repo.Path, "log", "-2", "--format=%s%n%an%n%cd", ref)
+
+	compacted, err := repo.CompactNotes("refs/notes/devtools/*", compactCutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compacted) != 2 || compacted[0] != "refs/notes/devtools/copy" || compacted[1] != ref {
+		t.Fatalf("unexpected compacted refs %v", compacted)
+	}
+	if got := repo.GetNotes(ref, head); len(got) != len(notes) || string(got[0]) != string(notes[0]) || string(got[4]) != string(notes[4]) {
+		t.Errorf("expected the notes to be unchanged, got %q, want %q", got, notes)
+	}
+	commits := strings.Fields(gitRun(t, repo.Path, "rev-list", ref))
+	if len(commits) != 3 {
+		t.Fatalf("expected the history to be compacted to 3 commits, got %v", commits)
+	}
+	snapshot := commits[2]
+	if got, want := gitRun(t, repo.Path, "rev-parse", snapshot+"^{tree}"), gitRun(t, repo.Path, "rev-parse", old[2]+"^{tree}"); got != want {
+		t.Errorf("expected the snapshot to have the notes of %s, got tree %s, want %s", old[2], got, want)
+	}
+	if got := gitRun(t, repo.Path, "log", "-1", "--format=%(trailers:key=Compacted-from,valueonly)", snapshot); got != old[2] {
+		t.Errorf("expected the snapshot to record its base %s, got %q", old[2], got)
+	}
+	if got := gitRun(t, repo.Path, "log", "-2", "--format=%s%n%an%n%cd", ref); got != messages {
+		t.Errorf("expected the later commits to be unchanged, got %q, want %q", got, messages)
+	}
+	if got, want := gitRun(t, repo.Path, "rev-parse", "refs/notes/devtools/copy"), commits[0]; got != want {
+		t.Errorf("expected compacting the same history to produce the same commits, got %s, want %s", got, want)
+	}
+
+	// There is nothing left to compact before the same cutoff, nor before
+	// the first note.
+	for _, before := range []time.Time{compactCutoff, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		if compacted, err := repo.CompactNotes("refs/notes/devtools/*", before); err != nil || len(compacted) != 0 {
+			t.Errorf("expected nothing to compact before %v, got %v, %v", before, compacted, err)
+		}
+	}
+
+	// Compacting everything leaves just the snapshot.
+	if _, err := repo.CompactNotes(ref, time.Now()); err == nil {
+		t.Error("expected an error for an unsupported ref pattern")
+	}
+	if _, err := repo.CompactNotes("refs/notes/devtools/*", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if commits := strings.Fields(gitRun(t, repo.Path, "rev-list", ref)); len(commits) != 1 {
+		t.Errorf("expected the history to be compacted to 1 commit, got %v", commits)
+	}
+	if got := repo.GetNotes(ref, head); len(got) != len(notes) {
+		t.Errorf("expected the notes to be unchanged, got %q, want %q", got, notes)
+	}
+}
+
+func TestGitRepoCompactArchives(t *testing.T) {
+	repo := setupTestRepo(t)
+	tree := gitRun(t, repo.Path, "rev-parse", "HEAD^{tree}")
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	var reviews []string
+	for i := range 4 {
+		reviews = append(reviews, gitRun(t, repo.Path, "commit-tree", tree, "-p", head, "-m", fmt.Sprintf("review %d", i)))
+	}
+	const ref = "refs/devtools/archives/reviews"
+	const date = "2020-01-01T00:00:00Z"
+	first := gitRunAt(t, repo.Path, date, "commit-tree", tree, "-p", reviews[0], "-m", archiveSummaryPrefix+reviews[0])
+	second := gitRunAt(t, repo.Path, date, "commit-tree", tree, "-p", first, "-p", reviews[1], "-m", archiveSummaryPrefix+reviews[1])
+	remote := gitRunAt(t, repo.Path, date, "commit-tree", tree, "-p", reviews[2], "-m", archiveSummaryPrefix+reviews[2])
+	other := gitRunAt(t, repo.Path, date, "commit-tree", tree, "-p", head, "-m", "unknown")
+	merge := gitRunAt(t, repo.Path, date, "commit-tree", tree, "-p", remote, "-p", second, "-p", other, "-m", mergeArchivesSummary)
+	latest := gitRunAt(t, repo.Path, "2024-01-01T00:00:00Z", "commit-tree", tree, "-p", merge, "-p", reviews[3], "-m", archiveSummaryPrefix+reviews[3])
+	gitRun(t, repo.Path, "update-ref", ref, latest)
+
+	compacted, err := repo.CompactArchives("refs/devtools/archives/*", compactCutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compacted) != 1 || compacted[0] != ref {
+		t.Fatalf("unexpected compacted refs %v", compacted)
+	}
+	for _, commit := range append(reviews, other) {
+		if isAncestor, err := repo.IsAncestor(commit, ref); err != nil || !isAncestor {
+			t.Errorf("expected %s to remain archived, got %v", commit, err)
+		}
+	}
+	parents := strings.Fields(gitRun(t, repo.Path, "log", "-1", "--format=%P", ref))
+	if len(parents) != 2 || parents[1] != reviews[3] {
+		t.Fatalf("unexpected parents %v of the latest archive commit", parents)
+	}
+	snapshotParents := strings.Fields(gitRun(t, repo.Path, "log", "-1", "--format=%P", parents[0]))
+	if len(snapshotParents) != 4 {
+		t.Errorf("expected the snapshot to have the archived commits as parents, got %v", snapshotParents)
+	}
+	if count := gitRun(t, repo.Path, "rev-list", "--count", "--min-parents=2", ref); count != "2" {
+		t.Errorf("expected only the snapshot and latest archive commits to remain, got %s merges", count)
+	}
+}
+
+func TestGitRepoCompactNotesErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/discuss"
+	addDatedNotes(t, repo, ref, head, "2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z", "2024-01-01T00:00:00Z")
+
+	old := storeObject
+	storeObject = func(repo *GitRepo, obj plumbing.EncodedObject) (plumbing.Hash, error) {
+		return plumbing.ZeroHash, fmt.Errorf("store failed")
+	}
+	_, err := repo.CompactNotes("refs/notes/devtools/*", compactCutoff)
+	storeObject = old
+	if err == nil {
+		t.Error("expected an error storing the snapshot")
+	}
+
+	// Fail storing the rewritten commits, rather than the snapshot.
+	stored := 0
+	storeObject = func(repo *GitRepo, obj plumbing.EncodedObject) (plumbing.Hash, error) {
+		if stored++; stored > 1 {
+			return plumbing.ZeroHash, fmt.Errorf("store failed")
+		}
+		return old(repo, obj)
+	}
+	_, err = repo.CompactNotes("refs/notes/devtools/*", compactCutoff)
+	storeObject = old
+	if err == nil {
+		t.Error("expected an error storing a rewritten commit")
+	}
+
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		return fmt.Errorf("rev-list failed")
+	})
+	if _, err := repo.CompactNotes("refs/notes/devtools/*", compactCutoff); err == nil {
+		t.Error("expected an error listing the commits to rewrite")
+	}
+}
+
+// cloneTestRepo clones the given remote into a new repo.
+func cloneTestRepo(t *testing.T, remoteDir string) *GitRepo {
+	t.Helper()
+	dir := t.TempDir()
+	gitRun(t, dir, "clone", remoteDir, ".")
+	repo, err := NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestGitRepoPullCompactedNotesAndArchive(t *testing.T) {
+	repo, remoteDir := setupTestRepoWithRemote(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	tree := gitRun(t, repo.Path, "rev-parse", "HEAD^{tree}")
+	const notesRef = "refs/notes/devtools/discuss"
+	const archiveRef = "refs/devtools/archives/reviews"
+	addDatedNotes(t, repo, notesRef, head, "2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z")
+	review := gitRun(t, repo.Path, "commit-tree", tree, "-p", head, "-m", "review")
+	archive := gitRunAt(t, repo.Path, "2020-01-01T00:00:00Z", "commit-tree", tree, "-p", review, "-m", archiveSummaryPrefix+review)
+	gitRun(t, repo.Path, "update-ref", archiveRef, archive)
+	if err := repo.PushNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another clone adds notes and archives, before the history is compacted
+	// and force-pushed.
+	other := cloneTestRepo(t, remoteDir)
+	if err := other.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	addDatedNotes(t, other, notesRef, head, "2024-01-01T00:00:00Z")
+	otherReview := gitRun(t, other.Path, "commit-tree", tree, "-p", head, "-m", "other review")
+	if err := other.ArchiveRef(otherReview, archiveRef); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.CompactNotes("refs/notes/devtools/*", compactCutoff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CompactArchives("refs/devtools/archives/*", compactCutoff); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, repo.Path, "push", "--force", "origin", "refs/notes/devtools/*:refs/notes/devtools/*", "refs/devtools/archives/*:refs/devtools/archives/*")
+
+	// Pulling compacts the other clone's history in the same way, rather
+	// than merging the squashed history back in.
+	if err := other.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{notesRef, archiveRef} {
+		compactedHistory := gitRun(t, repo.Path, "rev-parse", ref)
+		if isAncestor, err := other.IsAncestor(compactedHistory, ref); err != nil || !isAncestor {
+			t.Errorf("%s: expected the compacted history to be merged in, got %v", ref, err)
+		}
+	}
+	if count := gitRun(t, other.Path, "rev-list", "--count", notesRef); count != "4" {
+		t.Errorf("expected the snapshot, the other clone's note, and the merge, got %s commits", count)
+	}
+	if notes := other.GetNotes(notesRef, head); len(notes) != 3 {
+		t.Errorf("expected every note to be kept, got %q", notes)
+	}
+	for _, commit := range []string{review, otherReview} {
+		if isAncestor, err := other.IsAncestor(commit, archiveRef); err != nil || !isAncestor {
+			t.Errorf("expected %s to remain archived, got %v", commit, err)
+		}
+	}
+	if count := gitRun(t, other.Path, "rev-list", "--count", "--grep", "^"+archiveSummaryPrefix, archiveRef); count != "1" {
+		t.Errorf("expected only the other clone's archive commit to be kept, got %s", count)
+	}
+}
+
+func TestGitRepoAdoptCompactionUnknownBase(t *testing.T) {
+	repo := setupTestRepo(t)
+	head := gitRun(t, repo.Path, "rev-parse", "HEAD")
+	const ref = "refs/notes/devtools/discuss"
+	const remoteRef = "refs/notes/remotes/origin/devtools/discuss"
+	addDatedNotes(t, repo, ref, head, "2020-01-01T00:00:00Z")
+	local := gitRun(t, repo.Path, "rev-parse", ref)
+
+	// A snapshot replacing history that the local ref never included is
+	// merged as usual.
+	tree := gitRun(t, repo.Path, "rev-parse", ref+"^{tree}")
+	snapshot := gitRun(t, repo.Path, "commit-tree", tree, "-m", "Compact\n\n"+compactedFromTrailer+head)
+	gitRun(t, repo.Path, "update-ref", remoteRef, snapshot)
+	if err := repo.mergeNotesRef(ref, remoteRef); err != nil {
+		t.Fatal(err)
+	}
+	if got := gitRun(t, repo.Path, "rev-parse", ref+"^1"); got != local {
+		t.Errorf("expected the local history to be kept, got %s, want %s", got, local)
+	}
+
+	withExecHook(t, func(cmd *exec.Cmd) error {
+		return fmt.Errorf("rev-list failed")
+	})
+	if err := repo.mergeNotesRef(ref, remoteRef); err == nil {
+		t.Error("expected an error listing the remote commits")
+	}
+	if err := repo.mergeArchives(ref, remoteRef); err == nil {
+		t.Error("expected an error listing the remote archive commits")
+	}
+}
+
+func TestIsReviewRef(t *testing.T) {
+	for ref, want := range map[string]bool{
+		"refs/notes/devtools/reviews":                true,
+		"refs/notes/security/discuss":                true,
+		"refs/notes/remotes/origin/devtools/reviews": false,
+		"refs/notes/":                                false,
+		"refs/devtools/archives/reviews":             true,
+		"refs/devtools/security/archives/reviews":    true,
+		"refs/devtools/other":                        false,
+		"refs/remoteDevtools/origin/archives/x":      false,
+		"refs/heads/main":                            false,
+	} {
+		if got := IsReviewRef(ref); got != want {
+			t.Errorf("IsReviewRef(%q) = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+func TestGitRepoMergeReviewRef(t *testing.T) {
+	repo := setupTestRepo(t)
+	headHash, _ := repo.GetCommitHash("HEAD")
+	const notesRef = "refs/notes/devtools/reviews"
+	const incomingRef = "refs/notes/incoming/reviews"
+	notes := func() []string {
+		t.Helper()
+		var notes []string
+		for _, note := range repo.GetNotes(notesRef, headHash) {
+			notes = append(notes, string(note))
+		}
+		return notes
+	}
+
+	// A new ref is created as is.
+	gitRun(t, repo.Path, "notes", "--ref", incomingRef, "add", "-m", "first", headHash)
+	if err := repo.MergeReviewRef(notesRef, incomingRef); err != nil {
+		t.Fatal(err)
+	}
+	incomingHash, _ := repo.GetCommitHash(incomingRef)
+	if got, _ := repo.GetCommitHash(notesRef); got != incomingHash {
+		t.Errorf("new notes ref = %s, want %s", got, incomingHash)
+	}
+
+	// A descendant is fast-forwarded to.
+	gitRun(t, repo.Path, "notes", "--ref", incomingRef, "append", "-m", "second", headHash)
+	if err := repo.MergeReviewRef(notesRef, incomingRef); err != nil {
+		t.Fatal(err)
+	}
+	incomingHash, _ = repo.GetCommitHash(incomingRef)
+	if got, _ := repo.GetCommitHash(notesRef); got != incomingHash {
+		t.Errorf("fast-forwarded notes ref = %s, want %s", got, incomingHash)
+	}
+
+	// An ancestor changes nothing.
+	gitRun(t, repo.Path, "update-ref", incomingRef, incomingRef+"^")
+	if err := repo.MergeReviewRef(notesRef, incomingRef); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := repo.GetCommitHash(notesRef); got != incomingHash {
+		t.Errorf("notes ref after merging an ancestor = %s, want %s", got, incomingHash)
+	}
+
+	// Diverged notes are merged.
+	gitRun(t, repo.Path, "notes", "--ref", incomingRef, "append", "-m", "third", headHash)
+	if err := repo.MergeReviewRef(notesRef, incomingRef); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := notes(), []string{"first", "second", "third"}; !slices.Equal(got, want) {
+		t.Errorf("merged notes = %q, want %q", got, want)
+	}
+}
+
+func TestGitRepoMergeReviewRefArchive(t *testing.T) {
+	repo := setupTestRepo(t)
+	const archiveRef = "refs/devtools/archives/reviews"
+	const incomingRef = "refs/appraise/incoming/archives/reviews"
+	if err := repo.ArchiveRef("refs/heads/main", incomingRef); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.MergeReviewRef(archiveRef, incomingRef); err != nil {
+		t.Fatal(err)
+	}
+	incomingHash, _ := repo.GetCommitHash(incomingRef)
+	if got, _ := repo.GetCommitHash(archiveRef); got != incomingHash {
+		t.Errorf("archive ref = %s, want %s", got, incomingHash)
+	}
+}
+
+func TestGitRepoMergeReviewRefErrors(t *testing.T) {
+	repo := setupTestRepo(t)
+	headHash, _ := repo.GetCommitHash("HEAD")
+	const notesRef = "refs/notes/devtools/reviews"
+	const incomingRef = "refs/notes/incoming/reviews"
+	if err := repo.MergeReviewRef("refs/heads/main", "HEAD"); err == nil || !strings.Contains(err.Error(), "not a review ref") {
+		t.Errorf("MergeReviewRef(branch) error = %v", err)
+	}
+	if err := repo.MergeReviewRef(notesRef, incomingRef); err == nil {
+		t.Error("expected an error for a missing incoming ref")
+	}
+	if err := (&GitRepo{}).MergeReviewRef(notesRef, "HEAD"); err == nil {
+		t.Error("expected an error for an uninitialized repo")
+	}
+
+	// The local notes ref holds something other than a commit.
+	gitRun(t, repo.Path, "notes", "--ref", incomingRef, "add", "-m", "note", headHash)
+	blob := strings.TrimSpace(gitRun(t, repo.Path, "rev-parse", "HEAD:file.txt"))
+	gitRun(t, repo.Path, "update-ref", notesRef, blob)
+	if err := repo.MergeReviewRef(notesRef, incomingRef); err == nil {
+		t.Error("expected an error for a corrupt notes ref")
+	}
+}
+
+func TestGitRepoWithContext(t *testing.T) {
+	repo := setupTestRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := repo.WithContext(ctx)
+	if _, err := bound.GetCommitHash("HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := bound.runGitCommand("rev-parse", "HEAD"); !errors.Is(err, context.Canceled) {
+		t.Errorf("running a command after canceling = %v", err)
+	}
+	if _, err := bound.runSigningProgram(nil, "true"); !errors.Is(err, context.Canceled) {
+		t.Errorf("running a signing program after canceling = %v", err)
+	}
+	// The original repo is not bound to the context.
+	if _, err := repo.runGitCommand("rev-parse", "HEAD"); err != nil {
+		t.Error(err)
+	}
+
+	store := setupTestRepo(t)
+	namespaced, err := NewNamespacedRepo(NewSidecarRepo(repo, store), "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundRepo := WithContext(ctx, namespaced).(*NamespacedRepo)
+	sidecar := boundRepo.Repo.(*SidecarRepo)
+	if sidecar.code.ctx != ctx || sidecar.store.ctx != ctx || !slices.Equal(boundRepo.Namespaces(), namespaced.Namespaces()) {
+		t.Errorf("WithContext() = %+v", boundRepo)
+	}
+	if namespaced.Repo.(*SidecarRepo).code.ctx != nil {
+		t.Error("WithContext() bound the original repo")
+	}
+	mock := NewMockRepoForTest()
+	if WithContext(ctx, mock) != mock {
+		t.Error("WithContext() changed the mock repo")
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notesLockFile is the name of the file, in the repo's data dir, that is
+// created while notes or archives are being written, so that git-appraise
+// processes writing to the same repo (e.g. the web UI, a bot and the CLI)
+// take turns rather than racing to update the review refs.
+const notesLockFile = "appraise-notes.lock"
+
+var (
+	// lockTimeout is how long to wait for another process to release a
+	// lock before giving up. Compacting the notes of a large repo holds the
+	// lock for a while, so this is far longer than it takes to write notes.
+	lockTimeout = 10 * time.Minute
+	// lockNoticeDelay is how long to wait for a lock before telling the
+	// user what is being waited for.
+	lockNoticeDelay = 2 * time.Second
+	// staleLockAge is how long a lock must have gone without being
+	// refreshed for it to be assumed that the process that took it died
+	// without releasing it.
+	staleLockAge = time.Minute
+	// lockPollInterval is how often to check whether a lock has been
+	// released.
+	lockPollInterval = 5 * time.Millisecond
+)
+
+// lockRefreshes is how many times a held lock is refreshed within
+// staleLockAge, so that missing a refresh or two does not make it stale.
+const lockRefreshes = 6
+
+// lockNotes takes the notes lock of the repo, waiting for any other process
+// or goroutine that holds it to release it, and returns the function that
+// releases it.
+func (repo *GitRepo) lockNotes() (func(), error) {
+	dataDir, err := repo.GetDataDir()
+	if err != nil {
+		return nil, err
+	}
+	ctx := repo.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return LockFile(ctx, filepath.Join(dataDir, notesLockFile))
+}
+
+// LockFile takes the lock at the given path, waiting for any other process or
+// goroutine that holds it to release it, and returns the function that
+// releases it.
+//
+// The lock is a file that is created exclusively, like the ".lock" files that
+// git uses for refs, so that it works on every platform and file system. It
+// holds a token that is unique to its holder, which refreshes its
+// modification time for as long as it is held.
+func LockFile(ctx context.Context, path string) (func(), error) {
+	token := fmt.Sprintf("%d %s", os.Getpid(), rand.Text())
+	start := time.Now()
+	noticed := false
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = fmt.Fprintln(f, token)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return holdLock(path, token), nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			// The holder of the lock would have refreshed it by now, so
+			// it must have been killed.
+			breakStaleLock(path)
+			continue
+		}
+		waited := time.Since(start)
+		if waited > lockTimeout {
+			return nil, fmt.Errorf("unable to take the lock %s; if no other git-appraise process is running, remove it", path)
+		}
+		if waited > lockNoticeDelay && !noticed {
+			fmt.Fprintf(os.Stderr, "Waiting for another git-appraise process to release the lock %s\n", path)
+			noticed = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// holdLock refreshes the lock at the given path, which holds the given
+// token, until the returned function is called to release it.
+//
+// If the lock stops holding the token, e.g. because the process was
+// suspended for so long that another one broke the lock, then it belongs to
+// someone else, and it is neither refreshed nor released.
+func holdLock(path, token string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(staleLockAge / lockRefreshes)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !holdsLock(path, token) {
+					return
+				}
+				now := time.Now()
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			removeLockIf(path, func(lock string) bool {
+				return holdsLock(lock, token)
+			})
+		})
+	}
+}
+
+// holdsLock reports whether the lock at the given path holds the given
+// token.
+func holdsLock(path, token string) bool {
+	contents, err := os.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(contents)) == token
+}
+
+// breakStaleLock removes the lock at the given path, if it is stale.
+func breakStaleLock(path string) {
+	removeLockIf(path, func(lock string) bool {
+		info, err := os.Stat(lock)
+		return err != nil || time.Since(info.ModTime()) > staleLockAge
+	})
+}
+
+// removeLockIf removes the lock at the given path, if the given function
+// reports that it should be.
+//
+// Other processes may take the lock again as soon as it is removed, so the
+// lock is not simply checked and then removed. It is first renamed to a
+// unique name, which only one process can do, and the lock that was renamed
+// is then checked before removing it. A lock that should not have been
+// removed is put back, unless yet another process has taken the lock since.
+func removeLockIf(path string, remove func(lock string) bool) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".removed-*")
+	if err != nil {
+		return
+	}
+	f.Close()
+	renamed := f.Name()
+	defer os.Remove(renamed)
+	if err := os.Rename(path, renamed); err != nil {
+		return
+	}
+	if !remove(renamed) {
+		os.Link(renamed, path)
+	}
+}
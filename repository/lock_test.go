@@ -0,0 +1,362 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockNotes(t *testing.T) {
+	repo := setupTestRepo(t)
+	origTimeout := lockTimeout
+	defer func() { lockTimeout = origTimeout }()
+	lockTimeout = 50 * time.Millisecond
+
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockPath := filepath.Join(repo.Path, ".git", notesLockFile)
+	if contents, err := os.ReadFile(lockPath); err != nil || len(strings.Fields(string(contents))) != 2 || strings.Fields(string(contents))[0] != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected the lock file to name this process and hold a token, got %q, %v", contents, err)
+	}
+	if _, err := repo.lockNotes(); err == nil || !strings.Contains(err.Error(), lockPath) {
+		t.Errorf("expected an error naming the lock file while it is held, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.WithContext(ctx).lockNotes(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context error while the lock is held, got %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("expected the lock file to be removed, got %v", err)
+	}
+	unlock, err = repo.lockNotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestLockNotesStale(t *testing.T) {
+	repo := setupTestRepo(t)
+	lockPath := filepath.Join(repo.Path, ".git", notesLockFile)
+	if err := os.WriteFile(lockPath, []byte("12345\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		t.Fatalf("expected the stale lock to be broken, got %v", err)
+	}
+	unlock()
+}
+
+func TestLockNotesStaleConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, notesLockFile)
+	if err := os.WriteFile(lockPath, []byte("12345\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// Every goroutine finds the stale lock, but only one holds the lock at
+	// any time.
+	var mu sync.Mutex
+	holders, maxHolders := 0, 0
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			unlock, err := LockFile(context.Background(), lockPath)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			holders++
+			maxHolders = max(maxHolders, holders)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			unlock()
+		})
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("expected the lock to be held by one goroutine at a time, got %d", maxHolders)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected no lock files to be left behind, got %v, %v", entries, err)
+	}
+}
+
+func TestLockFileHeldPastStaleAge(t *testing.T) {
+	origTimeout, origStaleAge := lockTimeout, staleLockAge
+	defer func() { lockTimeout, staleLockAge = origTimeout, origStaleAge }()
+	staleLockAge = 60 * time.Millisecond
+	lockTimeout = 5 * staleLockAge
+
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, notesLockFile)
+	unlock, err := LockFile(context.Background(), lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The holder refreshes the lock, so it is not broken however long it
+	// is held for.
+	if _, err := LockFile(context.Background(), lockPath); err == nil {
+		t.Fatal("expected the lock to be kept by its holder")
+	}
+	unlock()
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected no lock files to be left behind, got %v, %v", entries, err)
+	}
+}
+
+func TestLockFileUnlockOtherHolder(t *testing.T) {
+	origStaleAge := staleLockAge
+	defer func() { staleLockAge = origStaleAge }()
+	staleLockAge = 60 * time.Millisecond
+
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, notesLockFile)
+	unlock, err := LockFile(context.Background(), lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another process broke the lock and took it, e.g. while this one was
+	// suspended, so the lock belongs to it from then on.
+	if err := os.WriteFile(lockPath, []byte("12345 other\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * staleLockAge / lockRefreshes)
+	if info, err := os.Stat(lockPath); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("expected the other process's lock not to be refreshed, got %v, %v", info, err)
+	}
+	unlock()
+	if contents, err := os.ReadFile(lockPath); err != nil || string(contents) != "12345 other\n" {
+		t.Errorf("expected the other process's lock to be kept, got %q, %v", contents, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("expected only the other process's lock, got %v, %v", entries, err)
+	}
+	unlock()
+}
+
+func TestBreakStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, notesLockFile)
+
+	// A lock that was taken again since it was found to be stale is kept.
+	if err := os.WriteFile(lockPath, []byte("live\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	breakStaleLock(lockPath)
+	if contents, err := os.ReadFile(lockPath); err != nil || string(contents) != "live\n" {
+		t.Errorf("expected the live lock to be kept, got %q, %v", contents, err)
+	}
+
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	breakStaleLock(lockPath)
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the stale lock to be removed, got %v, %v", entries, err)
+	}
+
+	// A lock that was already broken is left alone.
+	breakStaleLock(lockPath)
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected no lock files, got %v, %v", entries, err)
+	}
+}
+
+func TestReviewRefWritersLock(t *testing.T) {
+	repo := setupTestRepo(t)
+	if out, err := exec.Command("git", "-C", repo.Path, "remote", "add", "origin", repo.Path).CombinedOutput(); err != nil {
+		t.Fatalf("git remote add failed: %v\n%s", err, out)
+	}
+	origTimeout := lockTimeout
+	defer func() { lockTimeout = origTimeout }()
+	lockTimeout = 0
+	unlock, err := repo.lockNotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	for name, write := range map[string]func() error{
+		"ArchiveRef":     func() error { return repo.ArchiveRef("HEAD", "refs/devtools/archives/reviews") },
+		"MergeNotes":     func() error { return repo.MergeNotes("origin", "refs/notes/devtools/*") },
+		"MergeArchives":  func() error { return repo.MergeArchives("origin", "refs/devtools/archives/*") },
+		"MergeReviewRef": func() error { return repo.MergeReviewRef("refs/notes/devtools/reviews", "HEAD") },
+		"PullNotesAndArchive": func() error {
+			return repo.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*")
+		},
+		"RewriteNotesHistory": func() error { _, err := repo.RewriteNotesHistory("refs/notes/devtools/reviews", nil); return err },
+		"CompactNotes":        func() error { _, err := repo.CompactNotes("refs/notes/devtools/*", time.Now()); return err },
+		"CompactArchives":     func() error { _, err := repo.CompactArchives("refs/devtools/archives/*", time.Now()); return err },
+	} {
+		if err := write(); err == nil || !strings.Contains(err.Error(), notesLockFile) {
+			t.Errorf("%s: expected an error while the notes lock is held, got %v", name, err)
+		}
+	}
+}
+
+func TestLockNotesErrors(t *testing.T) {
+	if _, err := (&GitRepo{}).lockNotes(); err != errNotInitialized {
+		t.Errorf("expected errNotInitialized, got %v", err)
+	}
+	repo := setupTestRepo(t)
+	if err := os.Rename(filepath.Join(repo.Path, ".git"), filepath.Join(repo.Path, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.lockNotes(); err == nil {
+		t.Error("expected an error when the data dir is missing")
+	}
+	if err := repo.AppendNote("refs/notes/test", "abc", Note("note")); err == nil {
+		t.Error("expected AppendNote to fail when the lock cannot be taken")
+	}
+}
+
+// appendConcurrently appends the given number of notes to the given
+// revision from each of the given repos at once, and fails the test if any
+// of them fail.
+func appendConcurrently(t *testing.T, repos []*GitRepo, revision string, count int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(repos)*count)
+	for i, repo := range repos {
+		wg.Go(func() {
+			for j := range count {
+				errs <- repo.AppendNote("refs/notes/test", revision, Note(fmt.Sprintf("writer %d note %d", i, j)))
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// checkAllNotes checks that each of the given number of writers wrote the
+// given number of notes to the given revision.
+func checkAllNotes(t *testing.T, repo *GitRepo, revision string, writers, count int) {
+	t.Helper()
+	written := make(map[string]bool)
+	for _, note := range repo.GetNotes("refs/notes/test", revision) {
+		written[string(note)] = true
+	}
+	for i := range writers {
+		for j := range count {
+			if note := fmt.Sprintf("writer %d note %d", i, j); !written[note] {
+				t.Errorf("missing note %q", note)
+			}
+		}
+	}
+	if out := gitRun(t, repo.Path, "rev-list", "--count", "refs/notes/test"); out != strconv.Itoa(writers*count) {
+		t.Errorf("expected one notes commit per note, got %s", out)
+	}
+}
+
+func TestAppendNoteConcurrentGoroutines(t *testing.T) {
+	repo := setupTestRepo(t)
+	hash, _ := repo.GetCommitHash("HEAD")
+	const writers, count = 8, 10
+	repos := make([]*GitRepo, writers)
+	for i := range repos {
+		// Half of the writers share a repo, and the rest open their own.
+		repos[i] = repo
+		if i%2 == 1 {
+			var err error
+			if repos[i], err = NewGitRepo(repo.Path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	appendConcurrently(t, repos, hash, count)
+	checkAllNotes(t, repo, hash, writers, count)
+}
+
+func TestAppendNoteConcurrentProcesses(t *testing.T) {
+	repo := setupTestRepo(t)
+	hash, _ := repo.GetCommitHash("HEAD")
+	const writers, count = 4, 10
+	var cmds []*exec.Cmd
+	for i := range writers {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAppendNoteConcurrentProcessesHelper$")
+		cmd.Env = append(os.Environ(),
+			"TEST_APPEND_NOTE_REPO="+repo.Path,
+			"TEST_APPEND_NOTE_REVISION="+hash,
+			"TEST_APPEND_NOTE_WRITER="+strconv.Itoa(i),
+			"TEST_APPEND_NOTE_COUNT="+strconv.Itoa(count))
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+	checkAllNotes(t, repo, hash, writers, count)
+}
+
+func TestAppendNoteConcurrentProcessesHelper(t *testing.T) {
+	path := os.Getenv("TEST_APPEND_NOTE_REPO")
+	if path == "" {
+		return
+	}
+	repo, err := NewGitRepo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _ := strconv.Atoi(os.Getenv("TEST_APPEND_NOTE_WRITER"))
+	count, _ := strconv.Atoi(os.Getenv("TEST_APPEND_NOTE_COUNT"))
+	for j := range count {
+		if err := repo.AppendNote("refs/notes/test", os.Getenv("TEST_APPEND_NOTE_REVISION"), Note(fmt.Sprintf("writer %d note %d", writer, j))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
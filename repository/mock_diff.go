@@ -0,0 +1,240 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// mockContextLines is the number of unchanged lines that the mock repo shows
+// around each change in a diff.
+const mockContextLines = 3
+
+// mockEdit is a single line of a line-by-line diff, prefixed with the
+// character that marks it in a unified diff.
+type mockEdit struct {
+	op   byte
+	line string
+}
+
+// splitFileLines splits file contents into lines, keeping their newlines.
+func splitFileLines(contents string) []string {
+	lines := strings.SplitAfter(contents, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffFileLines returns the shortest sequence of edits that turns the old
+// lines into the new ones, with deletions before additions.
+func diffFileLines(old, new []string) []mockEdit {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// old[i:] and new[j:].
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var edits []mockEdit
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && j < len(new) && old[i] == new[j]:
+			edits = append(edits, mockEdit{' ', old[i]})
+			i++
+			j++
+		case i < len(old) && (j == len(new) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, mockEdit{'-', old[i]})
+			i++
+		default:
+			edits = append(edits, mockEdit{'+', new[j]})
+			j++
+		}
+	}
+	return edits
+}
+
+// hunkRange formats the start and length of one side of a hunk, the way
+// that git does.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if length == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, length)
+}
+
+// funcContext returns the text that git shows after the header of a hunk
+// starting at the given line of the old file: the last line before the hunk
+// that starts with a letter, an underscore, or a dollar sign.
+func funcContext(old []string, start int) string {
+	for _, line := range slices.Backward(old[:start-1]) {
+		if c := line[0]; 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$' {
+			line = strings.TrimRightFunc(line, unicode.IsSpace)
+			return " " + line[:min(len(line), 80)]
+		}
+	}
+	return ""
+}
+
+// writeHunks writes the changed lines of the given edits of the old file,
+// along with their context, as the hunks of a unified diff.
+func writeHunks(b *strings.Builder, old []string, edits []mockEdit) {
+	// oldLine[i] and newLine[i] are the line numbers at which edits[i] starts.
+	oldLine := make([]int, len(edits)+1)
+	newLine := make([]int, len(edits)+1)
+	oldLine[0], newLine[0] = 1, 1
+	var changes []int
+	for i, e := range edits {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if e.op != '+' {
+			oldLine[i+1]++
+		}
+		if e.op != '-' {
+			newLine[i+1]++
+		}
+		if e.op != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	for len(changes) > 0 {
+		// Extend the hunk over every change whose context overlaps or
+		// abuts that of the previous one.
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*mockContextLines+1 {
+			last++
+		}
+		start := max(changes[0]-mockContextLines, 0)
+		end := min(changes[last]+mockContextLines+1, len(edits))
+		changes = changes[last+1:]
+
+		fmt.Fprintf(b, "@@ -%s +%s @@%s\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]),
+			funcContext(old, oldLine[start]))
+		for _, e := range edits[start:end] {
+			b.WriteByte(e.op)
+			b.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+}
+
+// abbrevBlob returns the abbreviated hash that the mock repo gives a blob
+// with the given contents, or all zeros if there is no such file.
+func abbrevBlob(contents string, exists bool) string {
+	if !exists {
+		return "0000000"
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(contents)))[:7]
+}
+
+// diffFiles returns a unified diff, in the format of "git diff", between
+// two sets of files keyed by their paths.
+//
+// When there is more than one shortest diff, the changed lines may be
+// grouped differently than git would group them.
+func diffFiles(oldFiles, newFiles map[string]string) string {
+	var paths []string
+	for path := range oldFiles {
+		paths = append(paths, path)
+	}
+	for path := range newFiles {
+		if _, ok := oldFiles[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	var b strings.Builder
+	for _, path := range paths {
+		oldContents, inOld := oldFiles[path]
+		newContents, inNew := newFiles[path]
+		if inOld && inNew && oldContents == newContents {
+			continue
+		}
+		oldName, newName := "a/"+path, "b/"+path
+		fmt.Fprintf(&b, "diff --git %s %s\n", oldName, newName)
+		oldIndex, newIndex := abbrevBlob(oldContents, inOld), abbrevBlob(newContents, inNew)
+		switch {
+		case !inOld:
+			oldName = "/dev/null"
+			fmt.Fprintf(&b, "new file mode 100644\nindex %s..%s\n", oldIndex, newIndex)
+		case !inNew:
+			newName = "/dev/null"
+			fmt.Fprintf(&b, "deleted file mode 100644\nindex %s..%s\n", oldIndex, newIndex)
+		default:
+			fmt.Fprintf(&b, "index %s..%s 100644\n", oldIndex, newIndex)
+		}
+		if strings.Contains(oldContents, "\x00") || strings.Contains(newContents, "\x00") {
+			fmt.Fprintf(&b, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+		if oldContents == "" && newContents == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+		oldLines := splitFileLines(oldContents)
+		writeHunks(&b, oldLines, diffFileLines(oldLines, splitFileLines(newContents)))
+	}
+	return b.String()
+}
+
+// mergeFiles performs a three-way merge of whole files. It fails if both
+// sides changed the same file, even if the changes would not overlap.
+func mergeFiles(baseFiles, ourFiles, theirFiles map[string]string) (map[string]string, error) {
+	merged := make(map[string]string)
+	paths := make(map[string]bool)
+	for _, files := range []map[string]string{baseFiles, ourFiles, theirFiles} {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+	for path := range paths {
+		baseContents, inBase := baseFiles[path]
+		ourContents, inOurs := ourFiles[path]
+		theirContents, inTheirs := theirFiles[path]
+		switch {
+		case inOurs == inTheirs && ourContents == theirContents:
+		case inBase == inOurs && baseContents == ourContents:
+			ourContents, inOurs = theirContents, inTheirs
+		case inBase != inTheirs || baseContents != theirContents:
+			return nil, fmt.Errorf("merge conflict in %q", path)
+		}
+		if inOurs {
+			merged[path] = ourContents
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// commitFiles commits the given files to the given branch of the mock repo,
+// on top of the branch's current head, and returns the new commit's hash.
+func commitFiles(t *testing.T, repo Repo, branch, message string, files map[string]string) string {
+	t.Helper()
+	var parents []string
+	if parent, err := repo.GetCommitHash(branch); err == nil {
+		parents = []string{parent}
+	}
+	tree, err := NewTreeFromFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := repo.CreateCommitWithTree(&CommitDetails{Summary: message, Parents: parents}, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef(branch, hash, ""); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// numberedLines returns the lines "line 1" through "line <n>", with the
+// given replacements.
+func numberedLines(n int, replacements map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		line, ok := replacements[i]
+		if !ok {
+			line = fmt.Sprintf("line %d", i)
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func TestMockRepoDiffFiles(t *testing.T) {
+	repo := NewEmptyMockRepoForTest()
+	first := commitFiles(t, repo, TestTargetRef, "First commit", map[string]string{
+		"long.txt": numberedLines(30, nil),
+		"del.txt":  "gone\nno newline",
+		"bin.dat":  "bin\x00ary",
+	})
+	second := commitFiles(t, repo, TestTargetRef, "Second commit", map[string]string{
+		"long.txt":  numberedLines(30, map[int]string{2: "LINE 2", 25: "LINE 25"}),
+		"bin.dat":   "bin\x00ary2",
+		"empty.txt": "",
+	})
+	want := `diff --git a/bin.dat b/bin.dat
+index 0684c7c..fa76c53 100644
+Binary files a/bin.dat and b/bin.dat differ
+diff --git a/del.txt b/del.txt
+deleted file mode 100644
+index 4a5e5d5..0000000
+--- a/del.txt
++++ /dev/null
+@@ -1,2 +0,0 @@
+-gone
+-no newline
+\ No newline at end of file
+diff --git a/empty.txt b/empty.txt
+new file mode 100644
+index 0000000..da39a3e
+diff --git a/long.txt b/long.txt
+index 46f9a53..a451441 100644
+--- a/long.txt
++++ b/long.txt
+@@ -1,5 +1,5 @@
+ line 1
+-line 2
++LINE 2
+ line 3
+ line 4
+ line 5
+@@ -22,7 +22,7 @@ line 21
+ line 22
+ line 23
+ line 24
+-line 25
++LINE 25
+ line 26
+ line 27
+ line 28
+`
+	if diff, err := repo.Diff(first, second); err != nil || diff != want {
+		t.Errorf("Diff() = %q, %v\nwant %q", diff, err, want)
+	}
+	if diff, err := repo.Diff1(second); err != nil || diff != want {
+		t.Errorf("Diff1() = %q, %v\nwant %q", diff, err, want)
+	}
+	// Trees can be diffed as well as commits.
+	details, err := repo.GetCommitDetails(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff, err := repo.Diff(second, details.Tree); err != nil || diff != "" {
+		t.Errorf("Diff(commit, tree) = %q, %v", diff, err)
+	}
+	if diff, err := repo.Diff1(first); err != nil || !strings.Contains(diff, "Binary files /dev/null and b/bin.dat differ\n") {
+		t.Errorf("Diff1(root) = %q, %v", diff, err)
+	}
+
+	diffs, err := repo.ParsedDiff(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 4 || diffs[3].NewName != "long.txt" || len(diffs[3].Fragments) != 2 {
+		t.Fatalf("unexpected parsed diff %+v", diffs)
+	}
+	fragment := diffs[3].Fragments[1]
+	if fragment.OldPosition != 22 || fragment.LinesAdded != 1 || fragment.LinesDeleted != 1 || fragment.Lines[3].Op != OpDelete || fragment.Lines[3].Line != "line 25" {
+		t.Errorf("unexpected fragment %+v", fragment)
+	}
+	if diffs, err := repo.ParsedDiff1(second); err != nil || len(diffs) != 4 {
+		t.Errorf("ParsedDiff1() = %+v, %v", diffs, err)
+	}
+}
+
+func TestMockRepoShowFiles(t *testing.T) {
+	repo := NewEmptyMockRepoForTest()
+	commit := commitFiles(t, repo, TestTargetRef, "First commit", map[string]string{"dir/a.txt": "A\n"})
+	if contents, err := repo.Show(commit, "dir/a.txt"); err != nil || contents != "A" {
+		t.Errorf("Show() = %q, %v", contents, err)
+	}
+	if _, err := repo.Show(commit, "missing.txt"); err == nil {
+		t.Error("expected an error showing a missing file")
+	}
+}
+
+func TestMockRepoMergeFiles(t *testing.T) {
+	repo := NewEmptyMockRepoForTest()
+	first := commitFiles(t, repo, TestTargetRef, "First commit", map[string]string{"README.md": "Hello\n"})
+	if err := repo.SetRef(TestReviewRef, first, ""); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, repo, TestReviewRef, "Feature commit", map[string]string{"README.md": "Hello\n", "feature.txt": "Feature\n"})
+	commitFiles(t, repo, TestTargetRef, "Second commit", map[string]string{"README.md": "Hello, world\n"})
+	if err := repo.MergeRef(TestReviewRef, false); err != nil {
+		t.Fatal(err)
+	}
+	if message, _ := repo.GetCommitMessage(TestTargetRef); message != "Merge branch 'ojarjur/mychange'" {
+		t.Errorf("unexpected merge message %q", message)
+	}
+	for path, want := range map[string]string{"README.md": "Hello, world", "feature.txt": "Feature"} {
+		if contents, err := repo.Show(TestTargetRef, path); err != nil || contents != want {
+			t.Errorf("Show(%q) = %q, %v", path, contents, err)
+		}
+	}
+
+	commitFiles(t, repo, TestReviewRef, "Conflicting commit", map[string]string{"README.md": "Conflict\n", "feature.txt": "Feature\n"})
+	if err := repo.MergeRef(TestReviewRef, false); err == nil || !strings.Contains(err.Error(), `merge conflict in "README.md"`) {
+		t.Errorf("expected a merge conflict, got %v", err)
+	}
+}
+
+func TestMockRepoRebaseFiles(t *testing.T) {
+	repo := NewEmptyMockRepoForTest()
+	first := commitFiles(t, repo, TestTargetRef, "First commit", map[string]string{"README.md": "Hello\n"})
+	if err := repo.SetRef(TestReviewRef, first, ""); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, repo, TestReviewRef, "Feature commit", map[string]string{"README.md": "Hello\n", "feature.txt": "Feature\n"})
+	target := commitFiles(t, repo, TestTargetRef, "Second commit", map[string]string{"README.md": "Hello, world\n"})
+	if err := repo.SwitchToRef(TestReviewRef); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RebaseRef(TestTargetRef); err != nil {
+		t.Fatal(err)
+	}
+	if parent, _ := repo.GetLastParent(TestReviewRef); parent != target {
+		t.Errorf("expected the rebased commit to be on %q, got %q", target, parent)
+	}
+	for path, want := range map[string]string{"README.md": "Hello, world", "feature.txt": "Feature"} {
+		if contents, err := repo.Show(TestReviewRef, path); err != nil || contents != want {
+			t.Errorf("Show(%q) = %q, %v", path, contents, err)
+		}
+	}
+}
+
+func TestDiffFileLines(t *testing.T) {
+	for _, tc := range []struct {
+		old, new string
+		want     string
+	}{
+		{"", "", ""},
+		{"a\n", "a\n", " a\n"},
+		{"a\nb\n", "b\nc\n", "-a\n b\n+c\n"},
+		{"a\nb\n", "c\n", "-a\n-b\n+c\n"},
+		{"a", "a\n", "-a+a\n"},
+	} {
+		var got strings.Builder
+		for _, e := range diffFileLines(splitFileLines(tc.old), splitFileLines(tc.new)) {
+			got.WriteByte(e.op)
+			got.WriteString(e.line)
+		}
+		if got.String() != tc.want {
+			t.Errorf("diffFileLines(%q, %q) = %q, want %q", tc.old, tc.new, got.String(), tc.want)
+		}
+	}
+}
+
+func TestFuncContext(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	old := splitFileLines("func f() {  \n\tbody\n" + long + "\n\tmore\n$var\n_under\n")
+	for start, want := range map[int]string{
+		1: "",
+		2: " func f() {",
+		3: " func f() {",
+		4: " " + long[:80],
+		5: " " + long[:80],
+		6: " $var",
+		7: " _under",
+	} {
+		if got := funcContext(old, start); got != want {
+			t.Errorf("funcContext(%d) = %q, want %q", start, got, want)
+		}
+	}
+}
+
+func TestHunkRange(t *testing.T) {
+	for _, tc := range []struct {
+		start, length int
+		want          string
+	}{
+		{1, 0, "0,0"},
+		{5, 0, "4,0"},
+		{3, 1, "3"},
+		{3, 7, "3,7"},
+	} {
+		if got := hunkRange(tc.start, tc.length); got != tc.want {
+			t.Errorf("hunkRange(%d, %d) = %q, want %q", tc.start, tc.length, got, tc.want)
+		}
+	}
+}
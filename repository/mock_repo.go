@@ -18,10 +18,15 @@ package repository
 
 import (
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"iter"
+	"maps"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 )
 
 // Constants used for testing.
@@ -75,12 +80,17 @@ type mockCommit struct {
 
 // mockRepoForTest defines an instance of Repo that can be used for testing.
 type mockRepoForTest struct {
-	Head    string
-	Refs    map[string]string               `json:"refs,omitempty"`
-	Commits map[string]mockCommit           `json:"commits,omitempty"`
-	Notes   map[string]map[string]string    `json:"notes,omitempty"`
-	Blobs   map[string]string               `json:"-"`
-	Trees   map[string]map[string]TreeChild `json:"-"`
+	Head       string
+	Refs       map[string]string               `json:"refs,omitempty"`
+	Commits    map[string]mockCommit           `json:"commits,omitempty"`
+	NotesByRef map[string]map[string]string    `json:"notes,omitempty"`
+	Blobs      map[string]string               `json:"-"`
+	Trees      map[string]map[string]TreeChild `json:"-"`
+	Config     map[string][]string             `json:"config,omitempty"`
+
+	// snapshots holds copies of notes refs, recorded by GetNotesCommit.
+	// They are not part of the repo's state.
+	snapshots map[string]map[string]string
 }
 
 func (r *mockRepoForTest) createCommit(message, time, tree string, parents []string) string {
@@ -167,7 +177,7 @@ func NewMockRepoForTest() Repo {
 			TestCommitI: commitI,
 			TestCommitJ: commitJ,
 		},
-		Notes: map[string]map[string]string{
+		NotesByRef: map[string]map[string]string{
 			TestRequestsRef: map[string]string{
 				TestCommitB: TestRequestB,
 				TestCommitD: TestRequestD,
@@ -181,6 +191,21 @@ func NewMockRepoForTest() Repo {
 	}
 }
 
+// NewEmptyMockRepoForTest returns a mocked-out instance of the Repo interface
+// that has no commits, refs, or notes, and whose HEAD points to TestTargetRef.
+//
+// Unlike the pre-populated test data, the commits written to it with
+// CreateCommitWithTree have files, which its Show, Diff, MergeRef, and
+// RebaseRef methods read and write the way git would.
+func NewEmptyMockRepoForTest() Repo {
+	return &mockRepoForTest{
+		Head:       TestTargetRef,
+		Refs:       make(map[string]string),
+		Commits:    make(map[string]mockCommit),
+		NotesByRef: make(map[string]map[string]string),
+	}
+}
+
 // GetPath returns the path to the repo.
 func (r *mockRepoForTest) GetPath() string { return "~/mockRepo/" }
 
@@ -194,7 +219,18 @@ func (r *mockRepoForTest) GetRepoStateHash() (string, error) {
 }
 
 // GetUserEmail returns the email address that the user has used to configure git.
-func (r *mockRepoForTest) GetUserEmail() (string, error) { return "user@example.com", nil }
+//
+// This defaults to "user@example.com" when user.email is not set.
+func (r *mockRepoForTest) GetUserEmail() (string, error) {
+	emails := r.Config["user.email"]
+	if len(emails) == 0 {
+		return "user@example.com", nil
+	}
+	if email := emails[len(emails)-1]; email != "" {
+		return email, nil
+	}
+	return "", fmt.Errorf("user email not configured")
+}
 
 // GetCoreEditor returns the name of the editor that the user has used to configure git.
 func (r *mockRepoForTest) GetCoreEditor() (string, error) { return "vi", nil }
@@ -202,6 +238,88 @@ func (r *mockRepoForTest) GetCoreEditor() (string, error) { return "vi", nil }
 // GetSubmitStrategy returns the way in which a review is submitted
 func (r *mockRepoForTest) GetSubmitStrategy() (string, error) { return "merge", nil }
 
+// GetConfigValues returns all of the values set for the given config key.
+func (r *mockRepoForTest) GetConfigValues(key string) ([]string, error) {
+	return r.Config[key], nil
+}
+
+// AddConfigValue adds a value for the given key to the repo's local config.
+func (r *mockRepoForTest) AddConfigValue(key, value string) error {
+	if r.Config == nil {
+		r.Config = make(map[string][]string)
+	}
+	r.Config[key] = append(r.Config[key], value)
+	return nil
+}
+
+// RemoveConfigValue removes every occurrence of the given value for the given key.
+func (r *mockRepoForTest) RemoveConfigValue(key, value string) error {
+	var remaining []string
+	for _, v := range r.Config[key] {
+		if v != value {
+			remaining = append(remaining, v)
+		}
+	}
+	if remaining == nil {
+		delete(r.Config, key)
+	} else {
+		r.Config[key] = remaining
+	}
+	return nil
+}
+
+// mockSignature returns the fake signature that the mock repo uses for the given payload and signer.
+func mockSignature(payload []byte, signer string) string {
+	return fmt.Sprintf("mock signature by %s of %x", signer, sha1.Sum(payload))
+}
+
+// SignPayload signs the given payload as the mock repo's user.
+func (r *mockRepoForTest) SignPayload(payload []byte) (string, error) {
+	email, err := r.GetUserEmail()
+	if err != nil {
+		return "", err
+	}
+	return mockSignature(payload, email), nil
+}
+
+// VerifyPayloadSignature verifies a signature created by the mock repo's SignPayload method.
+func (r *mockRepoForTest) VerifyPayloadSignature(payload []byte, signature, signer string) error {
+	if signature != mockSignature(payload, signer) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// mockCiphertextPrefix starts the "ciphertexts" created by the mock repo.
+const mockCiphertextPrefix = "mock encrypted to "
+
+// EncryptPayload "encrypts" the payload to the configured recipients, by
+// base64 encoding it along with the list of recipients.
+func (r *mockRepoForTest) EncryptPayload(payload []byte) (string, error) {
+	recipients := r.Config[EncryptToKey]
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("%s must be set to encrypt reviews", EncryptToKey)
+	}
+	return mockCiphertextPrefix + strings.Join(recipients, ",") + ": " + base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// DecryptPayload decrypts a payload encrypted by the mock repo's
+// EncryptPayload method, if the mock repo's user is one of its recipients.
+func (r *mockRepoForTest) DecryptPayload(ciphertext string) ([]byte, error) {
+	recipients, encoded, ok := strings.Cut(strings.TrimPrefix(ciphertext, mockCiphertextPrefix), ": ")
+	if !ok || !strings.HasPrefix(ciphertext, mockCiphertextPrefix) {
+		return nil, fmt.Errorf("unrecognized encryption format")
+	}
+	email, err := r.GetUserEmail()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(strings.Split(recipients, ","), email) {
+		return nil, fmt.Errorf("not encrypted to %s", email)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
 // HasUncommittedChanges returns true if there are local, uncommitted changes.
 func (r *mockRepoForTest) HasUncommittedChanges() (bool, error) { return false, nil }
 
@@ -336,6 +454,7 @@ func (r *mockRepoForTest) GetCommitDetails(ref string) (*CommitDetails, error) {
 	details.AuthorEmail = "author@example.com"
 	details.Summary = commit.Message
 	details.Time = commit.Time
+	details.Tree = commit.Tree
 	details.Parents = commit.Parents
 	return &details, nil
 }
@@ -388,11 +507,15 @@ func (r *mockRepoForTest) IsAncestor(ancestor, descendant string) (bool, error)
 
 // MergeBase determines if the first commit that is an ancestor of the two arguments.
 func (r *mockRepoForTest) MergeBase(a, b string) (string, error) {
+	a, err := r.resolveLocalRef(a)
+	if err != nil {
+		return "", err
+	}
 	ancestors, err := r.ancestors(a)
 	if err != nil {
 		return "", err
 	}
-	for _, ancestor := range ancestors {
+	for _, ancestor := range append([]string{a}, ancestors...) {
 		if t, e := r.IsAncestor(ancestor, b); e == nil && t {
 			return ancestor, nil
 		}
@@ -400,18 +523,61 @@ func (r *mockRepoForTest) MergeBase(a, b string) (string, error) {
 	return "", nil
 }
 
+// files returns the files in the tree of the given revision, which may
+// name either a commit or a tree, and whether or not it has a tree. The
+// commits in the pre-populated test data do not.
+func (r *mockRepoForTest) files(rev string) (map[string]string, bool) {
+	tree := rev
+	if hash, err := r.resolveLocalRef(rev); err == nil {
+		tree = r.Commits[hash].Tree
+	}
+	contents, ok := r.Trees[tree]
+	if !ok {
+		return nil, false
+	}
+	return NewTree(contents).Files(), true
+}
+
+// parentFiles returns the files in the tree of the given commit's first
+// parent, which are empty for a root commit.
+func (r *mockRepoForTest) parentFiles(commit string) map[string]string {
+	c, err := r.getCommit(commit)
+	if err != nil || len(c.Parents) == 0 {
+		return nil
+	}
+	files, _ := r.files(c.Parents[0])
+	return files
+}
+
 // Diff computes the diff between two given commits.
+//
+// If both commits have trees, this is a unified diff of their files in the
+// format of "git diff", and the diff arguments are ignored.
 func (r *mockRepoForTest) Diff(left, right string, diffArgs ...string) (string, error) {
-	return fmt.Sprintf("Diff between %q and %q", left, right), nil
+	oldFiles, oldOK := r.files(left)
+	newFiles, newOK := r.files(right)
+	if !oldOK || !newOK {
+		return fmt.Sprintf("Diff between %q and %q", left, right), nil
+	}
+	return diffFiles(oldFiles, newFiles), nil
 }
 
 // Diff1 computes the diff for a single commit.
 func (r *mockRepoForTest) Diff1(commit string, diffArgs ...string) (string, error) {
-	return r.Diff(commit, commit+"~", diffArgs...)
+	files, ok := r.files(commit)
+	if !ok {
+		return r.Diff(commit, commit+"~", diffArgs...)
+	}
+	return diffFiles(r.parentFiles(commit), files), nil
 }
 
 // Diff computes the diff between two given commits.
 func (r *mockRepoForTest) ParsedDiff(left, right string, diffArgs ...string) ([]FileDiff, error) {
+	oldFiles, oldOK := r.files(left)
+	newFiles, newOK := r.files(right)
+	if oldOK && newOK {
+		return ParseDiff(diffFiles(oldFiles, newFiles))
+	}
 	return []FileDiff{
 		{
 			OldName: "foo",
@@ -439,12 +605,26 @@ func (r *mockRepoForTest) ParsedDiff(left, right string, diffArgs ...string) ([]
 
 // ParsedDiff1 computes the diff for a single commit.
 func (r *mockRepoForTest) ParsedDiff1(commit string, diffArgs ...string) ([]FileDiff, error) {
-	return r.ParsedDiff(commit, commit+"~", diffArgs...)
+	files, ok := r.files(commit)
+	if !ok {
+		return r.ParsedDiff(commit, commit+"~", diffArgs...)
+	}
+	return ParseDiff(diffFiles(r.parentFiles(commit), files))
 }
 
 // Show returns the contents of the given file at the given commit.
+//
+// For a commit without a tree, this is just the commit and path.
 func (r *mockRepoForTest) Show(commit, path string) (string, error) {
-	return fmt.Sprintf("%s:%s", commit, path), nil
+	files, ok := r.files(commit)
+	if !ok {
+		return fmt.Sprintf("%s:%s", commit, path), nil
+	}
+	contents, ok := files[path]
+	if !ok {
+		return "", fmt.Errorf("there is no file %q at %q", path, commit)
+	}
+	return strings.TrimSpace(contents), nil
 }
 
 // SwitchToRef changes the currently-checked-out ref.
@@ -478,10 +658,38 @@ func (r *mockRepoForTest) ArchiveRef(ref, archive string) error {
 	return nil
 }
 
+// mergeTrees merges the files of the two given commits, as changed since
+// their merge base, and returns the hash of the merged tree. If either
+// commit has no tree, then neither does the merge.
+func (r *mockRepoForTest) mergeTrees(ours, theirs string) (string, error) {
+	ourFiles, oursOK := r.files(ours)
+	theirFiles, theirsOK := r.files(theirs)
+	if !oursOK || !theirsOK {
+		return "", nil
+	}
+	base, err := r.MergeBase(ours, theirs)
+	if err != nil {
+		return "", err
+	}
+	baseFiles, _ := r.files(base)
+	merged, err := mergeFiles(baseFiles, ourFiles, theirFiles)
+	if err != nil {
+		return "", err
+	}
+	tree, err := NewTreeFromFiles(merged)
+	if err != nil {
+		return "", err
+	}
+	return r.StoreTree(tree.Contents())
+}
+
 // MergeRef merges the given ref into the current one.
 //
 // The ref argument is the ref to merge, and fastForward indicates that the
 // current ref should only move forward, as opposed to creating a bubble merge.
+//
+// Files changed on both sides of the merge are reported as conflicts,
+// even if the changes would not overlap.
 func (r *mockRepoForTest) MergeRef(ref string, fastForward bool, messages ...string) error {
 	newCommitHash, err := r.resolveLocalRef(ref)
 	if err != nil {
@@ -496,23 +704,41 @@ func (r *mockRepoForTest) MergeRef(ref string, fastForward bool, messages ...str
 		if err != nil {
 			return err
 		}
+		tree, err := r.mergeTrees(origCommit, newCommitHash)
+		if err != nil {
+			return err
+		}
 		message := strings.Join(messages, "\n\n")
+		if message == "" {
+			message = "Merge " + ref
+			if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+				message = fmt.Sprintf("Merge branch '%s'", branch)
+			}
+		}
 		time := newCommit.Time
 		parents := []string{origCommit, newCommitHash}
-		newCommitHash = r.createCommit(message, time, "", parents)
+		newCommitHash = r.createCommit(message, time, tree, parents)
 	}
 	r.Refs[r.Head] = newCommitHash
 	return nil
 }
 
 // RebaseRef rebases the current ref onto the given one.
+//
+// The changes of the current ref are squashed into a single commit.
 func (r *mockRepoForTest) RebaseRef(ref string) error {
 	parentHash := r.Refs[ref]
 	origCommit, err := r.getCommit(r.Head)
 	if err != nil {
 		return err
 	}
-	newCommitHash := r.createCommit(origCommit.Message, origCommit.Time, origCommit.Tree, []string{parentHash})
+	tree := origCommit.Tree
+	if _, ok := r.files(r.Head); ok {
+		if tree, err = r.mergeTrees(ref, r.Head); err != nil {
+			return err
+		}
+	}
+	newCommitHash := r.createCommit(origCommit.Message, origCommit.Time, tree, []string{parentHash})
 	if strings.HasPrefix(r.Head, "refs/heads/") {
 		r.Refs[r.Head] = newCommitHash
 	} else {
@@ -661,7 +887,7 @@ func (r *mockRepoForTest) SetRef(ref, newCommitHash, previousCommitHash string)
 
 // GetNotes reads the notes from the given ref that annotate the given revision.
 func (r *mockRepoForTest) GetNotes(notesRef, revision string) []Note {
-	notesText := r.Notes[notesRef][revision]
+	notesText := r.NotesByRef[notesRef][revision]
 	var notes []Note
 	for line := range strings.SplitSeq(notesText, "\n") {
 		notes = append(notes, Note(line))
@@ -682,18 +908,129 @@ func (r *mockRepoForTest) GetAllNotes(notesRef string) (map[string][]Note, error
 	return notesMap, nil
 }
 
+// Notes returns an iterator over the notes under the given ref, or recorded
+// by GetNotesCommit under the given name, in order of the annotated revisions.
+func (r *mockRepoForTest) Notes(notesRef, prefix string) (iter.Seq2[string, []Note], func() error) {
+	notes := r.notesAt(notesRef)
+	return func(yield func(string, []Note) bool) {
+		for _, revision := range slices.Sorted(maps.Keys(notes)) {
+			if strings.HasPrefix(revision, prefix) && !yield(revision, splitNotesBlob(notes[revision])) {
+				return
+			}
+		}
+	}, func() error { return nil }
+}
+
+// notesAt returns the notes under the given ref, or recorded by
+// GetNotesCommit under the given name.
+func (r *mockRepoForTest) notesAt(name string) map[string]string {
+	if notes, ok := r.NotesByRef[name]; ok {
+		return notes
+	}
+	return r.snapshots[name]
+}
+
+// DiffNotes compares the notes under two refs.
+func (r *mockRepoForTest) DiffNotes(from, to string) ([]NotesDiff, error) {
+	fromNotes, toNotes := r.notesAt(from), r.notesAt(to)
+	revisions := slices.Collect(maps.Keys(fromNotes))
+	for revision := range toNotes {
+		if _, ok := fromNotes[revision]; !ok {
+			revisions = append(revisions, revision)
+		}
+	}
+	slices.Sort(revisions)
+	var diffs []NotesDiff
+	for _, revision := range revisions {
+		oldContents, hasOld := fromNotes[revision]
+		newContents, hasNew := toNotes[revision]
+		if hasOld == hasNew && oldContents == newContents {
+			continue
+		}
+		diff := NotesDiff{Revision: revision}
+		if hasOld {
+			diff.Old = splitNotesBlob(oldContents)
+		}
+		if hasNew {
+			diff.New = splitNotesBlob(newContents)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// GetNotesCommit returns a name for the current state of the given notes
+// ref, or the empty string if there is no such ref.
+//
+// The mock repo does not track the history of notes refs, so this records a
+// copy of the ref's current notes under a name derived from their contents,
+// which DiffNotes can then read.
+func (r *mockRepoForTest) GetNotesCommit(notesRef string) (string, error) {
+	notes, ok := r.NotesByRef[notesRef]
+	if !ok {
+		return "", nil
+	}
+	// Maps of strings always encode successfully.
+	notesJSON, _ := json.Marshal(notes)
+	name := fmt.Sprintf("%x", sha1.Sum(append([]byte(notesRef+"\n"), notesJSON...)))
+	if r.snapshots == nil {
+		r.snapshots = make(map[string]map[string]string)
+	}
+	r.snapshots[name] = maps.Clone(notes)
+	return name, nil
+}
+
 // AppendNote appends a note to a revision under the given ref.
 func (r *mockRepoForTest) AppendNote(ref, revision string, note Note) error {
-	existingNotes := r.Notes[ref][revision]
+	if r.NotesByRef[ref] == nil {
+		r.NotesByRef[ref] = make(map[string]string)
+	}
+	existingNotes := r.NotesByRef[ref][revision]
 	newNotes := existingNotes + "\n" + string(note)
-	r.Notes[ref][revision] = newNotes
+	r.NotesByRef[ref][revision] = newNotes
 	return nil
 }
 
+// AppendNotes appends the given notes to each of the given revisions under
+// the given ref.
+func (r *mockRepoForTest) AppendNotes(ref string, notes map[string][]Note) error {
+	for revision, revisionNotes := range notes {
+		for _, note := range revisionNotes {
+			if err := r.AppendNote(ref, revision, note); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RewriteNotesHistory replaces the matching note lines under the given ref.
+//
+// The mock repo does not track the history of notes refs, so this returns
+// the number of revisions whose notes were changed.
+func (r *mockRepoForTest) RewriteNotesHistory(notesRef string, replacements map[string]Note) (int, error) {
+	rewritten := 0
+	for revision, notesText := range r.NotesByRef[notesRef] {
+		lines := strings.Split(notesText, "\n")
+		changed := false
+		for i, line := range lines {
+			if replacement, ok := replacements[line]; ok {
+				lines[i] = string(replacement)
+				changed = true
+			}
+		}
+		if changed {
+			r.NotesByRef[notesRef][revision] = strings.Join(lines, "\n")
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
 // ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
 func (r *mockRepoForTest) ListNotedRevisions(notesRef string) []string {
 	var revisions []string
-	for revision := range r.Notes[notesRef] {
+	for revision := range r.NotesByRef[notesRef] {
 		if _, ok := r.Commits[revision]; ok {
 			revisions = append(revisions, revision)
 		}
@@ -750,6 +1087,16 @@ func (r *mockRepoForTest) MergeArchives(remote, archiveRefPattern string) error
 	return nil
 }
 
+// CompactNotes is a no-op, since the mock notes do not have any history.
+func (r *mockRepoForTest) CompactNotes(notesRefPattern string, before time.Time) ([]string, error) {
+	return nil, nil
+}
+
+// CompactArchives is a no-op, since the mock archives are never shared.
+func (r *mockRepoForTest) CompactArchives(archiveRefPattern string, before time.Time) ([]string, error) {
+	return nil, nil
+}
+
 // FetchAndReturnNewReviewHashes fetches the notes "branches" and then susses
 // out the IDs (the revision the review points to) of any new reviews, then
 // returns that list of IDs.
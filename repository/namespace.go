@@ -0,0 +1,375 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	// DefaultNamespace is the namespace of the review refs, unless another
+	// one is configured.
+	DefaultNamespace = "devtools"
+
+	// NamespaceKey is the git config setting for the namespace in which to
+	// read and write reviews.
+	NamespaceKey = "appraise.namespace"
+
+	// ReadNamespaceKey is the git config setting for any other namespaces
+	// from which to also read reviews. It may be set multiple times.
+	ReadNamespaceKey = "appraise.readNamespace"
+
+	// NamespaceEnv is the environment variable that overrides the configured
+	// namespaces, as a comma-separated list. The first namespace is the one
+	// in which reviews are written, and reviews are read from all of them.
+	NamespaceEnv = "GIT_APPRAISE_NAMESPACE"
+)
+
+// NamespacedRepo is a Repo that moves the review refs, which are named under
+// DefaultNamespace (e.g. "refs/notes/devtools/reviews"), to another namespace
+// (e.g. "refs/notes/security/reviews").
+//
+// This allows separate groups to keep independent reviews in the same repo.
+// Notes are written to a single namespace, but may be read from several,
+// in which case the notes from all of them are combined.
+type NamespacedRepo struct {
+	Repo
+
+	namespaces []string
+}
+
+// validateNamespace checks that the given namespace can be used as a single
+// component of a ref name.
+func validateNamespace(namespace string) error {
+	if namespace == "" || namespace == "remotes" || strings.Contains(namespace, "/") || plumbing.ReferenceName("refs/notes/"+namespace).Validate() != nil {
+		return fmt.Errorf("invalid review namespace %q", namespace)
+	}
+	return nil
+}
+
+// NewNamespacedRepo returns a Repo that writes reviews in the given
+// namespace, and reads them from that namespace and any of the others.
+func NewNamespacedRepo(repo Repo, namespace string, readNamespaces ...string) (*NamespacedRepo, error) {
+	namespaces := []string{namespace}
+	for _, ns := range readNamespaces {
+		if !slices.Contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	for _, ns := range namespaces {
+		if err := validateNamespace(ns); err != nil {
+			return nil, err
+		}
+	}
+	return &NamespacedRepo{Repo: repo, namespaces: namespaces}, nil
+}
+
+// OpenNamespace returns a Repo that uses the review namespaces given in the
+// comma-separated override, or else those configured by NamespaceKey and
+// ReadNamespaceKey. If that is only the default namespace, then the repo is
+// returned as is.
+func OpenNamespace(repo Repo, override string) (Repo, error) {
+	var namespaces []string
+	if override != "" {
+		namespaces = strings.Split(override, ",")
+	} else {
+		configured, err := repo.GetConfigValues(NamespaceKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(configured) == 0 {
+			configured = []string{DefaultNamespace}
+		}
+		readNamespaces, err := repo.GetConfigValues(ReadNamespaceKey)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(configured[len(configured)-1:], readNamespaces...)
+	}
+	if len(namespaces) == 1 && namespaces[0] == DefaultNamespace {
+		return repo, nil
+	}
+	return NewNamespacedRepo(repo, namespaces[0], namespaces[1:]...)
+}
+
+// WithContext returns a copy of the repo whose underlying repo runs each of
+// its git commands with the given context.
+func (repo *NamespacedRepo) WithContext(ctx context.Context) *NamespacedRepo {
+	return &NamespacedRepo{Repo: WithContext(ctx, repo.Repo), namespaces: repo.namespaces}
+}
+
+// Namespace returns the namespace in which reviews are written.
+func (repo *NamespacedRepo) Namespace() string {
+	return repo.namespaces[0]
+}
+
+// Namespaces returns the namespaces from which reviews are read, starting
+// with the one in which they are written.
+func (repo *NamespacedRepo) Namespaces() []string {
+	return slices.Clone(repo.namespaces)
+}
+
+// refIn returns the name of the given review ref (or ref pattern) in the
+// given namespace. Refs that are not review refs are returned unchanged.
+func refIn(namespace, ref string) string {
+	const notesPrefix = notesRefPrefix + DefaultNamespace + "/"
+	const remoteNotesPrefix = notesRefPrefix + "remotes/"
+	const archivesPrefix = devtoolsRefPrefix + "archives/"
+	if rest, ok := strings.CutPrefix(ref, notesPrefix); ok {
+		return notesRefPrefix + namespace + "/" + rest
+	}
+	if rest, ok := strings.CutPrefix(ref, remoteNotesPrefix); ok {
+		if remote, rest, ok := strings.Cut(rest, "/"+DefaultNamespace+"/"); ok {
+			return remoteNotesPrefix + remote + "/" + namespace + "/" + rest
+		}
+	}
+	if namespace == DefaultNamespace {
+		return ref
+	}
+	if rest, ok := strings.CutPrefix(ref, archivesPrefix); ok {
+		return devtoolsRefPrefix + namespace + "/archives/" + rest
+	}
+	if rest, ok := strings.CutPrefix(ref, remoteDevtoolsRefPrefix); ok {
+		if remote, rest, ok := strings.Cut(rest, "/archives/"); ok {
+			return remoteDevtoolsRefPrefix + remote + "/" + namespace + "/archives/" + rest
+		}
+	}
+	return ref
+}
+
+// Ref returns the name of the given review ref (or ref pattern) in the
+// namespace in which reviews are written.
+func (repo *NamespacedRepo) Ref(ref string) string {
+	return refIn(repo.Namespace(), ref)
+}
+
+// DefaultRef returns the name that the given notes ref, from any of the
+// namespaces that reviews are read from, has in DefaultNamespace. It returns
+// the empty string if the ref is not in any of those namespaces.
+func (repo *NamespacedRepo) DefaultRef(ref string) string {
+	for _, ns := range repo.namespaces {
+		if rest, ok := strings.CutPrefix(ref, notesRefPrefix+ns+"/"); ok {
+			return notesRefPrefix + DefaultNamespace + "/" + rest
+		}
+	}
+	return ""
+}
+
+// GetCommitHash returns the hash of the commit pointed to by the given ref,
+// after moving any review ref to the namespace in which reviews are written.
+func (repo *NamespacedRepo) GetCommitHash(ref string) (string, error) {
+	return repo.Repo.GetCommitHash(repo.Ref(ref))
+}
+
+// GetNotes reads the notes from the given ref, in each of the namespaces that
+// reviews are read from, that annotate the given revision.
+func (repo *NamespacedRepo) GetNotes(notesRef, revision string) []Note {
+	var notes []Note
+	for _, ns := range repo.namespaces {
+		notes = append(notes, repo.Repo.GetNotes(refIn(ns, notesRef), revision)...)
+	}
+	return notes
+}
+
+// GetAllNotes reads the contents of the notes under the given ref, in each of
+// the namespaces that reviews are read from, for every commit.
+func (repo *NamespacedRepo) GetAllNotes(notesRef string) (map[string][]Note, error) {
+	var allNotes map[string][]Note
+	for _, ns := range repo.namespaces {
+		notes, err := repo.Repo.GetAllNotes(refIn(ns, notesRef))
+		if err != nil {
+			return nil, err
+		}
+		if len(notes) > 0 && allNotes == nil {
+			allNotes = make(map[string][]Note)
+		}
+		for revision, revisionNotes := range notes {
+			allNotes[revision] = append(allNotes[revision], revisionNotes...)
+		}
+	}
+	return allNotes, nil
+}
+
+// Notes returns an iterator over the notes under the given ref, in each of
+// the namespaces that reviews are read from.
+//
+// If reviews are read from more than one namespace, then the notes of each
+// annotated object are combined, which requires reading all of them before
+// the first one is yielded.
+func (repo *NamespacedRepo) Notes(notesRef, prefix string) (iter.Seq2[string, []Note], func() error) {
+	var refs []string
+	for _, ns := range repo.namespaces {
+		if ref := refIn(ns, notesRef); !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) == 1 {
+		return repo.Repo.Notes(refs[0], prefix)
+	}
+	var err error
+	notes := func(yield func(string, []Note) bool) {
+		allNotes := make(map[string][]Note)
+		for _, ref := range refs {
+			notes, notesErr := repo.Repo.Notes(ref, prefix)
+			for revision, revisionNotes := range notes {
+				allNotes[revision] = append(allNotes[revision], revisionNotes...)
+			}
+			if err = notesErr(); err != nil {
+				return
+			}
+		}
+		for _, revision := range slices.Sorted(maps.Keys(allNotes)) {
+			if !yield(revision, allNotes[revision]) {
+				return
+			}
+		}
+	}
+	return notes, func() error { return err }
+}
+
+// ListNotedRevisions returns the revisions that are annotated by notes in the
+// given ref, in any of the namespaces that reviews are read from.
+func (repo *NamespacedRepo) ListNotedRevisions(notesRef string) []string {
+	var revisions []string
+	for _, ns := range repo.namespaces {
+		for _, revision := range repo.Repo.ListNotedRevisions(refIn(ns, notesRef)) {
+			if !slices.Contains(revisions, revision) {
+				revisions = append(revisions, revision)
+			}
+		}
+	}
+	return revisions
+}
+
+// DiffNotes compares two versions of a notes ref in the namespace in which
+// reviews are written.
+func (repo *NamespacedRepo) DiffNotes(from, to string) ([]NotesDiff, error) {
+	return repo.Repo.DiffNotes(repo.Ref(from), repo.Ref(to))
+}
+
+// GetNotesCommit returns the hash of the commit that the given notes ref
+// points to, in the namespace in which reviews are written.
+func (repo *NamespacedRepo) GetNotesCommit(notesRef string) (string, error) {
+	return repo.Repo.GetNotesCommit(repo.Ref(notesRef))
+}
+
+// AppendNote appends a note to a revision under the given ref, in the
+// namespace in which reviews are written.
+func (repo *NamespacedRepo) AppendNote(ref, revision string, note Note) error {
+	return repo.Repo.AppendNote(repo.Ref(ref), revision, note)
+}
+
+// AppendNotes appends the given notes to each of the given revisions under
+// the given ref, in a single notes commit in the namespace in which reviews
+// are written.
+func (repo *NamespacedRepo) AppendNotes(ref string, notes map[string][]Note) error {
+	return repo.Repo.AppendNotes(repo.Ref(ref), notes)
+}
+
+// RewriteNotesHistory rewrites the history of the given notes ref, in the
+// namespace in which reviews are written.
+func (repo *NamespacedRepo) RewriteNotesHistory(notesRef string, replacements map[string]Note) (int, error) {
+	return repo.Repo.RewriteNotesHistory(repo.Ref(notesRef), replacements)
+}
+
+// PushNotes pushes the notes in the namespace in which reviews are written.
+func (repo *NamespacedRepo) PushNotes(remote, notesRefPattern string) error {
+	return repo.Repo.PushNotes(remote, repo.Ref(notesRefPattern))
+}
+
+// PullNotes pulls the notes in the namespace in which reviews are written.
+func (repo *NamespacedRepo) PullNotes(remote, notesRefPattern string) error {
+	return repo.Repo.PullNotes(remote, repo.Ref(notesRefPattern))
+}
+
+// PushNotesAndArchive pushes the notes and archive refs in the namespace in
+// which reviews are written.
+func (repo *NamespacedRepo) PushNotesAndArchive(remote, notesRefPattern, archiveRefPattern string) error {
+	return repo.Repo.PushNotesAndArchive(remote, repo.Ref(notesRefPattern), repo.Ref(archiveRefPattern))
+}
+
+// PullNotesAndArchive pulls the notes and archive refs in each of the
+// namespaces that reviews are read from.
+func (repo *NamespacedRepo) PullNotesAndArchive(remote, notesRefPattern, archiveRefPattern string) error {
+	for _, ns := range repo.namespaces {
+		if err := repo.Repo.PullNotesAndArchive(remote, refIn(ns, notesRefPattern), refIn(ns, archiveRefPattern)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeNotes merges in the remote's notes in the namespace in which reviews
+// are written.
+func (repo *NamespacedRepo) MergeNotes(remote, notesRefPattern string) error {
+	return repo.Repo.MergeNotes(remote, repo.Ref(notesRefPattern))
+}
+
+// CompactNotes compacts the notes in the namespace in which reviews are
+// written.
+func (repo *NamespacedRepo) CompactNotes(notesRefPattern string, before time.Time) ([]string, error) {
+	return repo.Repo.CompactNotes(repo.Ref(notesRefPattern), before)
+}
+
+// FetchAndReturnNewReviewHashes fetches the notes and devtools refs in each
+// of the namespaces that reviews are read from, and returns the IDs of any
+// new reviews in them.
+func (repo *NamespacedRepo) FetchAndReturnNewReviewHashes(remote, notesRefPattern string, devtoolsRefPatterns ...string) ([]string, error) {
+	var reviews []string
+	for _, ns := range repo.namespaces {
+		var patterns []string
+		for _, pattern := range devtoolsRefPatterns {
+			patterns = append(patterns, refIn(ns, pattern))
+		}
+		nsReviews, err := repo.Repo.FetchAndReturnNewReviewHashes(remote, refIn(ns, notesRefPattern), patterns...)
+		if err != nil {
+			return nil, err
+		}
+		for _, review := range nsReviews {
+			if !slices.Contains(reviews, review) {
+				reviews = append(reviews, review)
+			}
+		}
+	}
+	return reviews, nil
+}
+
+// ArchiveRef archives the given ref under the given archive ref, in the
+// namespace in which reviews are written.
+func (repo *NamespacedRepo) ArchiveRef(ref, archive string) error {
+	return repo.Repo.ArchiveRef(ref, repo.Ref(archive))
+}
+
+// MergeArchives merges in the remote's archives in the namespace in which
+// reviews are written.
+func (repo *NamespacedRepo) MergeArchives(remote, archiveRefPattern string) error {
+	return repo.Repo.MergeArchives(remote, repo.Ref(archiveRefPattern))
+}
+
+// CompactArchives compacts the archives in the namespace in which reviews
+// are written.
+func (repo *NamespacedRepo) CompactArchives(archiveRefPattern string, before time.Time) ([]string, error) {
+	return repo.Repo.CompactArchives(repo.Ref(archiveRefPattern), before)
+}
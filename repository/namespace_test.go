@@ -0,0 +1,369 @@
+package repository
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefIn(t *testing.T) {
+	for _, tc := range []struct{ namespace, ref, want string }{
+		{"security", "refs/notes/devtools/reviews", "refs/notes/security/reviews"},
+		{"security", "refs/notes/devtools/*", "refs/notes/security/*"},
+		{"security", "refs/notes/remotes/origin/devtools/discuss", "refs/notes/remotes/origin/security/discuss"},
+		{"security", "refs/devtools/archives/reviews", "refs/devtools/security/archives/reviews"},
+		{"security", "refs/devtools/archives/*", "refs/devtools/security/archives/*"},
+		{"security", "refs/remoteDevtools/origin/archives/reviews", "refs/remoteDevtools/origin/security/archives/reviews"},
+		{"security", "refs/notes/commits", "refs/notes/commits"},
+		{"security", "refs/heads/master", "refs/heads/master"},
+		{"security", "refs/remoteDevtools/origin/other", "refs/remoteDevtools/origin/other"},
+		{"security", "HEAD", "HEAD"},
+		{"devtools", "refs/notes/devtools/reviews", "refs/notes/devtools/reviews"},
+		{"devtools", "refs/devtools/archives/reviews", "refs/devtools/archives/reviews"},
+		{"devtools", "refs/remoteDevtools/origin/archives/reviews", "refs/remoteDevtools/origin/archives/reviews"},
+	} {
+		if got := refIn(tc.namespace, tc.ref); got != tc.want {
+			t.Errorf("refIn(%q, %q) = %q, want %q", tc.namespace, tc.ref, got, tc.want)
+		}
+	}
+}
+
+func TestNewNamespacedRepo(t *testing.T) {
+	repo := NewMockRepoForTest()
+	nsRepo, err := NewNamespacedRepo(repo, "security", "devtools", "security", "devtools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsRepo.Namespace() != "security" || !slices.Equal(nsRepo.Namespaces(), []string{"security", "devtools"}) {
+		t.Errorf("unexpected namespaces %q", nsRepo.namespaces)
+	}
+	nsRepo.Namespaces()[0] = "changed"
+	if nsRepo.Namespace() != "security" {
+		t.Error("expected the namespaces to be copied")
+	}
+	for _, namespace := range []string{"", "remotes", "team/a", "team..a", "team a", "team.lock"} {
+		if _, err := NewNamespacedRepo(repo, "devtools", namespace); err == nil || !strings.Contains(err.Error(), "invalid review namespace") {
+			t.Errorf("expected the namespace %q to be rejected, got %v", namespace, err)
+		}
+	}
+}
+
+func TestOpenNamespace(t *testing.T) {
+	repo := NewMockRepoForTest()
+	opened, err := OpenNamespace(repo, "")
+	if err != nil || opened != repo {
+		t.Errorf("expected the repo itself without a namespace, got %T, %v", opened, err)
+	}
+	if opened, err := OpenNamespace(repo, DefaultNamespace); err != nil || opened != repo {
+		t.Errorf("expected the repo itself for the default namespace, got %T, %v", opened, err)
+	}
+
+	repo.AddConfigValue(NamespaceKey, "ignored")
+	repo.AddConfigValue(NamespaceKey, "security")
+	repo.AddConfigValue(ReadNamespaceKey, "devtools")
+	opened, err = OpenNamespace(repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsRepo, ok := opened.(*NamespacedRepo); !ok || !slices.Equal(nsRepo.namespaces, []string{"security", "devtools"}) {
+		t.Errorf("expected the configured namespaces, got %+v", opened)
+	}
+
+	opened, err = OpenNamespace(repo, "teamA,teamB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsRepo, ok := opened.(*NamespacedRepo); !ok || !slices.Equal(nsRepo.namespaces, []string{"teamA", "teamB"}) {
+		t.Errorf("expected the overriding namespaces, got %+v", opened)
+	}
+
+	if _, err := OpenNamespace(repo, "teamA,"); err == nil {
+		t.Error("expected an error for an empty namespace")
+	}
+
+	repo = NewMockRepoForTest()
+	repo.AddConfigValue(ReadNamespaceKey, "security")
+	opened, err = OpenNamespace(repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsRepo, ok := opened.(*NamespacedRepo); !ok || !slices.Equal(nsRepo.namespaces, []string{"devtools", "security"}) {
+		t.Errorf("expected to also read the configured namespace, got %+v", opened)
+	}
+}
+
+func TestOpenNamespaceConfigError(t *testing.T) {
+	repo := setupTestRepo(t)
+	for _, key := range []string{NamespaceKey, ReadNamespaceKey} {
+		withExecHook(t, func(cmd *exec.Cmd) error {
+			if slices.Contains(cmd.Args, key) {
+				return errors.New("config failure")
+			}
+			return cmd.Run()
+		})
+		if _, err := OpenNamespace(repo, ""); err == nil {
+			t.Errorf("expected an error reading %s", key)
+		}
+	}
+}
+
+func TestNamespacedRepoDefaultRef(t *testing.T) {
+	nsRepo, err := NewNamespacedRepo(NewMockRepoForTest(), "security", "teamA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ ref, want string }{
+		{"refs/notes/security/reviews", "refs/notes/devtools/reviews"},
+		{"refs/notes/teamA/discuss", "refs/notes/devtools/discuss"},
+		{"refs/notes/devtools/reviews", ""},
+		{"refs/notes/teamB/reviews", ""},
+		{"refs/heads/master", ""},
+	} {
+		if got := nsRepo.DefaultRef(tc.ref); got != tc.want {
+			t.Errorf("DefaultRef(%q) = %q, want %q", tc.ref, got, tc.want)
+		}
+	}
+	if got := nsRepo.Ref("refs/notes/devtools/reviews"); got != "refs/notes/security/reviews" {
+		t.Errorf("unexpected ref %q", got)
+	}
+}
+
+func TestNamespacedRepoNotes(t *testing.T) {
+	base := setupTestRepo(t)
+	first := gitRun(t, base.Path, "rev-parse", "HEAD")
+	addCommit(t, base, "second.txt", "second", "second commit")
+	head := gitRun(t, base.Path, "rev-parse", "HEAD")
+	repo, err := NewNamespacedRepo(base, "security", "devtools")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ref = "refs/notes/devtools/discuss"
+	if err := base.AppendNote(ref, head, Note("default")); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.AppendNote(ref, first, Note("default first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(ref, head, Note("security")); err != nil {
+		t.Fatal(err)
+	}
+	if notes := base.GetNotes("refs/notes/security/discuss", head); len(notes) != 1 || string(notes[0]) != "security" {
+		t.Errorf("expected the note to be written in the namespace, got %q", notes)
+	}
+	if notes := base.GetNotes(ref, head); len(notes) != 1 || string(notes[0]) != "default" {
+		t.Errorf("expected the default namespace to be unchanged, got %q", notes)
+	}
+
+	if notes := repo.GetNotes(ref, head); len(notes) != 2 || string(notes[0]) != "security" || string(notes[1]) != "default" {
+		t.Errorf("expected the notes from both namespaces, got %q", notes)
+	}
+	allNotes, err := repo.GetAllNotes(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allNotes) != 2 || len(allNotes[head]) != 2 || len(allNotes[first]) != 1 {
+		t.Errorf("expected the notes from both namespaces, got %q", allNotes)
+	}
+	revisions := repo.ListNotedRevisions(ref)
+	slices.Sort(revisions)
+	want := []string{first, head}
+	slices.Sort(want)
+	if !slices.Equal(revisions, want) {
+		t.Errorf("expected the revisions from both namespaces, got %v", revisions)
+	}
+
+	notes, notesErr := repo.Notes(ref, "")
+	if got := collectNotes(t, notes, notesErr); len(got) != 2 || got[head] != "security\ndefault" || got[first] != "default first" {
+		t.Errorf("expected the notes from both namespaces, got %q", got)
+	}
+	notes, notesErr = repo.Notes(ref, head)
+	if got := collectNotes(t, notes, notesErr); len(got) != 1 || got[head] != "security\ndefault" {
+		t.Errorf("expected the notes for %q from both namespaces, got %q", head, got)
+	}
+	notes, notesErr = repo.Notes(ref, "")
+	for range notes {
+		break
+	}
+	if err := notesErr(); err != nil {
+		t.Fatal(err)
+	}
+	securityCommit := gitRun(t, base.Path, "rev-parse", "refs/notes/security/discuss")
+	notes, notesErr = repo.Notes(securityCommit, "")
+	if got := collectNotes(t, notes, notesErr); len(got) != 1 || got[head] != "security" {
+		t.Errorf("expected the notes of a single commit, got %q", got)
+	}
+	single, err := NewNamespacedRepo(base, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, notesErr = single.Notes(ref, "")
+	if got := collectNotes(t, notes, notesErr); len(got) != 1 || got[head] != "security" {
+		t.Errorf("expected the notes from the namespace, got %q", got)
+	}
+	uninitialized, err := NewNamespacedRepo(&GitRepo{}, "security", "devtools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, notesErr = uninitialized.Notes(ref, "")
+	for range notes {
+		t.Error("expected no notes from an uninitialized repo")
+	}
+	if notesErr() == nil {
+		t.Error("expected an error reading the notes of an uninitialized repo")
+	}
+
+	diffs, err := repo.DiffNotes("", ref)
+	if err != nil || len(diffs) != 1 || diffs[0].Revision != head {
+		t.Errorf("expected to diff the namespaced notes, got %+v, %v", diffs, err)
+	}
+	if commit, err := repo.GetNotesCommit(ref); err != nil || commit != gitRun(t, base.Path, "rev-parse", "refs/notes/security/discuss") {
+		t.Errorf("expected the commit of the namespaced notes, got %q, %v", commit, err)
+	}
+
+	empty, err := NewNamespacedRepo(base, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allNotes, err := empty.GetAllNotes(ref); err != nil || allNotes != nil {
+		t.Errorf("expected no notes, got %q, %v", allNotes, err)
+	}
+
+	replacements := map[string]Note{"security": Note("rewritten")}
+	if rewritten, err := repo.RewriteNotesHistory(ref, replacements); err != nil || rewritten != 1 {
+		t.Errorf("expected to rewrite the namespaced notes, got %d, %v", rewritten, err)
+	}
+	if notes := base.GetNotes("refs/notes/security/discuss", head); len(notes) != 1 || string(notes[0]) != "rewritten" {
+		t.Errorf("unexpected rewritten notes %q", notes)
+	}
+
+	if err := repo.AppendNote(ref, first, Note("security first")); err != nil {
+		t.Fatal(err)
+	}
+	if compacted, err := repo.CompactNotes("refs/notes/devtools/*", time.Now()); err != nil || !slices.Equal(compacted, []string{"refs/notes/security/discuss"}) {
+		t.Errorf("expected to compact the namespaced notes, got %v, %v", compacted, err)
+	}
+}
+
+func TestNamespacedRepoAppendNotes(t *testing.T) {
+	base := setupTestRepo(t)
+	head := gitRun(t, base.Path, "rev-parse", "HEAD")
+	repo, err := NewNamespacedRepo(base, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNotes("refs/notes/devtools/reviews", map[string][]Note{head: {Note("first"), Note("second")}}); err != nil {
+		t.Fatal(err)
+	}
+	if notes := base.GetNotes("refs/notes/security/reviews", head); len(notes) != 2 || string(notes[1]) != "second" {
+		t.Errorf("expected the notes to be written in the namespace, got %q", notes)
+	}
+	if notes := base.GetNotes("refs/notes/devtools/reviews", head); notes != nil {
+		t.Errorf("expected the default namespace to be unchanged, got %q", notes)
+	}
+}
+
+func TestNamespacedRepoArchives(t *testing.T) {
+	base := setupTestRepo(t)
+	head := gitRun(t, base.Path, "rev-parse", "HEAD")
+	repo, err := NewNamespacedRepo(base, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const archive = "refs/devtools/archives/reviews"
+	if err := repo.ArchiveRef(head, archive); err != nil {
+		t.Fatal(err)
+	}
+	if hasRef, _ := base.HasRef(archive); hasRef {
+		t.Error("expected the default archive to be unchanged")
+	}
+	archiveHash, err := repo.GetCommitHash(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archiveHash != gitRun(t, base.Path, "rev-parse", "refs/devtools/security/archives/reviews") {
+		t.Errorf("expected to resolve the namespaced archive, got %s", archiveHash)
+	}
+	if err := repo.MergeArchives("origin", "refs/devtools/archives/*"); err != nil {
+		t.Errorf("unexpected error merging missing archives: %v", err)
+	}
+	if compacted, err := repo.CompactArchives("refs/devtools/archives/*", time.Now()); err != nil || !slices.Equal(compacted, []string{"refs/devtools/security/archives/reviews"}) {
+		t.Errorf("expected to compact the namespaced archive, got %v, %v", compacted, err)
+	}
+}
+
+func TestNamespacedRepoPushAndPull(t *testing.T) {
+	local, remoteDir := setupTestRepoWithRemote(t)
+	head := gitRun(t, local.Path, "rev-parse", "HEAD")
+	repo, err := NewNamespacedRepo(local, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ref = "refs/notes/devtools/discuss"
+	if err := repo.AppendNote(ref, head, Note("security")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ArchiveRef(head, "refs/devtools/archives/reviews"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PushNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := gitRun(t, remoteDir, "for-each-ref", "--format=%(refname)", "refs/notes", "refs/devtools"); refs != "refs/devtools/security/archives/reviews\nrefs/notes/security/discuss" {
+		t.Errorf("expected only the namespaced refs to be pushed, got %q", refs)
+	}
+	if err := repo.PushNotes("origin", "refs/notes/devtools/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	clone, err := NewNamespacedRepo(cloneTestRepo(t, remoteDir), "teamA", "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	if notes := clone.GetNotes(ref, head); len(notes) != 1 || string(notes[0]) != "security" {
+		t.Errorf("expected to pull the notes from the read namespace, got %q", notes)
+	}
+	if err := clone.PullNotes("origin", "refs/notes/devtools/*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.MergeNotes("origin", "refs/notes/devtools/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.AppendNote("refs/notes/devtools/reviews", head, Note("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PushNotes("origin", "refs/notes/devtools/*"); err != nil {
+		t.Fatal(err)
+	}
+	reviews, err := clone.FetchAndReturnNewReviewHashes("origin", "refs/notes/devtools/*", "refs/devtools/archives/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reviews, []string{head}) {
+		t.Errorf("expected the new review from the read namespace, got %v", reviews)
+	}
+	if hash := gitRun(t, clone.Repo.GetPath(), "rev-parse", "refs/notes/remotes/origin/security/reviews"); hash == "" {
+		t.Error("expected the namespaced notes to be fetched")
+	}
+}
+
+func TestNamespacedRepoPullError(t *testing.T) {
+	local := setupTestRepo(t)
+	repo, err := NewNamespacedRepo(local, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PullNotesAndArchive("missing", "refs/notes/devtools/*", "refs/devtools/archives/*"); err == nil {
+		t.Error("expected an error pulling from a missing remote")
+	}
+	if _, err := repo.FetchAndReturnNewReviewHashes("missing", "refs/notes/devtools/*"); err == nil {
+		t.Error("expected an error fetching from a missing remote")
+	}
+}
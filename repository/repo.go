@@ -18,19 +18,75 @@ limitations under the License.
 package repository
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
+	"iter"
 	"maps"
+	"strings"
+	"time"
 )
 
 // Note represents the contents of a git-note
 type Note []byte
 
 // Hash returns a hash of the given note
+//
+// This is always a SHA-1 hash, even in repos that use SHA-256 object names,
+// since it identifies the note rather than any git object, and so must be
+// the same in every clone of a review.
 func (n Note) Hash() string {
 	return fmt.Sprintf("%x", sha1.Sum([]byte(n)))
 }
 
+// DefaultAllowedSignersFile is the path, within the repo, of the file listing
+// the SSH keys that are allowed to sign review comments and requests. It uses
+// the format described in the "ALLOWED SIGNERS" section of ssh-keygen(1).
+const DefaultAllowedSignersFile = ".git-appraise/allowed_signers"
+
+// AllowedSignersRefKey is the git config setting that names the ref (e.g.
+// "refs/remotes/origin/master") from which the committed allowed signers file
+// is read. Only changes that have been merged into that ref are trusted, so
+// that a review cannot add its own keys to the file.
+const AllowedSignersRefKey = "appraise.allowedSignersRef"
+
+// TrustedOpenPGPKeyKey is the multi-valued git config setting that lists the
+// fingerprints of OpenPGP keys that are trusted to sign reviews, regardless
+// of their trust level in the user's keyring.
+const TrustedOpenPGPKeyKey = "appraise.trustedOpenPGPKey"
+
+// The namespace used for SSH signatures, and the armor header lines that
+// identify each supported signature format.
+const (
+	signatureNamespace = "git-appraise"
+	sshSignaturePrefix = "-----BEGIN SSH SIGNATURE-----"
+	pgpSignaturePrefix = "-----BEGIN PGP SIGNATURE-----"
+)
+
+// EncryptToKey is the multi-valued git config setting that lists the
+// recipients to encrypt private reviews to. Each recipient is either an age
+// recipient (an "age1..." or "ssh-..." public key), or an OpenPGP key ID,
+// fingerprint, or email address in the user's keyring.
+const EncryptToKey = "appraise.encryptTo"
+
+// AgeIdentityKey is the multi-valued git config setting that lists the age
+// identity files used to decrypt private reviews.
+const AgeIdentityKey = "appraise.ageIdentity"
+
+// The armor header lines that identify each supported encryption format.
+const (
+	ageMessagePrefix = "-----BEGIN AGE ENCRYPTED FILE-----"
+	pgpMessagePrefix = "-----BEGIN PGP MESSAGE-----"
+)
+
+// NotesDiff describes how the notes annotating a single object differ between
+// two versions of a notes ref.
+type NotesDiff struct {
+	Revision string
+	Old      []Note
+	New      []Note
+}
+
 // CommitDetails represents the contents of a commit.
 type CommitDetails struct {
 	Author         string   `json:"author,omitempty"`
@@ -133,6 +189,55 @@ func (t *Tree) Contents() map[string]TreeChild {
 	return result
 }
 
+// NewTreeFromFiles constructs a new *Tree object holding the given files,
+// which are keyed by their slash-separated paths.
+func NewTreeFromFiles(files map[string]string) (*Tree, error) {
+	contents := make(map[string]TreeChild)
+	dirs := make(map[string]map[string]string)
+	for path, fileContents := range files {
+		name, rest, inDir := strings.Cut(path, "/")
+		if name == "" || inDir && rest == "" {
+			return nil, fmt.Errorf("invalid file path %q", path)
+		}
+		if !inDir {
+			contents[name] = NewBlob(fileContents)
+			continue
+		}
+		if dirs[name] == nil {
+			dirs[name] = make(map[string]string)
+		}
+		dirs[name][rest] = fileContents
+	}
+	for name, dirFiles := range dirs {
+		if _, ok := contents[name]; ok {
+			return nil, fmt.Errorf("%q is both a file and a directory", name)
+		}
+		subtree, err := NewTreeFromFiles(dirFiles)
+		if err != nil {
+			return nil, err
+		}
+		contents[name] = subtree
+	}
+	return NewTree(contents), nil
+}
+
+// Files returns the contents of every file under the tree, keyed by their
+// slash-separated paths.
+func (t *Tree) Files() map[string]string {
+	files := make(map[string]string)
+	for name, child := range t.contents {
+		switch child := child.(type) {
+		case *Blob:
+			files[name] = child.Contents()
+		case *Tree:
+			for path, contents := range child.Files() {
+				files[name+"/"+path] = contents
+			}
+		}
+	}
+	return files
+}
+
 type DiffOp int
 
 const (
@@ -189,8 +294,9 @@ type FileDiff struct {
 	Fragments []DiffFragment
 }
 
-// Repo represents a source code repository.
-type Repo interface {
+// CodeRepo represents a source code repository, which holds the commits
+// that are reviewed.
+type CodeRepo interface {
 	// GetPath returns the path to the repo.
 	GetPath() string
 
@@ -210,6 +316,33 @@ type Repo interface {
 	// GetSubmitStrategy returns the way in which a review is submitted
 	GetSubmitStrategy() (string, error)
 
+	// GetConfigValues returns all of the values set for the given config key
+	// (e.g. "remote.origin.fetch"), or an empty slice if the key is not set.
+	GetConfigValues(key string) ([]string, error)
+
+	// AddConfigValue adds a value for the given key to the repo's local config.
+	AddConfigValue(key, value string) error
+
+	// RemoveConfigValue removes every occurrence of the given value for the given
+	// key from the repo's local config. Removing a value that is not set is not an error.
+	RemoveConfigValue(key, value string) error
+
+	// SignPayload signs the given payload with the user's configured signing
+	// key, and returns the armored signature.
+	SignPayload(payload []byte) (string, error)
+
+	// VerifyPayloadSignature verifies that the given armored signature of the
+	// payload was made by the given signer (identified by email address).
+	VerifyPayloadSignature(payload []byte, signature, signer string) error
+
+	// EncryptPayload encrypts the given payload to the recipients configured
+	// by EncryptToKey, and returns the armored ciphertext.
+	EncryptPayload(payload []byte) (string, error)
+
+	// DecryptPayload decrypts the given armored ciphertext, using the user's
+	// OpenPGP keyring or the age identities configured by AgeIdentityKey.
+	DecryptPayload(ciphertext string) ([]byte, error)
+
 	// HasUncommittedChanges returns true if there are local, uncommitted changes.
 	HasUncommittedChanges() (bool, error)
 
@@ -342,6 +475,34 @@ type Repo interface {
 	// iff the ref currently points `previousCommitHash`.
 	SetRef(ref, newCommitHash, previousCommitHash string) error
 
+	// Remotes returns a list of the remotes.
+	Remotes() ([]string, error)
+
+	// Fetch fetches from the given remote using the supplied refspecs.
+	Fetch(remote string, refspecs ...string) error
+
+	// MergeArchives merges in the remote's state of the archives reference
+	// into the local repository's.
+	MergeArchives(remote, archiveRefPattern string) error
+
+	// CompactArchives squashes the history of each archive ref matching the
+	// given pattern, up to its last commit before the given time, into a
+	// single snapshot commit whose parents are every commit archived in
+	// that history, so that they all remain reachable.
+	//
+	// It returns the names of the refs that were compacted.
+	CompactArchives(archiveRefPattern string, before time.Time) ([]string, error)
+
+	// Push pushes the given refs to a remote repo.
+	Push(remote string, refPattern ...string) error
+}
+
+// ReviewStore represents the git notes in which reviews are stored, along with
+// the means of sharing them with remote repos.
+//
+// The notes annotate commits in a CodeRepo, but need not be stored in the
+// same repo as those commits.
+type ReviewStore interface {
 	// GetNotes reads the notes from the given ref that annotate the given revision.
 	GetNotes(notesRef, revision string) []Note
 
@@ -352,18 +513,55 @@ type Repo interface {
 	// This is the batch version of the corresponding GetNotes(...) method.
 	GetAllNotes(notesRef string) (map[string][]Note, error)
 
+	// Notes returns an iterator over the notes under the given ref, which
+	// yields the hash of every annotated object along with its notes. The
+	// ref may also be the hash of a notes commit.
+	//
+	// Unlike GetAllNotes, this reads the notes lazily as the iteration
+	// proceeds, and does not check which annotated objects are commits. If
+	// the prefix is not empty, then only the objects whose hashes start with
+	// it are yielded.
+	//
+	// The returned function reports the error, if any, that kept the notes
+	// from being read; when it is not nil, the notes yielded are incomplete.
+	// It should be checked after the iteration.
+	Notes(notesRef, prefix string) (iter.Seq2[string, []Note], func() error)
+
+	// DiffNotes compares two versions of a notes ref, and returns the notes of
+	// every annotated object whose notes differ between them.
+	//
+	// Both "from" and "to" may be either refs or commit hashes, and an empty
+	// "from" is treated as having no notes. This only relies on the git
+	// command line tool, so that it can read the quarantined objects that
+	// are visible to server-side hooks.
+	DiffNotes(from, to string) ([]NotesDiff, error)
+
+	// GetNotesCommit returns the hash of the commit that the given notes ref
+	// points to, or the empty string if there is no such ref. The hash can
+	// later be passed to DiffNotes, to find the notes that were added since.
+	GetNotesCommit(notesRef string) (string, error)
+
 	// AppendNote appends a note to a revision under the given ref.
 	AppendNote(ref, revision string, note Note) error
 
+	// AppendNotes appends the given notes to each of the given revisions
+	// under the given ref, in a single notes commit. If other notes are
+	// written to the ref in the meantime, then the notes commit is rebuilt
+	// on top of them, so that none are lost; if that keeps happening, then
+	// an error is returned and none of the notes are written.
+	AppendNotes(ref string, notes map[string][]Note) error
+
+	// RewriteNotesHistory rewrites every commit in the history of the given
+	// notes ref, so that each note line that matches a key of the given map
+	// is replaced by the corresponding value, and then updates the ref to
+	// point to the rewritten history.
+	//
+	// It returns the number of commits whose notes were changed.
+	RewriteNotesHistory(notesRef string, replacements map[string]Note) (int, error)
+
 	// ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
 	ListNotedRevisions(notesRef string) []string
 
-	// Remotes returns a list of the remotes.
-	Remotes() ([]string, error)
-
-	// Fetch fetches from the given remote using the supplied refspecs.
-	Fetch(remote string, refspecs ...string) error
-
 	// PushNotes pushes git notes to a remote repo.
 	PushNotes(remote, notesRefPattern string) error
 
@@ -393,9 +591,17 @@ type Repo interface {
 	// the local repository's.
 	MergeNotes(remote, notesRefPattern string) error
 
-	// MergeArchives merges in the remote's state of the archives reference
-	// into the local repository's.
-	MergeArchives(remote, archiveRefPattern string) error
+	// CompactNotes squashes the history of each notes ref matching the given
+	// pattern, up to its last commit before the given time, into a single
+	// snapshot commit with the same notes. Any later commits are rewritten
+	// on top of the snapshot.
+	//
+	// Compacting the same history always produces the same commits, so that
+	// clones which merge in a compacted ref compact their own copy of it
+	// rather than merging the squashed history back in.
+	//
+	// It returns the names of the refs that were compacted.
+	CompactNotes(notesRefPattern string, before time.Time) ([]string, error)
 
 	// FetchAndReturnNewReviewHashes fetches the notes "branches" and then
 	// susses out the IDs (the revision the review points to) of any new
@@ -405,7 +611,26 @@ type Repo interface {
 	// changed because the _names_ of these files correspond to the revisions
 	// they point to.
 	FetchAndReturnNewReviewHashes(remote, notesRefPattern string, devtoolsRefPatterns ...string) ([]string, error)
+}
 
-	// Push pushes the given refs to a remote repo.
-	Push(remote string, refPattern ...string) error
+// Repo represents a source code repository, along with the store of the
+// reviews of its commits.
+type Repo interface {
+	CodeRepo
+	ReviewStore
+}
+
+// WithContext returns a copy of the repo that runs each of its git commands
+// with the given context, so that they are killed once it is done. Repos
+// that do not run commands, such as the mock repo, are returned as is.
+func WithContext(ctx context.Context, repo Repo) Repo {
+	switch repo := repo.(type) {
+	case *GitRepo:
+		return repo.WithContext(ctx)
+	case *SidecarRepo:
+		return repo.WithContext(ctx)
+	case *NamespacedRepo:
+		return repo.WithContext(ctx)
+	}
+	return repo
 }
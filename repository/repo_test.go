@@ -2,8 +2,11 @@ package repository
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNoteHash(t *testing.T) {
@@ -131,6 +134,30 @@ func TestTreeNested(t *testing.T) {
 	}
 }
 
+func TestTreeFromFiles(t *testing.T) {
+	files := map[string]string{"a.txt": "A", "dir/b.txt": "B", "dir/sub/c.txt": "C"}
+	tree, err := NewTreeFromFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tree.Contents()["dir"].(*Tree); !ok {
+		t.Fatalf("expected a subtree, got %+v", tree.Contents())
+	}
+	if got := tree.Files(); !maps.Equal(got, files) {
+		t.Fatalf("Files() = %q, want %q", got, files)
+	}
+	for _, files := range []map[string]string{
+		{"": "empty"},
+		{"/a": "absolute"},
+		{"a/": "directory"},
+		{"a": "file", "a/b": "nested"},
+	} {
+		if _, err := NewTreeFromFiles(files); err == nil {
+			t.Errorf("expected an error for %q", files)
+		}
+	}
+}
+
 func TestDiffOpString(t *testing.T) {
 	tests := []struct {
 		op       DiffOp
@@ -664,6 +691,212 @@ func TestMockRepoGetAllNotes(t *testing.T) {
 	}
 }
 
+func TestMockRepoAppendNotes(t *testing.T) {
+	repo := NewMockRepoForTest()
+	if err := repo.AppendNotes("refs/notes/test", map[string][]Note{
+		TestCommitB: {Note("first"), Note("second")},
+		TestCommitD: {Note("third")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes("refs/notes/test", TestCommitB); len(notes) < 2 || string(notes[len(notes)-2]) != "first" || string(notes[len(notes)-1]) != "second" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+	if notes := repo.GetNotes("refs/notes/test", TestCommitD); len(notes) == 0 || string(notes[len(notes)-1]) != "third" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+}
+
+func TestMockRepoNotesIterator(t *testing.T) {
+	repo := NewMockRepoForTest()
+	if err := repo.AppendNote(TestRequestsRef, "not a commit", Note("note")); err != nil {
+		t.Fatal(err)
+	}
+	notes, notesErr := repo.Notes(TestRequestsRef, "")
+	var revisions []string
+	for revision, revisionNotes := range notes {
+		if len(revisionNotes) == 0 {
+			t.Errorf("expected notes for %q", revision)
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := notesErr(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{TestCommitB, TestCommitD, TestCommitG, "not a commit"}; !slices.Equal(revisions, want) {
+		t.Errorf("unexpected revisions %v, want %v", revisions, want)
+	}
+
+	commit, err := repo.GetNotesCommit(TestRequestsRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, notesErr = repo.Notes(commit, TestCommitD)
+	revisions = nil
+	for revision := range notes {
+		revisions = append(revisions, revision)
+		break
+	}
+	if !slices.Equal(revisions, []string{TestCommitD}) {
+		t.Errorf("unexpected revisions for the prefix %q: %v", TestCommitD, revisions)
+	}
+}
+
+func TestMockRepoDiffNotes(t *testing.T) {
+	repo := NewMockRepoForTest()
+	const newRef = "refs/notes/devtools/new"
+	if err := repo.AppendNote(newRef, TestCommitB, Note("new note")); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := repo.DiffNotes(TestRequestsRef, TestRequestsRef)
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("expected no differences, got %+v, %v", diffs, err)
+	}
+	diffs, err = repo.DiffNotes("", newRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Revision != TestCommitB || diffs[0].Old != nil || string(diffs[0].New[len(diffs[0].New)-1]) != "new note" {
+		t.Fatalf("unexpected diffs %+v", diffs)
+	}
+	diffs, err = repo.DiffNotes(TestRequestsRef, newRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		if diff.Revision != TestCommitB && diff.New != nil {
+			t.Errorf("expected the notes for %q to be removed, got %+v", diff.Revision, diff)
+		}
+	}
+	if len(diffs) != len(repo.ListNotedRevisions(TestRequestsRef)) {
+		t.Errorf("unexpected diffs %+v", diffs)
+	}
+}
+
+func TestMockRepoGetNotesCommit(t *testing.T) {
+	repo := NewMockRepoForTest()
+	if commit, err := repo.GetNotesCommit("refs/notes/devtools/missing"); err != nil || commit != "" {
+		t.Errorf("expected no commit for a missing ref, got %q, %v", commit, err)
+	}
+	before, err := repo.GetNotesCommit(TestRequestsRef)
+	if err != nil || before == "" {
+		t.Fatalf("unexpected commit %q, %v", before, err)
+	}
+	if err := repo.AppendNote(TestRequestsRef, TestCommitB, Note("new note")); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := repo.DiffNotes(before, TestRequestsRef)
+	if err != nil || len(diffs) != 1 || diffs[0].Revision != TestCommitB {
+		t.Errorf("unexpected diffs %+v, %v", diffs, err)
+	}
+	if after, err := repo.GetNotesCommit(TestRequestsRef); err != nil || after == before {
+		t.Errorf("expected the commit to change, got %q, %v", after, err)
+	}
+}
+
+func TestMockRepoConfigValues(t *testing.T) {
+	repo := NewMockRepoForTest()
+	for _, value := range []string{"a", "b", "a"} {
+		if err := repo.AddConfigValue("appraise.test", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.RemoveConfigValue("appraise.test", "a"); err != nil {
+		t.Fatal(err)
+	}
+	values, err := repo.GetConfigValues("appraise.test")
+	if err != nil || len(values) != 1 || values[0] != "b" {
+		t.Fatalf("unexpected values %q, %v", values, err)
+	}
+	if err := repo.RemoveConfigValue("appraise.test", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := repo.GetConfigValues("appraise.test"); values != nil {
+		t.Fatalf("unexpected values %q", values)
+	}
+}
+
+func TestMockRepoSignatures(t *testing.T) {
+	repo := NewMockRepoForTest()
+	signature, err := repo.SignPayload([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.VerifyPayloadSignature([]byte("payload"), signature, "user@example.com"); err != nil {
+		t.Errorf("unexpected verification failure: %v", err)
+	}
+	if err := repo.VerifyPayloadSignature([]byte("payload"), signature, "other@example.com"); err == nil {
+		t.Error("expected verification to fail for a different signer")
+	}
+	if err := repo.VerifyPayloadSignature([]byte("modified"), signature, "user@example.com"); err == nil {
+		t.Error("expected verification to fail for a modified payload")
+	}
+}
+
+func TestMockRepoEncryption(t *testing.T) {
+	repo := NewMockRepoForTest()
+	if _, err := repo.EncryptPayload([]byte("secret")); err == nil {
+		t.Error("expected an error encrypting without any recipients")
+	}
+	repo.AddConfigValue(EncryptToKey, "user@example.com")
+	ciphertext, err := repo.EncryptPayload([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ciphertext, "secret") {
+		t.Errorf("expected the payload to be encoded, got %q", ciphertext)
+	}
+	if plaintext, err := repo.DecryptPayload(ciphertext); err != nil || string(plaintext) != "secret" {
+		t.Errorf("unexpected decryption %q, %v", plaintext, err)
+	}
+	if _, err := repo.DecryptPayload("not a ciphertext"); err == nil {
+		t.Error("expected an error decrypting an unrecognized ciphertext")
+	}
+
+	repo = NewMockRepoForTest()
+	repo.AddConfigValue(EncryptToKey, "other@example.com")
+	ciphertext, err = repo.EncryptPayload([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.DecryptPayload(ciphertext); err == nil {
+		t.Error("expected an error decrypting a payload encrypted to someone else")
+	}
+}
+
+func TestMockRepoRewriteNotesHistory(t *testing.T) {
+	repo := NewMockRepoForTest()
+	const ref = "refs/notes/test"
+	for _, revision := range []string{TestCommitA, TestCommitB} {
+		if err := repo.AppendNote(ref, revision, Note("secret")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.AppendNote(ref, TestCommitC, Note("other")); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := repo.RewriteNotesHistory(ref, map[string]Note{"secret": Note("[redacted]")})
+	if err != nil || rewritten != 2 {
+		t.Fatalf("expected two revisions to be rewritten, got %d, %v", rewritten, err)
+	}
+	if notes := repo.GetNotes(ref, TestCommitA); string(notes[len(notes)-1]) != "[redacted]" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+	if notes := repo.GetNotes(ref, TestCommitC); string(notes[len(notes)-1]) != "other" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+}
+
+func TestMockRepoCompact(t *testing.T) {
+	repo := NewMockRepoForTest()
+	if compacted, err := repo.CompactNotes("refs/notes/devtools/*", time.Now()); err != nil || len(compacted) != 0 {
+		t.Errorf("expected nothing to compact, got %v, %v", compacted, err)
+	}
+	if compacted, err := repo.CompactArchives("refs/devtools/archives/*", time.Now()); err != nil || len(compacted) != 0 {
+		t.Errorf("expected nothing to compact, got %v, %v", compacted, err)
+	}
+}
+
 func TestMockRepoListNotedRevisions(t *testing.T) {
 	repo := NewMockRepoForTest()
 	revisions := repo.ListNotedRevisions(TestRequestsRef)
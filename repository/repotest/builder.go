@@ -0,0 +1,439 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package repotest provides a builder for populating an in-memory
+// repository.Repo with commits, branches, and reviews.
+//
+// This lets tools built on git-appraise write hermetic tests that do not
+// need the git command line tool:
+//
+//	repo, err := repotest.NewBuilder().
+//		Commit("master", "Initial commit", repotest.Files{"README.md": "Hello\n"}).
+//		Branch("feature", "master").
+//		Commit("feature", "Add a greeting", repotest.Files{"hello.txt": "Hi\n"}).
+//		Review("feature", "master", "Add a greeting").
+//		Accept("feature", "reviewer@example.com").
+//		Build()
+//
+// The repo is the one returned by repository.NewEmptyMockRepoForTest, so
+// its commits have files that can be shown, diffed, merged, and rebased,
+// but it has no remotes, and its signatures and encryption are fake.
+package repotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// archiveRef is the ref under which the review package archives the
+// commits of reviews that are rebased.
+const archiveRef = "refs/devtools/archives/reviews"
+
+// DefaultTime is the time of the first commit and note written by a Builder.
+var DefaultTime = time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Files maps the slash-separated paths of files to their contents.
+type Files map[string]string
+
+// Builder populates a repo with a scenario, one step at a time.
+//
+// Each method adds a step and returns the Builder, so that calls can be
+// chained. Branches may be named either in full (e.g. "refs/heads/master")
+// or by their short names (e.g. "master"). If a step fails, then the
+// remaining steps are skipped, and the error is returned by Build.
+//
+// Every commit and note is dated by a clock that starts at DefaultTime and
+// advances by a second for each one, so that the hashes of the commits do
+// not depend on when a test is run.
+type Builder struct {
+	repo  repository.Repo
+	err   error
+	clock time.Time
+	// reviews maps each branch under review to its review request.
+	reviews map[string]*review
+}
+
+// review is a review requested by a Builder.
+type review struct {
+	revision string
+	request  request.Request
+}
+
+// NewBuilder returns a Builder for a new, empty repo, whose HEAD points
+// to the master branch.
+func NewBuilder() *Builder {
+	return &Builder{
+		repo:    repository.NewEmptyMockRepoForTest(),
+		clock:   DefaultTime,
+		reviews: make(map[string]*review),
+	}
+}
+
+// Build returns the populated repo, or the error from the first step that failed.
+func (b *Builder) Build() (repository.Repo, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.repo, nil
+}
+
+// Revision returns the revision of the review requested for the given
+// branch, or the empty string if there is none.
+func (b *Builder) Revision(branch string) string {
+	if rev := b.reviews[branchRef(branch)]; rev != nil {
+		return rev.revision
+	}
+	return ""
+}
+
+// branchRef returns the full name of the given branch.
+func branchRef(branch string) string {
+	if strings.HasPrefix(branch, "refs/") {
+		return branch
+	}
+	return "refs/heads/" + branch
+}
+
+// step runs the given function, unless an earlier step failed.
+func (b *Builder) step(fn func() error) *Builder {
+	if b.err == nil {
+		b.err = fn()
+	}
+	return b
+}
+
+// head returns the commit at the tip of the given branch.
+func (b *Builder) head(branch string) (string, error) {
+	ref := branchRef(branch)
+	if ok, err := b.repo.HasRef(ref); err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("repotest: there is no branch %q", branch)
+	}
+	return b.repo.GetCommitHash(ref)
+}
+
+// getReview returns the review requested for the given branch.
+func (b *Builder) getReview(branch string) (*review, error) {
+	rev := b.reviews[branchRef(branch)]
+	if rev == nil {
+		return nil, fmt.Errorf("repotest: there is no review for %q", branch)
+	}
+	return rev, nil
+}
+
+// timestamp returns the timestamp for a new commit or note, and advances
+// the clock.
+func (b *Builder) timestamp() string {
+	t := b.clock
+	b.clock = b.clock.Add(time.Second)
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// withHead runs the given function, and then points HEAD back to where it was.
+func (b *Builder) withHead(fn func() error) error {
+	head, err := b.repo.GetHeadRef()
+	if err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return b.repo.SwitchToRef(head)
+}
+
+// At sets the time of the next commit or note.
+func (b *Builder) At(t time.Time) *Builder {
+	b.clock = t
+	return b
+}
+
+// Config adds a value for the given key to the repo's config.
+func (b *Builder) Config(key, value string) *Builder {
+	return b.step(func() error {
+		return b.repo.AddConfigValue(key, value)
+	})
+}
+
+// Commit adds a commit to the given branch that writes the given files,
+// creating the branch if it does not exist yet.
+func (b *Builder) Commit(branch, message string, files Files) *Builder {
+	return b.step(func() error {
+		for path := range files {
+			if path == "" || strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") || strings.Contains(path, "//") {
+				return fmt.Errorf("repotest: invalid path %q", path)
+			}
+		}
+		return b.commit(branch, message, func(contents map[string]string) {
+			maps.Copy(contents, files)
+		})
+	})
+}
+
+// Remove adds a commit to the given branch that removes the given files.
+func (b *Builder) Remove(branch, message string, paths ...string) *Builder {
+	return b.step(func() error {
+		return b.commit(branch, message, func(contents map[string]string) {
+			for _, path := range paths {
+				delete(contents, path)
+			}
+		})
+	})
+}
+
+// commit adds a commit to the given branch whose files are those of the
+// branch's head, as changed by the given function.
+func (b *Builder) commit(branch, message string, change func(contents map[string]string)) error {
+	ref := branchRef(branch)
+	contents := make(map[string]string)
+	var parents []string
+	if ok, err := b.repo.HasRef(ref); err != nil {
+		return err
+	} else if ok {
+		parent, err := b.repo.GetCommitHash(ref)
+		if err != nil {
+			return err
+		}
+		details, err := b.repo.GetCommitDetails(parent)
+		if err != nil {
+			return err
+		}
+		tree, err := b.repo.ReadTree(details.Tree)
+		if err != nil {
+			return err
+		}
+		contents = tree.Files()
+		parents = []string{parent}
+	}
+	change(contents)
+	tree, err := repository.NewTreeFromFiles(contents)
+	if err != nil {
+		return fmt.Errorf("repotest: %v", err)
+	}
+	hash, err := b.repo.CreateCommitWithTree(&repository.CommitDetails{
+		Summary: message,
+		Time:    b.timestamp(),
+		Parents: parents,
+	}, tree)
+	if err != nil {
+		return err
+	}
+	return b.repo.SetRef(ref, hash, "")
+}
+
+// Branch creates a new branch pointing to the head of an existing one.
+func (b *Builder) Branch(name, from string) *Builder {
+	return b.step(func() error {
+		ref := branchRef(name)
+		if ok, err := b.repo.HasRef(ref); err != nil {
+			return err
+		} else if ok {
+			return fmt.Errorf("repotest: the branch %q already exists", name)
+		}
+		hash, err := b.head(from)
+		if err != nil {
+			return err
+		}
+		return b.repo.SetRef(ref, hash, "")
+	})
+}
+
+// Checkout makes HEAD point to the given branch.
+func (b *Builder) Checkout(branch string) *Builder {
+	return b.step(func() error {
+		if _, err := b.head(branch); err != nil {
+			return err
+		}
+		return b.repo.SwitchToRef(branchRef(branch))
+	})
+}
+
+// Merge merges one branch into another, with a merge commit.
+func (b *Builder) Merge(branch, into string) *Builder {
+	return b.step(func() error {
+		for _, name := range []string{branch, into} {
+			if _, err := b.head(name); err != nil {
+				return err
+			}
+		}
+		return b.withHead(func() error {
+			if err := b.repo.SwitchToRef(branchRef(into)); err != nil {
+				return err
+			}
+			return b.repo.MergeRef(branchRef(branch), false)
+		})
+	})
+}
+
+// Review requests a review of the commits on the given branch that are
+// not on the target branch, as the configured user.
+//
+// The review's revision is the first of those commits, and the given
+// description defaults to that commit's message.
+func (b *Builder) Review(branch, target, description string) *Builder {
+	return b.step(func() error {
+		if _, err := b.head(branch); err != nil {
+			return err
+		}
+		base, err := b.head(target)
+		if err != nil {
+			return err
+		}
+		reviewRef, targetRef := branchRef(branch), branchRef(target)
+		var commits []string
+		for _, commit := range b.repo.ListCommits(reviewRef) {
+			merged, err := b.repo.IsAncestor(commit, targetRef)
+			if err != nil {
+				return err
+			}
+			if !merged {
+				commits = append(commits, commit)
+			}
+		}
+		if len(commits) == 0 {
+			return fmt.Errorf("repotest: %q has no commits that are not in %q", branch, target)
+		}
+		if description == "" {
+			if description, err = b.repo.GetCommitMessage(commits[0]); err != nil {
+				return err
+			}
+		}
+		requester, err := b.repo.GetUserEmail()
+		if err != nil {
+			return err
+		}
+		r := request.New(requester, nil, reviewRef, targetRef, description)
+		r.Timestamp = b.timestamp()
+		r.BaseCommit = base
+		rev := &review{revision: commits[0], request: r}
+		if err := b.appendRequest(rev); err != nil {
+			return err
+		}
+		b.reviews[reviewRef] = rev
+		return nil
+	})
+}
+
+// appendRequest writes the given review's request.
+func (b *Builder) appendRequest(rev *review) error {
+	note, err := rev.request.Write()
+	if err != nil {
+		return err
+	}
+	return b.repo.AppendNote(request.Ref, rev.revision, note)
+}
+
+// Comment adds a comment by the given author to the review of the given
+// branch, on the branch's head commit.
+func (b *Builder) Comment(branch, author, message string) *Builder {
+	return b.addComment(branch, author, message, nil)
+}
+
+// Accept adds a comment by the given author that accepts the review of
+// the given branch.
+func (b *Builder) Accept(branch, author string) *Builder {
+	resolved := true
+	return b.addComment(branch, author, "", &resolved)
+}
+
+// Reject adds a comment by the given author that rejects the review of
+// the given branch.
+func (b *Builder) Reject(branch, author, message string) *Builder {
+	resolved := false
+	return b.addComment(branch, author, message, &resolved)
+}
+
+// addComment adds a comment to the review of the given branch.
+func (b *Builder) addComment(branch, author, message string, resolved *bool) *Builder {
+	return b.step(func() error {
+		rev, err := b.getReview(branch)
+		if err != nil {
+			return err
+		}
+		head, err := b.head(branch)
+		if err != nil {
+			return err
+		}
+		c := comment.New(author, message)
+		c.Timestamp = b.timestamp()
+		c.Location = &comment.Location{Commit: head}
+		c.Resolved = resolved
+		note, err := c.Write()
+		if err != nil {
+			return err
+		}
+		return b.repo.AppendNote(comment.Ref, rev.revision, note)
+	})
+}
+
+// CIReport adds a continuous integration report with the given status
+// (e.g. ci.StatusSuccess) for the head commit of the given branch.
+func (b *Builder) CIReport(branch, status string) *Builder {
+	return b.step(func() error {
+		head, err := b.head(branch)
+		if err != nil {
+			return err
+		}
+		report := ci.Report{
+			Timestamp: b.timestamp(),
+			Status:    status,
+			Agent:     "repotest",
+		}
+		note, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		return b.repo.AppendNote(ci.Ref, head, repository.Note(note))
+	})
+}
+
+// Rebase rebases the review of the given branch onto its target branch,
+// the way that "git appraise rebase" does: the branch's old head is
+// archived, and the review request is updated with the new head.
+func (b *Builder) Rebase(branch string) *Builder {
+	return b.step(func() error {
+		rev, err := b.getReview(branch)
+		if err != nil {
+			return err
+		}
+		err = b.withHead(func() error {
+			if err := b.repo.ArchiveRef(rev.request.ReviewRef, archiveRef); err != nil {
+				return err
+			}
+			if err := b.repo.SwitchToRef(rev.request.ReviewRef); err != nil {
+				return err
+			}
+			return b.repo.RebaseRef(rev.request.TargetRef)
+		})
+		if err != nil {
+			return err
+		}
+		if rev.request.Alias, err = b.repo.GetCommitHash(rev.request.ReviewRef); err != nil {
+			return err
+		}
+		rev.request.Timestamp = b.timestamp()
+		return b.appendRequest(rev)
+	})
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repotest
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/ci"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// mustBuild returns the repo built by the given builder.
+func mustBuild(t *testing.T, b *Builder) repository.Repo {
+	t.Helper()
+	repo, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// mustResolve returns the hash of the given revision.
+func mustResolve(t *testing.T, repo repository.Repo, rev string) string {
+	t.Helper()
+	hash, err := repo.GetCommitHash(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// twoBranchesBuilder returns a builder for a repo with a master branch of
+// two commits, and a feature branch of one commit on top of the first.
+func twoBranchesBuilder() *Builder {
+	return NewBuilder().
+		Commit("master", "First commit", Files{"README.md": "Hello\n"}).
+		Branch("feature", "master").
+		Commit("master", "Second commit", Files{"README.md": "Hello, world\n"}).
+		Commit("feature", "Feature commit\n\nWith details.", Files{"feature.txt": "Feature\n"})
+}
+
+func TestBuilderCommit(t *testing.T) {
+	repo := mustBuild(t, NewBuilder().
+		At(time.Unix(1000, 0).UTC()).
+		Commit("master", "First commit", Files{"a.txt": "A\n", "dir/b.txt": "B\n"}).
+		Commit("refs/heads/master", "Second commit", Files{"dir/c.txt": "C\n"}).
+		Remove("master", "Third commit", "a.txt", "missing.txt"))
+	head, err := repo.GetCommitDetails("HEAD")
+	if err != nil || head.Time != "1002" || head.Summary != "Third commit" {
+		t.Errorf("unexpected head commit %+v, %v", head, err)
+	}
+	for path, want := range map[string]string{"dir/b.txt": "B", "dir/c.txt": "C"} {
+		if got, err := repo.Show("HEAD", path); err != nil || got != want {
+			t.Errorf("Show(%q) = %q, %v", path, got, err)
+		}
+	}
+	if _, err := repo.Show("HEAD", "a.txt"); err == nil {
+		t.Error("expected the removed file to be missing")
+	}
+	if commits := repo.ListCommits("refs/heads/master"); len(commits) != 3 {
+		t.Errorf("unexpected commits %q", commits)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	for name, b := range map[string]*Builder{
+		"empty path":         NewBuilder().Commit("master", "Commit", Files{"": "contents"}),
+		"absolute path":      NewBuilder().Commit("master", "Commit", Files{"/a": "contents"}),
+		"directory path":     NewBuilder().Commit("master", "Commit", Files{"a/": "contents"}),
+		"empty segment":      NewBuilder().Commit("master", "Commit", Files{"a//b": "contents"}),
+		"file and dir":       NewBuilder().Commit("master", "Commit", Files{"a": "file", "a/b": "nested"}),
+		"file becomes dir":   twoBranchesBuilder().Commit("master", "Commit", Files{"README.md/nested": "nested"}),
+		"existing branch":    twoBranchesBuilder().Branch("feature", "master"),
+		"missing branch":     twoBranchesBuilder().Branch("other", "missing"),
+		"checkout missing":   twoBranchesBuilder().Checkout("missing"),
+		"merge missing":      twoBranchesBuilder().Merge("missing", "master"),
+		"merge into missing": twoBranchesBuilder().Merge("feature", "missing"),
+		"review missing":     twoBranchesBuilder().Review("missing", "master", ""),
+		"review merged":      twoBranchesBuilder().Review("master", "master", ""),
+		"review no email":    twoBranchesBuilder().Config("user.email", "").Review("feature", "master", ""),
+		"comment no review":  twoBranchesBuilder().Comment("feature", "reviewer", "Comment"),
+		"accept no review":   twoBranchesBuilder().Accept("feature", "reviewer"),
+		"reject no review":   twoBranchesBuilder().Reject("feature", "reviewer", "No"),
+		"ci missing":         twoBranchesBuilder().CIReport("missing", ci.StatusSuccess),
+		"rebase no review":   twoBranchesBuilder().Rebase("feature"),
+		"rebase conflict": twoBranchesBuilder().
+			Commit("feature", "Conflict", Files{"README.md": "Conflict\n"}).
+			Review("feature", "master", "").
+			Rebase("feature"),
+	} {
+		if repo, err := b.Build(); err == nil {
+			t.Errorf("%s: expected an error, got %+v", name, repo)
+		}
+	}
+	// Steps after a failure are skipped.
+	b := NewBuilder().Branch("feature", "missing").Commit("master", "Commit", nil)
+	if _, err := b.Build(); err == nil || !strings.Contains(err.Error(), `there is no branch "missing"`) {
+		t.Errorf("expected the first error, got %v", err)
+	}
+	if ok, _ := b.repo.HasRef("refs/heads/master"); ok {
+		t.Error("expected the steps after an error to be skipped")
+	}
+}
+
+func TestBuilderBranches(t *testing.T) {
+	repo := mustBuild(t, twoBranchesBuilder().
+		Checkout("feature").
+		Merge("feature", "master"))
+	if ref, _ := repo.GetHeadRef(); ref != "refs/heads/feature" {
+		t.Errorf("expected the merge to leave HEAD at the feature branch, got %q", ref)
+	}
+	merge, err := repo.GetCommitDetails("refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merge.Parents) != 2 || merge.Parents[1] != mustResolve(t, repo, "refs/heads/feature") || merge.Summary != "Merge branch 'feature'" {
+		t.Errorf("unexpected merge commit %+v", merge)
+	}
+	if message, _ := repo.GetCommitMessage(merge.Parents[0]); message != "Second commit" {
+		t.Errorf("unexpected first parent of the merge %q", message)
+	}
+	for path, want := range map[string]string{"README.md": "Hello, world", "feature.txt": "Feature"} {
+		if got, err := repo.Show("refs/heads/master", path); err != nil || got != want {
+			t.Errorf("Show(%q) = %q, %v", path, got, err)
+		}
+	}
+}
+
+func TestBuilderReview(t *testing.T) {
+	b := twoBranchesBuilder().
+		Review("feature", "master", "").
+		Comment("feature", "reviewer@example.com", "Looks good").
+		CIReport("feature", ci.StatusSuccess).
+		Reject("feature", "reviewer@example.com", "Needs a rebase").
+		Rebase("feature").
+		Accept("feature", "reviewer@example.com")
+	repo := mustBuild(t, b)
+	revision := b.Revision("feature")
+	if revision == "" || b.Revision("refs/heads/feature") != revision || b.Revision("master") != "" {
+		t.Fatalf("unexpected revisions %q, %q", revision, b.Revision("master"))
+	}
+	if message, _ := repo.GetCommitMessage(revision); !strings.HasPrefix(message, "Feature commit") {
+		t.Errorf("unexpected review revision message %q", message)
+	}
+	requests := request.ParseAllValid(repo.GetNotes(request.Ref, revision))
+	if len(requests) != 2 {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	first, rebased := requests[0], requests[1]
+	if first.Requester != "user@example.com" || first.ReviewRef != "refs/heads/feature" || first.TargetRef != "refs/heads/master" ||
+		first.Description != "Feature commit\n\nWith details." || first.BaseCommit != mustResolve(t, repo, "refs/heads/master") || first.Alias != "" {
+		t.Errorf("unexpected request %+v", first)
+	}
+	head := mustResolve(t, repo, "refs/heads/feature")
+	if rebased.Alias != head || rebased.Timestamp <= first.Timestamp {
+		t.Errorf("unexpected rebased request %+v", rebased)
+	}
+	if ok, _ := repo.IsAncestor("refs/heads/master", head); !ok {
+		t.Error("expected the feature branch to be rebased onto master")
+	}
+	for path, want := range map[string]string{"README.md": "Hello, world", "feature.txt": "Feature"} {
+		if got, err := repo.Show(head, path); err != nil || got != want {
+			t.Errorf("Show(%q) = %q, %v", path, got, err)
+		}
+	}
+	if ok, _ := repo.IsAncestor(revision, archiveRef); !ok {
+		t.Error("expected the original commits to be archived")
+	}
+	if ref, _ := repo.GetHeadRef(); ref != "refs/heads/master" {
+		t.Errorf("expected the rebase to leave HEAD unchanged, got %q", ref)
+	}
+
+	comments := comment.ParseAllValid(repo.GetNotes(comment.Ref, revision))
+	var resolved []string
+	for _, c := range comments {
+		if c.Author != "reviewer@example.com" {
+			t.Errorf("unexpected comment %+v", c)
+		}
+		state := "comment"
+		if c.Resolved != nil && *c.Resolved {
+			state = "accept"
+			if c.Location.Commit != head {
+				t.Errorf("expected the approval to be on the rebased head, got %+v", c.Location)
+			}
+		} else if c.Resolved != nil {
+			state = "reject:" + c.Description
+		}
+		resolved = append(resolved, state)
+	}
+	slices.Sort(resolved)
+	if !slices.Equal(resolved, []string{"accept", "comment", "reject:Needs a rebase"}) {
+		t.Errorf("unexpected comments %q", resolved)
+	}
+
+	reports := ci.ParseAllValid(repo.GetNotes(ci.Ref, revision))
+	if len(reports) != 1 || reports[0].Status != ci.StatusSuccess || reports[0].Agent != "repotest" {
+		t.Errorf("unexpected CI reports %+v", reports)
+	}
+}
+
+func TestBuilderReviewDescription(t *testing.T) {
+	b := twoBranchesBuilder().Review("feature", "master", "A description")
+	repo := mustBuild(t, b)
+	requests := request.ParseAllValid(repo.GetNotes(request.Ref, b.Revision("feature")))
+	if len(requests) != 1 || requests[0].Description != "A description" {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repotest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"msrl.dev/git-appraise/client"
+	"msrl.dev/git-appraise/repository/repotest"
+	"msrl.dev/git-appraise/review"
+	"msrl.dev/git-appraise/review/ci"
+)
+
+func Example() {
+	b := repotest.NewBuilder().
+		Commit("master", "Initial commit", repotest.Files{"README.md": "Hello\n"}).
+		Branch("feature", "master").
+		Commit("feature", "Add a greeting", repotest.Files{"hello.txt": "Hi\n"}).
+		Review("feature", "master", "").
+		Comment("feature", "reviewer@example.com", "Could this be friendlier?").
+		Commit("feature", "Make the greeting friendlier", repotest.Files{"hello.txt": "Hi there!\n"}).
+		CIReport("feature", ci.StatusSuccess).
+		Accept("feature", "reviewer@example.com")
+	repo, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	r, err := review.Get(repo, b.Revision("feature"))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(r.Request.Description)
+	fmt.Println(*r.Resolved, r.Reports[0].Status)
+	base, err := r.GetBaseCommit()
+	if err != nil {
+		panic(err)
+	}
+	head, err := r.GetHeadCommit()
+	if err != nil {
+		panic(err)
+	}
+	diffs, err := repo.ParsedDiff(base, head)
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range diffs {
+		fmt.Println(file.NewName)
+		for _, line := range file.Fragments[0].Lines {
+			fmt.Println(line.Op, line.Line)
+		}
+	}
+	// Output:
+	// Add a greeting
+	// true success
+	// hello.txt
+	// + Hi there!
+}
+
+func TestClientSubmit(t *testing.T) {
+	b := repotest.NewBuilder().
+		Commit("master", "Initial commit", repotest.Files{"README.md": "Hello\n"}).
+		Branch("feature", "master").
+		Commit("feature", "Add a feature", repotest.Files{"feature.txt": "Feature\n"}).
+		Commit("master", "Change the README", repotest.Files{"README.md": "Hello, world\n"}).
+		Review("feature", "master", "")
+	repo, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := client.New(repo)
+	revision := b.Revision("feature")
+	if err := c.Submit(ctx, revision, client.SubmitOptions{}); !errors.Is(err, client.ErrNotAccepted) {
+		t.Fatalf("expected an unaccepted review to not be submitted, got %v", err)
+	}
+	if _, err := c.Accept(ctx, revision, client.CommentOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Submit(ctx, revision, client.SubmitOptions{}); !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("expected a review behind its target to not be submitted, got %v", err)
+	}
+	if err := c.Rebase(ctx, revision, client.RebaseOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Submit(ctx, revision, client.SubmitOptions{Strategy: client.StrategyMerge}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Get(ctx, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Submitted {
+		t.Errorf("expected the review to be submitted: %+v", r.Summary)
+	}
+	for path, want := range map[string]string{"README.md": "Hello, world", "feature.txt": "Feature"} {
+		if got, err := repo.Show("refs/heads/master", path); err != nil || got != want {
+			t.Errorf("Show(%q) = %q, %v", path, got, err)
+		}
+	}
+	if message, _ := repo.GetCommitMessage("refs/heads/master"); message != fmt.Sprintf("Submitting review %.12s\n\nAdd a feature", revision) {
+		t.Errorf("unexpected merge message %q", message)
+	}
+}
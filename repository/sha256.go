@@ -0,0 +1,859 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// usesGit reports whether the objects of the repo are read and written with
+// git itself, rather than go-git.
+//
+// go-git fixes the size of object names when it is built, so it cannot read
+// repos that use SHA-256 object names. The methods in this file handle those
+// repos in the same way that the go-git code in git.go handles SHA-1 ones.
+func (repo *GitRepo) usesGit() bool {
+	return repo.objectFormat == formatcfg.SHA256
+}
+
+// isObjectName reports whether the given string is a full object name, in
+// either of the object formats.
+func isObjectName(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
+
+// runGitCommandWithInput runs the given git command with the given input,
+// and returns its stdout, which unlike that of runGitCommand is not trimmed.
+func (repo *GitRepo) runGitCommandWithInput(input string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := repo.runGitCommandWithIO(strings.NewReader(input), &stdout, &stderr, args...)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s", msg)
+		}
+	}
+	return stdout.String(), err
+}
+
+// readObjectWithGit returns the name, type, and contents of the object that
+// the given revision names.
+func (repo *GitRepo) readObjectWithGit(revision string) (hash, kind, contents string, err error) {
+	if strings.Contains(revision, "\n") {
+		return "", "", "", fmt.Errorf("invalid revision %q", revision)
+	}
+	out, err := repo.runGitCommandWithInput(revision+"\n", "cat-file", "--batch")
+	if err != nil {
+		return "", "", "", err
+	}
+	// The object is printed as "<hash> SP <type> SP <size> LF <contents> LF",
+	// or as "<revision> SP missing LF" if there is no such object.
+	header, rest, _ := strings.Cut(out, "\n")
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return "", "", "", fmt.Errorf("object %q not found", revision)
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil || size > len(rest) {
+		return "", "", "", fmt.Errorf("failed to read the object %q: %q", revision, header)
+	}
+	return fields[0], fields[1], rest[:size], nil
+}
+
+// readBlobWithGit returns the contents of the given blob.
+func (repo *GitRepo) readBlobWithGit(hash string) (string, error) {
+	_, kind, contents, err := repo.readObjectWithGit(hash)
+	if err == nil && kind != "blob" {
+		err = fmt.Errorf("object %q is a %s, not a blob", hash, kind)
+	}
+	return contents, err
+}
+
+// gitCommit is a commit that was read with git itself.
+type gitCommit struct {
+	Hash      string
+	Tree      string
+	Parents   []string
+	Author    object.Signature
+	Committer object.Signature
+	Message   string
+	// headers holds the commit's other headers (e.g. "encoding"), along
+	// with their continuation lines, except for its signature, which is
+	// dropped when the commit is rewritten.
+	headers []string
+}
+
+// readCommitWithGit reads the commit that the given revision points to.
+func (repo *GitRepo) readCommitWithGit(revision string) (*gitCommit, error) {
+	hash, _, contents, err := repo.readObjectWithGit(revision + "^{commit}")
+	if err != nil {
+		return nil, err
+	}
+	header, message, _ := strings.Cut(contents, "\n\n")
+	c := &gitCommit{Hash: hash, Message: message}
+	signature := false
+	for line := range strings.SplitSeq(header, "\n") {
+		if strings.HasPrefix(line, " ") {
+			if !signature && len(c.headers) > 0 {
+				c.headers[len(c.headers)-1] += "\n" + line
+			}
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		signature = false
+		switch key {
+		case "tree":
+			c.Tree = value
+		case "parent":
+			c.Parents = append(c.Parents, value)
+		case "author":
+			c.Author.Decode([]byte(value))
+		case "committer":
+			c.Committer.Decode([]byte(value))
+		case "gpgsig", "gpgsig-sha256":
+			signature = true
+		default:
+			c.headers = append(c.headers, line)
+		}
+	}
+	return c, nil
+}
+
+// writeCommitWithGit stores the given commit, without any signature, and
+// returns its hash.
+func (repo *GitRepo) writeCommitWithGit(c *gitCommit) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tree %s\n", c.Tree)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&b, "parent %s\n", parent)
+	}
+	b.WriteString("author ")
+	c.Author.Encode(&b)
+	b.WriteString("\ncommitter ")
+	c.Committer.Encode(&b)
+	b.WriteString("\n")
+	for _, header := range c.headers {
+		b.WriteString(header + "\n")
+	}
+	b.WriteString("\n" + c.Message)
+	out, err := repo.runGitCommandWithInput(b.String(), "hash-object", "-t", "commit", "-w", "--stdin")
+	return strings.TrimSpace(out), err
+}
+
+// gitTreeEntry is an entry of a tree that was read with git itself.
+type gitTreeEntry struct {
+	Mode, Type, Hash, Name string
+}
+
+// readTreeWithGit returns the entries of the given tree.
+func (repo *GitRepo) readTreeWithGit(treeish string) ([]gitTreeEntry, error) {
+	out, err := repo.runGitCommandWithInput("", "ls-tree", "-z", "--end-of-options", treeish)
+	if err != nil {
+		return nil, err
+	}
+	var entries []gitTreeEntry
+	for line := range strings.SplitSeq(out, "\x00") {
+		// Each entry has the form "<mode> SP <type> SP <hash> TAB <name>".
+		info, name, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 {
+			continue
+		}
+		entries = append(entries, gitTreeEntry{Mode: fields[0], Type: fields[1], Hash: fields[2], Name: name})
+	}
+	return entries, nil
+}
+
+// writeTreeWithGit stores a tree with the given entries, and returns its
+// hash.
+func (repo *GitRepo) writeTreeWithGit(entries []gitTreeEntry) (string, error) {
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s %s %s\t%s\x00", e.Mode, e.Type, e.Hash, e.Name)
+	}
+	out, err := repo.runGitCommandWithInput(b.String(), "mktree", "-z")
+	return strings.TrimSpace(out), err
+}
+
+// storeTreeWithGit is StoreTree for repos whose objects go-git cannot write.
+func (repo *GitRepo) storeTreeWithGit(contents map[string]TreeChild) (string, error) {
+	var entries []gitTreeEntry
+	for path, obj := range contents {
+		objHash, err := obj.Store(repo)
+		if err != nil {
+			return "", err
+		}
+		mode := "040000"
+		if obj.Type() == "blob" {
+			mode = "100644"
+		}
+		entries = append(entries, gitTreeEntry{Mode: mode, Type: obj.Type(), Hash: objHash, Name: path})
+	}
+	h, err := repo.writeTreeWithGit(entries)
+	if err != nil {
+		return "", fmt.Errorf("failure storing a git tree: %v", err)
+	}
+	return h, nil
+}
+
+// readTreeWithHashWithGit is readTreeWithHash for repos whose objects go-git
+// cannot read.
+func (repo *GitRepo) readTreeWithHashWithGit(ref, hash string) (*Tree, error) {
+	entries, err := repo.readTreeWithGit(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failure listing the file contents of %q: %v", ref, err)
+	}
+	contents := make(map[string]TreeChild)
+	for _, entry := range entries {
+		var child TreeChild
+		switch entry.Type {
+		case "tree":
+			child, err = repo.readTreeWithHashWithGit(entry.Hash, entry.Hash)
+		case "blob":
+			child, err = repo.readBlob(entry.Hash)
+		default:
+			return nil, fmt.Errorf("unrecognized tree object type for entry %q: submodule", entry.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read a tree child object: %v", err)
+		}
+		contents[entry.Name] = child
+	}
+	result := NewTree(contents)
+	result.savedHashes[repo] = hash
+	return result, nil
+}
+
+// hasObjectWithGit returns whether the repo contains an object with the
+// given hash.
+func (repo *GitRepo) hasObjectWithGit(hash string) (bool, error) {
+	_, _, err := repo.runGitCommandRaw("cat-file", "-e", "--end-of-options", hash)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setRefWithGit is SetRef for repos whose objects go-git cannot read.
+func (repo *GitRepo) setRefWithGit(ref, newCommitHash, previousCommitHash string) error {
+	args := []string{"update-ref", "--no-deref", ref, newCommitHash}
+	if previousCommitHash != "" {
+		args = append(args, previousCommitHash)
+	}
+	if _, err := repo.runGitCommand(args...); err != nil {
+		if current, _ := repo.runGitCommand("rev-parse", "--verify", "--quiet", ref); previousCommitHash != "" && current != previousCommitHash {
+			return fmt.Errorf("%w: %v", storage.ErrReferenceHasChanged, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// getRefHashesWithGit returns the hash of every ref under the given prefix.
+func (repo *GitRepo) getRefHashesWithGit(refPrefix string) (map[string]string, error) {
+	out, err := repo.runGitCommand("for-each-ref", "--format=%(objectname) %(refname)", refPrefix)
+	if err != nil {
+		return nil, err
+	}
+	refsMap := make(map[string]string)
+	for line := range strings.SplitSeq(out, "\n") {
+		if hash, name, ok := strings.Cut(line, " "); ok {
+			refsMap[name] = hash
+		}
+	}
+	return refsMap, nil
+}
+
+// notesCommitWithGit returns the hash of the notes commit that the given
+// ref points to, or the empty string if there is no such ref. The hash of a
+// notes commit is also accepted in place of the ref.
+func (repo *GitRepo) notesCommitWithGit(notesRef string) (string, error) {
+	if hasRef, err := repo.HasRef(notesRef); err != nil {
+		return "", err
+	} else if !hasRef && !isObjectName(notesRef) {
+		return "", nil
+	}
+	return repo.GetCommitHash(notesRef)
+}
+
+// getNotesWithGit is GetNotes for repos whose objects go-git cannot read.
+func (repo *GitRepo) getNotesWithGit(notesRef, revision string) []Note {
+	blob, err := repo.runGitCommand("notes", "--ref", notesRef, "list", revision)
+	if err != nil {
+		return nil
+	}
+	contents, err := repo.readBlobWithGit(blob)
+	if err != nil {
+		return nil
+	}
+	return splitNotesBlob(contents)
+}
+
+// notesWithGit is Notes for repos whose objects go-git cannot read.
+//
+// The notes of all of the matching objects are read at once, with a single
+// git process, before the first of them is yielded.
+func (repo *GitRepo) notesWithGit(notesRef, prefix string) (iter.Seq2[string, []Note], func() error) {
+	var err error
+	notes := func(yield func(string, []Note) bool) {
+		var commit string
+		if commit, err = repo.notesCommitWithGit(notesRef); err != nil || commit == "" {
+			return
+		}
+		var blobs map[string]string
+		if blobs, err = repo.listNotesBlobs(commit); err != nil {
+			return
+		}
+		var revisions, hashes []string
+		for revision, blob := range blobs {
+			if strings.HasPrefix(revision, prefix) {
+				revisions = append(revisions, revision)
+				hashes = append(hashes, blob)
+			}
+		}
+		slices.Sort(revisions)
+		slices.Sort(hashes)
+		var contents map[string][]Note
+		if contents, err = repo.readNotesBlobs(slices.Compact(hashes)); err != nil {
+			return
+		}
+		for _, revision := range revisions {
+			if !yield(revision, contents[blobs[revision]]) {
+				return
+			}
+		}
+	}
+	return notes, func() error { return err }
+}
+
+// listNotedRevisionsWithGit is listNotedRevisions for repos whose objects
+// go-git cannot read.
+func (repo *GitRepo) listNotedRevisionsWithGit(notesRef string, isCommit func(string) bool) []string {
+	commit, err := repo.notesCommitWithGit(notesRef)
+	if err != nil || commit == "" {
+		return nil
+	}
+	blobs, err := repo.listNotesBlobs(commit)
+	if err != nil {
+		return nil
+	}
+	var revisions []string
+	for _, revision := range slices.Sorted(maps.Keys(blobs)) {
+		if isCommit(revision) {
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions
+}
+
+// buildNotesTreeWithGit is buildNotesTree for repos whose objects go-git
+// cannot read. The existing tree is given by its hash, or is empty.
+func (repo *GitRepo) buildNotesTreeWithGit(existing string, blobs map[string]string) (string, error) {
+	var existingEntries []gitTreeEntry
+	if existing != "" {
+		var err error
+		if existingEntries, err = repo.readTreeWithGit(existing); err != nil {
+			return "", err
+		}
+	}
+	fanout := slices.ContainsFunc(existingEntries, func(e gitTreeEntry) bool { return e.Type == "tree" })
+	var entries []gitTreeEntry
+	if !fanout {
+		for _, e := range existingEntries {
+			if _, ok := blobs[e.Name]; !ok {
+				entries = append(entries, e)
+			}
+		}
+		return repo.writeTreeWithGit(appendNoteEntriesWithGit(entries, blobs))
+	}
+
+	// Group the blobs by the fan-out directory that holds them.
+	subtrees := make(map[string]map[string]string)
+	for revision, blob := range blobs {
+		if subtrees[revision[:2]] == nil {
+			subtrees[revision[:2]] = make(map[string]string)
+		}
+		subtrees[revision[:2]][revision[2:]] = blob
+	}
+	for _, e := range existingEntries {
+		updates, ok := subtrees[e.Name]
+		if e.Type != "tree" || !ok {
+			if _, ok := blobs[e.Name]; !ok {
+				entries = append(entries, e)
+			}
+			continue
+		}
+		subEntries, err := repo.readTreeWithGit(e.Hash)
+		if err != nil {
+			return "", err
+		}
+		subEntries = slices.DeleteFunc(subEntries, func(se gitTreeEntry) bool {
+			_, ok := updates[se.Name]
+			return ok
+		})
+		h, err := repo.writeTreeWithGit(appendNoteEntriesWithGit(subEntries, updates))
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, gitTreeEntry{Mode: "040000", Type: "tree", Hash: h, Name: e.Name})
+		delete(subtrees, e.Name)
+	}
+	for dir, updates := range subtrees {
+		h, err := repo.writeTreeWithGit(appendNoteEntriesWithGit(nil, updates))
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, gitTreeEntry{Mode: "040000", Type: "tree", Hash: h, Name: dir})
+	}
+	return repo.writeTreeWithGit(entries)
+}
+
+// appendNoteEntriesWithGit appends a tree entry for each of the given notes
+// blobs, keyed by their names within the tree.
+func appendNoteEntriesWithGit(entries []gitTreeEntry, blobs map[string]string) []gitTreeEntry {
+	for name, blob := range blobs {
+		entries = append(entries, gitTreeEntry{Mode: "100644", Type: "blob", Hash: blob, Name: name})
+	}
+	return entries
+}
+
+// appendNotesWithGit is appendNotes for repos whose objects go-git cannot
+// read.
+func (repo *GitRepo) appendNotesWithGit(notesRef string, notes map[string][]Note) error {
+	parent, err := repo.GetNotesCommit(notesRef)
+	if err != nil {
+		return err
+	}
+	existing, err := repo.listNotesBlobs(parent)
+	if err != nil {
+		return err
+	}
+	blobs := make(map[string]string)
+	for revision, revisionNotes := range notes {
+		if len(revisionNotes) == 0 {
+			continue
+		}
+		var newContent string
+		if blob, ok := existing[revision]; ok {
+			if contents, err := repo.readBlobWithGit(blob); err == nil && contents != "" {
+				newContent = strings.TrimRight(contents, "\n") + "\n"
+			}
+		}
+		for _, note := range revisionNotes {
+			newContent += string(note) + "\n"
+		}
+		if blobs[revision], err = repo.StoreBlob(newContent); err != nil {
+			return err
+		}
+	}
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	var existingTree string
+	var parents []string
+	if parent != "" {
+		existingTree = parent + "^{tree}"
+		parents = []string{parent}
+	}
+	treeHash, err := repo.buildNotesTreeWithGit(existingTree, blobs)
+	if err != nil {
+		return err
+	}
+	sig := repo.notesSignature()
+	commitHash, err := repo.writeCommitWithGit(&gitCommit{
+		Tree:      treeHash,
+		Parents:   parents,
+		Author:    sig,
+		Committer: sig,
+		Message:   "Notes added by 'git notes append'\n",
+	})
+	if err != nil {
+		return err
+	}
+	return repo.SetRef(notesRef, commitHash, parent)
+}
+
+// rewriteNotesHistoryWithGit is RewriteNotesHistory for repos whose objects
+// go-git cannot read. The notes lock must be held.
+func (repo *GitRepo) rewriteNotesHistoryWithGit(notesRef string, replacements map[string]Note) (int, error) {
+	head, err := repo.GetNotesCommit(notesRef)
+	if err != nil || head == "" {
+		return 0, err
+	}
+	out, err := repo.runGitCommand("rev-list", "--reverse", "--topo-order", head)
+	if err != nil {
+		return 0, err
+	}
+	// objects maps the blobs and trees that were read to their rewritten
+	// versions, since most of them are shared between commits.
+	objects := make(map[string]string)
+	var rewriteTree func(tree string) (string, error)
+	rewriteTree = func(tree string) (string, error) {
+		if rewritten, ok := objects[tree]; ok {
+			return rewritten, nil
+		}
+		entries, err := repo.readTreeWithGit(tree)
+		if err != nil {
+			return "", err
+		}
+		changed := false
+		for i, entry := range entries {
+			newHash, ok := objects[entry.Hash]
+			if !ok {
+				if entry.Type == "tree" {
+					newHash, err = rewriteTree(entry.Hash)
+				} else {
+					newHash, err = repo.rewriteNotesBlobWithGit(entry.Hash, replacements)
+				}
+				if err != nil {
+					return "", err
+				}
+				objects[entry.Hash] = newHash
+			}
+			changed = changed || newHash != entry.Hash
+			entries[i].Hash = newHash
+		}
+		newHash := tree
+		if changed {
+			if newHash, err = repo.writeTreeWithGit(entries); err != nil {
+				return "", err
+			}
+		}
+		objects[tree] = newHash
+		return newHash, nil
+	}
+
+	commits := make(map[string]string)
+	rewritten := 0
+	for line := range strings.SplitSeq(out, "\n") {
+		c, err := repo.readCommitWithGit(line)
+		if err != nil {
+			return 0, err
+		}
+		treeHash, err := rewriteTree(c.Tree)
+		if err != nil {
+			return 0, err
+		}
+		changed := treeHash != c.Tree
+		if changed {
+			rewritten++
+		}
+		for i, parent := range c.Parents {
+			c.Parents[i] = commits[parent]
+			changed = changed || c.Parents[i] != parent
+		}
+		if !changed {
+			commits[c.Hash] = c.Hash
+			continue
+		}
+		c.Tree = treeHash
+		if commits[c.Hash], err = repo.writeCommitWithGit(c); err != nil {
+			return 0, err
+		}
+	}
+	if newHead := commits[head]; newHead != head {
+		if err := repo.SetRef(notesRef, newHead, head); err != nil {
+			return 0, err
+		}
+	}
+	return rewritten, nil
+}
+
+// rewriteNotesBlobWithGit returns the hash of the given notes blob with the
+// lines that match a key of the given map replaced.
+func (repo *GitRepo) rewriteNotesBlobWithGit(hash string, replacements map[string]Note) (string, error) {
+	contents, err := repo.readBlobWithGit(hash)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(contents, "\n")
+	changed := false
+	for i, line := range lines {
+		if replacement, ok := replacements[line]; ok {
+			lines[i] = string(replacement)
+			changed = true
+		}
+	}
+	if !changed {
+		return hash, nil
+	}
+	return repo.StoreBlob(strings.Join(lines, "\n"))
+}
+
+// mergeNotesRefWithGit is mergeNotesRef for repos whose objects go-git
+// cannot read.
+func (repo *GitRepo) mergeNotesRefWithGit(localRef, remoteRef string) error {
+	if err := repo.adoptCompaction(localRef, remoteRef, false); err != nil {
+		return err
+	}
+	localCommit, err := repo.GetNotesCommit(localRef)
+	if err != nil {
+		return err
+	}
+	remoteCommit, err := repo.GetNotesCommit(remoteRef)
+	if err != nil || remoteCommit == "" {
+		return err
+	}
+	localBlobs, err := repo.listNotesBlobs(localCommit)
+	if err != nil {
+		return err
+	}
+	remoteBlobs, err := repo.listNotesBlobs(remoteCommit)
+	if err != nil {
+		return err
+	}
+
+	// Merge: union of all keys, cat_sort_uniq for conflicts.
+	merged := maps.Clone(remoteBlobs)
+	for revision, localBlob := range localBlobs {
+		remoteBlob, inRemote := remoteBlobs[revision]
+		if !inRemote || remoteBlob == localBlob {
+			merged[revision] = localBlob
+			continue
+		}
+		localContent, err := repo.readBlobWithGit(localBlob)
+		if err != nil {
+			return err
+		}
+		remoteContent, err := repo.readBlobWithGit(remoteBlob)
+		if err != nil {
+			return err
+		}
+		if merged[revision], err = repo.StoreBlob(catSortUniq(localContent, remoteContent) + "\n"); err != nil {
+			return err
+		}
+	}
+	treeHash, err := repo.writeTreeWithGit(appendNoteEntriesWithGit(nil, merged))
+	if err != nil {
+		return err
+	}
+
+	// Create merge commit (or regular commit if local didn't exist).
+	sig := repo.notesSignature()
+	var parents []string
+	if localCommit != "" {
+		parents = append(parents, localCommit)
+	}
+	commitHash, err := repo.writeCommitWithGit(&gitCommit{
+		Tree:      treeHash,
+		Parents:   append(parents, remoteCommit),
+		Author:    sig,
+		Committer: sig,
+		Message:   "notes merge by go-git\n",
+	})
+	if err != nil {
+		return err
+	}
+	return repo.SetRef(localRef, commitHash, localCommit)
+}
+
+// compactRefWithGit compacts the history of the given ref before the given
+// time, in a repo whose objects go-git cannot read, and reports whether
+// there was any history to compact.
+func (repo *GitRepo) compactRefWithGit(ref string, before time.Time, archive bool) (bool, error) {
+	base, err := repo.compactionBaseWithGit(ref, before)
+	if err != nil || base == nil {
+		return false, err
+	}
+	var history map[string]bool
+	var parents []string
+	if archive {
+		if history, parents, err = repo.archiveHistoryWithGit(base); err != nil {
+			return false, err
+		}
+	}
+	return true, repo.compactHistoryWithGit(ref, base, parents, history)
+}
+
+// compactionBaseWithGit is compactionBase for repos whose objects go-git
+// cannot read.
+func (repo *GitRepo) compactionBaseWithGit(ref string, before time.Time) (*gitCommit, error) {
+	c, err := repo.readCommitWithGit(ref)
+	if err != nil {
+		return nil, err
+	}
+	for !c.Committer.When.Before(before) {
+		if len(c.Parents) == 0 {
+			return nil, nil
+		}
+		if c, err = repo.readCommitWithGit(c.Parents[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Parents) == 0 || compactedFrom(c.Message) != "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// archiveHistoryWithGit is archiveHistory for repos whose objects go-git
+// cannot read.
+func (repo *GitRepo) archiveHistoryWithGit(head *gitCommit) (map[string]bool, []string, error) {
+	history := make(map[string]bool)
+	archived := make(map[string]bool)
+	queue := []string{head.Hash}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if history[h] || archived[h] {
+			continue
+		}
+		c, err := repo.readCommitWithGit(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		parents := c.Parents
+		switch {
+		case compactedFrom(c.Message) != "":
+			history[h] = true
+		case strings.HasPrefix(c.Message, archiveSummaryPrefix) && len(parents) > 0:
+			history[h] = true
+			queue = append(queue, parents[:len(parents)-1]...)
+			parents = parents[len(parents)-1:]
+		case strings.HasPrefix(c.Message, mergeArchivesSummary):
+			history[h] = true
+			queue = append(queue, parents...)
+			parents = nil
+		default:
+			archived[h] = true
+			parents = nil
+		}
+		for _, parent := range parents {
+			archived[parent] = true
+		}
+	}
+	return history, slices.Sorted(maps.Keys(archived)), nil
+}
+
+// compactHistoryWithGit is compactHistory for repos whose objects go-git
+// cannot read.
+func (repo *GitRepo) compactHistoryWithGit(ref string, base *gitCommit, parents []string, history map[string]bool) error {
+	head, err := repo.GetCommitHash(ref)
+	if err != nil {
+		return err
+	}
+	snapshotHash, err := repo.writeCommitWithGit(&gitCommit{
+		Tree:      base.Tree,
+		Parents:   parents,
+		Author:    base.Author,
+		Committer: base.Committer,
+		Message:   fmt.Sprintf("Compact the history up to %s\n\n%s%s\n", base.Hash, compactedFromTrailer, base.Hash),
+	})
+	if err != nil {
+		return err
+	}
+
+	// List the commits since the base with parents before their children,
+	// so that each commit's parents have been rewritten when it is reached.
+	out, err := repo.runGitCommand("rev-list", "--reverse", "--topo-order", head, "^"+base.Hash)
+	if err != nil {
+		return err
+	}
+	commits := map[string]string{base.Hash: snapshotHash}
+	for line := range strings.SplitSeq(out, "\n") {
+		if line == "" {
+			continue
+		}
+		c, err := repo.readCommitWithGit(line)
+		if err != nil {
+			return err
+		}
+		var newParents []string
+		for _, parent := range c.Parents {
+			newParent, ok := commits[parent]
+			if !ok {
+				newParent = parent
+				if history == nil || history[parent] {
+					newParent = snapshotHash
+				}
+			}
+			if !slices.Contains(newParents, newParent) {
+				newParents = append(newParents, newParent)
+			}
+		}
+		// Leave the commits that were archived untouched, along with any
+		// signatures on them.
+		if slices.Equal(newParents, c.Parents) {
+			commits[c.Hash] = c.Hash
+			continue
+		}
+		c.Parents = newParents
+		if commits[c.Hash], err = repo.writeCommitWithGit(c); err != nil {
+			return err
+		}
+	}
+	return repo.SetRef(ref, commits[head], head)
+}
+
+// adoptCompactionWithGit is adoptCompaction for repos whose objects go-git
+// cannot read.
+func (repo *GitRepo) adoptCompactionWithGit(localRef, remoteRef string, archive bool) error {
+	if hasLocal, err := repo.HasRef(localRef); err != nil || !hasLocal {
+		return err
+	}
+	out, err := repo.runGitCommand("rev-list", remoteRef, "--not", localRef)
+	if err != nil {
+		return err
+	}
+	for line := range strings.SplitSeq(out, "\n") {
+		if line == "" {
+			continue
+		}
+		snapshot, err := repo.readCommitWithGit(line)
+		if err != nil {
+			return err
+		}
+		baseHash := compactedFrom(snapshot.Message)
+		if baseHash == "" {
+			continue
+		}
+		// The base is missing if the local ref has never included it.
+		if isAncestor, err := repo.IsAncestor(baseHash, localRef); err != nil || !isAncestor {
+			continue
+		}
+		base, err := repo.readCommitWithGit(baseHash)
+		if err != nil {
+			return err
+		}
+		var history map[string]bool
+		if archive {
+			if history, _, err = repo.archiveHistoryWithGit(base); err != nil {
+				return err
+			}
+		}
+		return repo.compactHistoryWithGit(localRef, base, snapshot.Parents, history)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// setupSHA256Repo creates a repo that uses SHA-256 object names, with a
+// commit on each of two branches, and with the feature branch checked out.
+func setupSHA256Repo(t *testing.T) (repo *GitRepo, main, feature string) {
+	t.Helper()
+	dir := t.TempDir()
+	gitRun(t, dir, "init", "--object-format=sha256", "-b", "main")
+	gitRun(t, dir, "config", "user.email", "test@example.com")
+	gitRun(t, dir, "config", "user.name", "Test")
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("initial\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, dir, "add", "file.txt")
+	gitRun(t, dir, "commit", "-m", "initial commit")
+	gitRun(t, dir, "checkout", "-b", "feature")
+	repo, err := NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addCommit(t, repo, "file.txt", "feature\n", "feature commit")
+	return repo, gitRun(t, dir, "rev-parse", "main"), gitRun(t, dir, "rev-parse", "feature")
+}
+
+func TestSHA256Notes(t *testing.T) {
+	repo, main, feature := setupSHA256Repo(t)
+	if len(main) != 64 {
+		t.Fatalf("expected a SHA-256 object name, got %q", main)
+	}
+	const ref = "refs/notes/devtools/reviews"
+	gitRun(t, repo.Path, "notes", "--ref="+ref, "add", "-m", "from git", main)
+	if err := repo.AppendNotes(ref, map[string][]Note{
+		main:    {Note("main")},
+		feature: {Note("feature")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(ref, main); !reflect.DeepEqual(notes, []Note{Note("from git"), Note("main")}) {
+		t.Errorf("unexpected notes for the main commit %q", notes)
+	}
+	if out := gitRun(t, repo.Path, "notes", "--ref="+ref, "show", feature); out != "feature" {
+		t.Errorf("expected git to read the notes, got %q", out)
+	}
+	all, err := repo.GetAllNotes(ref)
+	if err != nil || len(all) != 2 || len(all[feature]) != 1 {
+		t.Errorf("GetAllNotes() = %q, %v", all, err)
+	}
+	notes, notesErr := repo.Notes(ref, feature[:4])
+	if got := collectNotes(t, notes, notesErr); !reflect.DeepEqual(got, map[string]string{feature: "feature"}) {
+		t.Errorf("Notes() with a prefix = %q", got)
+	}
+	head, err := repo.GetNotesCommit(ref)
+	if err != nil || len(head) != 64 {
+		t.Fatalf("GetNotesCommit() = %q, %v", head, err)
+	}
+	notes, notesErr = repo.Notes(head, "")
+	if got := collectNotes(t, notes, notesErr); len(got) != 2 {
+		t.Errorf("Notes() of the notes commit = %q", got)
+	}
+	if revisions := repo.ListNotedRevisions(ref); !slices.Equal(revisions, slices.Sorted(slices.Values([]string{main, feature}))) {
+		t.Errorf("ListNotedRevisions() = %q", revisions)
+	}
+	diffs, err := repo.DiffNotes("", head)
+	if err != nil || len(diffs) != 2 {
+		t.Errorf("DiffNotes() = %v, %v", diffs, err)
+	}
+	gitRun(t, repo.Path, "fsck", "--strict")
+}
+
+func TestSHA256NotesFanout(t *testing.T) {
+	repo, main, feature := setupSHA256Repo(t)
+	const ref = "refs/notes/devtools/reviews"
+	blob, err := repo.StoreBlob("existing\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subtree, err := repo.writeTreeWithGit([]gitTreeEntry{{Mode: "100644", Type: "blob", Hash: blob, Name: main[2:]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := repo.writeTreeWithGit([]gitTreeEntry{{Mode: "040000", Type: "tree", Hash: subtree, Name: main[:2]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.writeCommitWithGit(&gitCommit{
+		Tree:      tree,
+		Author:    repo.notesSignature(),
+		Committer: repo.notesSignature(),
+		Message:   "fan-out notes\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef(ref, commit, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNotes(ref, map[string][]Note{main: {Note("main")}, feature: {Note("feature")}}); err != nil {
+		t.Fatal(err)
+	}
+	out := gitRun(t, repo.Path, "ls-tree", "-r", "--name-only", ref)
+	for _, revision := range []string{main, feature} {
+		if !strings.Contains(out, revision[:2]+"/"+revision[2:]) {
+			t.Errorf("expected a fan-out path for %s, got %q", revision, out)
+		}
+	}
+	if out := gitRun(t, repo.Path, "notes", "--ref="+ref, "show", main); out != "existing\nmain" {
+		t.Errorf("expected git to read the fan-out notes, got %q", out)
+	}
+	if notes := repo.GetNotes(ref, feature); !reflect.DeepEqual(notes, []Note{Note("feature")}) {
+		t.Errorf("unexpected notes for the feature commit %q", notes)
+	}
+	notes, notesErr := repo.Notes(ref, main[:3])
+	if got := collectNotes(t, notes, notesErr); !reflect.DeepEqual(got, map[string]string{main: "existing\nmain"}) {
+		t.Errorf("Notes() with a prefix = %q", got)
+	}
+	gitRun(t, repo.Path, "fsck", "--strict")
+}
+
+func TestSHA256RewriteNotesHistory(t *testing.T) {
+	repo, main, feature := setupSHA256Repo(t)
+	const ref = "refs/notes/devtools/reviews"
+	if err := repo.AppendNote(ref, main, Note("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(ref, feature, Note("public")); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := repo.RewriteNotesHistory(ref, map[string]Note{"secret": Note("redacted")})
+	if err != nil || rewritten != 2 {
+		t.Fatalf("RewriteNotesHistory() = %d, %v", rewritten, err)
+	}
+	if notes := repo.GetNotes(ref, main); !reflect.DeepEqual(notes, []Note{Note("redacted")}) {
+		t.Errorf("unexpected notes for the main commit %q", notes)
+	}
+	if out := gitRun(t, repo.Path, "log", "-p", ref); strings.Contains(out, "secret") || !strings.Contains(out, "public") {
+		t.Errorf("expected the history of the notes to be rewritten, got %q", out)
+	}
+	gitRun(t, repo.Path, "fsck", "--strict")
+}
+
+func TestSHA256Commits(t *testing.T) {
+	repo, main, feature := setupSHA256Repo(t)
+	if h, err := repo.GetCommitHash("refs/heads/feature"); err != nil || h != feature {
+		t.Errorf("GetCommitHash() = %q, %v", h, err)
+	}
+	if msg, err := repo.GetCommitMessage(feature); err != nil || msg != "feature commit" {
+		t.Errorf("GetCommitMessage() = %q, %v", msg, err)
+	}
+	if parent, err := repo.GetLastParent(feature); err != nil || parent != main {
+		t.Errorf("GetLastParent() = %q, %v", parent, err)
+	}
+	details, err := repo.GetCommitDetails(feature)
+	if err != nil || details.Author != "Test" || !slices.Equal(details.Parents, []string{main}) || len(details.Tree) != 64 {
+		t.Errorf("GetCommitDetails() = %+v, %v", details, err)
+	}
+	if base, err := repo.MergeBase(main, feature); err != nil || base != main {
+		t.Errorf("MergeBase() = %q, %v", base, err)
+	}
+	if ok, err := repo.IsAncestor(main, feature); err != nil || !ok {
+		t.Errorf("IsAncestor(main, feature) = %v, %v", ok, err)
+	}
+	if ok, err := repo.IsAncestor(feature, main); err != nil || ok {
+		t.Errorf("IsAncestor(feature, main) = %v, %v", ok, err)
+	}
+	if commits := repo.ListCommits("refs/heads/feature"); !slices.Equal(commits, []string{main, feature}) {
+		t.Errorf("ListCommits() = %q", commits)
+	}
+	if commits, err := repo.ListCommitsBetween(main, feature); err != nil || !slices.Equal(commits, []string{feature}) {
+		t.Errorf("ListCommitsBetween() = %q, %v", commits, err)
+	}
+	if err := repo.VerifyCommit(feature); err != nil {
+		t.Errorf("VerifyCommit() = %v", err)
+	}
+	if err := repo.VerifyCommit(details.Tree); err == nil {
+		t.Error("expected an error verifying a tree as a commit")
+	}
+	if ok, err := repo.HasObject(details.Tree); err != nil || !ok {
+		t.Errorf("HasObject() = %v, %v", ok, err)
+	}
+	if ok, err := repo.HasObject(strings.Repeat("0", 64)); err != nil || ok {
+		t.Errorf("HasObject() of a missing object = %v, %v", ok, err)
+	}
+	if contents, err := repo.Show(main, "file.txt"); err != nil || contents != "initial" {
+		t.Errorf("Show() = %q, %v", contents, err)
+	}
+	if dirty, err := repo.HasUncommittedChanges(); err != nil || dirty {
+		t.Errorf("HasUncommittedChanges() = %v, %v", dirty, err)
+	}
+	if err := repo.SwitchToRef("refs/heads/main"); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := repo.GetHeadRef(); err != nil || head != "refs/heads/main" {
+		t.Errorf("GetHeadRef() = %q, %v", head, err)
+	}
+	if _, err := repo.GetRepoStateHash(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSHA256CreateCommit(t *testing.T) {
+	repo, main, feature := setupSHA256Repo(t)
+	tree, err := repo.ReadTree(feature + "^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := tree.Contents()
+	contents["dir"] = NewTree(map[string]TreeChild{"nested.txt": NewBlob("nested\n")})
+	commit, err := repo.CreateCommitWithTree(&CommitDetails{
+		Summary: "Add a dir",
+		Parents: []string{feature},
+		Time:    "1700000000 +0000",
+	}, NewTree(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef("refs/heads/feature", commit, main); !errors.Is(err, storage.ErrReferenceHasChanged) {
+		t.Errorf("expected ErrReferenceHasChanged, got %v", err)
+	}
+	if err := repo.SetRef("refs/heads/feature", commit, feature); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := repo.Show("refs/heads/feature", "dir/nested.txt"); err != nil || contents != "nested" {
+		t.Errorf("Show() = %q, %v", contents, err)
+	}
+	if ts, err := repo.GetCommitTime(commit); err != nil || ts != "1700000000" {
+		t.Errorf("GetCommitTime() = %q, %v", ts, err)
+	}
+	const archive = "refs/devtools/archives/reviews"
+	for _, ref := range []string{"refs/heads/main", "refs/heads/feature", "refs/heads/feature"} {
+		if err := repo.ArchiveRef(ref, archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if archived := gitRun(t, repo.Path, "rev-parse", archive+"^2", archive+"^1^1"); archived != commit+"\n"+main {
+		t.Errorf("expected each ref to be archived once, got %q", archived)
+	}
+	gitRun(t, repo.Path, "fsck", "--strict")
+}
+
+func TestSHA256PushAndPull(t *testing.T) {
+	local, main, feature := setupSHA256Repo(t)
+	remoteDir := t.TempDir()
+	gitRun(t, remoteDir, "init", "--bare", "--object-format=sha256")
+	gitRun(t, local.Path, "remote", "add", "origin", remoteDir)
+	if err := local.Push("origin", "refs/heads/main:refs/heads/main", "refs/heads/feature:refs/heads/feature"); err != nil {
+		t.Fatal(err)
+	}
+	other := cloneTestRepo(t, remoteDir)
+	gitRun(t, other.Path, "config", "user.email", "other@example.com")
+	gitRun(t, other.Path, "config", "user.name", "Other")
+
+	const notesRefs = "refs/notes/devtools/*"
+	const archiveRefs = "refs/devtools/archives/*"
+	const ref = "refs/notes/devtools/reviews"
+	old := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	if err := local.AppendNote(ref, main, Note("local")); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.ArchiveRef("refs/heads/feature", "refs/devtools/archives/reviews"); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.PushNotesAndArchive("origin", notesRefs, archiveRefs); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AppendNote(ref, main, Note("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AppendNote(ref, feature, Note("feature")); err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := other.FetchAndReturnNewReviewHashes("origin", notesRefs, archiveRefs)
+	if err != nil || !slices.Equal(hashes, []string{main}) {
+		t.Errorf("FetchAndReturnNewReviewHashes() = %q, %v", hashes, err)
+	}
+	if err := other.PullNotesAndArchive("origin", notesRefs, archiveRefs); err != nil {
+		t.Fatal(err)
+	}
+	if notes := other.GetNotes(ref, main); !reflect.DeepEqual(notes, []Note{Note("local"), Note("other")}) {
+		t.Errorf("unexpected merged notes %q", notes)
+	}
+	if err := other.PushNotesAndArchive("origin", notesRefs, archiveRefs); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.PullNotesAndArchive("origin", notesRefs, archiveRefs); err != nil {
+		t.Fatal(err)
+	}
+	all, err := local.GetAllNotes(ref)
+	if err != nil || len(all) != 2 || len(all[main]) != 2 {
+		t.Errorf("GetAllNotes() after pulling = %q, %v", all, err)
+	}
+
+	const oldRef = "refs/notes/devtools/old"
+	gitRunAt(t, local.Path, old, "notes", "--ref="+oldRef, "add", "-m", "old", feature)
+	gitRunAt(t, local.Path, old, "notes", "--ref="+oldRef, "add", "-m", "old", main)
+	if err := local.AppendNote(oldRef, feature, Note("new")); err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := local.CompactNotes(notesRefs, time.Now().Add(-time.Minute))
+	if err != nil || !slices.Equal(compacted, []string{oldRef}) {
+		t.Fatalf("CompactNotes() = %q, %v", compacted, err)
+	}
+	if notes := local.GetNotes(oldRef, feature); !reflect.DeepEqual(notes, []Note{Note("old"), Note("new")}) {
+		t.Errorf("unexpected notes after compacting %q", notes)
+	}
+	if count := gitRun(t, local.Path, "rev-list", "--count", oldRef); count != "2" {
+		t.Errorf("expected the compacted history to have two commits, got %s", count)
+	}
+	gitRun(t, local.Path, "fsck", "--strict")
+	gitRun(t, other.Path, "fsck", "--strict")
+}
+
+func TestSHA256PullCompactedNotesAndArchive(t *testing.T) {
+	repo, head, _ := setupSHA256Repo(t)
+	remoteDir := t.TempDir()
+	gitRun(t, remoteDir, "init", "--bare", "--object-format=sha256")
+	gitRun(t, repo.Path, "remote", "add", "origin", remoteDir)
+	// Clones of a repo without any branches use SHA-1 object names in some
+	// versions of git.
+	gitRun(t, repo.Path, "push", "origin", "main", "feature")
+	tree := gitRun(t, repo.Path, "rev-parse", head+"^{tree}")
+	const notesRef = "refs/notes/devtools/discuss"
+	const archiveRef = "refs/devtools/archives/reviews"
+	addDatedNotes(t, repo, notesRef, head, "2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z")
+	review := gitRun(t, repo.Path, "commit-tree", tree, "-p", head, "-m", "review")
+	archive := gitRunAt(t, repo.Path, "2020-01-01T00:00:00Z", "commit-tree", tree, "-p", review, "-m", archiveSummaryPrefix+review)
+	gitRun(t, repo.Path, "update-ref", archiveRef, archive)
+	if err := repo.PushNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	other := cloneTestRepo(t, remoteDir)
+	if err := other.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	addDatedNotes(t, other, notesRef, head, "2024-01-01T00:00:00Z")
+	otherReview := gitRun(t, other.Path, "commit-tree", tree, "-p", head, "-m", "other review")
+	if err := other.ArchiveRef(otherReview, archiveRef); err != nil {
+		t.Fatal(err)
+	}
+
+	if compacted, err := repo.CompactNotes("refs/notes/devtools/*", compactCutoff); err != nil || len(compacted) != 1 {
+		t.Fatalf("CompactNotes() = %q, %v", compacted, err)
+	}
+	if compacted, err := repo.CompactArchives("refs/devtools/archives/*", compactCutoff); err != nil || len(compacted) != 1 {
+		t.Fatalf("CompactArchives() = %q, %v", compacted, err)
+	}
+	gitRun(t, repo.Path, "push", "--force", "origin", "refs/notes/devtools/*:refs/notes/devtools/*", "refs/devtools/archives/*:refs/devtools/archives/*")
+
+	if err := other.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	if count := gitRun(t, other.Path, "rev-list", "--count", notesRef); count != "4" {
+		t.Errorf("expected the snapshot, the other clone's note, and the merge, got %s commits", count)
+	}
+	if notes := other.GetNotes(notesRef, head); len(notes) != 3 {
+		t.Errorf("expected every note to be kept, got %q", notes)
+	}
+	for _, commit := range []string{review, otherReview} {
+		if isAncestor, err := other.IsAncestor(commit, archiveRef); err != nil || !isAncestor {
+			t.Errorf("expected %s to remain archived, got %v", commit, err)
+		}
+	}
+	gitRun(t, other.Path, "fsck", "--strict")
+}
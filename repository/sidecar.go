@@ -0,0 +1,139 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+)
+
+// ReviewStoreKey is the git config setting that names a separate local repo
+// in which to store the reviews of a repo. Relative paths are resolved
+// against the top level of the repo.
+const ReviewStoreKey = "appraise.reviewStore"
+
+// SidecarRepo is a Repo that reads commits from one git repo, while storing
+// the reviews of those commits in the notes of a separate "sidecar" repo.
+//
+// This allows reviewing repos that cannot hold any extra refs, such as
+// read-only mirrors. Remote names used for sharing the reviews refer to the
+// remotes of the sidecar repo, and the archive refs that keep reviewed
+// commits reachable stay local to the code repo.
+type SidecarRepo struct {
+	CodeRepo
+	ReviewStore
+
+	code, store *GitRepo
+}
+
+// NewSidecarRepo returns a Repo that reads commits from the code repo and
+// stores their reviews in the store repo.
+func NewSidecarRepo(code, store *GitRepo) *SidecarRepo {
+	return &SidecarRepo{
+		CodeRepo:    code,
+		ReviewStore: store,
+		code:        code,
+		store:       store,
+	}
+}
+
+// OpenReviewStore returns a Repo for the given git repo that stores its
+// reviews in the sidecar repo configured by ReviewStoreKey. If there is no
+// such configuration, then the git repo is returned as is.
+func OpenReviewStore(code *GitRepo) (Repo, error) {
+	values, err := code.GetConfigValues(ReviewStoreKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 || values[len(values)-1] == "" {
+		return code, nil
+	}
+	storePath := values[len(values)-1]
+	if !filepath.IsAbs(storePath) {
+		storePath = filepath.Join(code.GetPath(), storePath)
+	}
+	store, err := NewGitRepo(storePath)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the review store %q: %v", storePath, err)
+	}
+	// Opening a path within the repo that is not a repo of its own finds
+	// the enclosing repo instead.
+	if store.GetPath() == code.GetPath() {
+		return nil, fmt.Errorf("the review store %q is not a separate git repo", storePath)
+	}
+	return NewSidecarRepo(code, store), nil
+}
+
+// WithContext returns a copy of the repo whose code and sidecar repos run
+// each of their git commands with the given context.
+func (repo *SidecarRepo) WithContext(ctx context.Context) *SidecarRepo {
+	return NewSidecarRepo(repo.code.WithContext(ctx), repo.store.WithContext(ctx))
+}
+
+// Store returns the sidecar repo in which the reviews are stored.
+func (repo *SidecarRepo) Store() *GitRepo {
+	return repo.store
+}
+
+// GetRepoStateHash returns a hash which embodies the current state of both
+// the code repo and the sidecar repo.
+func (repo *SidecarRepo) GetRepoStateHash() (string, error) {
+	codeHash, err := repo.code.GetRepoStateHash()
+	if err != nil {
+		return "", err
+	}
+	storeHash, err := repo.store.GetRepoStateHash()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(codeHash+storeHash))), nil
+}
+
+// GetAllNotes reads the contents of the notes under the given ref for every
+// commit in the code repo.
+func (repo *SidecarRepo) GetAllNotes(notesRef string) (map[string][]Note, error) {
+	return repo.store.getAllNotes(notesRef, repo.code.isCommit)
+}
+
+// ListNotedRevisions returns the commits in the code repo that are annotated
+// by notes in the given ref.
+func (repo *SidecarRepo) ListNotedRevisions(notesRef string) []string {
+	return repo.store.listNotedRevisions(notesRef, repo.code.isCommit)
+}
+
+// PushNotesAndArchive pushes the given notes refs from the sidecar repo to
+// one of its remotes. The archive refs are not pushed, since they are kept
+// in the code repo.
+func (repo *SidecarRepo) PushNotesAndArchive(remote, notesRefPattern, archiveRefPattern string) error {
+	return repo.store.PushNotes(remote, notesRefPattern)
+}
+
+// PullNotesAndArchive fetches the given notes refs from one of the sidecar
+// repo's remotes, and merges them into its local notes. The archive refs
+// are not pulled, since they are kept in the code repo.
+func (repo *SidecarRepo) PullNotesAndArchive(remote, notesRefPattern, archiveRefPattern string) error {
+	return repo.store.PullNotes(remote, notesRefPattern)
+}
+
+// FetchAndReturnNewReviewHashes fetches the given notes refs from one of the
+// sidecar repo's remotes, and returns the IDs of any new reviews in them.
+// The devtools refs are not fetched, since they are kept in the code repo.
+func (repo *SidecarRepo) FetchAndReturnNewReviewHashes(remote, notesRefPattern string, devtoolsRefPatterns ...string) ([]string, error) {
+	return repo.store.FetchAndReturnNewReviewHashes(remote, notesRefPattern)
+}
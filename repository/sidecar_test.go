@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenReviewStore(t *testing.T) {
+	code := setupTestRepo(t)
+	repo, err := OpenReviewStore(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo != Repo(code) {
+		t.Errorf("expected the repo itself without a review store, got %T", repo)
+	}
+
+	store := setupTestRepo(t)
+	relative, err := filepath.Rel(code.Path, store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{store.Path, relative} {
+		gitRun(t, code.Path, "config", ReviewStoreKey, path)
+		repo, err := OpenReviewStore(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sidecar, ok := repo.(*SidecarRepo)
+		if !ok || sidecar.store.Path != store.Path {
+			t.Errorf("expected a sidecar repo for %q, got %+v", path, repo)
+		}
+	}
+
+	for _, path := range []string{"missing", filepath.Join(t.TempDir(), "missing")} {
+		gitRun(t, code.Path, "config", ReviewStoreKey, path)
+		if _, err := OpenReviewStore(code); err == nil || !strings.Contains(err.Error(), "review store") {
+			t.Errorf("expected an error opening the missing review store %q, got %v", path, err)
+		}
+	}
+}
+
+func TestSidecarRepoNotes(t *testing.T) {
+	code := setupTestRepo(t)
+	store := setupTestRepo(t)
+	repo := NewSidecarRepo(code, store)
+	if repo.Store() != store {
+		t.Error("Store() did not return the sidecar repo")
+	}
+	head, err := repo.GetCommitHash("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != gitRun(t, code.Path, "rev-parse", "HEAD") {
+		t.Errorf("expected commits to be read from the code repo, got %s", head)
+	}
+	stateHash, err := repo.GetRepoStateHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ref = "refs/notes/devtools/discuss"
+	if err := repo.AppendNote(ref, head, Note("note")); err != nil {
+		t.Fatal(err)
+	}
+	if hasRef, _ := code.HasRef(ref); hasRef {
+		t.Error("expected the notes not to be stored in the code repo")
+	}
+	if entries := gitRun(t, store.Path, "ls-tree", "--name-only", ref); entries != head {
+		t.Errorf("expected the notes to be stored in the sidecar repo, got %q", entries)
+	}
+	if notes := repo.GetNotes(ref, head); len(notes) != 1 || string(notes[0]) != "note" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+	allNotes, err := repo.GetAllNotes(ref)
+	if err != nil || len(allNotes[head]) != 1 {
+		t.Errorf("unexpected notes %v, %v", allNotes, err)
+	}
+	if revisions := repo.ListNotedRevisions(ref); len(revisions) != 1 || revisions[0] != head {
+		t.Errorf("unexpected noted revisions %v", revisions)
+	}
+	if newStateHash, err := repo.GetRepoStateHash(); err != nil || newStateHash == stateHash {
+		t.Errorf("expected the state hash to change with the notes, got %q, %v", newStateHash, err)
+	}
+
+	if _, err := NewSidecarRepo(&GitRepo{}, store).GetRepoStateHash(); err == nil {
+		t.Error("expected an error for an uninitialized code repo")
+	}
+	if _, err := NewSidecarRepo(code, &GitRepo{}).GetRepoStateHash(); err == nil {
+		t.Error("expected an error for an uninitialized sidecar repo")
+	}
+}
+
+func TestSidecarRepoPushAndPull(t *testing.T) {
+	code := setupTestRepo(t)
+	store, remoteDir := setupTestRepoWithRemote(t)
+	repo := NewSidecarRepo(code, store)
+	head, err := repo.GetCommitHash("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ref = "refs/notes/devtools/discuss"
+	const archive = "refs/devtools/archives/reviews"
+	if err := repo.AppendNote(ref, head, Note("local")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ArchiveRef("HEAD", archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PushNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := gitRun(t, remoteDir, "for-each-ref", "--format=%(refname)", "refs/notes", "refs/devtools"); refs != ref {
+		t.Errorf("expected only the notes to be pushed, got %q", refs)
+	}
+
+	// Add a note in the remote, which fetching and pulling pick up.
+	other := cloneTestRepo(t, remoteDir)
+	gitRun(t, other.Path, "fetch", "origin", ref+":"+ref)
+	if err := other.AppendNote(ref, head, Note("remote")); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, other.Path, "push", "origin", ref)
+	reviews, err := repo.FetchAndReturnNewReviewHashes("origin", "refs/notes/devtools/*", "refs/devtools/archives/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews) != 1 || reviews[0] != head {
+		t.Errorf("expected the review with new notes to be returned, got %v", reviews)
+	}
+	if err := repo.PullNotesAndArchive("origin", "refs/notes/devtools/*", "refs/devtools/archives/*"); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(ref, head); len(notes) != 2 {
+		t.Errorf("expected the remote note to be merged in, got %q", notes)
+	}
+}
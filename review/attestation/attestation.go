@@ -0,0 +1,214 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package attestation defines signed in-toto attestations that record how a
+// submitted commit was reviewed.
+//
+// Each attestation is an in-toto Statement wrapped in a DSSE envelope, and is
+// stored as a single line of JSON in a git note on the submitted commit.
+package attestation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/ci"
+)
+
+const (
+	// Ref defines the git-notes ref that we expect to contain review attestations.
+	Ref = "refs/notes/devtools/attestations"
+
+	// StatementType is the in-toto type of the statements in the attestations.
+	StatementType = "https://in-toto.io/Statement/v1"
+	// PredicateType identifies the review predicate defined by this package.
+	PredicateType = "https://msrl.dev/git-appraise/review/v1"
+	// PayloadType is the DSSE payload type for in-toto statements.
+	PayloadType = "application/vnd.in-toto+json"
+)
+
+// Subject identifies a commit that an attestation is about.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Approval records a single comment that approved the review.
+type Approval struct {
+	Author    string `json:"author"`
+	Timestamp string `json:"timestamp,omitempty"`
+	// Comment is the hash of the approving comment.
+	Comment string `json:"comment"`
+	// Verified indicates that the approval was signed by its author.
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Policy describes the requirements that the review satisfied when submitted.
+type Policy struct {
+	// RequireApproval is false when the review was submitted without being
+	// accepted (i.e. "to be reviewed").
+	RequireApproval bool `json:"requireApproval"`
+	// RequireVerifiedApprovals is true when only signed approvals were counted.
+	RequireVerifiedApprovals bool `json:"requireVerifiedApprovals"`
+	// Strategy is how the review was submitted, e.g. "merge" or "rebase".
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// Predicate describes the review of the attested commit.
+type Predicate struct {
+	Timestamp      string     `json:"timestamp,omitempty"`
+	ReviewRevision string     `json:"reviewRevision"`
+	ReviewRef      string     `json:"reviewRef,omitempty"`
+	TargetRef      string     `json:"targetRef,omitempty"`
+	Requester      string     `json:"requester,omitempty"`
+	Submitter      string     `json:"submitter,omitempty"`
+	Approvers      []Approval `json:"approvers"`
+	CI             *ci.Report `json:"ci,omitempty"`
+	Policy         Policy     `json:"policy"`
+}
+
+// Statement is an in-toto statement attesting to the review of a commit.
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+// Signature is a single DSSE signature.
+//
+// The "sig" field holds the base64 encoding of an ASCII-armored SSH or
+// OpenPGP signature, and the "keyid" field holds the email of the signer.
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// Envelope is a DSSE envelope holding a signed statement.
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     string      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+// New returns a statement attesting to the given review predicate for a commit.
+func New(commit string, predicate Predicate) Statement {
+	return Statement{
+		Type: StatementType,
+		Subject: []Subject{{
+			Name:   commit,
+			Digest: map[string]string{"gitCommit": commit},
+		}},
+		PredicateType: PredicateType,
+		Predicate:     predicate,
+	}
+}
+
+// pae returns the DSSE pre-authentication encoding of a payload, which is
+// what actually gets signed.
+func pae(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+// Sign signs the statement as the given signer, using the repo's signing key.
+func Sign(repo repository.Repo, statement Statement, signer string) (Envelope, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return Envelope{}, err
+	}
+	sig, err := repo.SignPayload(pae(PayloadType, payload))
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		PayloadType: PayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []Signature{{
+			KeyID: signer,
+			Sig:   base64.StdEncoding.EncodeToString([]byte(sig)),
+		}},
+	}, nil
+}
+
+// Write writes an envelope as a JSON-formatted git note.
+func (envelope Envelope) Write() (repository.Note, error) {
+	bytes, err := json.Marshal(envelope)
+	return repository.Note(bytes), err
+}
+
+// Parse parses an envelope from a git note.
+func Parse(note repository.Note) (Envelope, error) {
+	var envelope Envelope
+	err := json.Unmarshal([]byte(note), &envelope)
+	return envelope, err
+}
+
+// ParseAllValid takes collection of git notes and tries to parse an envelope
+// from each one. Any notes that are not valid envelopes get ignored.
+func ParseAllValid(notes []repository.Note) []Envelope {
+	var envelopes []Envelope
+	for _, note := range notes {
+		envelope, err := Parse(note)
+		if err == nil && envelope.PayloadType == PayloadType {
+			envelopes = append(envelopes, envelope)
+		}
+	}
+	return envelopes
+}
+
+// Verify checks that the envelope holds a review statement about the given
+// commit, with a valid signature by the signer named in it.
+//
+// It returns the statement along with the email of the signer.
+func (envelope Envelope) Verify(repo repository.Repo, commit string) (*Statement, string, error) {
+	if envelope.PayloadType != PayloadType {
+		return nil, "", fmt.Errorf("unsupported payload type %q", envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid payload: %v", err)
+	}
+	var statement Statement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, "", fmt.Errorf("invalid statement: %v", err)
+	}
+	if statement.Type != StatementType || statement.PredicateType != PredicateType {
+		return nil, "", fmt.Errorf("unsupported statement type %q with predicate %q", statement.Type, statement.PredicateType)
+	}
+	if len(statement.Subject) != 1 || statement.Subject[0].Digest["gitCommit"] != commit {
+		return nil, "", fmt.Errorf("the attestation is not about the commit %s", commit)
+	}
+	if len(envelope.Signatures) == 0 {
+		return nil, "", errors.New("the attestation is not signed")
+	}
+	var errs []error
+	for _, signature := range envelope.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid signature: %v", err))
+			continue
+		}
+		if err := repo.VerifyPayloadSignature(pae(envelope.PayloadType, payload), string(sig), signature.KeyID); err != nil {
+			errs = append(errs, fmt.Errorf("invalid signature by %q: %v", signature.KeyID, err))
+			continue
+		}
+		return &statement, signature.KeyID, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+package attestation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/ci"
+)
+
+const signer = "user@example.com"
+
+func testStatement() Statement {
+	return New(repository.TestCommitJ, Predicate{
+		Timestamp:      "0000000001",
+		ReviewRevision: repository.TestCommitG,
+		Requester:      "requester@example.com",
+		Approvers:      []Approval{{Author: signer, Comment: "abc", Verified: true}},
+		CI:             &ci.Report{Status: ci.StatusSuccess},
+		Policy:         Policy{RequireApproval: true, Strategy: "merge"},
+	})
+}
+
+func TestNew(t *testing.T) {
+	s := testStatement()
+	if s.Type != StatementType || s.PredicateType != PredicateType {
+		t.Fatalf("unexpected types: %+v", s)
+	}
+	if len(s.Subject) != 1 || s.Subject[0].Name != repository.TestCommitJ || s.Subject[0].Digest["gitCommit"] != repository.TestCommitJ {
+		t.Fatalf("unexpected subject: %+v", s.Subject)
+	}
+}
+
+func TestPAE(t *testing.T) {
+	if got, want := string(pae("type", []byte("payload"))), "DSSEv1 4 type 7 payload"; got != want {
+		t.Errorf("pae() = %q, want %q", got, want)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	envelope, err := Sign(repo, testStatement(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := envelope.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(note), "\n") {
+		t.Fatalf("expected a single line note, got %q", note)
+	}
+	envelopes := ParseAllValid([]repository.Note{repository.Note("not json"), repository.Note(`{"payloadType":"other"}`), note})
+	if len(envelopes) != 1 {
+		t.Fatalf("expected 1 valid envelope, got %d", len(envelopes))
+	}
+	statement, keyID, err := envelopes[0].Verify(repo, repository.TestCommitJ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != signer || statement.Predicate.ReviewRevision != repository.TestCommitG || statement.Predicate.CI.Status != ci.StatusSuccess {
+		t.Errorf("unexpected verification result: %q, %+v", keyID, statement)
+	}
+	if _, _, err := envelopes[0].Verify(repo, repository.TestCommitI); err == nil {
+		t.Error("expected verification to fail for a different commit")
+	}
+}
+
+func TestSignError(t *testing.T) {
+	if _, err := Sign(errSignRepo{repository.NewMockRepoForTest()}, testStatement(), signer); err == nil {
+		t.Error("expected an error when signing fails")
+	}
+}
+
+type errSignRepo struct {
+	repository.Repo
+}
+
+func (errSignRepo) SignPayload([]byte) (string, error) {
+	return "", errors.New("signing failed")
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	valid, err := Sign(repo, testStatement(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	otherType := testStatement()
+	otherType.PredicateType = "https://example.com/other"
+	otherTypePayload, err := json.Marshal(otherType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for description, envelope := range map[string]Envelope{
+		"payload type":     {PayloadType: "other", Payload: valid.Payload, Signatures: valid.Signatures},
+		"payload encoding": {PayloadType: PayloadType, Payload: "!", Signatures: valid.Signatures},
+		"statement":        {PayloadType: PayloadType, Payload: encode("not json"), Signatures: valid.Signatures},
+		"predicate type":   {PayloadType: PayloadType, Payload: encode(string(otherTypePayload)), Signatures: valid.Signatures},
+		"unsigned":         {PayloadType: PayloadType, Payload: valid.Payload},
+		"signer":           {PayloadType: PayloadType, Payload: valid.Payload, Signatures: []Signature{{KeyID: "other@example.com", Sig: valid.Signatures[0].Sig}}},
+		"sig encoding":     {PayloadType: PayloadType, Payload: valid.Payload, Signatures: []Signature{{KeyID: signer, Sig: "!"}}},
+	} {
+		if _, _, err := envelope.Verify(repo, repository.TestCommitJ); err == nil {
+			t.Errorf("%s: expected verification to fail", description)
+		}
+	}
+
+	// A single valid signature is enough.
+	multiple := valid
+	multiple.Signatures = []Signature{{KeyID: "other@example.com", Sig: encode("bad")}, valid.Signatures[0]}
+	if _, _, err := multiple.Verify(repo, repository.TestCommitJ); err != nil {
+		t.Errorf("unexpected verification failure: %v", err)
+	}
+}
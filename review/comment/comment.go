@@ -18,6 +18,7 @@ limitations under the License.
 package comment
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
@@ -31,6 +32,9 @@ import (
 // Ref defines the git-notes ref that we expect to contain review comments.
 const Ref = "refs/notes/devtools/discuss"
 
+// RedactedDescription replaces the description of redacted comments.
+const RedactedDescription = "[redacted]"
+
 // FormatVersion defines the latest version of the comment format supported by the tool.
 const FormatVersion = 0
 
@@ -120,6 +124,16 @@ type Comment struct {
 	Resolved *bool `json:"resolved,omitempty"`
 	// Version represents the version of the metadata format.
 	Version int `json:"v,omitempty"`
+	// Signature is an optional, armored SSH or OpenPGP signature of the
+	// comment's signing payload, made by the comment's author.
+	Signature string `json:"signature,omitempty"`
+	// Redacted is set on the tombstones of redacted comments, and holds the
+	// hash of the comment that was redacted.
+	Redacted string `json:"redacted,omitempty"`
+	// Encrypted holds the armored ciphertext of the description of a comment
+	// on a private review. When it is set, the description is only filled in
+	// by Decrypt, and is never written.
+	Encrypted string `json:"encrypted,omitempty"`
 }
 
 // New returns a new comment with the given description message.
@@ -146,15 +160,25 @@ func Parse(note repository.Note) (Comment, error) {
 // some of them being review comments.
 func ParseAllValid(notes []repository.Note) map[string]Comment {
 	comments := make(map[string]Comment)
+	tombstones := make(map[string]Comment)
 	for _, note := range notes {
 		comment, err := Parse(note)
 		if err == nil && comment.Version == FormatVersion {
-			hash, err := comment.Hash()
-			if err == nil {
+			if comment.Redacted != "" {
+				tombstones[comment.Redacted] = comment
+			} else if hash, err := comment.Hash(); err == nil {
 				comments[hash] = comment
 			}
 		}
 	}
+	for hash, tombstone := range tombstones {
+		// A redacted comment might resurface from a clone that still has
+		// it, but its tombstone takes precedence, as long as the tombstone
+		// does not change anything about the comment but its description.
+		if original, ok := comments[hash]; !ok || tombstone.IsTombstoneOf(original) {
+			comments[hash] = tombstone
+		}
+	}
 	return comments
 }
 
@@ -170,6 +194,9 @@ func (comment Comment) serialize() ([]byte, error) {
 		// We ignore the other case, as the comment timestamp is not in a format
 		// we expected, so we should just leave it alone.
 	}
+	if comment.Encrypted != "" {
+		comment.Description = ""
+	}
 	return json.Marshal(comment)
 }
 
@@ -179,8 +206,78 @@ func (comment Comment) Write() (repository.Note, error) {
 	return repository.Note(bytes), err
 }
 
+// SigningPayload returns the bytes that are covered by the comment's
+// signature, which are the serialized comment without the signature itself.
+func (comment Comment) SigningPayload() ([]byte, error) {
+	comment.Signature = ""
+	return comment.serialize()
+}
+
+// Redact returns a tombstone to replace the comment with, which keeps the
+// comment's place in its review but not its description.
+func (comment Comment) Redact() (Comment, error) {
+	hash, err := comment.Hash()
+	if err != nil {
+		return Comment{}, err
+	}
+	comment.Redacted = hash
+	comment.Description = RedactedDescription
+	comment.Signature = ""
+	comment.Encrypted = ""
+	return comment, nil
+}
+
+// IsTombstoneOf returns whether the comment is exactly the tombstone that
+// Redact returns for the given comment.
+func (comment Comment) IsTombstoneOf(original Comment) bool {
+	tombstone, err := original.Redact()
+	if err != nil {
+		return false
+	}
+	want, err := tombstone.serialize()
+	if err != nil {
+		return false
+	}
+	got, err := comment.serialize()
+	return err == nil && bytes.Equal(got, want)
+}
+
+// Encrypt encrypts the comment's description to the recipients configured
+// for the repo.
+func (comment *Comment) Encrypt(repo repository.Repo) error {
+	ciphertext, err := repo.EncryptPayload([]byte(comment.Description))
+	if err != nil {
+		return err
+	}
+	comment.Encrypted = ciphertext
+	return nil
+}
+
+// Decrypt sets the description of an encrypted comment to its plaintext.
+func (comment *Comment) Decrypt(repo repository.Repo) error {
+	if comment.Encrypted == "" {
+		return nil
+	}
+	plaintext, err := repo.DecryptPayload(comment.Encrypted)
+	if err != nil {
+		return err
+	}
+	comment.Description = string(plaintext)
+	return nil
+}
+
 // Hash returns the SHA1 hash of a review comment.
+//
+// This is used to refer to the comment, e.g. in the replies to it, so it
+// remains a SHA1 hash in repos that use SHA-256 object names, which keeps
+// it the same for every client.
+//
+// The hash of a tombstone is that of the comment that it replaced, so that
+// the replies to that comment still refer to it.
 func (comment Comment) Hash() (string, error) {
+	if comment.Redacted != "" {
+		return comment.Redacted, nil
+	}
 	bytes, err := comment.serialize()
 	return fmt.Sprintf("%x", sha1.Sum(bytes)), err
 }
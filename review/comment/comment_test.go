@@ -2,6 +2,7 @@ package comment
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"msrl.dev/git-appraise/repository"
@@ -84,6 +85,145 @@ func TestWriteRoundtrip(t *testing.T) {
 	}
 }
 
+func TestSigningPayload(t *testing.T) {
+	c := New("user@example.com", "signed")
+	c.Timestamp = "1234567890"
+	unsigned, err := c.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Signature = "signature"
+	signed, err := c.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signed) != string(unsigned) {
+		t.Fatalf("expected the payload to exclude the signature, got %q vs %q", signed, unsigned)
+	}
+	c.Description = "changed"
+	changed, err := c.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(changed) == string(unsigned) {
+		t.Fatal("expected the payload to cover the description")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	resolved := true
+	c := New("user@example.com", "leaked secret")
+	c.Timestamp = "1234567890"
+	c.Parent = "parent"
+	c.Resolved = &resolved
+	c.Signature = "signature"
+	hash, err := c.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstone, err := c.Redact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstone.Description != RedactedDescription || tombstone.Signature != "" || tombstone.Redacted != hash {
+		t.Errorf("unexpected tombstone %+v", tombstone)
+	}
+	if tombstone.Parent != c.Parent || tombstone.Author != c.Author || tombstone.Resolved != c.Resolved {
+		t.Errorf("expected the tombstone to keep the comment's place, got %+v", tombstone)
+	}
+	if tombstoneHash, err := tombstone.Hash(); err != nil || tombstoneHash != hash {
+		t.Errorf("expected the tombstone to keep the comment's hash, got %q, %v", tombstoneHash, err)
+	}
+
+	// The tombstone takes precedence over the original regardless of order.
+	original, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := tombstone.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, notes := range [][]repository.Note{{original, note}, {note, original}} {
+		comments := ParseAllValid(notes)
+		if len(comments) != 1 || comments[hash].Redacted != hash {
+			t.Errorf("expected only the tombstone, got %+v", comments)
+		}
+	}
+
+	// A tombstone that changes anything but the description does not.
+	forged := tombstone
+	forged.Resolved = nil
+	if forged.IsTombstoneOf(c) || !tombstone.IsTombstoneOf(c) {
+		t.Error("expected only the tombstone written by Redact to match the comment")
+	}
+	forgedNote, err := forged.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, notes := range [][]repository.Note{{original, forgedNote}, {forgedNote, original}} {
+		comments := ParseAllValid(notes)
+		if len(comments) != 1 || comments[hash].Redacted != "" {
+			t.Errorf("expected only the original comment, got %+v", comments)
+		}
+	}
+	if comments := ParseAllValid([]repository.Note{forgedNote}); comments[hash].Redacted != hash {
+		t.Errorf("expected a tombstone without its original to be kept, got %+v", comments)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	c := New("user@example.com", "secret comment")
+	c.Timestamp = "1234567890"
+	if err := c.Encrypt(repo); err == nil {
+		t.Error("expected an error encrypting without any recipients")
+	}
+	repo.AddConfigValue(repository.EncryptToKey, "user@example.com")
+	if err := c.Encrypt(repo); err != nil {
+		t.Fatal(err)
+	}
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(note), "secret comment") {
+		t.Errorf("expected the description not to be written, got %q", note)
+	}
+	hash, err := c.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := Parse(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.Decrypt(repo); err != nil || parsed.Description != "secret comment" {
+		t.Errorf("unexpected decrypted description %q, %v", parsed.Description, err)
+	}
+	if decryptedHash, err := parsed.Hash(); err != nil || decryptedHash != hash {
+		t.Errorf("expected decrypting to keep the comment's hash, got %q, %v", decryptedHash, err)
+	}
+
+	tombstone, err := parsed.Redact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstone.Encrypted != "" || tombstone.Description != RedactedDescription {
+		t.Errorf("expected the tombstone to drop the ciphertext, got %+v", tombstone)
+	}
+
+	parsed.Encrypted = "not a ciphertext"
+	if err := parsed.Decrypt(repo); err == nil {
+		t.Error("expected an error decrypting an invalid ciphertext")
+	}
+	plain := New("user@example.com", "plain")
+	if err := plain.Decrypt(repo); err != nil || plain.Description != "plain" {
+		t.Errorf("expected an unencrypted comment to be unchanged, got %q, %v", plain.Description, err)
+	}
+}
+
 func TestHashDeterministic(t *testing.T) {
 	c := New("user@example.com", "hash test")
 	c.Timestamp = "1234567890"
@@ -0,0 +1,274 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// IndexFile is the name of the file, in the repo's data directory, that
+// caches the review notes and the submission state of each review, so that
+// listing reviews does not have to re-read every note and walk the history
+// of every target ref.
+//
+// The index is keyed by the commits of the notes refs and the tips of the
+// target refs, and is brought up to date incrementally from the differences
+// between the indexed and current notes, so it never has to be invalidated
+// by hand. Deleting it is always safe.
+const IndexFile = "appraise-index"
+
+// indexVersion identifies the format of the index file. It must be changed
+// whenever that format changes, so that older indexes are rebuilt.
+const indexVersion = 1
+
+// submission records whether a review's starting commit was reachable from
+// its target ref, when that ref pointed to the given tip.
+type submission struct {
+	Target    string
+	Start     string
+	Tip       string
+	Submitted bool
+}
+
+// index holds the review and discussion notes for every annotated revision,
+// as of the given notes commits.
+type index struct {
+	Version        int
+	RequestsCommit string
+	CommentsCommit string
+	Requests       map[string][]repository.Note
+	Comments       map[string][]repository.Note
+	// Commits records the annotated revisions which are known to be commits.
+	// Notes may annotate revisions that have not been fetched yet, so any
+	// others are checked again each time that the index is used.
+	Commits     map[string]bool
+	Submissions map[string]submission
+
+	path  string
+	dirty bool
+}
+
+// mergesNotes reports whether the given repo reads its review notes from
+// several namespaces. The index cannot be used for such repos, since only the
+// notes commits of the namespace in which reviews are written can be tracked.
+func mergesNotes(repo repository.Repo) bool {
+	namespaced, ok := repo.(interface{ Namespaces() []string })
+	return ok && len(namespaced.Namespaces()) > 1
+}
+
+// indexPath returns the path of the index file for the given repo, or the
+// empty string if the index cannot be stored on disk.
+func indexPath(repo repository.Repo) string {
+	if mergesNotes(repo) {
+		return ""
+	}
+	name := IndexFile
+	if namespaced, ok := repo.(interface{ Namespaces() []string }); ok {
+		if namespace := namespaced.Namespaces()[0]; namespace != repository.DefaultNamespace {
+			name += "-" + namespace
+		}
+	}
+	dataDir, err := repo.GetDataDir()
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(dataDir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return filepath.Join(dataDir, name)
+}
+
+// newIndex returns an empty index, which is stored at the given path.
+func newIndex(path string) *index {
+	return &index{
+		Version:     indexVersion,
+		Requests:    make(map[string][]repository.Note),
+		Comments:    make(map[string][]repository.Note),
+		Commits:     make(map[string]bool),
+		Submissions: make(map[string]submission),
+		path:        path,
+	}
+}
+
+// readIndex reads the index for the given repo, falling back to an empty
+// one if it is missing, unreadable, or in an older format.
+func readIndex(repo repository.Repo) *index {
+	path := indexPath(repo)
+	idx := newIndex(path)
+	if path == "" {
+		return idx
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return idx
+	}
+	defer f.Close()
+	stored := newIndex(path)
+	if err := gob.NewDecoder(f).Decode(stored); err != nil || stored.Version != indexVersion {
+		return idx
+	}
+	return stored
+}
+
+// write stores the index, if it has changed since it was read.
+//
+// The index is written to a temporary file that is then renamed into place,
+// so that concurrent readers never see a partially written index.
+func (idx *index) write() error {
+	if idx.path == "" || !idx.dirty {
+		return nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(idx.path), filepath.Base(idx.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(idx)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), idx.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// refreshNotes brings the indexed notes from the given ref up to date, by
+// applying the differences between the indexed and current notes commits.
+func (idx *index) refreshNotes(repo repository.Repo, notesRef string, indexed *string, notes map[string][]repository.Note) error {
+	current, err := repo.GetNotesCommit(notesRef)
+	if err != nil {
+		return err
+	}
+	if current == *indexed {
+		return nil
+	}
+	idx.dirty = true
+	if *indexed != "" {
+		// The indexed commit may no longer exist, e.g. if the notes were
+		// rewritten and then garbage collected, in which case the notes
+		// are read from scratch.
+		if diffs, err := repo.DiffNotes(*indexed, current); err == nil {
+			for _, diff := range diffs {
+				if len(diff.New) == 0 {
+					delete(notes, diff.Revision)
+				} else {
+					notes[diff.Revision] = diff.New
+				}
+			}
+			*indexed = current
+			return nil
+		}
+	}
+	clear(notes)
+	*indexed = ""
+	if current == "" {
+		return nil
+	}
+	allNotes, notesErr := repo.Notes(current, "")
+	for revision, revisionNotes := range allNotes {
+		notes[revision] = revisionNotes
+	}
+	if err := notesErr(); err != nil {
+		// Do not index a partial set of notes.
+		clear(notes)
+		return err
+	}
+	*indexed = current
+	return nil
+}
+
+// refresh brings the index up to date with the repo's review notes.
+//
+// For repos that merge the notes of several namespaces, the notes are instead
+// read from scratch.
+func (idx *index) refresh(repo repository.Repo) error {
+	if mergesNotes(repo) {
+		requests, err := repo.GetAllNotes(request.Ref)
+		if err != nil {
+			return err
+		}
+		comments, err := repo.GetAllNotes(comment.Ref)
+		if err != nil {
+			return err
+		}
+		idx.Requests, idx.Comments = requests, comments
+		return nil
+	}
+	if err := idx.refreshNotes(repo, request.Ref, &idx.RequestsCommit, idx.Requests); err != nil {
+		return err
+	}
+	if err := idx.refreshNotes(repo, comment.Ref, &idx.CommentsCommit, idx.Comments); err != nil {
+		return err
+	}
+	for revision := range idx.Commits {
+		if _, ok := idx.Requests[revision]; !ok {
+			delete(idx.Commits, revision)
+		}
+	}
+	for revision := range idx.Submissions {
+		if _, ok := idx.Requests[revision]; !ok {
+			delete(idx.Submissions, revision)
+		}
+	}
+	return nil
+}
+
+// isCommit reports whether the given annotated revision is a commit.
+func (idx *index) isCommit(repo repository.Repo, revision string) bool {
+	if idx.Commits[revision] {
+		return true
+	}
+	if repo.VerifyCommit(revision) != nil {
+		return false
+	}
+	idx.Commits[revision] = true
+	idx.dirty = true
+	return true
+}
+
+// isSubmitted reports whether the given review has been submitted, reusing
+// the indexed answer if neither the review nor its target ref has changed.
+//
+// The tip of each target ref is looked up at most once, in the given map,
+// and the history of a target ref is only walked if some review needs it.
+func (idx *index) isSubmitted(repo repository.Repo, summary *Summary, tips map[string]string, isSubmittedCheck func(ref, commit string) bool) bool {
+	target, start := summary.Request.TargetRef, summary.getStartingCommit()
+	tip, ok := tips[target]
+	if !ok {
+		// A missing target ref has no history, so nothing was submitted to it.
+		tip, _ = repo.GetCommitHash(target)
+		tips[target] = tip
+	}
+	if s, ok := idx.Submissions[summary.Revision]; ok && s.Target == target && s.Start == start && s.Tip == tip {
+		return s.Submitted
+	}
+	submitted := isSubmittedCheck(target, start)
+	idx.Submissions[summary.Revision] = submission{Target: target, Start: start, Tip: tip, Submitted: submitted}
+	idx.dirty = true
+	return submitted
+}
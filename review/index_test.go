@@ -0,0 +1,438 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+	"iter"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// indexedRepo wraps a Repo with a data directory in which the index can be
+// stored, and counts the operations that the index is meant to avoid.
+type indexedRepo struct {
+	repository.Repo
+	dataDir     string
+	diffNotes   int
+	listCommits int
+	dataDirErr  error
+	notesErr    error
+	missing     map[string]bool // commits and notes commits to treat as absent
+	removed     []string        // revisions whose notes are reported as removed
+}
+
+func newIndexedRepo(t *testing.T) *indexedRepo {
+	return &indexedRepo{
+		Repo:    repository.NewMockRepoForTest(),
+		dataDir: t.TempDir(),
+		missing: make(map[string]bool),
+	}
+}
+
+func (r *indexedRepo) GetDataDir() (string, error) { return r.dataDir, r.dataDirErr }
+
+func (r *indexedRepo) DiffNotes(from, to string) ([]repository.NotesDiff, error) {
+	r.diffNotes++
+	if r.missing[from] {
+		return nil, fmt.Errorf("no commit %q", from)
+	}
+	diffs, err := r.Repo.DiffNotes(from, to)
+	for _, revision := range r.removed {
+		diffs = append(diffs, repository.NotesDiff{Revision: revision})
+	}
+	return diffs, err
+}
+
+func (r *indexedRepo) Notes(notesRef, prefix string) (iter.Seq2[string, []repository.Note], func() error) {
+	notes, notesErr := r.Repo.Notes(notesRef, prefix)
+	if r.notesErr != nil {
+		return notes, func() error { return r.notesErr }
+	}
+	return notes, notesErr
+}
+
+func (r *indexedRepo) ListCommits(ref string) []string {
+	r.listCommits++
+	return r.Repo.ListCommits(ref)
+}
+
+func (r *indexedRepo) VerifyCommit(hash string) error {
+	if r.missing[hash] {
+		return fmt.Errorf("no commit %q", hash)
+	}
+	return r.Repo.VerifyCommit(hash)
+}
+
+// submittedRevisions returns the set of listed reviews that are submitted,
+// failing the test if they cannot be listed.
+func submittedRevisions(t *testing.T, repo repository.Repo) map[string]bool {
+	t.Helper()
+	reviews, err := List(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := make(map[string]bool)
+	for _, r := range reviews {
+		submitted[r.Revision] = r.Submitted
+	}
+	return submitted
+}
+
+func TestIndexPath(t *testing.T) {
+	if path := indexPath(repository.NewMockRepoForTest()); path != "" {
+		t.Errorf("expected no index for a missing data dir, got %q", path)
+	}
+	repo := newIndexedRepo(t)
+	if path := indexPath(repo); path != filepath.Join(repo.dataDir, IndexFile) {
+		t.Errorf("unexpected index path %q", path)
+	}
+	notDir := filepath.Join(repo.dataDir, "file")
+	if err := os.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if path := indexPath(&indexedRepo{Repo: repo.Repo, dataDir: notDir}); path != "" {
+		t.Errorf("expected no index for a data dir that is a file, got %q", path)
+	}
+	if path := indexPath(&indexedRepo{Repo: repo.Repo, dataDirErr: fmt.Errorf("no data dir")}); path != "" {
+		t.Errorf("expected no index when the data dir is unknown, got %q", path)
+	}
+
+	for _, test := range []struct {
+		namespaces []string
+		want       string
+	}{
+		{[]string{repository.DefaultNamespace}, IndexFile},
+		{[]string{"security"}, IndexFile + "-security"},
+		{[]string{"security", repository.DefaultNamespace}, ""},
+	} {
+		namespaced, err := repository.NewNamespacedRepo(repo, test.namespaces[0], test.namespaces[1:]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.want
+		if want != "" {
+			want = filepath.Join(repo.dataDir, want)
+		}
+		if path := indexPath(namespaced); path != want {
+			t.Errorf("unexpected index path for %q: got %q, want %q", test.namespaces, path, want)
+		}
+	}
+}
+
+func TestListMergedNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=User", "-c", "user.email=user@example.com"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+	git("commit", "--quiet", "--allow-empty", "-m", "Reviewed")
+	commit := git("rev-parse", "HEAD")
+	// The review is only in a namespace that reviews are read from, and not
+	// in the one that they are written to.
+	git("notes", "--ref", "refs/notes/security/reviews", "add", "-m", `{"timestamp": "0000000001", "requester": "user@example.com", "targetRef": "refs/heads/other"}`, commit)
+	gitRepo, err := repository.NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := repository.NewNamespacedRepo(gitRepo, repository.DefaultNamespace, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if notes := repo.GetNotes(request.Ref, commit); len(notes) != 1 {
+		t.Fatalf("expected 1 request note, got %q", notes)
+	}
+	for range 2 {
+		if reviews := ListAll(repo); len(reviews) != 1 || reviews[0].Revision != commit {
+			t.Errorf("expected the review of %s, got %+v", commit, reviews)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, ".git")); slices.ContainsFunc(entries, func(e os.DirEntry) bool { return strings.HasPrefix(e.Name(), IndexFile) }) {
+		t.Error("expected no index for merged namespaces")
+	}
+}
+
+func TestListIndex(t *testing.T) {
+	repo := newIndexedRepo(t)
+	want := map[string]bool{repository.TestCommitB: true, repository.TestCommitD: true, repository.TestCommitG: false}
+	if got := submittedRevisions(t, repo); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected reviews %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(repo.dataDir, IndexFile)); err != nil {
+		t.Fatalf("expected the index to be written: %v", err)
+	}
+
+	// Nothing has changed, so the index is used as is.
+	repo.diffNotes, repo.listCommits = 0, 0
+	if got := submittedRevisions(t, repo); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected reviews from the index %v", got)
+	}
+	if repo.diffNotes != 0 || repo.listCommits != 0 {
+		t.Errorf("expected the index to be reused, got %d diffs and %d walks", repo.diffNotes, repo.listCommits)
+	}
+
+	// New notes are read from the diff, without re-walking the target.
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, repository.Note(`{"timestamp": "0000000007", "author": "ojarjur", "description": "new"}`)); err != nil {
+		t.Fatal(err)
+	}
+	reviews, err := List(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reviews {
+		if r.Revision == repository.TestCommitG && (len(r.Comments) != 1 || r.Comments[0].Comment.Description != "new") {
+			t.Errorf("expected the new comment, got %+v", r.Comments)
+		}
+	}
+	if repo.diffNotes != 1 || repo.listCommits != 0 {
+		t.Errorf("expected a single diff and no walks, got %d diffs and %d walks", repo.diffNotes, repo.listCommits)
+	}
+
+	// Moving the target ref rechecks whether its reviews were submitted.
+	if err := repo.SetRef("refs/heads/master", repository.TestCommitI, ""); err != nil {
+		t.Fatal(err)
+	}
+	want[repository.TestCommitG] = true
+	if got := submittedRevisions(t, repo); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected reviews after moving the target %v", got)
+	}
+	if repo.listCommits != 1 {
+		t.Errorf("expected the target to be walked once, got %d", repo.listCommits)
+	}
+}
+
+func TestListIndexRebuild(t *testing.T) {
+	repo := newIndexedRepo(t)
+	path := filepath.Join(repo.dataDir, IndexFile)
+	want := fmt.Sprint(submittedRevisions(t, repo))
+
+	for _, contents := range []string{"not an index", ""} {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(submittedRevisions(t, repo)); got != want {
+			t.Errorf("unexpected reviews after corrupting the index: %v", got)
+		}
+	}
+
+	idx := readIndex(repo)
+	idx.Version = indexVersion - 1
+	idx.Requests = nil
+	idx.dirty = true
+	if err := idx.write(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readIndex(repo); got.Version != indexVersion || len(got.Requests) != 0 {
+		t.Errorf("expected an older index to be ignored, got %+v", got)
+	}
+
+	// If the indexed notes commit is gone, the notes are read from scratch.
+	submittedRevisions(t, repo)
+	idx = readIndex(repo)
+	idx.RequestsCommit = "gone"
+	idx.Requests["stale"] = []repository.Note{repository.Note(repository.TestRequestB)}
+	idx.dirty = true
+	if err := idx.write(); err != nil {
+		t.Fatal(err)
+	}
+	repo.missing["gone"] = true
+	if got := fmt.Sprint(submittedRevisions(t, repo)); got != want {
+		t.Errorf("unexpected reviews after losing the notes commit: %v", got)
+	}
+	if _, ok := readIndex(repo).Requests["stale"]; ok {
+		t.Error("expected the stale notes to be dropped")
+	}
+}
+
+func TestListIndexRemovedNotes(t *testing.T) {
+	repo := newIndexedRepo(t)
+	submittedRevisions(t, repo)
+	if err := repo.AppendNote(request.Ref, repository.TestCommitD, repository.Note(repository.TestRequestD)); err != nil {
+		t.Fatal(err)
+	}
+	repo.removed = []string{repository.TestCommitB}
+	if got := submittedRevisions(t, repo); len(got) != 2 || got[repository.TestCommitB] {
+		t.Fatalf("expected the removed review to be dropped, got %v", got)
+	}
+	idx := readIndex(repo)
+	if _, ok := idx.Commits[repository.TestCommitB]; ok {
+		t.Error("expected the removed review's commit to be forgotten")
+	}
+	if _, ok := idx.Submissions[repository.TestCommitB]; ok {
+		t.Error("expected the removed review's submission to be forgotten")
+	}
+}
+
+func TestListIndexNotesError(t *testing.T) {
+	repo := newIndexedRepo(t)
+	repo.notesErr = fmt.Errorf("notes error")
+	if _, err := List(repo); err == nil {
+		t.Fatal("expected an error listing reviews when the notes cannot be read")
+	}
+	idx := newIndex(filepath.Join(repo.dataDir, IndexFile))
+	if err := idx.refreshNotes(repo, request.Ref, &idx.RequestsCommit, idx.Requests); err == nil {
+		t.Fatal("expected an error refreshing the index")
+	}
+	if idx.RequestsCommit != "" || len(idx.Requests) != 0 {
+		t.Fatalf("expected the partial notes not to be indexed, got %q, %d", idx.RequestsCommit, len(idx.Requests))
+	}
+
+	repo.notesErr = nil
+	if got := submittedRevisions(t, repo); len(got) != 3 {
+		t.Fatalf("expected the reviews once the notes can be read, got %v", got)
+	}
+}
+
+func TestListIndexUnknownCommit(t *testing.T) {
+	repo := newIndexedRepo(t)
+	repo.missing[repository.TestCommitG] = true
+	if got := submittedRevisions(t, repo); len(got) != 2 {
+		t.Fatalf("expected the review of a missing commit to be skipped, got %v", got)
+	}
+	// Once the commit is fetched, its review is listed.
+	delete(repo.missing, repository.TestCommitG)
+	if got := submittedRevisions(t, repo); len(got) != 3 {
+		t.Fatalf("expected the review of a fetched commit to be listed, got %v", got)
+	}
+	if !readIndex(repo).Commits[repository.TestCommitG] {
+		t.Error("expected the fetched commit to be recorded")
+	}
+}
+
+func TestIndexWrite(t *testing.T) {
+	dir := t.TempDir()
+	idx := newIndex(filepath.Join(dir, "missing", IndexFile))
+	if err := idx.write(); err != nil {
+		t.Errorf("expected an unchanged index not to be written, got %v", err)
+	}
+	idx.dirty = true
+	if err := idx.write(); err == nil {
+		t.Error("expected an error writing to a missing directory")
+	}
+	idx.path = filepath.Join(dir, IndexFile)
+	if err := os.MkdirAll(filepath.Join(idx.path, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.write(); err == nil {
+		t.Error("expected an error replacing a directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected the temporary file to be removed, got %v", entries)
+	}
+}
+
+// newLargeRepo creates a git repo with the given number of commits on its
+// master branch, each of which has a review request and a comment.
+func newLargeRepo(b *testing.B, reviews int) *repository.GitRepo {
+	b.Helper()
+	dir := b.TempDir()
+	if out, err := exec.Command("git", "init", "--quiet", dir).CombinedOutput(); err != nil {
+		b.Fatalf("git init failed: %v\n%s", err, out)
+	}
+	var stream strings.Builder
+	data := func(contents string) {
+		fmt.Fprintf(&stream, "data %d\n%s\n", len(contents), contents)
+	}
+	for i := 1; i <= reviews; i++ {
+		fmt.Fprintf(&stream, "commit refs/heads/master\nmark :%d\ncommitter User <user@example.com> %d +0000\n", i, i)
+		data(fmt.Sprintf("Commit %d", i))
+		if i > 1 {
+			fmt.Fprintf(&stream, "from :%d\n", i-1)
+		}
+		fmt.Fprintf(&stream, "M 644 inline file\n")
+		data(fmt.Sprintf("contents %d", i))
+	}
+	for _, ref := range []string{request.Ref, comment.Ref} {
+		fmt.Fprintf(&stream, "commit %s\ncommitter User <user@example.com> %d +0000\n", ref, reviews)
+		data("Notes")
+		for i := 1; i <= reviews; i++ {
+			note := fmt.Sprintf(`{"timestamp": "%010d", "author": "user@example.com", "description": "Comment %d"}`, i, i)
+			if ref == request.Ref {
+				note = fmt.Sprintf(`{"timestamp": "%010d", "reviewRef": "refs/heads/review%d", "targetRef": "refs/heads/master", "requester": "user@example.com", "description": "Review %d"}`, i, i, i)
+			}
+			fmt.Fprintf(&stream, "N inline :%d\n", i)
+			data(note)
+		}
+	}
+	cmd := exec.Command("git", "fast-import", "--quiet")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stream.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		b.Fatalf("git fast-import failed: %v\n%s", err, out)
+	}
+	repo, err := repository.NewGitRepo(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return repo
+}
+
+// benchmarkList lists the reviews in a large repo, calling the given
+// function before each iteration.
+func benchmarkList(b *testing.B, reviews int, before func(repo *repository.GitRepo)) {
+	repo := newLargeRepo(b, reviews)
+	if got, err := List(repo); err != nil || len(got) != reviews {
+		b.Fatalf("expected %d reviews, got %d, %v", reviews, len(got), err)
+	}
+	for b.Loop() {
+		b.StopTimer()
+		before(repo)
+		b.StartTimer()
+		if _, err := List(repo); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkList compares listing the reviews of a large repo without an
+// index, with an up to date index, and with an index that is missing the
+// latest comment.
+func BenchmarkList(b *testing.B) {
+	for _, reviews := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("reviews=%d/unindexed", reviews), func(b *testing.B) {
+			benchmarkList(b, reviews, func(repo *repository.GitRepo) {
+				dataDir, _ := repo.GetDataDir()
+				os.Remove(filepath.Join(dataDir, IndexFile))
+			})
+		})
+		b.Run(fmt.Sprintf("reviews=%d/indexed", reviews), func(b *testing.B) {
+			benchmarkList(b, reviews, func(*repository.GitRepo) {})
+		})
+		b.Run(fmt.Sprintf("reviews=%d/new-comment", reviews), func(b *testing.B) {
+			benchmarkList(b, reviews, func(repo *repository.GitRepo) {
+				head, _ := repo.GetCommitHash("refs/heads/master")
+				if err := repo.AppendNote(comment.Ref, head, repository.Note(`{"timestamp": "9999999999", "description": "New"}`)); err != nil {
+					b.Fatal(err)
+				}
+			})
+		})
+	}
+}
@@ -52,6 +52,13 @@ type Request struct {
 	// Alias stores a post-rebase commit ID for the review. This allows the tool
 	// to track the history of a review even if the commit history changes.
 	Alias string `json:"alias,omitempty"`
+	// Signature is an optional, armored SSH or OpenPGP signature of the
+	// request's signing payload, made by the requester.
+	Signature string `json:"signature,omitempty"`
+	// Encrypted holds the armored ciphertext of the description of a private
+	// review. When it is set, the description is only filled in by Decrypt,
+	// and is never written.
+	Encrypted string `json:"encrypted,omitempty"`
 }
 
 // New returns a new request.
@@ -91,8 +98,46 @@ func ParseAllValid(notes []repository.Note) []Request {
 	return requests
 }
 
+func (request Request) serialize() ([]byte, error) {
+	if request.Encrypted != "" {
+		request.Description = ""
+	}
+	return json.Marshal(request)
+}
+
 // Write writes a review request as a JSON-formatted git note.
 func (request *Request) Write() (repository.Note, error) {
-	bytes, err := json.Marshal(request)
+	bytes, err := request.serialize()
 	return repository.Note(bytes), err
 }
+
+// SigningPayload returns the bytes that are covered by the request's
+// signature, which are the serialized request without the signature itself.
+func (request Request) SigningPayload() ([]byte, error) {
+	request.Signature = ""
+	return request.serialize()
+}
+
+// Encrypt encrypts the request's description to the recipients configured
+// for the repo.
+func (request *Request) Encrypt(repo repository.Repo) error {
+	ciphertext, err := repo.EncryptPayload([]byte(request.Description))
+	if err != nil {
+		return err
+	}
+	request.Encrypted = ciphertext
+	return nil
+}
+
+// Decrypt sets the description of an encrypted request to its plaintext.
+func (request *Request) Decrypt(repo repository.Repo) error {
+	if request.Encrypted == "" {
+		return nil
+	}
+	plaintext, err := repo.DecryptPayload(request.Encrypted)
+	if err != nil {
+		return err
+	}
+	request.Description = string(plaintext)
+	return nil
+}
@@ -1,6 +1,7 @@
 package request
 
 import (
+	"strings"
 	"testing"
 
 	"msrl.dev/git-appraise/repository"
@@ -77,3 +78,78 @@ func TestWriteRoundtrip(t *testing.T) {
 		t.Fatalf("roundtrip refs failed: got %+v", parsed)
 	}
 }
+
+func TestSigningPayload(t *testing.T) {
+	r := New("user@example.com", nil, "refs/heads/feature", "refs/heads/master", "signed")
+	r.Timestamp = "1234567890"
+	unsigned, err := r.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Signature = "signature"
+	signed, err := r.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signed) != string(unsigned) {
+		t.Fatalf("expected the payload to exclude the signature, got %q vs %q", signed, unsigned)
+	}
+	r.Description = "changed"
+	changed, err := r.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(changed) == string(unsigned) {
+		t.Fatal("expected the payload to cover the description")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	r := New("user@example.com", nil, "refs/heads/feature", "refs/heads/master", "secret fix")
+	if err := r.Encrypt(repo); err == nil {
+		t.Error("expected an error encrypting without any recipients")
+	}
+	repo.AddConfigValue(repository.EncryptToKey, "user@example.com")
+	if err := r.Encrypt(repo); err != nil {
+		t.Fatal(err)
+	}
+	note, err := r.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := r.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, written := range []string{string(note), string(payload)} {
+		if strings.Contains(written, "secret fix") {
+			t.Errorf("expected the description not to be written, got %q", written)
+		}
+	}
+	if r.Description != "secret fix" {
+		t.Errorf("expected writing to leave the description, got %q", r.Description)
+	}
+
+	parsed, err := Parse(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Description != "" || parsed.Encrypted != r.Encrypted {
+		t.Errorf("unexpected parsed request %+v", parsed)
+	}
+	if err := parsed.Decrypt(repo); err != nil || parsed.Description != "secret fix" {
+		t.Errorf("unexpected decrypted description %q, %v", parsed.Description, err)
+	}
+
+	other := repository.NewMockRepoForTest()
+	other.AddConfigValue(repository.EncryptToKey, "other@example.com")
+	parsed.Encrypted, _ = other.EncryptPayload([]byte("hidden"))
+	if err := parsed.Decrypt(repo); err == nil {
+		t.Error("expected an error decrypting a request encrypted to someone else")
+	}
+	plain := New("user@example.com", nil, "refs/heads/feature", "refs/heads/master", "plain")
+	if err := plain.Decrypt(repo); err != nil || plain.Description != "plain" {
+		t.Errorf("expected an unencrypted request to be unchanged, got %q, %v", plain.Description, err)
+	}
+}
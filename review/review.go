@@ -22,6 +22,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
+	"sync"
 
 	"msrl.dev/git-appraise/repository"
 	"msrl.dev/git-appraise/review/analyses"
@@ -32,6 +34,14 @@ import (
 
 const archiveRef = "refs/devtools/archives/reviews"
 
+// RequireVerifiedApprovalsKey is the git config key which, when set to true,
+// causes approvals that are not signed by their authors to be ignored.
+const RequireVerifiedApprovalsKey = "appraise.requireVerifiedApprovals"
+
+// EncryptedDescription replaces the descriptions of encrypted requests and
+// comments that cannot be decrypted.
+const EncryptedDescription = "[encrypted]"
+
 var emptyTree = repository.NewTree(map[string]repository.TreeChild{})
 
 // Test seams: these package-level vars allow tests to inject failures.
@@ -62,6 +72,15 @@ type CommentThread struct {
 	Children []CommentThread    `json:"children,omitempty"`
 	Resolved *bool              `json:"resolved,omitempty"`
 	Edited   bool               `json:"edited,omitempty"`
+	// Verified indicates that the comment is signed by its author. It is
+	// only set once the signatures of the review have been verified.
+	Verified bool `json:"verified,omitempty"`
+	// unverifiedApproval is set when the comment is an approval that does not
+	// count towards the status of the review, because the repo requires
+	// approvals to be signed and this one is not.
+	unverifiedApproval bool
+	// signatureChecked is set once the comment's signature has been verified.
+	signatureChecked bool
 }
 
 // Summary represents the high-level state of a code review.
@@ -82,6 +101,10 @@ type Summary struct {
 	Comments    []CommentThread   `json:"comments,omitempty"`
 	Resolved    *bool             `json:"resolved,omitempty"`
 	Submitted   bool              `json:"submitted"`
+	// RequestVerified indicates that the current request is signed by its
+	// requester. It is only set once the signatures of the review have been
+	// verified.
+	RequestVerified bool `json:"requestVerified,omitempty"`
 }
 
 // Review represents the entire state of a code review.
@@ -160,8 +183,12 @@ func updateThreadsStatus(threads []CommentThread) *bool {
 // and updates the "Resolved" field of that thread accordingly.
 func (thread *CommentThread) updateResolvedStatus() {
 	resolved := updateThreadsStatus(thread.Children)
+	commentResolved := thread.Comment.Resolved
+	if thread.unverifiedApproval {
+		commentResolved = nil
+	}
 	if resolved == nil {
-		thread.Resolved = thread.Comment.Resolved
+		thread.Resolved = commentResolved
 		return
 	}
 
@@ -170,7 +197,7 @@ func (thread *CommentThread) updateResolvedStatus() {
 		return
 	}
 
-	if thread.Comment.Resolved == nil || !*thread.Comment.Resolved {
+	if commentResolved == nil || !*commentResolved {
 		thread.Resolved = nil
 		return
 	}
@@ -254,11 +281,125 @@ func buildCommentThreads(commentsByHash map[string]comment.Comment) []CommentThr
 	return threads
 }
 
+// decryptComments decrypts the descriptions of any encrypted comments, or
+// replaces them with EncryptedDescription if they cannot be decrypted.
+func decryptComments(repo repository.Repo, commentsByHash map[string]comment.Comment) {
+	for hash, c := range commentsByHash {
+		if c.Encrypted == "" {
+			continue
+		}
+		if err := c.Decrypt(repo); err != nil {
+			c.Description = EncryptedDescription
+		}
+		commentsByHash[hash] = c
+	}
+}
+
+// decryptRequests decrypts the descriptions of any encrypted requests, or
+// replaces them with EncryptedDescription if they cannot be decrypted.
+func decryptRequests(repo repository.Repo, requests []request.Request) {
+	for i := range requests {
+		if requests[i].Encrypted == "" {
+			continue
+		}
+		if err := requests[i].Decrypt(repo); err != nil {
+			requests[i].Description = EncryptedDescription
+		}
+	}
+}
+
+// RequiresVerifiedApprovals returns whether the repo is configured to only
+// accept reviews based on approvals that are signed by their authors.
+func RequiresVerifiedApprovals(repo repository.Repo) bool {
+	values, err := repo.GetConfigValues(RequireVerifiedApprovalsKey)
+	if err != nil || len(values) == 0 {
+		return false
+	}
+	required, err := strconv.ParseBool(values[len(values)-1])
+	return err == nil && required
+}
+
+// verifySignature returns whether the given signature is a valid signature
+// of the payload made by the given signer.
+func verifySignature(repo repository.Repo, signature string, payload func() ([]byte, error), signer string) bool {
+	if signature == "" {
+		return false
+	}
+	data, err := payload()
+	if err != nil {
+		return false
+	}
+	return repo.VerifyPayloadSignature(data, signature, signer) == nil
+}
+
+// verifyThread sets the "Verified" field of the given comment thread, unless
+// it has already been set.
+func verifyThread(repo repository.Repo, thread *CommentThread) {
+	if !thread.signatureChecked {
+		thread.Verified = verifySignature(repo, thread.Comment.Signature, thread.Comment.SigningPayload, thread.Comment.Author)
+		thread.signatureChecked = true
+	}
+}
+
+// verifyThreads sets the "Verified" field of all of the given comment threads.
+func verifyThreads(repo repository.Repo, threads []CommentThread) {
+	for i := range threads {
+		verifyThread(repo, &threads[i])
+		verifyThreads(repo, threads[i].Children)
+	}
+}
+
+// markUnverifiedApprovals verifies the approvals in the given comment threads
+// if the repo requires them to be signed, and marks those that do not count
+// due to not being verified.
+func markUnverifiedApprovals(repo repository.Repo, threads []CommentThread, requireVerified func() bool) {
+	for i := range threads {
+		thread := &threads[i]
+		if thread.Comment.Resolved != nil && *thread.Comment.Resolved && requireVerified() {
+			verifyThread(repo, thread)
+			thread.unverifiedApproval = !thread.Verified
+		}
+		markUnverifiedApprovals(repo, thread.Children, requireVerified)
+	}
+}
+
+// VerifySignatures verifies the signatures of the review's current request
+// and of all of its comments, and sets their "Verified" fields accordingly.
+//
+// This runs the signing program once for each signature, so it is left to
+// the callers that show whether reviews are signed, rather than being done
+// whenever a review is read. Approvals are still verified when reading a
+// review if the repo requires them to be signed.
+func (r *Summary) VerifySignatures() {
+	r.RequestVerified = verifySignature(r.Repo, r.Request.Signature, r.Request.SigningPayload, r.Request.Requester)
+	verifyThreads(r.Repo, r.Comments)
+}
+
+// appendApprovals appends the approvals in the given threads that count
+// towards the status of the review.
+func appendApprovals(approvals []CommentThread, threads []CommentThread) []CommentThread {
+	for _, thread := range threads {
+		if thread.Comment.Resolved != nil && *thread.Comment.Resolved && !thread.unverifiedApproval {
+			approvals = append(approvals, thread)
+		}
+		approvals = appendApprovals(approvals, thread.Children)
+	}
+	return approvals
+}
+
+// GetApprovals returns all of the comment threads whose comment approves the
+// review and counts towards its status.
+func (r *Summary) GetApprovals() []CommentThread {
+	return appendApprovals(nil, r.Comments)
+}
+
 // getCommentsFromNotes parses the log-structured sequence of comments for a commit,
 // and then builds the corresponding tree-structured comment threads.
 func getCommentsFromNotes(repo repository.Repo, revision string, commentNotes []repository.Note) ([]CommentThread, *bool) {
 	commentsByHash := comment.ParseAllValid(commentNotes)
+	decryptComments(repo, commentsByHash)
 	comments := buildCommentThreads(commentsByHash)
+	markUnverifiedApprovals(repo, comments, sync.OnceValue(func() bool { return RequiresVerifiedApprovals(repo) }))
 	resolved := updateThreadsStatus(comments)
 	return comments, resolved
 }
@@ -269,6 +410,7 @@ func getSummaryFromNotes(repo repository.Repo, revision string, requestNotes, co
 		return nil, fmt.Errorf("Could not find any review requests for %q", revision)
 	}
 	sort.Stable(requestsByTimestamp(requests))
+	decryptRequests(repo, requests)
 	reviewSummary := Summary{
 		Repo:        repo,
 		Revision:    revision,
@@ -378,47 +520,59 @@ func getIsSubmittedCheck(repo repository.Repo) func(ref, commit string) bool {
 	}
 }
 
-func unsortedListAll(repo repository.Repo) []Summary {
-	reviewNotesMap, err := repo.GetAllNotes(request.Ref)
-	if err != nil {
-		return nil
-	}
-	discussNotesMap, err := repo.GetAllNotes(comment.Ref)
-	if err != nil {
-		return nil
+func unsortedListAll(repo repository.Repo) ([]Summary, error) {
+	idx := readIndex(repo)
+	if err := idx.refresh(repo); err != nil {
+		return nil, err
 	}
 
 	isSubmittedCheck := getIsSubmittedCheck(repo)
+	tips := make(map[string]string)
 	var reviews []Summary
-	for commit, notes := range reviewNotesMap {
-		summary, err := getSummaryFromNotes(repo, commit, notes, discussNotesMap[commit])
+	for commit, notes := range idx.Requests {
+		if !idx.isCommit(repo, commit) {
+			continue
+		}
+		summary, err := getSummaryFromNotes(repo, commit, notes, idx.Comments[commit])
 		if err != nil {
 			continue
 		}
 		if !summary.IsAbandoned() {
-			summary.Submitted = isSubmittedCheck(summary.Request.TargetRef, summary.getStartingCommit())
+			summary.Submitted = idx.isSubmitted(repo, summary, tips, isSubmittedCheck)
 		}
 		reviews = append(reviews, *summary)
 	}
-	return reviews
+	// The index is only a cache, so failing to store it is not an error.
+	idx.write()
+	return reviews, nil
 }
 
-// ListAll returns all reviews stored in the git-notes.
-func ListAll(repo repository.Repo) []Summary {
-	reviews := unsortedListAll(repo)
+// List returns all reviews stored in the git-notes, or an error if the
+// notes cannot be read.
+func List(repo repository.Repo) ([]Summary, error) {
+	reviews, err := unsortedListAll(repo)
+	if err != nil {
+		return nil, err
+	}
 	sort.Stable(summariesWithNewestRequestsFirst(reviews))
+	return reviews, nil
+}
+
+// ListAll returns all reviews stored in the git-notes, or nil if the notes
+// cannot be read.
+func ListAll(repo repository.Repo) []Summary {
+	reviews, _ := List(repo)
 	return reviews
 }
 
 // ListOpen returns all reviews that are not yet incorporated into their target refs.
 func ListOpen(repo repository.Repo) []Summary {
 	var openReviews []Summary
-	for _, review := range unsortedListAll(repo) {
+	for _, review := range ListAll(repo) {
 		if review.IsOpen() {
 			openReviews = append(openReviews, review)
 		}
 	}
-	sort.Stable(summariesWithNewestRequestsFirst(openReviews))
 	return openReviews
 }
 
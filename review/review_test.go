@@ -18,6 +18,7 @@ package review
 
 import (
 	"fmt"
+	"iter"
 	"net/http"
 	"net/http/httptest"
 	"sort"
@@ -34,16 +35,18 @@ import (
 // errorRepo wraps a real Repo and injects errors for specific operations.
 type errorRepo struct {
 	repository.Repo
-	getAllNotesErr   map[string]error // keyed by notesRef
-	getHeadRefErr    error
-	isAncestorErr    error
-	getCommitHashErr error
-	getCommitTimeErr map[string]error // keyed by ref
-	appendNoteErr    error
-	rebaseRefErr     error
-	switchToRefErr   error
-	archiveRefErr    error
-	createCommitErr  error
+	getAllNotesErr    map[string]error // keyed by notesRef
+	getNotesCommitErr map[string]error // keyed by notesRef
+	notesErr          error
+	getHeadRefErr     error
+	isAncestorErr     error
+	getCommitHashErr  error
+	getCommitTimeErr  map[string]error // keyed by ref
+	appendNoteErr     error
+	rebaseRefErr      error
+	switchToRefErr    error
+	archiveRefErr     error
+	createCommitErr   error
 }
 
 func (e *errorRepo) GetAllNotes(notesRef string) (map[string][]repository.Note, error) {
@@ -55,6 +58,21 @@ func (e *errorRepo) GetAllNotes(notesRef string) (map[string][]repository.Note,
 	return e.Repo.GetAllNotes(notesRef)
 }
 
+func (e *errorRepo) GetNotesCommit(notesRef string) (string, error) {
+	if err, ok := e.getNotesCommitErr[notesRef]; ok {
+		return "", err
+	}
+	return e.Repo.GetNotesCommit(notesRef)
+}
+
+func (e *errorRepo) Notes(notesRef, prefix string) (iter.Seq2[string, []repository.Note], func() error) {
+	notes, notesErr := e.Repo.Notes(notesRef, prefix)
+	if e.notesErr != nil {
+		return notes, func() error { return e.notesErr }
+	}
+	return notes, notesErr
+}
+
 func (e *errorRepo) GetCommitTime(ref string) (string, error) {
 	if e.getCommitTimeErr != nil {
 		if err, ok := e.getCommitTimeErr[ref]; ok {
@@ -1150,6 +1168,257 @@ func TestAddComment(t *testing.T) {
 	}
 }
 
+// addApproval adds an approval of commit G, signed if requested, to the repo.
+func addApproval(t *testing.T, repo repository.Repo, author string, signed bool) {
+	t.Helper()
+	resolved := true
+	c := comment.New(author, "LGTM")
+	c.Timestamp = "9999999999"
+	c.Resolved = &resolved
+	if signed {
+		payload, err := c.SigningPayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Signature, err = repo.SignPayload(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifiedApprovals(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		author      string
+		signed      bool
+		required    string
+		verified    bool
+		accepted    bool
+	}{
+		{"unsigned", "user@example.com", false, "", false, true},
+		{"signed", "user@example.com", true, "", true, true},
+		{"unsigned and required", "user@example.com", false, "true", false, false},
+		{"signed and required", "user@example.com", true, "true", true, true},
+		{"signed by someone else", "other@example.com", true, "true", false, false},
+		{"invalid policy", "user@example.com", false, "sometimes", false, true},
+	} {
+		repo := repository.NewMockRepoForTest()
+		if test.required != "" {
+			if err := repo.AddConfigValue(RequireVerifiedApprovalsKey, test.required); err != nil {
+				t.Fatal(err)
+			}
+		}
+		addApproval(t, repo, test.author, test.signed)
+		summary, err := GetSummary(repo, repository.TestCommitG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary.VerifySignatures()
+		comments := summary.Comments
+		if len(comments) != 1 {
+			t.Fatalf("%s: expected 1 comment thread, got %d", test.description, len(comments))
+		}
+		if comments[0].Verified != test.verified {
+			t.Errorf("%s: expected verified=%v, got %v", test.description, test.verified, comments[0].Verified)
+		}
+		accepted := comments[0].Resolved != nil && *comments[0].Resolved
+		if accepted != test.accepted {
+			t.Errorf("%s: expected accepted=%v, got %v", test.description, test.accepted, accepted)
+		}
+	}
+}
+
+// countingVerifyRepo counts the signatures that are verified in a repo.
+type countingVerifyRepo struct {
+	repository.Repo
+	verified *int
+}
+
+func (r countingVerifyRepo) VerifyPayloadSignature(payload []byte, signature, signer string) error {
+	*r.verified++
+	return r.Repo.VerifyPayloadSignature(payload, signature, signer)
+}
+
+func TestVerifySignaturesLazily(t *testing.T) {
+	mockRepo := repository.NewMockRepoForTest()
+	addApproval(t, mockRepo, "user@example.com", true)
+	var verified int
+	repo := countingVerifyRepo{Repo: mockRepo, verified: &verified}
+	ListAll(repo)
+	summary, err := GetSummary(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified != 0 || summary.Comments[0].Verified {
+		t.Errorf("expected no signatures to be verified when reading reviews, got %d", verified)
+	}
+	summary.VerifySignatures()
+	if verified != 1 || !summary.Comments[0].Verified {
+		t.Errorf("expected the approval to be verified once, got %d", verified)
+	}
+
+	if err := mockRepo.AddConfigValue(RequireVerifiedApprovalsKey, "true"); err != nil {
+		t.Fatal(err)
+	}
+	verified = 0
+	summary, err = GetSummary(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified != 1 || !summary.Comments[0].Verified {
+		t.Errorf("expected the approval to be verified when required, got %d", verified)
+	}
+	summary.VerifySignatures()
+	if verified != 1 {
+		t.Errorf("expected the approval not to be verified again, got %d", verified)
+	}
+}
+
+func TestGetApprovals(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if err := repo.AddConfigValue(RequireVerifiedApprovalsKey, "true"); err != nil {
+		t.Fatal(err)
+	}
+	addApproval(t, repo, "user@example.com", true)
+	addApproval(t, repo, "other@example.com", false)
+	summary, err := GetSummary(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	approvals := summary.GetApprovals()
+	if len(approvals) != 1 || approvals[0].Comment.Author != "user@example.com" {
+		t.Errorf("expected only the signed approval, got %+v", approvals)
+	}
+}
+
+func TestVerifiedRequest(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	r := request.New("user@example.com", nil, repository.TestReviewRef, repository.TestTargetRef, "signed")
+	r.Timestamp = "9999999999"
+	payload, err := r.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Signature, err = repo.SignPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	note, err := r.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(request.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := GetSummary(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary.VerifySignatures()
+	if !summary.RequestVerified {
+		t.Errorf("expected the signed request to be verified, got %+v", summary.Request)
+	}
+
+	unsigned, err := GetSummary(repo, repository.TestCommitB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned.VerifySignatures()
+	if unsigned.RequestVerified {
+		t.Error("expected an unsigned request not to be verified")
+	}
+}
+
+// addEncryptedReview adds a signed, encrypted request and comment on
+// TestCommitG, encrypted to the given recipient.
+func addEncryptedReview(t *testing.T, repo repository.Repo, recipient string) {
+	t.Helper()
+	if err := repo.AddConfigValue(repository.EncryptToKey, recipient); err != nil {
+		t.Fatal(err)
+	}
+	r := request.New("user@example.com", nil, repository.TestReviewRef, repository.TestTargetRef, "private request")
+	r.Timestamp = "9999999999"
+	if err := r.Encrypt(repo); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := r.SigningPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Signature, err = repo.SignPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	note, err := r.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(request.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	c := comment.New("user@example.com", "private comment")
+	c.Timestamp = "9999999999"
+	if err := c.Encrypt(repo); err != nil {
+		t.Fatal(err)
+	}
+	if note, err = c.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedReview(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	addEncryptedReview(t, repo, "user@example.com")
+	summary, err := GetSummary(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary.VerifySignatures()
+	if summary.Request.Description != "private request" || !summary.RequestVerified {
+		t.Errorf("expected the request to be decrypted and verified, got %+v", summary.Request)
+	}
+	if len(summary.Comments) != 1 || summary.Comments[0].Comment.Description != "private comment" {
+		t.Errorf("expected the comment to be decrypted, got %+v", summary.Comments)
+	}
+	for _, listed := range ListAll(repo) {
+		if listed.Revision == repository.TestCommitG && listed.Request.Description != "private request" {
+			t.Errorf("expected the listed request to be decrypted, got %+v", listed.Request)
+		}
+	}
+
+	// Writing the request back, e.g. when abandoning the review, does not
+	// write the plaintext.
+	note, err := summary.Request.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(note), "private request") {
+		t.Errorf("expected the description not to be written, got %q", note)
+	}
+
+	repo = repository.NewMockRepoForTest()
+	addEncryptedReview(t, repo, "other@example.com")
+	summary, err = GetSummary(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary.VerifySignatures()
+	if summary.Request.Description != EncryptedDescription || !summary.RequestVerified {
+		t.Errorf("expected the request to be shown as encrypted, got %+v", summary.Request)
+	}
+	if len(summary.Comments) != 1 || summary.Comments[0].Comment.Description != EncryptedDescription {
+		t.Errorf("expected the comment to be shown as encrypted, got %+v", summary.Comments)
+	}
+}
+
 func TestListCommits(t *testing.T) {
 	repo := repository.NewMockRepoForTest()
 	review, err := Get(repo, repository.TestCommitG)
@@ -1762,13 +2031,11 @@ func TestRebaseArchiveGetHeadError(t *testing.T) {
 	}
 }
 
-func TestUnsortedListAllGetAllNotesError(t *testing.T) {
-	// The mock repo won't naturally error on GetAllNotes, but we can verify
-	// it returns results in the normal case
+func TestUnsortedListAll(t *testing.T) {
 	repo := repository.NewMockRepoForTest()
-	reviews := unsortedListAll(repo)
-	if len(reviews) != 3 {
-		t.Fatalf("expected 3 reviews, got %d", len(reviews))
+	reviews, err := unsortedListAll(repo)
+	if err != nil || len(reviews) != 3 {
+		t.Fatalf("expected 3 reviews, got %d, %v", len(reviews), err)
 	}
 }
 
@@ -2061,29 +2328,46 @@ func TestFindLastCommitTimestampNotLater(t *testing.T) {
 
 // --- Error path tests using errorRepo ---
 
-func TestUnsortedListAllGetAllNotesRequestError(t *testing.T) {
+func TestUnsortedListAllGetNotesCommitRequestError(t *testing.T) {
 	repo := &errorRepo{
 		Repo: repository.NewMockRepoForTest(),
-		getAllNotesErr: map[string]error{
+		getNotesCommitErr: map[string]error{
 			request.Ref: fmt.Errorf("notes error"),
 		},
 	}
-	reviews := unsortedListAll(repo)
-	if reviews != nil {
-		t.Fatalf("expected nil reviews on GetAllNotes error, got %d", len(reviews))
+	reviews, err := unsortedListAll(repo)
+	if reviews != nil || err == nil {
+		t.Fatalf("expected an error and nil reviews on GetNotesCommit error, got %d, %v", len(reviews), err)
+	}
+	if reviews, err := List(repo); reviews != nil || err == nil {
+		t.Fatalf("expected an error listing reviews, got %d, %v", len(reviews), err)
+	}
+	if reviews := ListAll(repo); reviews != nil {
+		t.Fatalf("expected nil reviews, got %d", len(reviews))
 	}
 }
 
-func TestUnsortedListAllGetAllNotesCommentError(t *testing.T) {
+func TestUnsortedListAllGetNotesCommitCommentError(t *testing.T) {
 	repo := &errorRepo{
 		Repo: repository.NewMockRepoForTest(),
-		getAllNotesErr: map[string]error{
+		getNotesCommitErr: map[string]error{
 			comment.Ref: fmt.Errorf("comment notes error"),
 		},
 	}
-	reviews := unsortedListAll(repo)
-	if reviews != nil {
-		t.Fatalf("expected nil reviews on GetAllNotes comment error, got %d", len(reviews))
+	reviews, err := unsortedListAll(repo)
+	if reviews != nil || err == nil {
+		t.Fatalf("expected an error and nil reviews on GetNotesCommit comment error, got %d, %v", len(reviews), err)
+	}
+}
+
+func TestUnsortedListAllNotesError(t *testing.T) {
+	repo := &errorRepo{
+		Repo:     repository.NewMockRepoForTest(),
+		notesErr: fmt.Errorf("notes error"),
+	}
+	reviews, err := unsortedListAll(repo)
+	if reviews != nil || err == nil {
+		t.Fatalf("expected an error and nil reviews on Notes error, got %d, %v", len(reviews), err)
 	}
 }
 
@@ -2094,7 +2378,7 @@ func TestUnsortedListAllInvalidRequestNotes(t *testing.T) {
 	if err := repo.AppendNote(request.Ref, repository.TestCommitA, repository.Note("not valid json")); err != nil {
 		t.Fatal(err)
 	}
-	reviews := unsortedListAll(repo)
+	reviews, _ := unsortedListAll(repo)
 	// Should still return the 3 valid reviews (B, D, G), skipping A
 	if len(reviews) != 3 {
 		t.Fatalf("expected 3 reviews (skipping invalid), got %d", len(reviews))
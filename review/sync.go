@@ -0,0 +1,258 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"sort"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// Status strings used when describing how a review would change during a sync.
+const (
+	StatusPending   = "pending"
+	StatusAccepted  = "accepted"
+	StatusRejected  = "rejected"
+	StatusAbandoned = "abandoned"
+)
+
+// ReviewChange describes how a single review would change if the notes from
+// one side of a sync were merged into the other side.
+type ReviewChange struct {
+	Revision    string `json:"revision"`
+	Description string `json:"description,omitempty"`
+	// New indicates that the review does not yet exist on the receiving side.
+	New bool `json:"new,omitempty"`
+	// Requests is the number of review requests (e.g. updates to the
+	// description or the target ref) that would be added.
+	Requests int `json:"requests,omitempty"`
+	// Comments holds the hashes of the comments that would be added.
+	Comments []string `json:"comments,omitempty"`
+	// OldStatus and NewStatus are only set when the status of the review
+	// would change. OldStatus is empty for new reviews.
+	OldStatus string `json:"oldStatus,omitempty"`
+	NewStatus string `json:"newStatus,omitempty"`
+}
+
+// SyncStatus describes the differences between the local review metadata and
+// the most recently fetched review metadata of a remote.
+//
+// Incoming changes are the ones that a pull would merge into the local repo,
+// while outgoing changes are the ones that a push would send to the remote.
+type SyncStatus struct {
+	Remote   string         `json:"remote"`
+	Incoming []ReviewChange `json:"incoming,omitempty"`
+	Outgoing []ReviewChange `json:"outgoing,omitempty"`
+	// IncomingArchives and OutgoingArchives are the number of archived
+	// commits that are only reachable from the remote or local archive.
+	IncomingArchives int `json:"incomingArchives,omitempty"`
+	OutgoingArchives int `json:"outgoingArchives,omitempty"`
+}
+
+// InSync returns whether or not there are any differences between the two sides.
+func (s *SyncStatus) InSync() bool {
+	return len(s.Incoming) == 0 && len(s.Outgoing) == 0 &&
+		s.IncomingArchives == 0 && s.OutgoingArchives == 0
+}
+
+// syncStatusString returns the status of a review as far as it can be
+// determined from the notes alone.
+func syncStatusString(s *Summary) string {
+	if s.IsAbandoned() {
+		return StatusAbandoned
+	}
+	if s.Resolved == nil {
+		return StatusPending
+	}
+	if *s.Resolved {
+		return StatusAccepted
+	}
+	return StatusRejected
+}
+
+// mergeNoteLists combines two lists of notes the same way that pulling
+// does: notes that only exist on one side are kept as-is, and everything
+// else is merged using the "cat_sort_uniq" strategy.
+func mergeNoteLists(a, b []repository.Note) []repository.Note {
+	if len(b) == 0 || slices.EqualFunc(a, b, func(x, y repository.Note) bool { return bytes.Equal(x, y) }) {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	lines := make(map[string]struct{})
+	for _, notes := range [][]repository.Note{a, b} {
+		for _, note := range notes {
+			if len(note) > 0 {
+				lines[string(note)] = struct{}{}
+			}
+		}
+	}
+	var merged []repository.Note
+	for _, line := range slices.Sorted(maps.Keys(lines)) {
+		merged = append(merged, repository.Note(line))
+	}
+	return merged
+}
+
+// countNewRequests returns the number of valid review requests in the
+// incoming notes that are not already present in the existing notes.
+func countNewRequests(existing, incoming []repository.Note) int {
+	existingSet := make(map[string]struct{})
+	for _, note := range existing {
+		existingSet[string(note)] = struct{}{}
+	}
+	count := 0
+	for _, note := range incoming {
+		if _, ok := existingSet[string(note)]; ok {
+			continue
+		}
+		existingSet[string(note)] = struct{}{}
+		if len(request.ParseAllValid([]repository.Note{note})) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// diffReviews computes the changes that merging the notes from the "incoming"
+// side into the "existing" side would make to each review.
+func diffReviews(repo repository.Repo, existingRequests, existingComments, incomingRequests, incomingComments map[string][]repository.Note) []ReviewChange {
+	revisions := make(map[string]struct{})
+	for revision := range incomingRequests {
+		revisions[revision] = struct{}{}
+	}
+	for revision := range incomingComments {
+		revisions[revision] = struct{}{}
+	}
+
+	var changes []ReviewChange
+	timestamps := make(map[string]string)
+	for revision := range revisions {
+		requests := countNewRequests(existingRequests[revision], incomingRequests[revision])
+		existingHashes := comment.ParseAllValid(existingComments[revision])
+		var newComments []string
+		for hash := range comment.ParseAllValid(incomingComments[revision]) {
+			if _, ok := existingHashes[hash]; !ok {
+				newComments = append(newComments, hash)
+			}
+		}
+		if requests == 0 && len(newComments) == 0 {
+			continue
+		}
+		merged, err := getSummaryFromNotes(repo, revision,
+			mergeNoteLists(existingRequests[revision], incomingRequests[revision]),
+			mergeNoteLists(existingComments[revision], incomingComments[revision]))
+		if err != nil {
+			// These are comments on something other than a review (e.g. detached comments).
+			continue
+		}
+		sort.Strings(newComments)
+		change := ReviewChange{
+			Revision:    revision,
+			Description: merged.Request.Description,
+			Requests:    requests,
+			Comments:    newComments,
+		}
+		newStatus := syncStatusString(merged)
+		if existing, err := getSummaryFromNotes(repo, revision, existingRequests[revision], existingComments[revision]); err != nil {
+			change.New = true
+			change.NewStatus = newStatus
+		} else if oldStatus := syncStatusString(existing); oldStatus != newStatus {
+			change.OldStatus = oldStatus
+			change.NewStatus = newStatus
+		}
+		timestamps[revision] = merged.Request.Timestamp
+		changes = append(changes, change)
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		ti, tj := timestamps[changes[i].Revision], timestamps[changes[j].Revision]
+		if ti != tj {
+			return ti > tj
+		}
+		return changes[i].Revision < changes[j].Revision
+	})
+	return changes
+}
+
+// countArchivedOnlyIn returns the number of commits reachable from the
+// archive ref "to" that are not reachable from the archive ref "from".
+func countArchivedOnlyIn(repo repository.Repo, from, to string) (int, error) {
+	toHash, err := repo.GetCommitHash(to)
+	if err != nil {
+		return 0, nil
+	}
+	fromHash, err := repo.GetCommitHash(from)
+	if err != nil {
+		return len(repo.ListCommits(toHash)), nil
+	}
+	if fromHash == toHash {
+		return 0, nil
+	}
+	commits, err := repo.ListCommitsBetween(fromHash, toHash)
+	if err != nil {
+		return 0, err
+	}
+	return len(commits), nil
+}
+
+// GetSyncStatus compares the local review metadata with the copy of the given
+// remote's review metadata that was most recently fetched.
+//
+// This does not fetch anything from the remote, nor merge anything into the
+// local refs. Callers that want an up-to-date comparison should first fetch
+// the remote refs using FetchAndReturnNewReviewHashes.
+func GetSyncStatus(repo repository.Repo, remote string) (*SyncStatus, error) {
+	localRequests, err := repo.GetAllNotes(request.Ref)
+	if err != nil {
+		return nil, err
+	}
+	localComments, err := repo.GetAllNotes(comment.Ref)
+	if err != nil {
+		return nil, err
+	}
+	remoteRequests, err := repo.GetAllNotes(repository.RemoteNotesRef(remote, request.Ref))
+	if err != nil {
+		return nil, err
+	}
+	remoteComments, err := repo.GetAllNotes(repository.RemoteNotesRef(remote, comment.Ref))
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SyncStatus{
+		Remote:   remote,
+		Incoming: diffReviews(repo, localRequests, localComments, remoteRequests, remoteComments),
+		Outgoing: diffReviews(repo, remoteRequests, remoteComments, localRequests, localComments),
+	}
+
+	remoteArchive := repository.RemoteDevtoolsRef(remote, archiveRef)
+	status.IncomingArchives, err = countArchivedOnlyIn(repo, archiveRef, remoteArchive)
+	if err != nil {
+		return nil, err
+	}
+	status.OutgoingArchives, err = countArchivedOnlyIn(repo, remoteArchive, archiveRef)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+	"testing"
+
+	"msrl.dev/git-appraise/repository"
+	"msrl.dev/git-appraise/review/comment"
+	"msrl.dev/git-appraise/review/request"
+)
+
+// copyNotesToRemote mirrors the local review notes into the remote-tracking
+// notes refs, as if they had just been pushed and fetched back.
+func copyNotesToRemote(t *testing.T, repo repository.Repo, remote string) {
+	t.Helper()
+	for _, ref := range []string{request.Ref, comment.Ref} {
+		notesMap, err := repo.GetAllNotes(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for revision, notes := range notesMap {
+			for _, note := range notes {
+				if err := repo.AppendNote(repository.RemoteNotesRef(remote, ref), revision, note); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestGetSyncStatusNothingFetched(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Remote != "origin" {
+		t.Errorf("unexpected remote %q", status.Remote)
+	}
+	if len(status.Incoming) != 0 {
+		t.Errorf("unexpected incoming changes: %+v", status.Incoming)
+	}
+	if len(status.Outgoing) != 3 {
+		t.Fatalf("expected 3 outgoing reviews, got %+v", status.Outgoing)
+	}
+	// Newest review first.
+	if status.Outgoing[0].Revision != repository.TestCommitG {
+		t.Errorf("expected the newest review first, got %q", status.Outgoing[0].Revision)
+	}
+	for _, change := range status.Outgoing {
+		if !change.New {
+			t.Errorf("expected review %q to be new", change.Revision)
+		}
+		if change.OldStatus != "" || change.NewStatus == "" {
+			t.Errorf("unexpected status change for a new review: %+v", change)
+		}
+	}
+	if status.Outgoing[0].Description != "Final description of G" {
+		t.Errorf("unexpected description %q", status.Outgoing[0].Description)
+	}
+	if status.InSync() {
+		t.Error("expected the repo to be out of sync")
+	}
+}
+
+func TestGetSyncStatusInSync(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	copyNotesToRemote(t, repo, "origin")
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.InSync() {
+		t.Errorf("expected the repo to be in sync, got %+v", status)
+	}
+}
+
+func TestGetSyncStatusIncomingAccept(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	copyNotesToRemote(t, repo, "origin")
+	resolved := true
+	c := comment.New("reviewer@example.com", "LGTM")
+	c.Timestamp = "0000000010"
+	c.Resolved = &resolved
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(repository.RemoteNotesRef("origin", comment.Ref), repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Outgoing) != 0 {
+		t.Errorf("unexpected outgoing changes: %+v", status.Outgoing)
+	}
+	if len(status.Incoming) != 1 {
+		t.Fatalf("expected one incoming change, got %+v", status.Incoming)
+	}
+	change := status.Incoming[0]
+	hash, _ := c.Hash()
+	if change.New || change.Requests != 0 || len(change.Comments) != 1 || change.Comments[0] != hash {
+		t.Errorf("unexpected change: %+v", change)
+	}
+	if change.OldStatus != StatusPending || change.NewStatus != StatusAccepted {
+		t.Errorf("unexpected status change %q -> %q", change.OldStatus, change.NewStatus)
+	}
+}
+
+func TestGetSyncStatusOutgoingAbandon(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	copyNotesToRemote(t, repo, "origin")
+	r := request.Request{Timestamp: "0000000010", Description: "abandoned"}
+	note, err := r.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(request.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	rejected := false
+	c := comment.New("reviewer@example.com", "No")
+	c.Timestamp = "0000000011"
+	c.Resolved = &rejected
+	commentNote, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitB, commentNote); err != nil {
+		t.Fatal(err)
+	}
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Incoming) != 0 {
+		t.Errorf("unexpected incoming changes: %+v", status.Incoming)
+	}
+	if len(status.Outgoing) != 2 {
+		t.Fatalf("expected two outgoing changes, got %+v", status.Outgoing)
+	}
+	abandoned := status.Outgoing[0]
+	if abandoned.Revision != repository.TestCommitG || abandoned.Requests != 1 || len(abandoned.Comments) != 0 {
+		t.Errorf("unexpected change: %+v", abandoned)
+	}
+	if abandoned.OldStatus != StatusPending || abandoned.NewStatus != StatusAbandoned {
+		t.Errorf("unexpected status change %q -> %q", abandoned.OldStatus, abandoned.NewStatus)
+	}
+	rejectedChange := status.Outgoing[1]
+	if rejectedChange.Revision != repository.TestCommitB || rejectedChange.NewStatus != StatusRejected {
+		t.Errorf("unexpected change: %+v", rejectedChange)
+	}
+}
+
+func TestGetSyncStatusCommentWithoutStatusChange(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	copyNotesToRemote(t, repo, "origin")
+	c := comment.New("reviewer@example.com", "FYI")
+	c.Timestamp = "0000000010"
+	note, _ := c.Write()
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Outgoing) != 1 {
+		t.Fatalf("expected one outgoing change, got %+v", status.Outgoing)
+	}
+	if change := status.Outgoing[0]; change.OldStatus != "" || change.NewStatus != "" || len(change.Comments) != 1 {
+		t.Errorf("unexpected change: %+v", change)
+	}
+}
+
+func TestGetSyncStatusIgnoresDetachedComments(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	copyNotesToRemote(t, repo, "origin")
+	c := comment.New("reviewer@example.com", "detached")
+	c.Location = &comment.Location{Path: "foo.txt"}
+	if err := AddDetachedComment(repo, &c); err != nil {
+		t.Fatal(err)
+	}
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Outgoing) != 0 {
+		t.Errorf("unexpected outgoing changes: %+v", status.Outgoing)
+	}
+	// The detached comment's well-known commit is archived locally.
+	if status.OutgoingArchives != 2 || status.IncomingArchives != 0 {
+		t.Errorf("unexpected archive counts: %d incoming, %d outgoing", status.IncomingArchives, status.OutgoingArchives)
+	}
+}
+
+func TestGetSyncStatusArchives(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	copyNotesToRemote(t, repo, "origin")
+	remoteArchive := repository.RemoteDevtoolsRef("origin", archiveRef)
+	if err := repo.ArchiveRef(repository.TestCommitG, remoteArchive); err != nil {
+		t.Fatal(err)
+	}
+	status, err := GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archive commit plus G, E, D, B, C, and A.
+	if status.IncomingArchives != 7 || status.OutgoingArchives != 0 {
+		t.Errorf("unexpected archive counts: %d incoming, %d outgoing", status.IncomingArchives, status.OutgoingArchives)
+	}
+
+	remoteHash, err := repo.GetCommitHash(remoteArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef(archiveRef, remoteHash, ""); err != nil {
+		t.Fatal(err)
+	}
+	status, err = GetSyncStatus(repo, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.InSync() {
+		t.Errorf("expected the archives to be in sync, got %+v", status)
+	}
+}
+
+func TestGetSyncStatusArchivesListCommitsBetweenError(t *testing.T) {
+	repo := &errCommitsBetweenRepo{Repo: repository.NewMockRepoForTest()}
+	if err := repo.ArchiveRef(repository.TestCommitG, archiveRef); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ArchiveRef(repository.TestCommitJ, repository.RemoteDevtoolsRef("origin", archiveRef)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetSyncStatus(repo, "origin"); err == nil {
+		t.Error("expected an error from ListCommitsBetween")
+	}
+}
+
+type errCommitsBetweenRepo struct {
+	repository.Repo
+}
+
+func (r *errCommitsBetweenRepo) ListCommitsBetween(from, to string) ([]string, error) {
+	return nil, fmt.Errorf("list commits failed")
+}
+
+func TestGetSyncStatusGetAllNotesErrors(t *testing.T) {
+	for _, ref := range []string{
+		request.Ref,
+		comment.Ref,
+		repository.RemoteNotesRef("origin", request.Ref),
+		repository.RemoteNotesRef("origin", comment.Ref),
+	} {
+		repo := &errorRepo{
+			Repo:           repository.NewMockRepoForTest(),
+			getAllNotesErr: map[string]error{ref: fmt.Errorf("read failed")},
+		}
+		if _, err := GetSyncStatus(repo, "origin"); err == nil {
+			t.Errorf("expected an error when reading %q fails", ref)
+		}
+	}
+}
+
+func TestMergeNoteListsOneSided(t *testing.T) {
+	notes := []repository.Note{repository.Note("b"), repository.Note("a")}
+	if merged := mergeNoteLists(notes, nil); len(merged) != 2 || string(merged[0]) != "b" {
+		t.Errorf("unexpected merged notes: %q", merged)
+	}
+	if merged := mergeNoteLists(nil, notes); len(merged) != 2 || string(merged[0]) != "b" {
+		t.Errorf("unexpected merged notes: %q", merged)
+	}
+	if merged := mergeNoteLists(notes, notes); len(merged) != 2 || string(merged[0]) != "b" {
+		t.Errorf("unexpected merged notes: %q", merged)
+	}
+}
+
+func TestMergeNoteLists(t *testing.T) {
+	merged := mergeNoteLists(
+		[]repository.Note{repository.Note("b"), repository.Note(""), repository.Note("a")},
+		[]repository.Note{repository.Note("c"), repository.Note("a")})
+	if len(merged) != 3 || string(merged[0]) != "a" || string(merged[1]) != "b" || string(merged[2]) != "c" {
+		t.Errorf("unexpected merged notes: %q", merged)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema validates git-notes against the JSON schemas of the
+// git-appraise metadata formats.
+//
+// Only the subset of JSON Schema (draft 4) used by the schemas in this
+// directory is supported.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// The names of the schemas for each of the metadata formats.
+const (
+	Request  = "request.json"
+	Comment  = "comment.json"
+	CI       = "ci.json"
+	Analysis = "analysis.json"
+)
+
+//go:embed *.json
+var files embed.FS
+
+// Test seam; not safe for t.Parallel().
+var readSchema = files.ReadFile
+
+// Validate checks that a single JSON value (e.g. one line of a git note)
+// conforms to the named schema.
+func Validate(name string, data []byte) error {
+	contents, err := readSchema(name)
+	if err != nil {
+		return fmt.Errorf("unknown schema %q", name)
+	}
+	var root map[string]any
+	if err := json.Unmarshal(contents, &root); err != nil {
+		return fmt.Errorf("invalid schema %q: %v", name, err)
+	}
+	value, err := decode(data)
+	if err != nil {
+		return err
+	}
+	return validate(root, root, value, "")
+}
+
+// decode parses JSON, keeping numbers as json.Number so that integers can be
+// told apart from other numbers.
+func decode(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return value, nil
+}
+
+// describe returns the path of a value for use in error messages.
+func describe(path string) string {
+	if path == "" {
+		return "the note"
+	}
+	return fmt.Sprintf("%q", path)
+}
+
+// typeMatches returns whether a decoded JSON value has the given schema type.
+func typeMatches(schemaType string, value any) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+// equal compares a decoded JSON value against an enum entry from a schema.
+func equal(schemaValue, value any) bool {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && schemaValue == f
+	}
+	return schemaValue == value
+}
+
+// resolve follows a local "$ref" of the form "#/definitions/<name>".
+func resolve(root map[string]any, ref string) (map[string]any, error) {
+	name, ok := strings.CutPrefix(ref, "#/definitions/")
+	if !ok {
+		return nil, fmt.Errorf("unsupported schema reference %q", ref)
+	}
+	definitions, _ := root["definitions"].(map[string]any)
+	definition, ok := definitions[name].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unknown schema reference %q", ref)
+	}
+	return definition, nil
+}
+
+func validate(root, s map[string]any, value any, path string) error {
+	if ref, ok := s["$ref"].(string); ok {
+		definition, err := resolve(root, ref)
+		if err != nil {
+			return err
+		}
+		return validate(root, definition, value, path)
+	}
+	if schemaType, ok := s["type"].(string); ok && !typeMatches(schemaType, value) {
+		return fmt.Errorf("%s must be of type %s", describe(path), schemaType)
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		if !slices.ContainsFunc(enum, func(e any) bool { return equal(e, value) }) {
+			return fmt.Errorf("%s must be one of %v", describe(path), enum)
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		matches := 0
+		for _, option := range oneOf {
+			if optionSchema, ok := option.(map[string]any); ok && validate(root, optionSchema, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s must match exactly one of the allowed schemas", describe(path))
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		if minLength, ok := s["minLength"].(float64); ok && utf8.RuneCountInString(v) < int(minLength) {
+			return fmt.Errorf("%s must be at least %d characters long", describe(path), int(minLength))
+		}
+		if maxLength, ok := s["maxLength"].(float64); ok && utf8.RuneCountInString(v) > int(maxLength) {
+			return fmt.Errorf("%s must be at most %d characters long", describe(path), int(maxLength))
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid schema pattern %q: %v", pattern, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s must match the pattern %q", describe(path), pattern)
+			}
+		}
+	case []any:
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validate(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		if required, ok := s["required"].([]any); ok {
+			for _, field := range required {
+				name, _ := field.(string)
+				if _, ok := v[name]; !ok {
+					return fmt.Errorf("%s is missing the required field %q", describe(path), name)
+				}
+			}
+		}
+		properties, _ := s["properties"].(map[string]any)
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			propertySchema, ok := properties[name].(map[string]any)
+			if !ok {
+				continue
+			}
+			propertyPath := name
+			if path != "" {
+				propertyPath = path + "." + name
+			}
+			if err := validate(root, propertySchema, v[name], propertyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
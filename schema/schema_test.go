@@ -0,0 +1,127 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateValid(t *testing.T) {
+	for name, notes := range map[string][]string{
+		Request: {
+			`{"timestamp":"0000000001","requester":"ojarjur","reviewers":["a","b"],"v":0}`,
+			`{"timestamp":"0000000002","requester":"ojarjur","targetRef":"refs/heads/master","alias":"abc"}`,
+		},
+		Comment: {
+			`{"timestamp":"0000000001","author":"ojarjur","description":"LGTM","resolved":true}`,
+			`{"timestamp":"0000000002","author":"ojarjur","location":{"commit":"abc","path":"foo","range":{"startLine":1,"endLine":2}},"unknown":1}`,
+		},
+		CI: {
+			`{"timestamp":"0000000001","agent":"ci","status":"success"}`,
+		},
+		Analysis: {
+			`{"timestamp":"0000000001","url":"https://example.com","status":"lgtm"}`,
+		},
+	} {
+		for _, note := range notes {
+			if err := Validate(name, []byte(note)); err != nil {
+				t.Errorf("Validate(%q, %q): unexpected error %v", name, note, err)
+			}
+		}
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		note string
+	}{
+		{Request, `not json`},
+		{Request, `{"timestamp":"0000000001","requester":"a"} {}`},
+		{Request, `[]`},
+		{Request, `{"timestamp":"0000000001"}`},
+		{Request, `{"timestamp":"1","requester":"a"}`},
+		{Request, `{"timestamp":"00000000001","requester":"a"}`},
+		{Request, `{"timestamp":"abcdefghij","requester":"a"}`},
+		{Request, `{"timestamp":"0000000001","requester":"a","reviewers":["a",1]}`},
+		{Request, `{"timestamp":"0000000001","requester":"a","v":1}`},
+		{Request, `{"timestamp":"0000000001","requester":"a","v":0.5}`},
+		{Request, `{"timestamp":"0000000001","requester":"a","v":"0"}`},
+		{Comment, `{"timestamp":"0000000001","author":"a","resolved":"yes"}`},
+		{Comment, `{"timestamp":"0000000001","author":"a","location":{"range":{"startLine":"1"}}}`},
+		{CI, `{"timestamp":"0000000001","agent":"ci","status":"maybe"}`},
+		{Analysis, `{"timestamp":"0000000001","url":"u","status":"bad"}`},
+		{Analysis, `{"timestamp":"0000000001","url":"u","status":1}`},
+		{"missing.json", `{}`},
+	} {
+		if err := Validate(test.name, []byte(test.note)); err == nil {
+			t.Errorf("Validate(%q, %q): expected an error", test.name, test.note)
+		}
+	}
+}
+
+func TestValidateInvalidSchema(t *testing.T) {
+	orig := readSchema
+	defer func() { readSchema = orig }()
+	readSchema = func(string) ([]byte, error) { return []byte("not json"), nil }
+	if err := Validate(Request, []byte("{}")); err == nil {
+		t.Error("expected an error for an invalid schema")
+	}
+}
+
+func TestValidateUnsupportedSchemas(t *testing.T) {
+	for _, s := range []string{
+		`{"$ref":"http://example.com/schema"}`,
+		`{"$ref":"#/definitions/missing"}`,
+		`{"type":"string","pattern":"("}`,
+	} {
+		var root map[string]any
+		if err := json.Unmarshal([]byte(s), &root); err != nil {
+			t.Fatal(err)
+		}
+		if err := validate(root, root, "value", ""); err == nil {
+			t.Errorf("expected an error for the schema %s", s)
+		}
+	}
+}
+
+func TestTypeMatches(t *testing.T) {
+	for _, test := range []struct {
+		schemaType string
+		value      any
+		want       bool
+	}{
+		{"null", nil, true},
+		{"null", "", false},
+		{"number", json.Number("1.5"), true},
+		{"number", "1.5", false},
+		{"integer", "1", false},
+		{"array", []any{}, true},
+		{"unknown", "", false},
+	} {
+		if got := typeMatches(test.schemaType, test.value); got != test.want {
+			t.Errorf("typeMatches(%q, %v) = %v, want %v", test.schemaType, test.value, got, test.want)
+		}
+	}
+}
+
+func TestEqualLargeNumber(t *testing.T) {
+	if equal(float64(1), json.Number("1e999")) {
+		t.Error("expected an out of range number not to match")
+	}
+}
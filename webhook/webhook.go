@@ -0,0 +1,297 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook sends the events of changes to the reviews in a repo to
+// webhooks, such as those of CI systems or chat bots.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+)
+
+const (
+	// URLKey is the git config setting for the URLs to which events are
+	// posted. It may be set multiple times.
+	URLKey = "appraise.webhook"
+
+	// SecretKey is the git config setting for the secret with which the
+	// bodies of the posted events are signed.
+	SecretKey = "appraise.webhookSecret"
+
+	// EventHeader is the HTTP header that holds the type of a posted event.
+	EventHeader = "X-Appraise-Event"
+	// DeliveryHeader is the HTTP header that holds the ID of a posted event.
+	DeliveryHeader = "X-Appraise-Delivery"
+	// SignatureHeader is the HTTP header that holds "sha256=" followed by
+	// the hex-encoded HMAC-SHA256 of the body of a posted event, keyed by
+	// the configured secret. It is omitted if there is no secret.
+	SignatureHeader = "X-Appraise-Signature"
+
+	// QueueFile is the name of the file, in the repo's data directory, that
+	// holds the deliveries of events that have yet to succeed.
+	QueueFile = "appraise-webhooks.json"
+	// queueLockSuffix is appended to the path of the queue file to get that
+	// of the lock that is held while the queue file is rewritten.
+	queueLockSuffix = ".lock"
+
+	// maxAttempts is the number of times that delivering an event is
+	// attempted before giving up on it.
+	maxAttempts = 10
+	// maxRetryDelay is the longest time to wait before retrying a delivery.
+	maxRetryDelay = 2 * time.Hour
+)
+
+// delivery is the pending delivery of an event to a single URL.
+type delivery struct {
+	URL         string       `json:"url"`
+	Event       events.Event `json:"event"`
+	Attempts    int          `json:"attempts,omitempty"`
+	NextAttempt time.Time    `json:"nextAttempt"`
+}
+
+// Dispatcher posts events to webhooks, and keeps the deliveries that fail in
+// a queue file so that they are retried later.
+type Dispatcher struct {
+	URLs      []string
+	Secret    string
+	QueuePath string
+	Client    *http.Client
+}
+
+// NewDispatcher returns a dispatcher for the webhooks configured in the given
+// repo, or nil if there are none.
+func NewDispatcher(repo repository.Repo) (*Dispatcher, error) {
+	urls, err := repo.GetConfigValues(URLKey)
+	if err != nil || len(urls) == 0 {
+		return nil, err
+	}
+	secrets, err := repo.GetConfigValues(SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	dataDir, err := repo.GetDataDir()
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		URLs:      urls,
+		QueuePath: filepath.Join(dataDir, QueueFile),
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(secrets) > 0 {
+		d.Secret = secrets[len(secrets)-1]
+	}
+	return d, nil
+}
+
+// retryDelay returns the time to wait before retrying a delivery that has
+// failed the given number of times.
+func retryDelay(attempts int) time.Duration {
+	return min(time.Minute<<(attempts-1), maxRetryDelay)
+}
+
+// permanentError is an error delivering an event that retrying cannot fix.
+type permanentError struct {
+	error
+}
+
+// Sign returns the value of the SignatureHeader for the given body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post posts a single event to a URL.
+func (d *Dispatcher) post(url string, event events.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(DeliveryHeader, event.ID)
+	if d.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(d.Secret, body))
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s", resp.Status)
+	default:
+		return permanentError{fmt.Errorf("%s", resp.Status)}
+	}
+}
+
+// readQueue reads the pending deliveries from the queue file.
+func (d *Dispatcher) readQueue() ([]delivery, error) {
+	contents, err := os.ReadFile(d.QueuePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var queue []delivery
+	if err := json.Unmarshal(contents, &queue); err != nil {
+		return nil, fmt.Errorf("failed to read the webhook queue %q: %v", d.QueuePath, err)
+	}
+	return queue, nil
+}
+
+// writeQueue replaces the contents of the queue file with the given
+// deliveries, or removes the file if there are none.
+func (d *Dispatcher) writeQueue(queue []delivery) error {
+	if len(queue) == 0 {
+		if err := os.Remove(d.QueuePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	contents, err := json.MarshalIndent(queue, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.QueuePath), filepath.Base(d.QueuePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.QueuePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// updateQueue replaces the contents of the queue file with the result of the
+// given function, which is passed its current contents. Other processes that
+// dispatch events for the same repo wait to update the queue until it is
+// done.
+func (d *Dispatcher) updateQueue(update func([]delivery) []delivery) error {
+	unlock, err := repository.LockFile(context.Background(), d.QueuePath+queueLockSuffix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	queue, err := d.readQueue()
+	if err != nil {
+		return err
+	}
+	return d.writeQueue(update(queue))
+}
+
+// deliveryKey identifies the delivery of an event to a URL.
+func deliveryKey(dl delivery) string {
+	return dl.URL + "\x00" + dl.Event.ID
+}
+
+// Dispatch posts the given events to each of the webhooks, along with any
+// earlier deliveries from the queue that are due to be retried.
+//
+// Deliveries that fail are kept in the queue and retried with exponential
+// backoff, unless the webhook rejected them or they have failed too many
+// times. While a delivery to a URL waits to be retried, the later ones to it
+// wait as well, so that their order is kept. The returned error
+// describes every delivery that failed.
+//
+// Deliveries that other processes queue in the meantime are kept. If another
+// process retries the same delivery at the same time, then the event may be
+// delivered twice, but it keeps the same ID.
+func (d *Dispatcher) Dispatch(evs []events.Event) error {
+	queue, err := d.readQueue()
+	if err != nil {
+		return err
+	}
+	attempted := make(map[string]bool)
+	for _, dl := range queue {
+		attempted[deliveryKey(dl)] = true
+	}
+	now := time.Now()
+	for _, event := range evs {
+		for _, url := range d.URLs {
+			queue = append(queue, delivery{URL: url, Event: event, NextAttempt: now})
+		}
+	}
+	var pending []delivery
+	var errs []error
+	unavailable := make(map[string]bool)
+	for _, dl := range queue {
+		if unavailable[dl.URL] || dl.NextAttempt.After(now) {
+			unavailable[dl.URL] = true
+			pending = append(pending, dl)
+			continue
+		}
+		err := d.post(dl.URL, dl.Event)
+		if err == nil {
+			continue
+		}
+		dl.Attempts++
+		var permanent permanentError
+		if errors.As(err, &permanent) || dl.Attempts >= maxAttempts {
+			errs = append(errs, fmt.Errorf("gave up delivering the %s event %s to %s: %v", dl.Event.Type, dl.Event.ID, dl.URL, err))
+			continue
+		}
+		unavailable[dl.URL] = true
+		dl.NextAttempt = now.Add(retryDelay(dl.Attempts))
+		pending = append(pending, dl)
+		errs = append(errs, fmt.Errorf("failed to deliver the %s event %s to %s, and will retry after %s: %v", dl.Event.Type, dl.Event.ID, dl.URL, dl.NextAttempt.Format(time.RFC3339), err))
+	}
+	if len(queue) == 0 {
+		// Nothing was queued, so there is nothing to update.
+		return errors.Join(errs...)
+	}
+	err = d.updateQueue(func(current []delivery) []delivery {
+		for _, dl := range current {
+			if !attempted[deliveryKey(dl)] {
+				pending = append(pending, dl)
+			}
+		}
+		return pending
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"msrl.dev/git-appraise/events"
+	"msrl.dev/git-appraise/repository"
+)
+
+// configRepo is a repo whose config cannot be read for a single key, or
+// whose data directory cannot be found.
+type configRepo struct {
+	repository.Repo
+	badKey string
+}
+
+func (r configRepo) GetConfigValues(key string) ([]string, error) {
+	if key == r.badKey {
+		return nil, errors.New("cannot read config")
+	}
+	return r.Repo.GetConfigValues(key)
+}
+
+func (r configRepo) GetDataDir() (string, error) {
+	if r.badKey == "" {
+		return "", errors.New("no data dir")
+	}
+	return r.Repo.GetDataDir()
+}
+
+func TestNewDispatcher(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if d, err := NewDispatcher(repo); d != nil || err != nil {
+		t.Errorf("NewDispatcher() without webhooks = %v, %v", d, err)
+	}
+	repo.AddConfigValue(URLKey, "https://example.com/a")
+	repo.AddConfigValue(URLKey, "https://example.com/b")
+	d, err := NewDispatcher(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.URLs) != 2 || d.Secret != "" || d.QueuePath != filepath.Join("~/mockRepo/.git", QueueFile) || d.Client == nil {
+		t.Errorf("NewDispatcher() = %+v", d)
+	}
+	repo.AddConfigValue(SecretKey, "old")
+	repo.AddConfigValue(SecretKey, "new")
+	if d, err := NewDispatcher(repo); err != nil || d.Secret != "new" {
+		t.Errorf("NewDispatcher() = %+v, %v, want the last secret", d, err)
+	}
+
+	for _, key := range []string{URLKey, SecretKey, ""} {
+		if _, err := NewDispatcher(configRepo{repo, key}); err == nil {
+			t.Errorf("expected an error when %q cannot be read", key)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	if got, want := Sign("secret", []byte("body")), "sha256=dc46983557fea127b43af721467eb9b3fde2338fe3e14f51952aa8478c13d355"; got != want {
+		t.Errorf("Sign() = %q, want %q", got, want)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 9: maxRetryDelay} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// webhookServer records the events posted to it, and responds to each with
+// the next of the given statuses, or with 200 once they run out.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, *[]*http.Request, *[]events.Event) {
+	t.Helper()
+	var requests []*http.Request
+	var posted []events.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event events.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid event %q: %v", body, err)
+		}
+		if got, want := r.Header.Get(SignatureHeader), Sign("secret", body); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		requests = append(requests, r)
+		posted = append(posted, event)
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests, &posted
+}
+
+func testDispatcher(t *testing.T, urls ...string) *Dispatcher {
+	t.Helper()
+	return &Dispatcher{
+		URLs:      urls,
+		Secret:    "secret",
+		QueuePath: filepath.Join(t.TempDir(), QueueFile),
+		Client:    http.DefaultClient,
+	}
+}
+
+var testEvents = []events.Event{
+	{ID: "1", Type: events.ReviewCreated, Review: "A", Revision: "A"},
+	{ID: "2", Type: events.CommentAdded, Review: "A", Revision: "A"},
+}
+
+// makeDue makes every delivery in the dispatcher's queue due to be retried.
+func makeDue(t *testing.T, d *Dispatcher) []delivery {
+	t.Helper()
+	queue, err := d.readQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range queue {
+		queue[i].NextAttempt = time.Now().Add(-time.Second)
+	}
+	if err := d.writeQueue(queue); err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func TestDispatch(t *testing.T) {
+	server, requests, posted := webhookServer(t)
+	d := testDispatcher(t, server.URL+"/a", server.URL+"/b")
+	if err := d.Dispatch(testEvents); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 4 {
+		t.Fatalf("got %d requests, want 4", len(*requests))
+	}
+	for i, r := range *requests {
+		event := testEvents[i/2]
+		if r.URL.Path != []string{"/a", "/b"}[i%2] || r.Header.Get(EventHeader) != event.Type ||
+			r.Header.Get(DeliveryHeader) != event.ID || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request %d = %s %v", i, r.URL, r.Header)
+		}
+		if (*posted)[i].ID != event.ID {
+			t.Errorf("event %d = %+v", i, (*posted)[i])
+		}
+	}
+	if _, err := os.Stat(d.QueuePath); !os.IsNotExist(err) {
+		t.Errorf("the queue was not removed: %v", err)
+	}
+
+	d.Secret = ""
+	d.URLs = []string{"http://[::1"}
+	if err := d.Dispatch(testEvents[:1]); err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Errorf("Dispatch() to an invalid URL error = %v", err)
+	}
+}
+
+func TestDispatchRetry(t *testing.T) {
+	server, requests, _ := webhookServer(t, http.StatusServiceUnavailable)
+	d := testDispatcher(t, server.URL)
+
+	// The first delivery fails, and the second one waits for it.
+	err := d.Dispatch(testEvents)
+	if err == nil || !strings.Contains(err.Error(), "will retry") {
+		t.Errorf("Dispatch() error = %v", err)
+	}
+	queue, err := d.readQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].Attempts != 1 || queue[1].Attempts != 0 || !queue[0].NextAttempt.After(time.Now()) {
+		t.Errorf("queue = %+v", queue)
+	}
+
+	// Neither is retried before it is due.
+	if err := d.Dispatch(nil); err != nil || len(*requests) != 1 {
+		t.Errorf("Dispatch() before the retry = %v, with %d requests", err, len(*requests))
+	}
+
+	makeDue(t, d)
+	if err := d.Dispatch(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(*requests))
+	}
+	if _, err := os.Stat(d.QueuePath); !os.IsNotExist(err) {
+		t.Errorf("the queue was not removed: %v", err)
+	}
+}
+
+func TestDispatchGiveUp(t *testing.T) {
+	server, _, _ := webhookServer(t, http.StatusBadRequest, http.StatusInternalServerError)
+	d := testDispatcher(t, server.URL)
+
+	// Rejected deliveries are not retried.
+	if err := d.Dispatch(testEvents[:1]); err == nil || !strings.Contains(err.Error(), "gave up") || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Dispatch() error = %v", err)
+	}
+
+	// Nor are those that have failed too many times.
+	if err := d.writeQueue([]delivery{{URL: server.URL, Event: testEvents[0], Attempts: maxAttempts - 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Dispatch(nil); err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Errorf("Dispatch() error = %v", err)
+	}
+	if queue, _ := d.readQueue(); len(queue) != 0 {
+		t.Errorf("queue = %+v", queue)
+	}
+
+	// Unreachable webhooks are retried.
+	server.Close()
+	if err := d.Dispatch(testEvents[:1]); err == nil || !strings.Contains(err.Error(), "will retry") {
+		t.Errorf("Dispatch() error = %v", err)
+	}
+}
+
+func TestDispatchQueueErrors(t *testing.T) {
+	d := testDispatcher(t, "http://example.com")
+	os.WriteFile(d.QueuePath, []byte("not json"), 0600)
+	if err := d.Dispatch(nil); err == nil || !strings.Contains(err.Error(), "webhook queue") {
+		t.Errorf("Dispatch() with a corrupt queue error = %v", err)
+	}
+
+	os.Remove(d.QueuePath)
+	os.Mkdir(d.QueuePath, 0700)
+	if err := d.Dispatch(nil); err == nil {
+		t.Error("expected an error for an unreadable queue")
+	}
+	os.WriteFile(filepath.Join(d.QueuePath, "file"), nil, 0600)
+	if err := d.writeQueue(nil); err == nil {
+		t.Error("expected an error removing the queue")
+	}
+	if err := d.writeQueue([]delivery{{URL: "http://example.com"}}); err == nil {
+		t.Error("expected an error replacing the queue")
+	}
+
+	// Failing to write the queue is reported.
+	d.QueuePath = filepath.Join(d.QueuePath, "missing", QueueFile)
+	if err := d.Dispatch(nil); err != nil {
+		t.Errorf("Dispatch() with nothing to queue error = %v", err)
+	}
+	server, _, _ := webhookServer(t, http.StatusInternalServerError)
+	d.URLs = []string{server.URL}
+	if err := d.Dispatch(testEvents[:1]); err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Dispatch() error = %v", err)
+	}
+}
+
+func TestDispatchKeepsConcurrentDeliveries(t *testing.T) {
+	var d *Dispatcher
+	other := delivery{URL: "http://example.com", Event: testEvents[1], NextAttempt: time.Now().Add(time.Hour)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Another process queues a delivery while this one is attempted.
+		queue, err := d.readQueue()
+		if err != nil {
+			t.Error(err)
+		}
+		if err := d.writeQueue(append(queue, other)); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	d = testDispatcher(t, server.URL)
+
+	if err := d.Dispatch(testEvents[:1]); err == nil || !strings.Contains(err.Error(), "will retry") {
+		t.Errorf("Dispatch() error = %v", err)
+	}
+	queue, err := d.readQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].Event.ID != testEvents[0].ID || queue[0].Attempts != 1 || queue[1].Event.ID != other.Event.ID {
+		t.Errorf("queue = %+v", queue)
+	}
+
+	// The queue is rewritten through a temporary file, and its lock is
+	// released.
+	entries, err := os.ReadDir(filepath.Dir(d.QueuePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != QueueFile {
+		t.Errorf("files next to the queue = %v", entries)
+	}
+}